@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
+)
+
+// minGoVersion is the oldest Go toolchain that builds generated code, the
+// go directive of procyon's go.mod
+const minGoVersion = "1.24"
+
+// generatedRequires are the modules generated binaries and plugins import,
+// at the versions in procyon's go.mod; keep them in step
+var generatedRequires = []string{
+	"github.com/google/uuid v1.6.0",
+	"github.com/mattn/go-sqlite3 v1.14.33",
+	"golang.org/x/sys v0.40.0",
+}
+
+// emitArtifact builds code, generated for class in --mode, with go build in
+// --out-dir or a temporary module, and installs the binary or plugin in the
+// compiled directory. The --emit-tests harness, if any, is written next to
+// main.go as main_test.go, unless --emit-tests already wrote it there. It
+// returns the path of the installed artifact.
+func emitArtifact(class *ast.Class, code, tests string) (string, error) {
+	dir := *outDir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "procyon-build-")
+		if err != nil {
+			return "", fmt.Errorf("creating build directory: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+
+	files := map[string]string{"main.go": code}
+	if tests != "" && !sameDir(filepath.Dir(*emitTests), dir) {
+		files["main_test.go"] = tests
+	}
+	if *mode == "binary" {
+		// The binary embeds its source for --source and --hash
+		embed := class.CompiledName() + ".trash"
+		if *sourceFile != "" {
+			src, err := os.ReadFile(*sourceFile)
+			if err != nil {
+				return "", cli.Errorf(cli.ExitUsage, "reading --source-file: %v", err)
+			}
+			files[embed] = string(src)
+		} else if _, err := os.Stat(filepath.Join(dir, embed)); err != nil {
+			cli.Logf("Warning: no --source-file, %s embeds an empty source", class.CompiledName())
+			files[embed] = ""
+		}
+	}
+	if err := writeModule(dir, class.CompiledName(), files); err != nil {
+		return "", err
+	}
+
+	name := class.CompiledName() + ".native"
+	args := []string{"build", "-mod=mod"}
+	if *mode == "plugin" {
+		name = class.CompiledName() + pluginExt()
+		args = append(args, "-buildmode=c-shared")
+	}
+	built := filepath.Join(dir, name)
+	if _, err := goCommand(dir, append(args, "-o", built, ".")...); err != nil {
+		return "", err
+	}
+
+	dest := *pluginDir
+	if dest == "" {
+		home, _ := os.UserHomeDir()
+		dest = filepath.Join(home, ".trashtalk", "trash", ".compiled")
+	}
+	return installArtifact(built, dest)
+}
+
+// sameDir reports whether a and b name the same directory
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// writeModule writes files into the module in dir, creating dir and its
+// go.mod, named module, if need be. An existing go.mod gains the
+// generatedRequires it lacks; the versions it has are kept.
+func writeModule(dir, module string, files map[string]string) error {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+
+	goMod := filepath.Join(dir, "go.mod")
+	if _, err := os.Stat(goMod); errors.Is(err, os.ErrNotExist) {
+		content := "module " + module + "\n\ngo " + minGoVersion + "\n\nrequire (\n\t" +
+			strings.Join(generatedRequires, "\n\t") + "\n)\n"
+		return os.WriteFile(goMod, []byte(content), 0o644)
+	}
+
+	out, err := goCommand(dir, "mod", "edit", "-json")
+	if err != nil {
+		return err
+	}
+	var mod struct {
+		Require []struct{ Path string }
+	}
+	if err := json.Unmarshal([]byte(out), &mod); err != nil {
+		return fmt.Errorf("reading %s: %w", goMod, err)
+	}
+	have := make(map[string]bool)
+	for _, r := range mod.Require {
+		have[r.Path] = true
+	}
+	edit := []string{"mod", "edit"}
+	for _, req := range generatedRequires {
+		path, version, _ := strings.Cut(req, " ")
+		if !have[path] {
+			edit = append(edit, "-require="+path+"@"+version)
+		}
+	}
+	if len(edit) == 2 {
+		return nil
+	}
+	_, err = goCommand(dir, edit...)
+	return err
+}
+
+// installArtifact copies the built file into dir under its own name. It is
+// written next to its final name first, so a daemon or Bash runtime never
+// loads a half-written binary or plugin.
+func installArtifact(built, dir string) (string, error) {
+	data, err := os.ReadFile(built)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("creating compiled directory: %w", err)
+	}
+	dest := filepath.Join(dir, filepath.Base(built))
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(built)+".")
+	if err != nil {
+		return "", fmt.Errorf("installing %s: %w", dest, err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o755)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("installing %s: %w", dest, err)
+	}
+	return dest, nil
+}
+
+// pluginExt returns the shared library extension trashtalk-daemon loads
+// plugins with on this platform
+func pluginExt() string {
+	if runtime.GOOS == "darwin" {
+		return ".dylib"
+	}
+	return ".so"
+}
+
+// goCommand runs the go command with args in dir, with workspaces off so a
+// go.work above dir cannot get in the way
+func goCommand(dir string, args ...string) (string, error) {
+	if _, err := exec.LookPath("go"); err != nil {
+		return "", errors.New("go not found on $PATH")
+	}
+	return runIn(dir, []string{"GOWORK=off"}, "go", args...)
+}
+
+// runIn runs name with args in dir, with env added to the environment, and
+// returns its trimmed stdout. The error includes the command's stderr.
+func runIn(dir string, env []string, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s %s: %v: %s", filepath.Base(name), strings.Join(args, " "), err, lastLines(msg, 5))
+		}
+		return "", fmt.Errorf("%s %s: %v", filepath.Base(name), strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// lastLines returns the last n lines of s, joined by " / "
+func lastLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, " / ")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmitTestsIntoFreshOutDir(t *testing.T) {
+	bin := buildProcyon(t)
+	input, err := os.ReadFile("../../testdata/counter/input.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither --out-dir nor the directory of the test file exist yet
+	tmp := t.TempDir()
+	outDir := filepath.Join(tmp, "build", "counter")
+	tests := filepath.Join(outDir, "counter_test.go")
+	cmd := exec.Command(bin, "--emit=binary", "--out-dir", outDir, "--emit-tests", tests, "--plugin-dir", filepath.Join(tmp, "bin"))
+	cmd.Stdin = bytes.NewReader(input)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("procyon: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(tests); err != nil {
+		t.Errorf("--emit-tests file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "bin", "Counter.native")); err != nil {
+		t.Errorf("installed binary: %v", err)
+	}
+
+	// The harness is in the module once, so it vets and runs
+	vet := exec.Command("go", "vet", ".")
+	vet.Dir = outDir
+	if out, err := vet.CombinedOutput(); err != nil {
+		t.Errorf("go vet in --out-dir: %v\n%s", err, out)
+	}
+}
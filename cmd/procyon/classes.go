@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compiledExts are the extensions of compiled classes in a plugin directory:
+// plugins for trashtalk-daemon and standalone binaries
+var compiledExts = []string{".so", ".dylib", ".native"}
+
+// pluginClasses lists the compiled class names (MyApp__Counter) in dir,
+// plus the classes of its manifest.json (as read by trashtalk-daemon)
+func pluginClasses(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		for _, ext := range compiledExts {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ext) {
+				names = append(names, strings.TrimSuffix(e.Name(), ext))
+			}
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return names, nil
+	}
+	var manifest struct {
+		Classes []struct {
+			Name    string `json:"name"`
+			Package string `json:"package"`
+		} `json:"classes"`
+	}
+	if json.Unmarshal(data, &manifest) == nil {
+		for _, c := range manifest.Classes {
+			if c.Package != "" {
+				names = append(names, c.Package+"::"+c.Name)
+			} else if c.Name != "" {
+				names = append(names, c.Name)
+			}
+		}
+	}
+	return names, nil
+}
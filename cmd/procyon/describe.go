@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/chazu/procyon/pkg/ast"
+)
+
+// classDescription is the JSON shape printed by --describe.
+// It is meant for tooling (editors, inspectors) rather than compilation.
+type classDescription struct {
+	Name          string              `json:"name"`
+	QualifiedName string              `json:"qualifiedName"`
+	Package       string              `json:"package,omitempty"`
+	Parent        string              `json:"parent,omitempty"`
+	ClassVersion  int                 `json:"classVersion,omitempty"`
+	Fields        []fieldDescription  `json:"fields"`
+	Methods       []methodDescription `json:"methods"`
+}
+
+// fieldDescription describes one instance variable.
+type fieldDescription struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // "string" or "json"
+	Default string `json:"default,omitempty"`
+	Ref     bool   `json:"ref,omitempty"` // Holds another instance's ID
+}
+
+// methodDescription describes one method selector.
+type methodDescription struct {
+	Selector string `json:"selector"`
+	Kind     string `json:"kind"`
+}
+
+// describeClass builds the --describe output for a class.
+func describeClass(class *ast.Class) ([]byte, error) {
+	desc := classDescription{
+		Name:          class.Name,
+		QualifiedName: class.QualifiedName(),
+		Package:       class.Package,
+		Parent:        class.Parent,
+		ClassVersion:  class.ClassVersion,
+		Fields:        []fieldDescription{},
+		Methods:       []methodDescription{},
+	}
+
+	for _, iv := range class.InstanceVars {
+		fieldType := "string"
+		if v := iv.Default.Value; len(v) > 0 && (v[0] == '{' || v[0] == '[') {
+			fieldType = "json"
+		}
+		desc.Fields = append(desc.Fields, fieldDescription{
+			Name:    iv.Name,
+			Type:    fieldType,
+			Default: iv.Default.Value,
+			Ref:     iv.Ref,
+		})
+	}
+
+	for _, m := range class.Methods {
+		desc.Methods = append(desc.Methods, methodDescription{
+			Selector: m.Selector,
+			Kind:     m.Kind,
+		})
+	}
+
+	return json.MarshalIndent(desc, "", "  ")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/diag"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// stdinName is the file diagnostics about the AST read from stdin name
+const stdinName = "<stdin>"
+
+// parseFailure returns the error for input, the AST JSON on stdin, failing
+// to parse with err. Under --diagnostics the error is written as a
+// diagnostic located in input.
+func parseFailure(input []byte, err error) error {
+	if *diagnostics == "" {
+		return cli.Errorf(cli.ExitParse, "parsing AST: %v", err)
+	}
+	d := diag.FromJSON(stdinName, input, err)
+	d.Message = "parsing AST: " + d.Message
+	if err := writeDiagnostics([]diag.Diagnostic{d}, map[string][]byte{stdinName: input}); err != nil {
+		return err
+	}
+	return cli.Exit(cli.ExitParse, nil)
+}
+
+// reportDiagnostics writes a diagnostic for each compile error and skipped
+// method of result, located in file. The excerpts come from --source-file,
+// which file names if given. Skipped methods are errors under --strict and
+// warnings otherwise.
+func reportDiagnostics(file string, result *codegen.Result) error {
+	sources := map[string][]byte{}
+	if *sourceFile != "" {
+		src, err := os.ReadFile(*sourceFile)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "reading --source-file: %v", err)
+		}
+		file = *sourceFile
+		sources[file] = src
+	}
+	severity := diag.Warning
+	if *strict {
+		severity = diag.Error
+	}
+
+	diags := make([]diag.Diagnostic, 0, len(result.Errors)+len(result.SkippedMethods))
+	for _, e := range result.Errors {
+		line, col := e.Location.Line, 0
+		if line > 0 {
+			col = e.Location.Col + 1
+		}
+		diags = append(diags, diag.Diagnostic{
+			Severity: diag.Error,
+			Message:  e.Message,
+			File:     file,
+			Line:     line,
+			Col:      col,
+		})
+	}
+	if *diagnostics == "json" || !cli.Quiet() || *strict {
+		for _, s := range result.SkippedMethods {
+			line, col := locationOf(s)
+			diags = append(diags, diag.Diagnostic{
+				Severity: severity,
+				Message:  "skipped: " + s.Reason,
+				File:     file,
+				Line:     line,
+				Col:      col,
+				Selector: mangle.TrashSelector(s.Selector),
+			})
+		}
+	}
+	if *diagnostics == "pretty" && len(diags) == 0 {
+		return nil
+	}
+	return writeDiagnostics(diags, sources)
+}
+
+// compileErrors returns the error compile fails with when result has compile
+// errors. Without --diagnostics each one is written to stderr, located in
+// file if given.
+func compileErrors(file string, result *codegen.Result) error {
+	if len(result.Errors) == 0 {
+		return nil
+	}
+	if *diagnostics == "" {
+		for _, e := range result.Errors {
+			if file == "" {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", e)
+			} else if e.Location.Line > 0 {
+				fmt.Fprintf(os.Stderr, "Error: %s:%d: %s\n", file, e.Location.Line, e.Message)
+			} else {
+				fmt.Fprintf(os.Stderr, "Error: %s: %s\n", file, e.Message)
+			}
+		}
+	}
+	return cli.Errorf(cli.ExitCodegen, "%d compile errors, refusing to generate", len(result.Errors))
+}
+
+// locationOf returns the 1-based line and column a skipped method's reason
+// applies to. AST columns count from 0.
+func locationOf(s codegen.SkippedMethod) (line, col int) {
+	loc := s.Location
+	if loc == (ast.Location{}) {
+		return s.Line, 0
+	}
+	return loc.Line, loc.Col + 1
+}
+
+// writeDiagnostics writes diags to stderr in the --diagnostics format
+func writeDiagnostics(diags []diag.Diagnostic, sources map[string][]byte) error {
+	if err := diag.Write(os.Stderr, *diagnostics, diags, sources); err != nil {
+		return cli.Errorf(cli.ExitUsage, "writing diagnostics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/client"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+// doctorClass is the class doctor compiles, builds and runs
+const doctorClass = `DoctorCheck subclass: Object
+  instanceVars: count:0
+
+  method: increment [
+    count := count + 1.
+    ^ count
+  ]
+`
+
+// dbProbe is the program doctor builds next to the class to read the
+// columns of the instances table of the database named by its argument,
+// opened read-only. With -create it opens the database for writing and
+// creates the table first.
+const dbProbe = `package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	dsn := "file:" + os.Args[1] + "?mode=ro"
+	create := len(os.Args) > 2 && os.Args[2] == "-create"
+	if create {
+		dsn = os.Args[1]
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err == nil && create {
+		_, err = db.Exec("CREATE TABLE IF NOT EXISTS instances (id TEXT PRIMARY KEY, data JSON NOT NULL)")
+	}
+	var columns []string
+	if err == nil {
+		var rows *sql.Rows
+		if rows, err = db.Query("SELECT name FROM pragma_table_info('instances')"); err == nil {
+			for rows.Next() {
+				var name string
+				rows.Scan(&name)
+				columns = append(columns, name)
+			}
+			err = rows.Err()
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(strings.Join(columns, " "))
+}
+`
+
+// doctorFlags holds the flags of the doctor command
+type doctorFlags struct {
+	dbPath    *string
+	pluginDir *string
+	socket    *string
+	token     *string
+	keep      *bool
+}
+
+var doctor doctorFlags
+
+// doctorCommand checks that the toolchain generated code needs works, end
+// to end, and says how to fix what does not.
+func doctorCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Short: "Check the Go toolchain, plugin directory, instances database and daemon",
+		Long: "Checks the Go version, that cgo and SQLite work, the plugin directory, the\n" +
+			"schema of the instances database and, with --socket, that the daemon answers.\n" +
+			"Then compiles, builds and runs a small class in a temporary module. Each\n" +
+			"failure comes with what to do about it; the exit status is 1 if any check fails.",
+		Examples: []string{
+			"procyon doctor",
+			"procyon doctor --socket /tmp/trashtalk.sock",
+			"procyon doctor --db ./instances.db --plugin-dir ./build --json",
+		},
+		Flags: func(fs *flag.FlagSet) {
+			doctor.dbPath = fs.String("db", "", "instances database to check (default $SQLITE_JSON_DB or ~/.trashtalk/instances.db)")
+			doctor.pluginDir = fs.String("plugin-dir", "", "plugin directory to check (default ~/.trashtalk/trash/.compiled)")
+			doctor.socket = fs.String("socket", "", "Unix socket of a trashtalk-daemon to check")
+			doctor.token = fs.String("token", "", "token to send the daemon, if it checks them")
+			doctor.keep = fs.Bool("keep", false, "keep the temporary module the test class is built in, and print its path")
+		},
+		Run: func([]string) error {
+			return runDoctor()
+		},
+	}
+}
+
+// checkStatus is the outcome of one doctor check
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "ok"
+	checkWarn checkStatus = "warn"
+	checkFail checkStatus = "fail"
+	checkSkip checkStatus = "skip"
+)
+
+// check is the result of one doctor check, as printed and as --json writes it
+type check struct {
+	Name   string      `json:"name"`
+	Status checkStatus `json:"status"`
+	Detail string      `json:"detail"`
+	Fix    string      `json:"fix,omitempty"`
+}
+
+// runDoctor runs every check in order. A check that needs an earlier one
+// to pass, such as running the build of a toolchain that is missing, is
+// skipped.
+func runDoctor() error {
+	home, _ := os.UserHomeDir()
+	dbPath := *doctor.dbPath
+	if dbPath == "" {
+		dbPath = os.Getenv("SQLITE_JSON_DB")
+	}
+	if dbPath == "" {
+		dbPath = filepath.Join(home, ".trashtalk", "instances.db")
+	}
+	pluginPath := *doctor.pluginDir
+	if pluginPath == "" {
+		pluginPath = filepath.Join(home, ".trashtalk", "trash", ".compiled")
+	}
+
+	var checks []check
+	goCheck := checkGo()
+	cgoCheck := checkCgo(goCheck)
+	checks = append(checks, goCheck, cgoCheck, checkPluginDir(pluginPath), checkDaemon(*doctor.socket))
+
+	dir, err := os.MkdirTemp("", "procyon-doctor-")
+	if err != nil {
+		return fmt.Errorf("creating build directory: %w", err)
+	}
+	if *doctor.keep {
+		cli.Logf("procyon doctor: building in %s", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	build := checkBuild(dir, cgoCheck)
+	checks = append(checks, build, checkSchema(dir, dbPath, build), checkRoundTrip(dir, build))
+
+	failed := 0
+	for _, c := range checks {
+		if c.Status == checkFail {
+			failed++
+		}
+	}
+	if cli.JSON() {
+		if err := cli.PrintJSON(checks); err != nil {
+			return err
+		}
+	} else {
+		printChecks(checks)
+	}
+	if failed > 0 {
+		if cli.JSON() {
+			return cli.Exit(cli.ExitUsage, nil)
+		}
+		return cli.Errorf(cli.ExitUsage, "%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// printChecks writes one line per check, and the fix of each one that did
+// not pass. --quiet leaves out the checks that passed or were skipped.
+func printChecks(checks []check) {
+	marks := map[checkStatus]string{checkOK: "✓", checkWarn: "⚠", checkFail: "✗", checkSkip: "-"}
+	for _, c := range checks {
+		if cli.Quiet() && (c.Status == checkOK || c.Status == checkSkip) {
+			continue
+		}
+		fmt.Printf("  %s %s: %s\n", marks[c.Status], c.Name, c.Detail)
+		if c.Fix != "" {
+			fmt.Printf("      fix: %s\n", c.Fix)
+		}
+	}
+}
+
+// checkGo checks that go is on $PATH and at least minGoVersion
+func checkGo() check {
+	c := check{Name: "go"}
+	out, err := goCommand("", "version")
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Fix = "install Go " + minGoVersion + " or newer from https://go.dev/dl/ and put it on $PATH"
+		return c
+	}
+	c.Detail = strings.TrimPrefix(out, "go version ")
+	fields := strings.Fields(c.Detail)
+	if len(fields) == 0 || !goVersionAtLeast(strings.TrimPrefix(fields[0], "go"), minGoVersion) {
+		c.Status = checkFail
+		c.Fix = "generated code needs Go " + minGoVersion + " or newer; upgrade from https://go.dev/dl/"
+		return c
+	}
+	c.Status = checkOK
+	return c
+}
+
+// goVersionAtLeast reports whether Go version v (1.24.5, 1.25rc1) is at
+// least min (1.24), comparing the major and minor numbers
+func goVersionAtLeast(v, min string) bool {
+	parse := func(s string) (int, int) {
+		parts := strings.SplitN(s, ".", 3)
+		major, _ := strconv.Atoi(parts[0])
+		minor := 0
+		if len(parts) > 1 {
+			digits := strings.IndexFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+			if digits >= 0 {
+				parts[1] = parts[1][:digits]
+			}
+			minor, _ = strconv.Atoi(parts[1])
+		}
+		return major, minor
+	}
+	vMajor, vMinor := parse(v)
+	minMajor, minMinor := parse(min)
+	return vMajor > minMajor || vMajor == minMajor && vMinor >= minMinor
+}
+
+// checkCgo checks that cgo is enabled and its C compiler found: the SQLite
+// driver of generated binaries and plugins is a cgo package
+func checkCgo(goCheck check) check {
+	c := check{Name: "cgo"}
+	if goCheck.Status != checkOK {
+		c.Status, c.Detail = checkSkip, "needs go"
+		return c
+	}
+	out, err := goCommand("", "env", "CGO_ENABLED", "CC")
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) < 2 || lines[0] != "1" {
+		c.Status, c.Detail = checkFail, "CGO_ENABLED=0"
+		c.Fix = "set CGO_ENABLED=1 (go env -w CGO_ENABLED=1); binary and plugin modes need cgo for SQLite, only --mode=wasm builds without it"
+		return c
+	}
+	cc := strings.Fields(lines[1])
+	if len(cc) == 0 {
+		cc = []string{"cc"}
+	}
+	path, err := exec.LookPath(cc[0])
+	if err != nil {
+		c.Status, c.Detail = checkFail, fmt.Sprintf("C compiler %q not found", cc[0])
+		c.Fix = "install a C compiler (gcc or clang, e.g. build-essential or Xcode command line tools), or point CC at one"
+		return c
+	}
+	c.Status, c.Detail = checkOK, "CGO_ENABLED=1, CC="+path
+	return c
+}
+
+// checkPluginDir checks that the plugin directory exists and is writable,
+// and counts the plugins in it
+func checkPluginDir(dir string) check {
+	c := check{Name: "plugin dir"}
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.Status, c.Detail = checkWarn, dir+" does not exist"
+		c.Fix = "mkdir -p " + dir + ", or pass the directory your build writes plugins to with --plugin-dir"
+		return c
+	case err != nil:
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	case !info.IsDir():
+		c.Status, c.Detail = checkFail, dir+" is not a directory"
+		c.Fix = "move the file away, or pass the plugin directory with --plugin-dir"
+		return c
+	}
+	probe, err := os.CreateTemp(dir, ".procyon-doctor-")
+	if err != nil {
+		c.Status, c.Detail = checkFail, dir+" is not writable: "+err.Error()
+		c.Fix = "chmod u+w " + dir + ", or run as the user that builds plugins"
+		return c
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+
+	plugins := 0
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if ext := filepath.Ext(e.Name()); ext == ".so" || ext == ".dylib" {
+			plugins++
+		}
+	}
+	c.Status, c.Detail = checkOK, fmt.Sprintf("%s, writable, %d plugins", dir, plugins)
+	return c
+}
+
+// checkDaemon checks that the daemon on socket answers an admin request
+func checkDaemon(socket string) check {
+	c := check{Name: "daemon"}
+	if socket == "" {
+		c.Status, c.Detail = checkSkip, "no --socket given"
+		return c
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.DialOptions(ctx, socket, client.Options{Reconnects: -1})
+	if err == nil {
+		var resp client.Response
+		resp, err = conn.SendContext(ctx, client.Request{Class: client.AdminClass, Selector: "children", Token: *doctor.token})
+		if err == nil && resp.ExitCode == client.ExitUnauthorized {
+			c.Status, c.Detail = checkFail, socket+" refused the request: "+resp.Error
+			c.Fix = "pass a token the daemon accepts with --token"
+			return c
+		}
+		if err == nil && resp.ExitCode != client.ExitOK {
+			err = fmt.Errorf("exit code %d: %s", resp.ExitCode, resp.Error)
+		}
+	}
+	if err != nil {
+		c.Status, c.Detail = checkFail, socket+": "+err.Error()
+		c.Fix = "start it with trashtalk-daemon --socket " + socket + ", or check the path"
+		return c
+	}
+	c.Status, c.Detail = checkOK, socket+" answers"
+	return c
+}
+
+// checkBuild compiles doctorClass and builds it, with dbProbe, in a
+// temporary module in dir. It needs the modules of generatedRequires in
+// the module cache or from the proxy.
+func checkBuild(dir string, cgoCheck check) check {
+	c := check{Name: "build"}
+	if cgoCheck.Status != checkOK {
+		c.Status, c.Detail = checkSkip, "needs cgo"
+		return c
+	}
+	class, err := source.Parse(doctorClass)
+	if err != nil {
+		c.Status, c.Detail = checkFail, "parsing the test class: "+err.Error()
+		return c
+	}
+	result := codegen.Generate(class)
+	if len(result.SkippedMethods) > 0 || len(result.Errors) > 0 {
+		c.Status, c.Detail = checkFail, fmt.Sprintf("the test class compiled with %d skipped methods and %d errors", len(result.SkippedMethods), len(result.Errors))
+		c.Fix = "this is a procyon bug; please report it with the output of procyon --version"
+		return c
+	}
+
+	files := map[string]string{
+		filepath.Join("class", "main.go"):           result.Code,
+		filepath.Join("class", class.Name+".trash"): doctorClass,
+		filepath.Join("dbprobe", "main.go"):         dbProbe,
+	}
+	if err := writeModule(dir, "procyon-doctor", files); err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		return c
+	}
+
+	start := time.Now()
+	if _, err := goCommand(dir, "build", "-mod=mod", "-o", filepath.Join(dir, "bin")+string(filepath.Separator), "./..."); err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Fix = "without network access, fetch " + strings.Join(generatedRequires, ", ") + " into the module cache first (go mod download)"
+		return c
+	}
+	c.Status, c.Detail = checkOK, fmt.Sprintf("compiled and built a test class and SQLite probe in %s", time.Since(start).Round(100*time.Millisecond))
+	return c
+}
+
+// checkSchema checks, with the probe checkBuild built, that the instances
+// database has the instances table generated binaries store instances in
+func checkSchema(dir, dbPath string, build check) check {
+	c := check{Name: "instances.db"}
+	if build.Status != checkOK {
+		c.Status, c.Detail = checkSkip, "needs build"
+		return c
+	}
+	createFix := "run a Trashtalk class once to create it, or create it with: sqlite3 " + dbPath +
+		" 'CREATE TABLE instances (id TEXT PRIMARY KEY, data JSON NOT NULL)'"
+	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+		c.Status, c.Detail = checkWarn, dbPath+" does not exist"
+		c.Fix = createFix
+		return c
+	}
+	out, err := runIn(dir, nil, filepath.Join(dir, "bin", "dbprobe"), dbPath)
+	if err != nil {
+		c.Status, c.Detail = checkFail, dbPath+": "+err.Error()
+		c.Fix = "check that the file is a SQLite database and readable, or point $SQLITE_JSON_DB elsewhere"
+		return c
+	}
+	columns := strings.Fields(out)
+	has := func(name string) bool {
+		for _, col := range columns {
+			if col == name {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case len(columns) == 0:
+		c.Status, c.Detail = checkFail, dbPath+" has no instances table"
+		c.Fix = createFix
+	case !has("id") || !has("data"):
+		c.Status, c.Detail = checkFail, fmt.Sprintf("%s: the instances table has columns %s, not id and data", dbPath, strings.Join(columns, ", "))
+		c.Fix = "this database was not created by Trashtalk; point $SQLITE_JSON_DB at the Trashtalk instances database"
+	default:
+		c.Status, c.Detail = checkOK, dbPath+": instances("+strings.Join(columns, ", ")+")"
+	}
+	return c
+}
+
+// checkRoundTrip runs the test class checkBuild built against a scratch
+// database: it creates an instance, sends it increment twice, and expects 2
+func checkRoundTrip(dir string, build check) check {
+	c := check{Name: "round trip"}
+	if build.Status != checkOK {
+		c.Status, c.Detail = checkSkip, "needs build"
+		return c
+	}
+	db := filepath.Join(dir, "instances.db")
+	if _, err := runIn(dir, nil, filepath.Join(dir, "bin", "dbprobe"), db, "-create"); err != nil {
+		c.Status, c.Detail = checkFail, "creating a scratch database: "+err.Error()
+		return c
+	}
+	env := []string{"SQLITE_JSON_DB=" + db}
+	bin := filepath.Join(dir, "bin", "class")
+	id, err := runIn(dir, env, bin, "DoctorCheck", "new")
+	var got string
+	if err == nil {
+		_, err = runIn(dir, env, bin, id, "increment")
+	}
+	if err == nil {
+		got, err = runIn(dir, env, bin, id, "increment")
+	}
+	if err != nil || got != "2" {
+		if err == nil {
+			err = fmt.Errorf("increment answered %q, want 2", got)
+		}
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Fix = "run procyon doctor --keep and run the binary in bin/ by hand to see what goes wrong"
+		return c
+	}
+	c.Status, c.Detail = checkOK, "created "+id+" and sent it increment twice"
+	return c
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/chazu/procyon/pkg/analysis"
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/diag"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+// runLint runs the checks of pkg/analysis on input, a class, a compilation
+// unit, or an array of them as bundle mode reads, and writes the findings to
+// stdout as diagnostics in the --diagnostics format, pretty by default. It
+// exits ExitCodegen if there are any.
+func runLint(input []byte) error {
+	var units []*ast.CompilationUnit
+	var err error
+	if trimmed := bytes.TrimSpace(input); len(trimmed) > 0 && trimmed[0] == '[' {
+		units, err = ast.ParseCompilationUnits(input)
+	} else {
+		var unit *ast.CompilationUnit
+		if unit, err = ast.ParseCompilationUnit(input); err == nil {
+			units = []*ast.CompilationUnit{unit}
+		}
+	}
+	if err != nil {
+		return parseFailure(input, err)
+	}
+	if *traitPath != "" {
+		for _, unit := range units {
+			if _, err := source.LoadTraits(unit, filepath.SplitList(*traitPath)); err != nil {
+				return cli.Errorf(cli.ExitParse, "%s: loading traits: %v", unit.Class.Name, err)
+			}
+		}
+	}
+
+	// --source-file is the source of the only class, for the excerpts
+	sources := map[string][]byte{}
+	var file string
+	if *sourceFile != "" {
+		if len(units) != 1 {
+			return cli.Errorf(cli.ExitUsage, "--source-file needs a single class to lint")
+		}
+		src, err := os.ReadFile(*sourceFile)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "reading --source-file: %v", err)
+		}
+		file = units[0].Class.CompiledName() + ".trash"
+		sources[*sourceFile] = src
+	}
+
+	findings := analysis.Analyze(units)
+	diags := make([]diag.Diagnostic, 0, len(findings))
+	for _, f := range findings {
+		d := diag.Diagnostic{
+			Severity: diag.Warning,
+			Message:  f.Message + " [" + string(f.Check) + "]",
+			File:     f.File,
+			Line:     f.Location.Line,
+			Selector: f.Selector,
+		}
+		if d.Line > 0 {
+			d.Col = f.Location.Col + 1
+		}
+		if f.File == file {
+			d.File = *sourceFile
+		}
+		diags = append(diags, d)
+	}
+
+	format := "pretty"
+	if *diagnostics != "" {
+		format = *diagnostics
+	}
+	if cli.JSON() {
+		format = "json"
+	}
+	if err := diag.Write(os.Stdout, format, diags, sources); err != nil {
+		return cli.Errorf(cli.ExitUsage, "writing findings: %v", err)
+	}
+	if len(diags) > 0 {
+		if format == "pretty" {
+			cli.Logf("procyon: %d lint findings in %d classes", len(diags), len(units))
+		}
+		return cli.Exit(cli.ExitCodegen, nil)
+	}
+	return nil
+}
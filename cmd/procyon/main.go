@@ -3,121 +3,364 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
 	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/diag"
 	"github.com/chazu/procyon/pkg/ir"
+	"github.com/chazu/procyon/pkg/protocol"
+	"github.com/chazu/procyon/pkg/source"
 )
 
 var (
-	strict     = flag.Bool("strict", false, "fail on unsupported constructs instead of warning")
-	dryRun     = flag.Bool("dry-run", false, "show what would be generated without outputting")
-	version    = flag.Bool("version", false, "print version and exit")
-	mode       = flag.String("mode", "binary", "output mode: bash (Bash script), binary (Go standalone), or plugin (Go c-shared library)")
-	sourceFile = flag.String("source-file", "", "path to original source file for embedding (bash mode only)")
+	strict      *bool
+	dryRun      *bool
+	diffFile    *string
+	version     *bool
+	mode        *string
+	sourceFile  *string
+	describe    *bool
+	report      *string
+	diagnostics *string
+	reportFile  *string
+	storage     *string
+	history     *bool
+	fallbacks   *bool
+	maxWarnings *int
+	schema      *string
+	traitPath   *string
+	only        *string
+	skip        *string
+	pluginDir   *string
+	accessors   *bool
+	implicit    *bool
+	migrate     *bool
+	comments    *bool
+	emit        *string
+	outDir      *string
+	emitTests   *string
+	sourceMap   *string
+	lint        *bool
+	dialect     *string
+	posixLocal  *bool
 )
 
 const versionStr = "0.7.0"
 
+// registerFlags defines the compiler flags on fs.
+func registerFlags(fs *flag.FlagSet) {
+	strict = fs.Bool("strict", false, "fail on unsupported constructs instead of warning")
+	dryRun = fs.Bool("dry-run", false, "show what would be generated without outputting")
+	diffFile = fs.String("diff", "", "print a unified diff from this file to the generated code instead of the code, and exit 4 if they differ")
+	version = fs.Bool("version", false, "print version and exit")
+	mode = fs.String("mode", "binary", "output mode: bash (Bash script), python (Python 3 module, standard library only), binary (Go standalone), plugin (Go c-shared library), wasm (Go for GOOS=wasip1, no cgo), or bundle (one Go binary for a JSON array of classes)")
+	sourceFile = fs.String("source-file", "", "path to original source file for embedding (bash and python modes), or whose hash the --comments header and a plugin's GetClassInfo name")
+	describe = fs.Bool("describe", false, "print a JSON description of the class (fields, references, methods) and exit")
+	lint = fs.Bool("lint", false, "report selectors never sent, instance variables never read, unmet trait requirements and methods shadowing a superclass's with another arity, for a class or a JSON array of them, and exit 3 if there are any")
+	report = fs.String("report", "text", "skipped-method report format: text or json")
+	diagnostics = fs.String("diagnostics", "", "report AST parse errors and skipped methods with their source positions: pretty (with the source line and a caret under the token; --source-file gives the source of methods) or json")
+	reportFile = fs.String("report-file", "", "write the report to this file instead of stderr (json report only)")
+	maxWarnings = fs.Int("max-warnings", 0, "show at most N distinct warnings, then a summary line (0 = no limit)")
+	storage = fs.String("storage", "", "comma-separated storage backends to compile in, default first: sqlite, file, memory, redis (binary mode only)")
+	schema = fs.String("schema", "", "print the JSON Schema of a protocol message and exit: request, response (trashtalk-daemon), serve-request, serve-response (--serve)")
+	traitPath = fs.String("trait-path", "", "directories to search for included traits not in the input (Name.trash or Name.json), separated like $PATH")
+	only = fs.String("only", "", "comma-separated selectors to compile; every other method falls back to Bash (binary, plugin and wasm modes)")
+	skip = fs.String("skip", "", "comma-separated selectors to leave to Bash even if they compile (binary, plugin and wasm modes)")
+	pluginDir = fs.String("plugin-dir", "", "directory of compiled classes (plugins, .native binaries, manifest.json) to resolve and check class references against (binary, plugin and wasm modes), and that --emit installs to")
+	emit = fs.String("emit", "", "build the generated code with go build and install the artifact (Class.native or the plugin library) in --plugin-dir, default ~/.trashtalk/trash/.compiled: binary or plugin, as --mode; or ir, to write the class's optimized IR as JSON in place of generated code, in any mode but bundle")
+	outDir = fs.String("out-dir", "", "module directory --emit writes main.go and go.mod to and builds in, kept afterwards (default a temporary one)")
+	emitTests = fs.String("emit-tests", "", "also write a Go test file for the binary to this path, run with go test next to main.go: it dispatches new, each compiled selector with sample arguments and unknown selectors against the memory storage backend, which it compiles in (binary mode only)")
+	sourceMap = fs.String("source-map", "", "also write a JSON source map from the generated Go lines of each compiled method to its .trash line to this path, and make the binary print panics with .trash positions (binary mode only)")
+	accessors = fs.Bool("accessors", false, "dispatch a getter and setter (value, value:) for each instance variable without a method of that name (binary, plugin and wasm modes)")
+	implicit = fs.Bool("implicit-locals", false, "declare variables a method uses without defining them as locals instead of leaving the method to Bash (binary, plugin and wasm modes)")
+	comments = fs.Bool("comments", false, "emit a doc comment on each method (selector, source line, trait) and helper, and a file header (binary, plugin and wasm modes)")
+	migrate = fs.Bool("migrate", false, "record the class source hash in each instance and migrate instances saved by another version of the class on load (binary and wasm modes)")
+	history = fs.Bool("history", false, "keep every saved instance state so requests can dispatch read-only --as-of a past time (binary mode only)")
+	dialect = fs.String("dialect", "bash", "shell the bash mode generates for: bash, or posix for POSIX sh (dash, busybox ash), warning about what it cannot express")
+	posixLocal = fs.Bool("posix-local", false, "the --dialect=posix target has local, as dash and busybox ash do; without it parameters and locals are global variables")
+	fallbacks = fs.Bool("fallback-stats", false, "count bash fallbacks per selector in fallback_stats, reported by the __fallbackStats class selector (binary mode only)")
+}
+
 func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Procyon - Trashtalk to Go compiler\n\n")
-		fmt.Fprintf(os.Stderr, "Usage:\n")
-		fmt.Fprintf(os.Stderr, "  procyon [options] < ast.json > output.go\n")
-		fmt.Fprintf(os.Stderr, "  trashtalk-parser Class.trash | procyon > class/main.go\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
+	root := &cli.Command{
+		Name:  "procyon",
+		Short: "Trashtalk to Go compiler",
+		Long:  "Reads a class AST as JSON on stdin and writes the generated code to stdout.",
+		Examples: []string{
+			"procyon < ast.json > output.go",
+			"trashtalk-parser Class.trash | procyon > class/main.go",
+			"procyon --mode=plugin < ast.json > plugin/main.go",
+			"procyon --trait-path=traits < ast.json > output.go",
+			"procyon --only=increment,add: < ast.json > output.go",
+		},
+		Flags:    registerFlags,
+		Commands: []*cli.Command{doctorCommand()},
+		FlagValues: map[string][]string{
+			"mode":        {"bash", "python", "binary", "plugin", "wasm", "bundle"},
+			"report":      {"text", "json"},
+			"diagnostics": diag.Formats,
+			"emit":        {"binary", "plugin", "ir"},
+			"dialect":     codegen.Dialects,
+			"storage":     codegen.StorageBackends,
+			"schema":      protocol.SchemaNames,
+		},
+		Run: func([]string) error {
+			return compile()
+		},
+	}
+	root.Execute()
+}
+
+// jsonResult is the stdout document written by --json on success.
+type jsonResult struct {
+	ExitCode  int            `json:"exit_code"`
+	Code      string         `json:"code,omitempty"`
+	Bytes     int            `json:"bytes"`
+	Diff      string         `json:"diff,omitempty"`
+	Artifact  string         `json:"artifact,omitempty"`   // --emit
+	Tests     string         `json:"tests,omitempty"`      // --emit-tests
+	SourceMap string         `json:"source_map,omitempty"` // --source-map
+	Report    *compileReport `json:"report,omitempty"`
+}
+
+// compile reads an AST from stdin and writes the generated code to stdout.
+func compile() error {
+	if *report != "text" && *report != "json" {
+		return cli.Errorf(cli.ExitUsage, "unknown report format %q (use 'text' or 'json')", *report)
+	}
+
+	if *diagnostics != "" && *diagnostics != "pretty" && *diagnostics != "json" {
+		return cli.Errorf(cli.ExitUsage, "unknown diagnostics format %q (use 'pretty' or 'json')", *diagnostics)
+	}
+
+	if *diffFile != "" && *dryRun {
+		return cli.Errorf(cli.ExitUsage, "--diff and --dry-run cannot be combined")
+	}
+
+	if *lint && (*emit != "" || *diffFile != "" || *describe) {
+		return cli.Errorf(cli.ExitUsage, "--lint cannot be combined with --emit, --diff or --describe")
+	}
+
+	if *emit == "ir" {
+		if *mode == "bundle" {
+			return cli.Errorf(cli.ExitUsage, "--emit=ir is not supported in bundle mode")
+		}
+		if *outDir != "" || *emitTests != "" || *sourceMap != "" {
+			return cli.Errorf(cli.ExitUsage, "--emit=ir cannot be combined with --out-dir, --emit-tests or --source-map")
+		}
+	} else if *emit != "" {
+		if *emit != "binary" && *emit != "plugin" {
+			return cli.Errorf(cli.ExitUsage, "unknown --emit %q (use 'binary', 'plugin' or 'ir')", *emit)
+		}
+		if *emit != *mode {
+			return cli.Errorf(cli.ExitUsage, "--emit=%s needs --mode=%s", *emit, *emit)
+		}
+		if *diffFile != "" || *dryRun {
+			return cli.Errorf(cli.ExitUsage, "--emit cannot be combined with --diff or --dry-run")
+		}
+	} else if *outDir != "" {
+		return cli.Errorf(cli.ExitUsage, "--out-dir needs --emit")
+	}
+
+	if *emitTests != "" {
+		if *mode != "binary" {
+			return cli.Errorf(cli.ExitUsage, "--emit-tests is only supported in binary mode")
+		}
+		if *diffFile != "" || *dryRun {
+			return cli.Errorf(cli.ExitUsage, "--emit-tests cannot be combined with --diff or --dry-run")
+		}
+		// Both need the SQLite helpers, which storage backends replace
+		if *history || *fallbacks {
+			return cli.Errorf(cli.ExitUsage, "--emit-tests cannot be combined with --history or --fallback-stats")
+		}
+	}
+
+	if *sourceMap != "" {
+		if *mode != "binary" {
+			return cli.Errorf(cli.ExitUsage, "--source-map is only supported in binary mode")
+		}
+		if *diffFile != "" || *dryRun {
+			return cli.Errorf(cli.ExitUsage, "--source-map cannot be combined with --diff or --dry-run")
+		}
+	}
+
+	if *dialect != codegen.DialectBash && *dialect != codegen.DialectPOSIX {
+		return cli.Errorf(cli.ExitUsage, "unknown --dialect %q (use 'bash' or 'posix')", *dialect)
+	}
+
+	if *dialect != codegen.DialectBash && *mode != "bash" {
+		return cli.Errorf(cli.ExitUsage, "--dialect is only supported in bash mode")
+	}
+
+	if *posixLocal && *dialect != codegen.DialectPOSIX {
+		return cli.Errorf(cli.ExitUsage, "--posix-local needs --dialect=posix")
 	}
 
-	flag.Parse()
+	if *storage != "" && *mode != "binary" {
+		return cli.Errorf(cli.ExitUsage, "--storage is only supported in binary mode")
+	}
+
+	if *history && *mode != "binary" {
+		return cli.Errorf(cli.ExitUsage, "--history is only supported in binary mode")
+	}
+
+	if *fallbacks && *mode != "binary" {
+		return cli.Errorf(cli.ExitUsage, "--fallback-stats is only supported in binary mode")
+	}
+
+	if *migrate && *mode != "binary" && *mode != "wasm" {
+		return cli.Errorf(cli.ExitUsage, "--migrate is only supported in binary and wasm modes")
+	}
+
+	if (*only != "" || *skip != "") && (*mode == "bash" || *mode == "python" || *mode == "bundle") {
+		return cli.Errorf(cli.ExitUsage, "--only and --skip are not supported in %s mode", *mode)
+	}
+
+	if *pluginDir != "" && (*mode == "bash" || *mode == "python" || *mode == "bundle") {
+		return cli.Errorf(cli.ExitUsage, "--plugin-dir is not supported in %s mode", *mode)
+	}
+
+	if *comments && (*mode == "bash" || *mode == "python" || *mode == "bundle") {
+		return cli.Errorf(cli.ExitUsage, "--comments is not supported in %s mode", *mode)
+	}
+
+	if *implicit && (*mode == "bash" || *mode == "python" || *mode == "bundle") {
+		return cli.Errorf(cli.ExitUsage, "--implicit-locals is not supported in %s mode", *mode)
+	}
 
 	if *version {
+		if cli.JSON() {
+			return cli.PrintJSON(map[string]string{"version": versionStr})
+		}
 		fmt.Printf("procyon version %s\n", versionStr)
-		os.Exit(0)
+		return nil
+	}
+
+	if *schema != "" {
+		doc, err := protocol.Schema(*schema)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "%v", err)
+		}
+		os.Stdout.Write(doc)
+		return nil
 	}
 
 	// Read AST from stdin
 	input, err := io.ReadAll(os.Stdin)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
-		os.Exit(1)
+		return cli.Errorf(cli.ExitUsage, "reading input: %v", err)
 	}
 
 	if len(input) == 0 {
-		fmt.Fprintf(os.Stderr, "Error: no input provided\n")
-		fmt.Fprintf(os.Stderr, "Usage: procyon < ast.json\n")
-		os.Exit(1)
+		return cli.Errorf(cli.ExitUsage, "no input provided\nUsage: procyon [flags] < ast.json (see procyon --help)")
+	}
+
+	if *lint {
+		return runLint(input)
+	}
+
+	if *mode == "bundle" {
+		return runBundle(input)
 	}
 
 	// Parse AST (supports both plain Class and CompilationUnit with traits)
 	unit, err := ast.ParseCompilationUnit(input)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing AST: %v\n", err)
-		os.Exit(1)
+		return parseFailure(input, err)
 	}
 
 	// Merge trait methods into the class
-	merged, missing := unit.MergeTraits()
-	if len(merged) > 0 {
-		fmt.Fprintf(os.Stderr, "Merged trait methods: %v\n", merged)
-	}
-	if len(missing) > 0 {
-		fmt.Fprintf(os.Stderr, "Warning: traits not provided (will fall back to Bash): %v\n", missing)
+	if err := mergeTraits(unit, ""); err != nil {
+		return err
 	}
 	class := unit.Class
 
+	if *describe {
+		out, err := describeClass(class)
+		if err != nil {
+			return cli.Errorf(cli.ExitCodegen, "describing class: %v", err)
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if *emit == "ir" {
+		return compileIR(class)
+	}
+
+	// Options shared by the Go modes
+	opts := codegen.Options{Only: cli.SplitList(*only), Skip: cli.SplitList(*skip), Accessors: *accessors, ImplicitLocals: *implicit}
+	if _, statErr := os.Stat(*pluginDir); *pluginDir != "" && (*emit == "" || statErr == nil) {
+		// --emit creates the directory it installs to
+		if opts.Classes, err = pluginClasses(*pluginDir); err != nil {
+			return cli.Errorf(cli.ExitUsage, "reading --plugin-dir: %v", err)
+		}
+	}
+	// The --comments header and a plugin's GetClassInfo name these
+	opts.Comments = *comments
+	opts.GeneratorVersion = versionStr
+	if *sourceFile != "" {
+		src, err := os.ReadFile(*sourceFile)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "reading --source-file: %v", err)
+		}
+		// The hash the binary's --hash prints
+		sum := sha256.Sum256(src)
+		opts.SourceHash = hex.EncodeToString(sum[:])
+	}
+
 	// Generate code based on mode
 	var result *codegen.Result
 	switch *mode {
 	case "bash":
-		// Bash mode: convert AST to IR, then generate Bash
-		builder := ir.NewBuilder(class)
-		prog, errs, warnings := builder.Build()
-		for _, w := range warnings {
-			fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
-		}
-		if len(errs) > 0 {
-			for _, e := range errs {
-				fmt.Fprintf(os.Stderr, "Error: %s\n", e)
-			}
-			os.Exit(1)
+		return compileBash(class)
+	case "python":
+		return compilePython(class)
+	case "binary":
+		opts.Storage = cli.SplitList(*storage)
+		if *emitTests != "" {
+			opts.Storage = withMemoryBackend(opts.Storage)
 		}
-		// Read source file for embedding if provided
-		if *sourceFile != "" {
-			sourceBytes, err := os.ReadFile(*sourceFile)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: could not read source file for embedding: %v\n", err)
-			} else {
-				prog.SourceCode = string(sourceBytes)
+		opts.History = *history
+		opts.FallbackStats = *fallbacks
+		opts.Migrate = *migrate
+		opts.SourceMap = *sourceMap != ""
+		result = codegen.GenerateWithOptions(class, opts)
+	case "plugin":
+		result = codegen.GeneratePluginWithOptions(class, opts)
+	case "wasm":
+		opts.Migrate = *migrate
+		result = codegen.GenerateWASMWithOptions(class, opts)
+		if result.Code == "" {
+			for _, w := range result.Warnings {
+				fmt.Fprintf(os.Stderr, "Error: %s\n", w)
 			}
+			return cli.Errorf(cli.ExitCodegen, "class cannot be compiled to WASM")
 		}
-		backend := codegen.NewBashBackend()
-		code, err := backend.Generate(prog)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error generating Bash: %v\n", err)
-			os.Exit(1)
-		}
-		if *dryRun {
-			fmt.Fprintf(os.Stderr, "Dry run - would generate %d bytes of Bash code\n", len(code))
-			os.Exit(0)
-		}
-		fmt.Print(code)
-		return
-	case "binary":
-		result = codegen.Generate(class)
-	case "plugin":
-		result = codegen.GeneratePlugin(class)
 	default:
-		fmt.Fprintf(os.Stderr, "Error: unknown mode %q (use 'bash', 'binary', or 'plugin')\n", *mode)
-		os.Exit(1)
+		return cli.Errorf(cli.ExitUsage, "unknown mode %q (use 'bash', 'python', 'binary', 'plugin', 'wasm', or 'bundle')", *mode)
 	}
 
 	// Report skipped methods
-	if len(result.SkippedMethods) > 0 {
+	if *report == "json" {
+		if err := writeJSONReport(*reportFile, class, result); err != nil {
+			return fmt.Errorf("writing report: %w", err)
+		}
+	}
+	if *diagnostics != "" {
+		if err := reportDiagnostics(class.Name+".trash", result); err != nil {
+			return err
+		}
+	} else if *report != "json" && len(result.SkippedMethods) > 0 && !cli.Quiet() {
 		fmt.Fprintf(os.Stderr, "procyon: %s.trash\n", class.Name)
 
 		// Count compiled methods
@@ -142,23 +385,309 @@ func main() {
 
 		fmt.Fprintf(os.Stderr, "\nGenerated %d/%d methods. %d will fall back to Bash.\n\n",
 			compiled, len(class.Methods), len(result.SkippedMethods))
+	}
+	if err := compileErrors(class.Name+".trash", result); err != nil {
+		return err
+	}
+	if *strict && len(result.SkippedMethods) > 0 {
+		return cli.Errorf(cli.ExitCodegen, "--strict mode enabled, refusing to generate with skipped methods")
+	}
+
+	// Report warnings (included in the JSON report when --report=json)
+	if *report != "json" {
+		printWarnings(result.Warnings)
+	}
 
-		if *strict {
-			fmt.Fprintf(os.Stderr, "Error: --strict mode enabled, refusing to generate with skipped methods\n")
-			os.Exit(1)
+	var tests string
+	if *emitTests != "" {
+		if tests, err = writeTests(class, opts); err != nil {
+			return err
+		}
+	}
+	if result.SourceMap != nil {
+		if err := writeSourceMap(result.SourceMap); err != nil {
+			return err
 		}
 	}
 
-	// Report warnings
-	for _, w := range result.Warnings {
-		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	if *emit != "" {
+		return emitOutput(class, result.Code, tests, newCompileReport(class, result))
 	}
+	return output(result.Code, newCompileReport(class, result), "Go code")
+}
+
+// withMemoryBackend returns the --storage backends with memory, which the
+// --emit-tests harness runs against, compiled in. SQLite stays the default
+// backend when none were given.
+func withMemoryBackend(backends []string) []string {
+	if len(backends) == 0 {
+		return []string{"sqlite", "memory"}
+	}
+	for _, b := range backends {
+		if b == "memory" {
+			return backends
+		}
+	}
+	return append(backends, "memory")
+}
 
-	// Output
+// writeTests generates the test harness for the binary and writes it to the
+// --emit-tests file, returning the code
+func writeTests(class *ast.Class, opts codegen.Options) (string, error) {
+	result := codegen.GenerateTests(class, opts)
+	if result.Code == "" {
+		for _, w := range result.Warnings {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", w)
+		}
+		return "", cli.Errorf(cli.ExitCodegen, "no tests generated for %s", class.Name)
+	}
+	// The file may go in the --out-dir that --emit creates after this
+	if err := os.MkdirAll(filepath.Dir(*emitTests), 0o755); err != nil {
+		return "", fmt.Errorf("writing --emit-tests file: %w", err)
+	}
+	if err := os.WriteFile(*emitTests, []byte(result.Code), 0o644); err != nil {
+		return "", fmt.Errorf("writing --emit-tests file: %w", err)
+	}
+	if !cli.JSON() {
+		cli.Logf("procyon: wrote tests to %s", *emitTests)
+	}
+	return result.Code, nil
+}
+
+// writeSourceMap writes the source map of the generated code to the
+// --source-map file
+func writeSourceMap(sm *codegen.SourceMap) error {
+	data, err := json.MarshalIndent(sm, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*sourceMap, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("writing --source-map file: %w", err)
+	}
+	if !cli.JSON() {
+		cli.Logf("procyon: wrote source map to %s", *sourceMap)
+	}
+	return nil
+}
+
+// compileBash converts the class to IR and writes the generated Bash.
+func compileBash(class *ast.Class) error {
+	prog, err := buildIR(class)
+	if err != nil {
+		return err
+	}
+	backend := codegen.NewBashBackend()
+	backend.Dialect = *dialect
+	backend.Local = *posixLocal
+	code, err := backend.Generate(prog)
+	if err != nil {
+		return cli.Errorf(cli.ExitCodegen, "generating Bash: %v", err)
+	}
+	printWarnings(backend.Warnings())
+	return output(code, nil, "Bash code")
+}
+
+// compilePython converts the class to IR and writes the generated Python.
+func compilePython(class *ast.Class) error {
+	prog, err := buildIR(class)
+	if err != nil {
+		return err
+	}
+	backend := codegen.NewPythonBackend()
+	code, err := backend.Generate(prog)
+	if err != nil {
+		return cli.Errorf(cli.ExitCodegen, "generating Python: %v", err)
+	}
+	printWarnings(backend.Warnings())
+	return output(code, nil, "Python code")
+}
+
+// compileIR converts the class to IR and writes it as JSON for --emit=ir.
+func compileIR(class *ast.Class) error {
+	prog, err := buildIR(class)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(prog, "", "  ")
+	if err != nil {
+		return cli.Errorf(cli.ExitCodegen, "encoding IR: %v", err)
+	}
+	return output(string(data)+"\n", nil, "IR")
+}
+
+// buildIR converts the class to optimized IR, with the --source-file source
+// to embed.
+func buildIR(class *ast.Class) (*ir.Program, error) {
+	builder := ir.NewBuilder(class)
+	prog, warnings, errs := builder.Build()
+	printWarnings(warnings)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+		}
+		return nil, cli.Errorf(cli.ExitCodegen, "IR building failed with %d errors", len(errs))
+	}
+	ir.Optimize(prog)
+	// Read source file for embedding if provided
+	if *sourceFile != "" {
+		sourceBytes, err := os.ReadFile(*sourceFile)
+		if err != nil {
+			cli.Logf("Warning: could not read source file for embedding: %v", err)
+		} else {
+			prog.SourceCode = string(sourceBytes)
+		}
+	}
+	return prog, nil
+}
+
+// output writes the generated code, or its size for --dry-run, or its diff
+// for --diff. Under --json the code and report are wrapped in a jsonResult
+// document.
+func output(code string, rep *compileReport, what string) error {
+	if *diffFile != "" {
+		return outputDiff(code, rep)
+	}
+	if cli.JSON() {
+		res := jsonResult{Bytes: len(code), Tests: *emitTests, SourceMap: *sourceMap, Report: rep}
+		if !*dryRun {
+			res.Code = code
+		}
+		return cli.PrintJSON(res)
+	}
 	if *dryRun {
-		fmt.Fprintf(os.Stderr, "Dry run - would generate %d bytes of Go code\n", len(result.Code))
-		os.Exit(0)
+		cli.Logf("Dry run - would generate %d bytes of %s", len(code), what)
+		return nil
+	}
+	fmt.Print(code)
+	return nil
+}
+
+// emitOutput builds and installs the generated code for --emit, and writes
+// where the artifact went in place of the code
+func emitOutput(class *ast.Class, code, tests string, rep *compileReport) error {
+	artifact, err := emitArtifact(class, code, tests)
+	if err != nil {
+		return cli.Errorf(cli.ExitCodegen, "building %s: %v", class.CompiledName(), err)
+	}
+	if cli.JSON() {
+		return cli.PrintJSON(jsonResult{Bytes: len(code), Artifact: artifact, Tests: *emitTests, SourceMap: *sourceMap, Report: rep})
+	}
+	cli.Logf("procyon: built %s", artifact)
+	return nil
+}
+
+// outputDiff writes the diff from the --diff file to the generated code and
+// exits ExitStale if there is one, so CI can fail on code that was not
+// regenerated. A missing file differs from any code.
+func outputDiff(code string, rep *compileReport) error {
+	existing, err := os.ReadFile(*diffFile)
+	if err != nil && !os.IsNotExist(err) {
+		return cli.Errorf(cli.ExitUsage, "reading --diff file: %v", err)
+	}
+	diff := cli.UnifiedDiff(*diffFile, *diffFile+" (generated)", string(existing), code)
+
+	switch {
+	case cli.JSON():
+		res := jsonResult{Bytes: len(code), Diff: diff, Report: rep}
+		if diff != "" {
+			res.ExitCode = cli.ExitStale
+		}
+		if err := cli.PrintJSON(res); err != nil {
+			return err
+		}
+	case diff == "":
+		cli.Logf("%s is up to date", *diffFile)
+	default:
+		fmt.Print(diff)
+	}
+	if diff != "" {
+		return cli.Exit(cli.ExitStale, nil)
+	}
+	return nil
+}
+
+// runBundle compiles a JSON array of classes into a single multi-class binary.
+func runBundle(input []byte) error {
+	units, err := ast.ParseCompilationUnits(input)
+	if err != nil {
+		return parseFailure(input, err)
+	}
+
+	var classes []*ast.Class
+	for _, unit := range units {
+		if err := mergeTraits(unit, unit.Class.Name+": "); err != nil {
+			return err
+		}
+		classes = append(classes, unit.Class)
 	}
 
-	fmt.Print(result.Code)
+	result := codegen.GenerateBundle(classes)
+	if *diagnostics != "" {
+		if err := reportDiagnostics("", result); err != nil {
+			return err
+		}
+	} else {
+		for _, s := range result.SkippedMethods {
+			cli.Logf("  ⚠ %s - skipped: %s", s.Selector, s.Reason)
+		}
+	}
+	printWarnings(result.Warnings)
+	if err := compileErrors("", result); err != nil {
+		return err
+	}
+	if *strict && len(result.SkippedMethods) > 0 {
+		return cli.Errorf(cli.ExitCodegen, "--strict mode enabled, refusing to generate with skipped methods")
+	}
+
+	return output(result.Code, newBundleReport(classes, result), fmt.Sprintf("Go code for %d classes", len(classes)))
+}
+
+// mergeTraits loads the unit's missing traits from --trait-path and merges
+// trait methods into its class, logging each message with prefix. A trait
+// method requirement the class does not meet is an error.
+func mergeTraits(unit *ast.CompilationUnit, prefix string) error {
+	if *traitPath != "" {
+		loaded, err := source.LoadTraits(unit, filepath.SplitList(*traitPath))
+		if err != nil {
+			return cli.Errorf(cli.ExitParse, "%sloading traits: %v", prefix, err)
+		}
+		if len(loaded) > 0 {
+			cli.Logf("%sLoaded traits from --trait-path: %v", prefix, loaded)
+		}
+	}
+
+	traits := unit.MergeTraits()
+	if len(traits.Merged) > 0 {
+		cli.Logf("%sMerged trait methods: %v", prefix, traits.Merged)
+	}
+	if len(traits.Missing) > 0 {
+		cli.Logf("Warning: %straits not provided (will fall back to Bash): %v", prefix, traits.Missing)
+	}
+	for _, o := range traits.Overridden {
+		cli.Logf("%sClass method overrides trait method %s", prefix, o)
+	}
+	for _, e := range traits.Excluded {
+		cli.Logf("%sExcluded trait method %s", prefix, e)
+	}
+	for _, r := range traits.Resolved {
+		cli.Logf("%sResolved trait conflict %s", prefix, r)
+	}
+	for _, c := range traits.Conflicts {
+		fmt.Fprintf(os.Stderr, "Error: %sselector defined by several traits: %s; choose one with resolve: <selector> use: <Trait> or drop one with exclude: <selector> from: <Trait>\n", prefix, c)
+	}
+	for _, i := range traits.Invalid {
+		fmt.Fprintf(os.Stderr, "Error: %s%s\n", prefix, i)
+	}
+	for _, u := range traits.Unmet {
+		fmt.Fprintf(os.Stderr, "Error: %s%s\n", prefix, u)
+	}
+	switch {
+	case len(traits.Conflicts) > 0:
+		return cli.Errorf(cli.ExitCodegen, "%s%d unresolved trait conflicts", prefix, len(traits.Conflicts))
+	case len(traits.Invalid) > 0:
+		return cli.Errorf(cli.ExitCodegen, "%s%d invalid trait resolutions", prefix, len(traits.Invalid))
+	case len(traits.Unmet) > 0:
+		return cli.Errorf(cli.ExitCodegen, "%s%d trait method requirements not met", prefix, len(traits.Unmet))
+	}
+	return nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/codegen"
+)
+
+// compileReport is the machine-readable form of the skipped-method report,
+// written by --report=json so build tooling can diff coverage between versions.
+type compileReport struct {
+	Class    string          `json:"class,omitempty"`
+	Classes  []string        `json:"classes,omitempty"` // bundle mode
+	Mode     string          `json:"mode"`
+	Total    int             `json:"total"`
+	Compiled int             `json:"compiled"`
+	Skipped  []skippedReport `json:"skipped"`
+	Warnings []string        `json:"warnings"`
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+// skippedReport describes one method that will fall back to Bash.
+type skippedReport struct {
+	Selector string `json:"selector"`
+	Reason   string `json:"reason"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// newCompileReport summarizes the generation result for class.
+func newCompileReport(class *ast.Class, result *codegen.Result) *compileReport {
+	report := &compileReport{
+		Class:    class.QualifiedName(),
+		Mode:     *mode,
+		Total:    len(class.Methods),
+		Compiled: len(class.Methods) - len(result.SkippedMethods),
+		Skipped:  []skippedReport{},
+		Warnings: []string{},
+	}
+	for _, s := range result.SkippedMethods {
+		report.Skipped = append(report.Skipped, skippedReport{
+			Selector: s.Selector,
+			Reason:   s.Reason,
+			Line:     s.Line,
+		})
+	}
+	report.Warnings = append(report.Warnings, result.Warnings...)
+	for _, e := range result.Errors {
+		report.Errors = append(report.Errors, e.Error())
+	}
+	return report
+}
+
+// newBundleReport summarizes the generation result for a bundle of classes.
+func newBundleReport(classes []*ast.Class, result *codegen.Result) *compileReport {
+	report := newCompileReport(&ast.Class{}, result)
+	report.Class = ""
+	for _, class := range classes {
+		report.Classes = append(report.Classes, class.QualifiedName())
+		report.Total += len(class.Methods)
+	}
+	report.Compiled = report.Total - len(result.SkippedMethods)
+	return report
+}
+
+// writeJSONReport writes the compile report to path, or to stderr if path is empty.
+func writeJSONReport(path string, class *ast.Class, result *codegen.Result) error {
+	data, err := json.MarshalIndent(newCompileReport(class, result), "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling report: %w", err)
+	}
+	data = append(data, '\n')
+
+	if path == "" {
+		_, err = os.Stderr.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
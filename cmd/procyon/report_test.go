@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/cli"
+)
+
+// buildProcyon builds the compiler into a temporary directory and returns
+// the path of the binary
+func buildProcyon(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds procyon")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+	bin := filepath.Join(t.TempDir(), "procyon")
+	if out, err := exec.Command(goTool, "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// runReport compiles the AST input with --report=json and answers the
+// decoded report, the generated code and the exit code
+func runReport(t *testing.T, bin string, input []byte) (*compileReport, string, int) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "report.json")
+	cmd := exec.Command(bin, "--report=json", "--report-file="+path)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	code := 0
+	var exit *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exit) {
+		code = exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading report: %v", err)
+	}
+	var report compileReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("decoding report: %v\n%s", err, data)
+	}
+	return &report, stdout.String(), code
+}
+
+func TestJSONReport(t *testing.T) {
+	bin := buildProcyon(t)
+	input, err := os.ReadFile("../../testdata/counter/input.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, code, exit := runReport(t, bin, input)
+	if exit != 0 {
+		t.Fatalf("exit %d, want 0", exit)
+	}
+	if !strings.Contains(code, "package main") {
+		t.Errorf("no Go code on stdout:\n%s", code)
+	}
+	if report.Class != "Counter" || report.Mode != "binary" || report.Total != 10 {
+		t.Errorf("report %+v, want class Counter, mode binary, 10 methods", report)
+	}
+	if report.Compiled+len(report.Skipped) != report.Total {
+		t.Errorf("compiled %d and skipped %d do not add up to %d", report.Compiled, len(report.Skipped), report.Total)
+	}
+	if len(report.Errors) != 0 {
+		t.Errorf("errors %v, want none", report.Errors)
+	}
+}
+
+func TestJSONReportFailingBuild(t *testing.T) {
+	bin := buildProcyon(t)
+	input, err := os.ReadFile("../../testdata/counter/input.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An array default that does not parse, and a method left to Bash
+	var class map[string]interface{}
+	if err := json.Unmarshal(input, &class); err != nil {
+		t.Fatal(err)
+	}
+	class["instanceVars"] = append(class["instanceVars"].([]interface{}), map[string]interface{}{
+		"name": "items", "type": "array",
+		"default":  map[string]interface{}{"type": "string", "value": "[1, "},
+		"location": map[string]interface{}{"line": 4, "col": 32},
+	})
+	class["methods"] = append(class["methods"].([]interface{}), map[string]interface{}{
+		"type": "method", "kind": "instance", "raw": true, "selector": "legacy", "args": []string{},
+		"body":     map[string]interface{}{"type": "block", "tokens": []interface{}{}},
+		"location": map[string]interface{}{"line": 40, "col": 2},
+	})
+	if input, err = json.Marshal(class); err != nil {
+		t.Fatal(err)
+	}
+
+	report, code, exit := runReport(t, bin, input)
+	if exit != cli.ExitCodegen {
+		t.Errorf("exit %d, want %d", exit, cli.ExitCodegen)
+	}
+	if code != "" {
+		t.Errorf("failing build wrote code:\n%s", code)
+	}
+	if len(report.Errors) != 1 || !strings.Contains(report.Errors[0], "default of instance variable items") {
+		t.Errorf("errors %v, want the items default", report.Errors)
+	}
+	if report.Total != 11 || report.Compiled != report.Total-len(report.Skipped) {
+		t.Errorf("report %+v, want 11 methods", report)
+	}
+	skipped := false
+	for _, s := range report.Skipped {
+		skipped = skipped || (s.Selector == "legacy" && s.Reason != "" && s.Line == 40)
+	}
+	if !skipped {
+		t.Errorf("skipped %+v, want legacy with its reason and line", report.Skipped)
+	}
+}
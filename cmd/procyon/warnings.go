@@ -0,0 +1,42 @@
+package main
+
+import "github.com/chazu/procyon/pkg/cli"
+
+// warningCount is a distinct warning and how many times it was reported.
+type warningCount struct {
+	Message string
+	Count   int
+}
+
+// dedupWarnings collapses identical warnings, keeping first-seen order.
+func dedupWarnings(warnings []string) []warningCount {
+	var out []warningCount
+	index := make(map[string]int)
+	for _, w := range warnings {
+		if i, ok := index[w]; ok {
+			out[i].Count++
+			continue
+		}
+		index[w] = len(out)
+		out = append(out, warningCount{Message: w, Count: 1})
+	}
+	return out
+}
+
+// printWarnings writes each distinct warning once, with a repeat count,
+// stopping after --max-warnings distinct warnings with a summary line.
+func printWarnings(warnings []string) {
+	distinct := dedupWarnings(warnings)
+	for i, w := range distinct {
+		if *maxWarnings > 0 && i == *maxWarnings {
+			cli.Logf("... %d more warnings not shown (%d total, limit set by --max-warnings)",
+				len(distinct)-i, len(warnings))
+			return
+		}
+		if w.Count > 1 {
+			cli.Logf("Warning: %s (%d times)", w.Message, w.Count)
+		} else {
+			cli.Logf("Warning: %s", w.Message)
+		}
+	}
+}
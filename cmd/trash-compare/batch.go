@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/lexer"
+)
+
+// batchStage is what tokenize, parse, ir and bash do to each file of a
+// --recursive run: translate returns the output written for a file's
+// source, which replaces .trash with ext.
+type batchStage struct {
+	ext       string
+	translate func(content string) (string, error)
+}
+
+var (
+	tokenizeStage = batchStage{".tokens.json", func(content string) (string, error) {
+		out, err := lexer.New(content).TokenizeJSON()
+		if err != nil {
+			return "", cli.Errorf(cli.ExitParse, "tokenizing: %v", err)
+		}
+		return out + "\n", nil
+	}}
+	parseStage = batchStage{".ast.json", func(content string) (string, error) {
+		classAST, parseErrors, err := parseSource(content)
+		if err != nil {
+			return "", err
+		}
+		if len(parseErrors) > 0 {
+			se := &sourceError{code: cli.ExitParse}
+			for _, pe := range parseErrors {
+				se.messages = append(se.messages, pe.Error())
+			}
+			return "", se
+		}
+		out, err := json.MarshalIndent(classAST, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("marshaling AST: %w", err)
+		}
+		return string(out) + "\n", nil
+	}}
+	irStage = batchStage{".ir.json", func(content string) (string, error) {
+		program, _, err := programFromSource(content)
+		if err != nil {
+			return "", err
+		}
+		out, err := json.MarshalIndent(program, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("marshaling IR: %w", err)
+		}
+		return string(out) + "\n", nil
+	}}
+	bashStage = batchStage{".bash", func(content string) (string, error) {
+		program, _, err := programFromSource(content)
+		if err != nil {
+			return "", err
+		}
+		out, err := codegen.NewBashBackend().Generate(program)
+		if err != nil {
+			return "", &sourceError{code: cli.ExitCodegen, messages: []string{"generating bash: " + err.Error()}}
+		}
+		return out, nil
+	}}
+)
+
+// batchFlags are the flags tokenize, parse and bash take for --recursive.
+type batchFlags struct {
+	recursive *bool
+	outDir    *string
+	jobs      *int
+}
+
+// batchFailure is a file a --recursive run could not translate.
+type batchFailure struct {
+	File     string   `json:"file"`
+	Stage    string   `json:"stage"` // parse, ir or io
+	Messages []string `json:"messages"`
+}
+
+// batchResult is the summary of a --recursive run, and the stdout document
+// written with --json.
+type batchResult struct {
+	Files       int            `json:"files"`
+	OK          int            `json:"ok"`
+	ParseErrors int            `json:"parse_errors"`
+	IRErrors    int            `json:"ir_errors"`
+	IOErrors    int            `json:"io_errors"`
+	Failures    []batchFailure `json:"failures"`
+}
+
+// runBatch translates every .trash file under dir with stage, in parallel,
+// writing each output next to its source or at the same relative path under
+// --out-dir, and prints a summary. It exits with 2 if any file failed to
+// parse, else 3 if any failed to build its IR, else 1 if any could not be
+// read or written.
+func runBatch(name string, stage batchStage, flags batchFlags, dir string) error {
+	files, err := trashFiles(dir)
+	if err != nil {
+		return cli.Errorf(cli.ExitUsage, "%v", err)
+	}
+	if len(files) == 0 {
+		return cli.Errorf(cli.ExitUsage, "no .trash files under %s", dir)
+	}
+	jobs := *flags.jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	failures := make([]*batchFailure, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				failures[i] = translateFile(stage, dir, files[i], *flags.outDir)
+			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	res := batchResult{Files: len(files), Failures: []batchFailure{}}
+	for _, f := range failures {
+		if f == nil {
+			res.OK++
+			continue
+		}
+		switch f.Stage {
+		case "parse":
+			res.ParseErrors++
+		case "ir":
+			res.IRErrors++
+		default:
+			res.IOErrors++
+		}
+		res.Failures = append(res.Failures, *f)
+	}
+
+	if cli.JSON() {
+		if err := cli.PrintJSON(res); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range res.Failures {
+			for _, msg := range f.Messages {
+				fmt.Printf("%s: %s error: %s\n", f.File, f.Stage, msg)
+			}
+		}
+		fmt.Printf("trash-compare %s: %d files, %d ok, %d parse errors, %d IR errors, %d I/O errors\n",
+			name, res.Files, res.OK, res.ParseErrors, res.IRErrors, res.IOErrors)
+	}
+
+	switch {
+	case res.ParseErrors > 0:
+		return cli.Exit(cli.ExitParse, nil)
+	case res.IRErrors > 0:
+		return cli.Exit(cli.ExitCodegen, nil)
+	case res.IOErrors > 0:
+		return cli.Exit(cli.ExitUsage, nil)
+	}
+	return nil
+}
+
+// trashFiles returns the .trash files under dir, sorted, skipping hidden
+// directories such as .compiled
+func trashFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".trash") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// translateFile translates the file at path under dir and writes its
+// output, returning what went wrong, if anything
+func translateFile(stage batchStage, dir, path, outDir string) *batchFailure {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return &batchFailure{path, "io", []string{err.Error()}}
+	}
+	out, err := stage.translate(string(content))
+	if err != nil {
+		return sourceFailure(path, err)
+	}
+
+	dest := strings.TrimSuffix(path, ".trash") + stage.ext
+	if outDir != "" {
+		rel, err := filepath.Rel(dir, dest)
+		if err != nil {
+			return &batchFailure{path, "io", []string{err.Error()}}
+		}
+		dest = filepath.Join(outDir, rel)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return &batchFailure{path, "io", []string{err.Error()}}
+	}
+	if err := os.WriteFile(dest, []byte(out), 0o644); err != nil {
+		return &batchFailure{path, "io", []string{err.Error()}}
+	}
+	return nil
+}
+
+// sourceFailure classifies a translation error by the exit code it carries
+func sourceFailure(path string, err error) *batchFailure {
+	var se *sourceError
+	var exitErr *cli.ExitError
+	stage, messages := "io", []string{err.Error()}
+	switch {
+	case errors.As(err, &se):
+		messages = se.messages
+		stage = "parse"
+		if se.code == cli.ExitCodegen {
+			stage = "ir"
+		}
+	case errors.As(err, &exitErr) && exitErr.Code == cli.ExitParse:
+		stage = "parse"
+	case errors.As(err, &exitErr) && exitErr.Code == cli.ExitCodegen:
+		stage = "ir"
+	}
+	return &batchFailure{path, stage, messages}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const pairSource = `Pair subclass: Object
+  instanceVars: left:0 right:0
+
+  method: sum [
+    ^ left + right
+  ]
+`
+
+// batchTree returns a temp dir of two classes, one that does not parse and
+// one in a hidden directory
+func batchTree(t *testing.T) string {
+	t.Helper()
+	return writeTrash(t, map[string]string{
+		"Counter.trash":         counterSource,
+		"lib/Pair.trash":        pairSource,
+		"lib/Broken.trash":      "Broken subclass: Object\n  instanceVars: items:#()\n",
+		".compiled/Stale.trash": counterSource,
+	})
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestBatchNextToSources(t *testing.T) {
+	bin := buildTrashCompare(t)
+	dir := batchTree(t)
+
+	out, code := runTrashCompare(t, bin, dir, "bash", "--recursive", "--jobs", "2", ".")
+	if code != 2 {
+		t.Errorf("exited %d, want 2 for the parse error", code)
+	}
+	if !strings.Contains(out, "lib/Broken.trash: parse error: ") {
+		t.Errorf("the parse error of lib/Broken.trash is not reported:\n%s", out)
+	}
+	if want := "trash-compare bash: 3 files, 2 ok, 1 parse errors, 0 IR errors, 0 I/O errors\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("summary is not %q:\n%s", want, out)
+	}
+	for path, want := range map[string]bool{
+		"Counter.bash":         true,
+		"lib/Pair.bash":        true,
+		"lib/Broken.bash":      false,
+		".compiled/Stale.bash": false,
+	} {
+		if got := exists(filepath.Join(dir, path)); got != want {
+			t.Errorf("%s written = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestBatchOutDirJSON(t *testing.T) {
+	bin := buildTrashCompare(t)
+	dir := batchTree(t)
+	os.Remove(filepath.Join(dir, "lib/Broken.trash"))
+	outDir := filepath.Join(t.TempDir(), "out")
+
+	for _, stage := range []struct{ name, ext string }{
+		{"tokenize", ".tokens.json"},
+		{"parse", ".ast.json"},
+		{"ir", ".ir.json"},
+		{"bash", ".bash"},
+	} {
+		out, code := runTrashCompare(t, bin, dir, stage.name, "--json", "--recursive", "--out-dir", outDir, ".")
+		if code != 0 {
+			t.Errorf("%s exited %d:\n%s", stage.name, code, out)
+			continue
+		}
+		var res batchResult
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Fatalf("%s: decoding %s: %v", stage.name, out, err)
+		}
+		if res.Files != 2 || res.OK != 2 || len(res.Failures) != 0 {
+			t.Errorf("%s answered %+v, want 2 files ok", stage.name, res)
+		}
+		for _, name := range []string{"Counter", "lib/Pair"} {
+			if !exists(filepath.Join(outDir, name+stage.ext)) {
+				t.Errorf("%s did not write %s", stage.name, name+stage.ext)
+			}
+			if exists(filepath.Join(dir, name+stage.ext)) {
+				t.Errorf("%s wrote %s next to its source", stage.name, name+stage.ext)
+			}
+		}
+	}
+}
+
+func TestBatchIOErrors(t *testing.T) {
+	bin := buildTrashCompare(t)
+	dir := writeTrash(t, map[string]string{"Counter.trash": counterSource, "lib/Pair.trash": pairSource})
+	// An out dir that is a file cannot be written under
+	outDir := filepath.Join(dir, "out")
+	if err := os.WriteFile(outDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code := runTrashCompare(t, bin, dir, "parse", "--json", "--recursive", "--out-dir", outDir, ".")
+	if code != 1 {
+		t.Errorf("exited %d, want 1", code)
+	}
+	var res batchResult
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("decoding %s: %v", out, err)
+	}
+	if res.Files != 2 || res.OK != 0 || res.IOErrors != 2 || len(res.Failures) != 2 {
+		t.Fatalf("answered %+v, want 2 I/O errors", res)
+	}
+	for i, want := range []string{"Counter.trash", "lib/Pair.trash"} {
+		if f := res.Failures[i]; f.File != want || f.Stage != "io" || len(f.Messages) == 0 {
+			t.Errorf("failure %d is %+v, want an io failure of %s", i, f, want)
+		}
+	}
+}
+
+func TestBatchUsage(t *testing.T) {
+	bin := buildTrashCompare(t)
+	dir := writeTrash(t, map[string]string{"Counter.trash": counterSource, "empty/README": ""})
+
+	for _, args := range [][]string{
+		{"bash", "--out-dir", "out", "Counter.trash"},
+		{"bash", "--jobs", "2", "Counter.trash"},
+		{"bash", "--recursive", "empty"},
+		{"bash", "--recursive", "missing"},
+	} {
+		if _, code := runTrashCompare(t, bin, dir, args...); code != 1 {
+			t.Errorf("%s exited %d, want 1", strings.Join(args, " "), code)
+		}
+	}
+}
+
+func TestTrashFiles(t *testing.T) {
+	dir := batchTree(t)
+	files, err := trashFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rel []string
+	for _, f := range files {
+		r, _ := filepath.Rel(dir, f)
+		rel = append(rel, r)
+	}
+	if want := "Counter.trash lib/Broken.trash lib/Pair.trash"; strings.Join(rel, " ") != want {
+		t.Errorf("trashFiles = %v, want %s", rel, want)
+	}
+}
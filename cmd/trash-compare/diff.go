@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/ir"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// diffTimeout bounds each run of a method, so a loop that never ends on one
+// side is reported instead of hanging the comparison
+const diffTimeout = 30 * time.Second
+
+// diffFlags are the flags of the diff subcommand.
+type diffFlags struct {
+	instance *string
+	keep     *bool
+}
+
+// diffCommand returns the diff subcommand.
+func diffCommand() *cli.Command {
+	var flags diffFlags
+	return &cli.Command{
+		Name:     "diff",
+		Usage:    "[--instance JSON] [--keep] <file.trash> [selector [args...]]",
+		Short:    "Run methods through the Bash backend and the Go semantics and report where results or instance state differ",
+		Args:     cli.AnyArgs,
+		ArgFiles: "*.trash",
+		Flags: func(fs *flag.FlagSet) {
+			flags.instance = fs.String("instance", "", "instance JSON each instance method starts from (default: a new instance)")
+			flags.keep = fs.Bool("keep", false, "keep the scratch directory (instances.db, the Bash code and its instance file) and print its path")
+		},
+		Run: func(args []string) error {
+			return cmdDiff(flags, args)
+		},
+	}
+}
+
+// diffOutcome is what one side answered for a method.
+type diffOutcome struct {
+	Result   string            `json:"result"`
+	Error    string            `json:"error,omitempty"`
+	Instance map[string]string `json:"instance,omitempty"` // ivars after an instance method
+}
+
+// methodDiff is the comparison of one method.
+type methodDiff struct {
+	Selector    string       `json:"selector"`
+	Kind        string       `json:"kind"`
+	Args        []string     `json:"args"`
+	Status      string       `json:"status"`           // same, differs or skipped
+	Reason      string       `json:"reason,omitempty"` // why it was skipped
+	Bash        *diffOutcome `json:"bash,omitempty"`
+	Go          *diffOutcome `json:"go,omitempty"`
+	Differences []string     `json:"differences,omitempty"`
+}
+
+// diffResult is the stdout document written by diff --json.
+type diffResult struct {
+	File    string       `json:"file"`
+	Class   string       `json:"class"`
+	Scratch string       `json:"scratch,omitempty"` // --keep
+	Methods []methodDiff `json:"methods"`
+}
+
+// cmdDiff runs each method of a file, or the given selector, through the
+// Bash backend and through the IR interpreter, which follows the Go
+// backend's semantics, starting from the same instance, and reports the
+// methods whose result or instance variables differ. The Go side keeps its
+// instances in a scratch instances.db; the Bash side runs the generated
+// functions with a prelude standing in for the Trashtalk runtime's _ivar,
+// _ivar_set and @, which keeps the instance in a JSON file next to it.
+func cmdDiff(flags diffFlags, args []string) error {
+	if len(args) < 1 {
+		return cli.Errorf(cli.ExitUsage, "usage: trash-compare diff [--instance JSON] [--keep] <file.trash> [selector [args...]]")
+	}
+	filename := args[0]
+	for _, tool := range []string{"bash", "jq"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return cli.Errorf(cli.ExitUsage, "%s not found on $PATH; the Bash side needs it", tool)
+		}
+	}
+
+	program, _, err := buildProgram(filename)
+	if err != nil {
+		return err
+	}
+	bashCode, err := codegen.NewBashBackend().Generate(program)
+	if err != nil {
+		return cli.Errorf(cli.ExitCodegen, "generating bash: %v", err)
+	}
+
+	methods := program.Methods
+	if len(args) > 1 {
+		methods = nil
+		for _, m := range program.Methods {
+			if mangle.Selector(m.Selector) == mangle.Selector(args[1]) {
+				methods = append(methods, m)
+			}
+		}
+		if len(methods) == 0 {
+			return cli.Errorf(cli.ExitUsage, "%s has no method %s", program.QualifiedName, args[1])
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "trash-compare-diff-")
+	if err != nil {
+		return fmt.Errorf("creating scratch directory: %w", err)
+	}
+	if *flags.keep {
+		cli.Logf("trash-compare: scratch directory %s", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	run, err := newDiffRun(program, dir, bashCode)
+	if err != nil {
+		return err
+	}
+	defer run.store.db.Close()
+
+	start := *flags.instance
+	if start == "" {
+		// Both sides start from the instance the Go side's new creates
+		id, err := run.interp.New()
+		if err != nil {
+			return fmt.Errorf("creating instance: %w", err)
+		}
+		if start, err = run.store.Load(id); err != nil {
+			return err
+		}
+	}
+
+	res := diffResult{File: filename, Class: program.QualifiedName}
+	if *flags.keep {
+		res.Scratch = dir
+	}
+	differ := 0
+	for i := range methods {
+		m := &methods[i]
+		sendArgs := sampleArgs(m, args[1:])
+		d := run.compare(m, sendArgs, start)
+		if d.Status == "differs" {
+			differ++
+		}
+		res.Methods = append(res.Methods, d)
+	}
+
+	if cli.JSON() {
+		res.Methods = append([]methodDiff{}, res.Methods...)
+		if err := cli.PrintJSON(res); err != nil {
+			return err
+		}
+	} else {
+		printDiff(res)
+	}
+	if differ > 0 {
+		if !cli.JSON() {
+			fmt.Printf("\n%d of %d methods differ\n", differ, len(res.Methods))
+		}
+		return cli.Exit(cli.ExitStale, nil)
+	}
+	return nil
+}
+
+// sampleArgs returns the arguments m is sent with: those given on the
+// command line after its selector, then "1" for each one missing
+func sampleArgs(m *ir.Method, given []string) []string {
+	var args []string
+	if len(given) > 0 {
+		args = append(args, given[1:]...)
+	}
+	for len(args) < len(m.Args) {
+		args = append(args, "1")
+	}
+	return args
+}
+
+// printDiff writes the comparison in the ✓/✗ layout of procyon's reports
+func printDiff(res diffResult) {
+	fmt.Printf("%s: %s\n", res.File, res.Class)
+	for _, d := range res.Methods {
+		name := mangle.TrashSelector(d.Selector)
+		if d.Kind == "class" {
+			name = "class " + name
+		}
+		switch d.Status {
+		case "same":
+			fmt.Printf("  ✓ %s\n", name)
+		case "skipped":
+			fmt.Printf("  - %s - skipped: %s\n", name, d.Reason)
+		default:
+			fmt.Printf("  ✗ %s %q\n", name, d.Args)
+			for _, diff := range d.Differences {
+				fmt.Printf("      %s\n", diff)
+			}
+		}
+	}
+}
+
+// diffRun holds the two sides of a comparison.
+type diffRun struct {
+	prog   *ir.Program
+	dir    string
+	store  *sqliteStorage
+	interp *ir.Interpreter
+	script string // the prelude and the class's Bash functions
+}
+
+// newDiffRun creates the scratch instances.db in dir and writes the Bash
+// side's script there
+func newDiffRun(prog *ir.Program, dir, bashCode string) (*diffRun, error) {
+	store, err := openScratchDB(filepath.Join(dir, "instances.db"))
+	if err != nil {
+		return nil, err
+	}
+	script := filepath.Join(dir, mangle.CompiledClass(prog.QualifiedName)+".bash")
+	if err := os.WriteFile(script, []byte(diffPrelude(prog)+bashCode), 0o644); err != nil {
+		store.db.Close()
+		return nil, err
+	}
+	return &diffRun{prog: prog, dir: dir, store: store, interp: ir.NewInterpreter(prog, store), script: script}, nil
+}
+
+// compare runs m with args on both sides, instance methods on a copy of the
+// instance start, and reports how the outcomes differ
+func (r *diffRun) compare(m *ir.Method, args []string, start string) methodDiff {
+	d := methodDiff{Selector: m.Selector, Kind: m.Kind.String(), Args: append([]string{}, args...)}
+	if m.IsRaw {
+		d.Status, d.Reason = "skipped", "raw method, Bash only"
+		return d
+	}
+
+	// Each method starts from the same state, under the same ID
+	id := mangle.InstanceIDPrefix(r.prog.QualifiedName) + "_diff"
+	if m.Kind == ir.InstanceMethod {
+		if err := r.store.Save(id, start); err != nil {
+			d.Status, d.Reason = "skipped", err.Error()
+			return d
+		}
+	}
+
+	goSide, reason := r.runGo(m, id, args)
+	if reason != "" {
+		d.Status, d.Reason = "skipped", "the Go backend leaves it to Bash: "+reason
+		return d
+	}
+	bashSide, reason := r.runBash(m, id, args, start)
+	if reason != "" {
+		d.Status, d.Reason = "skipped", reason
+		return d
+	}
+	d.Go, d.Bash = goSide, bashSide
+
+	switch {
+	case (goSide.Error == "") != (bashSide.Error == ""):
+		d.Differences = append(d.Differences, fmt.Sprintf("error: bash %q, go %q", bashSide.Error, goSide.Error))
+	case goSide.Error == "" && goSide.Result != bashSide.Result:
+		d.Differences = append(d.Differences, fmt.Sprintf("result: bash %q, go %q", bashSide.Result, goSide.Result))
+	}
+	for _, iv := range r.prog.InstanceVars {
+		if m.Kind != ir.InstanceMethod || goSide.Error != "" || bashSide.Error != "" {
+			break
+		}
+		if b, g := bashSide.Instance[iv.Name], goSide.Instance[iv.Name]; b != g {
+			d.Differences = append(d.Differences, fmt.Sprintf("%s: bash %q, go %q", iv.Name, b, g))
+		}
+	}
+	d.Status = "same"
+	if len(d.Differences) > 0 {
+		d.Status = "differs"
+	}
+	return d
+}
+
+// runGo runs m with the IR interpreter. It returns the reason instead when
+// the Go backend would leave the method to Bash.
+func (r *diffRun) runGo(m *ir.Method, id string, args []string) (*diffOutcome, string) {
+	var result string
+	var err error
+	if m.Kind == ir.ClassMethod {
+		result, err = r.interp.SendClass(m.Selector, args)
+	} else {
+		result, err = r.interp.Send(id, m.Selector, args)
+	}
+
+	var bashErr *ir.BashError
+	switch {
+	case errors.As(err, &bashErr):
+		return nil, bashErr.Reason
+	case errors.Is(err, ir.ErrUnknownSelector):
+		return nil, err.Error()
+	case err != nil:
+		return &diffOutcome{Error: err.Error()}, ""
+	}
+	out := &diffOutcome{Result: result}
+	if m.Kind == ir.InstanceMethod {
+		data, err := r.store.Load(id)
+		if err != nil {
+			return &diffOutcome{Error: err.Error()}, ""
+		}
+		out.Instance = r.ivars(data)
+	}
+	return out, ""
+}
+
+// runBash runs m's Bash function with the instance start in the Bash side's
+// instance file. It returns the reason instead when the method sends to
+// something the prelude cannot stand in for.
+func (r *diffRun) runBash(m *ir.Method, id string, args []string, start string) (*diffOutcome, string) {
+	state := filepath.Join(r.dir, "instance.json")
+	needs := filepath.Join(r.dir, "needs-runtime")
+	os.Remove(needs)
+	if err := os.WriteFile(state, []byte(start), 0o644); err != nil {
+		return nil, err.Error()
+	}
+	receiver := id
+	if m.Kind == ir.ClassMethod {
+		receiver = r.prog.QualifiedName
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diffTimeout)
+	defer cancel()
+	fn := mangle.BashFunction(r.prog.QualifiedName, m.Selector, m.Kind == ir.ClassMethod)
+	cmd := exec.CommandContext(ctx, "bash", append([]string{"-c", `source "$1" && shift && "$@"`, "bash", r.script, fn}, args...)...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), "_RECEIVER="+receiver, "__TRASH_STATE="+state, "__TRASH_NEEDS="+needs)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	runErr := cmd.Run()
+
+	if data, err := os.ReadFile(needs); err == nil {
+		return nil, "the Bash side needs the Trashtalk runtime: " + strings.TrimSpace(string(data))
+	}
+	out := &diffOutcome{Result: strings.TrimSuffix(stdout.String(), "\n")}
+	if runErr != nil {
+		out.Error = runErr.Error()
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			out.Error += ": " + lastLine(msg)
+		}
+		return out, ""
+	}
+	if m.Kind == ir.InstanceMethod {
+		data, err := os.ReadFile(state)
+		if err != nil {
+			return &diffOutcome{Error: err.Error()}, ""
+		}
+		out.Instance = r.ivars(string(data))
+	}
+	return out, ""
+}
+
+// ivars returns the instance variables in instance JSON data as the strings
+// both runtimes print them as: scalars as they are, arrays and objects as
+// compact JSON, whether they are stored decoded or as JSON text
+func (r *diffRun) ivars(data string) map[string]string {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil
+	}
+	vars := make(map[string]string, len(r.prog.InstanceVars))
+	for _, iv := range r.prog.InstanceVars {
+		vars[iv.Name] = canonicalValue(fields[iv.Name])
+	}
+	return vars
+}
+
+// canonicalValue returns the string form of a stored instance variable
+func canonicalValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		trimmed := strings.TrimSpace(x)
+		if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+			var decoded interface{}
+			if json.Unmarshal([]byte(trimmed), &decoded) == nil {
+				return canonicalValue(decoded)
+			}
+		}
+		return x
+	case json.Number:
+		return x.String()
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// lastLine returns the last line of s
+func lastLine(s string) string {
+	return s[strings.LastIndex(s, "\n")+1:]
+}
+
+// diffPrelude returns the Bash functions the generated code calls into the
+// Trashtalk runtime for. Instance variables live in the JSON file
+// $__TRASH_STATE, so assignments made in $(...) subshells persist as they
+// do in instances.db. @ runs the class's own methods on the receiver or the
+// class, and records any other send in $__TRASH_NEEDS, since only the real
+// runtime can answer it.
+func diffPrelude(prog *ir.Program) string {
+	class := mangle.CompiledClass(prog.QualifiedName)
+	names := []string{prog.Name, prog.QualifiedName}
+	sort.Strings(names)
+	return fmt.Sprintf(`#!/usr/bin/env bash
+# trash-compare diff: stand-ins for the Trashtalk runtime
+
+_ivar() {
+  jq -r --arg k "$1" '.[$k] | if type == "string" then . elif . == null then "" else tojson end' "$__TRASH_STATE"
+}
+
+_ivar_set() {
+  local __next__
+  __next__=$(jq -c --arg k "$1" --arg v "$2" '.[$k] = $v' "$__TRASH_STATE") && printf '%%s\n' "$__next__" > "$__TRASH_STATE"
+}
+
+@() {
+  local __receiver__="$1" __selector__="$2"
+  shift 2
+  if [[ "$__receiver__" == "$_RECEIVER" ]] && declare -F "__%[1]s__$__selector__" > /dev/null; then
+    "__%[1]s__$__selector__" "$@"
+    return
+  fi
+  if [[ "$__receiver__" == %[2]q || "$__receiver__" == %[3]q ]] && declare -F "__%[1]s__class__$__selector__" > /dev/null; then
+    "__%[1]s__class__$__selector__" "$@"
+    return
+  fi
+  echo "@ $__receiver__ $__selector__" >> "$__TRASH_NEEDS"
+  return 200
+}
+
+`, class, names[0], names[1])
+}
+
+// sqliteStorage is an ir.Storage on the instances table of an SQLite
+// database, laid out as the Trashtalk runtime and generated binaries use it
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// openScratchDB creates the instances database at path
+func openScratchDB(path string) (*sqliteStorage, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS instances (id TEXT PRIMARY KEY, data JSON NOT NULL)"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating instances table: %w", err)
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+// Load returns the instance JSON saved as id
+func (s *sqliteStorage) Load(id string) (string, error) {
+	var data string
+	err := s.db.QueryRow("SELECT data FROM instances WHERE id = ?", id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("instance %s not found", id)
+	}
+	return data, err
+}
+
+// Save stores data as id
+func (s *sqliteStorage) Save(id, data string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO instances (id, data) VALUES (?, json(?))", id, data)
+	return err
+}
+
+// Delete removes id
+func (s *sqliteStorage) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM instances WHERE id = ?", id)
+	return err
+}
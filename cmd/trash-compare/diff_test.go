@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+const counterSource = `Counter subclass: Object
+  instanceVars: value:0
+
+  method: increment [
+    value := value + 1.
+    ^ value
+  ]
+
+  method: add: n [
+    value := value + n.
+    ^ value
+  ]
+
+  rawMethod: shout [
+    echo LOUD
+  ]
+
+  classMethod: answer [
+    ^ 42
+  ]
+`
+
+// buildTrashCompare builds trash-compare into a temporary directory and
+// returns the path of the binary
+func buildTrashCompare(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds trash-compare")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+	bin := filepath.Join(t.TempDir(), "trash-compare")
+	if out, err := exec.Command(goTool, "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// runTrashCompare runs bin with args in dir and answers its stdout and
+// exit code
+func runTrashCompare(t *testing.T, bin, dir string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	code := 0
+	var exit *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exit) {
+		code = exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if stderr.Len() > 0 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return stdout.String(), code
+}
+
+// writeTrash writes the .trash files named in files into a new temp dir,
+// creating their directories, and returns it
+func writeTrash(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func needDiffTools(t *testing.T) {
+	t.Helper()
+	for _, tool := range []string{"bash", "jq"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+}
+
+func TestDiffOutput(t *testing.T) {
+	needDiffTools(t)
+	bin := buildTrashCompare(t)
+	dir := writeTrash(t, map[string]string{"Counter.trash": counterSource})
+
+	out, code := runTrashCompare(t, bin, dir, "diff", "Counter.trash")
+	want := `Counter.trash: Counter
+  ✓ increment
+  ✓ add:
+  - shout - skipped: raw method, Bash only
+  ✓ class answer
+`
+	if code != 0 || out != want {
+		t.Errorf("diff exited %d with\n%s\nwant 0 with\n%s", code, out, want)
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	needDiffTools(t)
+	bin := buildTrashCompare(t)
+	dir := writeTrash(t, map[string]string{"Counter.trash": counterSource})
+
+	out, code := runTrashCompare(t, bin, dir, "diff", "--json", "--instance", `{"value":"7"}`, "Counter.trash", "add:", "3")
+	if code != 0 {
+		t.Fatalf("diff exited %d:\n%s", code, out)
+	}
+	var res diffResult
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		t.Fatalf("decoding %s: %v", out, err)
+	}
+	if res.File != "Counter.trash" || res.Class != "Counter" || len(res.Methods) != 1 {
+		t.Fatalf("diff answered %+v, want the one method add: of Counter", res)
+	}
+	d := res.Methods[0]
+	if d.Selector != "add_" || d.Kind != "instance" || !slices.Equal(d.Args, []string{"3"}) || d.Status != "same" {
+		t.Errorf("add: compared as %+v", d)
+	}
+	want := diffOutcome{Result: "10", Instance: map[string]string{"value": "10"}}
+	for side, got := range map[string]*diffOutcome{"bash": d.Bash, "go": d.Go} {
+		if got == nil || got.Result != want.Result || got.Error != "" || !maps.Equal(got.Instance, want.Instance) {
+			t.Errorf("%s side answered %+v, want %+v", side, got, want)
+		}
+	}
+}
+
+func TestDiffUnknownSelector(t *testing.T) {
+	needDiffTools(t)
+	bin := buildTrashCompare(t)
+	dir := writeTrash(t, map[string]string{"Counter.trash": counterSource})
+
+	if _, code := runTrashCompare(t, bin, dir, "diff", "Counter.trash", "decrement"); code != 1 {
+		t.Errorf("diff of an unknown selector exited %d, want 1", code)
+	}
+}
+
+// TestDiffReportsDifferences runs the comparison on a Bash side whose
+// increment is replaced by one that adds 5, so it differs in the result and
+// in the instance it leaves
+func TestDiffReportsDifferences(t *testing.T) {
+	needDiffTools(t)
+	dir := writeTrash(t, map[string]string{"Counter.trash": counterSource})
+	prog, _, err := buildProgram(filepath.Join(dir, "Counter.trash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bashCode, err := codegen.NewBashBackend().Generate(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bashCode += "\n" + mangle.BashFunction("Counter", "increment", false) + `() {
+  _ivar_set value 5
+  echo 5
+}
+`
+	run, err := newDiffRun(prog, dir, bashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer run.store.db.Close()
+
+	res := diffResult{File: "Counter.trash", Class: "Counter"}
+	for i := range prog.Methods {
+		m := &prog.Methods[i]
+		res.Methods = append(res.Methods, run.compare(m, sampleArgs(m, nil), `{"value":"0"}`))
+	}
+	d := res.Methods[0]
+	wantDiffs := []string{`result: bash "5", go "1"`, `value: bash "5", go "1"`}
+	if d.Selector != "increment" || d.Status != "differs" || !slices.Equal(d.Differences, wantDiffs) {
+		t.Errorf("increment compared as %+v, want differences %q", d, wantDiffs)
+	}
+
+	out := captureStdout(t, func() { printDiff(res) })
+	want := `Counter.trash: Counter
+  ✗ increment []
+      result: bash "5", go "1"
+      value: bash "5", go "1"
+  ✓ add:
+  - shout - skipped: raw method, Bash only
+  ✓ class answer
+`
+	if out != want {
+		t.Errorf("printDiff wrote\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestCanonicalValue(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want string
+	}{
+		{nil, ""},
+		{"abc", "abc"},
+		{json.Number("12"), "12"},
+		{"[1, 2]", "[1,2]"},
+		{` {"a": [true]}`, `{"a":[true]}`},
+		{"[not json", "[not json"},
+		{[]interface{}{"x", 1.5}, `["x",1.5]`},
+	}
+	for _, tt := range tests {
+		if got := canonicalValue(tt.in); got != tt.want {
+			t.Errorf("canonicalValue(%#v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// captureStdout returns what fn writes to os.Stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	w.Close()
+	return string(<-done)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+// lintProblem is one problem found by lint.
+type lintProblem struct {
+	File    string `json:"file"`
+	Class   string `json:"class"`
+	Message string `json:"message"`
+}
+
+// lintResult is the stdout document written by lint --json.
+type lintResult struct {
+	Problems []lintProblem `json:"problems"`
+}
+
+// lintCommand returns the lint subcommand.
+func lintCommand() *cli.Command {
+	return &cli.Command{
+		Name:     "lint",
+		Usage:    "<file.trash>...",
+		Short:    "Check that concrete classes implement the abstract methods they inherit",
+		Args:     cli.AnyArgs,
+		ArgFiles: "*.trash",
+		Run:      cmdLint,
+	}
+}
+
+// lintClass is a parsed class and the file it came from.
+type lintClass struct {
+	class *ast.Class
+	file  string
+}
+
+// cmdLint reports the abstract selectors (abstractMethod:) that each
+// concrete class leaves unimplemented. Superclasses and traits are taken
+// from the given files, or else looked up as Name.trash next to the file
+// that names them.
+func cmdLint(files []string) error {
+	if len(files) == 0 {
+		return cli.Errorf(cli.ExitUsage, "usage: trash-compare lint <file.trash>...")
+	}
+
+	classes := map[string]*lintClass{}
+	var order []*lintClass
+	for _, file := range files {
+		class, err := source.ParseFile(file)
+		if err != nil {
+			return cli.Errorf(cli.ExitParse, "%s: %v", file, err)
+		}
+		lc := &lintClass{class, file}
+		classes[class.Name] = lc
+		classes[class.QualifiedName()] = lc
+		order = append(order, lc)
+	}
+
+	// lookup finds a class by name in the given files or next to from
+	lookup := func(name, from string) (*lintClass, error) {
+		if lc, ok := classes[name]; ok {
+			return lc, nil
+		}
+		path, ok := source.FindTrait([]string{filepath.Dir(from)}, name)
+		if !ok {
+			return nil, nil
+		}
+		class, err := source.ParseFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		lc := &lintClass{class, path}
+		classes[name] = lc
+		return lc, nil
+	}
+
+	var problems []lintProblem
+	for _, lc := range order {
+		if lc.class.IsTrait || lc.class.IsAbstract {
+			continue
+		}
+		implemented := map[string]bool{}
+		var abstract []string
+		declaredBy := map[string]string{}
+		add := func(c *ast.Class) {
+			for _, m := range c.Methods {
+				if m.Kind != "class" {
+					implemented[m.Selector] = true
+				}
+			}
+			for _, sel := range c.AbstractMethods {
+				if _, ok := declaredBy[sel]; !ok {
+					declaredBy[sel] = c.QualifiedName()
+					abstract = append(abstract, sel)
+				}
+			}
+		}
+
+		seen := map[*ast.Class]bool{}
+		for current := lc; current != nil && !seen[current.class]; {
+			seen[current.class] = true
+			add(current.class)
+			for _, name := range current.class.Traits {
+				trait, err := lookup(name, current.file)
+				if err != nil {
+					return cli.Errorf(cli.ExitParse, "%v", err)
+				}
+				if trait != nil {
+					add(trait.class)
+				}
+			}
+
+			parent := current.class.Parent
+			if parent == "" || parent == "Object" {
+				break
+			}
+			next, err := lookup(parent, current.file)
+			if err != nil {
+				return cli.Errorf(cli.ExitParse, "%v", err)
+			}
+			if next == nil {
+				fmt.Fprintf(os.Stderr, "%s: warning: superclass %s of %s not found; its abstract methods are not checked\n",
+					lc.file, parent, lc.class.QualifiedName())
+			}
+			current = next
+		}
+
+		for _, sel := range abstract {
+			if !implemented[sel] {
+				problems = append(problems, lintProblem{lc.file, lc.class.QualifiedName(),
+					fmt.Sprintf("does not implement %s>>%s", declaredBy[sel], mangle.TrashSelector(sel))})
+			}
+		}
+	}
+
+	if cli.JSON() {
+		if err := cli.PrintJSON(lintResult{Problems: append([]lintProblem{}, problems...)}); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Printf("%s: %s %s\n", p.File, p.Class, p.Message)
+		}
+	}
+	if len(problems) > 0 {
+		return cli.Exit(cli.ExitCodegen, nil)
+	}
+	return nil
+}
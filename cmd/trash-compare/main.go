@@ -7,99 +7,123 @@
 //
 //	trash-compare tokenize <file.trash>    # Output JSON tokens (same format as jq-compiler)
 //	trash-compare parse <file.trash>       # Output JSON AST
+//	trash-compare ir <file.trash>          # Output the optimized IR as JSON
 //	trash-compare bash <file.trash>        # Output compiled Bash (via bash_backend)
+//	trash-compare bash --recursive <dir>   # Compile every .trash file under dir (also tokenize, parse, ir)
+//	trash-compare ir-run <file.trash> <selector> [args...]
+//	                                       # Run a selector with the IR interpreter
+//	trash-compare diff <file.trash> [selector [args...]]
+//	                                       # Compare the Bash backend with the Go semantics
+//	trash-compare lint <file.trash>...     # Check abstract methods are implemented
+//	trash-compare mangle [name...]         # Output the mangling corpus or a name's forms
 package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 
-	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
 	"github.com/chazu/procyon/pkg/codegen"
 	"github.com/chazu/procyon/pkg/ir"
 	"github.com/chazu/procyon/pkg/lexer"
 	"github.com/chazu/procyon/pkg/parser"
+	"github.com/chazu/procyon/pkg/protocol"
+	"github.com/chazu/procyon/pkg/source"
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
+	root := &cli.Command{
+		Name:  "trash-compare",
+		Short: "Compare jq-compiler and Procyon compiler outputs",
+		Examples: []string{
+			"trash-compare tokenize Counter.trash",
+			"trash-compare parse Counter.trash | jq .",
+			"trash-compare ir Counter.trash > Counter.ir.json",
+			"trash-compare bash Counter.trash > Counter.bash",
+			"trash-compare ir-run Counter.ir.json increment",
+			"trash-compare bash --recursive --out-dir build/ lib/",
+			"trash-compare ir-run --instance '{\"value\":\"5\"}' Counter.trash increment",
+			"trash-compare diff Counter.trash",
+			"trash-compare diff --instance '{\"value\":\"5\"}' Counter.trash add: 3",
+			"trash-compare lint Shape.trash Circle.trash",
+			"trash-compare mangle > mangle-corpus.json",
+			"trash-compare mangle MyApp::Counter at:put:",
+		},
+		Commands: []*cli.Command{
+			fileCommand("tokenize", "Output JSON tokens (same format as jq-compiler)", cmdTokenize, tokenizeStage),
+			fileCommand("parse", "Output JSON AST", cmdParse, parseStage),
+			fileCommand("ir", "Output the optimized IR as JSON", cmdIR, irStage),
+			fileCommand("bash", "Output compiled Bash (via bash_backend)", cmdBash, bashStage),
+			irRunCommand(),
+			diffCommand(),
+			lintCommand(),
+			mangleCommand(),
+		},
 	}
+	root.Execute()
+}
 
-	command := os.Args[1]
-
-	switch command {
-	case "tokenize":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: missing file argument")
-			printUsage()
-			os.Exit(1)
-		}
-		if err := cmdTokenize(os.Args[2]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
-
-	case "parse":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: missing file argument")
-			printUsage()
-			os.Exit(1)
-		}
-		if err := cmdParse(os.Args[2]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
-
-	case "bash":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "Error: missing file argument")
-			printUsage()
-			os.Exit(1)
-		}
-		if err := cmdBash(os.Args[2]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
-
-	case "-h", "--help", "help":
-		printUsage()
-
-	default:
-		fmt.Fprintf(os.Stderr, "Error: unknown command '%s'\n", command)
-		printUsage()
-		os.Exit(1)
+// irRunCommand returns the ir-run subcommand.
+func irRunCommand() *cli.Command {
+	var flags irRunFlags
+	return &cli.Command{
+		Name:     "ir-run",
+		Usage:    "[--instance JSON] <file.trash> <selector> [args...]",
+		Short:    "Run a selector with the IR interpreter and output a --serve response",
+		Args:     cli.AnyArgs,
+		ArgFiles: "*.trash",
+		Flags: func(fs *flag.FlagSet) {
+			flags.instance = fs.String("instance", "", "instance JSON to run an instance method on (default: a new instance)")
+			flags.id = fs.String("id", "ir-run", "ID of the --instance instance")
+		},
+		Run: func(args []string) error {
+			return cmdIRRun(flags, args)
+		},
 	}
 }
 
-func printUsage() {
-	fmt.Println(`trash-compare - Compare jq-compiler and Procyon compiler outputs
-
-Usage:
-  trash-compare tokenize <file.trash>    Output JSON tokens (same format as jq-compiler)
-  trash-compare parse <file.trash>       Output JSON AST
-  trash-compare bash <file.trash>        Output compiled Bash (via bash_backend)
-  trash-compare help                     Show this help message
-
-Examples:
-  trash-compare tokenize Counter.trash
-  trash-compare parse Counter.trash | jq .
-  trash-compare bash Counter.trash > Counter.bash`)
+// fileCommand returns a subcommand that runs fn on a single .trash file, or
+// with --recursive runs stage on every .trash file under a directory.
+func fileCommand(name, short string, fn func(filename string) error, stage batchStage) *cli.Command {
+	var flags batchFlags
+	return &cli.Command{
+		Name:     name,
+		Usage:    "[--recursive [--out-dir DIR] [--jobs N]] <file.trash|dir>",
+		Short:    short,
+		Args:     1,
+		ArgFiles: "*.trash",
+		Flags: func(fs *flag.FlagSet) {
+			flags.recursive = fs.Bool("recursive", false, "process every .trash file under the directory, in parallel, writing Name"+stage.ext+" next to each, and print a summary")
+			flags.outDir = fs.String("out-dir", "", "with --recursive, write the outputs under this directory at the paths of their sources instead")
+			flags.jobs = fs.Int("jobs", 0, "with --recursive, files processed at once (default the number of CPUs)")
+		},
+		Run: func(args []string) error {
+			if *flags.recursive {
+				return runBatch(name, stage, flags, args[0])
+			}
+			if *flags.outDir != "" || *flags.jobs != 0 {
+				return cli.Errorf(cli.ExitUsage, "--out-dir and --jobs need --recursive")
+			}
+			return fn(args[0])
+		},
+	}
 }
 
 // cmdTokenize reads a file and outputs JSON tokens.
 func cmdTokenize(filename string) error {
 	content, err := os.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("reading file: %w", err)
+		return cli.Errorf(cli.ExitUsage, "reading file: %v", err)
 	}
 
 	lex := lexer.New(string(content))
 	jsonOutput, err := lex.TokenizeJSON()
 	if err != nil {
-		return fmt.Errorf("tokenizing: %w", err)
+		return cli.Errorf(cli.ExitParse, "tokenizing: %v", err)
 	}
 
 	fmt.Println(jsonOutput)
@@ -110,21 +134,13 @@ func cmdTokenize(filename string) error {
 func cmdParse(filename string) error {
 	content, err := os.ReadFile(filename)
 	if err != nil {
-		return fmt.Errorf("reading file: %w", err)
+		return cli.Errorf(cli.ExitUsage, "reading file: %v", err)
 	}
 
-	// Tokenize
-	lex := lexer.New(string(content))
-	tokens, err := lex.Tokenize()
+	classAST, parseErrors, err := parseSource(string(content))
 	if err != nil {
-		return fmt.Errorf("tokenizing: %w", err)
+		return err
 	}
-
-	// Convert lexer tokens to parser tokens
-	parserTokens := convertTokens(tokens)
-
-	// Parse
-	classAST, parseErrors := parser.ParseClass(parserTokens)
 	if len(parseErrors) > 0 {
 		// Output parse errors as JSON
 		result := map[string]interface{}{
@@ -136,7 +152,8 @@ func cmdParse(filename string) error {
 		}
 		jsonOutput, _ := json.MarshalIndent(result, "", "  ")
 		fmt.Println(string(jsonOutput))
-		return nil
+		// The errors are already on stdout
+		return cli.Exit(cli.ExitParse, nil)
 	}
 
 	// Marshal AST to JSON
@@ -149,195 +166,208 @@ func cmdParse(filename string) error {
 	return nil
 }
 
+// bashResult is the stdout document written by bash --json.
+type bashResult struct {
+	ExitCode int      `json:"exit_code"`
+	Code     string   `json:"code"`
+	Warnings []string `json:"warnings"`
+}
+
 // cmdBash reads a file, tokenizes, parses, builds IR, and outputs compiled Bash.
 func cmdBash(filename string) error {
-	content, err := os.ReadFile(filename)
+	program, warnings, err := buildProgram(filename)
 	if err != nil {
-		return fmt.Errorf("reading file: %w", err)
+		return err
 	}
 
-	// Tokenize
-	lex := lexer.New(string(content))
-	tokens, err := lex.Tokenize()
+	// Generate Bash code
+	backend := codegen.NewBashBackend()
+	output, err := backend.Generate(program)
 	if err != nil {
-		return fmt.Errorf("tokenizing: %w", err)
+		return cli.Errorf(cli.ExitCodegen, "generating bash: %v", err)
 	}
 
-	// Convert lexer tokens to parser tokens
-	parserTokens := convertTokens(tokens)
+	if cli.JSON() {
+		return cli.PrintJSON(bashResult{Code: output, Warnings: append([]string{}, warnings...)})
+	}
+	fmt.Print(output)
+	return nil
+}
 
-	// Parse to ClassAST
-	classAST, parseErrors := parser.ParseClass(parserTokens)
-	if len(parseErrors) > 0 {
-		for _, pe := range parseErrors {
-			fmt.Fprintf(os.Stderr, "Parse error: %s\n", pe.Error())
-		}
-		return fmt.Errorf("parsing failed with %d errors", len(parseErrors))
+// cmdIR reads a file, tokenizes, parses, builds IR, and outputs it as JSON.
+func cmdIR(filename string) error {
+	program, _, err := buildProgram(filename)
+	if err != nil {
+		return err
 	}
+	jsonOutput, err := json.MarshalIndent(program, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling IR: %w", err)
+	}
+	fmt.Println(string(jsonOutput))
+	return nil
+}
 
-	// Convert ClassAST to ast.Class for IR builder
-	astClass := convertClassASTToAstClass(classAST)
+// buildProgram reads a file, tokenizes, parses, and builds its IR. A file
+// ending .ir.json is the IR itself, as trash-compare ir writes it.
+func buildProgram(filename string) (*ir.Program, []string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, cli.Errorf(cli.ExitUsage, "reading file: %v", err)
+	}
+	if strings.HasSuffix(filename, ".ir.json") {
+		program := &ir.Program{}
+		if err := json.Unmarshal(content, program); err != nil {
+			return nil, nil, cli.Errorf(cli.ExitParse, "reading IR: %v", err)
+		}
+		return program, nil, nil
+	}
 
-	// Build IR
-	builder := ir.NewBuilder(astClass)
-	program, warnings, errors := builder.Build()
+	program, warnings, err := programFromSource(string(content))
+	var se *sourceError
+	if errors.As(err, &se) && se.code == cli.ExitParse {
+		for _, msg := range se.messages {
+			fmt.Fprintf(os.Stderr, "Parse error: %s\n", msg)
+		}
+		return nil, nil, cli.Errorf(cli.ExitParse, "parsing failed with %d errors", len(se.messages))
+	}
 
 	// Print warnings
 	for _, w := range warnings {
-		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+		cli.Logf("Warning: %s", w)
 	}
 
-	// Check for errors
-	if len(errors) > 0 {
-		for _, e := range errors {
-			fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+	if errors.As(err, &se) {
+		for _, msg := range se.messages {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", msg)
 		}
-		return fmt.Errorf("IR building failed with %d errors", len(errors))
+		return nil, nil, cli.Errorf(cli.ExitCodegen, "IR building failed with %d errors", len(se.messages))
 	}
-
-	// Generate Bash code
-	backend := codegen.NewBashBackend()
-	output, err := backend.Generate(program)
 	if err != nil {
-		return fmt.Errorf("generating bash: %w", err)
+		return nil, nil, err
 	}
+	return program, warnings, nil
+}
 
-	fmt.Print(output)
-	return nil
+// sourceError reports the parse errors (code cli.ExitParse) or IR errors
+// (cli.ExitCodegen) of a source file.
+type sourceError struct {
+	code     int
+	messages []string
 }
 
-// convertTokens converts lexer.Token slice to parser.Token slice.
-func convertTokens(tokens []lexer.Token) []parser.Token {
-	result := make([]parser.Token, len(tokens))
-	for i, t := range tokens {
-		result[i] = parser.Token{
-			Type:  parser.TokenType(t.Type),
-			Value: t.Value,
-			Line:  t.Line,
-			Col:   t.Column,
-		}
-	}
-	return result
+func (e *sourceError) Error() string {
+	return strings.Join(e.messages, "; ")
 }
 
-// convertClassASTToAstClass converts parser.ClassAST to ast.Class for the IR builder.
-func convertClassASTToAstClass(classAST *parser.ClassAST) *ast.Class {
-	if classAST == nil {
-		return nil
+// parseSource tokenizes and parses the source of a class. Parse errors are
+// returned with the partial AST; err is set if the source does not tokenize.
+func parseSource(content string) (*parser.ClassAST, []parser.ParseError, error) {
+	// Tokenize
+	lex := lexer.New(content)
+	tokens, err := lex.Tokenize()
+	if err != nil {
+		return nil, nil, cli.Errorf(cli.ExitParse, "tokenizing: %v", err)
 	}
 
-	// Import the ast package
-	astClass := &ast.Class{
-		Type:               classAST.Type,
-		Name:               classAST.Name,
-		Parent:             classAST.Parent,
-		Package:            classAST.Package,
-		Imports:            classAST.Imports,
-		IsTrait:            classAST.IsTrait,
-		Traits:             classAST.Traits,
-		Requires:           classAST.Requires,
-		MethodRequirements: classAST.MethodRequirements,
-		Location: ast.Location{
-			Line: classAST.Location.Line,
-			Col:  classAST.Location.Col,
-		},
-	}
+	// Convert lexer tokens to parser tokens and parse
+	classAST, parseErrors := parser.ParseClass(source.ParserTokens(tokens))
+	return classAST, parseErrors, nil
+}
 
-	// Convert instance variables
-	for _, v := range classAST.InstanceVars {
-		ivar := ast.InstanceVar{
-			Name: v.Name,
-			Location: ast.Location{
-				Line: v.Location.Line,
-				Col:  v.Location.Col,
-			},
-		}
-		if v.Default != nil {
-			ivar.Default = ast.DefaultValue{
-				Type:  v.Default.Type,
-				Value: v.Default.Value,
-			}
+// programFromSource parses the source of a class and builds its IR. Parse
+// and IR errors are returned as a *sourceError, after the warnings.
+func programFromSource(content string) (*ir.Program, []string, error) {
+	classAST, parseErrors, err := parseSource(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(parseErrors) > 0 {
+		se := &sourceError{code: cli.ExitParse}
+		for _, pe := range parseErrors {
+			se.messages = append(se.messages, pe.Error())
 		}
-		astClass.InstanceVars = append(astClass.InstanceVars, ivar)
+		return nil, nil, se
 	}
 
-	// Convert class instance variables
-	for _, v := range classAST.ClassInstanceVars {
-		cvar := ast.InstanceVar{
-			Name: v.Name,
-			Location: ast.Location{
-				Line: v.Location.Line,
-				Col:  v.Location.Col,
-			},
-		}
-		if v.Default != nil {
-			cvar.Default = ast.DefaultValue{
-				Type:  v.Default.Type,
-				Value: v.Default.Value,
-			}
-		}
-		astClass.ClassInstanceVars = append(astClass.ClassInstanceVars, cvar)
+	// Convert ClassAST to ast.Class for IR builder and build IR
+	builder := ir.NewBuilder(source.ToAST(classAST))
+	program, warnings, errs := builder.Build()
+	if len(errs) > 0 {
+		return nil, warnings, &sourceError{code: cli.ExitCodegen, messages: errs}
 	}
+	ir.Optimize(program)
+	return program, warnings, nil
+}
 
-	// Convert methods
-	for _, m := range classAST.Methods {
-		method := ast.Method{
-			Type:     m.Type,
-			Kind:     m.Kind,
-			Raw:      m.Raw,
-			Selector: m.Selector,
-			Keywords: m.Keywords,
-			Args:     m.Args,
-			Pragmas:  m.Pragmas,
-			Location: ast.Location{
-				Line: m.Location.Line,
-				Col:  m.Location.Col,
-			},
-		}
+// irRunFlags are the flags of the ir-run subcommand.
+type irRunFlags struct {
+	instance *string
+	id       *string
+}
 
-		// Convert body tokens
-		method.Body = ast.Block{
-			Type: m.Body.Type,
-		}
-		for _, t := range m.Body.Tokens {
-			method.Body.Tokens = append(method.Body.Tokens, ast.Token{
-				Type:  string(t.Type),
-				Value: t.Value,
-				Line:  t.Line,
-				Col:   t.Col,
-			})
-		}
+// cmdIRRun builds a file's IR and runs one selector with the IR interpreter,
+// printing the result as a --serve response so it can be compared with a
+// compiled binary's.
+func cmdIRRun(flags irRunFlags, args []string) error {
+	if len(args) < 2 {
+		return cli.Errorf(cli.ExitUsage, "usage: trash-compare ir-run [--instance JSON] <file.trash> <selector> [args...]")
+	}
+	filename, selector, sendArgs := args[0], args[1], args[2:]
 
-		astClass.Methods = append(astClass.Methods, method)
+	program, _, err := buildProgram(filename)
+	if err != nil {
+		return err
 	}
 
-	// Convert aliases
-	for _, a := range classAST.Aliases {
-		astClass.Aliases = append(astClass.Aliases, ast.Alias{
-			From: a.AliasName,
-			To:   a.OriginalMethod,
-		})
+	store := ir.NewMemoryStorage()
+	interp := ir.NewInterpreter(program, store)
+
+	// Class methods run on the class unless an instance is supplied;
+	// instance methods run on the supplied instance or a new one
+	classMethod := false
+	for _, m := range program.Methods {
+		if m.Selector == selector && m.Kind == ir.ClassMethod {
+			classMethod = true
+		}
 	}
 
-	// Convert advice
-	for _, adv := range classAST.Advice {
-		advice := ast.Advice{
-			Type:     adv.AdviceType,
-			Selector: adv.Selector,
+	var resp protocol.ServeResponse
+	var result string
+	switch {
+	case *flags.instance != "":
+		if err = store.Save(*flags.id, *flags.instance); err == nil {
+			result, err = interp.Send(*flags.id, selector, sendArgs)
 		}
-		advice.Body = ast.Block{
-			Type: adv.Block.Type,
+	case classMethod || selector == "new":
+		result, err = interp.SendClass(selector, sendArgs)
+	default:
+		var id string
+		if id, err = interp.New(); err == nil {
+			*flags.id = id
+			result, err = interp.Send(id, selector, sendArgs)
 		}
-		for _, t := range adv.Block.Tokens {
-			advice.Body.Tokens = append(advice.Body.Tokens, ast.Token{
-				Type:  string(t.Type),
-				Value: t.Value,
-				Line:  t.Line,
-				Col:   t.Col,
-			})
+	}
+
+	var bashErr *ir.BashError
+	switch {
+	case err == nil:
+		resp.Result = result
+		if !classMethod && selector != "new" {
+			resp.Instance, _ = store.Load(*flags.id)
 		}
-		astClass.Advice = append(astClass.Advice, advice)
+	case errors.As(err, &bashErr), errors.Is(err, ir.ErrUnknownSelector):
+		resp.ExitCode = protocol.ExitUnknownSelector
+		resp.Error = err.Error()
+	default:
+		resp.ExitCode = protocol.ExitError
+		resp.Error = err.Error()
 	}
 
-	return astClass
+	data, _ := json.Marshal(resp)
+	fmt.Println(string(data))
+	if resp.ExitCode != protocol.ExitOK {
+		return cli.Exit(resp.ExitCode, nil)
+	}
+	return nil
 }
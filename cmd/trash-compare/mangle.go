@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// mangleCommand returns the mangle subcommand.
+func mangleCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "mangle",
+		Usage: "[name...]",
+		Short: "Output the mangling corpus, or the mangled forms of the given names",
+		Long: "Without arguments, outputs the corpus of selectors, classes and Bash function\n" +
+			"names that mangling is tested against, for the Bash runtime and jq-compiler\n" +
+			"test suites. With arguments, outputs one JSON object per name with its\n" +
+			"selector forms, or class forms for names starting with an upper-case letter.",
+		Args: cli.AnyArgs,
+		Run:  cmdMangle,
+	}
+}
+
+// mangledName is the output of mangle for one name: its selector forms, or
+// its class forms for a name starting with an upper-case letter
+type mangledName struct {
+	Name          string  `json:"name"`
+	Selector      string  `json:"selector,omitempty"`
+	TrashSelector string  `json:"trash_selector,omitempty"`
+	Go            string  `json:"go,omitempty"`
+	Qualified     string  `json:"qualified,omitempty"`
+	Compiled      string  `json:"compiled,omitempty"`
+	Package       *string `json:"package,omitempty"`
+	Class         string  `json:"class,omitempty"`
+	IDPrefix      string  `json:"id_prefix,omitempty"`
+}
+
+// cmdMangle prints the corpus, or the forms of each name in args.
+func cmdMangle(args []string) error {
+	if len(args) == 0 {
+		_, err := os.Stdout.Write(mangle.Corpus())
+		return err
+	}
+	for _, name := range args {
+		m := mangledName{Name: name}
+		if r, _ := utf8.DecodeRuneInString(name); unicode.IsUpper(r) {
+			pkg, class := mangle.SplitClass(name)
+			m.Qualified = mangle.QualifiedClass(name)
+			m.Compiled = mangle.CompiledClass(name)
+			m.Package = &pkg
+			m.Class = class
+			m.IDPrefix = mangle.InstanceIDPrefix(name)
+		} else {
+			m.Selector = mangle.Selector(name)
+			m.TrashSelector = mangle.TrashSelector(m.Selector)
+			m.Go = mangle.GoName(m.Selector)
+		}
+		out, _ := json.Marshal(m)
+		fmt.Println(string(out))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Package main provides trash-db, a maintenance tool for the Trashtalk
+// instances database (~/.trashtalk/instances.db).
+//
+// Usage:
+//
+//	trash-db gc --roots App,Session            # Report unreachable instances
+//	trash-db gc --roots App,Session --delete   # Delete unreachable instances
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/runtime"
+)
+
+// gcFlags holds the flags of the gc command
+type gcFlags struct {
+	roots  *string
+	remove *bool
+	dbPath *string
+}
+
+func main() {
+	var gc gcFlags
+	root := &cli.Command{
+		Name:  "trash-db",
+		Short: "Maintenance for the Trashtalk instances database",
+		Long:  "The database defaults to $SQLITE_JSON_DB or ~/.trashtalk/instances.db.",
+		Commands: []*cli.Command{
+			{
+				Name:  "gc",
+				Short: "Find instances unreachable from root classes",
+				Examples: []string{
+					"trash-db gc --roots App,Session",
+					"trash-db gc --roots App,Session --delete",
+				},
+				Flags: func(fs *flag.FlagSet) {
+					gc.roots = fs.String("roots", "", "comma-separated root class names (required)")
+					gc.remove = fs.Bool("delete", false, "delete unreachable instances instead of only reporting them")
+					gc.dbPath = fs.String("db", "", "path to instances.db")
+				},
+				Run: func([]string) error {
+					return cmdGC(gc)
+				},
+			},
+		},
+	}
+	root.Execute()
+}
+
+// cmdGC runs a garbage collection pass and prints the report.
+func cmdGC(flags gcFlags) error {
+	rootClasses := cli.SplitList(*flags.roots)
+	if len(rootClasses) == 0 {
+		return cli.Errorf(cli.ExitUsage, "gc requires --roots")
+	}
+
+	rt, err := runtime.New(&runtime.Config{DBPath: *flags.dbPath})
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+
+	report, err := rt.CollectGarbage(rootClasses, *flags.remove)
+	if err != nil {
+		return err
+	}
+
+	if cli.JSON() {
+		return cli.PrintJSON(report)
+	}
+
+	for _, id := range report.Unreachable {
+		fmt.Println(id)
+	}
+	action := "unreachable"
+	if *flags.remove {
+		action = "deleted"
+	}
+	cli.Logf("%d instances, %d reachable, %d %s",
+		report.Total, report.Reachable, len(report.Unreachable), action)
+	return nil
+}
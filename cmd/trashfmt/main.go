@@ -0,0 +1,214 @@
+// Package main provides trashfmt, which formats Trashtalk .trash sources in
+// the canonical layout of pkg/format.
+//
+// Usage:
+//
+//	trashfmt < Counter.trash                # formatted source on stdout
+//	trashfmt -w Counter.trash lib/          # rewrite files in place
+//	trashfmt --check lib/                   # list unformatted files, exit 4 if any
+//	trashfmt --check --diff lib/            # and show how they would change
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/format"
+)
+
+// fmtFlags holds trashfmt's flags
+type fmtFlags struct {
+	write *bool
+	check *bool
+	list  *bool
+	diff  *bool
+}
+
+// fileResult is what formatting one file did, and an element of the stdout
+// document written with --json
+type fileResult struct {
+	File    string `json:"file"`
+	Changed bool   `json:"changed"`
+	Diff    string `json:"diff,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func main() {
+	var flags fmtFlags
+	root := &cli.Command{
+		Name:  "trashfmt",
+		Usage: "[file.trash | dir ...]",
+		Short: "Format Trashtalk source files",
+		Long: "Formats each file, or each .trash file under a directory, and writes it to\n" +
+			"stdout. Without arguments it formats stdin. Comments and the text of every\n" +
+			"token are kept; files that do not parse are reported and left alone.\n\n" +
+			"--check exits 4 if any file is not formatted, for CI.",
+		Examples: []string{
+			"trashfmt < Counter.trash",
+			"trashfmt -w Counter.trash lib/",
+			"trashfmt --check --diff lib/",
+		},
+		Args:     cli.AnyArgs,
+		ArgFiles: "*.trash",
+		Flags: func(fs *flag.FlagSet) {
+			flags.write = fs.Bool("w", false, "write the formatted source back to each file instead of to stdout")
+			flags.check = fs.Bool("check", false, "write nothing; list the files that are not formatted and exit 4 if there are any")
+			flags.list = fs.Bool("l", false, "list the files whose formatting differs instead of writing their source")
+			flags.diff = fs.Bool("diff", false, "write a unified diff of the changes instead of the source")
+		},
+		Run: func(args []string) error {
+			return run(flags, args)
+		},
+	}
+	root.Execute()
+}
+
+// run formats stdin or the files args name
+func run(flags fmtFlags, args []string) error {
+	if *flags.write && *flags.check {
+		return cli.Errorf(cli.ExitUsage, "-w and --check cannot be combined")
+	}
+	if len(args) == 0 {
+		if *flags.write {
+			return cli.Errorf(cli.ExitUsage, "-w needs files to rewrite")
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "reading stdin: %v", err)
+		}
+		return report(flags, []fileResult{formatFile(flags, "<stdin>", src, os.Stdout)})
+	}
+
+	files, err := trashFiles(args)
+	if err != nil {
+		return cli.Errorf(cli.ExitUsage, "%v", err)
+	}
+	results := make([]fileResult, 0, len(files))
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			results = append(results, fileResult{File: file, Error: err.Error()})
+			continue
+		}
+		results = append(results, formatFile(flags, file, src, os.Stdout))
+	}
+	return report(flags, results)
+}
+
+// formatFile formats src, read from file, and writes it to w, writes it back
+// to file with -w, or writes the diff with --diff. With --check, -l or
+// --json nothing is written but the diff, which is kept in the result.
+func formatFile(flags fmtFlags, file string, src []byte, w io.Writer) fileResult {
+	res := fileResult{File: file}
+	out, err := format.Source(src)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Changed = string(out) != string(src)
+	if *flags.diff {
+		res.Diff = cli.UnifiedDiff(file, file+" (formatted)", string(src), string(out))
+	}
+
+	switch {
+	case *flags.write:
+		if res.Changed {
+			if err := os.WriteFile(file, out, 0o644); err != nil {
+				res.Error = err.Error()
+			}
+		}
+	case *flags.check || *flags.list || cli.JSON():
+	case *flags.diff:
+		fmt.Fprint(w, res.Diff)
+	default:
+		w.Write(out)
+	}
+	return res
+}
+
+// report writes the files that failed, and the changed files for --check
+// and -l, and returns the exit status: 2 if any file failed, else 4 if
+// --check found one that is not formatted
+func report(flags fmtFlags, results []fileResult) error {
+	failed, changed := 0, 0
+	for _, res := range results {
+		switch {
+		case res.Error != "":
+			failed++
+		case res.Changed:
+			changed++
+		}
+	}
+
+	if cli.JSON() {
+		if err := cli.PrintJSON(results); err != nil {
+			return err
+		}
+	} else {
+		for _, res := range results {
+			switch {
+			case res.Error != "":
+				fmt.Fprintf(os.Stderr, "%s: %s\n", res.File, res.Error)
+			case res.Changed && (*flags.check || *flags.list):
+				fmt.Println(res.File)
+				if *flags.diff {
+					fmt.Print(res.Diff)
+				}
+			}
+		}
+	}
+
+	switch {
+	case failed > 0:
+		return cli.Exit(cli.ExitParse, nil)
+	case *flags.check && changed > 0:
+		if !cli.JSON() {
+			cli.Logf("trashfmt: %d of %d files not formatted", changed, len(results))
+		}
+		return cli.Exit(cli.ExitStale, nil)
+	}
+	return nil
+}
+
+// trashFiles returns the files args name, with the .trash files under each
+// directory among them, sorted, skipping hidden directories such as
+// .compiled
+func trashFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		var found []string
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && path != arg && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && strings.HasSuffix(path, ".trash") {
+				found = append(found, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	return files, nil
+}
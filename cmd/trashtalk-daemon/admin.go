@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/client"
+)
+
+// Requests addressed to adminClass are handled by the daemon itself rather
+// than dispatched to a plugin. The name cannot collide with a Trashtalk class.
+//
+//	{"class": "@daemon", "selector": "preload", "args": ["Counter", "MyApp__Store"]}
+//
+// preload drops the cached plugins for the named classes and loads them again
+// straight away, so the first request after a build does not pay for the load.
+// A build driver sends it with the rebuilt classes plus their dependents.
+//
+//	{"class": "@daemon", "selector": "children"}
+//
+// children answers the state of the supervised children, such as the
+// scheduled GC or the child process of a --serve-classes class: status,
+// restarts, last error and the time of the next restart.
+//
+//	{"class": "@daemon", "selector": "backends"}
+//
+// backends answers each class served by a child process: the child, its
+// process ID while it runs, and the requests sent to it and failed by it.
+//
+//	{"class": "@daemon", "selector": "classes"}
+//
+// classes answers the GetClassInfo of each loaded plugin: its native
+// selectors, those it leaves to Bash, and the source hash and compiler.
+const adminClass = client.AdminClass
+
+// preloadResult is the Result of a preload request, as JSON
+type preloadResult struct {
+	Loaded []string          `json:"loaded"`
+	Bash   []string          `json:"bash,omitempty"`   // no plugin, served by Bash
+	Failed map[string]string `json:"failed,omitempty"` // class -> load error
+}
+
+// handleAdmin runs a request addressed to the daemon
+func (d *Daemon) handleAdmin(req Request) Response {
+	switch req.Selector {
+	case "preload":
+		result, _ := json.Marshal(d.Preload(req.Args))
+		return Response{Result: string(result)}
+	case "children":
+		result, _ := json.Marshal(d.children.states())
+		return Response{Result: string(result)}
+	case "backends":
+		result, _ := json.Marshal(d.backendStates())
+		return Response{Result: string(result)}
+	case "classes":
+		result, _ := json.Marshal(d.loadedClasses())
+		return Response{Result: string(result)}
+	}
+	return Response{ExitCode: 1, Error: fmt.Sprintf("unknown admin selector %q", req.Selector)}
+}
+
+// Preload reloads and pre-warms the plugins for the given classes. The alias
+// table is rebuilt first, since a build may have added plugins or changed
+// the manifest. Classes without a plugin file are reported as served by Bash.
+func (d *Daemon) Preload(classes []string) preloadResult {
+	result := preloadResult{Loaded: []string{}}
+	var compiled []string
+
+	d.mu.Lock()
+	d.aliases = nil
+	for _, name := range classes {
+		c := d.resolveClass(name)
+		delete(d.plugins, c)
+		delete(d.bad, c)
+		delete(d.classInfo, c)
+		if _, ok := d.classes[c]; ok {
+			compiled = append(compiled, c)
+		} else {
+			result.Bash = append(result.Bash, name)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, name := range compiled {
+		p, err := d.LoadPlugin(name)
+		if err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			result.Failed[name] = err.Error()
+			continue
+		}
+		result.Loaded = append(result.Loaded, p.className)
+	}
+
+	if *debug {
+		fmt.Fprintf(os.Stderr, "trashtalk-daemon: preloaded %v, %d failed\n", result.Loaded, len(result.Failed))
+	}
+	return result
+}
+
+// loadedClasses returns the class info of the loaded plugins, by compiled
+// name. Plugins without GetClassInfo have an entry from their file name.
+func (d *Daemon) loadedClasses() []classEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	classes := []classEntry{}
+	for compiled := range d.plugins {
+		e, ok := d.classInfo[compiled]
+		if !ok {
+			e = entryForPlugin(compiled)
+		}
+		classes = append(classes, e)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i].Plugin < classes[j].Plugin })
+	return classes
+}
+
+var (
+	preloadSocket *string
+	preloadAST    *string
+)
+
+// preloadCommand is the client side of the preload admin request, run by
+// build drivers once their plugins are written.
+func preloadCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "preload",
+		Usage: "<class>...",
+		Short: "Tell a running daemon to reload rebuilt class plugins",
+		Long: "Sends the rebuilt classes, plus every class that depends on them in the\n" +
+			"--ast import graph, to the daemon on --socket, which reloads exactly those\n" +
+			"plugins. Succeeds without doing anything if no daemon is listening.",
+		Examples: []string{
+			"trashtalk-daemon preload --socket /tmp/trashtalk.sock Counter",
+			"trashtalk-daemon preload --socket /tmp/trashtalk.sock --ast classes.json Counter",
+		},
+		Args: cli.AnyArgs,
+		Flags: func(fs *flag.FlagSet) {
+			preloadSocket = fs.String("socket", "", "Unix socket of the running daemon")
+			preloadAST = fs.String("ast", "", "JSON array of class ASTs (bundle input) used to find dependents")
+		},
+		Run: runPreload,
+	}
+}
+
+func runPreload(args []string) error {
+	if *preloadSocket == "" {
+		return cli.Errorf(cli.ExitUsage, "--socket is required")
+	}
+	if len(args) == 0 {
+		return cli.Errorf(cli.ExitUsage, "missing argument <class>...")
+	}
+
+	classes := args
+	if *preloadAST != "" {
+		data, err := os.ReadFile(*preloadAST)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "reading %s: %v", *preloadAST, err)
+		}
+		units, err := ast.ParseCompilationUnits(data)
+		if err != nil {
+			return cli.Errorf(cli.ExitParse, "parsing %s: %v", *preloadAST, err)
+		}
+		var all []*ast.Class
+		for _, unit := range units {
+			all = append(all, unit.Class)
+		}
+		classes = ast.Dependents(all, args)
+	}
+
+	c, err := client.DialOptions(context.Background(), *preloadSocket, client.Options{Reconnects: -1})
+	if err != nil {
+		cli.Logf("trashtalk-daemon: no daemon on %s, nothing to preload", *preloadSocket)
+		return nil
+	}
+
+	resp, err := c.Send(Request{Class: adminClass, Selector: "preload", Args: classes})
+	if err != nil {
+		return err
+	}
+	if resp.ExitCode != 0 {
+		return fmt.Errorf("daemon: %s", resp.Error)
+	}
+	var result preloadResult
+	if err := json.Unmarshal([]byte(resp.Result), &result); err != nil {
+		return fmt.Errorf("invalid preload result from daemon: %w", err)
+	}
+
+	if cli.JSON() {
+		return cli.PrintJSON(result)
+	}
+	cli.Logf("trashtalk-daemon: preloaded %d plugins %s", len(result.Loaded), strings.Join(result.Loaded, " "))
+	if len(result.Bash) > 0 {
+		cli.Logf("  no plugin (Bash): %s", strings.Join(result.Bash, " "))
+	}
+	for class, reason := range result.Failed {
+		cli.Logf("  ⚠ %s: %s", class, reason)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/jamesits/goinvoke"
+)
+
+// Namespaced classes compile to MyApp__Counter plugins, but callers may ask
+// for MyApp__Counter, MyApp::Counter, or just Counter. The alias table maps
+// every accepted name to one plugin. It is built from the plugin file names,
+// an optional manifest.json in the plugin directory, and the GetClassInfo
+// export of plugins that have been loaded.
+//
+// A bare name resolves to the non-namespaced class of that name if there is
+// one, otherwise to the only namespaced class with that name. Bare names that
+// several packages share stay unresolved and must be qualified.
+
+// manifestFile is the optional list of compiled classes in the plugin directory:
+//
+//	{"classes": [{"name": "Counter", "package": "MyApp", "plugin": "MyApp__Counter"}]}
+//
+// Entries may also list the class's source "hashes", which the daemon ignores
+// and a binary's --reembed checks.
+const manifestFile = "manifest.json"
+
+// classManifest is the contents of manifest.json
+type classManifest struct {
+	Classes []classEntry `json:"classes"`
+}
+
+// classEntry describes one compiled class. GetClassInfo returns the same
+// shape, adding what the plugin dispatches: the selectors it compiled, and
+// those it leaves to Bash, which answer exit 200.
+type classEntry struct {
+	Name    string `json:"name"`
+	Package string `json:"package,omitempty"`
+	Plugin  string `json:"plugin,omitempty"`
+
+	Parent         string   `json:"parent,omitempty"`
+	Selectors      []string `json:"selectors,omitempty"`
+	ClassSelectors []string `json:"classSelectors,omitempty"`
+	Fallback       []string `json:"fallback,omitempty"`
+	Hash           string   `json:"hash,omitempty"`
+	Compiler       string   `json:"compiler,omitempty"`
+}
+
+// PluginInfoFuncs holds optional plugin exports. It is loaded separately from
+// PluginFuncs so that plugins built without them still load.
+type PluginInfoFuncs struct {
+	GetClassInfo *goinvoke.Proc `func:"GetClassInfo"`
+}
+
+// pluginExt returns the shared library extension for this platform
+func pluginExt() string {
+	if runtime.GOOS == "darwin" {
+		return ".dylib"
+	}
+	return ".so"
+}
+
+// entryForPlugin derives a class entry from a compiled plugin name
+func entryForPlugin(compiled string) classEntry {
+	pkg, name := mangle.SplitClass(compiled)
+	return classEntry{Name: name, Package: pkg, Plugin: compiled}
+}
+
+// compiledName returns the plugin base name for an entry
+func (e classEntry) compiledName() string {
+	if e.Plugin != "" {
+		return strings.TrimSuffix(filepath.Base(e.Plugin), pluginExt())
+	}
+	return mangle.CompiledClass(mangle.Qualify(e.Package, e.Name))
+}
+
+// buildAliases maps every accepted class name to a plugin's compiled name
+func buildAliases(entries map[string]classEntry) map[string]string {
+	aliases := make(map[string]string)
+	bare := make(map[string][]string)
+	for compiled, e := range entries {
+		aliases[compiled] = compiled
+		if e.Package != "" {
+			aliases[mangle.Qualify(e.Package, e.Name)] = compiled
+			bare[e.Name] = append(bare[e.Name], compiled)
+		}
+	}
+	for name, plugins := range bare {
+		if _, ok := aliases[name]; ok {
+			continue // a non-namespaced class owns the bare name
+		}
+		if len(plugins) == 1 {
+			aliases[name] = plugins[0]
+		}
+	}
+	return aliases
+}
+
+// scanClasses lists the plugins in dir, using manifest entries where present
+func scanClasses(dir string) map[string]classEntry {
+	ext := pluginExt()
+	entries := make(map[string]classEntry)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+	for _, file := range files {
+		compiled := strings.TrimSuffix(filepath.Base(file), ext)
+		entries[compiled] = entryForPlugin(compiled)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return entries
+	}
+	var manifest classManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "trashtalk-daemon: ignoring %s: %v\n", manifestFile, err)
+		}
+		return entries
+	}
+	for _, e := range manifest.Classes {
+		compiled := e.compiledName()
+		// Entries without a plugin file cannot be dispatched to
+		if _, ok := entries[compiled]; ok && e.Name != "" {
+			e.Plugin = compiled
+			entries[compiled] = e
+		}
+	}
+	return entries
+}
+
+// dirStamp returns the latest modification time of the plugin directory and
+// its manifest, so the table is rebuilt when either changes
+func dirStamp(dir string) time.Time {
+	var stamp time.Time
+	for _, path := range []string{dir, filepath.Join(dir, manifestFile)} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(stamp) {
+			stamp = info.ModTime()
+		}
+	}
+	return stamp
+}
+
+// resolveClass returns the compiled plugin name for a requested class name.
+// Must be called with d.mu held.
+func (d *Daemon) resolveClass(className string) string {
+	if stamp := dirStamp(d.pluginDir); d.aliases == nil || !stamp.Equal(d.aliasStamp) {
+		d.classes = scanClasses(d.pluginDir)
+		for compiled, e := range d.classInfo {
+			if _, ok := d.classes[compiled]; ok {
+				d.classes[compiled] = e
+			}
+		}
+		d.aliases = buildAliases(d.classes)
+		d.aliasStamp = stamp
+	}
+
+	if compiled, ok := d.aliases[className]; ok {
+		return compiled
+	}
+	return className
+}
+
+// recordClassInfo adds a loaded plugin's GetClassInfo to the alias table,
+// unless it names another class. Must be called with d.mu held.
+func (d *Daemon) recordClassInfo(soPath, compiled string) {
+	var funcs PluginInfoFuncs
+	if err := goinvoke.Unmarshal(soPath, &funcs); err != nil || funcs.GetClassInfo == nil {
+		return // older plugin without GetClassInfo
+	}
+
+	ret, _, _ := funcs.GetClassInfo.Call()
+	var e classEntry
+	if err := json.Unmarshal([]byte(retString(ret)), &e); err != nil || e.Name == "" {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "trashtalk-daemon: ignoring GetClassInfo from %s: %v\n", soPath, err)
+		}
+		return
+	}
+	// Like GetClassName, it must describe the class the plugin was loaded as
+	if !classNameMatches(compiled, e.Name) {
+		cli.Logf("trashtalk-daemon: ignoring GetClassInfo from %s: describes class %q, expected %q", soPath, e.Name, compiled)
+		return
+	}
+	e.Plugin = compiled
+
+	d.classInfo[compiled] = e
+	if d.classes != nil {
+		d.classes[compiled] = e
+		d.aliases = buildAliases(d.classes)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// aliasDaemon returns a daemon on a plugin dir holding empty plugin files
+// named plugins and the given manifest.json, if not empty
+func aliasDaemon(t *testing.T, manifest string, plugins ...string) *Daemon {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range plugins {
+		if err := os.WriteFile(filepath.Join(dir, name+pluginExt()), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if manifest != "" {
+		if err := os.WriteFile(filepath.Join(dir, manifestFile), []byte(manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Daemon{
+		plugins:   make(map[string]*Plugin),
+		bad:       make(map[string]badPlugin),
+		classInfo: make(map[string]classEntry),
+		pluginDir: dir,
+	}
+}
+
+func TestResolveClass(t *testing.T) {
+	d := aliasDaemon(t, `{"classes": [
+  {"name": "Thing", "package": "Acme", "plugin": "legacy_thing"},
+  {"name": "Ghost", "package": "Acme", "plugin": "Acme__Ghost"}
+]}`,
+		"Counter", "MyApp__Counter", "MyApp__Widget", "Other__Widget", "Tools__Gadget", "legacy_thing")
+
+	tests := []struct {
+		requested string
+		want      string
+	}{
+		{"Counter", "Counter"}, // the non-namespaced class owns the bare name
+		{"MyApp::Counter", "MyApp__Counter"},
+		{"MyApp__Counter", "MyApp__Counter"},
+		{"Gadget", "Tools__Gadget"}, // the only namespaced class of that name
+		{"Tools::Gadget", "Tools__Gadget"},
+		{"Widget", "Widget"}, // shared by two packages, so left unresolved
+		{"Other::Widget", "Other__Widget"},
+		{"Acme::Thing", "legacy_thing"}, // from the manifest
+		{"Thing", "legacy_thing"},
+		{"Acme::Ghost", "Acme::Ghost"}, // listed without a plugin file
+		{"Unknown", "Unknown"},
+	}
+	for _, tt := range tests {
+		if got := d.resolveClass(tt.requested); got != tt.want {
+			t.Errorf("resolveClass(%q) = %q, want %q", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestResolveClassSeesNewPlugins(t *testing.T) {
+	d := aliasDaemon(t, "", "MyApp__Counter")
+	if got := d.resolveClass("Counter"); got != "MyApp__Counter" {
+		t.Fatalf("resolveClass(Counter) = %q, want MyApp__Counter", got)
+	}
+
+	// Another package's Counter makes the bare name ambiguous
+	if err := os.WriteFile(filepath.Join(d.pluginDir, "Other__Counter"+pluginExt()), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(d.pluginDir, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.resolveClass("Counter"); got != "Counter" {
+		t.Errorf("resolveClass(Counter) = %q after Other__Counter was added, want it unresolved", got)
+	}
+}
+
+func TestLoadPluginUnknownAlias(t *testing.T) {
+	d := aliasDaemon(t, "", "MyApp__Widget", "Other__Widget")
+	for _, requested := range []string{"Unknown", "Widget", "Nowhere::Widget"} {
+		_, err := d.LoadPlugin(requested)
+		if err == nil || !strings.Contains(err.Error(), "plugin not found") || !strings.Contains(err.Error(), requested) {
+			t.Errorf("LoadPlugin(%q) = %v, want plugin not found for it", requested, err)
+		}
+	}
+}
+
+func TestBuildAliases(t *testing.T) {
+	entries := map[string]classEntry{
+		"Counter":        entryForPlugin("Counter"),
+		"MyApp__Counter": entryForPlugin("MyApp__Counter"),
+		"MyApp__Widget":  entryForPlugin("MyApp__Widget"),
+	}
+	want := map[string]string{
+		"Counter":        "Counter",
+		"MyApp__Counter": "MyApp__Counter",
+		"MyApp::Counter": "MyApp__Counter",
+		"MyApp__Widget":  "MyApp__Widget",
+		"MyApp::Widget":  "MyApp__Widget",
+		"Widget":         "MyApp__Widget",
+	}
+	if got := buildAliases(entries); !maps.Equal(got, want) {
+		t.Errorf("buildAliases = %v, want %v", got, want)
+	}
+}
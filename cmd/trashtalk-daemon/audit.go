@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chazu/procyon/pkg/cli"
+)
+
+// With --audit-log the daemon appends one JSON line per request to the audit
+// log, whatever the outcome:
+//
+//	{"time":"2026-10-14T09:30:00.123Z","peer":{"pid":4242,"uid":501,"gid":20},"class":"Counter","selector":"increment","instance":"sha256:...","exit_code":0}
+//
+// peer is the connecting process as the kernel reports it, or the process
+// that started the daemon in stdin mode. With --auth-tokens or --auth-hook,
+// "principal" names who the request's token identified. Requests carry the instance's state
+// rather than its ID, so the log keeps a digest of it: audits can follow one
+// state through the log without the log holding the data.
+//
+// When the log would grow past --audit-max-size it is renamed to PATH.1 (PATH.1
+// to PATH.2 and so on, up to --audit-keep files) and a new one is started.
+// --audit-retention keeps entries for a time per class,
+//
+//	--audit-retention 'Payments=2160h,*=720h'
+//
+// and older entries are dropped from every file when the daemon starts, on
+// each rotation, and hourly. Classes without a retention are kept until their
+// file is rotated out.
+
+// auditPruneInterval is how often entries past their retention are dropped
+const auditPruneInterval = time.Hour
+
+// peerCred identifies the process on the other end of a request
+type peerCred struct {
+	PID int `json:"pid,omitempty"`
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// auditEntry is one line of the audit log
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Peer      *peerCred `json:"peer,omitempty"`
+	Principal string    `json:"principal,omitempty"`
+	Class     string    `json:"class"`
+	Selector  string    `json:"selector"`
+	Instance  string    `json:"instance,omitempty"`
+	ExitCode  int       `json:"exit_code"`
+}
+
+// auditLog is an append-only NDJSON request log rotated by size
+type auditLog struct {
+	mu        sync.Mutex
+	path      string
+	maxSize   int64                    // bytes before the log is rotated, 0 = never
+	keep      int                      // rotated files kept
+	retention map[string]time.Duration // class -> how long entries are kept, "*" for the rest
+	file      *os.File
+	size      int64
+	now       func() time.Time // clock entries are stamped and expired by
+}
+
+// openAuditLog opens the audit log at path for appending, first dropping
+// entries past their retention
+func openAuditLog(path string, maxSize int64, keep int, retention map[string]time.Duration) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, keep: keep, retention: retention, now: time.Now}
+	if err := a.start(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// start drops the entries past their retention and opens the log
+func (a *auditLog) start() error {
+	if err := a.prune(); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// open opens the current log file
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file, a.size = f, info.Size()
+	return nil
+}
+
+// Record appends the outcome of a request by principal, "" if the daemon
+// does not authenticate requests or refused it
+func (a *auditLog) Record(peer *peerCred, principal string, req Request, resp Response) {
+	line, _ := json.Marshal(auditEntry{
+		Time:      a.now().UTC(),
+		Peer:      peer,
+		Principal: principal,
+		Class:     req.Class,
+		Selector:  req.Selector,
+		Instance:  instanceRef(req.Instance),
+		ExitCode:  resp.ExitCode,
+	})
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			logAuditError(err)
+		}
+	}
+	if a.file == nil {
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		logAuditError(err)
+	}
+}
+
+// rotate moves the log to PATH.1, shifting older files up and dropping the
+// one past --audit-keep, and starts a new log. Must be called with a.mu held.
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+
+	os.Remove(a.rotatedPath(a.keep))
+	for i := a.keep - 1; i >= 1; i-- {
+		os.Rename(a.rotatedPath(i), a.rotatedPath(i+1))
+	}
+	if a.keep > 0 {
+		os.Rename(a.path, a.rotatedPath(1))
+	} else {
+		os.Remove(a.path)
+	}
+	if err := a.pruneRotated(); err != nil {
+		logAuditError(err)
+	}
+	return a.open()
+}
+
+// rotatedPath returns the name of the i-th rotated file
+func (a *auditLog) rotatedPath(i int) string {
+	return a.path + "." + strconv.Itoa(i)
+}
+
+// Prune drops the entries past their retention from every file
+func (a *auditLog) Prune() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	err := a.prune()
+	if openErr := a.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+// prune drops old entries from the current and rotated files. The current
+// file must not be open.
+func (a *auditLog) prune() error {
+	if len(a.retention) == 0 {
+		return nil
+	}
+	if err := a.pruneFile(a.path); err != nil {
+		return err
+	}
+	return a.pruneRotated()
+}
+
+// pruneRotated drops old entries from the rotated files
+func (a *auditLog) pruneRotated() error {
+	if len(a.retention) == 0 {
+		return nil
+	}
+	for i := 1; i <= a.keep; i++ {
+		if err := a.pruneFile(a.rotatedPath(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneFile rewrites path without the entries past their class's
+// retention, removing it if none are left. Lines that are not entries are
+// kept.
+func (a *auditLog) pruneFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := a.now()
+	var kept bytes.Buffer
+	dropped := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e auditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && a.expired(e, now) {
+			dropped = true
+			continue
+		}
+		kept.Write(scanner.Bytes())
+		kept.WriteByte('\n')
+	}
+	switch {
+	case !dropped:
+		return nil
+	case kept.Len() == 0:
+		return os.Remove(path)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, kept.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// expired reports whether e is past its class's retention at now
+func (a *auditLog) expired(e auditEntry, now time.Time) bool {
+	keep, ok := a.retention[e.Class]
+	if !ok {
+		keep = a.retention["*"]
+	}
+	return keep > 0 && now.Sub(e.Time) > keep
+}
+
+// Close closes the log
+func (a *auditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+// startAuditPruneJob drops entries past their retention every
+// auditPruneInterval, under the supervisor like the scheduled GC
+func (d *Daemon) startAuditPruneJob(policy restartPolicy) {
+	d.children.start(childSpec{
+		name: "audit-retention",
+		run: func(ctx context.Context) error {
+			ticker := time.NewTicker(auditPruneInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					if err := d.audit.Prune(); err != nil {
+						return err
+					}
+				}
+			}
+		},
+		policy:      policy,
+		maxRestarts: *maxRestarts,
+		minBackoff:  time.Second,
+		maxBackoff:  time.Minute,
+	})
+}
+
+// parseRetention parses --audit-retention: comma-separated Class=duration
+// pairs, * naming every other class. Durations are Go durations or a number
+// of days such as 90d.
+func parseRetention(s string) (map[string]time.Duration, error) {
+	retention := map[string]time.Duration{}
+	for _, part := range cli.SplitList(s) {
+		class, value, ok := strings.Cut(part, "=")
+		class, value = strings.TrimSpace(class), strings.TrimSpace(value)
+		if !ok || class == "" {
+			return nil, fmt.Errorf("%q is not Class=duration", part)
+		}
+		keep, err := parseRetentionDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", class, err)
+		}
+		retention[class] = keep
+	}
+	return retention, nil
+}
+
+// parseRetentionDuration parses a Go duration or a number of days (90d)
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	keep, err := time.ParseDuration(s)
+	if err != nil || keep < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return keep, nil
+}
+
+// instanceRef returns what the audit log records of a request's instance:
+// nothing for class-side requests, a digest of instance JSON, or the value
+// itself otherwise
+func instanceRef(instance string) string {
+	if !strings.HasPrefix(strings.TrimSpace(instance), "{") {
+		return instance
+	}
+	sum := sha256.Sum256([]byte(instance))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// connPeer returns the credentials of the process on the other end of conn,
+// nil if they are not available
+func connPeer(conn net.Conn) *peerCred {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var peer *peerCred
+	raw.Control(func(fd uintptr) {
+		peer = socketPeer(int(fd))
+	})
+	return peer
+}
+
+// stdinPeer returns the credentials recorded for requests read from stdin:
+// those of the process that started the daemon
+func stdinPeer() *peerCred {
+	return &peerCred{PID: os.Getppid(), UID: os.Getuid(), GID: os.Getgid()}
+}
+
+// logAuditError reports a failure to write the audit log
+func logAuditError(err error) {
+	cli.Logf("trashtalk-daemon: audit log: %v", err)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testClock is a clock tests move by hand
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+// startAuditLog opens an audit log in a temp dir on clock
+func startAuditLog(t *testing.T, maxSize int64, keep int, retention map[string]time.Duration, clock *testClock) *auditLog {
+	t.Helper()
+	a := &auditLog{
+		path:      filepath.Join(t.TempDir(), "audit.ndjson"),
+		maxSize:   maxSize,
+		keep:      keep,
+		retention: retention,
+		now:       clock.now,
+	}
+	if err := a.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Close)
+	return a
+}
+
+// auditClasses returns the classes of the entries in the file at path, nil
+// if there is none
+func auditClasses(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var classes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		classes = append(classes, e.Class)
+	}
+	return classes
+}
+
+// entrySize is the size of an audit line for the classes of these tests
+var entrySize = func() int64 {
+	line, _ := json.Marshal(auditEntry{Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Class: "C0", Selector: "run"})
+	return int64(len(line)) + 1
+}()
+
+func TestAuditLogRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		keep    int
+		records int
+		want    [][]string // classes in PATH, PATH.1, PATH.2, ...
+	}{
+		{"no limit", 0, 2, 4, [][]string{{"C0", "C1", "C2", "C3"}, nil}},
+		{"under the limit", 4 * entrySize, 2, 4, [][]string{{"C0", "C1", "C2", "C3"}, nil}},
+		{"one rotation", 2 * entrySize, 2, 3, [][]string{{"C2"}, {"C0", "C1"}, nil}},
+		{"keep drops the oldest", entrySize, 2, 4, [][]string{{"C3"}, {"C2"}, {"C1"}, nil}},
+		{"keep 0", entrySize, 0, 3, [][]string{{"C2"}, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+			a := startAuditLog(t, tt.maxSize, tt.keep, nil, clock)
+			for i := 0; i < tt.records; i++ {
+				a.Record(nil, "", Request{Class: "C" + string(rune('0'+i)), Selector: "run"}, Response{})
+			}
+			for i, want := range tt.want {
+				path := a.path
+				if i > 0 {
+					path = a.rotatedPath(i)
+				}
+				if got := auditClasses(t, path); !slices.Equal(got, want) {
+					t.Errorf("%s has %v, want %v", filepath.Base(path), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogRetention(t *testing.T) {
+	retention := map[string]time.Duration{"Payments": 48 * time.Hour, "*": time.Hour}
+	tests := []struct {
+		name  string
+		class string
+		age   time.Duration
+		kept  bool
+	}{
+		{"class retention, young", "Payments", 47 * time.Hour, true},
+		{"class retention, old", "Payments", 49 * time.Hour, false},
+		{"default retention, young", "Counter", 59 * time.Minute, true},
+		{"default retention, old", "Counter", 61 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &testClock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+			a := startAuditLog(t, 0, 1, retention, clock)
+			a.Record(nil, "", Request{Class: tt.class, Selector: "run"}, Response{})
+			clock.t = clock.t.Add(tt.age)
+			if err := a.Prune(); err != nil {
+				t.Fatal(err)
+			}
+			got := auditClasses(t, a.path)
+			if kept := len(got) == 1; kept != tt.kept {
+				t.Errorf("after %v the log has %v, kept = %v, want %v", tt.age, got, kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestAuditLogRetentionPrunesRotatedFiles(t *testing.T) {
+	clock := &testClock{time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := startAuditLog(t, entrySize, 2, map[string]time.Duration{"*": time.Hour}, clock)
+	a.Record(nil, "", Request{Class: "C0", Selector: "run"}, Response{})
+	clock.t = clock.t.Add(30 * time.Minute)
+	a.Record(nil, "", Request{Class: "C1", Selector: "run"}, Response{})
+	clock.t = clock.t.Add(45 * time.Minute)
+
+	// Rotating drops C0, past its hour in PATH.2; a file left empty is removed
+	a.Record(nil, "", Request{Class: "C2", Selector: "run"}, Response{})
+	if _, err := os.Stat(a.rotatedPath(2)); !os.IsNotExist(err) {
+		t.Errorf("%s with only expired entries was kept: %v", filepath.Base(a.rotatedPath(2)), err)
+	}
+	if got := auditClasses(t, a.rotatedPath(1)); len(got) != 1 || got[0] != "C1" {
+		t.Errorf("%s has %v, want [C1]", filepath.Base(a.rotatedPath(1)), got)
+	}
+
+	// Reopening the log prunes it too
+	a.Close()
+	clock.t = clock.t.Add(2 * time.Hour)
+	if err := a.start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{a.path, a.rotatedPath(1)} {
+		if got := auditClasses(t, path); got != nil {
+			t.Errorf("%s has %v after reopening, want no entries", filepath.Base(path), got)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{"", map[string]time.Duration{}, false},
+		{"Payments=90d", map[string]time.Duration{"Payments": 90 * 24 * time.Hour}, false},
+		{"Payments=2160h, *=30m", map[string]time.Duration{"Payments": 2160 * time.Hour, "*": 30 * time.Minute}, false},
+		{"Payments", nil, true},
+		{"=1h", nil, true},
+		{"Payments=-1d", nil, true},
+		{"Payments=soon", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRetention(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRetention(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !maps.Equal(got, tt.want) {
+			t.Errorf("parseRetention(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/protocol"
+)
+
+// With --auth-tokens or --auth-hook every request is run past a
+// protocol.AuthProvider before it is dispatched, admin requests included:
+// its "token" must name a principal allowed the class. --auth-tokens reads a
+// protocol.StaticTokens file, --auth-hook asks a program through a
+// protocol.ExecHook. Refused requests are answered with exit code 203 and
+// recorded in the audit log like any other.
+
+// parseAuth returns the AuthProvider selected by the --auth-tokens and
+// --auth-hook values, nil for none
+func parseAuth(tokensPath, hook string) (protocol.AuthProvider, error) {
+	switch {
+	case tokensPath != "" && hook != "":
+		return nil, cli.Errorf(cli.ExitUsage, "--auth-tokens and --auth-hook are mutually exclusive")
+	case tokensPath != "":
+		tokens, err := protocol.LoadStaticTokens(tokensPath)
+		if err != nil {
+			return nil, cli.Errorf(cli.ExitUsage, "--auth-tokens: %v", err)
+		}
+		return tokens, nil
+	case hook != "":
+		return &protocol.ExecHook{Command: hook}, nil
+	}
+	return nil, nil
+}
+
+// authorize runs req past the daemon's AuthProvider and returns the
+// principal that made it, "" without a provider
+func (d *Daemon) authorize(req Request) (string, error) {
+	if d.auth == nil {
+		return "", nil
+	}
+	class := req.Class
+	if class != adminClass {
+		d.mu.Lock()
+		class = d.resolveClass(class)
+		d.mu.Unlock()
+	}
+	return protocol.CheckAuth(d.auth, req.Token, class, req.Selector)
+}
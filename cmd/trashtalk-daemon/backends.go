@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/protocol"
+)
+
+// Some classes are served by a child process instead of a plugin loaded into
+// the daemon: with --serve-classes, by the class binary run with --serve;
+// with --isolate, by the class's plugin loaded into a trashtalk-daemon of
+// its own, so that a plugin that crashes does not take the daemon with it.
+// Each child is a supervised child named "serve:<Class>" or "plugin:<Class>",
+// restarted per --restart and --max-restarts like the background jobs. A
+// request that arrives while the child is down falls back to Bash; one the
+// child dies or hangs on fails.
+
+// Kinds of child process backends
+const (
+	backendServe  = "serve"  // the class binary, with --serve
+	backendPlugin = "plugin" // the class plugin, in a child trashtalk-daemon
+)
+
+// backendTimeout bounds a request to a child, which is killed, and so
+// restarted, if it does not answer in time
+const backendTimeout = 60 * time.Second
+
+// errNotRunning is the error of a request to a child that is down
+var errNotRunning = errors.New("not running")
+
+// processBackend is a class served by a child process, one request at a time
+type processBackend struct {
+	className string // compiled name
+	kind      string
+	command   []string
+
+	mu     sync.Mutex // held for a request, or while the child is attached or detached
+	proc   *os.Process
+	stdin  io.WriteCloser
+	stdout *os.File
+	reader *bufio.Reader
+
+	requests atomic.Int64
+	failures atomic.Int64
+}
+
+// backendState is a child process backend, as reported by the backends
+// admin selector
+type backendState struct {
+	Class    string `json:"class"`
+	Kind     string `json:"kind"`
+	Child    string `json:"child"`
+	PID      int    `json:"pid,omitempty"` // 0 while it is down
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"` // requests the child died or hung on
+}
+
+// name returns the name of the backend's supervised child
+func (b *processBackend) name() string {
+	return b.kind + ":" + b.className
+}
+
+// startBackends starts a supervised child for each class of --serve-classes
+// and --isolate
+func (d *Daemon) startBackends(serveClasses, isolated []string, policy restartPolicy) error {
+	exe, err := os.Executable()
+	if err != nil && len(isolated) > 0 {
+		return fmt.Errorf("--isolate: %w", err)
+	}
+	d.backends = make(map[string]*processBackend)
+	add := func(requested, kind string, command func(compiled string) []string) error {
+		d.mu.Lock()
+		compiled := d.resolveClass(requested)
+		d.mu.Unlock()
+		if b, ok := d.backends[compiled]; ok {
+			return fmt.Errorf("%s is in both --serve-classes and --isolate", b.className)
+		}
+		b := &processBackend{className: compiled, kind: kind, command: command(compiled)}
+		d.backends[compiled] = b
+		b.start(d.children, policy, *maxRestarts)
+		return nil
+	}
+
+	for _, class := range serveClasses {
+		err := add(class, backendServe, func(compiled string) []string {
+			return []string{filepath.Join(d.pluginDir, compiled+".native"), "--serve"}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, class := range isolated {
+		err := add(class, backendPlugin, func(string) []string {
+			command := []string{exe, "--plugin-dir", d.pluginDir, "--grant", *grant}
+			if *debug {
+				command = append(command, "--debug")
+			}
+			return command
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backendFor returns the child process backend of the requested class, or
+// nil if a plugin serves it
+func (d *Daemon) backendFor(requested string) *processBackend {
+	if len(d.backends) == 0 {
+		return nil
+	}
+	d.mu.Lock()
+	compiled := d.resolveClass(requested)
+	d.mu.Unlock()
+	return d.backends[compiled]
+}
+
+// backendStates returns the state of each child process backend, by class
+func (d *Daemon) backendStates() []backendState {
+	states := []backendState{}
+	for _, b := range d.backends {
+		states = append(states, b.state())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Class < states[j].Class })
+	return states
+}
+
+// start runs the backend's child under s
+func (b *processBackend) start(s *supervisor, policy restartPolicy, maxRestarts int) {
+	s.start(childSpec{
+		name:        b.name(),
+		run:         b.run,
+		policy:      policy,
+		maxRestarts: maxRestarts,
+		minBackoff:  time.Second,
+		maxBackoff:  time.Minute,
+	})
+}
+
+// run starts the child and waits for it to exit. A child that exits 0 has
+// returned; one that fails or is killed has failed.
+func (b *processBackend) run(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, b.command[0], b.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	// The read end is ours, so Wait does not close it under a request
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdout.Close()
+		return err
+	}
+
+	b.mu.Lock()
+	b.proc, b.stdin, b.stdout, b.reader = cmd.Process, stdin, stdout, bufio.NewReaderSize(stdout, 1024*1024)
+	b.mu.Unlock()
+	if *debug {
+		cli.Logf("trashtalk-daemon: %s: started pid %d", b.name(), cmd.Process.Pid)
+	}
+
+	err = cmd.Wait()
+	b.mu.Lock()
+	b.proc, b.stdin, b.stdout, b.reader = nil, nil, nil, nil
+	b.mu.Unlock()
+	stdout.Close()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// dispatch sends req to the child. A child that is down leaves the request
+// to Bash.
+func (b *processBackend) dispatch(req Request) Response {
+	b.requests.Add(1)
+	resp, err := b.roundTrip(req)
+	if errors.Is(err, errNotRunning) {
+		return Response{ExitCode: 200}
+	}
+	if err != nil {
+		b.failures.Add(1)
+		return Response{ExitCode: 1, Error: fmt.Sprintf("%s: %v", b.name(), err)}
+	}
+	return resp
+}
+
+// roundTrip writes req to the child as the line its kind reads and reads
+// its answer. A child that does not answer within backendTimeout is killed.
+func (b *processBackend) roundTrip(req Request) (Response, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var resp Response
+	if b.proc == nil {
+		return resp, errNotRunning
+	}
+
+	var line any = Request{Class: req.Class, Instance: req.Instance, Selector: req.Selector, Args: req.Args}
+	if b.kind == backendServe {
+		line = protocol.ServeRequest{Instance: req.Instance, Selector: req.Selector, Args: req.Args}
+	}
+	out, err := json.Marshal(line)
+	if err != nil {
+		return resp, err
+	}
+	if _, err := b.stdin.Write(append(out, '\n')); err != nil {
+		return resp, err
+	}
+	b.stdout.SetReadDeadline(time.Now().Add(backendTimeout))
+	answer, err := b.reader.ReadBytes('\n')
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.proc.Kill()
+		return resp, fmt.Errorf("no answer within %v", backendTimeout)
+	}
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		return resp, fmt.Errorf("invalid JSON: %w", err)
+	}
+	return resp, nil
+}
+
+// pid returns the process ID of the running child, or 0 while it is down
+func (b *processBackend) pid() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.proc == nil {
+		return 0
+	}
+	return b.proc.Pid
+}
+
+// state returns the backend's metrics
+func (b *processBackend) state() backendState {
+	return backendState{
+		Class:    b.className,
+		Kind:     b.kind,
+		Child:    b.name(),
+		PID:      b.pid(),
+		Requests: b.requests.Load(),
+		Failures: b.failures.Load(),
+	}
+}
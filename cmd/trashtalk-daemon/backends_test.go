@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chazu/procyon/pkg/client"
+)
+
+// pongServer is a --serve child that answers pong to every request
+const pongServer = `while read line; do echo '{"result":"pong","exit_code":0}'; done`
+
+// waitFor polls cond until it holds, failing the test after 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestBackendRestartsKilledChild(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	tests := []struct {
+		policy      restartPolicy
+		wantStatus  string
+		wantRestart bool
+	}{
+		{restartOnFailure, childRunning, true},
+		{restartNever, childFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s, _ := testSupervisor(t)
+			b := &processBackend{className: "Counter", kind: backendServe, command: []string{"sh", "-c", pongServer}}
+			b.start(s, tt.policy, 5)
+
+			waitFor(t, "the child to start", func() bool { return b.pid() != 0 })
+			if resp := b.dispatch(Request{Class: "Counter", Selector: "increment"}); resp.ExitCode != 0 || resp.Result != "pong" {
+				t.Fatalf("dispatch answered %+v, want pong", resp)
+			}
+
+			pid := b.pid()
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the child to be restarted or left down", func() bool {
+				state := s.states()[0]
+				return state.Status == childFailed || state.Restarts > 0 && b.pid() != 0
+			})
+
+			state := s.states()[0]
+			if state.Name != "serve:Counter" || state.Status != tt.wantStatus {
+				t.Errorf("state = %+v, want serve:Counter %s", state, tt.wantStatus)
+			}
+			resp := b.dispatch(Request{Class: "Counter", Selector: "increment"})
+			if tt.wantRestart {
+				if state.Restarts != 1 || b.pid() == pid {
+					t.Errorf("restarts = %d with pid %d, want 1 restart with a new pid", state.Restarts, b.pid())
+				}
+				if resp.ExitCode != 0 || resp.Result != "pong" {
+					t.Errorf("dispatch after the restart answered %+v, want pong", resp)
+				}
+			} else {
+				if state.Restarts != 0 || b.pid() != 0 {
+					t.Errorf("restarts = %d with pid %d, want the child left down", state.Restarts, b.pid())
+				}
+				if resp.ExitCode != 200 {
+					t.Errorf("dispatch to the stopped child answered %+v, want the Bash fallback", resp)
+				}
+			}
+			if got := b.state(); got.Requests != 2 || got.Failures != 0 {
+				t.Errorf("metrics = %+v, want 2 requests and no failures", got)
+			}
+		})
+	}
+}
+
+func TestIsolatedPluginSendsThroughDaemon(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the daemon and plugins")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	plugins := t.TempDir()
+	buildPlugin(t, plugins, `Echo subclass: Object
+
+  classMethod: ping [
+    ^ 'pong'
+  ]
+`)
+	buildPlugin(t, plugins, `Greeter subclass: Object
+
+  classMethod: hello [
+    ^ @ Echo ping
+  ]
+`)
+	c := startDaemon(t, plugins, "--isolate", "Greeter")
+
+	// Greeter runs in the child daemon and sends to Echo through this one
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := c.SendContext(ctx, client.Request{Class: "Greeter", Selector: "hello"})
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if resp.ExitCode != 0 || resp.Result != "pong" {
+		t.Errorf("hello answered %+v, want pong", resp)
+	}
+
+	resp, err = c.SendContext(ctx, client.Request{Class: adminClass, Selector: "backends"})
+	if err != nil {
+		t.Fatalf("backends: %v", err)
+	}
+	var states []backendState
+	if err := json.Unmarshal([]byte(resp.Result), &states); err != nil {
+		t.Fatalf("backends answered %+v: %v", resp, err)
+	}
+	if len(states) != 1 || states[0].Child != "plugin:Greeter" || states[0].PID == 0 || states[0].Requests != 1 {
+		t.Errorf("backends = %+v, want plugin:Greeter running with 1 request", states)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jamesits/goinvoke"
+
+	"github.com/chazu/procyon/pkg/cli"
+)
+
+// Classes that use primitives reaching outside the instance store declare
+// them (capabilities: network fileWrite), and their plugins export the list
+// as GetCapabilities. --grant names the capabilities this daemon allows;
+// a plugin asking for any other is refused instead of dispatched to, so a
+// shared daemon only runs classes with the powers its operator granted.
+// Plugins without GetCapabilities need none.
+
+// PluginCapabilityFuncs holds the optional GetCapabilities export, loaded on
+// its own since goinvoke fails a struct if any of its exports is missing
+type PluginCapabilityFuncs struct {
+	GetCapabilities *goinvoke.Proc `func:"GetCapabilities"`
+}
+
+// capabilityError is the refusal of a plugin that needs ungranted capabilities
+type capabilityError struct {
+	className string
+	missing   []string
+}
+
+func (e *capabilityError) Error() string {
+	return fmt.Sprintf("class %s requires capabilities not granted to this daemon: %s (see --grant)",
+		e.className, strings.Join(e.missing, ", "))
+}
+
+// parseGrants parses --grant: a comma-separated list of capabilities, "all"
+// or "none". It returns nil if every capability is granted.
+func parseGrants(s string) map[string]bool {
+	switch strings.TrimSpace(s) {
+	case "all":
+		return nil
+	case "none":
+		return map[string]bool{}
+	}
+	granted := map[string]bool{}
+	for _, c := range cli.SplitList(s) {
+		granted[c] = true
+	}
+	return granted
+}
+
+// checkCapabilities returns a *capabilityError if the plugin at soPath
+// requires capabilities that were not granted.
+func (d *Daemon) checkCapabilities(soPath, className string) error {
+	if d.granted == nil {
+		return nil
+	}
+	var funcs PluginCapabilityFuncs
+	if err := goinvoke.Unmarshal(soPath, &funcs); err != nil || funcs.GetCapabilities == nil {
+		return nil // plugin needs no capabilities
+	}
+
+	ret, _, _ := funcs.GetCapabilities.Call()
+	var required []string
+	if err := json.Unmarshal([]byte(retString(ret)), &required); err != nil {
+		return fmt.Errorf("invalid GetCapabilities: %w", err)
+	}
+	var missing []string
+	for _, c := range required {
+		if !d.granted[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return &capabilityError{className: className, missing: missing}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chazu/procyon/pkg/client"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+func TestMain(m *testing.M) {
+	registerFlags(flag.NewFlagSet("trashtalk-daemon", flag.ContinueOnError))
+	os.Exit(m.Run())
+}
+
+// buildPlugin generates the plugin of the class in src and builds it into
+// dir as the daemon loads it
+func buildPlugin(t *testing.T, dir, src string) {
+	t.Helper()
+	class, err := source.Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := codegen.GeneratePlugin(class)
+	if len(result.Errors) > 0 {
+		t.Fatalf("generate %s: %v", class.Name, result.Errors)
+	}
+
+	mod := t.TempDir()
+	for _, name := range []string{"go.mod", "go.sum"} {
+		data, err := os.ReadFile(filepath.Join("../..", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "go.mod" {
+			data = bytes.Replace(data, []byte("module github.com/chazu/procyon"), []byte("module generated"), 1)
+		}
+		if err := os.WriteFile(filepath.Join(mod, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(mod, "main.go"), []byte(result.Code), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goBuild(t, mod, "-buildmode=c-shared", "-o", filepath.Join(dir, class.Name+pluginExt()), ".")
+}
+
+// goBuild runs go build with args in dir
+func goBuild(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("go", append([]string{"build"}, args...)...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+}
+
+// startDaemon builds trashtalk-daemon and runs it with --socket on the
+// plugins in pluginDir and the further flags in args, and returns a client
+// of its socket
+func startDaemon(t *testing.T, pluginDir string, args ...string) *client.Client {
+	t.Helper()
+	tmp := t.TempDir()
+	bin := filepath.Join(tmp, "trashtalk-daemon")
+	goBuild(t, ".", "-o", bin, ".")
+
+	sock := filepath.Join(tmp, "daemon.sock")
+	cmd := exec.Command(bin, append([]string{"--socket", sock, "--plugin-dir", pluginDir, "--idle-timeout", "0"}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"TRASHTALK_DAEMON_SOCKET="+sock,
+		"SQLITE_JSON_DB="+filepath.Join(tmp, "instances.db"),
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for start := time.Now(); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("daemon did not create its socket")
+		}
+	}
+	c, err := client.Dial(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPluginSendsThroughDaemon(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the daemon and plugins")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	plugins := t.TempDir()
+	buildPlugin(t, plugins, `Echo subclass: Object
+
+  classMethod: ping [
+    ^ 'pong'
+  ]
+`)
+	buildPlugin(t, plugins, `Greeter subclass: Object
+
+  classMethod: hello [
+    ^ @ Echo ping
+  ]
+`)
+	c := startDaemon(t, plugins)
+
+	// Greeter's dispatch connects back to the daemon, which must answer it
+	// while it is still dispatching hello
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := c.SendContext(ctx, client.Request{Class: "Greeter", Selector: "hello"})
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	if resp.ExitCode != 0 || resp.Result != "pong" {
+		t.Errorf("hello answered %+v, want pong", resp)
+	}
+
+	// And the daemon goes on answering afterwards
+	resp, err = c.SendContext(ctx, client.Request{Class: adminClass, Selector: "children"})
+	if err != nil {
+		t.Fatalf("children: %v", err)
+	}
+	if resp.ExitCode != 0 {
+		t.Errorf("children answered %+v", resp)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// An instance selector a plugin leaves to Bash may be compiled in the plugin
+// of a parent class. Before the request falls back, the daemon forwards it
+// up the parents named by GetClassInfo, as compiled binaries forward to
+// their parent's binary. A class already asked is not asked again, so a
+// cycle in the class infos ends in Bash.
+
+// inheritable reports whether a request the plugin answered 200 for may be
+// answered by a parent: class methods and delete are left to Bash
+func inheritable(plugin *Plugin, req Request) bool {
+	return !isClassCall(req.Instance, plugin.bareName) && req.Selector != "delete"
+}
+
+// parentOf returns the parent class from the GetClassInfo of a loaded plugin,
+// or "" when it derives from Object or did not report one
+func (d *Daemon) parentOf(compiled string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if e, ok := d.classInfo[compiled]; ok && e.Parent != "Object" {
+		return e.Parent
+	}
+	return ""
+}
+
+// forwardToParent dispatches req to the nearest parent plugin that answers it,
+// merging the instance variables it returns into the request's instance
+func (d *Daemon) forwardToParent(plugin *Plugin, req Request) Response {
+	seen := map[string]bool{plugin.className: true}
+	for {
+		parent := d.parentOf(plugin.className)
+		if parent == "" {
+			return Response{ExitCode: 200}
+		}
+		p, err := d.LoadPlugin(parent)
+		var refused *capabilityError
+		if errors.As(err, &refused) {
+			return Response{ExitCode: 1, Error: refused.Error()}
+		}
+		if err != nil || seen[p.className] {
+			return Response{ExitCode: 200}
+		}
+		seen[p.className] = true
+
+		if *debug {
+			fmt.Fprintf(os.Stderr, "trashtalk-daemon: %s %s forwarded to %s\n", plugin.className, req.Selector, p.className)
+		}
+		resp := d.dispatch(p, req)
+		if resp.ExitCode == 0 {
+			resp.Instance = mergeInstance(req.Instance, resp.Instance)
+		}
+		if resp.ExitCode != 200 {
+			return resp
+		}
+		plugin = p
+	}
+}
+
+// mergeInstance returns the instance JSON with the fields of updated, which a
+// parent plugin returns without the instance variables only the subclass has
+func mergeInstance(instance, updated string) string {
+	var fields, changed map[string]json.RawMessage
+	if json.Unmarshal([]byte(instance), &fields) != nil || json.Unmarshal([]byte(updated), &changed) != nil || fields == nil {
+		return updated
+	}
+	for k, v := range changed {
+		fields[k] = v
+	}
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return updated
+	}
+	return string(merged)
+}
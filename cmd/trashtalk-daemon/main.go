@@ -8,23 +8,36 @@
 //   trashtalk-daemon [--plugin-dir DIR]                    # stdin/stdout mode
 //   trashtalk-daemon --socket /tmp/trashtalk.sock          # socket mode
 //   trashtalk-daemon --socket /tmp/trashtalk.sock --idle-timeout 300
+//   trashtalk-daemon --socket /tmp/trashtalk.sock --gc-interval 3600 --gc-roots App
+//   trashtalk-daemon --socket /tmp/trashtalk.sock --gc-interval 3600 --gc-roots App --restart always --max-restarts 0
+//   trashtalk-daemon --socket /tmp/trashtalk.sock --grant network,env
+//   trashtalk-daemon --socket /tmp/trashtalk.sock --audit-log /var/log/trashtalk/audit.ndjson --audit-retention '*=90d'
+//   trashtalk-daemon --socket /tmp/trashtalk.sock --auth-tokens /etc/trashtalk/tokens
+//   trashtalk-daemon --socket /tmp/trashtalk.sock --serve-classes Counter --isolate Fetcher
+//   trashtalk-daemon preload --socket /tmp/trashtalk.sock --ast classes.json Counter
 package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 	"sync"
 	"syscall"
 	"time"
 	"unsafe"
 
+	"github.com/chazu/procyon/pkg/cli"
+	"github.com/chazu/procyon/pkg/client"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/chazu/procyon/pkg/protocol"
+	trashruntime "github.com/chazu/procyon/pkg/runtime"
 	"github.com/jamesits/goinvoke"
 )
 
@@ -37,46 +50,116 @@ type PluginFuncs struct {
 // Plugin represents a loaded class plugin
 type Plugin struct {
 	funcs     *PluginFuncs
+	stream    *PluginStreamFuncs // nil for plugins without DispatchStream
+	routes    *selectorRoutes
 	className string
+	bareName  string // the GetClassName of the plugin, which addresses class methods
 	path      string
 }
 
-// Request is the JSON request from Bash
-type Request struct {
-	Class    string   `json:"class"`
-	Instance string   `json:"instance"`
-	Selector string   `json:"selector"`
-	Args     []string `json:"args"`
+// badPlugin records a plugin that failed validation. The error is reused
+// until the plugin file changes, so a rebuilt plugin is tried again.
+type badPlugin struct {
+	modTime time.Time
+	err     error
 }
 
+// Request is the JSON request from Bash
+type Request = client.Request
+
 // Response is the JSON response to Bash
-type Response struct {
-	Instance string `json:"instance,omitempty"`
-	Result   string `json:"result,omitempty"`
-	ExitCode int    `json:"exit_code"`
-	Error    string `json:"error,omitempty"`
-}
+type Response = client.Response
 
 // Daemon manages plugin loading and dispatch
 type Daemon struct {
-	plugins     map[string]*Plugin // className -> plugin
+	plugins     map[string]*Plugin    // compiled name -> plugin
+	bad         map[string]badPlugin  // compiled name -> failed validation
+	classes     map[string]classEntry // compiled name -> class, from the plugin dir
+	classInfo   map[string]classEntry // compiled name -> class, from GetClassInfo
+	aliases     map[string]string     // requested name -> compiled name
+	aliasStamp  time.Time
 	pluginDir   string
 	mu          sync.RWMutex
 	idleTimeout time.Duration
 	idleTimer   *time.Timer
 	timerMu     sync.Mutex
+	children    *supervisor                // background jobs and child processes, restarted per --restart
+	backends    map[string]*processBackend // compiled name -> child process serving the class (--serve-classes, --isolate)
+	granted     map[string]bool            // capabilities plugins may require, nil for all (--grant)
+	audit       *auditLog                  // request log, nil without --audit-log
+	auth        protocol.AuthProvider      // checks requests before dispatch, nil without --auth-tokens or --auth-hook
 }
 
 var (
-	pluginDir   = flag.String("plugin-dir", "", "Directory containing .dylib/.so plugins")
-	socketPath  = flag.String("socket", "", "Unix socket path (enables socket mode)")
-	idleTimeout = flag.Int("idle-timeout", 300, "Idle timeout in seconds (socket mode only, 0 = no timeout)")
-	debug       = flag.Bool("debug", false, "Enable debug output to stderr")
+	pluginDir   *string
+	socketPath  *string
+	idleTimeout *int
+	debug       *bool
+	gcInterval  *int
+	gcRoots     *string
+	gcDelete    *bool
+	restart     *string
+	maxRestarts *int
+	grant       *string
+	auditPath   *string
+	auditSize   *int
+	auditKeep   *int
+	auditRetain *string
+	authTokens  *string
+	authHook    *string
+	serveClass  *string
+	isolate     *string
 )
 
+// registerFlags defines the daemon flags on fs.
+func registerFlags(fs *flag.FlagSet) {
+	pluginDir = fs.String("plugin-dir", "", "Directory containing .dylib/.so plugins")
+	socketPath = fs.String("socket", "", "Unix socket path (enables socket mode)")
+	idleTimeout = fs.Int("idle-timeout", 300, "Idle timeout in seconds (socket mode only, 0 = no timeout)")
+	debug = fs.Bool("debug", false, "Enable debug output to stderr")
+	gcInterval = fs.Int("gc-interval", 0, "Run instance garbage collection every N seconds (0 = disabled)")
+	gcRoots = fs.String("gc-roots", "", "Comma-separated root classes for garbage collection")
+	gcDelete = fs.Bool("gc-delete", false, "Delete unreachable instances during scheduled GC (default: report only)")
+	restart = fs.String("restart", string(restartOnFailure), "Restart policy for background jobs and child processes: always, on-failure or never")
+	maxRestarts = fs.Int("max-restarts", 5, "Restarts of a background job or child process before it is left failed (0 = no limit)")
+	grant = fs.String("grant", "all", "Comma-separated capabilities plugins may require (network, fileWrite, process, env), all or none")
+	auditPath = fs.String("audit-log", "", "Append one JSON line per request (peer, class, selector, instance, exit code) to this file")
+	auditSize = fs.Int("audit-max-size", 10, "Rotate the audit log when it would grow past N megabytes (0 = never)")
+	auditKeep = fs.Int("audit-keep", 5, "Rotated audit logs kept")
+	auditRetain = fs.String("audit-retention", "", "Comma-separated Class=duration pairs (90d, 720h; * for other classes) after which audit entries are dropped")
+	authTokens = fs.String("auth-tokens", "", "Only dispatch requests whose token is listed in this file (TOKEN PRINCIPAL [CLASS...] per line)")
+	authHook = fs.String("auth-hook", "", "Only dispatch requests this command, run with sh -c, authenticates and authorizes")
+	serveClass = fs.String("serve-classes", "", "Comma-separated classes served by their binary (<Class>.native --serve in the plugin dir) in a supervised child process")
+	isolate = fs.String("isolate", "", "Comma-separated classes whose plugins are loaded in a supervised child daemon instead of this one")
+}
+
 func main() {
-	flag.Parse()
+	root := &cli.Command{
+		Name:  "trashtalk-daemon",
+		Short: "Dynamic plugin loader for Trashtalk",
+		Long: "Loads c-shared class plugins on demand and dispatches JSON requests read from\n" +
+			"stdin, or from a Unix socket with --socket. Plugins default to\n" +
+			"~/.trashtalk/trash/.compiled.",
+		Examples: []string{
+			"trashtalk-daemon --plugin-dir DIR",
+			"trashtalk-daemon --socket /tmp/trashtalk.sock --idle-timeout 300",
+			"trashtalk-daemon --socket /tmp/trashtalk.sock --gc-interval 3600 --gc-roots App",
+			"trashtalk-daemon --socket /tmp/trashtalk.sock --grant network",
+			"trashtalk-daemon --socket /tmp/trashtalk.sock --audit-log audit.ndjson --audit-retention 'Payments=2160h,*=30d'",
+			"trashtalk-daemon --socket /tmp/trashtalk.sock --auth-hook /usr/local/libexec/trashtalk-auth",
+			"trashtalk-daemon --socket /tmp/trashtalk.sock --serve-classes Counter --isolate Fetcher",
+		},
+		Flags:    registerFlags,
+		Commands: []*cli.Command{preloadCommand()},
+		Run: func([]string) error {
+			return serve()
+		},
+	}
+	root.Execute()
+}
 
+// serve starts the daemon in stdin or socket mode.
+func serve() error {
 	// Determine plugin directory
 	dir := *pluginDir
 	if dir == "" {
@@ -84,21 +167,59 @@ func main() {
 		dir = filepath.Join(home, ".trashtalk", "trash", ".compiled")
 	}
 
+	policy, err := parseRestartPolicy(*restart)
+	if err != nil {
+		return cli.Errorf(cli.ExitUsage, "--restart: %v", err)
+	}
+	auth, err := parseAuth(*authTokens, *authHook)
+	if err != nil {
+		return err
+	}
+
 	d := &Daemon{
 		plugins:     make(map[string]*Plugin),
+		bad:         make(map[string]badPlugin),
+		classInfo:   make(map[string]classEntry),
 		pluginDir:   dir,
 		idleTimeout: time.Duration(*idleTimeout) * time.Second,
+		children:    newSupervisor(),
+		granted:     parseGrants(*grant),
+		auth:        auth,
 	}
+	defer d.children.stop()
 
 	if *debug {
 		fmt.Fprintf(os.Stderr, "trashtalk-daemon: plugin-dir=%s\n", dir)
 	}
 
+	if *auditPath != "" {
+		retention, err := parseRetention(*auditRetain)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "--audit-retention: %v", err)
+		}
+		d.audit, err = openAuditLog(*auditPath, int64(*auditSize)<<20, max(*auditKeep, 0), retention)
+		if err != nil {
+			return cli.Errorf(cli.ExitUsage, "--audit-log: %v", err)
+		}
+		defer d.audit.Close()
+		if len(retention) > 0 {
+			d.startAuditPruneJob(policy)
+		}
+	}
+
+	if *gcInterval > 0 {
+		d.startGCJob(time.Duration(*gcInterval)*time.Second, cli.SplitList(*gcRoots), *gcDelete, policy)
+	}
+
+	if err := d.startBackends(cli.SplitList(*serveClass), cli.SplitList(*isolate), policy); err != nil {
+		return cli.Errorf(cli.ExitUsage, "%v", err)
+	}
+
 	if *socketPath != "" {
-		d.RunSocket(*socketPath)
-	} else {
-		d.RunStdin()
+		return d.RunSocket(*socketPath)
 	}
+	d.RunStdin()
+	return nil
 }
 
 // RunStdin processes JSON requests from stdin (original mode)
@@ -107,6 +228,8 @@ func (d *Daemon) RunStdin() {
 	// Increase buffer for large instance JSON
 	buf := make([]byte, 1024*1024) // 1MB
 	scanner.Buffer(buf, len(buf))
+	peer := stdinPeer()
+	var dec protocol.Decoder
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -115,7 +238,7 @@ func (d *Daemon) RunStdin() {
 		}
 
 		var req Request
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
+		if err := dec.Decode([]byte(line), &req); err != nil {
 			d.respond(os.Stdout, Response{ExitCode: 1, Error: "invalid JSON: " + err.Error()})
 			continue
 		}
@@ -124,8 +247,7 @@ func (d *Daemon) RunStdin() {
 			fmt.Fprintf(os.Stderr, "trashtalk-daemon: request class=%s selector=%s\n", req.Class, req.Selector)
 		}
 
-		resp := d.HandleRequest(req)
-		d.respond(os.Stdout, resp)
+		d.respond(os.Stdout, d.handle(peer, req))
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -134,14 +256,13 @@ func (d *Daemon) RunStdin() {
 }
 
 // RunSocket runs the daemon in Unix socket mode
-func (d *Daemon) RunSocket(path string) {
+func (d *Daemon) RunSocket(path string) error {
 	// Remove existing socket file
 	os.Remove(path)
 
 	listener, err := net.Listen("unix", path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "trashtalk-daemon: failed to listen on %s: %v\n", path, err)
-		os.Exit(1)
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
 	}
 	defer listener.Close()
 	defer os.Remove(path)
@@ -174,7 +295,11 @@ func (d *Daemon) RunSocket(path string) {
 		d.startIdleTimer(listener)
 	}
 
-	// Accept connections
+	// Accept connections. Each is served on its own goroutine: a plugin that
+	// sends a message connects back to the daemon while its own request is
+	// still being dispatched. The plugin serializes its dispatches itself.
+	var conns sync.WaitGroup
+	defer conns.Wait()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
@@ -192,12 +317,17 @@ func (d *Daemon) RunSocket(path string) {
 		d.resetIdleTimer(listener)
 
 		// Handle connection (one request per connection)
-		d.handleConnection(conn)
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			d.handleConnection(conn)
+		}()
 	}
 
 	if *debug {
 		fmt.Fprintf(os.Stderr, "trashtalk-daemon: exiting\n")
 	}
+	return nil
 }
 
 // handleConnection handles a single request on a connection
@@ -217,7 +347,8 @@ func (d *Daemon) handleConnection(conn net.Conn) {
 	}
 
 	var req Request
-	if err := json.Unmarshal([]byte(line), &req); err != nil {
+	var dec protocol.Decoder
+	if err := dec.Decode([]byte(line), &req); err != nil {
 		d.respond(conn, Response{ExitCode: 1, Error: "invalid JSON: " + err.Error()})
 		return
 	}
@@ -226,8 +357,23 @@ func (d *Daemon) handleConnection(conn net.Conn) {
 		fmt.Fprintf(os.Stderr, "trashtalk-daemon: request class=%s selector=%s\n", req.Class, req.Selector)
 	}
 
-	resp := d.HandleRequest(req)
-	d.respond(conn, resp)
+	d.respond(conn, d.handle(connPeer(conn), req))
+}
+
+// handle authorizes and dispatches a request from peer and records it in
+// the audit log, if there is one
+func (d *Daemon) handle(peer *peerCred, req Request) Response {
+	principal, err := d.authorize(req)
+	var resp Response
+	if err != nil {
+		resp = Response{ExitCode: protocol.ExitUnauthorized, Error: err.Error()}
+	} else {
+		resp = d.HandleRequest(req)
+	}
+	if d.audit != nil {
+		d.audit.Record(peer, principal, req, resp)
+	}
+	return resp
 }
 
 // startIdleTimer starts the idle timeout timer
@@ -259,6 +405,58 @@ func (d *Daemon) resetIdleTimer(listener net.Listener) {
 	}
 }
 
+// startGCJob periodically collects instances unreachable from the root
+// classes, as the supervised child "gc". A failed pass ends the child, so
+// the restart policy decides whether collection goes on.
+func (d *Daemon) startGCJob(interval time.Duration, roots []string, remove bool, policy restartPolicy) {
+	if len(roots) == 0 {
+		cli.Logf("trashtalk-daemon: --gc-interval set without --gc-roots, scheduled GC disabled")
+		return
+	}
+
+	d.children.start(childSpec{
+		name: "gc",
+		run: func(ctx context.Context) error {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+					if err := d.runGC(roots, remove); err != nil {
+						return err
+					}
+				}
+			}
+		},
+		policy:      policy,
+		maxRestarts: *maxRestarts,
+		minBackoff:  time.Second,
+		maxBackoff:  min(interval, time.Minute),
+	})
+}
+
+// runGC performs a single garbage collection pass and logs the outcome
+func (d *Daemon) runGC(roots []string, remove bool) error {
+	rt, err := trashruntime.New(nil)
+	if err != nil {
+		return err
+	}
+	defer rt.Close()
+
+	report, err := rt.CollectGarbage(roots, remove)
+	if err != nil {
+		return err
+	}
+
+	if *debug || len(report.Unreachable) > 0 {
+		cli.Logf("trashtalk-daemon: gc: %d instances, %d unreachable, %d deleted",
+			report.Total, len(report.Unreachable), report.Deleted)
+	}
+	return nil
+}
+
 func (d *Daemon) respond(w interface{ Write([]byte) (int, error) }, resp Response) {
 	output, _ := json.Marshal(resp)
 	w.Write(append(output, '\n'))
@@ -266,8 +464,20 @@ func (d *Daemon) respond(w interface{ Write([]byte) (int, error) }, resp Respons
 
 // HandleRequest processes a single dispatch request
 func (d *Daemon) HandleRequest(req Request) Response {
+	if req.Class == adminClass {
+		return d.handleAdmin(req)
+	}
+	if b := d.backendFor(req.Class); b != nil {
+		return b.dispatch(req)
+	}
+
 	// Load plugin on demand
 	plugin, err := d.LoadPlugin(req.Class)
+	var refused *capabilityError
+	if errors.As(err, &refused) {
+		// Running the class in Bash would grant what the daemon refused
+		return Response{ExitCode: 1, Error: refused.Error()}
+	}
 	if err != nil {
 		if *debug {
 			fmt.Fprintf(os.Stderr, "trashtalk-daemon: no plugin for %s: %v\n", req.Class, err)
@@ -276,6 +486,24 @@ func (d *Daemon) HandleRequest(req Request) Response {
 		return Response{ExitCode: 200}
 	}
 
+	resp := d.dispatch(plugin, req)
+	if resp.ExitCode == 200 && inheritable(plugin, req) {
+		return d.forwardToParent(plugin, req)
+	}
+	return resp
+}
+
+// dispatch sends a request to a loaded plugin
+func (d *Daemon) dispatch(plugin *Plugin, req Request) Response {
+	// Skip the plugin for selectors it leaves to Bash
+	class := isClassCall(req.Instance, plugin.bareName)
+	if plugin.routes.toBash(class, req.Selector) {
+		if *debug {
+			fmt.Fprintf(os.Stderr, "trashtalk-daemon: %s %s routed to Bash\n", plugin.className, req.Selector)
+		}
+		return Response{ExitCode: 200}
+	}
+
 	// Convert args to JSON
 	argsJSON, _ := json.Marshal(req.Args)
 
@@ -299,6 +527,7 @@ func (d *Daemon) HandleRequest(req Request) Response {
 	}
 
 	if resultData.ExitCode == 200 {
+		plugin.routes.learnBash(class, req.Selector)
 		return Response{ExitCode: 200}
 	}
 
@@ -313,40 +542,59 @@ func (d *Daemon) HandleRequest(req Request) Response {
 	}
 }
 
-// LoadPlugin loads a class plugin, caching for subsequent calls
-func (d *Daemon) LoadPlugin(className string) (*Plugin, error) {
+// LoadPlugin loads a class plugin, caching for subsequent calls.
+// The requested name may be a compiled, qualified, or bare class name.
+func (d *Daemon) LoadPlugin(requested string) (*Plugin, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
+	className := d.resolveClass(requested)
 	if p, ok := d.plugins[className]; ok {
 		return p, nil // Already loaded
 	}
 
-	// Determine shared library extension
-	ext := ".so"
-	if runtime.GOOS == "darwin" {
-		ext = ".dylib"
-	}
-
 	// Find and load shared library
-	soPath := filepath.Join(d.pluginDir, className+ext)
-	if _, err := os.Stat(soPath); os.IsNotExist(err) {
+	soPath := filepath.Join(d.pluginDir, className+pluginExt())
+	info, err := os.Stat(soPath)
+	if err != nil {
 		return nil, fmt.Errorf("plugin not found: %s", soPath)
 	}
 
+	if b, ok := d.bad[className]; ok && b.modTime.Equal(info.ModTime()) {
+		return nil, b.err
+	}
+
 	funcs := &PluginFuncs{}
 	if err := goinvoke.Unmarshal(soPath, funcs); err != nil {
 		return nil, fmt.Errorf("failed to load %s: %w", soPath, err)
 	}
 
-	// Verify plugin loaded correctly
-	if funcs.Dispatch == nil {
-		return nil, fmt.Errorf("plugin %s missing Dispatch function", soPath)
+	// Verify plugin loaded correctly and is the class that was asked for
+	if err := validatePlugin(funcs, className); err != nil {
+		err = fmt.Errorf("plugin %s: %w", soPath, err)
+		cli.Logf("trashtalk-daemon: %v; using Bash until it is rebuilt", err)
+		d.bad[className] = badPlugin{modTime: info.ModTime(), err: err}
+		return nil, err
+	}
+	if err := d.checkCapabilities(soPath, className); err != nil {
+		cli.Logf("trashtalk-daemon: plugin %s: %v", soPath, err)
+		d.bad[className] = badPlugin{modTime: info.ModTime(), err: err}
+		return nil, err
 	}
+	delete(d.bad, className)
+	d.recordClassInfo(soPath, className)
 
+	var classInfo *classEntry
+	if e, ok := d.classInfo[className]; ok {
+		classInfo = &e
+	}
+	_, bare := mangle.SplitClass(className)
 	p := &Plugin{
 		funcs:     funcs,
+		stream:    loadStream(soPath),
+		routes:    newRoutes(classInfo),
 		className: className,
+		bareName:  bare,
 		path:      soPath,
 	}
 
@@ -358,9 +606,43 @@ func (d *Daemon) LoadPlugin(className string) (*Plugin, error) {
 	return p, nil
 }
 
+// validatePlugin checks that a loaded plugin has the required exports and
+// that GetClassName reports the requested class. A mismatch means the plugin
+// is stale or was renamed, and dispatching to it would run the wrong methods.
+func validatePlugin(funcs *PluginFuncs, className string) error {
+	if funcs.Dispatch == nil {
+		return fmt.Errorf("missing Dispatch function")
+	}
+	if funcs.GetClassName == nil {
+		return fmt.Errorf("missing GetClassName function")
+	}
+
+	ret, _, _ := funcs.GetClassName.Call()
+	exported := retString(ret)
+	if !classNameMatches(className, exported) {
+		return fmt.Errorf("exports class %q, expected %q (stale or renamed plugin?)", exported, className)
+	}
+	return nil
+}
+
+// classNameMatches reports whether a plugin's GetClassName result names the
+// requested class. Plugins export the bare class name, while namespaced
+// classes are requested as MyApp__Counter or MyApp::Counter.
+func classNameMatches(requested, exported string) bool {
+	if exported == "" {
+		return false
+	}
+	_, class := mangle.SplitClass(requested)
+	return requested == exported || class == exported
+}
+
 // callDispatch calls the plugin's Dispatch function via FFI
 // The plugin returns a single JSON string with exit_code embedded to avoid struct return ABI issues
 func (d *Daemon) callDispatch(plugin *Plugin, instance, selector, argsJSON string) string {
+	if plugin.stream != nil {
+		return d.callDispatchStream(plugin, instance, selector, argsJSON)
+	}
+
 	// Convert Go strings to C strings (null-terminated)
 	instancePtr := cstring(instance)
 	selectorPtr := cstring(selector)
@@ -375,7 +657,7 @@ func (d *Daemon) callDispatch(plugin *Plugin, instance, selector, argsJSON strin
 	)
 
 	// The return is a single char* pointer to JSON
-	return gostring(unsafe.Pointer(ret))
+	return retString(ret)
 }
 
 // cstring converts a Go string to a C string (null-terminated byte slice)
@@ -404,6 +686,13 @@ func gostring(p unsafe.Pointer) string {
 	return string(unsafe.Slice((*byte)(p), length))
 }
 
+// retString copies out the C string a plugin export answers. The pointer is
+// read through the address of ret, so the uintptr is never converted to a
+// pointer directly.
+func retString(ret uintptr) string {
+	return gostring(*(*unsafe.Pointer)(unsafe.Pointer(&ret)))
+}
+
 // freeStrings is a no-op since we're using Go-allocated memory
 // that will be GC'd. In a real implementation, we might need to
 // free C.CString allocations from the plugin side.
@@ -0,0 +1,20 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// socketPeer returns the LOCAL_PEERCRED credentials and LOCAL_PEERPID of a
+// connected Unix socket
+func socketPeer(fd int) *peerCred {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return nil
+	}
+	peer := &peerCred{UID: int(cred.Uid)}
+	if cred.Ngroups > 0 {
+		peer.GID = int(cred.Groups[0])
+	}
+	if pid, err := unix.GetsockoptInt(fd, unix.SOL_LOCAL, unix.LOCAL_PEERPID); err == nil {
+		peer.PID = pid
+	}
+	return peer
+}
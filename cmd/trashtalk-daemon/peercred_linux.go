@@ -0,0 +1,12 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// socketPeer returns the SO_PEERCRED credentials of a connected Unix socket
+func socketPeer(fd int) *peerCred {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return nil
+	}
+	return &peerCred{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// socketPeer reports no credentials where the platform has no way to ask
+func socketPeer(fd int) *peerCred {
+	return nil
+}
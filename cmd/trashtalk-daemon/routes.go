@@ -0,0 +1,81 @@
+package main
+
+import "sync"
+
+// A plugin answers exit 200 for selectors it leaves to Bash, which costs a
+// round trip through the FFI before the caller falls back. Each loaded
+// plugin keeps a routing table so the daemon can answer 200 itself: the
+// selectors from GetClassInfo when the plugin exports it, and otherwise the
+// selectors the plugin has already answered 200 for. The table lives on the
+// Plugin, so a preload or reload starts it afresh.
+
+// selectorRoutes records which selectors a plugin answers natively
+type selectorRoutes struct {
+	known       bool            // native and nativeClass come from GetClassInfo
+	native      map[string]bool // instance selectors
+	nativeClass map[string]bool // class selectors
+
+	mu        sync.Mutex
+	bash      map[string]bool // instance selectors answered with 200
+	bashClass map[string]bool // class selectors answered with 200
+}
+
+// newRoutes returns the routing table for a plugin, seeded from its
+// GetClassInfo when info is non-nil
+func newRoutes(info *classEntry) *selectorRoutes {
+	r := &selectorRoutes{bash: make(map[string]bool), bashClass: make(map[string]bool)}
+	if info == nil {
+		return r
+	}
+	r.known = true
+	r.native = selectorSet(info.Selectors)
+	r.nativeClass = selectorSet(info.ClassSelectors)
+	return r
+}
+
+func selectorSet(selectors []string) map[string]bool {
+	set := make(map[string]bool, len(selectors))
+	for _, s := range selectors {
+		set[s] = true
+	}
+	return set
+}
+
+// isClassCall reports whether the plugin treats a request for instance as a
+// class method call: an empty instance or the bare class name
+func isClassCall(instance, className string) bool {
+	return instance == "" || instance == className
+}
+
+// toBash reports whether the plugin is known to answer 200 for selector, so
+// the request can fall back without calling it
+func (r *selectorRoutes) toBash(class bool, selector string) bool {
+	if r.known {
+		if class {
+			return !r.nativeClass[selector]
+		}
+		return !r.native[selector]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if class {
+		return r.bashClass[selector]
+	}
+	return r.bash[selector]
+}
+
+// learnBash records that the plugin answered 200 for selector. The answer
+// is fixed when the plugin is built, so it holds until the plugin reloads.
+func (r *selectorRoutes) learnBash(class bool, selector string) {
+	if r.known {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if class {
+		r.bashClass[selector] = true
+	} else {
+		r.bash[selector] = true
+	}
+}
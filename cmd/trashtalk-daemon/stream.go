@@ -0,0 +1,64 @@
+package main
+
+import (
+	"runtime"
+	"unsafe"
+
+	"github.com/jamesits/goinvoke"
+)
+
+// Dispatch answers one C string, which the daemon reads up to gostring's
+// limit and cannot free. Plugins that also export DispatchStream and
+// ReadResult keep the response on their side and hand it over in chunks
+// copied into a daemon buffer, so results of any size arrive whole. Older
+// plugins are still called through Dispatch.
+
+// streamChunk is the size of the buffer ReadResult copies a response into
+const streamChunk = 64 << 10
+
+// PluginStreamFuncs holds the optional streaming exports, loaded on their
+// own since goinvoke fails a struct if any of its exports is missing
+type PluginStreamFuncs struct {
+	DispatchStream *goinvoke.Proc `func:"DispatchStream"`
+	ReadResult     *goinvoke.Proc `func:"ReadResult"`
+}
+
+// loadStream returns the streaming exports of the plugin at soPath, or nil
+// for a plugin built without them
+func loadStream(soPath string) *PluginStreamFuncs {
+	var funcs PluginStreamFuncs
+	if err := goinvoke.Unmarshal(soPath, &funcs); err != nil || funcs.DispatchStream == nil || funcs.ReadResult == nil {
+		return nil
+	}
+	return &funcs
+}
+
+// callDispatchStream calls DispatchStream, then reads the response with
+// ReadResult until it has the length DispatchStream reported
+func (d *Daemon) callDispatchStream(plugin *Plugin, instance, selector, argsJSON string) string {
+	instancePtr := cstring(instance)
+	selectorPtr := cstring(selector)
+	argsPtr := cstring(argsJSON)
+	defer freeStrings(instancePtr, selectorPtr, argsPtr)
+	size := new(int64)
+
+	handle, _, _ := plugin.stream.DispatchStream.Call(
+		uintptr(instancePtr),
+		uintptr(selectorPtr),
+		uintptr(argsPtr),
+		uintptr(unsafe.Pointer(size)),
+	)
+
+	out := make([]byte, 0, *size)
+	buf := make([]byte, streamChunk)
+	for int64(len(out)) < *size {
+		n, _, _ := plugin.stream.ReadResult.Call(handle, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)))
+		if int64(n) <= 0 {
+			break
+		}
+		out = append(out, buf[:n]...)
+	}
+	runtime.KeepAlive(size)
+	runtime.KeepAlive(buf)
+	return string(out)
+}
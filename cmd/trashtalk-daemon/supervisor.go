@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chazu/procyon/pkg/cli"
+)
+
+// The daemon's background work runs as children of one supervisor rather
+// than as goroutines of their own. A child that returns, fails or panics is
+// restarted according to its policy, after a backoff that doubles on each
+// restart up to maxBackoff, until it has been restarted maxRestarts times.
+// Every child is stopped through one context when the daemon exits.
+
+// restartPolicy says whether a child that returned is started again
+type restartPolicy string
+
+const (
+	restartAlways    restartPolicy = "always"     // whatever it returned
+	restartOnFailure restartPolicy = "on-failure" // if it returned an error or panicked
+	restartNever     restartPolicy = "never"
+)
+
+// parseRestartPolicy parses a --restart policy flag value
+func parseRestartPolicy(s string) (restartPolicy, error) {
+	switch p := restartPolicy(s); p {
+	case restartAlways, restartOnFailure, restartNever:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid restart policy %q (want always, on-failure or never)", s)
+}
+
+// restarts reports whether the policy restarts a child that returned err
+func (p restartPolicy) restarts(err error) bool {
+	switch p {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// childSpec describes a supervised child. run must return when ctx is done.
+type childSpec struct {
+	name        string
+	run         func(ctx context.Context) error
+	policy      restartPolicy
+	maxRestarts int // 0 = no limit
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+// Child statuses
+const (
+	childRunning = "running"
+	childBackoff = "backoff" // waiting to be restarted
+	childStopped = "stopped" // returned and not restarted, or shut down
+	childFailed  = "failed"  // failed and not restarted
+)
+
+// childState is the state of a child, as reported by the children admin
+// selector
+type childState struct {
+	Name        string     `json:"name"`
+	Policy      string     `json:"policy"`
+	Status      string     `json:"status"`
+	Restarts    int        `json:"restarts"`
+	MaxRestarts int        `json:"max_restarts,omitempty"`
+	StartedAt   time.Time  `json:"started_at"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRestart *time.Time `json:"next_restart,omitempty"`
+}
+
+// supervisor runs and restarts the daemon's children
+type supervisor struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	children []*childState
+	after    func(time.Duration) <-chan time.Time // waits out a backoff
+}
+
+func newSupervisor() *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{ctx: ctx, cancel: cancel, after: time.After}
+}
+
+// start runs a child under the supervisor
+func (s *supervisor) start(spec childSpec) {
+	if spec.minBackoff <= 0 {
+		spec.minBackoff = time.Second
+	}
+	if spec.maxBackoff < spec.minBackoff {
+		spec.maxBackoff = spec.minBackoff
+	}
+	state := &childState{Name: spec.name, Policy: string(spec.policy), MaxRestarts: spec.maxRestarts}
+
+	s.mu.Lock()
+	s.children = append(s.children, state)
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.supervise(spec, state)
+}
+
+// supervise runs spec until its policy or restart limit stops it, or the
+// supervisor is stopped
+func (s *supervisor) supervise(spec childSpec, state *childState) {
+	defer s.wg.Done()
+
+	backoff := spec.minBackoff
+	for {
+		started := time.Now()
+		s.update(state, func() {
+			state.Status = childRunning
+			state.StartedAt = started
+			state.NextRestart = nil
+		})
+
+		err := runChild(s.ctx, spec.run)
+		if s.ctx.Err() != nil {
+			s.update(state, func() { state.Status = childStopped })
+			return
+		}
+		if err != nil {
+			s.update(state, func() { state.LastError = err.Error() })
+		}
+
+		if !spec.policy.restarts(err) {
+			status := childStopped
+			if err != nil {
+				status = childFailed
+				cli.Logf("trashtalk-daemon: %s: %v", spec.name, err)
+			}
+			s.update(state, func() { state.Status = status })
+			return
+		}
+		if spec.maxRestarts > 0 && state.Restarts >= spec.maxRestarts {
+			cli.Logf("trashtalk-daemon: %s: %v; giving up after %d restarts", spec.name, err, state.Restarts)
+			s.update(state, func() { state.Status = childFailed })
+			return
+		}
+
+		// A child that ran for longer than the longest backoff was healthy,
+		// so its next failure starts the backoff over
+		if time.Since(started) > spec.maxBackoff {
+			backoff = spec.minBackoff
+		}
+		next := time.Now().Add(backoff)
+		s.update(state, func() {
+			state.Status = childBackoff
+			state.NextRestart = &next
+		})
+		if *debug || err != nil {
+			cli.Logf("trashtalk-daemon: %s: %v; restarting in %v", spec.name, err, backoff)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			s.update(state, func() { state.Status = childStopped })
+			return
+		case <-s.after(backoff):
+		}
+		s.update(state, func() { state.Restarts++ })
+		backoff = min(backoff*2, spec.maxBackoff)
+	}
+}
+
+// runChild runs a child, turning a panic into its error
+func runChild(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(ctx)
+}
+
+func (s *supervisor) update(state *childState, change func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change()
+}
+
+// states returns a copy of every child's state, in start order
+func (s *supervisor) states() []childState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]childState, 0, len(s.children))
+	for _, c := range s.children {
+		out = append(out, *c)
+	}
+	return out
+}
+
+// stop stops every child and waits for them to return
+func (s *supervisor) stop() {
+	s.cancel()
+	s.wg.Wait()
+}
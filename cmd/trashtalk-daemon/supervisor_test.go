@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSupervisor returns a supervisor that records each backoff it waits
+// out instead of sleeping
+func testSupervisor(t *testing.T) (*supervisor, func() []time.Duration) {
+	t.Helper()
+	s := newSupervisor()
+	t.Cleanup(s.stop)
+	var mu sync.Mutex
+	var waits []time.Duration
+	s.after = func(d time.Duration) <-chan time.Time {
+		mu.Lock()
+		waits = append(waits, d)
+		mu.Unlock()
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	return s, func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(waits)
+	}
+}
+
+func TestSupervisorBackoff(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name        string
+		policy      restartPolicy
+		maxRestarts int
+		results     []error // what each run returns, the last one for every later run
+		slowRun     int     // 1-based run that outlives maxBackoff, 0 for none
+		wantWaits   []time.Duration
+		wantStatus  string
+	}{
+		{
+			name: "backoff doubles up to the max", policy: restartOnFailure, maxRestarts: 5,
+			results:    []error{errFailed},
+			wantWaits:  []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond},
+			wantStatus: childFailed,
+		},
+		{
+			name: "a healthy run starts the backoff over", policy: restartOnFailure, maxRestarts: 4,
+			results: []error{errFailed}, slowRun: 3,
+			wantWaits:  []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			wantStatus: childFailed,
+		},
+		{
+			name: "max restarts stops always", policy: restartAlways, maxRestarts: 2,
+			results:    []error{nil},
+			wantWaits:  []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+			wantStatus: childFailed,
+		},
+		{
+			name: "on-failure stops after a success", policy: restartOnFailure, maxRestarts: 5,
+			results:    []error{errFailed, errFailed, nil},
+			wantWaits:  []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+			wantStatus: childStopped,
+		},
+		{
+			name: "never restarts", policy: restartNever, maxRestarts: 5,
+			results:    []error{errFailed},
+			wantStatus: childFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, waits := testSupervisor(t)
+			runs := 0
+			s.start(childSpec{
+				name: "job",
+				run: func(ctx context.Context) error {
+					runs++
+					if runs == tt.slowRun {
+						time.Sleep(60 * time.Millisecond)
+					}
+					return tt.results[min(runs, len(tt.results))-1]
+				},
+				policy:      tt.policy,
+				maxRestarts: tt.maxRestarts,
+				minBackoff:  10 * time.Millisecond,
+				maxBackoff:  40 * time.Millisecond,
+			})
+			s.wg.Wait()
+
+			if got := waits(); !slices.Equal(got, tt.wantWaits) {
+				t.Errorf("backoffs = %v, want %v", got, tt.wantWaits)
+			}
+			state := s.states()[0]
+			if state.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", state.Status, tt.wantStatus)
+			}
+			if state.Restarts != len(tt.wantWaits) || runs != len(tt.wantWaits)+1 {
+				t.Errorf("restarts = %d and runs = %d, want %d restarts", state.Restarts, runs, len(tt.wantWaits))
+			}
+		})
+	}
+}
+
+func TestSupervisorNoRestartLimit(t *testing.T) {
+	s, waits := testSupervisor(t)
+	running := make(chan struct{})
+	runs := 0
+	s.start(childSpec{
+		name: "job",
+		run: func(ctx context.Context) error {
+			if runs++; runs <= 8 {
+				return errors.New("failed")
+			}
+			close(running)
+			<-ctx.Done()
+			return nil
+		},
+		policy:     restartOnFailure,
+		minBackoff: 10 * time.Millisecond,
+		maxBackoff: 40 * time.Millisecond,
+	})
+
+	select {
+	case <-running:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("child was restarted %d times, want 8", runs-1)
+	}
+	if got := len(waits()); got != 8 {
+		t.Errorf("waited out %d backoffs, want 8", got)
+	}
+	s.stop()
+	if state := s.states()[0]; state.Status != childStopped {
+		t.Errorf("status after stop = %s, want %s", state.Status, childStopped)
+	}
+}
+
+func TestSupervisorRecoversPanics(t *testing.T) {
+	s, _ := testSupervisor(t)
+	s.start(childSpec{
+		name:   "job",
+		run:    func(ctx context.Context) error { panic("boom") },
+		policy: restartNever,
+	})
+	s.wg.Wait()
+	if state := s.states()[0]; state.Status != childFailed || state.LastError != "panic: boom" {
+		t.Errorf("state = %+v, want failed with panic: boom", state)
+	}
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, s := range []string{"always", "on-failure", "never"} {
+		if p, err := parseRestartPolicy(s); err != nil || string(p) != s {
+			t.Errorf("parseRestartPolicy(%q) = %q, %v", s, p, err)
+		}
+	}
+	if _, err := parseRestartPolicy("sometimes"); err == nil {
+		t.Error("parseRestartPolicy(sometimes) succeeded")
+	}
+}
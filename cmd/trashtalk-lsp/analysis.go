@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/compiler"
+	"github.com/chazu/procyon/pkg/lexer"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// diagnosticSource names the server in the diagnostics it publishes
+const diagnosticSource = "trashtalk"
+
+// compiled is the outcome of compiling a document to a binary: the result,
+// and the error if compilation failed
+type compiled struct {
+	result compiler.Result
+	err    error
+}
+
+// compileDocument compiles doc as procyon would, taking included traits
+// from the workspace before the trait path
+func (s *server) compileDocument(doc *document) *compiled {
+	opts := compiler.Options{Filename: filepath.Base(uriPath(doc.uri)), TraitPath: s.traitPath}
+	if doc.class != nil {
+		opts.Traits = s.workspace.traitSources(doc.class)
+	}
+	res, err := compiler.Compile([]byte(doc.text), opts)
+	return &compiled{result: res, err: err}
+}
+
+// diagnostics returns the problems in doc: parse, trait and codegen errors,
+// the methods that fall back to Bash and why, and the included traits that
+// could not be found
+func (s *server) diagnostics(doc *document, c *compiled) []diagnostic {
+	diags := []diagnostic{}
+	var cerr *compiler.Error
+	if errors.As(c.err, &cerr) {
+		for _, d := range cerr.Diagnostics {
+			rng := doc.classRange()
+			if d.Line > 0 {
+				rng = doc.rangeAt(d.Line-1, max(d.Col-1, 0))
+			}
+			msg := d.Message
+			if cerr.Stage != compiler.StageParse {
+				msg = string(cerr.Stage) + ": " + msg
+			}
+			diags = append(diags, diagnostic{Range: rng, Severity: severityError, Source: diagnosticSource, Message: msg})
+		}
+	} else if c.err != nil {
+		diags = append(diags, diagnostic{Range: doc.classRange(), Severity: severityError, Source: diagnosticSource, Message: c.err.Error()})
+	}
+
+	own := map[string]bool{}
+	if c.result.Class != nil {
+		for _, m := range c.result.Class.Methods {
+			if m.Trait == "" {
+				own[methodKey(m.Selector, m.Location.Line)] = true
+			}
+		}
+	}
+	for _, skip := range c.result.SkippedMethods {
+		// Methods merged from a trait are reported in the trait's file
+		if !own[methodKey(skip.Selector, skip.Line)] {
+			continue
+		}
+		diags = append(diags, diagnostic{
+			Range:    doc.rangeAt(skip.Location.Line-1, skip.Location.Col),
+			Severity: severityWarning,
+			Source:   diagnosticSource,
+			Message:  fmt.Sprintf("%s falls back to Bash: %s", mangle.TrashSelector(skip.Selector), skip.Reason),
+		})
+	}
+
+	includes := doc.includes()
+	for _, name := range c.result.Traits.Missing {
+		rng, ok := includes[name]
+		if !ok {
+			rng = doc.classRange()
+		}
+		diags = append(diags, diagnostic{
+			Range:    rng,
+			Severity: severityInformation,
+			Source:   diagnosticSource,
+			Message:  fmt.Sprintf("trait %s is not in the workspace or the trait path; its methods fall back to Bash", name),
+		})
+	}
+	return diags
+}
+
+// methodKey identifies a method by its selector and definition line, which
+// tells an instance method from a class method of the same name
+func methodKey(selector string, line int) string {
+	return fmt.Sprintf("%s:%d", selector, line)
+}
+
+// symbols returns the outline of doc: the class, with its instance
+// variables, included traits and methods
+func (doc *document) symbols() []documentSymbol {
+	if doc.class == nil {
+		return []documentSymbol{}
+	}
+	class := doc.class
+	kind := symbolClass
+	detail := "subclass of " + class.Parent
+	if class.IsTrait {
+		kind, detail = symbolInterface, "trait"
+	}
+	top := documentSymbol{
+		Name:           class.QualifiedName(),
+		Detail:         detail,
+		Kind:           kind,
+		Range:          doc.wholeRange(),
+		SelectionRange: doc.classRange(),
+	}
+	for _, v := range class.InstanceVars {
+		rng := doc.nameRange(v.Location, v.Name)
+		top.Children = append(top.Children, documentSymbol{Name: v.Name, Detail: "instance variable", Kind: symbolField, Range: rng, SelectionRange: rng})
+	}
+	for _, v := range class.ClassInstanceVars {
+		rng := doc.nameRange(v.Location, v.Name)
+		top.Children = append(top.Children, documentSymbol{Name: v.Name, Detail: "class instance variable", Kind: symbolField, Range: rng, SelectionRange: rng})
+	}
+	includes := doc.includes()
+	for _, name := range class.Traits {
+		rng := includes[name]
+		top.Children = append(top.Children, documentSymbol{Name: name, Detail: "included trait", Kind: symbolInterface, Range: rng, SelectionRange: rng})
+	}
+	for _, m := range class.Methods {
+		rng, sel := doc.methodRanges(m)
+		detail := signature(m)
+		if m.Kind == "class" {
+			detail = "class " + detail
+		}
+		top.Children = append(top.Children, documentSymbol{Name: mangle.TrashSelector(m.Selector), Detail: detail, Kind: symbolMethod, Range: rng, SelectionRange: sel})
+	}
+	return []documentSymbol{top}
+}
+
+// definition returns where the word at pos in doc is defined: an instance
+// variable of doc's class, a class or trait in the workspace, or else every
+// workspace method the selector could send to
+func (s *server) definition(doc *document, pos position) []location {
+	i := doc.tokenAt(pos)
+	if i < 0 {
+		return nil
+	}
+	tok := doc.tokens[i]
+	if tok.Type == lexer.IDENTIFIER && doc.class != nil {
+		for _, v := range doc.class.InstanceVars {
+			if v.Name == tok.Value {
+				return []location{{doc.uri, doc.nameRange(v.Location, v.Name)}}
+			}
+		}
+	}
+
+	docs := s.workspace.documents()
+	var locs []location
+	if tok.Type == lexer.IDENTIFIER {
+		for _, d := range docs {
+			if d.class != nil && classNamed(d.class, tok.Value) {
+				locs = append(locs, location{d.uri, d.classRange()})
+			}
+		}
+		if len(locs) > 0 {
+			return locs
+		}
+	}
+	for _, d := range docs {
+		if d.class == nil {
+			continue
+		}
+		for _, m := range d.class.Methods {
+			if sendsTo(tok, m) {
+				_, sel := d.methodRanges(m)
+				locs = append(locs, location{d.uri, sel})
+			}
+		}
+	}
+	return locs
+}
+
+// hover describes the methods of doc's class the word at pos names,
+// including those merged from traits: their signature, and whether they
+// compile to Go or fall back to Bash
+func (s *server) hover(doc *document, pos position) *hover {
+	i := doc.tokenAt(pos)
+	if i < 0 || doc.class == nil {
+		return nil
+	}
+	c := s.compiledFor(doc)
+	class := doc.class
+	if c.err == nil && c.result.Class != nil {
+		class = c.result.Class
+	}
+	skipped := map[string]codegen.SkippedMethod{}
+	for _, skip := range c.result.SkippedMethods {
+		skipped[methodKey(skip.Selector, skip.Line)] = skip
+	}
+
+	// In a method's header, the hover is about that method alone
+	header := doc.headerAt(i)
+	var parts []string
+	for _, m := range class.Methods {
+		if header != nil && (m.Trait != "" || m.Location != header.Location) {
+			continue
+		}
+		if header == nil && !sendsTo(doc.tokens[i], m) {
+			continue
+		}
+		keyword := "method:"
+		if m.Kind == "class" {
+			keyword = "classMethod:"
+		}
+		text := fmt.Sprintf("```trashtalk\n%s %s\n```\n", keyword, signature(m))
+		switch skip, ok := skipped[methodKey(m.Selector, m.Location.Line)]; {
+		case c.err != nil:
+			text += "\nNot compiled: " + c.err.Error()
+		case ok:
+			text += "\nFalls back to Bash: " + skip.Reason
+		default:
+			text += "\nCompiled to Go."
+		}
+		if m.Trait != "" {
+			text += " From trait " + m.Trait + "."
+		}
+		parts = append(parts, text)
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	rng := doc.tokenRange(i)
+	return &hover{Contents: markupContent{Kind: "markdown", Value: strings.Join(parts, "\n---\n")}, Range: &rng}
+}
+
+// sendsTo reports whether tok, a selector or one of its keywords, could
+// name m
+func sendsTo(tok lexer.Token, m ast.Method) bool {
+	switch tok.Type {
+	case lexer.IDENTIFIER:
+		return len(m.Keywords) == 0 && m.Selector == tok.Value
+	case lexer.KEYWORD:
+		keyword := strings.TrimSuffix(tok.Value, ":")
+		for _, k := range m.Keywords {
+			if k == keyword {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signature returns m's selector with its argument names, "at: i put: v"
+func signature(m ast.Method) string {
+	if len(m.Keywords) == 0 {
+		return mangle.TrashSelector(m.Selector)
+	}
+	parts := make([]string, len(m.Keywords))
+	for i, k := range m.Keywords {
+		parts[i] = k + ":"
+		if i < len(m.Args) {
+			parts[i] += " " + m.Args[i]
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// tokenAt returns the index of the identifier or keyword token at pos, or -1
+func (doc *document) tokenAt(pos position) int {
+	for i, tok := range doc.tokens {
+		if tok.Type != lexer.IDENTIFIER && tok.Type != lexer.KEYWORD {
+			continue
+		}
+		if tok.Line-1 == pos.Line && pos.Character >= tok.Column && pos.Character <= tokenEnd(tok) {
+			return i
+		}
+	}
+	return -1
+}
+
+// tokenIndex returns the index of the token starting at loc, or -1
+func (doc *document) tokenIndex(loc ast.Location) int {
+	for i, tok := range doc.tokens {
+		if tok.Line == loc.Line && tok.Column == loc.Col {
+			return i
+		}
+	}
+	return -1
+}
+
+// headerAt returns the method of doc's class whose header holds token i,
+// between its method: keyword and its opening bracket, or nil
+func (doc *document) headerAt(i int) *ast.Method {
+	for k := range doc.class.Methods {
+		m := &doc.class.Methods[k]
+		start := doc.tokenIndex(m.Location)
+		if start < 0 || i < start {
+			continue
+		}
+		end := start + 1
+		for end < len(doc.tokens) && doc.tokens[end].Type != lexer.LBRACKET {
+			end++
+		}
+		if i < end {
+			return m
+		}
+	}
+	return nil
+}
+
+// methodRanges returns the range of m's definition, from its method:
+// keyword to its closing bracket, and of its selector and arguments
+func (doc *document) methodRanges(m ast.Method) (whole, selector lspRange) {
+	start := doc.tokenIndex(m.Location)
+	if start < 0 {
+		rng := doc.rangeAt(m.Location.Line-1, m.Location.Col)
+		return rng, rng
+	}
+	open := start + 1
+	for open < len(doc.tokens) && doc.tokens[open].Type != lexer.LBRACKET {
+		open++
+	}
+	selector = doc.tokenRange(start)
+	if open > start+1 {
+		selector = lspRange{doc.tokenRange(start + 1).Start, doc.tokenRange(open - 1).End}
+	}
+	whole = lspRange{doc.tokenRange(start).Start, selector.End}
+	depth := 0
+	for i := open; i < len(doc.tokens); i++ {
+		switch doc.tokens[i].Type {
+		case lexer.LBRACKET:
+			depth++
+		case lexer.RBRACKET:
+			depth--
+		}
+		if depth == 0 {
+			whole.End = doc.tokenRange(i).End
+			break
+		}
+	}
+	return whole, selector
+}
+
+// includes returns the range of each trait name in doc's include:
+// declarations
+func (doc *document) includes() map[string]lspRange {
+	ranges := map[string]lspRange{}
+	for i, tok := range doc.tokens {
+		if tok.Type != lexer.KEYWORD || tok.Value != "include:" {
+			continue
+		}
+		var name strings.Builder
+		first, last := i+1, i
+		for j := i + 1; j < len(doc.tokens) && doc.tokens[j].Type != lexer.NEWLINE && doc.tokens[j].Line == tok.Line; j++ {
+			name.WriteString(doc.tokens[j].Value)
+			last = j
+		}
+		if last >= first {
+			ranges[name.String()] = lspRange{doc.tokenRange(first).Start, doc.tokenRange(last).End}
+		}
+	}
+	return ranges
+}
+
+// classRange returns the range of the class name in doc's header
+func (doc *document) classRange() lspRange {
+	if doc.class == nil {
+		return lspRange{}
+	}
+	for i, tok := range doc.tokens {
+		if tok.Type == lexer.IDENTIFIER && tok.Value == doc.class.Name {
+			return doc.tokenRange(i)
+		}
+	}
+	return doc.nameRange(doc.class.Location, doc.class.Name)
+}
+
+// wholeRange returns the range of all of doc
+func (doc *document) wholeRange() lspRange {
+	lines := strings.Split(doc.text, "\n")
+	last := len(lines) - 1
+	return lspRange{End: position{last, utf8.RuneCountInString(lines[last])}}
+}
+
+// nameRange returns the range of name starting at loc
+func (doc *document) nameRange(loc ast.Location, name string) lspRange {
+	start := position{max(loc.Line-1, 0), loc.Col}
+	return lspRange{start, position{start.Line, start.Character + utf8.RuneCountInString(name)}}
+}
+
+// rangeAt returns the range of the token at the 0-based line and character,
+// or an empty range there if no token starts at it
+func (doc *document) rangeAt(line, char int) lspRange {
+	if i := doc.tokenIndex(ast.Location{Line: line + 1, Col: char}); i >= 0 {
+		return doc.tokenRange(i)
+	}
+	p := position{max(line, 0), char}
+	return lspRange{p, p}
+}
+
+// tokenRange returns the range of token i
+func (doc *document) tokenRange(i int) lspRange {
+	tok := doc.tokens[i]
+	return lspRange{position{tok.Line - 1, tok.Column}, position{tok.Line - 1, tokenEnd(tok)}}
+}
+
+// tokenEnd returns the column just past tok
+func tokenEnd(tok lexer.Token) int {
+	return tok.Column + utf8.RuneCountInString(tok.Value)
+}
@@ -0,0 +1,297 @@
+// Package main provides trashtalk-lsp, a Language Server Protocol server for
+// Trashtalk .trash files, built on Procyon's lexer, parser and compiler. It
+// speaks JSON-RPC on stdin and stdout and provides:
+//
+//   - diagnostics: parse errors, trait and codegen errors, and the methods
+//     that fall back to Bash with the reason, on open, change and save
+//   - document symbols: the class with its instance variables, included
+//     traits and methods
+//   - go-to-definition of selectors, classes, traits and instance variables
+//     across the .trash files of the workspace
+//   - hover showing a method's signature and whether it compiles to Go
+//
+// Usage:
+//
+//	trashtalk-lsp                          # serve on stdin/stdout
+//	trashtalk-lsp --trait-path traits:lib  # also look up traits in these directories
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/chazu/procyon/pkg/cli"
+)
+
+func main() {
+	var traitPath *string
+	root := &cli.Command{
+		Name:  "trashtalk-lsp",
+		Short: "Language server for Trashtalk .trash files",
+		Long: "Serves the Language Server Protocol on stdin and stdout. Included traits are\n" +
+			"taken from the workspace, then from --trait-path.",
+		Examples: []string{
+			"trashtalk-lsp",
+			"trashtalk-lsp --trait-path traits:lib",
+		},
+		Flags: func(fs *flag.FlagSet) {
+			traitPath = fs.String("trait-path", "", "directories to search for included traits not in the workspace, separated like $PATH")
+			fs.Bool("stdio", true, "serve on stdin and stdout (the only transport; accepted for editors that pass it)")
+		},
+		Run: func([]string) error {
+			s := newServer(newConn(os.Stdin, os.Stdout))
+			if *traitPath != "" {
+				s.traitPath = filepath.SplitList(*traitPath)
+			}
+			return s.serve()
+		},
+	}
+	root.Execute()
+}
+
+// server answers one client's requests, one at a time
+type server struct {
+	conn      *conn
+	workspace *workspace
+	traitPath []string
+	// compiled caches the compilation of each open document
+	compiled map[string]*compiled
+	shutdown bool
+}
+
+func newServer(c *conn) *server {
+	return &server{conn: c, workspace: newWorkspace(), compiled: map[string]*compiled{}}
+}
+
+// errExit stops serve after an exit notification that followed shutdown
+var errExit = errors.New("exit")
+
+// serve handles messages until the client sends exit or closes stdin. Exit
+// without a shutdown request first is an error, as the protocol requires.
+func (s *server) serve() error {
+	for {
+		body, err := s.conn.read()
+		if err == io.EOF {
+			if s.shutdown {
+				return nil
+			}
+			return cli.Errorf(cli.ExitUsage, "client closed the connection without shutdown")
+		}
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.conn.write(response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{codeParseError, err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.handle(msg); err != nil {
+			if err == errExit {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// handle dispatches msg, answering it if it is a request
+func (s *server) handle(msg message) error {
+	if msg.Method == "exit" {
+		if !s.shutdown {
+			return cli.Errorf(cli.ExitUsage, "exit before shutdown")
+		}
+		return errExit
+	}
+	result, err := s.call(msg)
+	var rerr *rpcError
+	if err != nil && !errors.As(err, &rerr) {
+		return err
+	}
+	if msg.ID == nil {
+		// A notification: there is nothing to answer, even on error
+		if rerr != nil && rerr.Code != codeMethodNotFound {
+			cli.Logf("trashtalk-lsp: %s: %v", msg.Method, rerr)
+		}
+		return nil
+	}
+	resp := response{JSONRPC: "2.0", ID: msg.ID, Error: rerr}
+	if rerr == nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		resp.Result = data
+	}
+	return s.conn.write(resp)
+}
+
+// call runs the method msg names and returns its result
+func (s *server) call(msg message) (any, error) {
+	if s.shutdown && msg.Method != "shutdown" {
+		return nil, &rpcError{codeInvalidRequest, "the server is shutting down"}
+	}
+	switch msg.Method {
+	case "initialize":
+		var params initializeParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.initialize(params), nil
+	case "initialized", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := params.TextDocument
+		return nil, s.update(doc.URI, doc.Text, &doc.Version)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, s.update(params.TextDocument.URI, params.ContentChanges[n-1].Text, &params.TextDocument.Version)
+		}
+		return nil, nil
+	case "textDocument/didSave":
+		// Saving may change what other documents compile to, through traits
+		s.workspace.refresh()
+		return nil, s.republish()
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		uri := params.TextDocument.URI
+		delete(s.workspace.open, uri)
+		delete(s.compiled, uri)
+		return nil, s.publish(uri, nil, []diagnostic{})
+
+	case "textDocument/documentSymbol":
+		var params documentSymbolParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := s.workspace.get(params.TextDocument.URI)
+		if doc == nil {
+			return []documentSymbol{}, nil
+		}
+		return doc.symbols(), nil
+	case "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := s.workspace.get(params.TextDocument.URI)
+		if doc == nil {
+			return []location{}, nil
+		}
+		s.workspace.refresh()
+		locs := s.definition(doc, params.Position)
+		if locs == nil {
+			locs = []location{}
+		}
+		return locs, nil
+	case "textDocument/hover":
+		var params textDocumentPositionParams
+		if err := decodeParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := s.workspace.get(params.TextDocument.URI)
+		if doc == nil {
+			return nil, nil
+		}
+		if h := s.hover(doc, params.Position); h != nil {
+			return h, nil
+		}
+		return nil, nil
+	}
+	return nil, &rpcError{codeMethodNotFound, "method not supported: " + msg.Method}
+}
+
+// initialize records the workspace roots, indexes their .trash files and
+// returns the server's capabilities
+func (s *server) initialize(params initializeParams) initializeResult {
+	for _, folder := range params.WorkspaceFolders {
+		if path := uriPath(folder.URI); path != "" {
+			s.workspace.roots = append(s.workspace.roots, path)
+		}
+	}
+	if len(s.workspace.roots) == 0 {
+		if path := uriPath(params.RootURI); path != "" {
+			s.workspace.roots = append(s.workspace.roots, path)
+		} else if params.RootPath != "" {
+			s.workspace.roots = append(s.workspace.roots, params.RootPath)
+		}
+	}
+	s.workspace.refresh()
+	return initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync:       textDocumentSyncOptions{OpenClose: true, Change: 1, Save: true},
+			DocumentSymbolProvider: true,
+			DefinitionProvider:     true,
+			HoverProvider:          true,
+		},
+		ServerInfo: serverInfo{Name: "trashtalk-lsp"},
+	}
+}
+
+// update replaces the text of the open document at uri, then compiles it
+// and publishes its diagnostics
+func (s *server) update(uri, text string, version *int) error {
+	doc := parseDocument(uri, text)
+	s.workspace.open[uri] = doc
+	c := s.compileDocument(doc)
+	s.compiled[uri] = c
+	return s.publish(uri, version, s.diagnostics(doc, c))
+}
+
+// republish recompiles every open document and publishes its diagnostics
+func (s *server) republish() error {
+	for uri, doc := range s.workspace.open {
+		c := s.compileDocument(doc)
+		s.compiled[uri] = c
+		if err := s.publish(uri, nil, s.diagnostics(doc, c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compiledFor returns the compilation of doc, compiling it if it is not an
+// open document
+func (s *server) compiledFor(doc *document) *compiled {
+	if c, ok := s.compiled[doc.uri]; ok && s.workspace.open[doc.uri] == doc {
+		return c
+	}
+	return s.compileDocument(doc)
+}
+
+// publish sends the diagnostics of the document at uri
+func (s *server) publish(uri string, version *int, diags []diagnostic) error {
+	return s.conn.write(notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  publishDiagnosticsParams{URI: uri, Version: version, Diagnostics: diags},
+	})
+}
+
+// decodeParams unmarshals the params of msg into v
+func decodeParams(msg message, v any) error {
+	if err := json.Unmarshal(msg.Params, v); err != nil {
+		return &rpcError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
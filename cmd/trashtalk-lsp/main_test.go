@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const counterSource = `Counter subclass: Object
+  instanceVars: value:0
+
+  method: increment [
+    value := value + 1.
+    ^ value
+  ]
+
+  method: power: n [
+    ^ value ** n
+  ]
+`
+
+// received is a message from the server: a response, or a notification
+// if Method is set
+type received struct {
+	response
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// testClient talks to a server over in-memory pipes. The server's messages
+// are read as they come, since it blocks writing them.
+type testClient struct {
+	t        *testing.T
+	conn     *conn
+	messages chan received
+	done     chan error
+	next     int
+}
+
+// startServer serves a new server on pipes and returns a client of it
+func startServer(t *testing.T) *testClient {
+	t.Helper()
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	s := newServer(newConn(serverIn, serverOut))
+	c := &testClient{t: t, conn: newConn(clientIn, clientOut), messages: make(chan received, 100), done: make(chan error, 1)}
+	go func() {
+		c.done <- s.serve()
+		serverOut.Close()
+	}()
+	go func() {
+		defer close(c.messages)
+		for {
+			body, err := c.conn.read()
+			if err != nil {
+				return
+			}
+			var msg received
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Errorf("decoding %s: %v", body, err)
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	t.Cleanup(func() { clientOut.Close() })
+	return c
+}
+
+// receive returns the next message from the server
+func (c *testClient) receive() received {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("the server closed the connection")
+		}
+		return msg
+	case <-time.After(30 * time.Second):
+		c.t.Fatal("the server did not answer")
+	}
+	return received{}
+}
+
+// request sends method with params and returns the response to it. No
+// notification may come first.
+func (c *testClient) request(method string, params any) response {
+	c.t.Helper()
+	c.next++
+	id := json.RawMessage(strconv.Itoa(c.next))
+	if err := c.conn.write(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}); err != nil {
+		c.t.Fatal(err)
+	}
+	msg := c.receive()
+	if msg.Method != "" || string(msg.ID) != string(id) {
+		c.t.Fatalf("%s: got %+v, want the response with id %s", method, msg, id)
+	}
+	return msg.response
+}
+
+// notify sends the notification method with params
+func (c *testClient) notify(method string, params any) {
+	c.t.Helper()
+	if err := c.conn.write(map[string]any{"jsonrpc": "2.0", "method": method, "params": params}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// diagnostics returns the diagnostics the server publishes next
+func (c *testClient) diagnostics() publishDiagnosticsParams {
+	c.t.Helper()
+	msg := c.receive()
+	if msg.Method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("got %+v, want diagnostics", msg)
+	}
+	var params publishDiagnosticsParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		c.t.Fatal(err)
+	}
+	return params
+}
+
+// decodeResult unmarshals the result of resp into v
+func decodeResult(t *testing.T, resp response, v any) {
+	t.Helper()
+	if resp.Error != nil {
+		t.Fatalf("error %d: %s", resp.Error.Code, resp.Error.Message)
+	}
+	if err := json.Unmarshal(resp.Result, v); err != nil {
+		t.Fatalf("decoding %s: %v", resp.Result, err)
+	}
+}
+
+// openCounter starts a server on a workspace holding Counter.trash, opens
+// it and returns the client, the document's URI and the diagnostics
+// published on opening
+func openCounter(t *testing.T) (*testClient, string, publishDiagnosticsParams) {
+	t.Helper()
+	root := t.TempDir()
+	path := filepath.Join(root, "Counter.trash")
+	if err := os.WriteFile(path, []byte(counterSource), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uri := pathURI(path)
+	c := startServer(t)
+	var init initializeResult
+	decodeResult(t, c.request("initialize", initializeParams{RootURI: pathURI(root)}), &init)
+	c.notify("initialized", struct{}{})
+	c.notify("textDocument/didOpen", didOpenParams{TextDocument: textDocumentItem{URI: uri, Version: 1, Text: counterSource}})
+	return c, uri, c.diagnostics()
+}
+
+// stop shuts the server down and checks it exits cleanly
+func (c *testClient) stop() {
+	c.t.Helper()
+	if resp := c.request("shutdown", nil); resp.Error != nil {
+		c.t.Fatalf("shutdown: %s", resp.Error.Message)
+	}
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Errorf("serve: %v", err)
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	c := startServer(t)
+	var init initializeResult
+	decodeResult(t, c.request("initialize", initializeParams{RootPath: t.TempDir()}), &init)
+	want := initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync:       textDocumentSyncOptions{OpenClose: true, Change: 1, Save: true},
+			DocumentSymbolProvider: true,
+			DefinitionProvider:     true,
+			HoverProvider:          true,
+		},
+		ServerInfo: serverInfo{Name: "trashtalk-lsp"},
+	}
+	if init != want {
+		t.Errorf("initialize answered %+v, want %+v", init, want)
+	}
+
+	if resp := c.request("workspace/symbol", struct{}{}); resp.Error == nil || resp.Error.Code != codeMethodNotFound {
+		t.Errorf("an unsupported request answered %+v, want method not found", resp)
+	}
+	c.stop()
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	c := startServer(t)
+	c.notify("exit", nil)
+	if err := <-c.done; err == nil {
+		t.Error("serve returned no error for exit before shutdown")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c, uri, diags := openCounter(t)
+	if diags.URI != uri || diags.Version == nil || *diags.Version != 1 {
+		t.Errorf("diagnostics for %s version %v, want %s version 1", diags.URI, diags.Version, uri)
+	}
+	// power: uses **, which the Go backend leaves to Bash
+	want := []diagnostic{{
+		Range:    lspRange{position{9, 13}, position{9, 14}},
+		Severity: severityWarning,
+		Source:   diagnosticSource,
+		Message:  "power: falls back to Bash: unexpected token: STAR (*)",
+	}}
+	if !slices.Equal(diags.Diagnostics, want) {
+		t.Errorf("diagnostics on open = %+v, want %+v", diags.Diagnostics, want)
+	}
+
+	// A parse error is reported where it is, as an error
+	broken := strings.Replace(counterSource, "value:0", "value:0 items:#()", 1)
+	c.notify("textDocument/didChange", map[string]any{
+		"textDocument":   map[string]any{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": broken}},
+	})
+	diags = c.diagnostics()
+	if diags.Version == nil || *diags.Version != 2 || len(diags.Diagnostics) == 0 {
+		t.Fatalf("diagnostics after the change = %+v, want version 2 with a parse error", diags)
+	}
+	if d := diags.Diagnostics[0]; d.Severity != severityError || d.Range.Start.Line != 1 || !strings.Contains(d.Message, "Unexpected token") {
+		t.Errorf("diagnostic after the change = %+v, want a parse error on line 1", d)
+	}
+
+	// Closing the document clears them
+	c.notify("textDocument/didClose", didCloseParams{TextDocument: textDocumentIdentifier{uri}})
+	if diags = c.diagnostics(); diags.URI != uri || diags.Diagnostics == nil || len(diags.Diagnostics) != 0 {
+		t.Errorf("diagnostics on close = %+v, want none", diags)
+	}
+	c.stop()
+}
+
+func TestHover(t *testing.T) {
+	c, uri, _ := openCounter(t)
+	tests := []struct {
+		name string
+		pos  position
+		want string // "" for no hover
+	}{
+		{"compiled method header", position{3, 12}, "```trashtalk\nmethod: increment\n```\n\nCompiled to Go."},
+		{"method falling back to Bash", position{8, 10}, "```trashtalk\nmethod: power: n\n```\n\nFalls back to Bash: unexpected token: STAR (*)"},
+		{"instance variable", position{4, 5}, ""},
+		{"whitespace", position{2, 0}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := c.request("textDocument/hover", textDocumentPositionParams{TextDocument: textDocumentIdentifier{uri}, Position: tt.pos})
+			if tt.want == "" {
+				if resp.Error != nil || string(resp.Result) != "null" {
+					t.Errorf("hover answered %s, want null", resp.Result)
+				}
+				return
+			}
+			var h hover
+			decodeResult(t, resp, &h)
+			if h.Contents.Kind != "markdown" || h.Contents.Value != tt.want {
+				t.Errorf("hover = %q, want %q", h.Contents.Value, tt.want)
+			}
+			if h.Range == nil || h.Range.Start.Line != tt.pos.Line {
+				t.Errorf("hover range = %+v, want one on line %d", h.Range, tt.pos.Line)
+			}
+		})
+	}
+	c.stop()
+}
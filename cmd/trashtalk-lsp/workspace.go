@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/lexer"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+// document is a parsed .trash file: an open editor buffer or a file on disk
+// in the workspace.
+type document struct {
+	uri     string
+	text    string
+	tokens  []lexer.Token
+	class   *ast.Class // nil if the class header did not parse
+	errors  []parser.ParseError
+	modTime time.Time // of the file on disk; zero for open buffers
+}
+
+// parseDocument tokenizes and parses text. A class whose body has errors is
+// kept, so symbols and definitions work while the file is being edited.
+func parseDocument(uri, text string) *document {
+	doc := &document{uri: uri, text: text}
+	tokens, err := lexer.New(text).Tokenize()
+	if err != nil {
+		return doc
+	}
+	doc.tokens = tokens
+	classAST, errs := parser.ParseClass(source.ParserTokens(tokens))
+	doc.errors = errs
+	if classAST != nil {
+		doc.class = source.ToAST(classAST)
+	}
+	return doc
+}
+
+// workspace holds the open documents and an index of the .trash files under
+// the workspace roots, used to resolve definitions and included traits.
+type workspace struct {
+	roots []string
+	open  map[string]*document // by the URI the editor uses
+	files map[string]*document // on disk, by canonical URI
+}
+
+func newWorkspace() *workspace {
+	return &workspace{open: map[string]*document{}, files: map[string]*document{}}
+}
+
+// refresh re-reads the files under the roots that are new or changed since
+// the last refresh and forgets those that are gone
+func (w *workspace) refresh() {
+	seen := map[string]bool{}
+	for _, root := range w.roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() && path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if d.IsDir() || !strings.HasSuffix(path, ".trash") {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			uri := pathURI(path)
+			seen[uri] = true
+			if doc, ok := w.files[uri]; ok && doc.modTime.Equal(info.ModTime()) {
+				return nil
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			doc := parseDocument(uri, string(content))
+			doc.modTime = info.ModTime()
+			w.files[uri] = doc
+			return nil
+		})
+	}
+	for uri := range w.files {
+		if !seen[uri] {
+			delete(w.files, uri)
+		}
+	}
+}
+
+// get returns the document at uri, preferring the open buffer
+func (w *workspace) get(uri string) *document {
+	if doc, ok := w.open[uri]; ok {
+		return doc
+	}
+	return w.files[canonicalURI(uri)]
+}
+
+// documents returns every document, open buffers replacing the files they
+// edit, sorted by URI
+func (w *workspace) documents() []*document {
+	var docs []*document
+	edited := map[string]bool{}
+	for uri, doc := range w.open {
+		edited[canonicalURI(uri)] = true
+		docs = append(docs, doc)
+	}
+	for uri, doc := range w.files {
+		if !edited[uri] {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].uri < docs[j].uri })
+	return docs
+}
+
+// traitSources returns the source of each trait class includes that a
+// workspace document defines
+func (w *workspace) traitSources(class *ast.Class) map[string][]byte {
+	traits := map[string][]byte{}
+	for _, name := range class.Traits {
+		for _, doc := range w.documents() {
+			if doc.class != nil && doc.class.IsTrait && doc.errors == nil && classNamed(doc.class, name) {
+				traits[name] = []byte(doc.text)
+				break
+			}
+		}
+	}
+	return traits
+}
+
+// classNamed reports whether name, qualified or not, names class
+func classNamed(class *ast.Class, name string) bool {
+	return class.QualifiedName() == name || class.Name == name
+}
+
+// pathURI returns the file URI of path
+func pathURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// uriPath returns the path of a file URI, or "" for other URIs
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// canonicalURI returns uri in the form pathURI gives, so an open document
+// can be matched with the file it edits
+func canonicalURI(uri string) string {
+	if path := uriPath(uri); path != "" {
+		return pathURI(path)
+	}
+	return uri
+}
@@ -34,6 +34,20 @@ build_class() {
     "$OUTPUT_DIR/${class_name}.native" --info
 }
 
+# Tell a running daemon to reload the rebuilt classes and their dependents.
+# Set TRASHTALK_AST to a JSON array of class ASTs to include dependents.
+notify_daemon() {
+    local socket="${TRASHTALK_DAEMON_SOCKET:-/tmp/trashtalk.sock}"
+    if [[ ! -S "$socket" ]] || ! command -v trashtalk-daemon >/dev/null; then
+        return 0
+    fi
+    local ast_args=()
+    if [[ -n "${TRASHTALK_AST:-}" ]]; then
+        ast_args=(--ast "$TRASHTALK_AST")
+    fi
+    trashtalk-daemon preload --socket "$socket" ${ast_args[@]+"${ast_args[@]}"} "$@" || true
+}
+
 # Find all native class directories
 find_native_classes() {
     for dir in "$SCRIPT_DIR"/*/; do
@@ -43,14 +57,20 @@ find_native_classes() {
     done
 }
 
+built=()
 if [[ $# -eq 0 ]]; then
     # Build all native classes
     for class_dir in $(find_native_classes); do
         # Convert to PascalCase (simple heuristic)
         class_name="$(echo "$class_dir" | sed 's/\b\(.\)/\u\1/g')"
-        build_class "$class_name" || true
+        build_class "$class_name" && built+=("$class_name") || true
     done
 else
     # Build specific class
     build_class "$1"
+    built+=("$1")
+fi
+
+if [[ ${#built[@]} -gt 0 ]]; then
+    notify_daemon "${built[@]}"
 fi
@@ -4,21 +4,21 @@ go 1.24.5
 
 require (
 	github.com/dave/jennifer v1.7.1
+	github.com/google/uuid v1.6.0
 	github.com/jamesits/goinvoke v1.3.3
+	github.com/mattn/go-sqlite3 v1.14.33
+	golang.org/x/sys v0.40.0
 )
 
 require (
 	github.com/bufbuild/protocompile v0.14.1 // indirect
 	github.com/ebitengine/purego v0.5.1 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/jhump/protoreflect v1.17.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.33 // indirect
 	golang.org/x/net v0.47.0 // indirect
 	golang.org/x/sync v0.18.0 // indirect
-	golang.org/x/sys v0.40.0 // indirect
 	golang.org/x/text v0.31.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20251029180050-ab9386a59fda // indirect
 	google.golang.org/grpc v1.78.0 // indirect
@@ -0,0 +1,425 @@
+// Package analysis checks the classes of a project for code that is likely
+// dead or wrong, from their ASTs and without compiling them:
+//
+//   - dead-selector: a method no class of the project sends
+//   - unused-ivar: an instance variable no method of the class, or of a
+//     subclass, reads
+//   - unmet-requirement: an included trait requires a method the class does
+//     not define
+//   - arity-shadow: a method named like one of its superclass's but taking
+//     a different number of arguments, which does not override it
+//
+// The project is the classes and traits given to Analyze; sends from Bash
+// scripts or classes outside it are not seen, so the entry points of a
+// project will be reported as dead unless it sends them itself.
+package analysis
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/lexer"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// Check names a kind of finding
+type Check string
+
+const (
+	DeadSelector     Check = "dead-selector"
+	UnusedIvar       Check = "unused-ivar"
+	UnmetRequirement Check = "unmet-requirement"
+	ArityShadow      Check = "arity-shadow"
+)
+
+// Checks lists every check, in the order findings of a class are reported
+var Checks = []Check{UnmetRequirement, ArityShadow, UnusedIvar, DeadSelector}
+
+// Finding is one problem Analyze found.
+type Finding struct {
+	Check Check  `json:"check"`
+	Class string `json:"class"` // qualified name
+	File  string `json:"file"`  // the class's .trash file
+	// Selector is the method the finding is about, as written in Trashtalk
+	Selector string       `json:"selector,omitempty"`
+	Message  string       `json:"message"`
+	Location ast.Location `json:"location"` // line 0 if unknown
+}
+
+// runtimeSelectors are the instance methods the runtime sends itself,
+// besides the keyword initializers new runs (initialize:, initialize:with:)
+var runtimeSelectors = map[string]bool{
+	"new":           true,
+	"initialize":    true,
+	"aboutToDelete": true,
+	"onDelete":      true,
+}
+
+// Analyze merges the traits of each unit into its class and returns the
+// findings for every class, in the order of units.
+func Analyze(units []*ast.CompilationUnit) []Finding {
+	reports := make([]ast.TraitReport, len(units))
+	classes := make([]*ast.Class, len(units))
+	byName := map[string]*ast.Class{}
+	for i, unit := range units {
+		reports[i] = unit.MergeTraits()
+		classes[i] = unit.Class
+		byName[unit.Class.Name] = unit.Class
+		byName[unit.Class.QualifiedName()] = unit.Class
+	}
+
+	// Selectors sent anywhere in the project, and the names read by each
+	// class's methods
+	sent := map[string]bool{}
+	reads := map[*ast.Class]map[string]bool{}
+	for _, class := range classes {
+		reads[class] = map[string]bool{}
+		for _, tokens := range bodies(class) {
+			for _, sel := range sends(tokens) {
+				sent[sel] = true
+			}
+			for _, name := range identifierReads(tokens) {
+				reads[class][name] = true
+			}
+		}
+	}
+	// alias: From for: To makes sends of From run To
+	for _, class := range classes {
+		for _, alias := range class.Aliases {
+			if sent[mangle.Selector(alias.From)] {
+				sent[mangle.Selector(alias.To)] = true
+			}
+		}
+	}
+
+	var findings []Finding
+	for i, class := range classes {
+		var found []Finding
+		found = append(found, unmetRequirements(class, reports[i])...)
+		found = append(found, arityShadows(class, byName)...)
+		found = append(found, unusedIvars(class, classes, byName, reads, sent)...)
+		found = append(found, deadSelectors(class, sent)...)
+		findings = append(findings, found...)
+	}
+	return findings
+}
+
+// newFinding returns a finding of check about class at loc
+func newFinding(check Check, class *ast.Class, loc ast.Location, selector, message string) Finding {
+	return Finding{
+		Check:    check,
+		Class:    class.QualifiedName(),
+		File:     class.CompiledName() + ".trash",
+		Selector: selector,
+		Message:  message,
+		Location: loc,
+	}
+}
+
+// unmetRequirements reports the method requirements of the traits class
+// includes that it does not meet
+func unmetRequirements(class *ast.Class, report ast.TraitReport) []Finding {
+	var found []Finding
+	for _, unmet := range report.Unmet {
+		// "Trait requires selector"
+		trait, selector, _ := strings.Cut(unmet, " requires ")
+		found = append(found, newFinding(UnmetRequirement, class, class.Location, "",
+			fmt.Sprintf("includes %s, which requires %s, but no method defines it", trait, selector)))
+	}
+	return found
+}
+
+// arityShadows reports the methods class defines under the name of a
+// method of a superclass with a different number of arguments: greet:
+// beside an inherited greet. Sends of the inherited selector still run the
+// superclass's method. Methods the class also defines with the inherited
+// arity are a family (at:, at:put:) and not reported.
+func arityShadows(class *ast.Class, byName map[string]*ast.Class) []Finding {
+	own := map[string]bool{}
+	for _, m := range class.Methods {
+		own[kindOf(m)+" "+m.Selector] = true
+	}
+	var found []Finding
+	for _, m := range class.Methods {
+		if m.Trait != "" {
+			continue
+		}
+		for _, parent := range ancestors(class, byName) {
+			inherited, ok := shadowedBy(parent, m)
+			if !ok {
+				continue
+			}
+			if !own[kindOf(m)+" "+inherited.Selector] {
+				found = append(found, newFinding(ArityShadow, class, m.Location, mangle.TrashSelector(m.Selector),
+					fmt.Sprintf("takes %s but %s>>%s takes %s, so it does not override it",
+						arguments(len(m.Args)), parent.QualifiedName(), mangle.TrashSelector(inherited.Selector), arguments(len(inherited.Args)))))
+			}
+			break
+		}
+	}
+	return found
+}
+
+// shadowedBy returns the method of parent named like m with another
+// arity, if parent does not define m's selector itself
+func shadowedBy(parent *ast.Class, m ast.Method) (ast.Method, bool) {
+	var match ast.Method
+	found := false
+	for _, pm := range parent.Methods {
+		if kindOf(pm) != kindOf(m) {
+			continue
+		}
+		if pm.Selector == m.Selector {
+			return ast.Method{}, false
+		}
+		if !found && baseName(pm) == baseName(m) && len(pm.Args) != len(m.Args) {
+			match, found = pm, true
+		}
+	}
+	return match, found
+}
+
+// kindOf returns the kind of m, "instance" if the AST leaves it empty
+func kindOf(m ast.Method) string {
+	if m.Kind == "" {
+		return "instance"
+	}
+	return m.Kind
+}
+
+// baseName returns the first keyword of a method's selector, or its unary
+// selector: greet for greet and greet:with:
+func baseName(m ast.Method) string {
+	if len(m.Keywords) > 0 {
+		return strings.TrimSuffix(m.Keywords[0], ":")
+	}
+	if strings.HasSuffix(m.Selector, "_") {
+		name, _, _ := strings.Cut(m.Selector, "_")
+		return name
+	}
+	return m.Selector
+}
+
+// arguments returns "no arguments", "1 argument" or "n arguments"
+func arguments(n int) string {
+	switch n {
+	case 0:
+		return "no arguments"
+	case 1:
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+// ancestors returns the superclasses of class in the project, nearest first
+func ancestors(class *ast.Class, byName map[string]*ast.Class) []*ast.Class {
+	var chain []*ast.Class
+	seen := map[*ast.Class]bool{class: true}
+	for parent := byName[class.Parent]; parent != nil && !seen[parent]; parent = byName[parent.Parent] {
+		seen[parent] = true
+		chain = append(chain, parent)
+	}
+	return chain
+}
+
+// unusedIvars reports the instance variables of class that neither its
+// methods nor those of its subclasses read, and whose getter no class
+// sends. Indexed variables are read by queries and not reported.
+func unusedIvars(class *ast.Class, classes []*ast.Class, byName map[string]*ast.Class, reads map[*ast.Class]map[string]bool, sent map[string]bool) []Finding {
+	users := []*ast.Class{class}
+	for _, other := range classes {
+		for _, parent := range ancestors(other, byName) {
+			if parent == class {
+				users = append(users, other)
+				break
+			}
+		}
+	}
+	indexed := map[string]bool{}
+	for _, field := range class.Indexes {
+		name, _, _ := strings.Cut(field, ".")
+		indexed[name] = true
+	}
+
+	var found []Finding
+	check := func(iv ast.InstanceVar, what string) {
+		if indexed[iv.Name] || sent[iv.Name] {
+			return
+		}
+		for _, user := range users {
+			if reads[user][iv.Name] {
+				return
+			}
+		}
+		found = append(found, newFinding(UnusedIvar, class, iv.Location, "",
+			fmt.Sprintf("%s %s is never read", what, iv.Name)))
+	}
+	for _, iv := range class.InstanceVars {
+		check(iv, "instance variable")
+	}
+	for _, iv := range class.ClassInstanceVars {
+		check(iv, "class instance variable")
+	}
+	return found
+}
+
+// deadSelectors reports the methods class defines that no class sends.
+// Methods merged from a trait are reported on the trait.
+func deadSelectors(class *ast.Class, sent map[string]bool) []Finding {
+	var found []Finding
+	for _, m := range class.Methods {
+		if m.Trait != "" || sent[m.Selector] || (m.Kind != "class" && (runtimeSelectors[m.Selector] || strings.HasPrefix(m.Selector, "initialize_"))) {
+			continue
+		}
+		message := "never sent in the project"
+		if m.Kind == "class" {
+			message = "class method " + message
+		}
+		found = append(found, newFinding(DeadSelector, class, m.Location, mangle.TrashSelector(m.Selector), message))
+	}
+	return found
+}
+
+// bodies returns the token streams of the class's methods, advice and
+// migrations
+func bodies(class *ast.Class) [][]ast.Token {
+	var out [][]ast.Token
+	for _, m := range class.Methods {
+		out = append(out, m.Body.Tokens)
+	}
+	for _, a := range class.Advice {
+		out = append(out, a.Body.Tokens)
+	}
+	for _, mig := range class.Migrations {
+		out = append(out, mig.Block.Tokens)
+	}
+	return out
+}
+
+// sends returns the mangled selector of each message send in tokens:
+// @ receiver unary, or @ receiver key: arg key: arg, including those in
+// $(...) subshells. Keywords belong to the send up to the end of the
+// statement, a closing bracket or parenthesis, or another @.
+func sends(tokens []ast.Token) []string {
+	tokens = expandSubshells(tokens)
+	var selectors []string
+	for i, tok := range tokens {
+		if tok.Type != ast.TokenAt {
+			continue
+		}
+		j := i + 1
+		if j < len(tokens) && isReceiver(tokens[j]) {
+			j++
+		}
+		for j+1 < len(tokens) && tokens[j].Type == ast.TokenNamespaceSep {
+			j += 2
+		}
+		if j >= len(tokens) {
+			continue
+		}
+		switch tokens[j].Type {
+		case ast.TokenIdentifier:
+			selectors = append(selectors, tokens[j].Value)
+		case ast.TokenKeyword:
+			selectors = append(selectors, keywordSelector(tokens[j:]))
+		}
+	}
+	return selectors
+}
+
+// isReceiver reports whether tok can be the receiver of a send
+func isReceiver(tok ast.Token) bool {
+	switch tok.Type {
+	case ast.TokenIdentifier, ast.TokenVariable, ast.TokenDString, ast.TokenSString, string(lexer.STRING), ast.TokenSubshell:
+		return true
+	}
+	return false
+}
+
+// keywordSelector returns the mangled selector of the keyword message
+// starting at tokens[0]
+func keywordSelector(tokens []ast.Token) string {
+	var b strings.Builder
+	depth := 0
+	for i, tok := range tokens {
+		switch tok.Type {
+		case ast.TokenLParen, ast.TokenLBracket, string(lexer.HASHlparen), string(lexer.HASHLBRACE), string(lexer.LBRACE):
+			depth++
+		case ast.TokenRParen, ast.TokenRBracket, string(lexer.RBRACE):
+			if depth == 0 {
+				return b.String()
+			}
+			depth--
+		case ast.TokenKeyword:
+			if depth == 0 {
+				b.WriteString(mangle.Selector(tok.Value))
+			}
+		case ast.TokenAt, ast.TokenDot, ast.TokenAssign, ast.TokenCaret:
+			if depth == 0 {
+				return b.String()
+			}
+		case ast.TokenNewline:
+			// A backslash continues the statement on the next line
+			if depth == 0 && (i == 0 || tokens[i-1].Type != ast.TokenBackslash) {
+				return b.String()
+			}
+		}
+	}
+	return b.String()
+}
+
+// identifierReads returns the identifiers in tokens that are read: those
+// not assigned to, nor declared as locals or block parameters
+func identifierReads(tokens []ast.Token) []string {
+	tokens = expandSubshells(tokens)
+	var names []string
+	inLocals := false
+	for i, tok := range tokens {
+		if tok.Type == ast.TokenPipe {
+			// | a b | declares locals at the start of a body or block
+			if !inLocals && (i == 0 || tokens[i-1].Type == ast.TokenLBracket || tokens[i-1].Type == ast.TokenNewline) {
+				inLocals = true
+			} else {
+				inLocals = false
+			}
+			continue
+		}
+		if tok.Type != ast.TokenIdentifier || inLocals {
+			continue
+		}
+		if i+1 < len(tokens) && tokens[i+1].Type == ast.TokenAssign {
+			continue
+		}
+		names = append(names, tok.Value)
+	}
+	return names
+}
+
+// expandSubshells returns tokens with each $(...) subshell replaced by the
+// tokens of the command inside it, so sends and reads in raw Bash are seen
+func expandSubshells(tokens []ast.Token) []ast.Token {
+	var out []ast.Token
+	for _, tok := range tokens {
+		if tok.Type != ast.TokenSubshell || !strings.HasPrefix(tok.Value, "$(") {
+			out = append(out, tok)
+			continue
+		}
+		inner, err := lexer.New(strings.TrimSuffix(strings.TrimPrefix(tok.Value, "$("), ")")).Tokenize()
+		if err != nil {
+			continue
+		}
+		var expanded []ast.Token
+		for _, t := range inner {
+			if t.Type == lexer.EOF || t.Type == lexer.COMMENT {
+				continue
+			}
+			expanded = append(expanded, ast.Token{Type: string(t.Type), Value: t.Value, Line: tok.Line, Col: tok.Col})
+		}
+		// Subshells nest: $(@ a b: $(@ c d))
+		out = append(out, ast.Token{Type: ast.TokenLParen, Value: "(", Line: tok.Line, Col: tok.Col})
+		out = append(out, expandSubshells(expanded)...)
+		out = append(out, ast.Token{Type: ast.TokenRParen, Value: ")", Line: tok.Line, Col: tok.Col})
+	}
+	return out
+}
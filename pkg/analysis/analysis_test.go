@@ -0,0 +1,137 @@
+package analysis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+const (
+	shapeSrc = `Shape subclass: Object
+  instanceVars: name:'' secret:0 label:''
+
+  method: describe [
+    ^ name
+  ]
+
+  method: greet [
+    ^ 'hi'
+  ]
+
+  method: at: i [
+    ^ i
+  ]
+
+  method: at: i put: v [
+    ^ v
+  ]
+`
+	squareSrc = `Square subclass: Shape
+  include: Greeter
+  instanceVars: size:0 unused:0
+
+  method: initialize [
+    size := 1
+  ]
+
+  method: greet: who [
+    ^ 'hi ' , who
+  ]
+
+  method: at: i [
+    | unused |
+    unused := i.
+    ^ size
+  ]
+
+  method: run [
+    @ self at: 1 put: (@ self at: 2).
+    ^ $(@ self describe)
+  ]
+
+  rawMethod: report [
+    local v=$(@ "$obj" label)
+    echo "$v"
+  ]
+
+  method: initialize: n [
+    size := n
+  ]
+
+  method: onDelete [
+    size := 0
+  ]
+`
+	greeterSrc = `Greeter trait
+  requires: salutationFor:
+
+  method: hello [
+    ^ @ self salutationFor: 'you'
+  ]
+`
+)
+
+func TestAnalyze(t *testing.T) {
+	var units []*ast.CompilationUnit
+	traits := map[string]*ast.Class{}
+	for _, src := range []string{shapeSrc, squareSrc, greeterSrc} {
+		class, err := source.Parse(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class.IsTrait {
+			traits[class.Name] = class
+		}
+		units = append(units, &ast.CompilationUnit{Class: class, Traits: traits})
+	}
+
+	type finding struct {
+		Check    Check
+		Class    string
+		Selector string
+		Message  string
+		Line     int
+	}
+	var got []finding
+	for _, f := range Analyze(units) {
+		got = append(got, finding{f.Check, f.Class, f.Selector, f.Message, f.Location.Line})
+	}
+	want := []finding{
+		{UnusedIvar, "Shape", "", "instance variable secret is never read", 2},
+		{DeadSelector, "Shape", "greet", "never sent in the project", 8},
+		{UnmetRequirement, "Square", "", "includes Greeter, which requires salutationFor:, but no method defines it", 1},
+		{ArityShadow, "Square", "greet:", "takes 1 argument but Shape>>greet takes no arguments, so it does not override it", 9},
+		{UnusedIvar, "Square", "", "instance variable unused is never read", 3},
+		{DeadSelector, "Square", "greet:", "never sent in the project", 9},
+		{DeadSelector, "Square", "run", "never sent in the project", 19},
+		{DeadSelector, "Square", "report", "never sent in the project", 24},
+		{DeadSelector, "Greeter", "hello", "never sent in the project", 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Analyze() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestSends(t *testing.T) {
+	class, err := source.Parse(squareSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run, report []ast.Token
+	for _, m := range class.Methods {
+		switch m.Selector {
+		case "run":
+			run = m.Body.Tokens
+		case "report":
+			report = m.Body.Tokens
+		}
+	}
+	if got, want := sends(run), []string{"at_put_", "at_", "describe"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sends(run) = %v, want %v", got, want)
+	}
+	if got, want := sends(report), []string{"label"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sends(report) = %v, want %v", got, want)
+	}
+}
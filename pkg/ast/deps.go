@@ -0,0 +1,70 @@
+package ast
+
+// Dependents returns the compiled names of the changed classes and of every
+// class that depends on them, directly or transitively, in the order the
+// classes appear. A class depends on its parent, on the traits it includes,
+// and on every class in a package it imports. Changed classes may be named
+// by bare, qualified (MyApp::Counter) or compiled (MyApp__Counter) name;
+// names that match no class are returned as given.
+func Dependents(classes []*Class, changed []string) []string {
+	// byName resolves every accepted name to the classes it may refer to
+	byName := make(map[string][]*Class)
+	for _, c := range classes {
+		byName[c.CompiledName()] = append(byName[c.CompiledName()], c)
+		if c.IsNamespaced() {
+			byName[c.QualifiedName()] = append(byName[c.QualifiedName()], c)
+		}
+		byName[c.Name] = append(byName[c.Name], c)
+	}
+
+	// users maps a class to the classes that depend on it
+	users := make(map[*Class][]*Class)
+	for _, c := range classes {
+		deps := append([]string{c.Parent}, c.Traits...)
+		for _, name := range deps {
+			for _, dep := range byName[name] {
+				if dep != c {
+					users[dep] = append(users[dep], c)
+				}
+			}
+		}
+		for _, pkg := range c.Imports {
+			for _, dep := range classes {
+				if dep != c && dep.Package == pkg {
+					users[dep] = append(users[dep], c)
+				}
+			}
+		}
+	}
+
+	affected := make(map[*Class]bool)
+	var visit func(c *Class)
+	visit = func(c *Class) {
+		if affected[c] {
+			return
+		}
+		affected[c] = true
+		for _, u := range users[c] {
+			visit(u)
+		}
+	}
+
+	var unknown []string
+	for _, name := range changed {
+		matches := byName[name]
+		if len(matches) == 0 {
+			unknown = append(unknown, name)
+		}
+		for _, c := range matches {
+			visit(c)
+		}
+	}
+
+	var out []string
+	for _, c := range classes {
+		if affected[c] {
+			out = append(out, c.CompiledName())
+		}
+	}
+	return append(out, unknown...)
+}
@@ -0,0 +1,35 @@
+package ast
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDependents(t *testing.T) {
+	classes := []*Class{
+		{Name: "Base", Parent: "Object"},
+		{Name: "Counter", Parent: "Base"},
+		{Name: "Loud", IsTrait: true},
+		{Name: "Shouter", Parent: "Object", Traits: []string{"Loud"}},
+		{Name: "Store", Package: "MyApp", Parent: "Object"},
+		{Name: "App", Parent: "Object", Imports: []string{"MyApp"}},
+		{Name: "Sub", Parent: "Counter"},
+	}
+
+	tests := []struct {
+		changed []string
+		want    string
+	}{
+		{[]string{"Base"}, "Base Counter Sub"},
+		{[]string{"Loud"}, "Loud Shouter"},
+		{[]string{"MyApp::Store"}, "MyApp__Store App"},
+		{[]string{"MyApp__Store"}, "MyApp__Store App"},
+		{[]string{"Sub", "Shouter"}, "Shouter Sub"},
+		{[]string{"Missing"}, "Missing"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(Dependents(classes, tt.changed), " "); got != tt.want {
+			t.Errorf("Dependents(%v) = %q, want %q", tt.changed, got, tt.want)
+		}
+	}
+}
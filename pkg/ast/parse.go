@@ -1,9 +1,14 @@
 package ast
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/mangle"
 )
 
 // Parse reads AST JSON from a reader and returns a Class.
@@ -57,31 +62,222 @@ func ParseCompilationUnit(data []byte) (*CompilationUnit, error) {
 	}, nil
 }
 
-// MergeTraits merges included trait methods into the class.
-// Returns lists of merged trait names and missing trait names.
-func (cu *CompilationUnit) MergeTraits() (merged []string, missing []string) {
+// ParseCompilationUnits parses a JSON array whose elements are each either a
+// CompilationUnit or a plain Class. This is the input format for bundle mode.
+func ParseCompilationUnits(data []byte) ([]*CompilationUnit, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse input: expected a JSON array: %w", err)
+	}
+
+	units := make([]*CompilationUnit, 0, len(items))
+	for i, item := range items {
+		unit, err := ParseCompilationUnit(item)
+		if err != nil {
+			// Locate type errors in data rather than in the element
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				typeErr.Offset += elementOffset(data, i)
+			}
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		units = append(units, unit)
+	}
+	return units, nil
+}
+
+// TraitReport describes the outcome of MergeTraits.
+type TraitReport struct {
+	Merged     []string // Traits whose methods were merged
+	Missing    []string // Included traits that were not provided
+	Overridden []string // "Trait>>selector" methods the class defines itself
+	Excluded   []string // "Trait>>selector" methods dropped by exclude:
+	Resolved   []string // "selector (use Trait1 over Trait2)" conflicts settled by resolve:
+	Conflicts  []string // "selector (Trait1, Trait2)" methods defined by several traits and not resolved
+	Invalid    []string // resolve: and exclude: declarations that name no included trait method
+	Unmet      []string // "Trait requires selector" requirements the class does not meet
+}
+
+// MergeTraits merges included trait methods into the class, recording the
+// trait each merged method came from in its Trait field. Methods the class
+// defines itself take precedence over trait methods. exclude: drops a
+// trait's method, and when several traits define a selector the one named
+// by resolve: wins; without one the first included trait wins and the
+// selector is reported as a conflict. Method requirements of the merged
+// traits are then checked against the resulting methods.
+func (cu *CompilationUnit) MergeTraits() TraitReport {
+	var report TraitReport
 	if len(cu.Class.Traits) == 0 {
-		return nil, nil
+		return report
 	}
 
-	for _, traitName := range cu.Class.Traits {
-		if cu.Traits == nil {
-			missing = append(missing, traitName)
-			continue
+	type methodKey struct{ kind, selector string }
+	keyOf := func(m Method) methodKey {
+		kind := m.Kind
+		if kind == "" {
+			kind = "instance"
 		}
+		return methodKey{kind, m.Selector}
+	}
+	defined := map[methodKey]bool{}
+	for _, m := range cu.Class.Methods {
+		defined[keyOf(m)] = true
+	}
 
+	var traits []*Class
+	var traitNames []string
+	for _, traitName := range cu.Class.Traits {
 		trait, ok := cu.Traits[traitName]
 		if !ok {
 			// Trait not provided, will fall back to Bash
-			missing = append(missing, traitName)
+			report.Missing = append(report.Missing, traitName)
 			continue
 		}
+		traits = append(traits, trait)
+		traitNames = append(traitNames, traitName)
+	}
+
+	uses, excluded := cu.checkResolutions(&report)
+
+	// Traits defining each selector, in include order
+	candidates := map[methodKey][]string{}
+	var order []methodKey
+	for i, trait := range traits {
+		for _, m := range trait.Methods {
+			key := keyOf(m)
+			if excluded[traitNames[i]+">>"+m.Selector] {
+				report.Excluded = append(report.Excluded, traitNames[i]+">>"+m.Selector)
+				continue
+			}
+			if defined[key] {
+				report.Overridden = append(report.Overridden, traitNames[i]+">>"+m.Selector)
+				continue
+			}
+			if len(candidates[key]) == 0 {
+				order = append(order, key)
+			}
+			candidates[key] = append(candidates[key], traitNames[i])
+		}
+	}
+
+	winner := map[methodKey]string{}
+	for _, key := range order {
+		names := candidates[key]
+		winner[key] = names[0]
+		if len(names) == 1 {
+			continue
+		}
+		if use, ok := uses[key.selector]; ok && containsString(names, use) {
+			winner[key] = use
+			var others []string
+			for _, name := range names {
+				if name != use {
+					others = append(others, name)
+				}
+			}
+			report.Resolved = append(report.Resolved, fmt.Sprintf("%s (use %s over %s)", key.selector, use, strings.Join(others, ", ")))
+			continue
+		}
+		report.Conflicts = append(report.Conflicts, fmt.Sprintf("%s (%s)", key.selector, strings.Join(names, ", ")))
+	}
 
-		// Add trait methods to the class
+	for i, trait := range traits {
 		for _, m := range trait.Methods {
+			key := keyOf(m)
+			if winner[key] != traitNames[i] || defined[key] {
+				continue
+			}
+			m.Trait = traitNames[i]
+			defined[key] = true
 			cu.Class.Methods = append(cu.Class.Methods, m)
 		}
-		merged = append(merged, traitName)
+		report.Merged = append(report.Merged, traitNames[i])
+	}
+
+	// requires: at:put: names the selector at_put_
+	for i, trait := range traits {
+		for _, req := range trait.MethodRequirements {
+			selector := mangle.Selector(req)
+			if !defined[methodKey{"instance", selector}] {
+				report.Unmet = append(report.Unmet, fmt.Sprintf("%s requires %s", traitNames[i], req))
+			}
+		}
+	}
+	return report
+}
+
+// checkResolutions validates the class's resolve: and exclude:
+// declarations against its included traits, adding those that name no
+// included trait method to report.Invalid. It returns the trait to use for
+// each resolved selector and the excluded "Trait>>selector" methods.
+// Declarations naming a trait that was not provided are kept unchecked.
+func (cu *CompilationUnit) checkResolutions(report *TraitReport) (map[string]string, map[string]bool) {
+	uses := map[string]string{}
+	excluded := map[string]bool{}
+	for _, r := range cu.Class.Resolutions {
+		decl := fmt.Sprintf("resolve: %s use: %s", r.Selector, r.Trait)
+		if r.Kind == "exclude" {
+			decl = fmt.Sprintf("exclude: %s from: %s", r.Selector, r.Trait)
+		}
+		if !containsString(cu.Class.Traits, r.Trait) {
+			report.Invalid = append(report.Invalid, fmt.Sprintf("%s: %s is not included", decl, r.Trait))
+			continue
+		}
+		if trait, ok := cu.Traits[r.Trait]; ok && !trait.definesSelector(r.Selector) {
+			report.Invalid = append(report.Invalid, fmt.Sprintf("%s: %s does not define %s", decl, r.Trait, r.Selector))
+			continue
+		}
+		if r.Kind == "exclude" {
+			excluded[r.Trait+">>"+r.Selector] = true
+			continue
+		}
+		if use, ok := uses[r.Selector]; ok && use != r.Trait {
+			report.Invalid = append(report.Invalid, fmt.Sprintf("%s: %s is already resolved to %s", decl, r.Selector, use))
+			continue
+		}
+		uses[r.Selector] = r.Trait
+	}
+	for _, r := range cu.Class.Resolutions {
+		if r.Kind == "resolve" && excluded[r.Trait+">>"+r.Selector] {
+			report.Invalid = append(report.Invalid, fmt.Sprintf("resolve: %s use: %s: %s>>%s is excluded", r.Selector, r.Trait, r.Trait, r.Selector))
+			delete(uses, r.Selector)
+		}
+	}
+	return uses, excluded
+}
+
+// definesSelector reports whether the class defines a method, of either
+// kind, with the given selector.
+func (c *Class) definesSelector(selector string) bool {
+	for _, m := range c.Methods {
+		if m.Selector == selector {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// elementOffset returns the offset in data, a valid JSON array, of its
+// element i
+func elementOffset(data []byte, i int) int64 {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.Token() // [
+	for ; i > 0; i-- {
+		var skip json.RawMessage
+		dec.Decode(&skip)
+	}
+	offset := dec.InputOffset()
+	for offset < int64(len(data)) && bytes.IndexByte([]byte(" \t\r\n,"), data[offset]) >= 0 {
+		offset++
 	}
-	return merged, missing
+	return offset
 }
@@ -0,0 +1,141 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMergeTraits(t *testing.T) {
+	unit := &CompilationUnit{
+		Class: &Class{
+			Name:    "Person",
+			Traits:  []string{"Greeter", "Waver", "Missing"},
+			Methods: []Method{{Selector: "describe", Kind: "instance"}},
+		},
+		Traits: map[string]*Class{
+			"Greeter": {
+				Name:               "Greeter",
+				IsTrait:            true,
+				MethodRequirements: []string{"nameFor:", "describe"},
+				Methods: []Method{
+					{Selector: "greet", Kind: "instance"},
+					{Selector: "describe", Kind: "instance"},
+					{Selector: "describe", Kind: "class"},
+				},
+			},
+			"Waver": {
+				Name:    "Waver",
+				IsTrait: true,
+				Methods: []Method{{Selector: "greet", Kind: "instance"}, {Selector: "wave", Kind: "instance"}},
+			},
+		},
+	}
+
+	report := unit.MergeTraits()
+	for _, c := range []struct {
+		name string
+		got  []string
+		want string
+	}{
+		{"Merged", report.Merged, "Greeter Waver"},
+		{"Missing", report.Missing, "Missing"},
+		{"Overridden", report.Overridden, "Greeter>>describe"},
+		{"Conflicts", report.Conflicts, "greet (Greeter, Waver)"},
+		{"Unmet", report.Unmet, "Greeter requires nameFor:"},
+	} {
+		if got := strings.Join(c.got, " "); got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	// The class's describe, Greeter's greet and class-side describe, and
+	// Waver's wave
+	var selectors []string
+	for _, m := range unit.Class.Methods {
+		selectors = append(selectors, m.Kind+" "+m.Selector)
+	}
+	if got, want := strings.Join(selectors, ", "), "instance describe, instance greet, class describe, instance wave"; got != want {
+		t.Errorf("methods = %s, want %s", got, want)
+	}
+}
+
+func TestMergeTraitsResolutions(t *testing.T) {
+	unit := &CompilationUnit{
+		Class: &Class{
+			Name:   "Person",
+			Traits: []string{"Greeter", "Waver", "Dict"},
+			Resolutions: []Resolution{
+				{Kind: "resolve", Selector: "greet", Trait: "Waver"},
+				{Kind: "exclude", Selector: "at_put_", Trait: "Greeter"},
+				{Kind: "resolve", Selector: "greet", Trait: "Nobody"},
+				{Kind: "exclude", Selector: "missing", Trait: "Waver"},
+				{Kind: "resolve", Selector: "lookup", Trait: "Dict"},
+			},
+		},
+		Traits: map[string]*Class{
+			"Greeter": {
+				Name:    "Greeter",
+				IsTrait: true,
+				Methods: []Method{{Selector: "greet", Kind: "instance"}, {Selector: "at_put_", Kind: "instance"}},
+			},
+			"Waver": {
+				Name:    "Waver",
+				IsTrait: true,
+				Methods: []Method{{Selector: "greet", Kind: "instance"}, {Selector: "size", Kind: "instance"}},
+			},
+			"Dict": {
+				Name:    "Dict",
+				IsTrait: true,
+				Methods: []Method{{Selector: "at_put_", Kind: "instance"}, {Selector: "size", Kind: "instance"}},
+			},
+		},
+	}
+
+	report := unit.MergeTraits()
+	for _, c := range []struct {
+		name string
+		got  []string
+		want string
+	}{
+		{"Excluded", report.Excluded, "Greeter>>at_put_"},
+		{"Resolved", report.Resolved, "greet (use Waver over Greeter)"},
+		{"Conflicts", report.Conflicts, "size (Waver, Dict)"},
+		{"Invalid", report.Invalid, "resolve: greet use: Nobody: Nobody is not included|" +
+			"exclude: missing from: Waver: Waver does not define missing|" +
+			"resolve: lookup use: Dict: Dict does not define lookup"},
+	} {
+		if got := strings.Join(c.got, "|"); got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	origins := map[string]string{}
+	for _, m := range unit.Class.Methods {
+		origins[m.Selector] = m.Trait
+	}
+	for selector, want := range map[string]string{"greet": "Waver", "at_put_": "Dict", "size": "Waver"} {
+		if origins[selector] != want {
+			t.Errorf("%s merged from %q, want %q", selector, origins[selector], want)
+		}
+	}
+	if len(unit.Class.Methods) != 3 {
+		t.Errorf("merged %d methods, want 3", len(unit.Class.Methods))
+	}
+}
+
+func TestParseCompilationUnitsErrorOffset(t *testing.T) {
+	data := []byte(`[{"name": "A"}, {"name": "B"},
+  {"name": 4}]`)
+	_, err := ParseCompilationUnits(data)
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected a type error, got %v", err)
+	}
+	// The offset is in data, after the 4
+	if want := int64(bytes.IndexByte(data, '4') + 1); typeErr.Offset != want {
+		t.Errorf("offset = %d, want %d", typeErr.Offset, want)
+	}
+}
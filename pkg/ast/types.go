@@ -1,6 +1,8 @@
 // Package ast defines types for the Trashtalk AST produced by the jq parser.
 package ast
 
+import "github.com/chazu/procyon/pkg/mangle"
+
 // CompilationUnit represents a class along with its included traits.
 // This is the preferred input format when traits need to be compiled in.
 type CompilationUnit struct {
@@ -16,6 +18,7 @@ type Class struct {
 	Package            string        `json:"package"`       // Namespace: "MyApp" or ""
 	Imports            []string      `json:"imports"`       // Imported packages
 	IsTrait            bool          `json:"isTrait"`
+	IsAbstract         bool          `json:"isAbstract,omitempty"` // Declared ClassName subclass: Parent abstract
 	Location           Location      `json:"location"`
 	InstanceVars       []InstanceVar `json:"instanceVars"`
 	ClassInstanceVars  []InstanceVar `json:"classInstanceVars"`
@@ -24,25 +27,47 @@ type Class struct {
 	MethodRequirements []string      `json:"methodRequirements"`
 	Methods            []Method      `json:"methods"`
 	Aliases            []Alias       `json:"aliases"`
+	Resolutions        []Resolution  `json:"resolutions,omitempty"` // Trait conflict resolutions
+	AbstractMethods    []string      `json:"abstractMethods,omitempty"` // Selectors declared with abstractMethod:
+	Indexes            []string      `json:"indexes,omitempty"`         // Instance fields declared with index:
 	Advice             []Advice      `json:"advice"`
+	ClassVersion       int           `json:"classVersion,omitempty"` // Declared schema version, 0 if unversioned
+	Migrations         []Migration   `json:"migrations,omitempty"`
+	Renames            []Rename      `json:"renames,omitempty"` // migrate: old to: new declarations
+	Pragmas            []string      `json:"pragmas,omitempty"` // Class pragmas (e.g., ["grpcNative"])
+	Capabilities       []string      `json:"capabilities,omitempty"` // Powers declared with capabilities: (e.g., ["network"])
+}
+
+// HasPragma checks if the class declares a specific pragma.
+func (c *Class) HasPragma(pragma string) bool {
+	for _, p := range c.Pragmas {
+		if p == pragma {
+			return true
+		}
+	}
+	return false
+}
+
+// HasCapability checks if the class declares a specific capability.
+func (c *Class) HasCapability(capability string) bool {
+	for _, name := range c.Capabilities {
+		if name == capability {
+			return true
+		}
+	}
+	return false
 }
 
 // QualifiedName returns the fully qualified name of the class.
 // Returns "MyApp::Counter" for namespaced, "Counter" for non-namespaced.
 func (c *Class) QualifiedName() string {
-	if c.Package != "" {
-		return c.Package + "::" + c.Name
-	}
-	return c.Name
+	return mangle.Qualify(c.Package, c.Name)
 }
 
 // CompiledName returns the name for the compiled binary.
 // Returns "MyApp__Counter" for namespaced, "Counter" for non-namespaced.
 func (c *Class) CompiledName() string {
-	if c.Package != "" {
-		return c.Package + "__" + c.Name
-	}
-	return c.Name
+	return mangle.CompiledClass(c.QualifiedName())
 }
 
 // IsNamespaced returns true if the class belongs to a package.
@@ -60,6 +85,8 @@ type Location struct {
 type InstanceVar struct {
 	Name     string       `json:"name"`
 	Default  DefaultValue `json:"default"`
+	Type     string       `json:"type,omitempty"` // Type annotation: int, float, string, array or object
+	Ref      bool         `json:"ref,omitempty"`  // Holds another instance's ID (ref: declaration)
 	Location Location     `json:"location"`
 }
 
@@ -79,8 +106,10 @@ type Method struct {
 	Keywords  []string `json:"keywords"`  // For keyword methods (e.g., ["setValue"])
 	Args      []string `json:"args"`      // Argument names
 	Pragmas   []string `json:"pragmas"`   // Method pragmas (e.g., ["procyonOnly", "direct"])
+	ArgTypes  map[string]string `json:"argTypes,omitempty"` // Arg name -> type declared with argTypes: (int, float, bool or string)
 	Body      Block    `json:"body"`
 	Location  Location `json:"location"`
+	Trait     string   `json:"trait,omitempty"` // Trait the method was merged from, empty if the class defines it
 }
 
 // HasPragma checks if the method has a specific pragma.
@@ -107,17 +136,49 @@ type Token struct {
 	Col   int    `json:"col"`
 }
 
-// Alias represents a method alias.
+// Alias represents a method alias: alias: From for: To. The JSON names are
+// those of the parser's AliasAST.
 type Alias struct {
-	From string `json:"from"`
-	To   string `json:"to"`
+	From     string   `json:"aliasName"`
+	To       string   `json:"originalMethod"`
+	Location Location `json:"location"`
 }
 
-// Advice represents before/after advice on a method.
+// Resolution represents a trait conflict resolution: resolve: Selector use:
+// Trait (Kind "resolve") or exclude: Selector from: Trait (Kind "exclude").
+// The JSON names are those of the parser's ResolutionAST.
+type Resolution struct {
+	Kind     string   `json:"type"`
+	Selector string   `json:"selector"`
+	Trait    string   `json:"trait"`
+	Location Location `json:"location"`
+}
+
+// Advice represents before/after advice on a method. The JSON names are
+// those of the parser's AdviceAST.
 type Advice struct {
-	Type     string `json:"type"` // "before" or "after"
-	Selector string `json:"selector"`
-	Body     Block  `json:"body"`
+	Type     string   `json:"adviceType"` // "before" or "after"
+	Selector string   `json:"selector"`
+	Body     Block    `json:"block"`
+	Location Location `json:"location"`
+}
+
+// Rename represents a migrate: From to: To declaration: instances saved
+// while instance variable To was called From keep its value. The JSON names
+// are those of the parser's RenameAST.
+type Rename struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Location Location `json:"location"`
+}
+
+// Migration represents a migrateFrom: block that upgrades stored instance
+// data from version From to From+1. Field names follow the parser's
+// MigrationAST so trash-compare parse output can be compiled directly.
+type Migration struct {
+	From     int      `json:"fromVersion"`
+	Block    Block    `json:"block"`
+	Location Location `json:"location"`
 }
 
 // Token type constants
@@ -140,6 +201,7 @@ const (
 	TokenColon      = "COLON"
 	TokenLBracket   = "LBRACKET"
 	TokenRBracket   = "RBRACKET"
+	TokenBackslash  = "BACKSLASH"
 
 	// Comparison operators
 	TokenGT      = "GT"      // >
@@ -152,6 +214,8 @@ const (
 	TokenPercent = "PERCENT" // % (modulo)
 	TokenDot     = "DOT"     // . (statement separator)
 	TokenComma   = "COMMA"   // , (string concatenation)
+	TokenAnd     = "AND"     // &&
+	TokenOr      = "OR"      // ||
 
 	// Control flow
 	TokenKeyword = "KEYWORD" // identifier followed by colon (e.g., "ifTrue:")
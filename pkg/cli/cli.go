@@ -0,0 +1,470 @@
+// Package cli is the small subcommand framework shared by the Procyon
+// command-line tools.
+//
+// A tool is a tree of Commands. Each command owns its flags and gets
+// consistent --help output, unknown flags and commands are reported with a
+// suggestion, and every root command gains "help" and "completion"
+// subcommands. Completion scripts for bash, zsh, and fish are generated from
+// the same tree, so they never drift from the flags a tool accepts.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// AnyArgs accepts any number of positional arguments.
+const AnyArgs = -1
+
+// Command is a CLI command or subcommand.
+type Command struct {
+	// Name is the command name as typed on the command line
+	Name string
+	// Usage is the positional argument synopsis, e.g. "<file.trash>"
+	Usage string
+	// Short is a one-line description shown in command lists
+	Short string
+	// Long is the description shown by --help
+	Long string
+	// Examples are shown by --help, one command line each
+	Examples []string
+
+	// Args is the exact number of positional arguments, or AnyArgs
+	Args int
+	// ArgFiles is the glob used to complete positional arguments, e.g. "*.trash"
+	ArgFiles string
+	// ArgValues completes positional arguments from a fixed list
+	ArgValues []string
+
+	// Flags registers the command's flags
+	Flags func(fs *flag.FlagSet)
+	// FlagValues lists the accepted values of enumerated flags, for completion
+	FlagValues map[string][]string
+
+	// Run executes the command with its positional arguments. Commands
+	// without Run only group subcommands.
+	Run func(args []string) error
+
+	// Commands are the subcommands
+	Commands []*Command
+
+	parent *Command
+	fs     *flag.FlagSet
+}
+
+// Execute runs the command tree against os.Args and exits with its status.
+func (c *Command) Execute() {
+	os.Exit(c.Main(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// Main runs the command tree against args and returns the exit status.
+// Help goes to stdout; errors go to stderr.
+func (c *Command) Main(args []string, stdout, stderr io.Writer) int {
+	quiet, jsonOut, outw, errw = false, false, stdout, stderr
+	c.addBuiltins(stdout)
+	return c.run(args, stdout, stderr)
+}
+
+func (c *Command) run(args []string, stdout, stderr io.Writer) int {
+	if len(c.Commands) > 0 {
+		args = takeGlobalFlags(args)
+	}
+	if len(c.Commands) > 0 && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if sub := c.find(args[0]); sub != nil {
+			return sub.run(args[1:], stdout, stderr)
+		}
+		if c.Run == nil {
+			return c.fail(stderr, fmt.Errorf("unknown command %q%s", args[0], suggest(args[0], "", c.commandNames())))
+		}
+	}
+
+	fs := c.flagSet()
+	rest, err := parseInterspersed(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			c.PrintHelp(stdout)
+			return 0
+		}
+		return c.fail(stderr, c.flagError(err))
+	}
+	quiet = quiet || isSet(fs, quietFlag)
+	jsonOut = jsonOut || isSet(fs, jsonFlag)
+
+	if c.Run == nil {
+		c.PrintHelp(stderr)
+		return ExitUsage
+	}
+
+	if c.Args != AnyArgs && len(rest) != c.Args {
+		switch {
+		case len(rest) < c.Args:
+			return c.fail(stderr, fmt.Errorf("missing argument %s", c.Usage))
+		case c.Args == 0:
+			return c.fail(stderr, fmt.Errorf("unexpected argument %q", rest[0]))
+		default:
+			return c.fail(stderr, fmt.Errorf("too many arguments, expected %s", c.Usage))
+		}
+	}
+
+	if err := c.Run(rest); err != nil {
+		code := exitCode(err)
+		if exit, ok := err.(*ExitError); ok && exit.Err == nil {
+			return code
+		}
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		reportJSON(code, err)
+		return code
+	}
+	return ExitOK
+}
+
+// parseInterspersed parses flags anywhere among the positional arguments,
+// so "tool parse file.trash --json" works. Arguments after "--" are
+// always positional.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var tail []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, tail = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+	return append(rest, tail...), nil
+}
+
+// fail reports a usage error and returns the usage exit status
+func (c *Command) fail(stderr io.Writer, err error) int {
+	fmt.Fprintf(stderr, "Error: %v\n", err)
+	fmt.Fprintf(stderr, "Run '%s --help' for usage.\n", c.Path())
+	reportJSON(ExitUsage, err)
+	return ExitUsage
+}
+
+// reportJSON writes the error document to stdout under --json
+func reportJSON(code int, err error) {
+	if jsonOut {
+		PrintJSON(errorDoc{ExitCode: code, Error: err.Error()})
+	}
+}
+
+// takeGlobalFlags consumes --quiet and --json given before a subcommand
+// name, so "tool --json sub" works like "tool sub --json"
+func takeGlobalFlags(args []string) []string {
+	for len(args) > 0 {
+		switch strings.TrimLeft(args[0], "-") {
+		case quietFlag:
+			quiet = true
+		case jsonFlag:
+			jsonOut = true
+		default:
+			return args
+		}
+		args = args[1:]
+	}
+	return args
+}
+
+// isSet reports whether a bool flag is true after parsing
+func isSet(fs *flag.FlagSet, name string) bool {
+	f := fs.Lookup(name)
+	return f != nil && f.Value.String() == "true"
+}
+
+// flagError rewrites the flag package's parse errors in --flag form
+func (c *Command) flagError(err error) error {
+	msg := err.Error()
+	if name, ok := strings.CutPrefix(msg, "flag provided but not defined: "); ok {
+		name = strings.TrimLeft(name, "-")
+		return fmt.Errorf("unknown flag --%s%s", name, suggest(name, "--", c.flagNames()))
+	}
+	if name, ok := strings.CutPrefix(msg, "flag needs an argument: "); ok {
+		return fmt.Errorf("flag --%s needs a value", strings.TrimLeft(name, "-"))
+	}
+	if rest, ok := strings.CutPrefix(msg, "invalid value "); ok {
+		return errors.New("invalid value " + strings.Replace(rest, " for flag -", " for flag --", 1))
+	}
+	return err
+}
+
+// Path returns the full command line prefix, e.g. "trash-compare parse".
+func (c *Command) Path() string {
+	if c.parent == nil {
+		return c.Name
+	}
+	return c.parent.Path() + " " + c.Name
+}
+
+// flagSet returns the command's flags, registering them on first use.
+// The same FlagSet serves parsing, help, and completion so flag variables
+// are only bound once.
+func (c *Command) flagSet() *flag.FlagSet {
+	if c.fs == nil {
+		c.fs = flag.NewFlagSet(c.Path(), flag.ContinueOnError)
+		c.fs.SetOutput(io.Discard)
+		if c.Flags != nil {
+			c.Flags(c.fs)
+		}
+		if c.fs.Lookup(quietFlag) == nil {
+			c.fs.Bool(quietFlag, false, "only write errors to stderr")
+		}
+		if c.fs.Lookup(jsonFlag) == nil {
+			c.fs.Bool(jsonFlag, false, "write results and errors to stdout as JSON")
+		}
+	}
+	return c.fs
+}
+
+func (c *Command) find(name string) *Command {
+	for _, sub := range c.Commands {
+		if sub.Name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (c *Command) commandNames() []string {
+	var names []string
+	for _, sub := range c.Commands {
+		names = append(names, sub.Name)
+	}
+	return names
+}
+
+func (c *Command) flagNames() []string {
+	var names []string
+	c.flagSet().VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	return names
+}
+
+// addBuiltins links parents and adds the help and completion subcommands
+func (c *Command) addBuiltins(stdout io.Writer) {
+	root := c
+	if root.find("help") == nil {
+		root.Commands = append(root.Commands, &Command{
+			Name:  "help",
+			Usage: "[command...]",
+			Short: "Show help for a command",
+			Args:  AnyArgs,
+			Run: func(args []string) error {
+				target := root
+				for _, name := range args {
+					sub := target.find(name)
+					if sub == nil {
+						return fmt.Errorf("unknown command %q%s", name, suggest(name, "", target.commandNames()))
+					}
+					target = sub
+				}
+				target.PrintHelp(stdout)
+				return nil
+			},
+		})
+	}
+	if root.find("completion") == nil {
+		root.Commands = append(root.Commands, &Command{
+			Name:      "completion",
+			Usage:     "<bash|zsh|fish>",
+			Short:     "Print a shell completion script",
+			Long:      "Print a completion script for the given shell. Load it with, e.g.:\n  source <(" + root.Name + " completion bash)",
+			Args:      1,
+			ArgValues: []string{"bash", "zsh", "fish"},
+			Run: func(args []string) error {
+				return root.WriteCompletion(stdout, args[0])
+			},
+		})
+	}
+	root.find("help").ArgValues = root.commandNames()
+	root.link()
+}
+
+func (c *Command) link() {
+	for _, sub := range c.Commands {
+		sub.parent = c
+		sub.link()
+	}
+}
+
+// PrintHelp writes the long-form help for the command.
+func (c *Command) PrintHelp(w io.Writer) {
+	title := c.Path()
+	if c.Short != "" {
+		title += " - " + c.Short
+	}
+	fmt.Fprintf(w, "%s\n\nUsage:\n", title)
+
+	synopsis := c.Path()
+	if c.hasFlags() {
+		synopsis += " [flags]"
+	}
+	if c.Run != nil {
+		if c.Usage != "" {
+			synopsis += " " + c.Usage
+		}
+		fmt.Fprintf(w, "  %s\n", synopsis)
+	}
+	if len(c.Commands) > 0 {
+		fmt.Fprintf(w, "  %s <command>\n", c.Path())
+	}
+
+	if c.Long != "" {
+		fmt.Fprintf(w, "\n%s\n", c.Long)
+	}
+
+	if len(c.Commands) > 0 {
+		fmt.Fprintf(w, "\nCommands:\n")
+		width := 0
+		for _, sub := range c.Commands {
+			width = max(width, len(sub.Name))
+		}
+		for _, sub := range c.Commands {
+			fmt.Fprintf(w, "  %-*s  %s\n", width, sub.Name, sub.Short)
+		}
+	}
+
+	var global []*flag.Flag
+	fmt.Fprintf(w, "\nFlags:\n")
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		if f.Name == quietFlag || f.Name == jsonFlag {
+			global = append(global, f)
+			return
+		}
+		name, usage := flag.UnquoteUsage(f)
+		line := "  --" + f.Name
+		if name != "" {
+			line += " " + name
+		}
+		fmt.Fprintf(w, "%s\n      %s", line, usage)
+		switch {
+		case isStringFlag(f):
+			if f.DefValue != "" {
+				fmt.Fprintf(w, " (default %q)", f.DefValue)
+			}
+		case !isZeroDefault(f):
+			fmt.Fprintf(w, " (default %s)", f.DefValue)
+		}
+		if values := c.FlagValues[f.Name]; len(values) > 0 {
+			fmt.Fprintf(w, " [%s]", strings.Join(values, ", "))
+		}
+		fmt.Fprintln(w)
+	})
+	fmt.Fprintf(w, "  -h, --help\n      show this help\n")
+	if len(global) > 0 {
+		fmt.Fprintf(w, "\nGlobal Flags:\n")
+		for _, f := range global {
+			fmt.Fprintf(w, "  --%s\n      %s\n", f.Name, f.Usage)
+		}
+	}
+
+	if len(c.Examples) > 0 {
+		fmt.Fprintf(w, "\nExamples:\n")
+		for _, ex := range c.Examples {
+			fmt.Fprintf(w, "  %s\n", ex)
+		}
+	}
+
+	if len(c.Commands) > 0 {
+		fmt.Fprintf(w, "\nRun '%s <command> --help' for more about a command.\n", c.Path())
+	}
+}
+
+func (c *Command) hasFlags() bool {
+	found := false
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		found = found || (f.Name != quietFlag && f.Name != jsonFlag)
+	})
+	return found
+}
+
+// isBoolFlag reports whether a flag takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// SplitList splits a comma-separated flag value such as --roots App,Session,
+// trimming entries and dropping empty ones.
+func SplitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// isStringFlag reports whether a flag holds a string, whose default help
+// quotes like flag.PrintDefaults
+func isStringFlag(f *flag.Flag) bool {
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return false
+	}
+	_, ok = g.Get().(string)
+	return ok
+}
+
+// isZeroDefault reports whether a flag that is not a string defaults to the
+// zero value of its type, which help leaves out
+func isZeroDefault(f *flag.Flag) bool {
+	switch f.DefValue {
+	case "", "0", "0s", "false":
+		return true
+	}
+	return false
+}
+
+// suggest returns " (did you mean X?)" for the candidate closest to name,
+// or "" if none is close. prefix is prepended to the suggestion, e.g. "--".
+func suggest(name, prefix string, candidates []string) string {
+	best, bestDist := "", 3 // only suggest close matches
+	sort.Strings(candidates)
+	for _, cand := range candidates {
+		if d := editDistance(name, cand); d < bestDist {
+			best, bestDist = cand, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %s%s?)", prefix, best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
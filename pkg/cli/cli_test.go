@@ -0,0 +1,272 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// newTestRoot returns a two-level command tree recording what ran
+func newTestRoot(ran *[]string) *Command {
+	var verbose *bool
+	var format *string
+	return &Command{
+		Name:  "tool",
+		Short: "A test tool",
+		Commands: []*Command{
+			{
+				Name:     "parse",
+				Usage:    "<file.trash>",
+				Short:    "Parse a file",
+				Args:     1,
+				ArgFiles: "*.trash",
+				Flags: func(fs *flag.FlagSet) {
+					verbose = fs.Bool("verbose", false, "print more")
+					format = fs.String("format", "text", "output format")
+					fs.Int("jobs", 4, "parallel jobs")
+					fs.Int("limit", 0, "stop after this many")
+					fs.Duration("timeout", 0, "give up after this long")
+					fs.String("out", "", "output file")
+				},
+				FlagValues: map[string][]string{"format": {"text", "json"}},
+				Run: func(args []string) error {
+					*ran = append(*ran, "parse "+args[0]+" "+*format)
+					if *verbose {
+						*ran = append(*ran, "verbose")
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func runTool(args ...string) (code int, stdout, stderr string, ran []string) {
+	var out, errOut bytes.Buffer
+	code = newTestRoot(&ran).Main(args, &out, &errOut)
+	return code, out.String(), errOut.String(), ran
+}
+
+func TestCommandDispatch(t *testing.T) {
+	code, _, stderr, ran := runTool("parse", "--format", "json", "--verbose", "A.trash")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	if strings.Join(ran, ",") != "parse A.trash json,verbose" {
+		t.Errorf("ran %v", ran)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"prase"}, `unknown command "prase" (did you mean parse?)`},
+		{[]string{"parse", "--formt", "x"}, "unknown flag --formt (did you mean --format?)"},
+		{[]string{"parse", "--format"}, "flag --format needs a value"},
+		{[]string{"parse"}, "missing argument <file.trash>"},
+		{[]string{"parse", "a", "b"}, "too many arguments"},
+		{[]string{"help", "nope"}, `unknown command "nope"`},
+	}
+	for _, tt := range tests {
+		code, _, stderr, ran := runTool(tt.args...)
+		if code != 1 {
+			t.Errorf("%v: exit %d, want 1", tt.args, code)
+		}
+		if !strings.Contains(stderr, tt.want) {
+			t.Errorf("%v: stderr %q, want %q", tt.args, stderr, tt.want)
+		}
+		if len(ran) > 0 {
+			t.Errorf("%v: command ran after a usage error", tt.args)
+		}
+	}
+}
+
+func TestCommandHelp(t *testing.T) {
+	for _, args := range [][]string{{"--help"}, {"help"}, {"parse", "-h"}, {"help", "parse"}} {
+		code, stdout, _, _ := runTool(args...)
+		if code != 0 {
+			t.Errorf("%v: exit %d", args, code)
+		}
+		if !strings.Contains(stdout, "Usage:") {
+			t.Errorf("%v: no usage in %q", args, stdout)
+		}
+	}
+
+	_, stdout, _, _ := runTool("help", "parse")
+	for _, want := range []string{"tool parse [flags] <file.trash>", "--format string", `(default "text") [text, json]`, "parallel jobs (default 4)\n"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("parse help missing %q:\n%s", want, stdout)
+		}
+	}
+	// Zero defaults are left out, like flag.PrintDefaults
+	for _, usage := range []string{"print more", "stop after this many", "give up after this long", "output file"} {
+		if !strings.Contains(stdout, usage+"\n") {
+			t.Errorf("parse help shows a default for %q:\n%s", usage, stdout)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	wants := map[string][]string{
+		"bash": {"complete -F _tool tool", `"tool parse")`, `compgen -W "text json"`, "!*.trash"},
+		"zsh":  {"#compdef tool", "_tool_parse()", "'--format=[output format]:format:(text json)'", "'parse[Parse a file]'"},
+		"fish": {"complete -c tool -n '__fish_use_subcommand' -a parse", "-l format -d 'output format' -x -a 'text json'"},
+	}
+	for shell, want := range wants {
+		code, stdout, stderr, _ := runTool("completion", shell)
+		if code != 0 {
+			t.Fatalf("%s: exit %d: %s", shell, code, stderr)
+		}
+		for _, w := range want {
+			if !strings.Contains(stdout, w) {
+				t.Errorf("%s completion missing %q:\n%s", shell, w, stdout)
+			}
+		}
+	}
+
+	if code, _, _, _ := runTool("completion", "tcsh"); code != 1 {
+		t.Errorf("unsupported shell: exit %d, want 1", code)
+	}
+
+	// The bash script must at least be syntactically valid
+	if bash, err := exec.LookPath("bash"); err == nil {
+		_, script, _, _ := runTool("completion", "bash")
+		cmd := exec.Command(bash, "-n")
+		cmd.Stdin = strings.NewReader(script)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("bash -n: %v\n%s", err, out)
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		err      error
+		code     int
+		stderr   string
+		jsonDocs bool
+	}{
+		{nil, ExitOK, "", false},
+		{errors.New("boom"), ExitUsage, "Error: boom", true},
+		{Errorf(ExitParse, "bad token"), ExitParse, "Error: bad token", true},
+		{Errorf(ExitCodegen, "refused"), ExitCodegen, "Error: refused", true},
+		{Exit(ExitParse, nil), ExitParse, "", false},
+	}
+	for _, tt := range tests {
+		root := &Command{Name: "tool", Run: func([]string) error { return tt.err }}
+		var out, errOut bytes.Buffer
+		if code := root.Main([]string{"--json"}, &out, &errOut); code != tt.code {
+			t.Errorf("%v: exit %d, want %d", tt.err, code, tt.code)
+		}
+		if got := strings.TrimSpace(errOut.String()); got != tt.stderr {
+			t.Errorf("%v: stderr %q, want %q", tt.err, got, tt.stderr)
+		}
+		if !tt.jsonDocs {
+			if out.Len() != 0 {
+				t.Errorf("%v: unexpected stdout %q", tt.err, out.String())
+			}
+			continue
+		}
+		var doc errorDoc
+		if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+			t.Fatalf("%v: stdout is not JSON: %v\n%s", tt.err, err, out.String())
+		}
+		if doc.ExitCode != tt.code || doc.Error != tt.err.Error() {
+			t.Errorf("%v: error document %+v", tt.err, doc)
+		}
+	}
+}
+
+func TestGlobalFlags(t *testing.T) {
+	var got []string
+	root := &Command{
+		Name: "tool",
+		Commands: []*Command{{
+			Name: "sub",
+			Args: AnyArgs,
+			Run: func(args []string) error {
+				Logf("progress")
+				got = append(args, fmt.Sprint(Quiet(), JSON()))
+				return PrintJSON(map[string]string{"code": "a < b"})
+			},
+		}},
+	}
+
+	var out, errOut bytes.Buffer
+	if code := root.Main([]string{"--quiet", "sub", "x", "--json", "--", "--y"}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	if strings.Join(got, " ") != "x --y true true" {
+		t.Errorf("got %v", got)
+	}
+	if errOut.Len() != 0 {
+		t.Errorf("--quiet still logged %q", errOut.String())
+	}
+	if !strings.Contains(out.String(), `"a < b"`) {
+		t.Errorf("JSON output escaped or missing: %s", out.String())
+	}
+
+	// Flags are reset between runs
+	out.Reset()
+	if root.Main([]string{"sub"}, &out, &errOut); !strings.Contains(errOut.String(), "progress") {
+		t.Errorf("Logf suppressed without --quiet")
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := map[string][]string{
+		"":                  nil,
+		"App":               {"App"},
+		"App, Session,,":    {"App", "Session"},
+		" , MyApp::Counter": {"MyApp::Counter"},
+	}
+	for in, want := range tests {
+		if got := SplitList(in); fmt.Sprint(got) != fmt.Sprint(want) || len(got) != len(want) {
+			t.Errorf("SplitList(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	if d := UnifiedDiff("a", "b", "x\ny\n", "x\ny\n"); d != "" {
+		t.Errorf("equal inputs: got %q", d)
+	}
+
+	old := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+	next := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n15\n16"
+	want := `--- old.go
++++ new.go
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -11,5 +11,5 @@
+ 11
+ 12
+ 13
+-14
+ 15
++16
+\ No newline at end of file
+`
+	if d := UnifiedDiff("old.go", "new.go", old, next); d != want {
+		t.Errorf("got:\n%s\nwant:\n%s", d, want)
+	}
+
+	// A missing file is diffed as empty
+	want = "--- none\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n"
+	if d := UnifiedDiff("none", "new", "", "a\nb\n"); d != want {
+		t.Errorf("got:\n%s\nwant:\n%s", d, want)
+	}
+}
@@ -0,0 +1,240 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteCompletion writes a completion script for shell (bash, zsh, or fish).
+func (c *Command) WriteCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		c.writeBash(w)
+	case "zsh":
+		c.writeZsh(w)
+	case "fish":
+		c.writeFish(w)
+	default:
+		return fmt.Errorf("unsupported shell %q (use bash, zsh, or fish)", shell)
+	}
+	return nil
+}
+
+// walk visits c and every subcommand, parents first
+func (c *Command) walk(visit func(*Command)) {
+	visit(c)
+	for _, sub := range c.Commands {
+		sub.walk(visit)
+	}
+}
+
+// funcName returns a shell function name for the command, e.g. _trash_compare_parse
+func (c *Command) funcName() string {
+	return "_" + strings.NewReplacer("-", "_", " ", "_").Replace(c.Path())
+}
+
+// flags returns the command's flags in definition order
+func (c *Command) flags() []*flag.Flag {
+	var out []*flag.Flag
+	c.flagSet().VisitAll(func(f *flag.Flag) { out = append(out, f) })
+	return out
+}
+
+// --- bash ---
+
+func (c *Command) writeBash(w io.Writer) {
+	fn := c.funcName()
+	fmt.Fprintf(w, "# bash completion for %s\n", c.Name)
+	fmt.Fprintf(w, "%s() {\n", fn)
+	fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	fmt.Fprintf(w, "    local path=%q i\n", c.Path())
+	fmt.Fprintf(w, "    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(w, "        case \"$path ${COMP_WORDS[i]}\" in\n")
+	var nested []string
+	c.walk(func(cmd *Command) {
+		if cmd != c {
+			nested = append(nested, fmt.Sprintf("%q", cmd.Path()))
+		}
+	})
+	if len(nested) > 0 {
+		fmt.Fprintf(w, "            %s) path=\"$path ${COMP_WORDS[i]}\" ;;\n", strings.Join(nested, "|"))
+	}
+	fmt.Fprintf(w, "        esac\n")
+	fmt.Fprintf(w, "    done\n\n")
+	fmt.Fprintf(w, "    case \"$path\" in\n")
+	c.walk(func(cmd *Command) {
+		fmt.Fprintf(w, "    %q)\n", cmd.Path())
+		cmd.writeBashCase(w)
+		fmt.Fprintf(w, "        ;;\n")
+	})
+	fmt.Fprintf(w, "    esac\n")
+	fmt.Fprintf(w, "}\n")
+	fmt.Fprintf(w, "complete -F %s %s\n", fn, c.Name)
+}
+
+func (c *Command) writeBashCase(w io.Writer) {
+	var flagWords []string
+	var valueCases []string
+	for _, f := range c.flags() {
+		flagWords = append(flagWords, "--"+f.Name)
+		if isBoolFlag(f) {
+			continue
+		}
+		if values := c.FlagValues[f.Name]; len(values) > 0 {
+			valueCases = append(valueCases, fmt.Sprintf("            --%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;", f.Name, strings.Join(values, " ")))
+		} else {
+			valueCases = append(valueCases, fmt.Sprintf("            --%s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;", f.Name))
+		}
+	}
+	flagWords = append(flagWords, "--help")
+
+	if len(valueCases) > 0 {
+		fmt.Fprintf(w, "        case \"$prev\" in\n%s\n        esac\n", strings.Join(valueCases, "\n"))
+	}
+	fmt.Fprintf(w, "        if [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(w, "            COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(flagWords, " "))
+	fmt.Fprintf(w, "            return\n")
+	fmt.Fprintf(w, "        fi\n")
+
+	switch {
+	case len(c.Commands) > 0:
+		fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(c.commandNames(), " "))
+	case len(c.ArgValues) > 0:
+		fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(c.ArgValues, " "))
+	case c.ArgFiles != "":
+		fmt.Fprintf(w, "        COMPREPLY=($(compgen -f -X '!%s' -- \"$cur\") $(compgen -d -- \"$cur\"))\n", c.ArgFiles)
+	case c.Args != 0:
+		fmt.Fprintf(w, "        COMPREPLY=($(compgen -f -- \"$cur\"))\n")
+	}
+}
+
+// --- zsh ---
+
+func (c *Command) writeZsh(w io.Writer) {
+	fmt.Fprintf(w, "#compdef %s\n", c.Name)
+	fmt.Fprintf(w, "# zsh completion for %s\n\n", c.Name)
+	c.walk(func(cmd *Command) {
+		cmd.writeZshFunc(w)
+	})
+	fmt.Fprintf(w, "compdef %s %s\n", c.funcName(), c.Name)
+}
+
+// zshEscape escapes text for a single-quoted [description]
+func zshEscape(s string) string {
+	return strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// zshMessage escapes text for the colon-separated message of an argument spec
+func zshMessage(s string) string {
+	return strings.ReplaceAll(zshEscape(s), ":", `\:`)
+}
+
+func (c *Command) writeZshFunc(w io.Writer) {
+	fmt.Fprintf(w, "%s() {\n", c.funcName())
+	specs := []string{`'(-h --help)'{-h,--help}'[show help]'`}
+	for _, f := range c.flags() {
+		desc := zshEscape(firstLine(f.Usage))
+		switch {
+		case isBoolFlag(f):
+			specs = append(specs, fmt.Sprintf("'--%s[%s]'", f.Name, desc))
+		case len(c.FlagValues[f.Name]) > 0:
+			specs = append(specs, fmt.Sprintf("'--%s=[%s]:%s:(%s)'", f.Name, desc, f.Name, strings.Join(c.FlagValues[f.Name], " ")))
+		default:
+			specs = append(specs, fmt.Sprintf("'--%s=[%s]:%s:_files'", f.Name, desc, f.Name))
+		}
+	}
+
+	switch {
+	case len(c.Commands) > 0:
+		fmt.Fprintf(w, "    local curcontext=\"$curcontext\" state line\n")
+		specs = append(specs, `'1: :->command'`, `'*:: :->args'`)
+	case len(c.ArgValues) > 0:
+		specs = append(specs, fmt.Sprintf("'1:%s:(%s)'", zshMessage(c.Usage), strings.Join(c.ArgValues, " ")))
+	case c.ArgFiles != "":
+		specs = append(specs, fmt.Sprintf(`'*:file:_files -g "%s"'`, c.ArgFiles))
+	case c.Args != 0:
+		specs = append(specs, `'*:file:_files'`)
+	}
+
+	args := "_arguments"
+	if len(c.Commands) > 0 {
+		args += " -C"
+	}
+	fmt.Fprintf(w, "    %s \\\n        %s\n", args, strings.Join(specs, " \\\n        "))
+
+	if len(c.Commands) > 0 {
+		fmt.Fprintf(w, "    case $state in\n")
+		fmt.Fprintf(w, "    command)\n")
+		var values []string
+		for _, sub := range c.Commands {
+			values = append(values, fmt.Sprintf("'%s[%s]'", sub.Name, zshEscape(sub.Short)))
+		}
+		fmt.Fprintf(w, "        _values 'command' %s\n", strings.Join(values, " "))
+		fmt.Fprintf(w, "        ;;\n")
+		fmt.Fprintf(w, "    args)\n")
+		fmt.Fprintf(w, "        case $line[1] in\n")
+		for _, sub := range c.Commands {
+			fmt.Fprintf(w, "        %s) %s ;;\n", sub.Name, sub.funcName())
+		}
+		fmt.Fprintf(w, "        esac\n")
+		fmt.Fprintf(w, "        ;;\n")
+		fmt.Fprintf(w, "    esac\n")
+	}
+	fmt.Fprintf(w, "}\n\n")
+}
+
+// --- fish ---
+
+func (c *Command) writeFish(w io.Writer) {
+	fmt.Fprintf(w, "# fish completion for %s\n", c.Name)
+	fmt.Fprintf(w, "complete -c %s -f\n", c.Name)
+	c.walk(func(cmd *Command) {
+		cond := cmd.fishCondition()
+		for _, sub := range cmd.Commands {
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s -d %s\n", c.Name, fishQuote(cond), sub.Name, fishQuote(sub.Short))
+		}
+		for _, f := range cmd.flags() {
+			line := fmt.Sprintf("complete -c %s -n %s -l %s -d %s", c.Name, fishQuote(cond), f.Name, fishQuote(firstLine(f.Usage)))
+			if !isBoolFlag(f) {
+				if values := cmd.FlagValues[f.Name]; len(values) > 0 {
+					line += " -x -a " + fishQuote(strings.Join(values, " "))
+				} else {
+					line += " -r -F"
+				}
+			}
+			fmt.Fprintln(w, line)
+		}
+		switch {
+		case len(cmd.Commands) > 0:
+		case len(cmd.ArgValues) > 0:
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", c.Name, fishQuote(cond), fishQuote(strings.Join(cmd.ArgValues, " ")))
+		case cmd.ArgFiles != "":
+			suffix := strings.TrimPrefix(cmd.ArgFiles, "*")
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", c.Name, fishQuote(cond), fishQuote("(__fish_complete_suffix "+suffix+")"))
+		case cmd.Args != 0:
+			fmt.Fprintf(w, "complete -c %s -n %s -F\n", c.Name, fishQuote(cond))
+		}
+	})
+}
+
+// fishCondition is the -n test selecting the command's completions
+func (c *Command) fishCondition() string {
+	if c.parent == nil {
+		if len(c.Commands) == 0 {
+			return "true"
+		}
+		return "__fish_use_subcommand"
+	}
+	return "__fish_seen_subcommand_from " + c.Name
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `'`, `\'`) + "'"
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
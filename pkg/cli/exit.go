@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Exit codes shared by every Procyon tool. Bash build scripts branch on
+// these instead of scraping stderr.
+const (
+	ExitOK      = 0
+	ExitUsage   = 1 // bad flags or arguments, unreadable input, other failures
+	ExitParse   = 2 // the source or AST could not be parsed
+	ExitCodegen = 3 // code generation failed or was refused (e.g. --strict)
+	ExitStale   = 4 // the output on disk differs from what would be generated (--diff)
+	// ExitFallback is reserved for compiled classes: unknown selector, fall
+	// back to Bash. The tools never exit with it.
+	ExitFallback = 200
+)
+
+// ExitError is an error carrying the exit code the tool should return.
+type ExitError struct {
+	Code int
+	Err  error // nil if the failure was already reported
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// Exit returns an error that makes the command exit with code. A nil err
+// exits without printing anything, for failures the command has already
+// reported on stdout.
+func Exit(code int, err error) error {
+	return &ExitError{Code: code, Err: err}
+}
+
+// Errorf formats an error that makes the command exit with code.
+func Errorf(code int, format string, args ...interface{}) error {
+	return Exit(code, fmt.Errorf(format, args...))
+}
+
+// exitCode returns the exit code for an error returned by Run
+func exitCode(err error) int {
+	var exit *ExitError
+	if errors.As(err, &exit) {
+		return exit.Code
+	}
+	return ExitUsage
+}
+
+// Global flags accepted by every command.
+const (
+	quietFlag = "quiet"
+	jsonFlag  = "json"
+)
+
+// Output state for the running command, set from the global flags.
+var (
+	quiet   bool
+	jsonOut bool
+	outw    io.Writer = os.Stdout
+	errw    io.Writer = os.Stderr
+)
+
+// Quiet reports whether --quiet was given: only errors go to stderr.
+func Quiet() bool { return quiet }
+
+// JSON reports whether --json was given: results and errors are written
+// to stdout as JSON documents.
+func JSON() bool { return jsonOut }
+
+// Logf writes a diagnostic line (progress, warnings, reports) to stderr
+// unless --quiet was given.
+func Logf(format string, args ...interface{}) {
+	if !quiet {
+		fmt.Fprintf(errw, format+"\n", args...)
+	}
+}
+
+// PrintJSON writes v to stdout as indented JSON.
+func PrintJSON(v interface{}) error {
+	enc := json.NewEncoder(outw)
+	enc.SetEscapeHTML(false) // generated code is full of < and &
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// errorDoc is the stdout document for a failed command under --json
+type errorDoc struct {
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error"`
+}
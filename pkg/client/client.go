@@ -0,0 +1,320 @@
+// Package client speaks the trashtalk-daemon protocol, so Go programs can
+// call class plugins the way the Bash runtime does.
+//
+// A request is one line of JSON naming the class, the instance JSON (empty
+// for class methods), the selector and its arguments; the response is one
+// line of JSON with the updated instance, the result and an exit code. On a
+// Unix socket (trashtalk-daemon --socket) the daemon answers one request per
+// connection, so a Client dials for every request and transparently
+// reconnects while the daemon restarts. A Stream keeps one connection, such
+// as the stdin and stdout of a trashtalk-daemon run without --socket (see
+// Spawn), and sends any number of requests over it in order.
+//
+// Instances are not loaded or saved here: the caller passes the instance
+// JSON it holds and stores the Instance of the response.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/chazu/procyon/pkg/protocol"
+)
+
+// The protocol is defined by package protocol; its names are repeated here
+// so that most programs only import client.
+
+// Exit codes carried by a Response
+const (
+	ExitOK              = protocol.ExitOK
+	ExitError           = protocol.ExitError
+	ExitUnknownSelector = protocol.ExitUnknownSelector
+	ExitTrashError      = protocol.ExitTrashError
+	ExitStorageBusy     = protocol.ExitStorageBusy
+	ExitUnauthorized    = protocol.ExitUnauthorized
+)
+
+// AdminClass is the class of requests handled by the daemon itself
+const AdminClass = protocol.AdminClass
+
+// ErrUnknownSelector is the error of a response with ExitUnknownSelector
+var ErrUnknownSelector = protocol.ErrUnknownSelector
+
+// ErrStorageBusy matches the error of a response with ExitStorageBusy; the
+// request can be sent again
+var ErrStorageBusy = protocol.ErrStorageBusy
+
+// ErrUnauthorized matches the error of a response with ExitUnauthorized
+var ErrUnauthorized = protocol.ErrUnauthorized
+
+type (
+	// Request is a dispatch request
+	Request = protocol.Request
+	// Response is the daemon's answer to a Request
+	Response = protocol.Response
+	// ResponseError is the error of a failed Response
+	ResponseError = protocol.ResponseError
+)
+
+// Options tune a Client. Zero fields take the defaults.
+type Options struct {
+	// DialTimeout bounds each connection attempt (default 5s)
+	DialTimeout time.Duration
+	// Reconnects is how often a refused connection is retried, for a daemon
+	// that is restarting after its idle timeout (default 3, negative for none)
+	Reconnects int
+	// ReconnectDelay is the wait before the first retry; it doubles after
+	// each one (default 50ms)
+	ReconnectDelay time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.DialTimeout == 0 {
+		o.DialTimeout = 5 * time.Second
+	}
+	if o.Reconnects == 0 {
+		o.Reconnects = 3
+	}
+	if o.ReconnectDelay == 0 {
+		o.ReconnectDelay = 50 * time.Millisecond
+	}
+	return o
+}
+
+// Client sends requests to a daemon listening on a Unix socket. It is safe
+// for concurrent use.
+type Client struct {
+	path string
+	opts Options
+}
+
+// Dial returns a Client for the daemon on the Unix socket at path, after
+// checking that it accepts connections
+func Dial(path string) (*Client, error) {
+	return DialOptions(context.Background(), path, Options{})
+}
+
+// DialOptions is Dial with a context and options
+func DialOptions(ctx context.Context, path string, opts Options) (*Client, error) {
+	c := &Client{path: path, opts: opts.withDefaults()}
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return c, nil
+}
+
+// Path returns the socket path the client dials
+func (c *Client) Path() string {
+	return c.path
+}
+
+// Send sends req and waits for the response
+func (c *Client) Send(req Request) (Response, error) {
+	return c.SendContext(context.Background(), req)
+}
+
+// SendContext sends req and waits for the response until ctx is done. A
+// request is only retried while the connection is refused, never once it
+// has been written, so a selector never runs twice.
+func (c *Client) SendContext(ctx context.Context, req Request) (Response, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+	return roundTrip(ctx, conn, bufio.NewReader(conn), req)
+}
+
+// Batch sends reqs in order and returns their responses. It stops at the
+// first request that cannot be delivered, returning the responses so far.
+func (c *Client) Batch(ctx context.Context, reqs []Request) ([]Response, error) {
+	responses := make([]Response, 0, len(reqs))
+	for i, req := range reqs {
+		resp, err := c.SendContext(ctx, req)
+		if err != nil {
+			return responses, fmt.Errorf("request %d (%s %s): %w", i, req.Class, req.Selector, err)
+		}
+		responses = append(responses, resp)
+	}
+	return responses, nil
+}
+
+// connect dials the socket, retrying while the daemon refuses connections
+// or its socket file is missing
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: c.opts.DialTimeout}
+	delay := c.opts.ReconnectDelay
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, "unix", c.path)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= c.opts.Reconnects || !retryable(err) {
+			return nil, fmt.Errorf("connecting to daemon on %s: %w", c.path, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retryable reports whether a dial error may clear once the daemon is up
+func retryable(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Stream sends requests over one connection carrying any number of them,
+// one line of JSON each way. Requests are answered in order; Send
+// serializes concurrent callers. A request that fails to round-trip leaves
+// the stream out of step with the responses, so every later Send fails too.
+type Stream struct {
+	w      io.Writer
+	r      *bufio.Reader
+	closer io.Closer
+	sem    chan struct{}
+	err    error // the failure that broke the stream
+}
+
+// NewStream returns a Stream reading responses from r and writing requests
+// to w, such as the stdout and stdin of trashtalk-daemon. Close closes w if
+// it is an io.Closer.
+func NewStream(r io.Reader, w io.Writer) *Stream {
+	s := &Stream{
+		w:   w,
+		r:   bufio.NewReaderSize(r, 1024*1024),
+		sem: make(chan struct{}, 1),
+	}
+	if closer, ok := w.(io.Closer); ok {
+		s.closer = closer
+	}
+	return s
+}
+
+// Spawn runs the daemon command name with args, such as
+// trashtalk-daemon --plugin-dir DIR, reading requests from stdin, and
+// returns a Stream to it. Close ends the daemon's input and waits for it to
+// exit; cancelling ctx kills it.
+func Spawn(ctx context.Context, name string, args ...string) (*Stream, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", name, err)
+	}
+	s := NewStream(stdout, stdin)
+	s.closer = closerFunc(func() error {
+		stdin.Close()
+		return cmd.Wait()
+	})
+	return s, nil
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// Send sends req and waits for its response until ctx is done
+func (s *Stream) Send(ctx context.Context, req Request) (Response, error) {
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return Response{}, ctx.Err()
+	}
+	defer func() { <-s.sem }()
+	if s.err != nil {
+		return Response{}, fmt.Errorf("stream unusable after earlier failure: %w", s.err)
+	}
+	resp, err := roundTrip(ctx, s.w, s.r, req)
+	if err != nil {
+		s.err = err
+	}
+	return resp, err
+}
+
+// Close closes the writing side, which ends a daemon reading stdin, and
+// waits for a spawned daemon to exit
+func (s *Stream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// roundTrip writes req as a line of JSON and reads one response line. If
+// the connection has deadlines, ctx cancellation interrupts a blocked read
+// or write; otherwise the round trip is abandoned and the error returned.
+func roundTrip(ctx context.Context, w io.Writer, r *bufio.Reader, req Request) (Response, error) {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	if conn, ok := w.(net.Conn); ok {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+		defer stop()
+	}
+
+	type result struct {
+		resp Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var res result
+		if _, res.err = w.Write(append(line, '\n')); res.err != nil {
+			res.err = fmt.Errorf("sending request: %w", res.err)
+			done <- res
+			return
+		}
+		out, err := r.ReadBytes('\n')
+		if err != nil {
+			res.err = fmt.Errorf("reading response: %w", err)
+			done <- res
+			return
+		}
+		if err := json.Unmarshal(out, &res.resp); err != nil {
+			res.err = fmt.Errorf("invalid response from daemon: %w", err)
+		}
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		if errors.Is(res.err, os.ErrDeadlineExceeded) {
+			// Deadlines are only set from ctx, which is done or about to be
+			<-ctx.Done()
+			return Response{}, ctx.Err()
+		}
+		if res.err != nil && ctx.Err() != nil {
+			return Response{}, ctx.Err()
+		}
+		return res.resp, res.err
+	case <-ctx.Done():
+		return Response{}, ctx.Err()
+	}
+}
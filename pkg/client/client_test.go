@@ -0,0 +1,193 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// echoHandler answers a request with its selector and arguments as the
+// result; "fail", "missing" and "busy" answer with exit codes 1, 200 and 202
+func echoHandler(req Request) Response {
+	switch req.Selector {
+	case "fail":
+		return Response{ExitCode: ExitError, Error: "it failed"}
+	case "missing":
+		return Response{ExitCode: ExitUnknownSelector}
+	case "busy":
+		return Response{ExitCode: ExitStorageBusy, Error: "storage busy: database is locked"}
+	}
+	result := req.Selector
+	for _, arg := range req.Args {
+		result += " " + arg
+	}
+	return Response{Instance: req.Instance, Result: result}
+}
+
+// serveSocket answers one request per connection on a Unix socket, like
+// trashtalk-daemon --socket
+func serveSocket(t *testing.T, path string, handle func(Request) Response) {
+	t.Helper()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			serveLines(conn, conn, handle, 1)
+			conn.Close()
+		}
+	}()
+}
+
+// serveLines answers up to n requests read from r (all of them if n < 0)
+func serveLines(r io.Reader, w io.Writer, handle func(Request) Response, n int) {
+	reader := bufio.NewReader(r)
+	for ; n != 0; n-- {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req Request
+		json.Unmarshal(line, &req)
+		out, _ := json.Marshal(handle(req))
+		w.Write(append(out, '\n'))
+	}
+}
+
+func TestSend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	serveSocket(t, path, echoHandler)
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	resp, err := c.Send(Request{Class: "Counter", Instance: `{"value":"1"}`, Selector: "add_", Args: []string{"2"}})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if resp.Result != "add_ 2" || resp.Instance != `{"value":"1"}` || resp.Err() != nil {
+		t.Errorf("got %+v", resp)
+	}
+
+	resp, _ = c.Send(Request{Class: "Counter", Selector: "missing"})
+	if !errors.Is(resp.Err(), ErrUnknownSelector) {
+		t.Errorf("missing: got %v, want ErrUnknownSelector", resp.Err())
+	}
+	resp, _ = c.Send(Request{Class: "Counter", Selector: "fail"})
+	var respErr *ResponseError
+	if !errors.As(resp.Err(), &respErr) || respErr.ExitCode != ExitError || respErr.Message != "it failed" {
+		t.Errorf("fail: got %v", resp.Err())
+	}
+	if errors.Is(resp.Err(), ErrStorageBusy) {
+		t.Errorf("fail: %v matches ErrStorageBusy", resp.Err())
+	}
+	resp, _ = c.Send(Request{Class: "Counter", Selector: "busy"})
+	if !errors.Is(resp.Err(), ErrStorageBusy) || !errors.As(resp.Err(), &respErr) || respErr.Message != "storage busy: database is locked" {
+		t.Errorf("busy: got %v, want ErrStorageBusy", resp.Err())
+	}
+}
+
+func TestBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	serveSocket(t, path, echoHandler)
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	responses, err := c.Batch(context.Background(), []Request{
+		{Class: "Counter", Selector: "a"},
+		{Class: "Counter", Selector: "b", Args: []string{"x"}},
+	})
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	if len(responses) != 2 || responses[0].Result != "a" || responses[1].Result != "b x" {
+		t.Errorf("got %+v", responses)
+	}
+}
+
+func TestDialNoDaemon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	if _, err := DialOptions(context.Background(), path, Options{Reconnects: -1}); err == nil {
+		t.Fatal("expected an error with no daemon listening")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	// The daemon comes up after the first attempts are refused
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		serveSocket(t, path, echoHandler)
+	}()
+
+	c, err := DialOptions(context.Background(), path, Options{Reconnects: 5, ReconnectDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if resp, err := c.Send(Request{Class: "Counter", Selector: "ping"}); err != nil || resp.Result != "ping" {
+		t.Errorf("got %+v, %v", resp, err)
+	}
+}
+
+func TestSendContextCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	serveSocket(t, path, func(req Request) Response {
+		time.Sleep(time.Second)
+		return echoHandler(req)
+	})
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.SendContext(ctx, Request{Class: "Counter", Selector: "slow"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("SendContext returned after %v", elapsed)
+	}
+}
+
+func TestStream(t *testing.T) {
+	reqR, reqW := io.Pipe()
+	respR, respW := io.Pipe()
+	go func() {
+		serveLines(reqR, respW, echoHandler, -1)
+		respW.Close()
+	}()
+
+	s := NewStream(respR, reqW)
+	for _, selector := range []string{"one", "two", "three"} {
+		resp, err := s.Send(context.Background(), Request{Class: "Counter", Selector: selector})
+		if err != nil {
+			t.Fatalf("Send %s: %v", selector, err)
+		}
+		if resp.Result != selector {
+			t.Errorf("Send %s: got %q", selector, resp.Result)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := s.Send(context.Background(), Request{Class: "Counter", Selector: "four"}); err == nil {
+		t.Error("expected an error after Close")
+	}
+}
@@ -0,0 +1,96 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains abstract classes and methods: abstractMethod: selectors
+// dispatch to a stub that signals NotImplemented, and new on a class declared
+// subclass: Parent abstract signals AbstractClass. Both are TrashErrors, so
+// they end the request with trashErrorExitCode like an unhandled _throw.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/dave/jennifer/jen"
+)
+
+// isAbstract reports whether class is declared abstract or declares
+// abstract selectors, which both need the TrashError helpers
+func isAbstract(class *ast.Class) bool {
+	return class.IsAbstract || len(class.AbstractMethods) > 0
+}
+
+// abstractSelectors returns the selectors declared with abstractMethod: that
+// the class does not implement itself
+func (g *generator) abstractSelectors() []string {
+	defined := g.definedInstanceSelectors()
+	var selectors []string
+	for _, sel := range g.class.AbstractMethods {
+		if !defined[sel] {
+			selectors = append(selectors, sel)
+		}
+	}
+	return selectors
+}
+
+// identifyAbstractMethods marks abstract selectors as skipped, so @ self
+// sends to them go through sendMessage to the subclass that implements them,
+// and warns about declarations the class implements itself
+func (g *generator) identifyAbstractMethods() {
+	defined := g.definedInstanceSelectors()
+	for _, sel := range g.class.AbstractMethods {
+		if defined[sel] {
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("abstractMethod: %s is implemented by %s; declaration ignored", sel, g.class.Name))
+			continue
+		}
+		g.skippedMethods[sel] = true
+	}
+}
+
+func (g *generator) definedInstanceSelectors() map[string]bool {
+	defined := map[string]bool{}
+	for _, m := range g.class.Methods {
+		if m.Kind != "class" {
+			defined[m.Selector] = true
+		}
+	}
+	return defined
+}
+
+// abstractDispatchCases returns a dispatch case for each abstract selector
+// that answers a NotImplemented error. The Bash runtime reaches the stub
+// when an instance of the abstract class itself receives the message.
+func (g *generator) abstractDispatchCases() []dispatchCase {
+	var cases []dispatchCase
+	for _, sel := range g.abstractSelectors() {
+		if g.deselected(sel) != "" {
+			continue
+		}
+		cases = append(cases, dispatchCase{sel, []jen.Code{
+			jen.Return(jen.Lit(""), trashError("NotImplemented", sel,
+				g.class.QualifiedName()+">>"+mangle.TrashSelector(sel)+" is abstract; a subclass must implement it")),
+		}})
+	}
+	return cases
+}
+
+// abstractNewCase returns the new case of an abstract class, which refuses to
+// create an instance, and false for other classes
+func (g *generator) abstractNewCase() (dispatchCase, bool) {
+	if !g.class.IsAbstract {
+		return dispatchCase{}, false
+	}
+	return dispatchCase{"new", []jen.Code{
+		jen.Return(jen.Lit(""), trashError("AbstractClass", "new",
+			g.class.QualifiedName()+" is abstract; create an instance of a subclass")),
+	}}, true
+}
+
+// trashError returns a *TrashError literal
+func trashError(class, selector, message string) *jen.Statement {
+	return jen.Op("&").Id("TrashError").Values(jen.Dict{
+		jen.Id("Class"):    jen.Lit(class),
+		jen.Id("Selector"): jen.Lit(selector),
+		jen.Id("Message"):  jen.Lit(message),
+	})
+}
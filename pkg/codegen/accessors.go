@@ -0,0 +1,52 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the accessors synthesized for instance variables
+// (Options.Accessors).
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// accessorDispatchCases returns a getter case (value) and a setter case
+// (value_) for each instance variable, as the Bash runtime generates them.
+// Selectors the class defines as instance methods, aliases or abstract
+// methods, and selectors deselected by Options.Only or Options.Skip, get no
+// accessor.
+func (g *generator) accessorDispatchCases() []dispatchCase {
+	if !g.accessors {
+		return nil
+	}
+	taken := map[string]bool{"class": true, "id": true, "delete": true}
+	for _, m := range g.class.Methods {
+		if m.Kind != "class" {
+			taken[m.Selector] = true
+		}
+	}
+	for _, a := range g.class.Aliases {
+		taken[a.From] = true
+	}
+	for _, sel := range g.abstractSelectors() {
+		taken[sel] = true
+	}
+
+	var cases []dispatchCase
+	for _, iv := range g.class.InstanceVars {
+		field := jen.Id("c").Dot(capitalize(iv.Name))
+		getter, setter := iv.Name, iv.Name+"_"
+
+		if !taken[getter] && g.deselected(getter) == "" {
+			cases = append(cases, dispatchCase{getter, []jen.Code{jen.Return(g.ivarString(iv.Name), jen.Nil())}})
+		}
+
+		if !taken[setter] && g.deselected(setter) == "" {
+			arg := g.ivarFromString(iv.Name, jen.Id("args").Index(jen.Lit(0)))
+			cases = append(cases, dispatchCase{setter, []jen.Code{
+				dispatchArgCheck(&compiledMethod{selector: setter, args: []string{iv.Name}}),
+				field.Clone().Op("=").Add(arg),
+				jen.Id("c").Dot("dirty").Op("=").True(),
+				jen.Return(jen.Lit(""), jen.Nil()),
+			}})
+		}
+	}
+	return cases
+}
@@ -0,0 +1,164 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains method advice (before:/after: do:).
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// Advice bodies compile to unexported methods (package-level functions for
+// class methods) named beforeX and afterX, taking the advised method's
+// arguments so the body can use them. The dispatch case of an advised
+// selector runs the before advice in declaration order, the method, then the
+// after advice; the first error ends the case and nothing is saved. Calls
+// with @ self go straight to the method, without its advice. A method whose
+// advice cannot be compiled falls back to Bash with it.
+
+// adviceFor returns the advice of the class on selector, in declaration order
+func (g *generator) adviceFor(selector string) []ast.Advice {
+	var advice []ast.Advice
+	for _, adv := range g.class.Advice {
+		if adv.Selector == selector {
+			advice = append(advice, adv)
+		}
+	}
+	return advice
+}
+
+// adviceUnsupported returns why the advice on m cannot be compiled, or ""
+func (g *generator) adviceUnsupported(m ast.Method) string {
+	for _, adv := range g.adviceFor(m.Selector) {
+		for _, tok := range adv.Body.Tokens {
+			if tok.Type == ast.TokenIdentifier {
+				switch tok.Value {
+				case "_ivar", "_ivar_set", "_on_error", "_ensure", "_pop_handler":
+					return adv.Type + " advice uses bash runtime function: " + tok.Value
+				}
+			}
+		}
+		if g.classVarsUnavailable(ast.Method{Kind: m.Kind, Body: adv.Body}) {
+			return adv.Type + " advice uses class instance variables, which need the SQLite helpers"
+		}
+		result := parser.ParseMethod(adv.Body.Tokens)
+		if result.Unsupported {
+			return adv.Type + " advice: " + result.Reason
+		}
+		if _, reason := findBlockVars(result.Body); reason != "" {
+			return adv.Type + " advice: " + reason
+		}
+	}
+	return ""
+}
+
+// attachAdvice compiles the advice on each of methods. Advice on a selector
+// the class does not define is reported, since it only runs in Bash.
+func (g *generator) attachAdvice(methods []*compiledMethod) {
+	for _, adv := range g.class.Advice {
+		defined := false
+		for _, m := range g.class.Methods {
+			if m.Selector == adv.Selector {
+				defined = true
+				break
+			}
+		}
+		if !defined {
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("%s advice on %s.%s not compiled: the class does not define %s",
+					adv.Type, g.class.Name, adv.Selector, adv.Selector))
+		}
+	}
+
+	for _, m := range methods {
+		counts := map[string]int{}
+		for _, adv := range g.adviceFor(m.selector) {
+			// adviceUnsupported has already sent m to Bash if this fails
+			result := parser.ParseMethod(adv.Body.Tokens)
+			blockVars, _ := findBlockVars(result.Body)
+
+			counts[adv.Type]++
+			name := adv.Type + mangle.GoName(m.selector)
+			if counts[adv.Type] > 1 {
+				name += fmt.Sprintf("%d", counts[adv.Type])
+			}
+			if m.isClass {
+				name = g.fn(name)
+			}
+			compiled := &compiledMethod{
+				selector:    name,
+				goName:      name,
+				args:        m.args,
+				body:        result.Body,
+				hasReturn:   hasReturnInStatements(result.Body.Statements),
+				isClass:     m.isClass,
+				returnsErr:  true,
+				renamedVars: make(map[string]string),
+				argTypes:    m.argTypes,
+				blockVars:   blockVars,
+			}
+			if adv.Type == "after" {
+				m.after = append(m.after, compiled)
+			} else {
+				m.before = append(m.before, compiled)
+			}
+		}
+	}
+}
+
+// generateAdviceMethods generates the advice compiled for m
+func (g *generator) generateAdviceMethods(f *jen.File, m *compiledMethod) {
+	for _, adv := range m.before {
+		g.generateMethod(f, adv)
+	}
+	for _, adv := range m.after {
+		g.generateMethod(f, adv)
+	}
+}
+
+// advisedDispatchCase returns the case for m running its advice around the
+// method. call builds the call to the method.
+func advisedDispatchCase(m *compiledMethod, call func(args ...jen.Code) *jen.Statement) dispatchCase {
+	var body []jen.Code
+	callArgs := []jen.Code{}
+	if len(m.args) > 0 {
+		body, callArgs = dispatchArgs(m)
+	}
+	adviceCall := func(adv *compiledMethod) *jen.Statement {
+		if adv.isClass {
+			return jen.Id(adv.goName).Call(callArgs...)
+		}
+		return jen.Id("c").Dot(adv.goName).Call(callArgs...)
+	}
+	runAdvice := func(advice []*compiledMethod) {
+		for _, adv := range advice {
+			body = append(body, jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Add(adviceCall(adv)), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			))
+		}
+	}
+
+	runAdvice(m.before)
+	result := jen.Lit("")
+	switch {
+	case m.returnsErr:
+		body = append(body,
+			jen.List(jen.Id("result"), jen.Err()).Op(":=").Add(call(callArgs...)),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+		)
+		result = jen.Id("result")
+	case m.hasReturn:
+		body = append(body, jen.Id("result").Op(":=").Add(call(callArgs...)))
+		result = jen.Id("result")
+	default:
+		body = append(body, call(callArgs...))
+	}
+	runAdvice(m.after)
+	body = append(body, jen.Return(result, jen.Nil()))
+	return dispatchCase{m.selector, body}
+}
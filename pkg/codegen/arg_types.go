@@ -0,0 +1,230 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains typed method arguments: a method whose body starts with
+// argTypes: amount:int flag:bool takes an int and a bool instead of strings.
+// Dispatch converts each argument once, before the method runs, and answers
+// a BadArgument TrashError naming the argument when one does not convert, so
+// the request ends with trashErrorExitCode instead of the method computing
+// with a zero. The body uses the arguments as they are, without toInt.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// usesArgTypes reports whether a method of class declares an int, float or
+// bool argument, which need the conversion helpers and TrashError. string
+// arguments are what dispatch passes anyway.
+func usesArgTypes(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, typ := range m.ArgTypes {
+			if typ != "string" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// argGoType returns the Go type of an argument declared as typ
+func argGoType(typ string) *jen.Statement {
+	switch typ {
+	case "int":
+		return jen.Int()
+	case "float":
+		return jen.Float64()
+	case "bool":
+		return jen.Bool()
+	}
+	return jen.String()
+}
+
+// typedArg returns the type declared for the argument name refers to in m,
+// or "" when name is not an int, float or bool argument
+func (g *generator) typedArg(name string, m *compiledMethod) string {
+	if m == nil {
+		return ""
+	}
+	switch typ := m.argTypes[name]; typ {
+	case "int", "float", "bool":
+		return typ
+	}
+	return ""
+}
+
+// typedValue returns the type and Go expression of the typed argument or
+// typed instance variable name refers to in m, or "" and nil when it is
+// neither
+func (g *generator) typedValue(name string, m *compiledMethod) (string, *jen.Statement) {
+	if typ := g.typedArg(name, m); typ != "" {
+		return typ, g.argParam(name, m)
+	}
+	if typ := g.typedIvar(name, m); typ != "" {
+		return typ, jen.Id("c").Dot(capitalize(name))
+	}
+	return "", nil
+}
+
+// argParam returns the parameter of argument name, renamed if it is a Go
+// keyword
+func (g *generator) argParam(name string, m *compiledMethod) *jen.Statement {
+	if renamed, ok := m.renamedVars[name]; ok {
+		return jen.Id(renamed)
+	}
+	return jen.Id(safeGoName(name))
+}
+
+// argString returns the string form of typed argument name, as the Bash
+// runtime would have passed it
+func (g *generator) argString(name string, m *compiledMethod) *jen.Statement {
+	param := g.argParam(name, m)
+	switch g.typedArg(name, m) {
+	case "int":
+		return jen.Qual("strconv", "Itoa").Call(param)
+	case "float":
+		return jen.Qual("strconv", "FormatFloat").Call(param, jen.LitRune('f'), jen.Lit(-1), jen.Lit(64))
+	case "bool":
+		return jen.Qual("strconv", "FormatBool").Call(param)
+	}
+	return param
+}
+
+// typedArgAssignment generates target := value for a typed argument
+func (g *generator) typedArgAssignment(target string, value parser.Expr, m *compiledMethod) []jen.Code {
+	var expr jen.Code
+	kind := g.numKind(value, m)
+	switch typ := g.typedArg(target, m); {
+	case typ == "int" && kind == numInt, typ == "float" && kind == numFloat:
+		expr = g.generateExpr(value, m)
+	case typ == "float" && kind == numInt:
+		expr = jen.Float64().Parens(g.generateExpr(value, m))
+	case typ == "int":
+		expr = jen.Id("toInt").Call(g.generateExpr(value, m))
+	case typ == "float":
+		expr = jen.Id("toFloat").Call(g.generateExpr(value, m))
+	default:
+		expr = jen.Id("toBool").Call(g.generateExpr(value, m))
+	}
+	return []jen.Code{g.argParam(target, m).Op("=").Add(expr)}
+}
+
+// argConverters are the helpers dispatch converts typed arguments with
+var argConverters = map[string]string{"int": "_argInt", "float": "_argFloat", "bool": "_argBool"}
+
+// dispatchArgs returns the statements a dispatch case for m starts with,
+// checking the argument count and converting typed arguments, and the
+// arguments it calls the method with
+func dispatchArgs(m *compiledMethod) ([]jen.Code, []jen.Code) {
+	prelude := []jen.Code{dispatchArgCheck(m)}
+	var callArgs []jen.Code
+	for i, arg := range m.args {
+		converter, ok := argConverters[m.argTypes[arg]]
+		if !ok {
+			callArgs = append(callArgs, jen.Id("args").Index(jen.Lit(i)))
+			continue
+		}
+		v := fmt.Sprintf("_arg%d", i)
+		prelude = append(prelude,
+			jen.List(jen.Id(v), jen.Err()).Op(":=").Id(converter).Call(jen.Lit(m.selector), jen.Lit(arg), jen.Id("args").Index(jen.Lit(i))),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+		)
+		callArgs = append(callArgs, jen.Id(v))
+	}
+	return prelude, callArgs
+}
+
+// selfSendArgTypes returns the types declared for the arguments of the
+// instance method selector, by position, or nil if it declares none
+func (g *generator) selfSendArgTypes(selector string) []string {
+	for _, method := range g.class.Methods {
+		if method.Selector != selector || method.Kind == "class" || len(method.ArgTypes) == 0 {
+			continue
+		}
+		types := make([]string, len(method.Args))
+		for i, arg := range method.Args {
+			types[i] = method.ArgTypes[arg]
+		}
+		return types
+	}
+	return nil
+}
+
+// selfSendArg converts arg of a self send to typ, the type the target
+// method declares for it. Values of the right type are passed as they are.
+func (g *generator) selfSendArg(arg parser.Expr, typ string, m *compiledMethod) *jen.Statement {
+	if id, ok := arg.(*parser.Identifier); ok {
+		if have, expr := g.typedValue(id.Name, m); have != "" {
+			switch {
+			case have == typ:
+				return expr
+			case have == "int" && typ == "float":
+				return jen.Float64().Parens(expr)
+			}
+		}
+	}
+	switch kind := g.numKind(arg, m); {
+	case typ == "int" && kind == numInt, typ == "float" && kind == numFloat:
+		return g.generateExpr(arg, m)
+	case typ == "float" && kind == numInt:
+		return jen.Float64().Parens(g.generateExpr(arg, m))
+	case typ == "int":
+		return jen.Id("toInt").Call(g.generateExpr(arg, m))
+	case typ == "float":
+		return jen.Id("toFloat").Call(g.generateExpr(arg, m))
+	}
+	return jen.Id("toBool").Call(g.generateExpr(arg, m))
+}
+
+// generateArgTypeHelpers generates _badArgument and the _argInt, _argFloat
+// and _argBool conversions when a method declares typed arguments
+func (g *generator) generateArgTypeHelpers(f *jen.File) {
+	if !g.typedArgs {
+		return
+	}
+	f.Comment("_badArgument returns the BadArgument error of argument arg of selector, which")
+	f.Comment("should be want but is got")
+	f.Func().Id("_badArgument").Params(jen.List(jen.Id("selector"), jen.Id("arg"), jen.Id("want"), jen.Id("got")).String()).Error().Block(
+		jen.Return(jen.Op("&").Id("TrashError").Values(jen.Dict{
+			jen.Id("Class"):    jen.Lit("BadArgument"),
+			jen.Id("Selector"): jen.Id("selector"),
+			jen.Id("Message"): jen.Qual("fmt", "Sprintf").Call(jen.Lit("%s argument %s must be %s, got %q"),
+				jen.Qual("strings", "ReplaceAll").Call(jen.Id("selector"), jen.Lit("_"), jen.Lit(":")), jen.Id("arg"), jen.Id("want"), jen.Id("got")),
+		})),
+	)
+	f.Line()
+
+	f.Comment("_argInt converts argument arg of selector to an int")
+	f.Func().Id("_argInt").Params(jen.List(jen.Id("selector"), jen.Id("arg"), jen.Id("s")).String()).Parens(jen.List(jen.Int(), jen.Error())).Block(
+		jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("s")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(0), jen.Id("_badArgument").Call(jen.Id("selector"), jen.Id("arg"), jen.Lit("an int"), jen.Id("s"))),
+		),
+		jen.Return(jen.Id("n"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("_argFloat converts argument arg of selector to a float64")
+	f.Func().Id("_argFloat").Params(jen.List(jen.Id("selector"), jen.Id("arg"), jen.Id("s")).String()).Parens(jen.List(jen.Float64(), jen.Error())).Block(
+		jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("s"), jen.Lit(64)),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(0), jen.Id("_badArgument").Call(jen.Id("selector"), jen.Id("arg"), jen.Lit("a number"), jen.Id("s"))),
+		),
+		jen.Return(jen.Id("n"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("_argBool converts argument arg of selector, true or false, to a bool")
+	f.Func().Id("_argBool").Params(jen.List(jen.Id("selector"), jen.Id("arg"), jen.Id("s")).String()).Parens(jen.List(jen.Bool(), jen.Error())).Block(
+		jen.Switch(jen.Id("s")).Block(
+			jen.Case(jen.Lit("true")).Block(jen.Return(jen.True(), jen.Nil())),
+			jen.Case(jen.Lit("false")).Block(jen.Return(jen.False(), jen.Nil())),
+		),
+		jen.Return(jen.False(), jen.Id("_badArgument").Call(jen.Id("selector"), jen.Id("arg"), jen.Lit("true or false"), jen.Id("s"))),
+	)
+	f.Line()
+}
@@ -0,0 +1,177 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the array ordering primitives: arraySort (lexical),
+// arraySortNumeric (numbers ascending, then anything else lexically),
+// arrayReverse, arrayUnique and arrayJoin:. All of them answer a new array
+// or string and leave the receiver as it was. <array> ivars use the native
+// helpers directly; other receivers are JSON text, decoded first and
+// answered as JSON text again.
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// arrayOps are the unary array ordering primitives
+var arrayOps = map[string]bool{"arraySort": true, "arraySortNumeric": true, "arrayReverse": true, "arrayUnique": true}
+
+// usesArrayOps reports whether a method of class sends an array ordering
+// primitive, so that their helpers are only generated when needed
+func usesArrayOps(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			switch {
+			case tok.Type == ast.TokenIdentifier && arrayOps[tok.Value],
+				tok.Type == ast.TokenKeyword && tok.Value == "arrayJoin:":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateArrayOp generates Go code for arraySort, arraySortNumeric,
+// arrayReverse, arrayUnique and arrayJoin:
+func (g *generator) generateArrayOp(e *parser.JSONPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	if e.Operation == "arrayJoin" {
+		// Always a string, whatever the receiver
+		return jen.Id("_arrayJoin").Call(g.nativeArray(e.Receiver, m), g.generateStringArg(e.Args[0], m))
+	}
+	if g.exprResultsInArray(e.Receiver, m) {
+		return g.arrayOpCall(e, m)
+	}
+	return jen.Id("_jsonArrayText").Call(g.arrayOpCall(e, m))
+}
+
+// arrayOpCall returns the native helper call of a unary array ordering
+// primitive, answering a []interface{}
+func (g *generator) arrayOpCall(e *parser.JSONPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	arr := g.nativeArray(e.Receiver, m)
+	switch e.Operation {
+	case "arraySort":
+		return jen.Id("_arraySort").Call(arr, jen.False())
+	case "arraySortNumeric":
+		return jen.Id("_arraySort").Call(arr, jen.True())
+	case "arrayReverse":
+		return jen.Id("_arrayReverse").Call(arr)
+	default:
+		return jen.Id("_arrayUnique").Call(arr)
+	}
+}
+
+// nativeArray returns expr as a []interface{}. Chained ordering primitives
+// stay native, so that only the end of a chain is encoded as JSON text.
+func (g *generator) nativeArray(expr parser.Expr, m *compiledMethod) *jen.Statement {
+	if g.exprResultsInArray(expr, m) {
+		return g.generateExpr(expr, m)
+	}
+	if e, ok := expr.(*parser.JSONPrimitiveExpr); ok && arrayOps[e.Operation] {
+		return g.arrayOpCall(e, m)
+	}
+	return jen.Id("_jsonArrayDecode").Call(g.generateExpr(expr, m))
+}
+
+// generateArrayOpHelpers generates _arraySort, _arrayLess, _arrayReverse,
+// _arrayUnique, _arrayJoin, _jsonArrayDecode and _jsonArrayText
+func (g *generator) generateArrayOpHelpers(f *jen.File) {
+	if !g.arrayOps {
+		return
+	}
+	ifaces := jen.Index().Interface()
+
+	f.Comment("// Array ordering primitive helpers")
+	f.Line()
+
+	f.Comment("// _arraySort answers a sorted copy of arr: numbers first and ascending if")
+	f.Comment("// numeric, then everything else by its string")
+	f.Func().Id("_arraySort").Params(jen.Id("arr").Add(ifaces.Clone()), jen.Id("numeric").Bool()).Add(ifaces.Clone()).Block(
+		jen.Id("out").Op(":=").Append(jen.Make(ifaces.Clone(), jen.Lit(0), jen.Len(jen.Id("arr"))), jen.Id("arr").Op("...")),
+		jen.Qual("sort", "SliceStable").Call(jen.Id("out"), jen.Func().Params(jen.List(jen.Id("i"), jen.Id("j")).Int()).Bool().Block(
+			jen.Return(jen.Id("_arrayLess").Call(jen.Id("out").Index(jen.Id("i")), jen.Id("out").Index(jen.Id("j")), jen.Id("numeric"))),
+		)),
+		jen.Return(jen.Id("out")),
+	)
+	f.Line()
+
+	f.Comment("// _arrayLess orders the elements a and b for _arraySort")
+	f.Func().Id("_arrayLess").Params(jen.List(jen.Id("a"), jen.Id("b")).Interface(), jen.Id("numeric").Bool()).Bool().Block(
+		jen.If(jen.Id("numeric")).Block(
+			jen.List(jen.Id("x"), jen.Id("errX")).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("_toStr").Call(jen.Id("a")), jen.Lit(64)),
+			jen.List(jen.Id("y"), jen.Id("errY")).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("_toStr").Call(jen.Id("b")), jen.Lit(64)),
+			jen.Switch().Block(
+				jen.Case(jen.Id("errX").Op("==").Nil().Op("&&").Id("errY").Op("==").Nil()).Block(
+					jen.Return(jen.Id("x").Op("<").Id("y")),
+				),
+				jen.Case(jen.Parens(jen.Id("errX").Op("==").Nil()).Op("!=").Parens(jen.Id("errY").Op("==").Nil())).Block(
+					jen.Return(jen.Id("errX").Op("==").Nil()),
+				),
+			),
+		),
+		jen.Return(jen.Id("_toStr").Call(jen.Id("a")).Op("<").Id("_toStr").Call(jen.Id("b"))),
+	)
+	f.Line()
+
+	f.Comment("// _arrayReverse answers a reversed copy of arr")
+	f.Func().Id("_arrayReverse").Params(jen.Id("arr").Add(ifaces.Clone())).Add(ifaces.Clone()).Block(
+		jen.Id("out").Op(":=").Make(ifaces.Clone(), jen.Len(jen.Id("arr"))),
+		jen.For(jen.List(jen.Id("i"), jen.Id("v")).Op(":=").Range().Id("arr")).Block(
+			jen.Id("out").Index(jen.Len(jen.Id("arr")).Op("-").Lit(1).Op("-").Id("i")).Op("=").Id("v"),
+		),
+		jen.Return(jen.Id("out")),
+	)
+	f.Line()
+
+	f.Comment("// _arrayUnique answers arr without repeated elements, keeping the first of")
+	f.Comment("// each. Elements are the same if their JSON is.")
+	f.Func().Id("_arrayUnique").Params(jen.Id("arr").Add(ifaces.Clone())).Add(ifaces.Clone()).Block(
+		jen.Id("out").Op(":=").Make(ifaces.Clone(), jen.Lit(0), jen.Len(jen.Id("arr"))),
+		jen.Id("seen").Op(":=").Map(jen.String()).Bool().Values(),
+		jen.For(jen.List(jen.Id("_"), jen.Id("v")).Op(":=").Range().Id("arr")).Block(
+			jen.List(jen.Id("key"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("v")),
+			jen.If(jen.Op("!").Id("seen").Index(jen.String().Parens(jen.Id("key")))).Block(
+				jen.Id("seen").Index(jen.String().Parens(jen.Id("key"))).Op("=").True(),
+				jen.Id("out").Op("=").Append(jen.Id("out"), jen.Id("v")),
+			),
+		),
+		jen.Return(jen.Id("out")),
+	)
+	f.Line()
+
+	f.Comment("// _arrayJoin joins the elements of arr with sep, nested objects and arrays")
+	f.Comment("// as JSON text")
+	f.Func().Id("_arrayJoin").Params(jen.Id("arr").Add(ifaces.Clone()), jen.Id("sep").String()).String().Block(
+		jen.Id("parts").Op(":=").Make(jen.Index().String(), jen.Len(jen.Id("arr"))),
+		jen.For(jen.List(jen.Id("i"), jen.Id("v")).Op(":=").Range().Id("arr")).Block(
+			jen.Switch(jen.Id("v").Assert(jen.Type())).Block(
+				jen.Case(jen.Map(jen.String()).Interface(), ifaces.Clone()).Block(
+					jen.List(jen.Id("text"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("v")),
+					jen.Id("parts").Index(jen.Id("i")).Op("=").String().Parens(jen.Id("text")),
+				),
+				jen.Default().Block(
+					jen.Id("parts").Index(jen.Id("i")).Op("=").Id("_toStr").Call(jen.Id("v")),
+				),
+			),
+		),
+		jen.Return(jen.Qual("strings", "Join").Call(jen.Id("parts"), jen.Id("sep"))),
+	)
+	f.Line()
+
+	f.Comment("// _jsonArrayDecode decodes the JSON array text jsonVal, nil if it is not one")
+	f.Func().Id("_jsonArrayDecode").Params(jen.Id("jsonVal").Interface()).Add(ifaces.Clone()).Block(
+		jen.Var().Id("arr").Add(ifaces.Clone()),
+		jen.Id("_jsonDecode").Call(jen.Index().Byte().Parens(jen.Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("jsonVal"))), jen.Op("&").Id("arr")),
+		jen.Return(jen.Id("arr")),
+	)
+	f.Line()
+
+	f.Comment("// _jsonArrayText encodes arr as JSON array text")
+	f.Func().Id("_jsonArrayText").Params(jen.Id("arr").Add(ifaces.Clone())).String().Block(
+		jen.If(jen.Id("arr").Op("==").Nil()).Block(
+			jen.Return(jen.Lit("[]")),
+		),
+		jen.List(jen.Id("result"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("arr")),
+		jen.Return(jen.String().Parens(jen.Id("result"))),
+	)
+	f.Line()
+}
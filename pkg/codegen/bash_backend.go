@@ -10,14 +10,36 @@ import (
 	"time"
 
 	"github.com/chazu/procyon/pkg/ir"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/chazu/procyon/pkg/parser"
 )
 
+// Dialects of shell the Bash backend generates.
+const (
+	DialectBash  = "bash"
+	DialectPOSIX = "posix" // POSIX sh, for dash and busybox ash
+)
+
+// Dialects lists the values BashBackend.Dialect accepts.
+var Dialects = []string{DialectBash, DialectPOSIX}
+
 // BashBackend generates Bash code from Trashtalk IR.
 type BashBackend struct {
+	// Dialect is the shell generated for, DialectBash if empty. POSIX sh
+	// replaces [[ ]], (( )) and echo with test, $(( )) and printf, and
+	// reports in Warnings what it cannot express.
+	Dialect string
+	// Local is set if a POSIX sh target has local, as dash and busybox ash
+	// do. Without it parameters and locals are global variables.
+	Local bool
+
 	prog         *ir.Program
 	buf          strings.Builder
 	indent       int
 	instanceVars map[string]bool // Track instance variable names for accessor generation
+	method       string          // selector of the method being generated
+	warnings     []string
+	warned       map[string]bool
 }
 
 // NewBashBackend creates a new Bash code generator.
@@ -29,9 +51,14 @@ func NewBashBackend() *BashBackend {
 
 // Generate produces Bash source code from a Trashtalk IR Program.
 func (b *BashBackend) Generate(prog *ir.Program) (string, error) {
+	if b.Dialect != "" && b.Dialect != DialectBash && b.Dialect != DialectPOSIX {
+		return "", fmt.Errorf("unknown dialect %q (use %s)", b.Dialect, strings.Join(Dialects, " or "))
+	}
 	b.prog = prog
 	b.buf.Reset()
 	b.indent = 0
+	b.warnings = nil
+	b.warned = map[string]bool{}
 
 	// Build instance var lookup
 	b.instanceVars = make(map[string]bool)
@@ -61,9 +88,42 @@ func (b *BashBackend) Generate(prog *ir.Program) (string, error) {
 	return b.buf.String(), nil
 }
 
+// Warnings returns what the last Generate could not express in its dialect,
+// one line per construct and method.
+func (b *BashBackend) Warnings() []string {
+	return b.warnings
+}
+
+// posix reports whether POSIX sh is generated
+func (b *BashBackend) posix() bool {
+	return b.Dialect == DialectPOSIX
+}
+
+// warn records a degradation once
+func (b *BashBackend) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !b.warned[msg] {
+		b.warned[msg] = true
+		b.warnings = append(b.warnings, msg)
+	}
+}
+
+// echo returns the command writing value and a newline: echo in Bash, and
+// printf in POSIX sh, whose echo expands the backslashes of JSON strings
+func (b *BashBackend) echo(value string) string {
+	if b.posix() {
+		return fmt.Sprintf("printf '%%s\\n' \"%s\"", value)
+	}
+	return fmt.Sprintf("echo \"%s\"", value)
+}
+
 // generateHeader writes the file header
 func (b *BashBackend) generateHeader() {
-	b.writeln("#!/usr/bin/env bash")
+	if b.posix() {
+		b.writeln("#!/bin/sh")
+	} else {
+		b.writeln("#!/usr/bin/env bash")
+	}
 	b.writeln("# Generated by Trashtalk Compiler (procyon) - DO NOT EDIT")
 	b.writef("# Source: %s.trash\n", b.prog.Name)
 	b.writef("# Generated: %s\n", time.Now().Format("2006-01-02T15:04:05"))
@@ -126,7 +186,7 @@ func (b *BashBackend) generateIVarAccessors() {
 		// Getter: __Counter__value()
 		b.writef("__%s__%s() {\n", className, iv.Name)
 		b.indent++
-		b.writef("echo \"$(_ivar %s)\"; return\n", iv.Name)
+		b.writef("%s; return\n", b.echo("$(_ivar "+iv.Name+")"))
 		b.indent--
 		b.writeln("}")
 		b.writeln("")
@@ -143,17 +203,35 @@ func (b *BashBackend) generateIVarAccessors() {
 
 // generateMethod generates a single method
 func (b *BashBackend) generateMethod(m *ir.Method) error {
-	className := b.className()
-	funcName := b.methodFuncName(m)
-
-	b.writef("__%s__%s() {\n", className, funcName)
+	b.method = m.Selector
+	b.writef("%s() {\n", b.methodFuncName(m))
 	b.indent++
 
+	// Parameters and locals are declared local where the shell has it
+	local := "local "
+	if b.posix() && !b.Local {
+		local = ""
+		var names []string
+		for _, v := range append(append([]ir.VarDecl{}, m.Args...), m.Locals...) {
+			names = append(names, v.Name)
+		}
+		switch len(names) {
+		case 0:
+		case 1:
+			b.warn("method %s: without local, %s is a global variable, shared with the methods it sends to", b.method, names[0])
+		default:
+			b.warn("method %s: without local, %s are global variables, shared with the methods it sends to", b.method, strings.Join(names, ", "))
+		}
+	}
+
 	// For raw methods, emit the raw Bash body directly
 	if m.IsRaw && m.RawBody != "" {
+		if b.posix() {
+			b.warn("method %s: the raw method body is copied as written and may need bash", b.method)
+		}
 		// First declare parameters (raw methods still need these)
 		for i, arg := range m.Args {
-			b.writef("local %s=\"$%d\"\n", arg.Name, i+1)
+			b.writef("%s%s=\"$%d\"\n", local, arg.Name, i+1)
 		}
 		// Write each line of the raw body with proper indentation
 		lines := strings.Split(m.RawBody, "\n")
@@ -171,11 +249,11 @@ func (b *BashBackend) generateMethod(m *ir.Method) error {
 
 	// Declare parameters
 	for i, arg := range m.Args {
-		b.writef("local %s=\"$%d\"\n", arg.Name, i+1)
+		b.writef("%s%s=\"$%d\"\n", local, arg.Name, i+1)
 	}
 
 	// Declare local variables
-	if len(m.Locals) > 0 {
+	if len(m.Locals) > 0 && local != "" {
 		var names []string
 		for _, l := range m.Locals {
 			names = append(names, l.Name)
@@ -228,6 +306,19 @@ func (b *BashBackend) generateAssign(s *ir.AssignStmt) error {
 			return err
 		}
 
+		if b.posix() {
+			// POSIX sh has $(( )) but not (( ))
+			switch s.Kind {
+			case ir.AssignIVar:
+				b.writef("_ivar_set %s \"$(( %s ))\"\n", s.Target, arithExpr)
+			case ir.AssignClassVar:
+				b.writef("__%s__%s=$(( %s ))\n", b.className(), s.Target, arithExpr)
+			default:
+				b.writef("%s=$(( %s ))\n", s.Target, arithExpr)
+			}
+			return nil
+		}
+
 		switch s.Kind {
 		case ir.AssignIVar:
 			// For ivars: use temp var pattern to avoid subshell
@@ -274,7 +365,7 @@ func (b *BashBackend) generateReturn(s *ir.ReturnStmt) error {
 		return err
 	}
 
-	b.writef("echo \"%s\"; return\n", exprStr)
+	b.writef("%s; return\n", b.echo(exprStr))
 	return nil
 }
 
@@ -304,16 +395,27 @@ func (b *BashBackend) generateIf(s *ir.IfStmt) error {
 	}
 
 	b.writef("if %s; then\n", condStr)
-	b.indent++
+	if err := b.generateBlock(s.ThenBlock); err != nil {
+		return err
+	}
 
-	for _, stmt := range s.ThenBlock {
-		if err := b.generateStatement(stmt); err != nil {
+	// An else branch that is only another conditional chains as elif
+	for len(s.ElseBlock) == 1 {
+		elseIf, ok := s.ElseBlock[0].(*ir.IfStmt)
+		if !ok {
+			break
+		}
+		s = elseIf
+		condStr, err = b.generateCondition(s.Condition)
+		if err != nil {
+			return err
+		}
+		b.writef("elif %s; then\n", condStr)
+		if err := b.generateBlock(s.ThenBlock); err != nil {
 			return err
 		}
 	}
 
-	b.indent--
-
 	if len(s.ElseBlock) > 0 {
 		b.writeln("else")
 		b.indent++
@@ -329,6 +431,18 @@ func (b *BashBackend) generateIf(s *ir.IfStmt) error {
 	return nil
 }
 
+// generateBlock generates indented statements
+func (b *BashBackend) generateBlock(stmts []ir.Statement) error {
+	b.indent++
+	defer func() { b.indent-- }()
+	for _, stmt := range stmts {
+		if err := b.generateStatement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // generateWhile generates a while loop
 func (b *BashBackend) generateWhile(s *ir.WhileStmt) error {
 	condStr, err := b.generateCondition(s.Condition)
@@ -382,6 +496,17 @@ func (b *BashBackend) generateBashStmt(s *ir.BashStmt) error {
 func (b *BashBackend) generateCondition(expr ir.Expression) (string, error) {
 	switch e := expr.(type) {
 	case *ir.BinaryExpr:
+		if e.Op == "&&" || e.Op == "||" {
+			left, err := b.generateCondition(e.Left)
+			if err != nil {
+				return "", err
+			}
+			right, err := b.generateCondition(e.Right)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("{ %s %s %s; }", left, e.Op, right), nil
+		}
 		left, err := b.generateExpr(e.Left)
 		if err != nil {
 			return "", err
@@ -391,6 +516,10 @@ func (b *BashBackend) generateCondition(expr ir.Expression) (string, error) {
 			return "", err
 		}
 
+		if b.posix() {
+			return posixTest(e.Op, left, right), nil
+		}
+
 		// Map operators to bash test operators
 		switch e.Op {
 		case "==":
@@ -408,6 +537,31 @@ func (b *BashBackend) generateCondition(expr ir.Expression) (string, error) {
 		default:
 			return fmt.Sprintf("[[ %s %s %s ]]", left, e.Op, right), nil
 		}
+	case *ir.BlockExpr:
+		// [condition] whileTrue: [...]
+		if len(e.Params) == 0 && len(e.Body) == 1 {
+			if exprStmt, ok := e.Body[0].(*ir.ExprStmt); ok {
+				return b.generateCondition(exprStmt.Expr)
+			}
+		}
+		exprStr, err := b.generateExpr(expr)
+		if err != nil {
+			return "", err
+		}
+		return b.nonEmpty(exprStr), nil
+	case *ir.UnaryExpr:
+		if e.Op == "!" {
+			operand, err := b.generateCondition(e.Operand)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("! %s", operand), nil
+		}
+		exprStr, err := b.generateExpr(expr)
+		if err != nil {
+			return "", err
+		}
+		return b.nonEmpty(exprStr), nil
 	case *ir.LiteralExpr:
 		// Boolean literal
 		if e.Type_ == ir.TypeBool {
@@ -423,7 +577,42 @@ func (b *BashBackend) generateCondition(expr ir.Expression) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		return fmt.Sprintf("[[ -n \"%s\" ]]", exprStr), nil
+		return b.nonEmpty(exprStr), nil
+	}
+}
+
+// nonEmpty returns the test that value is not empty
+func (b *BashBackend) nonEmpty(value string) string {
+	if b.posix() {
+		return fmt.Sprintf("[ -n \"%s\" ]", value)
+	}
+	return fmt.Sprintf("[[ -n \"%s\" ]]", value)
+}
+
+// posixTest returns the test command comparing left and right with op.
+// Ordering compares integers, as (( )) does in Bash.
+func posixTest(op, left, right string) string {
+	switch op {
+	case "==":
+		return fmt.Sprintf("[ \"%s\" = \"%s\" ]", left, right)
+	case "!=":
+		return fmt.Sprintf("[ \"%s\" != \"%s\" ]", left, right)
+	case "<":
+		return fmt.Sprintf("[ \"%s\" -lt \"%s\" ]", left, right)
+	case ">":
+		return fmt.Sprintf("[ \"%s\" -gt \"%s\" ]", left, right)
+	case "<=":
+		return fmt.Sprintf("[ \"%s\" -le \"%s\" ]", left, right)
+	case ">=":
+		return fmt.Sprintf("[ \"%s\" -ge \"%s\" ]", left, right)
+	}
+	return fmt.Sprintf("[ %s %s %s ]", left, op, right)
+}
+
+// sendWarning reports that sends need the runtime's @ as a command
+func (b *BashBackend) sendWarning() {
+	if b.posix() {
+		b.warn("sends call @, which POSIX sh cannot define as a function: the runtime must provide it as a command")
 	}
 }
 
@@ -438,6 +627,8 @@ func (b *BashBackend) generateExpr(expr ir.Expression) (string, error) {
 		return b.generateBinaryExpr(e)
 	case *ir.UnaryExpr:
 		return b.generateUnaryExpr(e)
+	case *ir.CondExpr:
+		return b.generateCondExpr(e)
 	case *ir.MessageSendExpr:
 		return b.generateMessageSend(e)
 	case *ir.BlockExpr:
@@ -512,7 +703,8 @@ func (b *BashBackend) generateBinaryExpr(e *ir.BinaryExpr) (string, error) {
 		// Comparison in arithmetic context
 		return fmt.Sprintf("$(( %s %s %s ))", left, e.Op, right), nil
 	case "&&", "||":
-		return fmt.Sprintf("%s %s %s", left, e.Op, right), nil
+		// Comparisons expand to 1 or 0, so combine them arithmetically
+		return fmt.Sprintf("$(( %s %s %s ))", left, e.Op, right), nil
 	default:
 		return fmt.Sprintf("%s %s %s", left, e.Op, right), nil
 	}
@@ -527,7 +719,7 @@ func (b *BashBackend) generateUnaryExpr(e *ir.UnaryExpr) (string, error) {
 
 	switch e.Op {
 	case "!":
-		return fmt.Sprintf("! %s", operand), nil
+		return fmt.Sprintf("$(( ! %s ))", operand), nil
 	case "-":
 		return fmt.Sprintf("$(( -%s ))", operand), nil
 	default:
@@ -535,6 +727,24 @@ func (b *BashBackend) generateUnaryExpr(e *ir.UnaryExpr) (string, error) {
 	}
 }
 
+// generateCondExpr generates a conditional used as a value as a subshell
+// that echoes the value of the branch taken
+func (b *BashBackend) generateCondExpr(e *ir.CondExpr) (string, error) {
+	condStr, err := b.generateCondition(e.Condition)
+	if err != nil {
+		return "", err
+	}
+	thenStr, err := b.generateExpr(e.Then)
+	if err != nil {
+		return "", err
+	}
+	elseStr, err := b.generateExpr(e.Else)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$(if %s; then %s; else %s; fi)", condStr, b.echo(thenStr), b.echo(elseStr)), nil
+}
+
 // generateMessageSend generates a message send expression
 func (b *BashBackend) generateMessageSend(e *ir.MessageSendExpr) (string, error) {
 	var receiver string
@@ -555,8 +765,10 @@ func (b *BashBackend) generateMessageSend(e *ir.MessageSendExpr) (string, error)
 		}
 	}
 
+	b.sendWarning()
+
 	// Build selector (replace : with _)
-	selector := selectorToBashName(e.Selector)
+	selector := mangle.Selector(e.Selector)
 
 	// Build args
 	var args []string
@@ -613,6 +825,9 @@ func (b *BashBackend) generateBlockExpr(e *ir.BlockExpr) (string, error) {
 
 // generateSubshell generates a subshell expression
 func (b *BashBackend) generateSubshell(e *ir.SubshellExpr) (string, error) {
+	if b.posix() {
+		b.warn("method %s: a subshell is copied as written and may need bash", b.method)
+	}
 	return fmt.Sprintf("$(%s)", e.Code), nil
 }
 
@@ -622,6 +837,21 @@ func (b *BashBackend) generateJSONPrimitive(e *ir.JSONPrimitiveExpr) (string, er
 	if err != nil {
 		return "", err
 	}
+	code, err := b.generateJSONOperation(e, receiver)
+	if err != nil || !b.posix() {
+		return code, err
+	}
+	// The JSON is piped to jq with printf, which leaves backslashes alone
+	bashPipe := "$(echo \"" + receiver + "\" | "
+	if strings.HasPrefix(code, bashPipe) {
+		code = "$(printf '%s\\n' \"" + receiver + "\" | " + code[len(bashPipe):]
+	}
+	return code, nil
+}
+
+// generateJSONOperation generates a JSON primitive operation on receiver,
+// the generated code of its receiver
+func (b *BashBackend) generateJSONOperation(e *ir.JSONPrimitiveExpr, receiver string) (string, error) {
 
 	switch e.Operation {
 	case "arrayAt":
@@ -638,6 +868,19 @@ func (b *BashBackend) generateJSONPrimitive(e *ir.JSONPrimitiveExpr) (string, er
 		if len(e.Args) < 1 {
 			return "", fmt.Errorf("arrayPush requires value argument")
 		}
+		if len(e.Args) > 1 {
+			// A chain of pushes coalesced by ir.Optimize
+			var flags, vars []string
+			for i, arg := range e.Args {
+				val, err := b.generateExpr(arg)
+				if err != nil {
+					return "", err
+				}
+				flags = append(flags, fmt.Sprintf("--arg v%d \"%s\"", i, val))
+				vars = append(vars, fmt.Sprintf("$v%d", i))
+			}
+			return fmt.Sprintf("$(echo \"%s\" | jq -c %s '. + [%s]')", receiver, strings.Join(flags, " "), strings.Join(vars, ", ")), nil
+		}
 		val, err := b.generateExpr(e.Args[0])
 		if err != nil {
 			return "", err
@@ -701,6 +944,52 @@ func (b *BashBackend) generateJSONPrimitive(e *ir.JSONPrimitiveExpr) (string, er
 		}
 		return fmt.Sprintf("$(echo \"%s\" | jq -c --arg k \"%s\" --arg v \"%s\" '. + {($k): $v}')", receiver, key, val), nil
 
+	case "arraySort":
+		return fmt.Sprintf("$(echo \"%s\" | jq -c 'sort_by(tostring)')", receiver), nil
+
+	case "arraySortNumeric":
+		return fmt.Sprintf("$(echo \"%s\" | jq -c 'sort_by((tonumber? // null) as $n | [$n == null, $n, tostring])')", receiver), nil
+
+	case "arrayReverse":
+		return fmt.Sprintf("$(echo \"%s\" | jq -c 'reverse')", receiver), nil
+
+	case "arrayUnique":
+		return fmt.Sprintf("$(echo \"%s\" | jq -c 'reduce .[] as $x ([]; if index([$x]) then . else . + [$x] end)')", receiver), nil
+
+	case "arrayJoin":
+		if len(e.Args) < 1 {
+			return "", fmt.Errorf("arrayJoin requires separator argument")
+		}
+		sep, err := b.generateExpr(e.Args[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$(echo \"%s\" | jq -r --arg s \"%s\" 'map(if type == \"object\" or type == \"array\" then tojson else tostring end) | join($s)')", receiver, sep), nil
+
+	case "jsonAtPath":
+		if len(e.Args) < 1 {
+			return "", fmt.Errorf("jsonAtPath requires path argument")
+		}
+		path, err := b.generateExpr(e.Args[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$(echo \"%s\" | jq -r --arg p \"%s\" 'getpath(%s) | if type == \"object\" or type == \"array\" then tojson else . // empty end')", receiver, path, jqPathSteps), nil
+
+	case "jsonSetPathPut":
+		if len(e.Args) < 2 {
+			return "", fmt.Errorf("jsonSetPathPut requires path and value arguments")
+		}
+		path, err := b.generateExpr(e.Args[0])
+		if err != nil {
+			return "", err
+		}
+		val, err := b.generateExpr(e.Args[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("$(echo \"%s\" | jq -c --arg p \"%s\" --arg v \"%s\" 'setpath(%s; if ($v | test(\"^\\\\s*[{\\\\[]\")) then ($v | fromjson? // $v) else $v end)')", receiver, path, val, jqPathSteps), nil
+
 	case "arrayIsEmpty":
 		return fmt.Sprintf("$(echo \"%s\" | jq 'length == 0')", receiver), nil
 
@@ -736,14 +1025,42 @@ func (b *BashBackend) generateJSONPrimitive(e *ir.JSONPrimitiveExpr) (string, er
 		}
 		return fmt.Sprintf("$(echo \"%s\" | jq -c --arg k \"%s\" 'del(.[$k])')", receiver, key), nil
 
+	case "objectMerge", "objectDeepMerge", "objectEquals":
+		if len(e.Args) < 1 {
+			return "", fmt.Errorf("%s requires object argument", e.Operation)
+		}
+		other, err := b.generateExpr(e.Args[0])
+		if err != nil {
+			return "", err
+		}
+		filter := map[string]string{
+			"objectMerge":     ". + $o",
+			"objectDeepMerge": ". * $o",
+			"objectEquals":    ". == $o",
+		}[e.Operation]
+		return fmt.Sprintf("$(echo \"%s\" | jq -c --argjson o \"%s\" '%s')", receiver, other, filter), nil
+
 	default:
 		return "", fmt.Errorf("unsupported JSON operation: %s", e.Operation)
 	}
 }
 
+// jqPathSteps is the jq expression splitting $p, a path like
+// user.addresses[0].city, into the steps getpath and setpath take
+const jqPathSteps = `[$p | scan("[^.\\[\\]]+|\\[[0-9]+\\]") | if startswith("[") then .[1:-1] | tonumber else . end]`
+
 // generateClassPrimitive generates Bash code for class primitive operations
 // by falling back to message sends to the Bash runtime
 func (b *BashBackend) generateClassPrimitive(e *ir.ClassPrimitiveExpr) (string, error) {
+	// $HOME is read by Bash itself
+	if e.Operation == "envGet" && len(e.Args) == 1 {
+		if lit, ok := e.Args[0].(*ir.LiteralExpr); ok {
+			if name, ok := parser.EnvVariableName(fmt.Sprintf("$%v", lit.Value)); ok {
+				return "${" + name + "}", nil
+			}
+		}
+	}
+
 	// Map operation names back to selectors
 	var selector string
 	switch e.Operation {
@@ -814,9 +1131,43 @@ func (b *BashBackend) generateClassPrimitive(e *ir.ClassPrimitiveExpr) (string,
 		selector = "isOlder:than:"
 	case "fileIsSame":
 		selector = "isSame:as:"
+	case "fileReadAll":
+		selector = "readAll:"
+	case "fileWriteContents":
+		selector = "writeContents:to:"
+	case "fileAppend":
+		selector = "append:to:"
+	case "fileDelete":
+		selector = "delete:"
+	case "fileCopy":
+		selector = "copy:to:"
+	case "fileListDirectory":
+		selector = "listDirectory:"
+	case "fileMkdirp":
+		selector = "mkdirp:"
+
+	// Locale operations
+	case "localeFormatNumber":
+		selector = "formatNumber:"
+	case "localeFormatNumberDecimals":
+		selector = "formatNumber:decimals:"
+	case "localeFormatDate":
+		selector = "formatDate:"
+	case "localeFormatDatePattern":
+		selector = "formatDate:pattern:"
 
 	default:
-		return "", fmt.Errorf("unsupported class primitive operation: %s", e.Operation)
+		sel, ok := httpClientSelector(e.Operation)
+		if !ok {
+			sel, ok = shellSelector(e.Operation)
+		}
+		if !ok {
+			sel, ok = envSelector(e.Operation)
+		}
+		if !ok {
+			return "", fmt.Errorf("unsupported class primitive operation: %s", e.Operation)
+		}
+		selector = sel
 	}
 
 	// Generate args
@@ -830,7 +1181,8 @@ func (b *BashBackend) generateClassPrimitive(e *ir.ClassPrimitiveExpr) (string,
 	}
 
 	// Generate message send: $(@ ClassName selector args...)
-	bashSelector := selectorToBashName(selector)
+	b.sendWarning()
+	bashSelector := mangle.Selector(selector)
 	if len(args) > 0 {
 		return fmt.Sprintf("$(@ %s %s %s)", e.ClassName, bashSelector, strings.Join(args, " ")), nil
 	}
@@ -841,25 +1193,12 @@ func (b *BashBackend) generateClassPrimitive(e *ir.ClassPrimitiveExpr) (string,
 
 // className returns the class name for function naming
 func (b *BashBackend) className() string {
-	if b.prog.Package != "" {
-		return b.prog.Package + "__" + b.prog.Name
-	}
-	return b.prog.Name
+	return mangle.CompiledClass(mangle.Qualify(b.prog.Package, b.prog.Name))
 }
 
-// methodFuncName converts a method to its Bash function name suffix
+// methodFuncName returns the name of a method's Bash function
 func (b *BashBackend) methodFuncName(m *ir.Method) string {
-	selector := selectorToBashName(m.Selector)
-
-	if m.Kind == ir.ClassMethod {
-		return "class__" + selector
-	}
-	return selector
-}
-
-// selectorToBashName converts a selector like "at:put:" to "at_put_"
-func selectorToBashName(selector string) string {
-	return strings.ReplaceAll(selector, ":", "_")
+	return mangle.BashFunction(b.className(), m.Selector, m.Kind == ir.ClassMethod)
 }
 
 // formatInstanceVars formats instance variables for metadata
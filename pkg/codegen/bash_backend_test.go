@@ -1,6 +1,7 @@
 package codegen_test
 
 import (
+	"os/exec"
 	"strings"
 	"testing"
 
@@ -2388,6 +2389,101 @@ func TestBashBackend_ClassPrimitive_FileIsNewer(t *testing.T) {
 	}
 }
 
+// posixProgram exercises the constructs the posix dialect rewrites
+func posixProgram() *ir.Program {
+	count := func() *ir.VarRefExpr { return &ir.VarRefExpr{Name: "count", Kind: ir.VarIVar, Type_: ir.TypeInt} }
+	return &ir.Program{
+		Name:         "Counter",
+		Parent:       "Object",
+		InstanceVars: []ir.VarDecl{{Name: "count", IsIVar: true}, {Name: "items", IsIVar: true}},
+		Methods: []ir.Method{
+			{
+				Selector: "bump_",
+				Kind:     ir.InstanceMethod,
+				Args:     []ir.VarDecl{{Name: "n", IsParam: true}},
+				Locals:   []ir.VarDecl{{Name: "t", IsLocal: true}},
+				Body: []ir.Statement{
+					&ir.AssignStmt{Target: "t", Kind: ir.AssignLocal, Value: &ir.BinaryExpr{
+						Left: &ir.VarRefExpr{Name: "n", Kind: ir.VarParam}, Op: "+", Right: &ir.LiteralExpr{Value: 1, Type_: ir.TypeInt}, Type_: ir.TypeInt,
+					}},
+					&ir.AssignStmt{Target: "count", Kind: ir.AssignIVar, Value: &ir.BinaryExpr{
+						Left: count(), Op: "+", Right: &ir.VarRefExpr{Name: "t", Kind: ir.VarLocal}, Type_: ir.TypeInt,
+					}},
+					&ir.IfStmt{
+						Condition: &ir.BinaryExpr{Left: count(), Op: ">", Right: &ir.LiteralExpr{Value: 10, Type_: ir.TypeInt}},
+						ThenBlock: []ir.Statement{&ir.AssignStmt{Target: "count", Kind: ir.AssignIVar, Value: &ir.LiteralExpr{Value: 0, Type_: ir.TypeInt}}},
+					},
+					&ir.AssignStmt{Target: "items", Kind: ir.AssignIVar, Value: &ir.JSONPrimitiveExpr{
+						Receiver: &ir.VarRefExpr{Name: "items", Kind: ir.VarIVar}, Operation: "arrayPush", Args: []ir.Expression{count()},
+					}},
+					&ir.ExprStmt{Expr: &ir.MessageSendExpr{Receiver: &ir.SelfExpr{}, Selector: "changed", IsSelfSend: true}},
+					&ir.ReturnStmt{Value: count()},
+				},
+			},
+		},
+	}
+}
+
+func TestBashBackend_PosixDialect(t *testing.T) {
+	backend := codegen.NewBashBackend()
+	backend.Dialect = codegen.DialectPOSIX
+	result, err := backend.Generate(posixProgram())
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+
+	if !strings.HasPrefix(result, "#!/bin/sh\n") {
+		t.Errorf("Expected a #!/bin/sh header, got:\n%s", result)
+	}
+	for _, bashism := range []string{"[[", "if ((", "while ((", "local ", "echo \""} {
+		if strings.Contains(result, bashism) {
+			t.Errorf("Output contains %q:\n%s", bashism, result)
+		}
+	}
+	assertContainsLine(t, result, `t=$(( ($n + 1) ))`)
+	assertContainsLine(t, result, `_ivar_set count "$(( ($(_ivar count) + $t) ))"`)
+	assertContainsLine(t, result, `if [ "$(_ivar count)" -gt "10" ]; then`)
+	assertContainsLine(t, result, `$(printf '%s\n' "$(_ivar items)" | jq -c`)
+	assertContainsLine(t, result, `printf '%s\n' "$(_ivar count)"`)
+
+	warnings := strings.Join(backend.Warnings(), "\n")
+	for _, want := range []string{"method bump_: without local, n, t are global", "sends call @"} {
+		if !strings.Contains(warnings, want) {
+			t.Errorf("Warnings do not mention %q:\n%s", want, warnings)
+		}
+	}
+
+	if path, err := exec.LookPath("dash"); err == nil {
+		cmd := exec.Command(path, "-n")
+		cmd.Stdin = strings.NewReader(result)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("dash -n: %v\n%s", err, out)
+		}
+	}
+}
+
+func TestBashBackend_PosixLocal(t *testing.T) {
+	backend := codegen.NewBashBackend()
+	backend.Dialect = codegen.DialectPOSIX
+	backend.Local = true
+	result, err := backend.Generate(posixProgram())
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	assertContainsLine(t, result, `local n="$1"`)
+	assertContainsLine(t, result, "local t")
+	for _, w := range backend.Warnings() {
+		if strings.Contains(w, "without local") {
+			t.Errorf("Unexpected warning with Local: %s", w)
+		}
+	}
+
+	backend.Dialect = "zsh"
+	if _, err := backend.Generate(posixProgram()); err == nil {
+		t.Error("Expected an error for an unknown dialect")
+	}
+}
+
 // =============================================================================
 // HELPER FUNCTIONS FOR TESTS
 // =============================================================================
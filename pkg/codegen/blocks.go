@@ -0,0 +1,177 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains block literals compiled to Go closures.
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// A local that is only ever assigned block literals, all taking the same
+// number of parameters, holds a compiled block. It is declared as a Go func
+// and each literal becomes a closure, so @ b value, @ b valueWith: x and
+// items collect: b call it directly. Blocks that arrive as arguments or
+// instance variables are Block instances in the Bash runtime and still go
+// through invokeBlock.
+
+// findBlockVars returns the locals of body holding compiled blocks, mapped to
+// their arity. A reason is returned if a block literal assigned to a local
+// contains ^, which a closure cannot return from the method with.
+func findBlockVars(body *parser.MethodBody) (map[string]int, string) {
+	locals := make(map[string]bool)
+	for _, v := range body.LocalVars {
+		locals[v] = true
+	}
+
+	arity := make(map[string]int) // -1: also assigned something else
+	reason := ""
+	var walk func(stmts []parser.Statement)
+	walk = func(stmts []parser.Statement) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *parser.Assignment:
+				if !locals[s.Target] {
+					continue
+				}
+				block, ok := s.Value.(*parser.BlockExpr)
+				if !ok {
+					arity[s.Target] = -1
+					continue
+				}
+				if hasReturnInStatements(block.Statements) && reason == "" {
+					reason = "non-local return (^) from a block"
+				}
+				if n, seen := arity[s.Target]; seen && n != len(block.Params) {
+					arity[s.Target] = -1
+				} else if !seen {
+					arity[s.Target] = len(block.Params)
+				}
+				walk(block.Statements)
+			case *parser.IfExpr:
+				walk(s.TrueBlock)
+				walk(s.FalseBlock)
+			case *parser.WhileExpr:
+				walk(s.Body)
+			case *parser.CountedLoopExpr:
+				walk(s.Body)
+			case *parser.IfNilExpr:
+				walk(s.NilBlock)
+				walk(s.NotNilBlock)
+			case *parser.IterationExpr:
+				walk(s.Body)
+				walk(s.IfNone)
+			case *parser.DynamicIterationExpr:
+				walk(s.IfNone)
+			}
+		}
+	}
+	walk(body.Statements)
+
+	blockVars := make(map[string]int)
+	for name, n := range arity {
+		if n >= 0 {
+			blockVars[name] = n
+		}
+	}
+	return blockVars, reason
+}
+
+// blockFuncType is the Go type of a compiled block taking arity arguments
+func blockFuncType(arity int) *jen.Statement {
+	params := make([]jen.Code, arity)
+	for i := range params {
+		params[i] = jen.Interface()
+	}
+	return jen.Func().Params(params...).Interface()
+}
+
+// generateBlockClosure generates a block literal as a Go closure returning
+// the value of its last expression
+func (g *generator) generateBlockClosure(b *parser.BlockExpr, m *compiledMethod) *jen.Statement {
+	params := make([]jen.Code, len(b.Params))
+	for i, p := range b.Params {
+		params[i] = jen.Id(p).Interface()
+	}
+	return jen.Func().Params(params...).Interface().Block(g.generateValueBranch(b.Statements, m)...)
+}
+
+// blockVar returns the Go name and arity of a local holding a compiled block
+func (m *compiledMethod) blockVar(expr parser.Expr) (string, int, bool) {
+	ident, ok := expr.(*parser.Identifier)
+	if !ok {
+		return "", 0, false
+	}
+	arity, ok := m.blockVars[ident.Name]
+	if !ok {
+		return "", 0, false
+	}
+	if renamed, ok := m.renamedVars[ident.Name]; ok {
+		return renamed, arity, true
+	}
+	return ident.Name, arity, true
+}
+
+// callBlock calls a compiled block. Missing arguments are empty, extra ones
+// are dropped, as when the Bash runtime evaluates the block.
+func callBlock(name string, arity int, args []jen.Code) *jen.Statement {
+	call := make([]jen.Code, arity)
+	for i := range call {
+		if i < len(args) {
+			call[i] = args[i]
+		} else {
+			call[i] = jen.Lit("")
+		}
+	}
+	return jen.Id(name).Call(call...)
+}
+
+// generateBlockIteration generates do:, collect:, select:, reject:,
+// inject:into:, detect:, anySatisfy: or allSatisfy: over a compiled block held
+// in a local
+func (g *generator) generateBlockIteration(s *parser.DynamicIterationExpr, name string, arity int, m *compiledMethod) []jen.Code {
+	var code []jen.Code
+	items := g.generateExpr(s.Collection, m)
+	if !g.exprResultsInArray(s.Collection, m) {
+		// JSON string: unmarshal first. Ivars are already strings or
+		// json.RawMessage; locals may hold anything.
+		if id, ok := s.Collection.(*parser.Identifier); !ok || !g.instanceVars[id.Name] || g.typedIvar(id.Name, m) != "" {
+			items = jen.Id("_toStr").Call(items)
+		}
+		code = append(code,
+			jen.Var().Id("_items").Index().Interface(),
+			jen.Id("_jsonDecode").Call(jen.Index().Byte().Parens(items), jen.Op("&").Id("_items")),
+		)
+		items = jen.Id("_items")
+	}
+
+	call := callBlock(name, arity, []jen.Code{jen.Id("_elem")})
+	var body jen.Code
+	switch s.Kind {
+	case "do":
+		body = call
+	case "collect":
+		code = append(code, jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)))
+		body = jen.Id("_results").Op("=").Append(jen.Id("_results"), call)
+	case "select":
+		code = append(code, jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)))
+		body = jen.If(jen.Id("toBool").Call(call)).Block(
+			jen.Id("_results").Op("=").Append(jen.Id("_results"), jen.Id("_elem")),
+		)
+	case "reject":
+		code = append(code, jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)))
+		body = jen.If(jen.Op("!").Id("toBool").Call(call)).Block(
+			jen.Id("_results").Op("=").Append(jen.Id("_results"), jen.Id("_elem")),
+		)
+	case "inject":
+		code = append(code, jen.Var().Id("_acc").Interface().Op("=").Add(g.generateExpr(s.Initial, m)))
+		body = jen.Id("_acc").Op("=").Add(callBlock(name, arity, []jen.Code{jen.Id("_acc"), jen.Id("_elem")}))
+	case "detect", "anySatisfy", "allSatisfy":
+		initValue, onMatch, ifNone := g.predicateIteration(s.Kind, jen.Id("toBool").Call(call), jen.Id("_elem"), s.IfNone, m)
+		code = append(code, initValue...)
+		code = append(code, jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Add(items)).Block(onMatch))
+		return append(code, ifNone...)
+	default:
+		return []jen.Code{jen.Comment("unknown dynamic iteration kind: " + s.Kind)}
+	}
+	return append(code, jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Add(items)).Block(body))
+}
@@ -0,0 +1,276 @@
+package codegen_test
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/protocol"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// embedPattern matches the class sources generated code embeds
+var embedPattern = regexp.MustCompile(`(?m)^//go:embed (\S+)$`)
+
+// buildGenerated vets and builds code as a main package in a module of its
+// own, which requires what the repo's go.mod does, and returns the path of
+// the binary. Embedded class sources are written as placeholders. env is
+// added to the environment of the go tool, such as GOOS=wasip1 GOARCH=wasm
+// for WASM modules.
+func buildGenerated(t testing.TB, code string, env ...string) string {
+	t.Helper()
+	dir := generatedModule(t, code)
+	bin := filepath.Join(dir, "class.native")
+	for _, args := range [][]string{{"vet", "."}, {"build", "-o", bin, "."}} {
+		goCommand(t, dir, env, args...)
+	}
+	return bin
+}
+
+// testGenerated runs testCode, the source of a test file in package main,
+// against code on the instances database dbPath
+func testGenerated(t *testing.T, code, testCode, dbPath string) {
+	t.Helper()
+	dir := generatedModule(t, code)
+	if err := os.WriteFile(filepath.Join(dir, "main_test.go"), []byte(testCode), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	goCommand(t, dir, []string{"SQLITE_JSON_DB=" + dbPath}, "test", ".")
+}
+
+// benchGenerated runs the benchmarks in benchCode, the source of a test file
+// in package main, against code and returns the output of go test
+func benchGenerated(b *testing.B, code, benchCode string) string {
+	b.Helper()
+	dir := generatedModule(b, code)
+	if err := os.WriteFile(filepath.Join(dir, "main_test.go"), []byte(benchCode), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return goCommand(b, dir, nil, "test", "-run", "^$", "-bench", ".", ".")
+}
+
+// generatedModule writes code as the main package of a module of its own,
+// for buildGenerated, testGenerated and benchGenerated, and returns its
+// directory
+func generatedModule(t testing.TB, code string) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds generated code")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"go.mod", "go.sum"} {
+		data, err := os.ReadFile(filepath.Join("../..", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "go.mod" {
+			data = bytes.Replace(data, []byte("module github.com/chazu/procyon"), []byte("module generated"), 1)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{"main.go": code}
+	for _, m := range embedPattern.FindAllStringSubmatch(code, -1) {
+		files[m[1]] = "\n"
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// goCommand runs the go tool with args in dir, adding env to its
+// environment, and returns its output. It fails the test if the tool fails.
+func goCommand(t testing.TB, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// newInstancesDB creates an instances database for generated binaries and
+// returns its path
+func newInstancesDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "instances.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE instances (id TEXT PRIMARY KEY, data JSON NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runGenerated runs bin on the instances database dbPath and returns its
+// trimmed output and exit code
+func runGenerated(t *testing.T, bin, dbPath string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(bin, args...)
+	cmd.Env = append(os.Environ(), "SQLITE_JSON_DB="+dbPath)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return strings.TrimSpace(string(out)), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out)), 0
+}
+
+// serveGenerated sends requests, one JSON object each, to bin --serve on the
+// instances database dbPath and returns its responses
+func serveGenerated(t *testing.T, bin, dbPath string, requests ...string) []serveResponse {
+	t.Helper()
+	cmd := exec.Command(bin, "--serve")
+	cmd.Env = append(os.Environ(), "SQLITE_JSON_DB="+dbPath)
+	cmd.Stdin = strings.NewReader(strings.Join(requests, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("--serve: %v", err)
+	}
+	var responses []serveResponse
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var resp serveResponse
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatalf("--serve answered %q: %v", out, err)
+		}
+		responses = append(responses, resp)
+	}
+	if len(responses) != len(requests) {
+		t.Fatalf("--serve answered %d responses to %d requests: %s", len(responses), len(requests), out)
+	}
+	return responses
+}
+
+// serveResponse is a response of a generated --serve loop
+type serveResponse struct {
+	Instance string `json:"instance"`
+	Result   string `json:"result"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error"`
+}
+
+// execSQL runs statements on the instances database dbPath
+func execSQL(t *testing.T, dbPath string, stmts ...string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+// fakeDaemon listens on a Unix socket like trashtalk-daemon --socket,
+// answering each request with handle, and returns the socket's path
+func fakeDaemon(t *testing.T, handle func(protocol.Request) protocol.Response) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var req protocol.Request
+			line, err := bufio.NewReader(conn).ReadBytes('\n')
+			resp := protocol.Response{ExitCode: protocol.ExitError, Error: "bad request"}
+			if err == nil && json.Unmarshal(line, &req) == nil {
+				resp = handle(req)
+			}
+			out, _ := json.Marshal(resp)
+			conn.Write(append(out, '\n'))
+			conn.Close()
+		}
+	}()
+	return path
+}
+
+// mustRun runs bin like runGenerated and fails the test unless it exits 0
+func mustRun(t *testing.T, bin, dbPath string, args ...string) string {
+	t.Helper()
+	out, code := runGenerated(t, bin, dbPath, args...)
+	if code != 0 {
+		t.Fatalf("%s exited %d: %s", strings.Join(args, " "), code, out)
+	}
+	return out
+}
+
+// storeInstance saves the JSON data as the instance id, the way an older
+// binary or the Bash runtime would have
+func storeInstance(t *testing.T, dbPath, id, data string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("INSERT INTO instances (id, data) VALUES (?, json(?))", id, data); err != nil {
+		t.Fatalf("store %s: %v", id, err)
+	}
+}
+
+// hasInstance answers whether the instance id is stored
+func hasInstance(t *testing.T, dbPath, id string) bool {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM instances WHERE id = ?", id).Scan(&n); err != nil {
+		t.Fatalf("count %s: %v", id, err)
+	}
+	return n > 0
+}
+
+// storedData answers the stored JSON of the instance id
+func storedData(t *testing.T, dbPath, id string) string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var data string
+	if err := db.QueryRow("SELECT data FROM instances WHERE id = ?", id).Scan(&data); err != nil {
+		t.Fatalf("load %s: %v", id, err)
+	}
+	return data
+}
@@ -0,0 +1,441 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains bundle mode generation: one binary hosting many classes.
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/dave/jennifer/jen"
+)
+
+// GenerateBundle produces Go source code for a single "fat" binary that hosts
+// every class in classes. Class-independent helpers (openDB, sendMessage, the
+// JSON helpers) are emitted once; per-class functions are prefixed with the
+// class's compiled name, which also names its struct type, and registered in
+// a top-level class table.
+//
+// The binary is invoked like a per-class binary (<receiver> <selector> [args])
+// and resolves instance receivers to their class via the class field stored in
+// the instances table. Each class source is embedded as <CompiledName>.trash.
+func GenerateBundle(classes []*ast.Class) *Result {
+	f := jen.NewFile("main")
+	result := &Result{Warnings: []string{}, SkippedMethods: []SkippedMethod{}}
+
+	// Go names are keyed on the compiled name, so classes of the same name
+	// in different packages are both bundled
+	var gens []*generator
+	seen := map[string]bool{}
+	for _, class := range classes {
+		if seen[class.CompiledName()] {
+			result.Warnings = append(result.Warnings,
+				fmt.Sprintf("duplicate class %s in bundle, skipping it", class.QualifiedName()))
+			continue
+		}
+		seen[class.CompiledName()] = true
+		g := newGenerator(class)
+		g.prefix = class.CompiledName() + "_"
+		g.ignoreIndexes()
+		g.ignoreSchemaMigration()
+		gens = append(gens, g)
+	}
+	// sendMessage is shared, and signals a receiver's error in whichever class
+	// sent the message, so each class recovers errors if one uses exceptions
+	exceptions := false
+	for _, g := range gens {
+		exceptions = exceptions || g.exceptions
+	}
+	for _, g := range gens {
+		g.exceptions = exceptions
+	}
+
+	f.Anon("embed")
+	f.Anon("github.com/mattn/go-sqlite3")
+	for _, g := range gens {
+		if g.grpc {
+			f.Anon("google.golang.org/grpc")
+			break
+		}
+	}
+
+	// Per-class embedded sources
+	for _, g := range gens {
+		f.Comment("//go:embed " + g.class.CompiledName() + ".trash")
+		f.Var().Id(g.fn("sourceCode")).String()
+		f.Line()
+	}
+
+	f.Var().Id("ErrUnknownSelector").Op("=").Qual("errors", "New").Call(jen.Lit("unknown selector"))
+	f.Line()
+	generateConflictDecls(f)
+
+	g0 := &generator{class: &ast.Class{}}
+	if len(gens) > 0 {
+		g0 = gens[0]
+	}
+
+	// Shared helpers, emitted once
+	g0.generateOpenDB(f)
+	g0.generateInstanceIDHelper(f)
+	g0.generateDeleteInstance(f)
+	g0.generateSendMessage(f)
+	for _, g := range gens {
+		if len(g.refVars()) > 0 {
+			g.generateSendRef(f)
+			break
+		}
+	}
+	g0.generateJSONHelpers(f)
+	for _, g := range gens {
+		if g.jsonPaths {
+			g.generateJSONPathHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.arrayOps {
+			g.generateArrayOpHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.objectOps {
+			g.generateObjectOpHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.hasTypedJSON() {
+			g.generateTypedIvarHelpers(f)
+			break
+		}
+	}
+	g0.generateStringFileHelpers(f)
+	for _, g := range gens {
+		if g.fileOps {
+			g.generateFileOpHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.httpClient {
+			g.generateHttpClientHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.shell {
+			g.generateShellHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.env {
+			g.generateEnvHelpers(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		if g.localeFormat {
+			g.generateLocaleHelpers(f)
+			break
+		}
+	}
+	// The gRPC helpers are methods, so each client class gets its own
+	for _, g := range gens {
+		if g.grpc {
+			g.generateGrpcHelpers(f)
+		}
+	}
+	for _, g := range gens {
+		if g.hasClassQueries() || g.hasEnvironmentQueries() {
+			g.generateQueryIDs(f)
+			break
+		}
+	}
+	for _, g := range gens {
+		g.generateEnvironmentQueryHelpers(f)
+	}
+	g0.generateTypeHelpers(f)
+	f.Line()
+	if exceptions {
+		generateExceptionHelpers(f)
+	}
+	for _, g := range gens {
+		if g.typedArgs {
+			g.generateArgTypeHelpers(f)
+			break
+		}
+	}
+
+	g0.generateBundleTable(f, gens)
+	generateBundleMain(f, exceptions)
+
+	// Per-class code
+	for _, g := range gens {
+		g.generateStruct(f)
+		f.Line()
+		g.generateLoadSave(f)
+		g.generateCreateInstance(f)
+		g.generateRefMethods(f)
+
+		g.preIdentifySkippedMethods()
+		compiled := g.compileMethods()
+
+		var instanceMethods, classMethods []*compiledMethod
+		for _, m := range compiled {
+			if m.isClass {
+				classMethods = append(classMethods, m)
+			} else {
+				instanceMethods = append(instanceMethods, m)
+			}
+		}
+
+		g.generateDispatch(f, instanceMethods)
+		f.Line()
+		g.generateClassDispatch(f, classMethods)
+		f.Line()
+		g.generateBundleInstanceDispatch(f)
+		f.Line()
+
+		for _, m := range compiled {
+			g.generateMethod(f, m)
+		}
+		g.generateMigrations(f)
+		g.generateClassVars(f)
+		g.generateJSONConstVars(f)
+
+		result.Warnings = append(result.Warnings, prefixAll(g.class.QualifiedName()+": ", g.warnings)...)
+		for _, s := range g.skipped {
+			s.Selector = g.class.QualifiedName() + "." + s.Selector
+			result.SkippedMethods = append(result.SkippedMethods, s)
+		}
+		for _, e := range g.errors {
+			e.Message = g.class.QualifiedName() + ": " + e.Message
+			result.Errors = append(result.Errors, e)
+		}
+	}
+	for _, g := range gens {
+		if len(g.jsonConsts) > 0 {
+			generateJSONCopyHelper(f)
+			break
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := f.Render(buf); err != nil {
+		result.Code = fmt.Sprintf("// Error rendering: %v", err)
+		return result
+	}
+	result.Code = buf.String()
+	return result
+}
+
+func prefixAll(prefix string, items []string) []string {
+	out := make([]string, len(items))
+	for i, s := range items {
+		out[i] = prefix + s
+	}
+	return out
+}
+
+// generateBundleInstanceDispatch generates <Prefix>dispatchInstance, which
+// loads an instance, dispatches the selector, and deletes it or saves it if
+// an instance variable changed. A save that conflicts with another process
+// answers ErrConflict.
+func (g *generator) generateBundleInstanceDispatch(f *jen.File) {
+	f.Func().Id(g.fn("dispatchInstance")).Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("id").String(),
+		jen.Id("selector").String(),
+		jen.Id("args").Index().String(),
+	).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.List(jen.Id("instance"), jen.Err()).Op(":=").Id(g.fn("loadInstance")).Call(jen.Id("db"), jen.Id("id")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatch")).Call(jen.Id("instance"), jen.Id("id"), jen.Id("selector"), jen.Id("args")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.If(jen.Id("selector").Op("==").Lit("delete")).Block(
+			jen.Return(jen.Id("result"), jen.Id("deleteInstance").Call(jen.Id("db"), jen.Id("id"))),
+		),
+		jen.If(jen.Op("!").Id("instance").Dot("dirty")).Block(
+			jen.Return(jen.Id("result"), jen.Nil()),
+		),
+		jen.Return(jen.Id("result"), jen.Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance"))),
+	)
+}
+
+// generateBundleTable generates the _bundleClass type and the _classes table,
+// keyed by both bare and qualified class names.
+func (g *generator) generateBundleTable(f *jen.File, gens []*generator) {
+	f.Comment("// _bundleClass holds the entry points for one class in the bundle")
+	f.Type().Id("_bundleClass").Struct(
+		jen.Id("name").String(),
+		jen.Id("source").Op("*").String(),
+		jen.Id("dispatchClass").Func().Params(jen.String(), jen.Index().String()).Parens(jen.List(jen.String(), jen.Error())),
+		jen.Id("dispatchInstance").Func().Params(jen.Op("*").Qual("database/sql", "DB"), jen.String(), jen.String(), jen.Index().String()).Parens(jen.List(jen.String(), jen.Error())),
+	)
+	f.Line()
+
+	entries := jen.Dict{}
+	var keys []string
+	byKey := map[string]*generator{}
+	// Qualified names first, so a bare name shared by classes of different
+	// packages never hides a class's own qualified name
+	for _, qualified := range []bool{true, false} {
+		for _, cg := range gens {
+			key := cg.class.Name
+			if qualified {
+				key = cg.class.QualifiedName()
+			}
+			if _, ok := byKey[key]; !ok {
+				byKey[key] = cg
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cg := byKey[key]
+		entries[jen.Lit(key)] = jen.Values(jen.Dict{
+			jen.Id("name"):             jen.Lit(cg.class.QualifiedName()),
+			jen.Id("source"):           jen.Op("&").Id(cg.fn("sourceCode")),
+			jen.Id("dispatchClass"):    jen.Id(cg.fn("dispatchClass")),
+			jen.Id("dispatchInstance"): jen.Id(cg.fn("dispatchInstance")),
+		})
+	}
+	f.Var().Id("_classes").Op("=").Map(jen.String()).Op("*").Id("_bundleClass").Values(entries)
+	f.Line()
+}
+
+// generateBundleMain generates main() for bundle mode. With exceptions, an
+// unhandled _throw exits with trashErrorExitCode; a database that stayed
+// locked exits with storageBusyExitCode.
+func generateBundleMain(f *jen.File, exceptions bool) {
+	trashErrorExit := jen.Null()
+	if exceptions {
+		trashErrorExit = exitOnTrashError()
+	}
+	exitOnErr := jen.If(jen.Err().Op("!=").Nil()).Block(
+		jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+			jen.Qual("os", "Exit").Call(jen.Lit(200)),
+		),
+		trashErrorExit,
+		storageBusyExit(),
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
+		jen.Qual("os", "Exit").Call(jen.Lit(1)),
+	)
+
+	f.Func().Id("main").Params().Block(
+		jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(2)).Block(
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("Usage: bundle <receiver> <selector> [args...]")),
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       bundle --classes")),
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       bundle --source <Class>")),
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       bundle --hash <Class>")),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Line(),
+
+		// Metadata commands
+		jen.Switch(jen.Qual("os", "Args").Index(jen.Lit(1))).Block(
+			jen.Case(jen.Lit("--classes")).Block(
+				jen.Id("names").Op(":=").Map(jen.String()).Bool().Values(),
+				jen.For(jen.List(jen.Id("_"), jen.Id("entry")).Op(":=").Range().Id("_classes")).Block(
+					jen.Id("names").Index(jen.Id("entry").Dot("name")).Op("=").True(),
+				),
+				jen.Id("sorted").Op(":=").Make(jen.Index().String(), jen.Lit(0), jen.Len(jen.Id("names"))),
+				jen.For(jen.Id("name").Op(":=").Range().Id("names")).Block(
+					jen.Id("sorted").Op("=").Append(jen.Id("sorted"), jen.Id("name")),
+				),
+				jen.Qual("sort", "Strings").Call(jen.Id("sorted")),
+				jen.For(jen.List(jen.Id("_"), jen.Id("name")).Op(":=").Range().Id("sorted")).Block(
+					jen.Qual("fmt", "Println").Call(jen.Id("name")),
+				),
+				jen.Return(),
+			),
+			jen.Case(jen.Lit("--source"), jen.Lit("--hash")).Block(
+				jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(3)).Block(
+					jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Usage: bundle %s <Class>\n"), jen.Qual("os", "Args").Index(jen.Lit(1))),
+					jen.Qual("os", "Exit").Call(jen.Lit(1)),
+				),
+				jen.List(jen.Id("entry"), jen.Id("ok")).Op(":=").Id("_classes").Index(jen.Qual("os", "Args").Index(jen.Lit(2))),
+				jen.If(jen.Op("!").Id("ok")).Block(
+					jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Unknown class: %s\n"), jen.Qual("os", "Args").Index(jen.Lit(2))),
+					jen.Qual("os", "Exit").Call(jen.Lit(1)),
+				),
+				jen.If(jen.Qual("os", "Args").Index(jen.Lit(1)).Op("==").Lit("--source")).Block(
+					jen.Qual("fmt", "Print").Call(jen.Op("*").Id("entry").Dot("source")),
+				).Else().Block(
+					jen.Id("hash").Op(":=").Qual("crypto/sha256", "Sum256").Call(jen.Index().Byte().Parens(jen.Op("*").Id("entry").Dot("source"))),
+					jen.Qual("fmt", "Println").Call(jen.Qual("encoding/hex", "EncodeToString").Call(jen.Id("hash").Index(jen.Op(":")))),
+				),
+				jen.Return(),
+			),
+		),
+		jen.Line(),
+
+		jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(3)).Block(
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("Usage: bundle <receiver> <selector> [args...]")),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Line(),
+
+		jen.Id("receiver").Op(":=").Qual("os", "Args").Index(jen.Lit(1)),
+		jen.Id("selector").Op(":=").Qual("os", "Args").Index(jen.Lit(2)),
+		jen.Id("args").Op(":=").Qual("os", "Args").Index(jen.Lit(3).Op(":")),
+		jen.Line(),
+
+		// Class method call
+		jen.If(jen.List(jen.Id("entry"), jen.Id("ok")).Op(":=").Id("_classes").Index(jen.Id("receiver")), jen.Id("ok")).Block(
+			jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("entry").Dot("dispatchClass").Call(jen.Id("selector"), jen.Id("args")),
+			exitOnErr,
+			jen.If(jen.Id("result").Op("!=").Lit("")).Block(
+				jen.Qual("fmt", "Println").Call(jen.Id("result")),
+			),
+			jen.Return(),
+		),
+		jen.Line(),
+
+		// Instance method call - resolve the instance's class from the database
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error opening database: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Defer().Id("db").Dot("Close").Call(),
+		jen.Line(),
+
+		jen.Var().Id("className").String(),
+		jen.If(jen.Err().Op(":=").Id("_retryBusy").Call(jen.Func().Params().Error().Block(
+			jen.Return(jen.Id("db").Dot("QueryRow").Call(jen.Lit("SELECT json_extract(data, '$.class') FROM instances WHERE id = ?"), jen.Id("receiver")).Dot("Scan").Call(jen.Op("&").Id("className"))),
+		)), jen.Err().Op("!=").Nil()).Block(
+			storageBusyExit(),
+			jen.Qual("os", "Exit").Call(jen.Lit(200)),
+		),
+		jen.List(jen.Id("entry"), jen.Id("ok")).Op(":=").Id("_classes").Index(jen.Id("className")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Qual("os", "Exit").Call(jen.Lit(200)),
+		),
+		jen.Line(),
+
+		jen.If(jen.Err().Op(":=").Id("beginWork").Call(), jen.Err().Op("!=").Nil()).Block(
+			storageBusyExit(),
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("entry").Dot("dispatchInstance").Call(jen.Id("db"), jen.Id("receiver"), jen.Id("selector"), jen.Id("args")),
+		jen.If(jen.Id("endErr").Op(":=").Id("endWork").Call(jen.Err().Op("==").Nil()), jen.Err().Op("==").Nil()).Block(
+			jen.Err().Op("=").Id("endErr"),
+		),
+		exitOnErr,
+		jen.If(jen.Id("result").Op("!=").Lit("")).Block(
+			jen.Qual("fmt", "Println").Call(jen.Id("result")),
+		),
+	)
+	f.Line()
+}
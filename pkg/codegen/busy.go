@@ -0,0 +1,110 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the handling of a locked SQLite database. openDB asks
+// SQLite to wait busyTimeoutMS for a lock, and loads, saves, creates and
+// deletes that still find the database locked are retried a few times after
+// a jittered backoff. When the lock outlasts them the request fails with
+// ErrStorageBusy, answered as storageBusyExitCode so that callers can tell
+// it from other errors and send the request again.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/dave/jennifer/jen"
+)
+
+// storageBusyExitCode is the exit code of a request that found the instance
+// store locked (protocol.ExitStorageBusy)
+const storageBusyExitCode = 202
+
+// busyTimeoutMS is how long SQLite waits for a lock before answering
+// SQLITE_BUSY, as in pkg/runtime
+const busyTimeoutMS = 5000
+
+// generateBusyHelpers generates ErrStorageBusy, withBusyTimeout, _isBusy and
+// _retryBusy. It is called with the shared connection helpers, which every
+// mode generates.
+func generateBusyHelpers(f *jen.File) {
+	f.Comment("ErrStorageBusy reports that the database stayed locked by another process")
+	f.Var().Id("ErrStorageBusy").Op("=").Qual("errors", "New").Call(jen.Lit("storage busy"))
+	f.Line()
+
+	f.Comment("maxBusyAttempts bounds how often an operation on a locked database is tried,")
+	f.Comment("busyBackoff is the wait before the first retry; it doubles after each one")
+	f.Const().Defs(
+		jen.Id("maxBusyAttempts").Op("=").Lit(4),
+		jen.Id("busyBackoff").Op("=").Lit(25).Op("*").Qual("time", "Millisecond"),
+	)
+	f.Line()
+
+	f.Comment("withBusyTimeout adds the busy timeout to an SQLite database path")
+	f.Func().Id("withBusyTimeout").Params(jen.Id("dbPath").String()).String().Block(
+		jen.Id("sep").Op(":=").Lit("?"),
+		jen.If(jen.Qual("strings", "Contains").Call(jen.Id("dbPath"), jen.Lit("?"))).Block(
+			jen.Id("sep").Op("=").Lit("&"),
+		),
+		jen.Return(jen.Id("dbPath").Op("+").Id("sep").Op("+").Lit(fmt.Sprintf("_busy_timeout=%d", busyTimeoutMS))),
+	)
+	f.Line()
+
+	f.Comment("_isBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED")
+	f.Func().Id("_isBusy").Params(jen.Err().Error()).Bool().Block(
+		jen.If(jen.Err().Op("==").Nil()).Block(
+			jen.Return(jen.False()),
+		),
+		jen.Id("msg").Op(":=").Err().Dot("Error").Call(),
+		jen.Return(jen.Qual("strings", "Contains").Call(jen.Id("msg"), jen.Lit("database is locked")).Op("||").
+			Qual("strings", "Contains").Call(jen.Id("msg"), jen.Lit("database table is locked"))),
+	)
+	f.Line()
+
+	f.Comment("_retryBusy runs op until it succeeds, fails for another reason than a locked")
+	f.Comment("database or has been tried maxBusyAttempts times, in which case the error")
+	f.Comment("wraps ErrStorageBusy")
+	f.Func().Id("_retryBusy").Params(jen.Id("op").Func().Params().Error()).Error().Block(
+		jen.Id("backoff").Op(":=").Id("busyBackoff"),
+		jen.For(jen.Id("attempt").Op(":=").Lit(1).Op(";").Op(";").Id("attempt").Op("++")).Block(
+			jen.Err().Op(":=").Id("op").Call(),
+			jen.If(jen.Op("!").Id("_isBusy").Call(jen.Err())).Block(
+				jen.Return(jen.Err()),
+			),
+			jen.If(jen.Id("attempt").Op("==").Id("maxBusyAttempts")).Block(
+				jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %v"), jen.Id("ErrStorageBusy"), jen.Err())),
+			),
+			jen.Comment("Jitter keeps processes that collided from retrying in step"),
+			jen.Qual("time", "Sleep").Call(jen.Id("backoff").Op("/").Lit(2).Op("+").Qual("time", "Duration").Call(
+				jen.Qual("math/rand", "Int63n").Call(jen.Int64().Call(jen.Id("backoff"))),
+			)),
+			jen.Id("backoff").Op("*=").Lit(2),
+		),
+	)
+	f.Line()
+}
+
+// storageBusyExit returns the statements of a binary's main that exit with
+// storageBusyExitCode if err wraps ErrStorageBusy
+func storageBusyExit() *jen.Statement {
+	return jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrStorageBusy"))).Block(
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
+		jen.Qual("os", "Exit").Call(jen.Lit(storageBusyExitCode)),
+	)
+}
+
+// storageBusyResponse returns the handleServeRequest statements that answer
+// an err wrapping ErrStorageBusy
+func storageBusyResponse() *jen.Statement {
+	return jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrStorageBusy"))).Block(
+		jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+			jen.Id("ExitCode"): jen.Lit(storageBusyExitCode),
+			jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+		})),
+	)
+}
+
+// storageBusyResult returns the plugin statements that answer an err
+// wrapping ErrStorageBusy
+func storageBusyResult() *jen.Statement {
+	return jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrStorageBusy"))).Block(
+		jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(fmt.Sprintf(`{"exit_code":%d,"error":%%q}`, storageBusyExitCode)), jen.Err().Dot("Error").Call())),
+	)
+}
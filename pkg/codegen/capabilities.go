@@ -0,0 +1,103 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains capability gating. Primitives that reach outside the
+// instance store (the network, file writes, processes and the environment,
+// $NAME included) need a capability the class declares:
+//
+//	capabilities: network
+//
+// A method using a primitive whose capability is not declared is not
+// compiled. Plugins export the declared capabilities as GetCapabilities, so
+// that the daemon can refuse classes asking for powers it was not granted.
+package codegen
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// Capabilities a class can declare
+var knownCapabilities = []string{"network", "fileWrite", "process", "env"}
+
+// capabilityPrimitives maps the primitives that need a capability to it.
+// A primitive is a send to receiver, of selector if that is not empty.
+var capabilityPrimitives = []struct{ receiver, selector, capability string }{
+	{"HttpClient", "", "network"},
+	{"File", "writeContents:", "fileWrite"},
+	{"File", "append:", "fileWrite"},
+	{"File", "delete:", "fileWrite"},
+	{"File", "copy:", "fileWrite"},
+	{"File", "mkdirp:", "fileWrite"},
+	{"Shell", "", "process"},
+	{"Env", "", "env"},
+}
+
+// methodCapabilities returns the capabilities the primitives a method sends
+// need, in the order they are first sent
+func methodCapabilities(m *ast.Method) []string {
+	var caps []string
+	tokens := m.Body.Tokens
+	for i, tok := range tokens {
+		if _, ok := parser.EnvVariableName(tok.Value); ok && tok.Type == ast.TokenVariable && !slices.Contains(caps, "env") {
+			caps = append(caps, "env")
+		}
+		if tok.Type != ast.TokenIdentifier {
+			continue
+		}
+		for _, p := range capabilityPrimitives {
+			if tok.Value != p.receiver {
+				continue
+			}
+			if p.selector != "" && (i+1 >= len(tokens) || tokens[i+1].Value != p.selector) {
+				continue
+			}
+			if !slices.Contains(caps, p.capability) {
+				caps = append(caps, p.capability)
+			}
+		}
+	}
+	return caps
+}
+
+// undeclaredCapability returns why a method cannot be compiled because it
+// needs a capability its class does not declare, or "" if it can
+func (g *generator) undeclaredCapability(m *ast.Method) string {
+	for _, c := range methodCapabilities(m) {
+		if !g.class.HasCapability(c) {
+			return fmt.Sprintf("requires capability %s (declare capabilities: %s)", c, c)
+		}
+	}
+	return ""
+}
+
+// warnUnknownCapabilities warns about declared capabilities that are not
+// known, most likely misspelt
+func (g *generator) warnUnknownCapabilities() {
+	for _, c := range g.class.Capabilities {
+		if !slices.Contains(knownCapabilities, c) {
+			g.warnings = append(g.warnings, fmt.Sprintf("unknown capability %s (expected one of %s)",
+				c, strings.Join(knownCapabilities, ", ")))
+		}
+	}
+}
+
+// generateCapabilitiesExport generates the GetCapabilities plugin export,
+// answering the declared capabilities as a JSON array. Plugins of classes
+// that declare none do not export it.
+func (g *generator) generateCapabilitiesExport(f *jen.File) {
+	if len(g.class.Capabilities) == 0 {
+		return
+	}
+	caps, _ := json.Marshal(g.class.Capabilities)
+
+	f.Line()
+	f.Comment("//export GetCapabilities")
+	f.Func().Id("GetCapabilities").Params().Op("*").Qual("C", "char").Block(
+		jen.Return(jen.Qual("C", "CString").Call(jen.Lit(string(caps)))),
+	)
+}
@@ -0,0 +1,124 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the reflective class methods every class answers, as
+// Object does in Bash: allInstances, firstInstance, instanceCount,
+// deleteAll and instancesOf:. They query the instances table by the class
+// each instance's data names, leaving out the <Class>::class rows holding
+// class instance variables, and answer instance IDs one per line. A class
+// defining a method with the same selector keeps its own.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// classOfInstance is the SQL selecting the instances of the class passed as
+// the query argument
+const classOfInstance = "json_extract(data, '$.class') = ? AND id NOT LIKE '%::class'"
+
+// classInstancesQuery is the query answering the IDs of a class's
+// instances, oldest first
+const classInstancesQuery = "SELECT id FROM instances WHERE " + classOfInstance + " ORDER BY json_extract(data, '$.created_at'), id"
+
+// hasClassQueries reports whether dispatchClass answers the reflective
+// class methods. They query SQLite, so binaries persisting through the
+// Storage interface leave them to Bash.
+func (g *generator) hasClassQueries() bool {
+	return !g.useStorage()
+}
+
+// classQueryCases returns the dispatchClass cases of the reflective class
+// methods the class does not define. deleteAll is left to Bash when the
+// class has an aboutToDelete or onDelete hook, which it would skip.
+func (g *generator) classQueryCases(methods []*compiledMethod) []dispatchCase {
+	if !g.hasClassQueries() {
+		return nil
+	}
+	defined := make(map[string]bool)
+	for _, m := range methods {
+		defined[m.selector] = true
+	}
+	for _, m := range g.class.Methods {
+		if m.Kind == "class" {
+			defined[m.Selector] = true
+		}
+	}
+	qualifiedName := jen.Lit(g.class.QualifiedName())
+	openDB := []jen.Code{
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+	}
+
+	candidates := []dispatchCase{
+		{"allInstances", []jen.Code{
+			jen.Return(jen.Id("_queryIDs").Call(jen.Lit(classInstancesQuery), qualifiedName)),
+		}},
+		{"firstInstance", []jen.Code{
+			jen.Return(jen.Id("_queryIDs").Call(jen.Lit(classInstancesQuery+" LIMIT 1"), qualifiedName)),
+		}},
+		{"instanceCount", append(append([]jen.Code{}, openDB...),
+			jen.Var().Id("n").Int(),
+			jen.If(jen.Err().Op(":=").Id("dbQueryRow").Call(jen.Id("db"), jen.Lit("SELECT COUNT(*) FROM instances WHERE "+classOfInstance), qualifiedName).Dot("Scan").Call(jen.Op("&").Id("n")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.Return(jen.Qual("strconv", "Itoa").Call(jen.Id("n")), jen.Nil()),
+		)},
+		{"instancesOf_", []jen.Code{
+			jen.If(jen.Len(jen.Id("args")).Op("<").Lit(1)).Block(
+				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("instancesOf_ requires 1 argument"))),
+			),
+			jen.Return(jen.Id("_queryIDs").Call(jen.Lit(classInstancesQuery), jen.Qual("strings", "ReplaceAll").Call(jen.Id("args").Index(jen.Lit(0)), jen.Lit("__"), jen.Lit("::")))),
+		}},
+	}
+	if !g.hasTeardown() {
+		candidates = append(candidates, dispatchCase{"deleteAll", append(append([]jen.Code{}, openDB...),
+			jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dbExec").Call(jen.Id("db"), jen.Lit("DELETE FROM instances WHERE "+classOfInstance), qualifiedName), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.Return(jen.Lit(""), jen.Nil()),
+		)})
+	}
+
+	var cases []dispatchCase
+	for _, c := range candidates {
+		if !defined[c.selector] {
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+// generateQueryIDs generates _queryIDs, shared by the reflective class
+// methods and the Environment queries
+func (g *generator) generateQueryIDs(f *jen.File) {
+	f.Comment("_queryIDs runs query and answers the instance IDs it selects, one per line")
+	f.Func().Id("_queryIDs").Params(
+		jen.Id("query").String(),
+		jen.Id("args").Op("...").Interface(),
+	).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+		jen.Line(),
+		jen.List(jen.Id("rows"), jen.Err()).Op(":=").Id("dbQuery").Call(jen.Id("db"), jen.Id("query"), jen.Id("args").Op("...")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Defer().Id("rows").Dot("Close").Call(),
+		jen.Line(),
+		jen.Var().Id("ids").Index().String(),
+		jen.For(jen.Id("rows").Dot("Next").Call()).Block(
+			jen.Var().Id("id").String(),
+			jen.If(jen.Err().Op(":=").Id("rows").Dot("Scan").Call(jen.Op("&").Id("id")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.Id("ids").Op("=").Append(jen.Id("ids"), jen.Id("id")),
+		),
+		jen.Return(jen.Qual("strings", "Join").Call(jen.Id("ids"), jen.Lit("\n")), jen.Id("rows").Dot("Err").Call()),
+	)
+	f.Line()
+}
@@ -0,0 +1,225 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains class instance variables (classInstanceVars:).
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// Class instance variables are kept in one row of the instances table, keyed
+// "<Class>::class", holding a JSON object of their string values. dispatchClass
+// loads the row (or the declared defaults if it was never saved) into
+// classVars, runs the class method and saves the row if the method assigned
+// one of the variables. Class-side getters and setters are dispatched for
+// each variable unless the class defines a method with that selector. As with
+// instances, nothing is saved when the method fails.
+
+// classVarsID is the instances table ID of the class instance variables
+func (g *generator) classVarsID() string {
+	return g.class.QualifiedName() + "::class"
+}
+
+// classVarsType is the name of the struct holding the class instance variables
+func (g *generator) classVarsType() string {
+	return g.typeName() + "ClassVars"
+}
+
+// hasClassVars reports whether class methods read and save class instance
+// variables. They are kept through the plain SQLite helpers only.
+func (g *generator) hasClassVars() bool {
+	return len(g.class.ClassInstanceVars) > 0 && !g.useStorage()
+}
+
+// isClassVar reports whether name refers to a class instance variable in m
+func (g *generator) isClassVar(name string, m *compiledMethod) bool {
+	if !m.isClass || !g.classVars[name] {
+		return false
+	}
+	for _, arg := range m.args {
+		if arg == name {
+			return false
+		}
+	}
+	return true
+}
+
+// classVarAccess returns the field of classVars holding name
+func (g *generator) classVarAccess(name string) *jen.Statement {
+	return jen.Id(g.fn("classVars")).Dot(capitalize(name))
+}
+
+// classVarsUnavailable reports whether m is a class method using class
+// instance variables that cannot be kept, because the binary persists
+// through the Storage interface. Such methods fall back to Bash.
+func (g *generator) classVarsUnavailable(m ast.Method) bool {
+	if m.Kind != "class" || len(g.class.ClassInstanceVars) == 0 || !g.useStorage() {
+		return false
+	}
+	for _, tok := range m.Body.Tokens {
+		if tok.Type == ast.TokenIdentifier && g.classVars[tok.Value] {
+			return true
+		}
+	}
+	return false
+}
+
+// generateClassVarsAssignment generates the assignment of value to a class
+// instance variable
+func (g *generator) generateClassVarsAssignment(target string, value parser.Expr, m *compiledMethod) []jen.Code {
+	field := g.classVarAccess(target)
+	if step, ok := ivarIncrement(target, value); ok {
+		return []jen.Code{
+			field.Clone().Op("=").Id("_addInt").Call(field.Clone(), jen.Lit(step)),
+			jen.Id(g.fn("classVars")).Dot("dirty").Op("=").True(),
+		}
+	}
+	return []jen.Code{
+		field.Op("=").Add(g.generateStringValue(value, m)),
+		jen.Id(g.fn("classVars")).Dot("dirty").Op("=").True(),
+	}
+}
+
+// generateClassVars generates the class instance variable struct, classVars
+// and the helpers loading and saving it. Nothing is emitted without class
+// instance variables.
+func (g *generator) generateClassVars(f *jen.File) {
+	if len(g.class.ClassInstanceVars) == 0 {
+		return
+	}
+	if !g.hasClassVars() {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("class instance variables need the SQLite helpers; class methods of %s using them fall back to Bash", g.class.Name))
+		return
+	}
+	typeName := g.classVarsType()
+	id := g.classVarsID()
+
+	fields := []jen.Code{}
+	defaults := jen.Dict{}
+	for _, cv := range g.class.ClassInstanceVars {
+		fields = append(fields, jen.Id(capitalize(cv.Name)).String().Tag(map[string]string{"json": cv.Name}))
+		defaults[jen.Id(capitalize(cv.Name))] = jen.Lit(cv.Default.Value)
+	}
+	fields = append(fields, jen.Id("dirty").Bool())
+
+	f.Comment(typeName + " holds the class instance variables of " + g.class.Name)
+	f.Type().Id(typeName).Struct(fields...)
+	f.Line()
+
+	f.Comment(g.fn("classVars") + " holds the class instance variables during dispatchClass")
+	f.Var().Id(g.fn("classVars")).Op("*").Id(typeName)
+	f.Line()
+
+	f.Comment(g.fn("loadClassVars") + " loads the class instance variables saved as " + id + ",")
+	f.Comment("or their defaults if they were never saved")
+	f.Func().Id(g.fn("loadClassVars")).Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+	).Parens(jen.List(jen.Op("*").Id(typeName), jen.Error())).Block(
+		jen.Id("vars").Op(":=").Op("&").Id(typeName).Values(defaults),
+		jen.Var().Id("data").String(),
+		jen.Err().Op(":=").Id("dbQueryRow").Call(jen.Id("db"), jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Lit(id)).Dot("Scan").Call(jen.Op("&").Id("data")),
+		jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Qual("database/sql", "ErrNoRows"))).Block(
+			jen.Return(jen.Id("vars"), jen.Nil()),
+		),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Id("vars")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.Return(jen.Id("vars"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment(g.fn("saveClassVars") + " stores the class instance variables as " + id)
+	f.Func().Id(g.fn("saveClassVars")).Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("vars").Op("*").Id(typeName),
+	).Error().Block(
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("vars")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dbExec").Call(
+			jen.Id("db"),
+			jen.Lit("INSERT OR REPLACE INTO instances (id, data) VALUES (?, json(?))"),
+			jen.Lit(id),
+			jen.String().Parens(jen.Id("data")),
+		), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Id("afterWork").Call(jen.Func().Params(jen.Id("committed").Bool()).Block(
+			jen.Id("vars").Dot("dirty").Op("=").Op("!").Id("committed"),
+		)),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+}
+
+// classVarAccessorCases returns the class-side getter and setter cases of
+// each class instance variable, except those a class method defines
+func (g *generator) classVarAccessorCases(methods []*compiledMethod) []dispatchCase {
+	defined := make(map[string]bool)
+	for _, m := range methods {
+		defined[m.selector] = true
+	}
+	for _, m := range g.class.Methods {
+		if m.Kind == "class" {
+			defined[m.Selector] = true
+		}
+	}
+
+	var cases []dispatchCase
+	for _, cv := range g.class.ClassInstanceVars {
+		if !defined[cv.Name] {
+			cases = append(cases, dispatchCase{cv.Name, []jen.Code{
+				jen.Return(g.classVarAccess(cv.Name), jen.Nil()),
+			}})
+		}
+		if setter := cv.Name + "_"; !defined[setter] {
+			cases = append(cases, dispatchCase{setter, []jen.Code{
+				jen.If(jen.Len(jen.Id("args")).Op("<").Lit(1)).Block(
+					jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(setter+" requires 1 argument"))),
+				),
+				g.classVarAccess(cv.Name).Op("=").Id("args").Index(jen.Lit(0)),
+				jen.Id(g.fn("classVars")).Dot("dirty").Op("=").True(),
+				jen.Return(jen.Lit(""), jen.Nil()),
+			}})
+		}
+	}
+	return cases
+}
+
+// generateClassVarsDispatch generates dispatchClass for a class with class
+// instance variables: it loads them, runs the class dispatch function inner
+// and saves them if they changed
+func (g *generator) generateClassVarsDispatch(f *jen.File, inner string) {
+	f.Comment(g.fn("dispatchClass") + " runs selector with the class instance variables loaded, and saves")
+	f.Comment("them if it assigned any")
+	f.Func().Id(g.fn("dispatchClass")).Params(
+		jen.Id("selector").String(),
+		jen.Id("args").Index().String(),
+	).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+		jen.If(jen.List(jen.Id(g.fn("classVars")), jen.Err()).Op("=").Id(g.fn("loadClassVars")).Call(jen.Id("db")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(inner).Call(jen.Id("selector"), jen.Id("args")),
+		jen.If(jen.Err().Op("!=").Nil().Op("||").Op("!").Id(g.fn("classVars")).Dot("dirty")).Block(
+			jen.Return(jen.Id("result"), jen.Err()),
+		),
+		jen.If(jen.Err().Op(":=").Id(g.fn("saveClassVars")).Call(jen.Id("db"), jen.Id(g.fn("classVars"))), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Return(jen.Id("result"), jen.Nil()),
+	)
+	f.Line()
+}
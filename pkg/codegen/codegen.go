@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
 	"github.com/chazu/procyon/pkg/parser"
 	"github.com/dave/jennifer/jen"
 )
@@ -16,23 +17,72 @@ type Result struct {
 	Code           string
 	Warnings       []string
 	SkippedMethods []SkippedMethod
+	// Errors are mistakes in the class source that the generated code
+	// would only hit at runtime, such as a malformed JSON literal
+	Errors []CompileError
+	// SourceMap links the generated functions to the methods they
+	// implement; nil unless Options.SourceMap is set
+	SourceMap *SourceMap
+}
+
+// CompileError is a mistake in the class source found while generating.
+type CompileError struct {
+	Message  string
+	Location ast.Location // Where in the source (line 0 if unknown)
+}
+
+func (e CompileError) Error() string {
+	if e.Location.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s", e.Location.Line, e.Message)
 }
 
 // SkippedMethod records a method that couldn't be compiled.
 type SkippedMethod struct {
 	Selector string
 	Reason   string
+	Line     int // Source line of the method definition (0 if unknown)
+	// Location is where the reason applies: the token the body failed to
+	// parse at or that needs Bash, otherwise the method definition
+	Location ast.Location
+}
+
+// tokenLocation returns the location of a token at line and col, or fallback
+// if the token carries no position
+func tokenLocation(line, col int, fallback ast.Location) ast.Location {
+	if line == 0 {
+		return fallback
+	}
+	return ast.Location{Line: line, Col: col}
 }
 
 // Generate produces Go source code from a Trashtalk class AST.
 func Generate(class *ast.Class) *Result {
+	return newGenerator(class).generate()
+}
+
+// newGenerator creates a generator for class with ivar lookups populated.
+func newGenerator(class *ast.Class) *generator {
 	g := &generator{
 		class:          class,
 		warnings:       []string{},
 		skipped:        []SkippedMethod{},
 		instanceVars:   map[string]bool{},
 		jsonVars:       map[string]bool{},
+		ivarTypes:      map[string]string{},
 		skippedMethods: map[string]bool{},
+		classVars:      map[string]bool{},
+		exceptions:     usesExceptions(class),
+		httpClient:     usesHttpClient(class),
+		shell:          usesShell(class),
+		env:            usesEnv(class),
+		localeFormat:   usesLocale(class),
+		jsonPaths:      usesJSONPaths(class),
+		arrayOps:       usesArrayOps(class),
+		objectOps:      usesObjectOps(class),
+		typedArgs:      usesArgTypes(class),
+		fileOps:        usesFileOps(class),
 	}
 
 	// Build instance var lookup and track JSON-typed vars
@@ -44,8 +94,15 @@ func Generate(class *ast.Class) *Result {
 			g.jsonVars[iv.Name] = true
 		}
 	}
+	for _, cv := range class.ClassInstanceVars {
+		g.classVars[cv.Name] = true
+	}
+	g.setIvarTypes()
+	g.setGrpcNative()
+	g.warnUnknownCapabilities()
+	g.checkJSONDefaults()
 
-	return g.generate()
+	return g
 }
 
 type generator struct {
@@ -54,7 +111,58 @@ type generator struct {
 	skipped      []SkippedMethod
 	instanceVars    map[string]bool
 	jsonVars        map[string]bool   // vars with JSON default values (use json.RawMessage)
+	ivarTypes       map[string]string // typed ivars (count:<int> 0) -> int, float, array or object
+	classVars       map[string]bool   // class instance variables (classInstanceVars:)
 	skippedMethods  map[string]bool   // methods that will fall back to bash (for @ self detection)
+	prefix          string            // prefix for per-class package-level names (bundle mode only)
+	wasm            bool              // persist through the Storage interface instead of SQLite
+	backends        []string          // storage backends compiled into a binary (empty: SQLite only)
+	history         bool              // keep every saved state in instance_history (Options.History)
+	exceptions      bool              // methods use _throw, on:do: or ensure:
+	httpClient      bool              // methods use the HttpClient primitives
+	shell           bool              // methods use the Shell primitives
+	env             bool              // methods use the Env or Os primitives
+	localeFormat    bool              // methods use the Locale primitives
+	jsonPaths       bool              // methods use jsonAtPath: or jsonSetPath:put:
+	arrayOps        bool              // methods use arraySort, arrayReverse, arrayUnique or arrayJoin:
+	objectOps       bool              // methods use objectMerge:, objectDeepMerge: or objectEquals:
+	typedArgs       bool              // methods declare int, float or bool arguments with argTypes:
+	fileOps         bool              // methods use File readAll:, writeContents:to: and the other fileOps
+	grpc            bool              // native gRPC client: GrpcClient, or a class with pragma: grpcNative
+	mapDispatch     bool              // dispatch through a selector map whatever the case count (Options.MapDispatch)
+	only            map[string]bool   // selectors to compile, nil for all (Options.Only)
+	skip            map[string]bool   // selectors left to Bash (Options.Skip)
+	knownClasses    map[string]bool   // qualified names of the classes sends can reach, nil if unknown (Options.Classes)
+	accessors       bool              // synthesize ivar getters and setters (Options.Accessors)
+	fallbackStats   bool              // count Bash fallbacks in fallback_stats (Options.FallbackStats)
+	initializers    []initializerHook // initialize and the keyword initializers, run by new
+	indexes         []string          // field paths declared with index:, created by ensureIndexes
+	schemaMigrate   bool              // record _contentHash per instance and migrateInstance on load
+	renames         []ast.Rename      // migrate: declarations applied by migrateInstance
+	comments        bool              // emit doc comments and a file header (Options.Comments)
+	sourceMap       bool              // emit the source map and the panic trace rewriting (Options.SourceMap)
+	implicitLocals  bool              // declare undefined variables as locals (Options.ImplicitLocals)
+	generatorVersion string           // procyon version named in the file header
+	sourceHash      string            // source hash named in the file header
+	errors          []CompileError    // mistakes in the source (Result.Errors)
+	jsonConsts      []string          // constant JSON literals decoded into package-level variables, by index
+	compiled        []*compiledMethod // methods generate compiled, for GenerateTests
+}
+
+// fn returns the package-level name for a per-class function such as
+// dispatch or loadInstance. Outside bundle mode the prefix is empty.
+func (g *generator) fn(name string) string {
+	return g.prefix + name
+}
+
+// typeName returns the Go type name of the class struct. Outside bundle mode
+// it is the class name; a bundle uses the compiled name, so classes of the
+// same name in different packages do not collide.
+func (g *generator) typeName() string {
+	if g.prefix == "" {
+		return g.class.Name
+	}
+	return g.class.CompiledName()
 }
 
 type compiledMethod struct {
@@ -67,20 +175,34 @@ type compiledMethod struct {
 	returnsErr  bool
 	primitive   bool                   // True if this is a primitive method with native impl
 	renamedVars map[string]string      // Original name -> safe Go name
+	argTypes    map[string]string      // Arg name -> type declared with argTypes:
+	blockVars   map[string]int         // Locals holding compiled blocks -> arity
+	line        int                    // Source line of the method definition (0 if unknown)
+	col         int                    // Source column of the method definition, 0-based
+	funcName    string                 // Name of the generated function, set by generateMethod
+	trait       string                 // Trait the method was merged from, empty if the class defines it
+	before      []*compiledMethod      // before: advice run by dispatch
+	after       []*compiledMethod      // after: advice run by dispatch
 }
 
 func (g *generator) generate() *Result {
 	f := jen.NewFile("main")
+	g.setIndexes()
+	g.setRenames()
+	g.generateHeader(f)
 
-	// Note: Trait handling is done at parse time via MergeTraits().
-	// If traits were provided, their methods are already in g.class.Methods.
+	// Note: Trait handling is done before codegen via MergeTraits().
+	// If traits were provided or found on --trait-path, their methods are
+	// already in g.class.Methods.
 
 	// Add blank imports for embed and sqlite3
 	f.Anon("embed")
-	f.Anon("github.com/mattn/go-sqlite3")
+	if g.usesSQLite() {
+		f.Anon("github.com/mattn/go-sqlite3")
+	}
 
-	// Add gRPC imports for GrpcClient class
-	if g.class.Name == "GrpcClient" {
+	// Add gRPC imports for native gRPC clients
+	if g.grpc {
 		f.Anon("google.golang.org/grpc")
 	}
 
@@ -103,6 +225,9 @@ func (g *generator) generate() *Result {
 	f.Var().Id("ErrUnknownSelector").Op("=").Qual("errors", "New").Call(jen.Lit("unknown selector"))
 	f.Line()
 
+	// ErrConflict
+	generateConflictDecls(f)
+
 	// Struct definition
 	g.generateStruct(f)
 	f.Line()
@@ -119,11 +244,18 @@ func (g *generator) generate() *Result {
 	g.generateTypeHelpers(f)
 	f.Line()
 
+	// TrashError and the _throw helpers
+	if g.exceptions {
+		generateExceptionHelpers(f)
+	}
+	g.generateArgTypeHelpers(f)
+
 	// First pass: identify which methods will be skipped (for @ self calls)
 	g.preIdentifySkippedMethods()
 
 	// Compile methods and separate into class/instance
 	compiled := g.compileMethods()
+	g.compiled = compiled
 
 	// Split into class and instance methods
 	var instanceMethods, classMethods []*compiledMethod
@@ -146,6 +278,19 @@ func (g *generator) generate() *Result {
 		g.generateMethod(f, m)
 	}
 
+	// Data migrations for versioned classes
+	g.generateMigrations(f)
+	g.generateMigrateInstance(f)
+
+	// Class instance variable storage
+	g.generateClassVars(f)
+
+	// Constant JSON arrays and objects, decoded once
+	g.generateJSONConsts(f)
+
+	// Panic trace rewriting through the source map
+	g.generateSourceMapHelpers(f)
+
 	// Render to string
 	buf := &bytes.Buffer{}
 	if err := f.Render(buf); err != nil {
@@ -153,13 +298,17 @@ func (g *generator) generate() *Result {
 			Code:           fmt.Sprintf("// Error rendering: %v", err),
 			Warnings:       g.warnings,
 			SkippedMethods: g.skipped,
+			Errors:         g.errors,
 		}
 	}
 
+	code, sourceMap := g.withSourceMap(g.withHelperComments(buf.String()))
 	return &Result{
-		Code:           buf.String(),
+		Code:           code,
 		Warnings:       g.warnings,
 		SkippedMethods: g.skipped,
+		Errors:         g.errors,
+		SourceMap:      sourceMap,
 	}
 }
 
@@ -168,22 +317,37 @@ func (g *generator) generateStruct(f *jen.File) {
 		jen.Id("Class").String().Tag(map[string]string{"json": "class"}),
 		jen.Id("CreatedAt").String().Tag(map[string]string{"json": "created_at"}),
 		jen.Id("Vars").Index().String().Tag(map[string]string{"json": "_vars"}),
+		jen.Id("Version").Int().Tag(map[string]string{"json": "_version"}),
 	}
 
 	for _, iv := range g.class.InstanceVars {
 		goName := capitalize(iv.Name)
-		goType := g.inferType(iv)
-		fields = append(fields, jen.Id(goName).Add(goType).Tag(map[string]string{"json": iv.Name}))
+		goType, tag := g.ivarGoType(iv)
+		fields = append(fields, jen.Id(goName).Add(goType).Tag(map[string]string{"json": tag}))
+	}
+
+	if g.versioned() {
+		fields = append(fields, g.versionField())
+	}
+	if g.schemaMigrate {
+		fields = append(fields, g.contentHashField())
 	}
 
-	// Add gRPC internal fields for GrpcClient (not serialized to JSON)
-	if g.class.Name == "GrpcClient" {
+	// Set by instance variable assignments so unchanged instances are not saved
+	fields = append(fields, jen.Id("dirty").Bool().Tag(map[string]string{"json": "-"}))
+	if g.inherits() {
+		fields = append(fields, inheritedField())
+	}
+
+	// Add gRPC internal fields for native gRPC clients (not serialized to JSON)
+	if g.grpc {
 		fields = append(fields, jen.Id("conn").Op("*").Qual("google.golang.org/grpc", "ClientConn").Tag(map[string]string{"json": "-"}))
 		// Cached file descriptors for proto file mode
 		fields = append(fields, jen.Id("fileDescs").Index().Op("*").Qual("github.com/jhump/protoreflect/desc", "FileDescriptor").Tag(map[string]string{"json": "-"}))
 	}
 
-	f.Type().Id(g.class.Name).Struct(fields...)
+	f.Type().Id(g.typeName()).Struct(fields...)
+	g.generateInheritedJSON(f)
 }
 
 func (g *generator) inferType(iv ast.InstanceVar) *jen.Statement {
@@ -198,31 +362,30 @@ func (g *generator) inferType(iv ast.InstanceVar) *jen.Statement {
 	return jen.String()
 }
 
-// isJSONArrayType checks if an instance variable has a JSON array type
-// Always returns false since we use string type for all instance variables
-func (g *generator) isJSONArrayType(name string) bool {
-	// With string-typed instance variables, we always use JSON string operations
-	return false
+// isJSONArrayType checks if an instance variable is a native []interface{}.
+// Only ivars declared <array> are; all others are strings or json.RawMessage.
+func (g *generator) isJSONArrayType(name string, m *compiledMethod) bool {
+	return g.typedIvar(name, m) == "array"
 }
 
-// isJSONObjectType checks if an instance variable has a JSON object type
-// Always returns false since we use string type for all instance variables
-func (g *generator) isJSONObjectType(name string) bool {
-	// With string-typed instance variables, we always use JSON string operations
-	return false
+// isJSONObjectType checks if an instance variable is a native
+// map[string]interface{}. Only ivars declared <object> are.
+func (g *generator) isJSONObjectType(name string, m *compiledMethod) bool {
+	return g.typedIvar(name, m) == "object"
 }
 
 // exprResultsInArray checks if an expression results in a native []interface{}
 // This handles chained operations like: items arrayPush: x arrayPush: y
-func (g *generator) exprResultsInArray(expr parser.Expr) bool {
+func (g *generator) exprResultsInArray(expr parser.Expr, m *compiledMethod) bool {
 	switch e := expr.(type) {
 	case *parser.Identifier:
-		return g.isJSONArrayType(e.Name)
+		return g.isJSONArrayType(e.Name, m)
 	case *parser.JSONPrimitiveExpr:
 		// If receiver results in array and operation preserves array type
-		if g.exprResultsInArray(e.Receiver) {
+		if g.exprResultsInArray(e.Receiver, m) {
 			switch e.Operation {
-			case "arrayPush", "arrayAtPut", "arrayRemoveAt":
+			case "arrayPush", "arrayAtPut", "arrayRemoveAt", "jsonSetPathPut",
+				"arraySort", "arraySortNumeric", "arrayReverse", "arrayUnique":
 				return true
 			}
 		}
@@ -232,15 +395,16 @@ func (g *generator) exprResultsInArray(expr parser.Expr) bool {
 
 // exprResultsInObject checks if an expression results in a native map[string]interface{}
 // This handles chained operations like: data objectAt: k1 put: v1 objectAt: k2 put: v2
-func (g *generator) exprResultsInObject(expr parser.Expr) bool {
+func (g *generator) exprResultsInObject(expr parser.Expr, m *compiledMethod) bool {
 	switch e := expr.(type) {
 	case *parser.Identifier:
-		return g.isJSONObjectType(e.Name)
+		return g.isJSONObjectType(e.Name, m)
 	case *parser.JSONPrimitiveExpr:
 		// If receiver results in object and operation preserves object type
-		if g.exprResultsInObject(e.Receiver) {
+		if g.exprResultsInObject(e.Receiver, m) {
 			switch e.Operation {
-			case "objectAtPut", "objectRemoveKey":
+			case "objectAtPut", "objectRemoveKey", "jsonSetPathPut",
+				"objectMerge", "objectDeepMerge":
 				return true
 			}
 		}
@@ -248,6 +412,17 @@ func (g *generator) exprResultsInObject(expr parser.Expr) bool {
 	return false
 }
 
+// isClassReceiver compares receiver with the class name, and with the
+// qualified name if the class has a package; comparing with the same
+// literal twice is a vet error, which fails go test of generated code
+func isClassReceiver(receiver *jen.Statement, className, qualifiedName string) *jen.Statement {
+	cond := receiver.Clone().Op("==").Lit(className)
+	if qualifiedName != className {
+		cond.Op("||").Add(receiver.Clone()).Op("==").Lit(qualifiedName)
+	}
+	return cond
+}
+
 func (g *generator) generateMain(f *jen.File) {
 	className := g.class.Name
 	compiledName := g.class.CompiledName()
@@ -262,21 +437,23 @@ func (g *generator) generateMain(f *jen.File) {
 	}
 
 	f.Func().Id("main").Params().Block(
+		g.sourceMapDefer(),
+		// Select a storage backend before anything else reads os.Args
+		g.storageFlag(),
+		g.historyFlag(),
 		// Check for minimum args
 		jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(2)).Block(
 			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("Usage: "+compiledName+".native <instance_id> <selector> [args...]")),
-			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       "+compiledName+".native --source")),
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       "+compiledName+".native --source [--raw|--json]")),
 			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       "+compiledName+".native --hash")),
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("       "+compiledName+".native --reembed <"+compiledName+".trash>")),
 			jen.Qual("os", "Exit").Call(jen.Lit(1)),
 		),
 		jen.Line(),
 
 		// Handle metadata commands and serve mode
 		jen.Switch(jen.Qual("os", "Args").Index(jen.Lit(1))).Block(
-			jen.Case(jen.Lit("--source")).Block(
-				jen.Qual("fmt", "Print").Call(jen.Id("_sourceCode")),
-				jen.Return(),
-			),
+			g.mainSource(),
 			jen.Case(jen.Lit("--hash")).Block(
 				jen.Qual("fmt", "Println").Call(jen.Id("_contentHash")),
 				jen.Return(),
@@ -289,9 +466,14 @@ func (g *generator) generateMain(f *jen.File) {
 				jen.Id("runServeMode").Call(),
 				jen.Return(),
 			),
+			g.mainServeSocket(),
+			g.mainReembed(),
 		),
 		jen.Line(),
 
+		// Create the declared indexes before dispatching
+		g.mainEnsureIndexes(),
+
 		// Check for selector arg
 		jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(3)).Block(
 			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit("Usage: "+compiledName+".native <instance_id> <selector> [args...]")),
@@ -305,13 +487,20 @@ func (g *generator) generateMain(f *jen.File) {
 		jen.Id("args").Op(":=").Qual("os", "Args").Index(jen.Lit(3).Op(":")),
 		jen.Line(),
 
+		// Read-only dispatch against a past state
+		g.mainAsOf(),
+
 		// Check for class method call (receiver is the class name)
-		jen.If(jen.Id("receiver").Op("==").Lit(className).Op("||").Id("receiver").Op("==").Lit(qualifiedName)).Block(
-			jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("dispatchClass").Call(jen.Id("selector"), jen.Id("args")),
+		jen.If(isClassReceiver(jen.Id("receiver"), className, qualifiedName)).Block(
+			g.mainFallbackStats(),
+			jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatchClass")).Call(jen.Id("selector"), jen.Id("args")),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+					g.mainRecordClassFallback(),
 					jen.Qual("os", "Exit").Call(jen.Lit(200)),
 				),
+				g.trashErrorExit(),
+				storageBusyExit(),
 				jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
 				jen.Qual("os", "Exit").Call(jen.Lit(1)),
 			),
@@ -329,38 +518,53 @@ func (g *generator) generateMain(f *jen.File) {
 			jen.Qual("os", "Exit").Call(jen.Lit(1)),
 		),
 		jen.Defer().Id("db").Dot("Close").Call(),
+		g.mainBeginWork(),
 		jen.Line(),
 
 		// Load instance
-		jen.List(jen.Id("instance"), jen.Err()).Op(":=").Id("loadInstance").Call(jen.Id("db"), jen.Id("receiver")),
+		jen.List(jen.Id("instance"), jen.Err()).Op(":=").Id(g.fn("loadInstance")).Call(jen.Id("db"), jen.Id("receiver")),
 		jen.If(jen.Err().Op("!=").Nil()).Block(
+			g.mainEndWork(false),
+			storageBusyExit(),
 			jen.Qual("os", "Exit").Call(jen.Lit(200)),
 		),
 		jen.Line(),
 
 		// Dispatch to instance method (pass receiver as instanceID)
-		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("dispatch").Call(jen.Id("instance"), jen.Id("receiver"), jen.Id("selector"), jen.Id("args")),
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatch")).Call(jen.Id("instance"), jen.Id("receiver"), jen.Id("selector"), jen.Id("args")),
+		g.mainForwardUnknown(),
 		jen.If(jen.Err().Op("!=").Nil()).Block(
+			g.mainEndWork(false),
 			jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+				g.recordFallback(jen.Id("db"), jen.Id("selector")),
 				jen.Qual("os", "Exit").Call(jen.Lit(200)),
 			),
+			g.trashErrorExit(),
+			storageBusyExit(),
 			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
 			jen.Qual("os", "Exit").Call(jen.Lit(1)),
 		),
 		jen.Line(),
 
-		// Save or delete instance
+		// Delete the instance, or save it if an instance variable changed. A
+		// save that lost a race with another process fails with ErrConflict;
+		// dispatching again would repeat the method's side effects.
 		jen.If(jen.Id("selector").Op("==").Lit("delete")).Block(
 			jen.If(jen.Err().Op(":=").Id("deleteInstance").Call(jen.Id("db"), jen.Id("receiver")), jen.Err().Op("!=").Nil()).Block(
+				g.mainEndWork(false),
+				storageBusyExit(),
 				jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error deleting instance: %v\n"), jen.Err()),
 				jen.Qual("os", "Exit").Call(jen.Lit(1)),
 			),
-		).Else().Block(
-			jen.If(jen.Err().Op(":=").Id("saveInstance").Call(jen.Id("db"), jen.Id("receiver"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+		).Else().If(jen.Id("instance").Dot("dirty")).Block(
+			jen.If(jen.Err().Op(":=").Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("receiver"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+				g.mainEndWork(false),
+				storageBusyExit(),
 				jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error saving instance: %v\n"), jen.Err()),
 				jen.Qual("os", "Exit").Call(jen.Lit(1)),
 			),
 		),
+		g.mainEndWork(true),
 		jen.Line(),
 
 		// Print result
@@ -371,129 +575,279 @@ func (g *generator) generateMain(f *jen.File) {
 }
 
 func (g *generator) generateHelpers(f *jen.File) {
-	className := g.class.Name
+	if g.useStorage() {
+		// Storage interface, backends, and openDB selecting one of them
+		g.generateStorage(f)
+		g.generateStorageLoadSave(f)
+		g.generateInstanceIDHelper(f)
+		g.generateStorageCreateDelete(f)
+	} else {
+		// openDB
+		g.generateOpenDB(f)
+
+		// loadInstance / saveInstance
+		g.generateLoadSave(f)
+
+		// generateInstanceID - creates a UUID-based instance ID
+		g.generateInstanceIDHelper(f)
+
+		// createInstance - inserts a new instance into the database
+		g.generateCreateInstance(f)
+
+		// deleteInstance - removes an instance from the database
+		g.generateDeleteInstance(f)
+
+		// ensureIndexes - creates the index: declarations
+		g.generateEnsureIndexes(f)
+	}
 
-	// openDB
+	// sendMessage - shell out to bash runtime for non-self message sends
+	g.generateSendMessage(f)
+
+	// Reference ivar helpers (ref: declarations)
+	g.generateRefHelpers(f)
+
+	// recordHistory, loadInstanceAsOf and dispatchAsOf (Options.History)
+	g.generateHistory(f)
+
+	// recordFallback and fallbackStats (Options.FallbackStats)
+	g.generateFallbackStats(f)
+
+	// runServeMode - daemon mode that reads JSON requests from stdin
+	g.generateServeMode(f)
+
+	// runServeSocket - the same requests on a Unix socket
+	g.generateServeSocket(f)
+
+	// forwardToParent - inherited selectors answered by the parent's binary
+	g.generateForwardToParent(f)
+	f.Line()
+
+	// sourceLineage and reembed - checks a source file against the embedded one
+	g.generateReembed(f)
+
+	// JSON primitive helper functions
+	g.generateJSONHelpers(f)
+	g.generateJSONPathHelpers(f)
+	g.generateArrayOpHelpers(f)
+	g.generateObjectOpHelpers(f)
+	g.generateTypedIvarHelpers(f)
+
+	// String/File primitive helper functions
+	g.generateStringFileHelpers(f)
+	g.generateFileOpHelpers(f)
+
+	// HttpClient, Shell, Env and Locale primitive helper functions
+	g.generateHttpClientHelpers(f)
+	g.generateShellHelpers(f)
+	g.generateEnvHelpers(f)
+	g.generateLocaleHelpers(f)
+
+	// gRPC helper functions for native gRPC clients
+	if g.grpc {
+		g.generateGrpcHelpers(f)
+	}
+	// Query helpers for the Environment query methods
+	if g.hasClassQueries() || g.hasEnvironmentQueries() {
+		g.generateQueryIDs(f)
+	}
+	g.generateEnvironmentQueryHelpers(f)
+}
+
+// generateOpenDB generates openDB, which honors SQLITE_JSON_DB, and the
+// shared serve connection
+func (g *generator) generateOpenDB(f *jen.File) {
 	f.Func().Id("openDB").Params().Parens(jen.List(jen.Op("*").Qual("database/sql", "DB"), jen.Error())).Block(
 		jen.Id("dbPath").Op(":=").Qual("os", "Getenv").Call(jen.Lit("SQLITE_JSON_DB")),
 		jen.If(jen.Id("dbPath").Op("==").Lit("")).Block(
 			jen.List(jen.Id("home"), jen.Id("_")).Op(":=").Qual("os", "UserHomeDir").Call(),
 			jen.Id("dbPath").Op("=").Qual("path/filepath", "Join").Call(jen.Id("home"), jen.Lit(".trashtalk"), jen.Lit("instances.db")),
 		),
-		jen.Return(jen.Qual("database/sql", "Open").Call(jen.Lit("sqlite3"), jen.Id("dbPath"))),
+		jen.Return(jen.Qual("database/sql", "Open").Call(jen.Lit("sqlite3"), jen.Id("withBusyTimeout").Call(jen.Id("dbPath")))),
+	)
+	f.Line()
+	g.generateSharedDB(f)
+	g.generateStmtCache(f)
+}
+
+// generateInstanceIDHelper generates generateInstanceID
+func (g *generator) generateInstanceIDHelper(f *jen.File) {
+	f.Func().Id("generateInstanceID").Params(jen.Id("className").String()).String().Block(
+		jen.Id("uuid").Op(":=").Qual("github.com/google/uuid", "New").Call().Dot("String").Call(),
+		jen.Return(jen.Qual("strings", "ToLower").Call(jen.Id("className")).Op("+").Lit("_").Op("+").Id("uuid")),
+	)
+	f.Line()
+}
+
+// generateDeleteInstance generates deleteInstance (shared by all classes)
+func (g *generator) generateDeleteInstance(f *jen.File) {
+	f.Func().Id("deleteInstance").Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("id").String(),
+	).Error().Block(
+		jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dbExec").Call(
+			jen.Id("db"),
+			jen.Lit("DELETE FROM instances WHERE id = ?"),
+			jen.Id("id"),
+		),
+		jen.Return(jen.Err()),
 	)
 	f.Line()
+}
+
+// generateSendMessage generates sendMessage, which sends through the daemon
+// client and shells out to trash-send when there is no daemon to send to
+func (g *generator) generateSendMessage(f *jen.File) {
+	g.generateDaemonSend(f)
+
+	// Returns just string to simplify usage in expressions - a receiver's
+	// error is signaled as a TrashError, other failures answer "" as in Bash
+	f.Func().Id("sendMessage").Params(
+		jen.Id("receiver").Interface(),
+		jen.Id("selector").String(),
+		jen.Id("args").Op("...").Interface(),
+	).String().BlockFunc(func(grp *jen.Group) {
+		// Convert receiver to string
+		grp.Id("receiverStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("receiver"))
+		// Convert args to strings
+		grp.Id("strArgs").Op(":=").Make(jen.Index().String(), jen.Lit(0), jen.Len(jen.Id("args")))
+		grp.For(jen.List(jen.Id("_"), jen.Id("arg")).Op(":=").Range().Id("args")).Block(
+			jen.Id("strArgs").Op("=").Append(jen.Id("strArgs"), jen.Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("arg"))),
+		)
+		if !g.wasm {
+			grp.If(jen.List(jen.Id("resp"), jen.Id("ok")).Op(":=").Id("_sendDaemon").Call(jen.Id("receiverStr"), jen.Id("selector"), jen.Id("strArgs")), jen.Id("ok")).Block(
+				g.raiseSendError(jen.Id("resp").Dot("ExitCode"), jen.Id("resp").Dot("Error")),
+				jen.Return(jen.Id("resp").Dot("Result")),
+			)
+		}
+		grp.Add(g.suspendWork())
+		// Build command args: @ receiver selector args...
+		grp.Id("cmdArgs").Op(":=").Append(jen.Index().String().Values(jen.Id("receiverStr"), jen.Id("selector")), jen.Id("strArgs").Op("..."))
+		// Find the trashtalk dispatch script
+		grp.List(jen.Id("home"), jen.Id("_")).Op(":=").Qual("os", "UserHomeDir").Call()
+		grp.Id("dispatchScript").Op(":=").Qual("path/filepath", "Join").Call(jen.Id("home"), jen.Lit(".trashtalk"), jen.Lit("bin"), jen.Lit("trash-send"))
+		// Execute: trash-send receiver selector args...
+		grp.Id("cmd").Op(":=").Qual("os/exec", "Command").Call(jen.Id("dispatchScript"), jen.Id("cmdArgs").Op("..."))
+		if !g.exceptions {
+			grp.List(jen.Id("output"), jen.Id("_")).Op(":=").Id("cmd").Dot("Output").Call()
+		} else {
+			// The receiver's binary reports its error on stderr as "Error: Class: message"
+			grp.List(jen.Id("output"), jen.Err()).Op(":=").Id("cmd").Dot("Output").Call()
+			grp.Var().Id("exitErr").Op("*").Qual("os/exec", "ExitError")
+			grp.If(jen.Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("exitErr"))).Block(
+				g.raiseSendError(
+					jen.Id("exitErr").Dot("ExitCode").Call(),
+					jen.Qual("strings", "TrimPrefix").Call(jen.Qual("strings", "TrimSpace").Call(jen.String().Parens(jen.Id("exitErr").Dot("Stderr"))), jen.Lit("Error: ")),
+				),
+			)
+		}
+		grp.Return(jen.Qual("strings", "TrimSpace").Call(jen.String().Parens(jen.Id("output"))))
+	})
+	f.Line()
+}
+
+// generateLoadSave generates the typed loadInstance and saveInstance helpers
+func (g *generator) generateLoadSave(f *jen.File) {
+	typeName := g.typeName()
 
 	// loadInstance
-	f.Func().Id("loadInstance").Params(
+	f.Func().Id(g.fn("loadInstance")).Params(
 		jen.Id("db").Op("*").Qual("database/sql", "DB"),
 		jen.Id("id").String(),
-	).Parens(jen.List(jen.Op("*").Id(className), jen.Error())).Block(
-		jen.Var().Id("data").String(),
-		jen.Err().Op(":=").Id("db").Dot("QueryRow").Call(jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Id("id")).Dot("Scan").Call(jen.Op("&").Id("data")),
-		jen.If(jen.Err().Op("!=").Nil()).Block(
+	).Parens(jen.List(jen.Op("*").Id(typeName), jen.Error())).BlockFunc(func(grp *jen.Group) {
+		grp.Var().Id("data").String()
+		grp.Err().Op(":=").Id("_retryBusy").Call(jen.Func().Params().Error().Block(
+			jen.Return(jen.Id("dbQueryRow").Call(jen.Id("db"), jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Id("id")).Dot("Scan").Call(jen.Op("&").Id("data"))),
+		))
+		grp.If(jen.Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Nil(), jen.Err()),
-		),
-		jen.Var().Id("instance").Id(className),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("instance")), jen.Err().Op("!=").Nil()).Block(
+		)
+		grp.Var().Id("instance").Id(typeName)
+		grp.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("instance")), jen.Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Nil(), jen.Err()),
-		),
-		jen.Return(jen.Op("&").Id("instance"), jen.Nil()),
-	)
+		)
+		// Upgrade data stored by an older classVersion or class source before dispatch
+		for _, stmt := range g.migrateOnLoad(jen.Id("data")) {
+			grp.Add(stmt)
+		}
+		grp.Return(jen.Op("&").Id("instance"), jen.Nil())
+	})
 	f.Line()
 
-	// saveInstance
-	f.Func().Id("saveInstance").Params(
+	// saveInstance - optimistic write: the stored _version must still be the
+	// one that was loaded. The check and write are one statement, so SQLite
+	// applies them atomically; in a unit of work they commit or roll back
+	// with the rest of the dispatch.
+	f.Comment("saveInstance stores instance unless another process saved it since it was loaded,")
+	f.Comment("in which case it returns ErrConflict. New IDs are inserted.")
+	f.Func().Id(g.fn("saveInstance")).Params(
 		jen.Id("db").Op("*").Qual("database/sql", "DB"),
 		jen.Id("id").String(),
-		jen.Id("instance").Op("*").Id(className),
+		jen.Id("instance").Op("*").Id(typeName),
 	).Error().Block(
+		jen.Id("loaded").Op(":=").Id("instance").Dot("Version"),
+		jen.Id("instance").Dot("Version").Op("++"),
 		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("instance")),
+		jen.If(jen.Err().Op("==").Nil()).Block(
+			jen.Err().Op("=").Id("dbUpdate").Call(
+				jen.Id("db"),
+				jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrConflict"), jen.Id("id")),
+				jen.Lit("INSERT INTO instances (id, data) VALUES (?, json(?)) "+
+					"ON CONFLICT(id) DO UPDATE SET data = excluded.data "+
+					"WHERE COALESCE(json_extract(instances.data, '$._version'), 0) = ?"),
+				jen.Id("id"),
+				jen.String().Parens(jen.Id("data")),
+				jen.Id("loaded"),
+			),
+		),
 		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("instance").Dot("Version").Op("=").Id("loaded"),
 			jen.Return(jen.Err()),
 		),
-		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("db").Dot("Exec").Call(jen.Lit("INSERT OR REPLACE INTO instances (id, data) VALUES (?, json(?))"), jen.Id("id"), jen.String().Parens(jen.Id("data"))),
-		jen.Return(jen.Err()),
+		jen.Comment("The instance is clean, at its new version, once the write is committed"),
+		jen.Id("afterWork").Call(jen.Func().Params(jen.Id("committed").Bool()).Block(
+			jen.If(jen.Id("committed")).Block(
+				jen.Id("instance").Dot("dirty").Op("=").False(),
+			).Else().Block(
+				jen.Id("instance").Dot("Version").Op("=").Id("loaded"),
+			),
+		)),
+		g.recordSaved(),
+		jen.Return(jen.Nil()),
 	)
 	f.Line()
+}
 
-	// generateInstanceID - creates a UUID-based instance ID
-	f.Func().Id("generateInstanceID").Params(jen.Id("className").String()).String().Block(
-		jen.Id("uuid").Op(":=").Qual("github.com/google/uuid", "New").Call().Dot("String").Call(),
-		jen.Return(jen.Qual("strings", "ToLower").Call(jen.Id("className")).Op("+").Lit("_").Op("+").Id("uuid")),
-	)
+// generateConflictDecls generates ErrConflict
+func generateConflictDecls(f *jen.File) {
+	f.Comment("ErrConflict reports that another process saved the instance first")
+	f.Var().Id("ErrConflict").Op("=").Qual("errors", "New").Call(jen.Lit("instance modified concurrently"))
 	f.Line()
+}
+
+// generateCreateInstance generates the typed createInstance helper
+func (g *generator) generateCreateInstance(f *jen.File) {
+	typeName := g.typeName()
 
-	// createInstance - inserts a new instance into the database
-	f.Func().Id("createInstance").Params(
+	f.Func().Id(g.fn("createInstance")).Params(
 		jen.Id("db").Op("*").Qual("database/sql", "DB"),
 		jen.Id("id").String(),
-		jen.Id("instance").Op("*").Id(className),
+		jen.Id("instance").Op("*").Id(typeName),
 	).Error().Block(
 		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("instance")),
 		jen.If(jen.Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Err()),
 		),
-		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("db").Dot("Exec").Call(
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("dbExec").Call(
+			jen.Id("db"),
 			jen.Lit("INSERT INTO instances (id, data) VALUES (?, json(?))"),
 			jen.Id("id"),
 			jen.String().Parens(jen.Id("data")),
 		),
+		g.createRecordSaved(),
 		jen.Return(jen.Err()),
 	)
 	f.Line()
-
-	// deleteInstance - removes an instance from the database
-	f.Func().Id("deleteInstance").Params(
-		jen.Id("db").Op("*").Qual("database/sql", "DB"),
-		jen.Id("id").String(),
-	).Error().Block(
-		jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("db").Dot("Exec").Call(
-			jen.Lit("DELETE FROM instances WHERE id = ?"),
-			jen.Id("id"),
-		),
-		jen.Return(jen.Err()),
-	)
-	f.Line()
-
-	// sendMessage - shell out to bash runtime for non-self message sends
-	// Returns just string - errors are silently ignored to match bash behavior and simplify usage in expressions
-	f.Func().Id("sendMessage").Params(
-		jen.Id("receiver").Interface(),
-		jen.Id("selector").String(),
-		jen.Id("args").Op("...").Interface(),
-	).String().Block(
-		// Convert receiver to string
-		jen.Id("receiverStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("receiver")),
-		// Build command args: @ receiver selector args...
-		jen.Id("cmdArgs").Op(":=").Index().String().Values(jen.Id("receiverStr"), jen.Id("selector")),
-		jen.For(jen.List(jen.Id("_"), jen.Id("arg")).Op(":=").Range().Id("args")).Block(
-			jen.Id("cmdArgs").Op("=").Append(jen.Id("cmdArgs"), jen.Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("arg"))),
-		),
-		// Find the trashtalk dispatch script
-		jen.List(jen.Id("home"), jen.Id("_")).Op(":=").Qual("os", "UserHomeDir").Call(),
-		jen.Id("dispatchScript").Op(":=").Qual("path/filepath", "Join").Call(jen.Id("home"), jen.Lit(".trashtalk"), jen.Lit("bin"), jen.Lit("trash-send")),
-		// Execute: trash-send receiver selector args...
-		jen.Id("cmd").Op(":=").Qual("os/exec", "Command").Call(jen.Id("dispatchScript"), jen.Id("cmdArgs").Op("...")),
-		jen.List(jen.Id("output"), jen.Id("_")).Op(":=").Id("cmd").Dot("Output").Call(),
-		jen.Return(jen.Qual("strings", "TrimSpace").Call(jen.String().Parens(jen.Id("output")))),
-	)
-	f.Line()
-
-	// runServeMode - daemon mode that reads JSON requests from stdin
-	g.generateServeMode(f)
-	f.Line()
-
-	// JSON primitive helper functions
-	g.generateJSONHelpers(f)
-
-	// String/File primitive helper functions
-	g.generateStringFileHelpers(f)
-
-	// gRPC helper functions for GrpcClient class
-	if g.class.Name == "GrpcClient" {
-		g.generateGrpcHelpers(f)
-	}
 }
 
 // generateTypeHelpers generates helper functions for type conversion in iteration blocks
@@ -505,15 +859,22 @@ func (g *generator) generateTypeHelpers(f *jen.File) {
 			jen.Case(jen.Int()).Block(jen.Return(jen.Id("x"))),
 			jen.Case(jen.Int64()).Block(jen.Return(jen.Int().Parens(jen.Id("x")))),
 			jen.Case(jen.Float64()).Block(jen.Return(jen.Int().Parens(jen.Id("x")))),
+			jen.Case(jen.Qual("encoding/json", "Number")).Block(jen.Return(jen.Id("toInt").Call(jen.String().Parens(jen.Id("x"))))),
 			jen.Case(jen.String()).Block(
-				jen.List(jen.Id("n"), jen.Id("_")).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("x")),
-				jen.Return(jen.Id("n")),
+				jen.If(jen.List(jen.Id("n"), jen.Id("ok")).Op(":=").Id("toNum").Call(jen.Id("x")).Assert(jen.Int()), jen.Id("ok")).Block(
+					jen.Return(jen.Id("n")),
+				),
+				jen.Comment("Decimal strings truncate like float64 values"),
+				jen.Return(jen.Int().Parens(jen.Id("toFloat").Call(jen.Id("x")))),
 			),
 			jen.Default().Block(jen.Return(jen.Lit(0))),
 		),
 	)
 	f.Line()
 
+	generateNumericHelpers(f)
+	generateCompareHelpers(f)
+
 	// toBool converts interface{} to bool for predicates
 	f.Comment("// toBool converts interface{} to bool for predicates in iteration blocks")
 	f.Func().Id("toBool").Params(jen.Id("v").Interface()).Bool().Block(
@@ -521,6 +882,7 @@ func (g *generator) generateTypeHelpers(f *jen.File) {
 			jen.Case(jen.Bool()).Block(jen.Return(jen.Id("x"))),
 			jen.Case(jen.Int()).Block(jen.Return(jen.Id("x").Op("!=").Lit(0))),
 			jen.Case(jen.String()).Block(jen.Return(jen.Id("x").Op("!=").Lit(""))),
+			jen.Case(jen.Qual("encoding/json", "Number")).Block(jen.Return(jen.Id("toFloat").Call(jen.Id("x")).Op("!=").Lit(0))),
 			jen.Default().Block(jen.Return(jen.Id("v").Op("!=").Nil())),
 		),
 	)
@@ -564,6 +926,7 @@ func (g *generator) generateTypeHelpers(f *jen.File) {
 			),
 		),
 		jen.Line(),
+		g.suspendWork(),
 		jen.Id("cmd").Op(":=").Qual("os/exec", "Command").Call(jen.Lit("bash"), jen.Lit("-c"), jen.Id("cmdStr")),
 		jen.List(jen.Id("output"), jen.Id("_")).Op(":=").Id("cmd").Dot("Output").Call(),
 		jen.Return(jen.Qual("strings", "TrimSpace").Call(jen.String().Parens(jen.Id("output")))),
@@ -574,6 +937,7 @@ func (g *generator) generateTypeHelpers(f *jen.File) {
 // generateServeMode generates the daemon loop that reads JSON from stdin
 func (g *generator) generateServeMode(f *jen.File) {
 	className := g.class.Name
+	typeName := g.typeName()
 	qualifiedName := g.class.QualifiedName()
 
 	// Request/Response structs
@@ -583,16 +947,21 @@ func (g *generator) generateServeMode(f *jen.File) {
 		jen.Id("Instance").String().Tag(map[string]string{"json": "instance"}),
 		jen.Id("Selector").String().Tag(map[string]string{"json": "selector"}),
 		jen.Id("Args").Index().String().Tag(map[string]string{"json": "args"}),
+		g.storageRequestField(),
+		g.historyRequestField(),
+		strictRequestField(),
+		tokenRequestField(),
 	)
 	f.Line()
 
 	f.Comment("// ServeResponse is the JSON response format for --serve mode")
-	f.Type().Id("ServeResponse").Struct(
+	responseFields := []jen.Code{
 		jen.Id("Instance").String().Tag(map[string]string{"json": "instance,omitempty"}),
 		jen.Id("Result").String().Tag(map[string]string{"json": "result,omitempty"}),
 		jen.Id("ExitCode").Int().Tag(map[string]string{"json": "exit_code"}),
 		jen.Id("Error").String().Tag(map[string]string{"json": "error,omitempty"}),
-	)
+	}
+	f.Type().Id("ServeResponse").Struct(append(responseFields, g.storageResponseFields()...)...)
 	f.Line()
 
 	f.Func().Id("runServeMode").Params().Block(
@@ -603,6 +972,8 @@ func (g *generator) generateServeMode(f *jen.File) {
 			jen.Qual("os", "Exit").Call(jen.Lit(1)),
 		),
 		jen.Defer().Id("db").Dot("Close").Call(),
+		jen.Id("sharedDB").Op("=").Id("db"),
+		g.ensureIndexesOn(jen.Id("db")),
 		jen.Line(),
 
 		// Scanner for reading lines from stdin
@@ -610,6 +981,7 @@ func (g *generator) generateServeMode(f *jen.File) {
 		jen.Comment("// Increase buffer for large instance JSON"),
 		jen.Id("buf").Op(":=").Make(jen.Index().Byte(), jen.Lit(1024*1024)),
 		jen.Id("scanner").Dot("Buffer").Call(jen.Id("buf"), jen.Len(jen.Id("buf"))),
+		jen.Id("strict").Op(":=").False(),
 		jen.Line(),
 
 		// Main loop
@@ -619,8 +991,9 @@ func (g *generator) generateServeMode(f *jen.File) {
 			jen.Line(),
 
 			jen.Var().Id("req").Id("ServeRequest"),
-			jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
-				jen.Index().Byte().Parens(jen.Id("line")),
+			jen.If(jen.Err().Op(":=").Id("decodeServeRequest").Call(
+				jen.Id("line"),
+				jen.Op("&").Id("strict"),
 				jen.Op("&").Id("req"),
 			).Op(";").Err().Op("!=").Nil()).Block(
 				jen.Id("respond").Call(jen.Id("ServeResponse").Values(jen.Dict{
@@ -631,7 +1004,9 @@ func (g *generator) generateServeMode(f *jen.File) {
 			),
 			jen.Line(),
 
-			jen.Id("resp").Op(":=").Id("handleServeRequest").Call(jen.Id("db"), jen.Op("&").Id("req")),
+			g.storageSeed(),
+			jen.Id("resp").Op(":=").Add(g.serveHandler()).Call(jen.Id("db"), jen.Op("&").Id("req")),
+			g.storageFlush(),
 			jen.Id("respond").Call(jen.Id("resp")),
 		),
 	)
@@ -644,23 +1019,33 @@ func (g *generator) generateServeMode(f *jen.File) {
 	)
 	f.Line()
 
+	// decodeServeRequest - lenient, or strict once a request asks for it
+	generateStrictDecode(f)
+
+	// handleServeWork - a request as one unit of work (SQLite only)
+	g.generateServeWork(f)
+
 	// handleServeRequest - dispatch a single request
 	f.Func().Id("handleServeRequest").Params(
-		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("db").Add(g.dbType()),
 		jen.Id("req").Op("*").Id("ServeRequest"),
 	).Id("ServeResponse").Block(
+		g.serveAsOf(),
 		// Check for class method call (empty instance or class name)
 		jen.If(jen.Id("req").Dot("Instance").Op("==").Lit("").Op("||").
-			Id("req").Dot("Instance").Op("==").Lit(className).Op("||").
-			Id("req").Dot("Instance").Op("==").Lit(qualifiedName)).Block(
-			jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("dispatchClass").Call(
+			Add(isClassReceiver(jen.Id("req").Dot("Instance"), className, qualifiedName))).Block(
+			g.serveFallbackStats(),
+			jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatchClass")).Call(
 				jen.Id("req").Dot("Selector"),
 				jen.Id("req").Dot("Args"),
 			),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+					g.recordFallback(jen.Id("db"), jen.Id("req").Dot("Selector")),
 					jen.Return(jen.Id("ServeResponse").Values(jen.Dict{jen.Id("ExitCode"): jen.Lit(200)})),
 				),
+				g.trashErrorResponse(),
+				storageBusyResponse(),
 				jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
 					jen.Id("ExitCode"): jen.Lit(1),
 					jen.Id("Error"):    jen.Err().Dot("Error").Call(),
@@ -674,7 +1059,7 @@ func (g *generator) generateServeMode(f *jen.File) {
 		jen.Line(),
 
 		// Instance method - parse instance from JSON
-		jen.Var().Id("instance").Id(className),
+		jen.Var().Id("instance").Id(typeName),
 		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
 			jen.Index().Byte().Parens(jen.Id("req").Dot("Instance")),
 			jen.Op("&").Id("instance"),
@@ -684,19 +1069,24 @@ func (g *generator) generateServeMode(f *jen.File) {
 				jen.Id("Error"):    jen.Lit("invalid instance JSON: ").Op("+").Err().Dot("Error").Call(),
 			})),
 		),
+		g.pluginMigrate(jen.Id("req").Dot("Instance")),
 		jen.Line(),
 
 		// Dispatch to instance method (pass instance ID for primitives)
-		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("dispatch").Call(
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatch")).Call(
 			jen.Op("&").Id("instance"),
 			jen.Id("req").Dot("InstanceID"),
 			jen.Id("req").Dot("Selector"),
 			jen.Id("req").Dot("Args"),
 		),
+		g.serveForwardUnknown(),
 		jen.If(jen.Err().Op("!=").Nil()).Block(
 			jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+				g.recordFallback(jen.Id("db"), jen.Id("req").Dot("Selector")),
 				jen.Return(jen.Id("ServeResponse").Values(jen.Dict{jen.Id("ExitCode"): jen.Lit(200)})),
 			),
+			g.trashErrorResponse(),
+			storageBusyResponse(),
 			jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
 				jen.Id("ExitCode"): jen.Lit(1),
 				jen.Id("Error"):    jen.Err().Dot("Error").Call(),
@@ -707,6 +1097,7 @@ func (g *generator) generateServeMode(f *jen.File) {
 		// Handle delete specially
 		jen.If(jen.Id("req").Dot("Selector").Op("==").Lit("delete")).Block(
 			jen.If(jen.Err().Op(":=").Id("deleteInstance").Call(jen.Id("db"), jen.Id("req").Dot("InstanceID")), jen.Err().Op("!=").Nil()).Block(
+				storageBusyResponse(),
 				jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
 					jen.Id("ExitCode"): jen.Lit(1),
 					jen.Id("Error"):    jen.Err().Dot("Error").Call(),
@@ -740,6 +1131,11 @@ func (g *generator) preIdentifySkippedMethods() {
 			willSkip = true
 		}
 
+		// Left out by Options.Only or Options.Skip
+		if g.deselected(m.Selector) != "" {
+			willSkip = true
+		}
+
 		// Raw methods (unless primitive or has procyon pragma)
 		if m.Raw && !m.Primitive && !m.HasPragma("procyonOnly") && !m.HasPragma("procyonNative") {
 			willSkip = true
@@ -750,11 +1146,26 @@ func (g *generator) preIdentifySkippedMethods() {
 			willSkip = true
 		}
 
+		// Class instance variables kept only through SQLite
+		if g.classVarsUnavailable(m) {
+			willSkip = true
+		}
+
+		// Advice that cannot be compiled
+		if g.adviceUnsupported(m) != "" {
+			willSkip = true
+		}
+
+		// Primitives needing an undeclared capability
+		if g.undeclaredCapability(&m) != "" {
+			willSkip = true
+		}
+
 		// Check for bash-specific function calls
 		for _, tok := range m.Body.Tokens {
 			if tok.Type == "IDENTIFIER" {
 				switch tok.Value {
-				case "_ivar", "_ivar_set", "_throw", "_on_error", "_ensure", "_pop_handler":
+				case "_ivar", "_ivar_set", "_on_error", "_ensure", "_pop_handler":
 					willSkip = true
 					break
 				}
@@ -773,17 +1184,31 @@ func (g *generator) preIdentifySkippedMethods() {
 			g.skippedMethods[m.Selector] = true
 		}
 	}
+	g.identifyAbstractMethods()
 }
 
 func (g *generator) compileMethods() []*compiledMethod {
 	var compiled []*compiledMethod
 
 	for _, m := range g.class.Methods {
+		// Skip methods left out by Options.Only or Options.Skip
+		if reason := g.deselected(m.Selector); reason != "" {
+			g.skipped = append(g.skipped, SkippedMethod{
+				Selector: m.Selector,
+				Reason:   reason,
+				Line:     m.Location.Line,
+				Location: m.Location,
+			})
+			continue
+		}
+
 		// Skip bashOnly methods - they should only run in Bash
 		if m.HasPragma("bashOnly") {
 			g.skipped = append(g.skipped, SkippedMethod{
 				Selector: m.Selector,
 				Reason:   "bashOnly pragma",
+				Line:     m.Location.Line,
+				Location: m.Location,
 			})
 			continue
 		}
@@ -796,6 +1221,32 @@ func (g *generator) compileMethods() []*compiledMethod {
 			g.skipped = append(g.skipped, SkippedMethod{
 				Selector: m.Selector,
 				Reason:   "raw method",
+				Line:     m.Location.Line,
+				Location: m.Location,
+			})
+			continue
+		}
+
+		// The advice runs around the method in dispatch, so a method whose
+		// advice cannot be compiled runs in Bash with it
+		if reason := g.adviceUnsupported(m); reason != "" {
+			g.skipped = append(g.skipped, SkippedMethod{
+				Selector: m.Selector,
+				Reason:   reason,
+				Line:     m.Location.Line,
+				Location: m.Location,
+			})
+			continue
+		}
+
+		// Methods reaching outside the instance store need the capability
+		// declared, so that the plugin's GetCapabilities covers them
+		if reason := g.undeclaredCapability(&m); reason != "" {
+			g.skipped = append(g.skipped, SkippedMethod{
+				Selector: m.Selector,
+				Reason:   reason,
+				Line:     m.Location.Line,
+				Location: m.Location,
 			})
 			continue
 		}
@@ -806,7 +1257,7 @@ func (g *generator) compileMethods() []*compiledMethod {
 			if hasPrimitiveImpl(g.class.Name, m.Selector) {
 				compiled = append(compiled, &compiledMethod{
 					selector:    m.Selector,
-					goName:      selectorToGoName(m.Selector),
+					goName:      mangle.GoName(m.Selector),
 					args:        m.Args,
 					body:        nil, // No parsed body - native impl provided
 					hasReturn:   true,
@@ -814,6 +1265,9 @@ func (g *generator) compileMethods() []*compiledMethod {
 					returnsErr:  true,
 					primitive:   true,
 					renamedVars: make(map[string]string),
+					line:        m.Location.Line,
+					col:         m.Location.Col,
+					trait:       m.Trait,
 				})
 			} else {
 				// No native impl registered - warn but still fall back to bash
@@ -823,24 +1277,39 @@ func (g *generator) compileMethods() []*compiledMethod {
 				g.skipped = append(g.skipped, SkippedMethod{
 					Selector: m.Selector,
 					Reason:   "primitive method without native implementation",
+					Line:     m.Location.Line,
+					Location: m.Location,
 				})
 			}
 			continue
 		}
 
-		// For GrpcClient procyonNative methods, skip body parsing entirely -
+		// For gRPC client procyonNative methods, skip body parsing entirely -
 		// these raw methods contain Bash code that won't parse, but
 		// generateGrpcClientMethod() will provide native implementations
-		if g.class.Name == "GrpcClient" && m.HasPragma("procyonNative") {
+		if g.grpc && m.HasPragma("procyonNative") {
 			compiled = append(compiled, &compiledMethod{
 				selector:    m.Selector,
-				goName:      selectorToGoName(m.Selector),
+				goName:      mangle.GoName(m.Selector),
 				args:        m.Args,
 				body:        nil, // No parsed body - native impl provided
 				hasReturn:   true,
 				isClass:     m.Kind == "class",
 				returnsErr:  true,
 				renamedVars: make(map[string]string),
+				line:        m.Location.Line,
+				col:         m.Location.Col,
+				trait:       m.Trait,
+			})
+			continue
+		}
+
+		if g.classVarsUnavailable(m) {
+			g.skipped = append(g.skipped, SkippedMethod{
+				Selector: m.Selector,
+				Reason:   "class instance variables need the SQLite helpers",
+				Line:     m.Location.Line,
+				Location: m.Location,
 			})
 			continue
 		}
@@ -850,10 +1319,12 @@ func (g *generator) compileMethods() []*compiledMethod {
 		for _, tok := range m.Body.Tokens {
 			if tok.Type == "IDENTIFIER" {
 				switch tok.Value {
-				case "_ivar", "_ivar_set", "_throw", "_on_error", "_ensure", "_pop_handler":
+				case "_ivar", "_ivar_set", "_on_error", "_ensure", "_pop_handler":
 					g.skipped = append(g.skipped, SkippedMethod{
 						Selector: m.Selector,
 						Reason:   "uses bash runtime function: " + tok.Value,
+						Line:     m.Location.Line,
+						Location: tokenLocation(tok.Line, tok.Col, m.Location),
 					})
 					hasBashRuntimeCall = true
 					break
@@ -870,6 +1341,29 @@ func (g *generator) compileMethods() []*compiledMethod {
 			g.skipped = append(g.skipped, SkippedMethod{
 				Selector: m.Selector,
 				Reason:   result.Reason,
+				Line:     m.Location.Line,
+				Location: tokenLocation(result.Line, result.Col, m.Location),
+			})
+			continue
+		}
+
+		if reason := g.checkUndefinedVars(m, result.Body); reason != "" {
+			g.skipped = append(g.skipped, SkippedMethod{
+				Selector: m.Selector,
+				Reason:   reason,
+				Line:     m.Location.Line,
+				Location: m.Location,
+			})
+			continue
+		}
+
+		blockVars, reason := findBlockVars(result.Body)
+		if reason != "" {
+			g.skipped = append(g.skipped, SkippedMethod{
+				Selector: m.Selector,
+				Reason:   reason,
+				Line:     m.Location.Line,
+				Location: m.Location,
 			})
 			continue
 		}
@@ -882,38 +1376,49 @@ func (g *generator) compileMethods() []*compiledMethod {
 
 		compiled = append(compiled, &compiledMethod{
 			selector:    m.Selector,
-			goName:      selectorToGoName(m.Selector),
+			goName:      mangle.GoName(m.Selector),
 			args:        m.Args,
 			body:        result.Body,
 			hasReturn:   hasReturn,
 			isClass:     m.Kind == "class",
 			returnsErr:  returnsErr,
 			renamedVars: make(map[string]string),
+			argTypes:    m.ArgTypes,
+			blockVars:   blockVars,
+			line:        m.Location.Line,
+			col:         m.Location.Col,
+			trait:       m.Trait,
 		})
 	}
 
+	// Class methods are package-level functions; prefix them so that
+	// several classes can share one package in bundle mode
+	for _, cm := range compiled {
+		if cm.isClass {
+			cm.goName = g.fn(cm.goName)
+		}
+	}
+
+	g.attachAdvice(compiled)
+	g.initializers = g.initializerHooks(compiled)
+
 	return compiled
 }
 
 func (g *generator) generateDispatch(f *jen.File, methods []*compiledMethod) {
-	className := g.class.Name
+	typeName := g.typeName()
 	qualifiedName := g.class.QualifiedName()
 
 	// Built-in primitive cases for Object methods
-	cases := []jen.Code{
+	cases := []dispatchCase{
 		// class - returns the class name
-		jen.Case(jen.Lit("class")).Block(
-			jen.Return(jen.Lit(qualifiedName), jen.Nil()),
-		),
+		{"class", []jen.Code{jen.Return(jen.Lit(qualifiedName), jen.Nil())}},
 		// id - returns the instance ID
-		jen.Case(jen.Lit("id")).Block(
-			jen.Return(jen.Id("instanceID"), jen.Nil()),
-		),
+		{"id", []jen.Code{jen.Return(jen.Id("instanceID"), jen.Nil())}},
 		// delete - signals deletion (actual deletion handled by caller)
-		jen.Case(jen.Lit("delete")).Block(
-			jen.Return(jen.Id("instanceID"), jen.Nil()),
-		),
+		g.deleteDispatchCase(methods),
 	}
+	cases = append(cases, g.refDispatchCases()...)
 
 	for _, m := range methods {
 		// Check if method name was renamed to avoid collision with ivar
@@ -922,72 +1427,23 @@ func (g *generator) generateDispatch(f *jen.File, methods []*compiledMethod) {
 		if !m.isClass && g.instanceVars[m.selector] {
 			methodName = "Get" + methodName
 		}
-
-		var callExpr *jen.Statement
-		if len(m.args) > 0 {
-			// Check args length
-			argCheck := jen.If(jen.Len(jen.Id("args")).Op("<").Lit(len(m.args))).Block(
-				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(m.selector+" requires "+fmt.Sprintf("%d", len(m.args))+" argument"))),
-			)
-
-			// Build call with args
-			callArgs := []jen.Code{}
-			for i := range m.args {
-				callArgs = append(callArgs, jen.Id("args").Index(jen.Lit(i)))
-			}
-			callExpr = jen.Id("c").Dot(methodName).Call(callArgs...)
-
-			if m.returnsErr {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr),
-				))
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr, jen.Nil()),
-				))
-			}
-		} else {
-			callExpr = jen.Id("c").Dot(methodName).Call()
-			if m.hasReturn {
-				if m.returnsErr {
-					// Method returns (string, error) - don't add extra nil
-					cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-						jen.Return(callExpr),
-					))
-				} else {
-					// Method returns string only - add nil for error
-					cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-						jen.Return(callExpr, jen.Nil()),
-					))
-				}
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					callExpr,
-					jen.Return(jen.Lit(""), jen.Nil()),
-				))
-			}
-		}
+		cases = append(cases, methodDispatchCase(m, jen.Id("c").Dot(methodName).Call))
 	}
-
-	// Default case
-	cases = append(cases, jen.Default().Block(
-		jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrUnknownSelector"), jen.Id("selector"))),
-	))
-
-	f.Func().Id("dispatch").Params(
-		jen.Id("c").Op("*").Id(className),
-		jen.Id("instanceID").String(),
-		jen.Id("selector").String(),
-		jen.Id("args").Index().String(),
-	).Parens(jen.List(jen.String(), jen.Error())).Block(
-		jen.Switch(jen.Id("selector")).Block(cases...),
-	)
+	cases = append(cases, g.abstractDispatchCases()...)
+	cases = append(cases, g.accessorDispatchCases()...)
+	cases = append(cases, g.printingCases(cases, jen.Id("instanceID"))...)
+	cases = append(cases, g.copyCases(cases)...)
+	cases = append(cases, g.introspectionCases(cases, false)...)
+
+	g.generateDispatchFunc(f, g.fn("dispatch"), []dispatchParam{
+		{"c", jen.Op("*").Id(typeName)},
+		{"instanceID", jen.String()},
+	}, cases)
 }
 
 func (g *generator) generateClassDispatch(f *jen.File, methods []*compiledMethod) {
 	className := g.class.Name
+	typeName := g.typeName()
 	qualifiedName := g.class.QualifiedName()
 
 	// Build struct initialization with default values for "new" primitive
@@ -996,94 +1452,72 @@ func (g *generator) generateClassDispatch(f *jen.File, methods []*compiledMethod
 		jen.Id("CreatedAt"): jen.Qual("time", "Now").Call().Dot("Format").Call(jen.Qual("time", "RFC3339")),
 	}
 	for _, iv := range g.class.InstanceVars {
-		goName := capitalize(iv.Name)
-		val := iv.Default.Value
-		// All instance variables are strings (JSON representations for arrays/objects)
-		structFields[jen.Id(goName)] = jen.Lit(val)
+		structFields[jen.Id(capitalize(iv.Name))] = g.ivarDefault(iv)
+	}
+	if g.versioned() {
+		structFields[jen.Id("ClassVersion")] = jen.Lit(g.class.ClassVersion)
+	}
+	if g.schemaMigrate {
+		structFields[jen.Id("ContentHash")] = jen.Id("_contentHash")
 	}
 
 	// "new" primitive case - creates and persists a new instance
-	cases := []jen.Code{
-		jen.Case(jen.Lit("new")).Block(
+	cases := []dispatchCase{
+		{"new", []jen.Code{
 			jen.Id("id").Op(":=").Id("generateInstanceID").Call(jen.Lit(className)),
-			jen.Id("instance").Op(":=").Op("&").Id(className).Values(structFields),
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+			jen.Id("instance").Op(":=").Op("&").Id(typeName).Values(structFields),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
-			jen.If(jen.Err().Op(":=").Id("createInstance").Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+			g.initializeNative(),
+			jen.If(jen.Err().Op(":=").Id(g.fn("createInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
+			g.initializeFallback(),
 			jen.Return(jen.Id("id"), jen.Nil()),
-		),
+		}},
+	}
+	if newCase, ok := g.abstractNewCase(); ok {
+		cases[0] = newCase
 	}
 
+	// Class methods are package-level functions
 	for _, m := range methods {
-		var callExpr *jen.Statement
-		if len(m.args) > 0 {
-			// Check args length
-			argCheck := jen.If(jen.Len(jen.Id("args")).Op("<").Lit(len(m.args))).Block(
-				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(m.selector+" requires "+fmt.Sprintf("%d", len(m.args))+" argument"))),
-			)
-
-			// Build call with args - class methods are package-level functions
-			callArgs := []jen.Code{}
-			for i := range m.args {
-				callArgs = append(callArgs, jen.Id("args").Index(jen.Lit(i)))
-			}
-			callExpr = jen.Id(m.goName).Call(callArgs...)
-
-			if m.returnsErr {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr),
-				))
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr, jen.Nil()),
-				))
-			}
-		} else {
-			// No args - direct call to package-level function
-			callExpr = jen.Id(m.goName).Call()
-			if m.returnsErr {
-				// Function already returns (string, error)
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					jen.Return(callExpr),
-				))
-			} else if m.hasReturn {
-				// Function returns only a value, wrap with nil error
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					jen.Return(callExpr, jen.Nil()),
-				))
-			} else {
-				// No return - call and return empty
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					callExpr,
-					jen.Return(jen.Lit(""), jen.Nil()),
-				))
-			}
-		}
+		cases = append(cases, methodDispatchCase(m, jen.Id(m.goName).Call))
 	}
-
-	// Default case
-	cases = append(cases, jen.Default().Block(
-		jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrUnknownSelector"), jen.Id("selector"))),
-	))
+	cases = append(cases, g.classQueryCases(methods)...)
+	if g.hasClassVars() {
+		cases = append(cases, g.classVarAccessorCases(methods)...)
+	}
+	cases = append(cases, g.introspectionCases(cases, true)...)
 
 	// dispatchClass takes no instance receiver
-	f.Func().Id("dispatchClass").Params(
-		jen.Id("selector").String(),
-		jen.Id("args").Index().String(),
-	).Parens(jen.List(jen.String(), jen.Error())).Block(
-		jen.Switch(jen.Id("selector")).Block(cases...),
-	)
+	if !g.hasClassVars() {
+		g.generateDispatchFunc(f, g.fn("dispatchClass"), nil, cases)
+		return
+	}
+	g.generateDispatchFunc(f, g.fn("dispatchClassMethod"), nil, cases)
+	f.Line()
+	g.generateClassVarsDispatch(f, g.fn("dispatchClassMethod"))
 }
 
 func (g *generator) generateMethod(f *jen.File, m *compiledMethod) {
-	className := g.class.Name
+	typeName := g.typeName()
+
+	// Advice follows the method it runs around
+	defer g.generateAdviceMethods(f, m)
+
+	// Check if method name collides with an instance variable (Go doesn't allow this)
+	// If it's a simple getter (no args, returns the ivar), rename to Get<Name>
+	methodName := m.goName
+	if !m.isClass && g.instanceVars[strings.ToLower(m.selector)] {
+		// Method name matches an ivar - rename to avoid Go collision
+		methodName = "Get" + methodName
+	}
+	m.funcName = methodName
+	g.methodComment(f, m, methodName)
 
 	// Special handling for Environment class - generate SQLite-based storage methods
 	if g.class.Name == "Environment" && m.isClass {
@@ -1091,8 +1525,8 @@ func (g *generator) generateMethod(f *jen.File, m *compiledMethod) {
 		return
 	}
 
-	// Special handling for GrpcClient class - wire methods to gRPC helpers
-	if g.class.Name == "GrpcClient" && !m.isClass {
+	// Special handling for native gRPC clients - wire methods to gRPC helpers
+	if g.grpc && !m.isClass {
 		if g.generateGrpcClientMethod(f, m) {
 			return
 		}
@@ -1105,14 +1539,6 @@ func (g *generator) generateMethod(f *jen.File, m *compiledMethod) {
 		}
 	}
 
-	// Check if method name collides with an instance variable (Go doesn't allow this)
-	// If it's a simple getter (no args, returns the ivar), rename to Get<Name>
-	methodName := m.goName
-	if !m.isClass && g.instanceVars[strings.ToLower(m.selector)] {
-		// Method name matches an ivar - rename to avoid Go collision
-		methodName = "Get" + methodName
-	}
-
 	// Build parameter list (sanitize Go keywords)
 	params := []jen.Code{}
 	for _, arg := range m.args {
@@ -1120,7 +1546,7 @@ func (g *generator) generateMethod(f *jen.File, m *compiledMethod) {
 		if safeName != arg {
 			m.renamedVars[arg] = safeName
 		}
-		params = append(params, jen.Id(safeName).String())
+		params = append(params, jen.Id(safeName).Add(argGoType(m.argTypes[arg])))
 	}
 
 	// Determine return type
@@ -1144,9 +1570,9 @@ func (g *generator) generateMethod(f *jen.File, m *compiledMethod) {
 	} else {
 		// Instance methods have receiver
 		if returnType != nil {
-			f.Func().Parens(jen.Id("c").Op("*").Id(className)).Id(methodName).Params(params...).Add(returnType).Block(body...)
+			f.Func().Parens(jen.Id("c").Op("*").Id(typeName)).Id(methodName).Params(params...).Add(returnType).Block(body...)
 		} else {
-			f.Func().Parens(jen.Id("c").Op("*").Id(className)).Id(methodName).Params(params...).Block(body...)
+			f.Func().Parens(jen.Id("c").Op("*").Id(typeName)).Id(methodName).Params(params...).Block(body...)
 		}
 	}
 	f.Line()
@@ -1165,6 +1591,10 @@ func (g *generator) generateMethodBody(m *compiledMethod) []jen.Code {
 		if safeName != v {
 			m.renamedVars[v] = safeName
 		}
+		if arity, ok := m.blockVars[v]; ok {
+			stmts = append(stmts, jen.Var().Id(safeName).Add(blockFuncType(arity)))
+			continue
+		}
 		stmts = append(stmts, jen.Var().Id(safeName).Interface())
 	}
 
@@ -1185,63 +1615,51 @@ func (g *generator) generateStatement(stmt parser.Statement, m *compiledMethod)
 	switch s := stmt.(type) {
 	case *parser.Assignment:
 		target := s.Target
+		// x := items inject: 0 into: [...]
+		switch v := s.Value.(type) {
+		case *parser.IterationExprAsValue:
+			return g.generateIterationAssignment(target, g.generateIterationStatement(v.Iteration, m), v.Iteration.Kind, m)
+		case *parser.DynamicIterationExprAsValue:
+			return g.generateIterationAssignment(target, g.generateDynamicIterationStatement(v.Iteration, m), v.Iteration.Kind, m)
+		}
+		if g.isClassVar(target, m) {
+			return g.generateClassVarsAssignment(target, s.Value, m)
+		}
+		if g.typedArg(target, m) != "" {
+			return g.typedArgAssignment(target, s.Value, m)
+		}
+		if g.typedIvar(target, m) != "" {
+			return g.typedIvarAssignment(target, s.Value, m)
+		}
 		// Check if it's an instance variable (string typed)
 		if g.instanceVars[target] {
-			// For instance variables, we need string values
-			var expr *jen.Statement
-			switch v := s.Value.(type) {
-			case *parser.Identifier:
-				// Check if value is a method arg - use original string param
-				isMethodArg := false
-				for _, arg := range m.args {
-					if arg == v.Name {
-						isMethodArg = true
-						break
-					}
-				}
-				if isMethodArg {
-					// Use renamed parameter name if it conflicted with Go keyword
-					paramName := v.Name
-					if renamed, ok := m.renamedVars[v.Name]; ok {
-						paramName = renamed
-					}
-					expr = jen.Id(paramName)
-				} else if g.instanceVars[v.Name] {
-					// Assigning one ivar to another - already a string
-					expr = g.generateExpr(s.Value, m)
-				} else {
-					// Local variable - need to convert to string
-					expr = jen.Id("_toStr").Call(g.generateExpr(s.Value, m))
+			// value := value + 1 updates the integer in place
+			if step, ok := ivarIncrement(target, s.Value); ok && !m.isClass && !g.jsonVars[target] {
+				return []jen.Code{
+					jen.Id("c").Dot(capitalize(target)).Op("=").Id("_addInt").Call(jen.Id("c").Dot(capitalize(target)), jen.Lit(step)),
+					jen.Id("c").Dot("dirty").Op("=").True(),
 				}
-			case *parser.BinaryExpr:
-				if v.Op == "," {
-					// String concatenation - already returns string
-					expr = g.generateExpr(s.Value, m)
-				} else {
-					// Arithmetic expression - result is int, need to convert to string
-					expr = jen.Qual("strconv", "Itoa").Call(g.generateExpr(s.Value, m))
-				}
-			case *parser.StringLit:
-				// String literal - already a string
-				expr = g.generateExpr(s.Value, m)
-			case *parser.JSONPrimitiveExpr:
-				// JSON primitives return strings
-				expr = g.generateExpr(s.Value, m)
-			case *parser.MessageSend:
-				// Message sends return strings
-				expr = g.generateExpr(s.Value, m)
-			default:
-				// Default: wrap in _toStr for safety
-				expr = jen.Id("_toStr").Call(g.generateExpr(s.Value, m))
 			}
+			// For instance variables, we need string values
+			expr := g.generateStringValue(s.Value, m)
 			// JSON vars need to be wrapped in json.RawMessage
 			if g.jsonVars[target] {
+				g.checkJSONLiteral(s.Value, "", m)
 				expr = jen.Qual("encoding/json", "RawMessage").Parens(expr)
 			}
-			return []jen.Code{jen.Id("c").Dot(capitalize(target)).Op("=").Add(expr)}
+			return []jen.Code{
+				jen.Id("c").Dot(capitalize(target)).Op("=").Add(expr),
+				jen.Id("c").Dot("dirty").Op("=").True(),
+			}
 		}
 		// For local variables
-		expr := g.generateExpr(s.Value, m)
+		var expr *jen.Statement
+		if _, isBlockVar := m.blockVars[target]; isBlockVar {
+			block, _ := s.Value.(*parser.BlockExpr) // findBlockVars only allows literals
+			expr = g.generateBlockClosure(block, m)
+		} else {
+			expr = g.generateExpr(s.Value, m)
+		}
 		// Check if target was renamed to avoid Go builtin conflict
 		if renamed, ok := m.renamedVars[target]; ok {
 			target = renamed
@@ -1251,27 +1669,46 @@ func (g *generator) generateStatement(stmt parser.Statement, m *compiledMethod)
 	case *parser.Return:
 		// Check for iteration expression as return value
 		if iterVal, ok := s.Value.(*parser.IterationExprAsValue); ok {
-			// Generate iteration statements (collect: or select: produce _results)
+			// Generate iteration statements (collect: or select: produce _results, inject: _acc)
 			iterStmts := g.generateIterationStatement(iterVal.Iteration, m)
-			// Return the results as JSON
-			returnStmt := jen.List(jen.Id("_resultJSON"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("_results"))
+			// Return the results as JSON, or the accumulator
+			resultStmts, value := iterationResult(iterVal.Iteration.Kind)
+			iterStmts = append(iterStmts, resultStmts...)
 			if m.returnsErr {
-				return append(iterStmts, returnStmt, jen.Return(jen.String().Call(jen.Id("_resultJSON")), jen.Nil()))
+				return append(iterStmts, jen.Return(value, jen.Nil()))
 			}
-			return append(iterStmts, returnStmt, jen.Return(jen.String().Call(jen.Id("_resultJSON"))))
+			return append(iterStmts, jen.Return(value))
 		}
 		if dynIterVal, ok := s.Value.(*parser.DynamicIterationExprAsValue); ok {
-			// Generate dynamic iteration statements (collect: or select: produce _results)
+			// Generate dynamic iteration statements (collect: or select: produce _results, inject: _acc)
 			iterStmts := g.generateDynamicIterationStatement(dynIterVal.Iteration, m)
-			// Return the results as JSON
-			returnStmt := jen.List(jen.Id("_resultJSON"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("_results"))
+			// Return the results as JSON, or the accumulator
+			resultStmts, value := iterationResult(dynIterVal.Iteration.Kind)
+			iterStmts = append(iterStmts, resultStmts...)
 			if m.returnsErr {
-				return append(iterStmts, returnStmt, jen.Return(jen.String().Call(jen.Id("_resultJSON")), jen.Nil()))
+				return append(iterStmts, jen.Return(value, jen.Nil()))
+			}
+			return append(iterStmts, jen.Return(value))
+		}
+
+		// Constants worked out at compile time are returned as strings
+		if folded := foldConstant(s.Value); folded != s.Value {
+			if str, ok := literalString(folded); ok {
+				if m.returnsErr {
+					return []jen.Code{jen.Return(jen.Lit(str), jen.Nil())}
+				}
+				return []jen.Code{jen.Return(jen.Lit(str))}
 			}
-			return append(iterStmts, returnStmt, jen.Return(jen.String().Call(jen.Id("_resultJSON"))))
 		}
 
 		expr := g.generateExpr(s.Value, m)
+		if str := g.typedString(s.Value, m); str != nil {
+			// Typed ivars and native arrays/objects are returned as strings
+			if m.returnsErr {
+				return []jen.Code{jen.Return(str, jen.Nil())}
+			}
+			return []jen.Code{jen.Return(str)}
+		}
 		// Check if the return value is already a string (message sends, string literals, JSON primitives)
 		_, isMessageSend := s.Value.(*parser.MessageSend)
 		_, isStringLit := s.Value.(*parser.StringLit)
@@ -1279,7 +1716,7 @@ func (g *generator) generateStatement(stmt parser.Statement, m *compiledMethod)
 		// Check if return value is an instance variable (all are string typed)
 		isIvarReturn := false
 		if id, ok := s.Value.(*parser.Identifier); ok {
-			isIvarReturn = g.instanceVars[id.Name]
+			isIvarReturn = g.instanceVars[id.Name] || g.isClassVar(id.Name, m)
 		}
 		// Check if JSON primitive returns an array type (needs JSON encoding)
 		isArrayReturningPrimitive := false
@@ -1315,6 +1752,17 @@ func (g *generator) generateStatement(stmt parser.Statement, m *compiledMethod)
 		return []jen.Code{jen.Return(jen.Id("_toStr").Call(expr))}
 
 	case *parser.ExprStmt:
+		// The result of a @ self send made as a statement is dropped
+		if send, ok := s.Expr.(*parser.MessageSend); ok && send.IsSelf {
+			return []jen.Code{g.generateSelfSend(send, m)}
+		}
+		// A value left as the last expression of a block, such as the
+		// element in [:each | each], is not a Go statement
+		switch s.Expr.(type) {
+		case *parser.Identifier, *parser.NumberLit, *parser.StringLit, *parser.BinaryExpr,
+			*parser.ComparisonExpr, *parser.LogicalExpr, *parser.NegateExpr, *parser.NotExpr:
+			return []jen.Code{jen.Id("_").Op("=").Add(g.generateExpr(s.Expr, m))}
+		}
 		return []jen.Code{g.generateExpr(s.Expr, m)}
 
 	case *parser.IfExpr:
@@ -1323,6 +1771,18 @@ func (g *generator) generateStatement(stmt parser.Statement, m *compiledMethod)
 	case *parser.WhileExpr:
 		return g.generateWhileStatement(s, m)
 
+	case *parser.CountedLoopExpr:
+		return g.generateCountedLoop(s, m)
+
+	case *parser.ThrowExpr:
+		return g.generateThrow(s, m)
+
+	case *parser.OnDoExpr:
+		return g.generateOnDo(s, m)
+
+	case *parser.EnsureExpr:
+		return g.generateEnsure(s, m)
+
 	case *parser.IfNilExpr:
 		return g.generateIfNilStatement(s, m)
 
@@ -1354,7 +1814,12 @@ func (g *generator) generateIfStatement(s *parser.IfExpr, m *compiledMethod) []j
 	}
 
 	// Build the if statement
-	if len(s.TrueBlock) > 0 && len(s.FalseBlock) > 0 {
+	if elseIf := elseIfOf(s); elseIf != nil && len(s.TrueBlock) > 0 {
+		// ifFalse: [(c2) ifTrue: [...] ...] chains as else if
+		return []jen.Code{
+			jen.If(condition).Block(trueStmts...).Else().Add(g.generateIfStatement(elseIf, m)...),
+		}
+	} else if len(s.TrueBlock) > 0 && len(s.FalseBlock) > 0 {
 		// ifTrue: [true] ifFalse: [false]
 		return []jen.Code{
 			jen.If(condition).Block(trueStmts...).Else().Block(falseStmts...),
@@ -1374,24 +1839,95 @@ func (g *generator) generateIfStatement(s *parser.IfExpr, m *compiledMethod) []j
 	return []jen.Code{jen.Comment("empty if statement")}
 }
 
+// elseIfOf returns the conditional that is the whole false branch of s, if any
+func elseIfOf(s *parser.IfExpr) *parser.IfExpr {
+	if len(s.FalseBlock) != 1 {
+		return nil
+	}
+	elseIf, _ := s.FalseBlock[0].(*parser.IfExpr)
+	return elseIf
+}
+
+// generateIfValue generates a conditional used as a value as a function
+// literal called in place, returning the last expression of the branch taken
+// or "" (nil) if that branch has no value. The parser rejects ^ inside such
+// conditionals, since it could not return from the method.
+func (g *generator) generateIfValue(s *parser.IfExpr, m *compiledMethod) *jen.Statement {
+	return jen.Func().Params().Interface().Block(g.generateValueChain(s, m)...).Call()
+}
+
+// generateValueChain generates an if/else-if chain in which every branch
+// returns. The final false branch follows the chain instead of an else.
+func (g *generator) generateValueChain(s *parser.IfExpr, m *compiledMethod) []jen.Code {
+	chain := jen.If(g.generateCondition(s.Condition, m)).Block(g.generateValueBranch(s.TrueBlock, m)...)
+	for elseIf := elseIfOf(s); elseIf != nil; elseIf = elseIfOf(s) {
+		s = elseIf
+		chain.Else().If(g.generateCondition(s.Condition, m)).Block(g.generateValueBranch(s.TrueBlock, m)...)
+	}
+	return append([]jen.Code{chain}, g.generateValueBranch(s.FalseBlock, m)...)
+}
+
+// generateValueBranch generates a branch that returns its last expression
+func (g *generator) generateValueBranch(stmts []parser.Statement, m *compiledMethod) []jen.Code {
+	var code []jen.Code
+	for i, stmt := range stmts {
+		if i == len(stmts)-1 {
+			switch last := stmt.(type) {
+			case *parser.ExprStmt:
+				return append(code, jen.Return(g.generateExpr(last.Expr, m)))
+			case *parser.IfExpr:
+				return append(code, g.generateValueChain(last, m)...)
+			}
+		}
+		code = append(code, g.generateStatement(stmt, m)...)
+	}
+	return append(code, jen.Return(jen.Lit("")))
+}
+
 // generateCondition generates a Go boolean condition from a Trashtalk expression.
 // Comparisons return bool directly, but message sends return strings.
 // For message sends, we convert to bool with: result != ""
 func (g *generator) generateCondition(expr parser.Expr, m *compiledMethod) *jen.Statement {
 	// Check if the expression is a comparison (already returns bool)
-	switch expr.(type) {
+	switch e := expr.(type) {
 	case *parser.ComparisonExpr:
 		return g.generateExpr(expr, m)
+	case *parser.LogicalExpr:
+		// Go's && and || short-circuit like and: [...] and or: [...]
+		return jen.Parens(g.generateCondition(e.Left, m).Op(e.Op).Add(g.generateCondition(e.Right, m)))
+	case *parser.BetweenExpr:
+		return g.generateBetween(e, m)
+	case *parser.NotExpr:
+		return jen.Op("!").Parens(g.generateCondition(e.Operand, m))
+	case *parser.Identifier:
+		if g.typedArg(e.Name, m) == "bool" {
+			return g.argParam(e.Name, m)
+		}
+	case *parser.ClassPrimitiveExpr:
+		// Predicates answer "true" or "false", both non-empty
+		if classPrimitivePredicates[e.Operation] {
+			return g.generateExpr(expr, m).Op("==").Lit("true")
+		}
+	case *parser.BlockExpr:
+		// [condition] whileTrue: [...]
+		if len(e.Params) == 0 && len(e.Statements) == 1 {
+			if stmt, ok := e.Statements[0].(*parser.ExprStmt); ok {
+				return g.generateCondition(stmt.Expr, m)
+			}
+		}
 	}
 
 	// For message sends and other expressions, wrap in truthiness check
 	// In Trashtalk, non-empty string = truthy
+	if str := g.typedString(expr, m); str != nil {
+		return str.Op("!=").Lit("")
+	}
 	return g.generateExpr(expr, m).Op("!=").Lit("")
 }
 
 // generateWhileStatement generates Go for loop from Trashtalk whileTrue:
 func (g *generator) generateWhileStatement(s *parser.WhileExpr, m *compiledMethod) []jen.Code {
-	condition := g.generateExpr(s.Condition, m)
+	condition := g.generateCondition(s.Condition, m)
 
 	// Generate body statements
 	var bodyStmts []jen.Code
@@ -1405,6 +1941,37 @@ func (g *generator) generateWhileStatement(s *parser.WhileExpr, m *compiledMetho
 	}
 }
 
+// generateCountedLoop generates a Go for loop from Trashtalk to:do: and
+// timesRepeat:. Both bounds are evaluated once, before the loop, and the
+// index is an int in scope in the body.
+func (g *generator) generateCountedLoop(s *parser.CountedLoopExpr, m *compiledMethod) []jen.Code {
+	index := s.IndexVar
+	if index == "" {
+		index = "_i"
+	}
+
+	var bodyStmts []jen.Code
+	for _, stmt := range s.Body {
+		bodyStmts = append(bodyStmts, g.generateStatement(stmt, m)...)
+	}
+
+	return []jen.Code{
+		jen.For(
+			jen.List(jen.Id(index), jen.Id("_end")).Op(":=").List(g.generateIntBound(s.From, m), g.generateIntBound(s.To, m)),
+			jen.Id(index).Op("<=").Id("_end"),
+			jen.Id(index).Op("++"),
+		).Block(bodyStmts...),
+	}
+}
+
+// generateIntBound generates a loop bound as a Go int
+func (g *generator) generateIntBound(expr parser.Expr, m *compiledMethod) *jen.Statement {
+	if lit, ok := expr.(*parser.NumberLit); ok && !isFloatLit(lit.Value) {
+		return generateNumberLit(lit)
+	}
+	return jen.Id("toInt").Call(g.generateExpr(expr, m))
+}
+
 // generateIfNilStatement generates Go if for Trashtalk ifNil:/ifNotNil:
 func (g *generator) generateIfNilStatement(s *parser.IfNilExpr, m *compiledMethod) []jen.Code {
 	subjectExpr := g.generateExpr(s.Subject, m)
@@ -1464,7 +2031,7 @@ func (g *generator) generateIterationStatement(s *parser.IterationExpr, m *compi
 	rawIterVar := "_" + iterVar // Raw interface{} variable from range
 
 	// Check if collection is a native array (from JSON primitives) vs JSON string
-	isNativeArray := g.exprResultsInArray(s.Collection)
+	isNativeArray := g.exprResultsInArray(s.Collection, m)
 
 	// Type conversion at start of loop: iterVar := toInt(_iterVar)
 	typeConversion := jen.Id(iterVar).Op(":=").Id("toInt").Call(jen.Id(rawIterVar))
@@ -1489,47 +2056,101 @@ func (g *generator) generateIterationStatement(s *parser.IterationExpr, m *compi
 		// JSON string: unmarshal first
 		return []jen.Code{
 			jen.Var().Id("_items").Index().Interface(),
-			jen.Qual("encoding/json", "Unmarshal").Call(
+			jen.Id("_jsonDecode").Call(
+				jen.Index().Byte().Parens(collectionExpr),
+				jen.Op("&").Id("_items"),
+			),
+			jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Id("_items")).Block(loopBody...),
+		}
+
+	case "collect":
+		// For collect:, the last statement's expression becomes the collected value
+		bodyStmts, resultExpr := g.generateCollectBody(s.Body, m, iterVar)
+
+		// Prepend type conversion, then body, then append result
+		loopBody := append([]jen.Code{typeConversion}, bodyStmts...)
+		loopBody = append(loopBody, jen.Id("_results").Op("=").Append(jen.Id("_results"), resultExpr))
+
+		if isNativeArray {
+			// Native array: collect directly into []interface{}
+			return []jen.Code{
+				jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0), jen.Len(collectionExpr)),
+				jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Add(collectionExpr)).Block(loopBody...),
+			}
+		}
+		// JSON string: unmarshal first
+		return []jen.Code{
+			jen.Var().Id("_items").Index().Interface(),
+			jen.Id("_jsonDecode").Call(
+				jen.Index().Byte().Parens(collectionExpr),
+				jen.Op("&").Id("_items"),
+			),
+			jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)),
+			jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Id("_items")).Block(loopBody...),
+		}
+
+	case "select":
+		// For select:, the last statement's expression becomes the filter condition
+		bodyStmts, conditionExpr := g.generateSelectBody(s.Body, m, iterVar)
+
+		// For select, we need to keep the original interface{} value for appending
+		// But use the typed value for the condition
+		loopBody := append([]jen.Code{typeConversion}, bodyStmts...)
+		loopBody = append(loopBody, jen.If(conditionExpr).Block(
+			jen.Id("_results").Op("=").Append(jen.Id("_results"), jen.Id(rawIterVar)),
+		))
+
+		if isNativeArray {
+			// Native array: filter directly into []interface{}
+			return []jen.Code{
+				jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)),
+				jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Add(collectionExpr)).Block(loopBody...),
+			}
+		}
+		// JSON string: unmarshal first
+		return []jen.Code{
+			jen.Var().Id("_items").Index().Interface(),
+			jen.Id("_jsonDecode").Call(
 				jen.Index().Byte().Parens(collectionExpr),
 				jen.Op("&").Id("_items"),
 			),
+			jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)),
 			jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Id("_items")).Block(loopBody...),
 		}
 
-	case "collect":
-		// For collect:, the last statement's expression becomes the collected value
-		bodyStmts, resultExpr := g.generateCollectBody(s.Body, m, iterVar)
+	case "inject":
+		// For inject:into:, the last statement's expression becomes the next
+		// accumulator; a trailing conditional is used as a value
+		bodyStmts, resultExpr := g.generateCollectBody(valueBody(s.Body), m, iterVar)
 
-		// Prepend type conversion, then body, then append result
-		loopBody := append([]jen.Code{typeConversion}, bodyStmts...)
-		loopBody = append(loopBody, jen.Id("_results").Op("=").Append(jen.Id("_results"), resultExpr))
+		loopBody := append([]jen.Code{typeConversion, jen.Id(s.AccVar).Op(":=").Id("_acc")}, bodyStmts...)
+		loopBody = append(loopBody, jen.Id("_acc").Op("=").Add(resultExpr))
+		initAcc := jen.Var().Id("_acc").Interface().Op("=").Add(g.generateExpr(s.Initial, m))
 
 		if isNativeArray {
-			// Native array: collect directly into []interface{}
+			// Native array: fold directly over []interface{}
 			return []jen.Code{
-				jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0), jen.Len(collectionExpr)),
+				initAcc,
 				jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Add(collectionExpr)).Block(loopBody...),
 			}
 		}
 		// JSON string: unmarshal first
 		return []jen.Code{
 			jen.Var().Id("_items").Index().Interface(),
-			jen.Qual("encoding/json", "Unmarshal").Call(
+			jen.Id("_jsonDecode").Call(
 				jen.Index().Byte().Parens(collectionExpr),
 				jen.Op("&").Id("_items"),
 			),
-			jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)),
+			initAcc,
 			jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Id("_items")).Block(loopBody...),
 		}
 
-	case "select":
-		// For select:, the last statement's expression becomes the filter condition
+	case "reject":
+		// For reject:, keep the elements the condition is false for
 		bodyStmts, conditionExpr := g.generateSelectBody(s.Body, m, iterVar)
 
-		// For select, we need to keep the original interface{} value for appending
-		// But use the typed value for the condition
 		loopBody := append([]jen.Code{typeConversion}, bodyStmts...)
-		loopBody = append(loopBody, jen.If(conditionExpr).Block(
+		loopBody = append(loopBody, jen.If(jen.Op("!").Parens(conditionExpr)).Block(
 			jen.Id("_results").Op("=").Append(jen.Id("_results"), jen.Id(rawIterVar)),
 		))
 
@@ -1543,7 +2164,7 @@ func (g *generator) generateIterationStatement(s *parser.IterationExpr, m *compi
 		// JSON string: unmarshal first
 		return []jen.Code{
 			jen.Var().Id("_items").Index().Interface(),
-			jen.Qual("encoding/json", "Unmarshal").Call(
+			jen.Id("_jsonDecode").Call(
 				jen.Index().Byte().Parens(collectionExpr),
 				jen.Op("&").Id("_items"),
 			),
@@ -1551,11 +2172,80 @@ func (g *generator) generateIterationStatement(s *parser.IterationExpr, m *compi
 			jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Id("_items")).Block(loopBody...),
 		}
 
+	case "detect", "anySatisfy", "allSatisfy":
+		// These stop at the first element that decides the result
+		bodyStmts, conditionExpr := g.generateSelectBody(s.Body, m, iterVar)
+
+		initValue, onMatch, ifNone := g.predicateIteration(s.Kind, conditionExpr, jen.Id(rawIterVar), s.IfNone, m)
+		loopBody := append([]jen.Code{typeConversion}, bodyStmts...)
+		loopBody = append(loopBody, onMatch)
+
+		var code []jen.Code
+		if isNativeArray {
+			// Native array: scan directly over []interface{}
+			code = append(initValue,
+				jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Add(collectionExpr)).Block(loopBody...),
+			)
+		} else {
+			// JSON string: unmarshal first
+			code = append([]jen.Code{
+				jen.Var().Id("_items").Index().Interface(),
+				jen.Id("_jsonDecode").Call(
+					jen.Index().Byte().Parens(collectionExpr),
+					jen.Op("&").Id("_items"),
+				),
+			}, initValue...)
+			code = append(code, jen.For(jen.List(jen.Id("_"), jen.Id(rawIterVar)).Op(":=").Range().Id("_items")).Block(loopBody...))
+		}
+		return append(code, ifNone...)
+
 	default:
 		return []jen.Code{jen.Comment("unknown iteration kind: " + s.Kind)}
 	}
 }
 
+// valueBody returns body with a trailing conditional turned into an
+// expression, so its value is the value of the body
+func valueBody(body []parser.Statement) []parser.Statement {
+	if n := len(body); n > 0 {
+		if ifx, ok := body[n-1].(*parser.IfExpr); ok && !hasReturnInStatements(body[n-1:]) {
+			return append(append([]parser.Statement{}, body[:n-1]...), &parser.ExprStmt{Expr: ifx})
+		}
+	}
+	return body
+}
+
+// predicateIteration returns the pieces of detect:, anySatisfy: and
+// allSatisfy: around a loop over elem: the declaration of _value, the check
+// closing the loop body, which breaks out once the result is known, and the
+// ifNone: block run when detect: finds nothing.
+func (g *generator) predicateIteration(kind string, condition, elem *jen.Statement, ifNone []parser.Statement, m *compiledMethod) ([]jen.Code, jen.Code, []jen.Code) {
+	switch kind {
+	case "anySatisfy":
+		return []jen.Code{jen.Var().Id("_value").Interface().Op("=").False()},
+			jen.If(condition).Block(jen.Id("_value").Op("=").True(), jen.Break()),
+			nil
+	case "allSatisfy":
+		return []jen.Code{jen.Var().Id("_value").Interface().Op("=").True()},
+			jen.If(jen.Op("!").Parens(condition)).Block(jen.Id("_value").Op("=").False(), jen.Break()),
+			nil
+	}
+
+	// detect: answers the first match, nil if there is none
+	init := []jen.Code{jen.Var().Id("_value").Interface().Op("=").Lit("")}
+	if len(ifNone) == 0 {
+		return init, jen.If(condition).Block(jen.Id("_value").Op("=").Add(elem), jen.Break()), nil
+	}
+	stmts, value := g.generateCollectBody(valueBody(ifNone), m, "")
+	return append(init, jen.Id("_found").Op(":=").False()),
+		jen.If(condition).Block(
+			jen.Id("_value").Op("=").Add(elem),
+			jen.Id("_found").Op("=").True(),
+			jen.Break(),
+		),
+		[]jen.Code{jen.If(jen.Op("!").Id("_found")).Block(append(stmts, jen.Id("_value").Op("=").Add(value))...)}
+}
+
 // generateCollectBody generates the body statements for a collect: block
 // Returns the body statements (all but last) and the result expression (last statement)
 func (g *generator) generateCollectBody(body []parser.Statement, m *compiledMethod, iterVar string) ([]jen.Code, *jen.Statement) {
@@ -1613,14 +2303,19 @@ func (g *generator) generateIterationBodyStatement(stmt parser.Statement, m *com
 }
 
 // generateDynamicIterationStatement generates shell-out iteration for dynamic blocks (Phase 2)
-// When the block is a variable/parameter, we call back to Bash for each element
+// When the block is a variable/parameter, we call back to Bash for each element,
+// unless it is a block compiled in this method
 func (g *generator) generateDynamicIterationStatement(s *parser.DynamicIterationExpr, m *compiledMethod) []jen.Code {
+	if name, arity, ok := m.blockVar(s.BlockVar); ok {
+		return g.generateBlockIteration(s, name, arity, m)
+	}
+
 	collectionExpr := g.generateExpr(s.Collection, m)
 	// Block IDs are strings - don't use the Int conversion
 	blockExpr := g.generateExprAsString(s.BlockVar, m)
 
 	// Check if collection is a native array (from JSON primitives) vs JSON string
-	isNativeArray := g.exprResultsInArray(s.Collection)
+	isNativeArray := g.exprResultsInArray(s.Collection, m)
 
 	switch s.Kind {
 	case "do":
@@ -1638,7 +2333,7 @@ func (g *generator) generateDynamicIterationStatement(s *parser.DynamicIteration
 		// JSON string: unmarshal first
 		return []jen.Code{
 			jen.Var().Id("_items").Index().Interface(),
-			jen.Qual("encoding/json", "Unmarshal").Call(
+			jen.Id("_jsonDecode").Call(
 				jen.Index().Byte().Parens(collectionExpr),
 				jen.Op("&").Id("_items"),
 			),
@@ -1667,7 +2362,7 @@ func (g *generator) generateDynamicIterationStatement(s *parser.DynamicIteration
 		// JSON string: unmarshal first
 		return []jen.Code{
 			jen.Var().Id("_items").Index().Interface(),
-			jen.Qual("encoding/json", "Unmarshal").Call(
+			jen.Id("_jsonDecode").Call(
 				jen.Index().Byte().Parens(collectionExpr),
 				jen.Op("&").Id("_items"),
 			),
@@ -1701,7 +2396,7 @@ func (g *generator) generateDynamicIterationStatement(s *parser.DynamicIteration
 		// JSON string: unmarshal first
 		return []jen.Code{
 			jen.Var().Id("_items").Index().Interface(),
-			jen.Qual("encoding/json", "Unmarshal").Call(
+			jen.Id("_jsonDecode").Call(
 				jen.Index().Byte().Parens(collectionExpr),
 				jen.Op("&").Id("_items"),
 			),
@@ -1718,11 +2413,210 @@ func (g *generator) generateDynamicIterationStatement(s *parser.DynamicIteration
 			),
 		}
 
+	case "inject":
+		// The block gets the accumulator and the element; its result is the next accumulator
+		initAcc := jen.Var().Id("_acc").Interface().Op("=").Add(g.generateExpr(s.Initial, m))
+		fold := jen.Id("_acc").Op("=").Id("invokeBlock").Call(
+			blockExpr,
+			jen.Id("_acc"),
+			jen.Id("_elem"),
+		)
+		if isNativeArray {
+			// Native array: fold directly
+			return []jen.Code{
+				initAcc,
+				jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Add(collectionExpr)).Block(fold),
+			}
+		}
+		// JSON string: unmarshal first
+		return []jen.Code{
+			jen.Var().Id("_items").Index().Interface(),
+			jen.Id("_jsonDecode").Call(
+				jen.Index().Byte().Parens(collectionExpr),
+				jen.Op("&").Id("_items"),
+			),
+			initAcc,
+			jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Id("_items")).Block(fold),
+		}
+
+	case "reject":
+		filter := []jen.Code{
+			jen.Id("_result").Op(":=").Id("invokeBlock").Call(
+				blockExpr,
+				jen.Id("_elem"),
+			),
+			jen.Comment("Empty string result means false"),
+			jen.If(jen.Id("_result").Op("==").Lit("")).Block(
+				jen.Id("_results").Op("=").Append(jen.Id("_results"), jen.Id("_elem")),
+			),
+		}
+		if isNativeArray {
+			// Native array: filter based on block result
+			return []jen.Code{
+				jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)),
+				jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Add(collectionExpr)).Block(filter...),
+			}
+		}
+		// JSON string: unmarshal first
+		return []jen.Code{
+			jen.Var().Id("_items").Index().Interface(),
+			jen.Id("_jsonDecode").Call(
+				jen.Index().Byte().Parens(collectionExpr),
+				jen.Op("&").Id("_items"),
+			),
+			jen.Id("_results").Op(":=").Make(jen.Index().Interface(), jen.Lit(0)),
+			jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Id("_items")).Block(filter...),
+		}
+
+	case "detect", "anySatisfy", "allSatisfy":
+		// Non-empty string result means true
+		condition := jen.Id("invokeBlock").Call(blockExpr, jen.Id("_elem")).Op("!=").Lit("")
+		initValue, onMatch, ifNone := g.predicateIteration(s.Kind, condition, jen.Id("_elem"), s.IfNone, m)
+		var code []jen.Code
+		if isNativeArray {
+			// Native array: scan directly
+			code = append(initValue,
+				jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Add(collectionExpr)).Block(onMatch),
+			)
+		} else {
+			// JSON string: unmarshal first
+			code = append([]jen.Code{
+				jen.Var().Id("_items").Index().Interface(),
+				jen.Id("_jsonDecode").Call(
+					jen.Index().Byte().Parens(collectionExpr),
+					jen.Op("&").Id("_items"),
+				),
+			}, initValue...)
+			code = append(code, jen.For(jen.List(jen.Id("_"), jen.Id("_elem")).Op(":=").Range().Id("_items")).Block(onMatch))
+		}
+		return append(code, ifNone...)
+
 	default:
 		return []jen.Code{jen.Comment("unknown dynamic iteration kind: " + s.Kind)}
 	}
 }
 
+// iterationResult returns the statements and string value an iteration used
+// as a value produces once its loop has run: the accumulator of inject:into:,
+// the element or boolean found by detect:, anySatisfy: and allSatisfy:, the
+// collected elements as JSON otherwise
+func iterationResult(kind string) ([]jen.Code, *jen.Statement) {
+	if v := iterationValueVar(kind); v != "" {
+		return nil, jen.Id("_toStr").Call(jen.Id(v))
+	}
+	return []jen.Code{
+		jen.List(jen.Id("_resultJSON"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("_results")),
+	}, jen.String().Call(jen.Id("_resultJSON"))
+}
+
+// generateStringValue generates value as the string stored in an instance
+// variable
+func (g *generator) generateStringValue(value parser.Expr, m *compiledMethod) *jen.Statement {
+	var expr *jen.Statement
+	switch v := value.(type) {
+	case *parser.Identifier:
+		// Check if value is a method arg - use original string param
+		isMethodArg := false
+		for _, arg := range m.args {
+			if arg == v.Name {
+				isMethodArg = true
+				break
+			}
+		}
+		if isMethodArg && g.typedArg(v.Name, m) != "" {
+			expr = g.argString(v.Name, m)
+		} else if isMethodArg {
+			// Use renamed parameter name if it conflicted with Go keyword
+			paramName := v.Name
+			if renamed, ok := m.renamedVars[v.Name]; ok {
+				paramName = renamed
+			}
+			expr = jen.Id(paramName)
+		} else if g.typedIvar(v.Name, m) != "" {
+			expr = g.ivarString(v.Name)
+		} else if g.instanceVars[v.Name] || g.isClassVar(v.Name, m) {
+			// Assigning one ivar to another - already a string
+			expr = g.generateExpr(value, m)
+		} else {
+			// Local variable - need to convert to string
+			expr = jen.Id("_toStr").Call(g.generateExpr(value, m))
+		}
+	case *parser.BinaryExpr:
+		if folded := foldConstant(v); folded != value {
+			if str, ok := literalString(folded); ok {
+				return jen.Lit(str)
+			}
+			return g.generateStringValue(folded, m)
+		}
+		if v.Op == "," {
+			// String concatenation - already returns string
+			expr = g.generateExpr(value, m)
+		} else if g.numKind(v, m) == numInt {
+			// Integer arithmetic - result is int, need to convert to string
+			expr = jen.Qual("strconv", "Itoa").Call(g.generateExpr(value, m))
+		} else {
+			// Float or mixed arithmetic - _toStr formats either result
+			expr = jen.Id("_toStr").Call(g.generateExpr(value, m))
+		}
+	case *parser.StringLit:
+		// String literal - already a string
+		expr = g.generateExpr(value, m)
+	case *parser.JSONPrimitiveExpr:
+		// JSON primitives return strings, except on typed arrays and objects
+		if str := g.typedString(value, m); str != nil {
+			return str
+		}
+		expr = g.generateExpr(value, m)
+	case *parser.MessageSend:
+		// Message sends return strings
+		expr = g.generateExpr(value, m)
+	default:
+		// Default: wrap in _toStr for safety
+		expr = jen.Id("_toStr").Call(g.generateExpr(value, m))
+	}
+	return expr
+}
+
+// generateIterationAssignment generates x := items inject: 0 into: [...]. The
+// loop runs in its own block so its temporaries cannot clash with other loops;
+// a local keeps the accumulator as is, an instance variable gets its string.
+func (g *generator) generateIterationAssignment(target string, iterStmts []jen.Code, kind string, m *compiledMethod) []jen.Code {
+	resultStmts, value := iterationResult(kind)
+	stmts := append(iterStmts, resultStmts...)
+	if g.isClassVar(target, m) {
+		return []jen.Code{jen.Block(append(stmts,
+			g.classVarAccess(target).Op("=").Add(value),
+			jen.Id(g.fn("classVars")).Dot("dirty").Op("=").True(),
+		)...)}
+	}
+	if g.instanceVars[target] {
+		stmts = append(stmts,
+			jen.Id("c").Dot(capitalize(target)).Op("=").Add(g.ivarFromString(target, value)),
+			jen.Id("c").Dot("dirty").Op("=").True(),
+		)
+		return []jen.Code{jen.Block(stmts...)}
+	}
+	if renamed, ok := m.renamedVars[target]; ok {
+		target = renamed
+	}
+	if v := iterationValueVar(kind); v != "" {
+		value = jen.Id(v)
+	}
+	return []jen.Code{jen.Block(append(stmts, jen.Id(target).Op("=").Add(value))...)}
+}
+
+// iterationValueVar is the variable holding the result of an iteration that
+// produces a single value rather than a collection, or "" for the others
+func iterationValueVar(kind string) string {
+	switch kind {
+	case "inject":
+		return "_acc"
+	case "detect", "anySatisfy", "allSatisfy":
+		return "_value"
+	}
+	return ""
+}
+
 // generateExprAsString generates an expression keeping method args as strings (no int conversion)
 // Used for block IDs and other cases where we need the original string parameter
 func (g *generator) generateExprAsString(expr parser.Expr, m *compiledMethod) *jen.Statement {
@@ -1733,6 +2627,15 @@ func (g *generator) generateExprAsString(expr parser.Expr, m *compiledMethod) *j
 		if name == "self" {
 			return jen.Id("c")
 		}
+		if g.typedArg(name, m) != "" {
+			return g.argString(name, m)
+		}
+		if g.isClassVar(name, m) {
+			return g.classVarAccess(name)
+		}
+		if g.typedIvar(name, m) != "" {
+			return g.ivarString(name)
+		}
 		// Check if it's an instance variable
 		if g.instanceVars[name] {
 			fieldAccess := jen.Id("c").Dot(capitalize(name))
@@ -1753,32 +2656,33 @@ func (g *generator) generateExprAsString(expr parser.Expr, m *compiledMethod) *j
 func (g *generator) generateExpr(expr parser.Expr, m *compiledMethod) *jen.Statement {
 	switch e := expr.(type) {
 	case *parser.BinaryExpr:
+		if folded := foldConstant(e); folded != expr {
+			return g.generateExpr(folded, m)
+		}
 		// String concatenation with comma operator
 		if e.Op == "," {
 			left := g.generateStringArg(e.Left, m)
 			right := g.generateStringArg(e.Right, m)
 			return left.Op("+").Add(right)
 		}
-		// Wrap in toInt() for interface{} compatibility (arithmetic)
-		left := jen.Id("toInt").Call(g.generateExpr(e.Left, m))
-		right := jen.Id("toInt").Call(g.generateExpr(e.Right, m))
-		switch e.Op {
-		case "+":
-			return left.Op("+").Add(right)
-		case "-":
-			return left.Op("-").Add(right)
-		case "*":
-			return left.Op("*").Add(right)
-		case "/":
-			return left.Op("/").Add(right)
-		}
-		return jen.Comment("unknown op: " + e.Op)
+		return g.generateArithmetic(e, m)
 
 	case *parser.ComparisonExpr:
-		// Wrap in toInt() for interface{} compatibility
-		left := jen.Id("toInt").Call(g.generateExpr(e.Left, m))
-		right := jen.Id("toInt").Call(g.generateExpr(e.Right, m))
-		return left.Op(e.Op).Add(right)
+		return g.generateComparison(e, m)
+
+	case *parser.NegateExpr:
+		return g.generateNegate(e, m)
+
+	case *parser.LogicalExpr, *parser.NotExpr, *parser.BetweenExpr:
+		// Boolean value, e.g. ^ (a > 0) and: [b > 0]
+		return g.generateCondition(e, m)
+
+	case *parser.MinMaxExpr:
+		return g.generateMinMax(e, m)
+
+	case *parser.IfExpr:
+		// Conditional inside a larger expression, e.g. 'n=', ((n > 0) ifTrue: ['pos'] ifFalse: ['neg'])
+		return g.generateIfValue(e, m)
 
 	case *parser.Identifier:
 		name := e.Name
@@ -1797,6 +2701,10 @@ func (g *generator) generateExpr(expr parser.Expr, m *compiledMethod) *jen.State
 				return jen.Id(name)
 			}
 		}
+		// Class instance variables (only for class methods)
+		if g.isClassVar(name, m) {
+			return g.classVarAccess(name)
+		}
 		// Check if it's an instance variable (only for instance methods)
 		if !m.isClass && g.instanceVars[name] {
 			fieldAccess := jen.Id("c").Dot(capitalize(name))
@@ -1814,70 +2722,26 @@ func (g *generator) generateExpr(expr parser.Expr, m *compiledMethod) *jen.State
 
 	case *parser.QualifiedName:
 		// Qualified name (Pkg::Class) - return the full name as a string literal
-		return jen.Lit(e.FullName())
+		return jen.Lit(g.resolveClass(e.FullName(), m))
 
 	case *parser.NumberLit:
-		return jen.Lit(mustAtoi(e.Value))
+		return generateNumberLit(e)
 
 	case *parser.StringLit:
 		return jen.Lit(e.Value)
 
 	case *parser.MessageSend:
 		if e.IsSelf {
-			// Check if target method is raw or skipped (will fall back to bash)
-			// If so, use sendMessage to call bash runtime instead of direct Go call
-			isTargetSkipped := g.skippedMethods[e.Selector]
-			if !isTargetSkipped {
-				// Also check if explicitly marked as raw
-				for _, method := range g.class.Methods {
-					if method.Selector == e.Selector && method.Raw {
-						isTargetSkipped = true
-						break
-					}
-				}
-			}
-
-			if isTargetSkipped {
-				// Use sendMessage for skipped/raw methods that aren't compiled to Go
-				args := []jen.Code{jen.Id("c"), jen.Lit(e.Selector)}
-				for _, arg := range e.Args {
-					args = append(args, g.generateExprAsString(arg, m))
-				}
-				return jen.Id("sendMessage").Call(args...)
-			}
+			return g.selfSendValue(e, g.generateSelfSend(e, m))
+		}
 
-			// Self send to compiled method: direct Go method call
-			goMethodName := selectorToGoName(e.Selector)
-			if len(e.Args) == 0 {
-				return jen.Id("c").Dot(goMethodName).Call()
-			}
-			// Build args - Go methods take string params
-			args := []jen.Code{}
+		// Blocks compiled in this method are called directly
+		if name, arity, ok := m.blockVar(e.Receiver); ok && isBlockInvocationSelector(e.Selector) {
+			var blockArgs []jen.Code
 			for _, arg := range e.Args {
-				// Check if the arg is a method parameter (already a string)
-				if ident, ok := arg.(*parser.Identifier); ok {
-					isMethodArg := false
-					for _, methodArg := range m.args {
-						if methodArg == ident.Name {
-							isMethodArg = true
-							break
-						}
-					}
-					if isMethodArg {
-						// Use original string parameter directly
-						args = append(args, jen.Id(ident.Name))
-						continue
-					}
-				}
-				// For other args, generate and convert if needed
-				argExpr := g.generateExpr(arg, m)
-				// Wrap numeric literals in strconv.Itoa
-				if _, ok := arg.(*parser.NumberLit); ok {
-					argExpr = jen.Qual("strconv", "Itoa").Call(argExpr)
-				}
-				args = append(args, argExpr)
+				blockArgs = append(blockArgs, g.generateExpr(arg, m))
 			}
-			return jen.Id("c").Dot(goMethodName).Call(args...)
+			return jen.Id("_toStr").Call(callBlock(name, arity, blockArgs))
 		}
 
 		// Check for block invocation pattern: @ aBlock value / valueWith: / valueWith:and:
@@ -1906,13 +2770,13 @@ func (g *generator) generateExpr(expr parser.Expr, m *compiledMethod) *jen.State
 		var receiverExpr *jen.Statement
 		// Check if receiver is a qualified name (Pkg::Class) - use full name as string literal
 		if qn, ok := e.Receiver.(*parser.QualifiedName); ok {
-			receiverExpr = jen.Lit(qn.FullName())
+			receiverExpr = jen.Lit(g.resolveClass(qn.FullName(), m))
 		} else if ident, ok := e.Receiver.(*parser.Identifier); ok {
 			// Check if receiver is a class name (uppercase identifier that's not a local var)
 			name := ident.Name
 			isLocalVar := false
 			// Check instance vars, method args, and local vars
-			if g.instanceVars[name] {
+			if g.instanceVars[name] || g.isClassVar(name, m) {
 				isLocalVar = true
 			}
 			for _, arg := range m.args {
@@ -1926,7 +2790,7 @@ func (g *generator) generateExpr(expr parser.Expr, m *compiledMethod) *jen.State
 			}
 			// Uppercase name that's not a local var is a class name - use string literal
 			if !isLocalVar && len(name) > 0 && name[0] >= 'A' && name[0] <= 'Z' {
-				receiverExpr = jen.Lit(name)
+				receiverExpr = jen.Lit(g.resolveClass(name, m))
 			} else {
 				receiverExpr = g.generateExpr(e.Receiver, m)
 			}
@@ -1938,6 +2802,10 @@ func (g *generator) generateExpr(expr parser.Expr, m *compiledMethod) *jen.State
 			jen.Lit(e.Selector),
 		}
 		for _, arg := range e.Args {
+			if str := g.typedString(arg, m); str != nil {
+				args = append(args, str)
+				continue
+			}
 			args = append(args, g.generateExpr(arg, m))
 		}
 		return jen.Id("sendMessage").Call(args...)
@@ -1971,15 +2839,27 @@ func (g *generator) generateStringArg(expr parser.Expr, m *compiledMethod) *jen.
 	case *parser.Identifier:
 		// For identifiers, check if it's a method arg - if so, use the original string
 		for _, arg := range m.args {
+			if arg == e.Name && g.typedArg(arg, m) != "" {
+				return g.argString(arg, m)
+			}
 			if arg == e.Name {
 				return jen.Id(e.Name) // Use original string parameter
 			}
 		}
+		if str := g.typedString(e, m); str != nil {
+			return str
+		}
 		// Local variables are interface{}, wrap in _toStr for string conversion
 		return jen.Id("_toStr").Call(g.generateExpr(expr, m))
 	case *parser.StringLit:
 		return jen.Lit(e.Value)
 	case *parser.BinaryExpr:
+		if folded := foldConstant(e); folded != expr {
+			if str, ok := literalString(folded); ok {
+				return jen.Lit(str)
+			}
+			return g.generateStringArg(folded, m)
+		}
 		if e.Op == "," {
 			// Nested concatenation - recursively handle
 			left := g.generateStringArg(e.Left, m)
@@ -1989,6 +2869,9 @@ func (g *generator) generateStringArg(expr parser.Expr, m *compiledMethod) *jen.
 		// Arithmetic expression - wrap result in _toStr
 		return jen.Id("_toStr").Call(g.generateExpr(expr, m))
 	default:
+		if str := g.typedString(expr, m); str != nil {
+			return str
+		}
 		// For other expressions, wrap in _toStr for string conversion
 		return jen.Id("_toStr").Call(g.generateExpr(expr, m))
 	}
@@ -1996,12 +2879,13 @@ func (g *generator) generateStringArg(expr parser.Expr, m *compiledMethod) *jen.
 
 // generateJSONPrimitive generates Go code for JSON primitive operations
 func (g *generator) generateJSONPrimitive(e *parser.JSONPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	g.checkJSONPrimitiveLiterals(e, m)
 	receiver := g.generateExpr(e.Receiver, m)
 
 	// Check if receiver expression results in a typed array/object
 	// This handles both direct ivar access and chained operations
-	isArrayType := g.exprResultsInArray(e.Receiver)
-	isObjectType := g.exprResultsInObject(e.Receiver)
+	isArrayType := g.exprResultsInArray(e.Receiver, m)
+	isObjectType := g.exprResultsInObject(e.Receiver, m)
 
 	switch e.Operation {
 	// Array operations
@@ -2135,6 +3019,28 @@ func (g *generator) generateJSONPrimitive(e *parser.JSONPrimitiveExpr, m *compil
 		}
 		return jen.Id("_jsonObjectRemoveKey").Call(receiver, key)
 
+	case "arraySort", "arraySortNumeric", "arrayReverse", "arrayUnique", "arrayJoin":
+		return g.generateArrayOp(e, m)
+
+	case "objectMerge", "objectDeepMerge", "objectEquals":
+		return g.generateObjectOp(e, m)
+
+	// Path operations
+	case "jsonAtPath":
+		path := g.generateStringArg(e.Args[0], m)
+		return jen.Id("_jsonAtPath").Call(receiver, path)
+
+	case "jsonSetPathPut":
+		path := g.generateStringArg(e.Args[0], m)
+		val := g.generateExpr(e.Args[1], m)
+		if isObjectType {
+			return jen.Id("_mapSetPath").Call(receiver, path, val)
+		}
+		if isArrayType {
+			return jen.Id("_arraySetPath").Call(receiver, path, val)
+		}
+		return jen.Id("_jsonSetPath").Call(receiver, path, val)
+
 	default:
 		return jen.Comment("unknown JSON primitive: " + e.Operation)
 	}
@@ -2149,12 +3055,6 @@ func capitalize(s string) string {
 	return strings.ToUpper(s[0:1]) + s[1:]
 }
 
-func selectorToGoName(selector string) string {
-	// Remove trailing underscore and capitalize
-	name := strings.TrimSuffix(selector, "_")
-	return capitalize(name)
-}
-
 func mustAtoi(s string) int {
 	var n int
 	fmt.Sscanf(s, "%d", &n)
@@ -2173,6 +3073,19 @@ func isBlockInvocationSelector(selector string) bool {
 	}
 }
 
+// classPrimitivePredicates are the class primitives answering "true" or
+// "false"
+var classPrimitivePredicates = map[string]bool{
+	"stringIsEmpty": true, "stringNotEmpty": true, "stringContains": true,
+	"stringStartsWith": true, "stringEndsWith": true, "stringEquals": true,
+	"fileExists": true, "fileIsFile": true, "fileIsDirectory": true, "fileIsSymlink": true,
+	"fileIsFifo": true, "fileIsSocket": true, "fileIsBlockDevice": true, "fileIsCharDevice": true,
+	"fileIsReadable": true, "fileIsWritable": true, "fileIsExecutable": true,
+	"fileIsEmpty": true, "fileNotEmpty": true,
+	"fileIsNewer": true, "fileIsOlder": true, "fileIsSame": true,
+	"envHas": true,
+}
+
 // generateClassPrimitive generates Go code for class primitive operations
 // like @ String isEmpty: str, @ File exists: path
 func (g *generator) generateClassPrimitive(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
@@ -2181,6 +3094,14 @@ func (g *generator) generateClassPrimitive(e *parser.ClassPrimitiveExpr, m *comp
 		return g.generateStringPrimitive(e, m)
 	case "File":
 		return g.generateFilePrimitive(e, m)
+	case "HttpClient":
+		return g.generateHttpClientPrimitive(e, m)
+	case "Locale":
+		return g.generateLocalePrimitive(e, m)
+	case "Shell":
+		return g.generateShellPrimitive(e, m)
+	case "Env", "Os":
+		return g.generateEnvPrimitive(e, m)
 	default:
 		return jen.Comment("unknown class primitive: " + e.ClassName)
 	}
@@ -2284,6 +3205,9 @@ func (g *generator) generateStringPrimitive(e *parser.ClassPrimitiveExpr, m *com
 
 // generateFilePrimitive generates Go code for File class primitives
 func (g *generator) generateFilePrimitive(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	if op := g.generateFileOp(e, m); op != nil {
+		return op
+	}
 	switch e.Operation {
 	case "fileExists":
 		path := g.generateStringArg(e.Args[0], m)
@@ -2357,6 +3281,98 @@ func (g *generator) generateFilePrimitive(e *parser.ClassPrimitiveExpr, m *compi
 	}
 }
 
+// generateSelfSend returns the call made for the @ self send e: a direct
+// call to the compiled method, or sendMessage for one left to Bash
+func (g *generator) generateSelfSend(e *parser.MessageSend, m *compiledMethod) *jen.Statement {
+	// Check if target method is raw or skipped (will fall back to bash)
+	// If so, use sendMessage to call bash runtime instead of direct Go call
+	isTargetSkipped := g.skippedMethods[e.Selector]
+	if !isTargetSkipped {
+		// Also check if explicitly marked as raw
+		for _, method := range g.class.Methods {
+			if method.Selector == e.Selector && method.Raw {
+				isTargetSkipped = true
+				break
+			}
+		}
+	}
+
+	if isTargetSkipped {
+		// Use sendMessage for skipped/raw methods that aren't compiled to Go
+		args := []jen.Code{jen.Id("c"), jen.Lit(e.Selector)}
+		for _, arg := range e.Args {
+			args = append(args, g.generateExprAsString(arg, m))
+		}
+		return jen.Id("sendMessage").Call(args...)
+	}
+
+	// Self send to compiled method: direct Go method call
+	goMethodName := mangle.GoName(e.Selector)
+	if len(e.Args) == 0 {
+		return jen.Id("c").Dot(goMethodName).Call()
+	}
+	// Build args - Go methods take string params, or the types
+	// declared with argTypes:
+	args := []jen.Code{}
+	argTypes := g.selfSendArgTypes(e.Selector)
+	for i, arg := range e.Args {
+		if i < len(argTypes) && argConverters[argTypes[i]] != "" {
+			args = append(args, g.selfSendArg(arg, argTypes[i], m))
+			continue
+		}
+		// Check if the arg is a method parameter (already a string)
+		if ident, ok := arg.(*parser.Identifier); ok {
+			isMethodArg := false
+			for _, methodArg := range m.args {
+				if methodArg == ident.Name {
+					isMethodArg = true
+					break
+				}
+			}
+			if isMethodArg && g.typedArg(ident.Name, m) != "" {
+				args = append(args, g.argString(ident.Name, m))
+				continue
+			}
+			if isMethodArg {
+				// Use original string parameter directly
+				args = append(args, jen.Id(ident.Name))
+				continue
+			}
+		}
+		if str := g.typedString(arg, m); str != nil {
+			args = append(args, str)
+			continue
+		}
+		// For other args, generate and convert if needed
+		argExpr := g.generateExpr(arg, m)
+		// Wrap numeric literals in strconv.Itoa
+		if num, ok := arg.(*parser.NumberLit); ok {
+			if isFloatLit(num.Value) {
+				argExpr = jen.Lit(num.Value)
+			} else {
+				argExpr = jen.Qual("strconv", "Itoa").Call(argExpr)
+			}
+		}
+		args = append(args, argExpr)
+	}
+	return jen.Id("c").Dot(goMethodName).Call(args...)
+}
+
+// selfSendValue returns call as the value of the @ self send e. A compiled
+// method that answers nothing is called in a function answering "", as its
+// dispatch case does.
+func (g *generator) selfSendValue(e *parser.MessageSend, call *jen.Statement) *jen.Statement {
+	if g.skippedMethods[e.Selector] {
+		return call
+	}
+	for _, target := range g.compiled {
+		if target.selector == e.Selector && !target.isClass && !target.hasReturn && !target.returnsErr {
+			return jen.Func().Params().String().Block(call, jen.Return(jen.Lit(""))).Call()
+		}
+	}
+	return call
+}
+
 // hasReturnInStatements recursively checks if any statement contains a return
 func hasReturnInStatements(stmts []parser.Statement) bool {
 	for _, stmt := range stmts {
@@ -2376,6 +3392,10 @@ func hasReturnInStatements(stmts []parser.Statement) bool {
 			if hasReturnInStatements(s.Body) {
 				return true
 			}
+		case *parser.CountedLoopExpr:
+			if hasReturnInStatements(s.Body) {
+				return true
+			}
 		case *parser.IfNilExpr:
 			// Check inside both nil and not-nil blocks
 			if hasReturnInStatements(s.NilBlock) {
@@ -2469,11 +3489,30 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	)
 	f.Line()
 
+	// _jsonDecode - json.Unmarshal keeping numbers as json.Number, so 64-bit
+	// IDs in arrays and objects are not rounded through float64
+	f.Comment("// _jsonDecode unmarshals data into v, decoding numbers as json.Number")
+	f.Func().Id("_jsonDecode").Params(
+		jen.Id("data").Index().Byte(),
+		jen.Id("v").Interface(),
+	).Error().Block(
+		jen.Id("dec").Op(":=").Qual("encoding/json", "NewDecoder").Call(jen.Qual("bytes", "NewReader").Call(jen.Id("data"))),
+		jen.Id("dec").Dot("UseNumber").Call(),
+		jen.Return(jen.Id("dec").Dot("Decode").Call(jen.Id("v"))),
+	)
+	f.Line()
+
 	// _toStr - convert interface{} to string
 	f.Func().Id("_toStr").Params(jen.Id("v").Interface()).String().Block(
 		jen.If(jen.Id("v").Op("==").Nil()).Block(
 			jen.Return(jen.Lit("")),
 		),
+		jen.If(jen.List(jen.Id("n"), jen.Id("ok")).Op(":=").Id("v").Assert(jen.Qual("encoding/json", "Number")), jen.Id("ok")).Block(
+			jen.Return(jen.Id("n").Dot("String").Call()),
+		),
+		jen.If(jen.List(jen.Id("f"), jen.Id("ok")).Op(":=").Id("v").Assert(jen.Float64()), jen.Id("ok")).Block(
+			jen.Return(jen.Qual("strconv", "FormatFloat").Call(jen.Id("f"), jen.LitRune('f'), jen.Lit(-1), jen.Lit(64))),
+		),
 		jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("v"))),
 	)
 	f.Line()
@@ -2607,7 +3646,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonArrayLen
 	f.Func().Id("_jsonArrayLen").Params(jen.Id("jsonStr").String()).Int().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2620,7 +3659,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonArrayFirst
 	f.Func().Id("_jsonArrayFirst").Params(jen.Id("jsonStr").String()).String().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		).Op(";").Err().Op("!=").Nil().Op("||").Len(jen.Id("arr")).Op("==").Lit(0)).Block(
@@ -2633,7 +3672,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonArrayLast
 	f.Func().Id("_jsonArrayLast").Params(jen.Id("jsonStr").String()).String().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		).Op(";").Err().Op("!=").Nil().Op("||").Len(jen.Id("arr")).Op("==").Lit(0)).Block(
@@ -2646,7 +3685,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonArrayIsEmpty
 	f.Func().Id("_jsonArrayIsEmpty").Params(jen.Id("jsonStr").String()).Bool().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2663,7 +3702,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	).String().Block(
 		jen.Id("jsonStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("jsonVal")),
 		jen.Var().Id("arr").Index().Interface(),
-		jen.Qual("encoding/json", "Unmarshal").Call(
+		jen.Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		),
@@ -2679,7 +3718,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 		jen.Id("idx").Int(),
 	).String().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2702,7 +3741,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 		jen.Id("val").Interface(),
 	).String().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.Qual("encoding/json", "Unmarshal").Call(
+		jen.Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		),
@@ -2723,7 +3762,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 		jen.Id("idx").Int(),
 	).String().Block(
 		jen.Var().Id("arr").Index().Interface(),
-		jen.Qual("encoding/json", "Unmarshal").Call(
+		jen.Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("arr"),
 		),
@@ -2742,7 +3781,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonObjectLen
 	f.Func().Id("_jsonObjectLen").Params(jen.Id("jsonStr").String()).Int().Block(
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2755,7 +3794,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonObjectKeys
 	f.Func().Id("_jsonObjectKeys").Params(jen.Id("jsonStr").String()).Index().String().Block(
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2768,7 +3807,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonObjectValues
 	f.Func().Id("_jsonObjectValues").Params(jen.Id("jsonStr").String()).Index().Interface().Block(
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2781,7 +3820,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	// _jsonObjectIsEmpty
 	f.Func().Id("_jsonObjectIsEmpty").Params(jen.Id("jsonStr").String()).Bool().Block(
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2798,7 +3837,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	).String().Block(
 		jen.Id("jsonStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("jsonVal")),
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2819,7 +3858,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	).String().Block(
 		jen.Id("jsonStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("jsonVal")),
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.Qual("encoding/json", "Unmarshal").Call(
+		jen.Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		),
@@ -2839,7 +3878,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	).Bool().Block(
 		jen.Id("jsonStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("jsonVal")),
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(
+		jen.If(jen.Err().Op(":=").Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		).Op(";").Err().Op("!=").Nil()).Block(
@@ -2857,7 +3896,7 @@ func (g *generator) generateJSONHelpers(f *jen.File) {
 	).String().Block(
 		jen.Id("jsonStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("jsonVal")),
 		jen.Var().Id("m").Map(jen.String()).Interface(),
-		jen.Qual("encoding/json", "Unmarshal").Call(
+		jen.Id("_jsonDecode").Call(
 			jen.Index().Byte().Parens(jen.Id("jsonStr")),
 			jen.Op("&").Id("m"),
 		),
@@ -2873,15 +3912,16 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 	switch m.selector {
 	case "get_":
 		// Get(instanceId string) (string, error) - retrieve instance data
-		f.Func().Id("Get").Params(jen.Id("instanceId").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		f.Func().Id(m.goName).Params(jen.Id("instanceId").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Var().Id("data").String(),
-			jen.Err().Op("=").Id("db").Dot("QueryRow").Call(
+			jen.Err().Op("=").Id("dbQueryRow").Call(
+				jen.Id("db"),
 				jen.Lit("SELECT data FROM instances WHERE id = ?"),
 				jen.Id("instanceId"),
 			).Dot("Scan").Call(jen.Op("&").Id("data")),
@@ -2893,17 +3933,18 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 
 	case "set_to_":
 		// Set_to(instanceId, data string) (string, error) - store instance data
-		f.Func().Id("Set_to").Params(
+		f.Func().Id(m.goName).Params(
 			jen.Id("instanceId").String(),
 			jen.Id("data").String(),
 		).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
-			jen.List(jen.Id("_"), jen.Err()).Op("=").Id("db").Dot("Exec").Call(
+			jen.List(jen.Id("_"), jen.Err()).Op("=").Id("dbExec").Call(
+				jen.Id("db"),
 				jen.Lit("INSERT OR REPLACE INTO instances (id, data) VALUES (?, json(?))"),
 				jen.Id("instanceId"),
 				jen.Id("data"),
@@ -2916,14 +3957,15 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 
 	case "delete_":
 		// Delete(instanceId string) (string, error) - remove instance
-		f.Func().Id("Delete").Params(jen.Id("instanceId").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		f.Func().Id(m.goName).Params(jen.Id("instanceId").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
-			jen.List(jen.Id("_"), jen.Err()).Op("=").Id("db").Dot("Exec").Call(
+			jen.List(jen.Id("_"), jen.Err()).Op("=").Id("dbExec").Call(
+				jen.Id("db"),
 				jen.Lit("DELETE FROM instances WHERE id = ?"),
 				jen.Id("instanceId"),
 			),
@@ -2935,14 +3977,15 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 
 	case "findByClass_":
 		// FindByClass(className string) (string, error) - find all instances of class
-		f.Func().Id("FindByClass").Params(jen.Id("className").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		f.Func().Id(m.goName).Params(jen.Id("className").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
-			jen.List(jen.Id("rows"), jen.Err()).Op(":=").Id("db").Dot("Query").Call(
+			jen.List(jen.Id("rows"), jen.Err()).Op(":=").Id("dbQuery").Call(
+				jen.Id("db"),
 				jen.Lit("SELECT id FROM instances WHERE class = ?"),
 				jen.Id("className"),
 			),
@@ -2963,15 +4006,16 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 
 	case "exists_":
 		// Exists(instanceId string) (string, error) - check if instance exists
-		f.Func().Id("Exists").Params(jen.Id("instanceId").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		f.Func().Id(m.goName).Params(jen.Id("instanceId").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Var().Id("exists").Int(),
-			jen.Err().Op("=").Id("db").Dot("QueryRow").Call(
+			jen.Err().Op("=").Id("dbQueryRow").Call(
+				jen.Id("db"),
 				jen.Lit("SELECT 1 FROM instances WHERE id = ?"),
 				jen.Id("instanceId"),
 			).Dot("Scan").Call(jen.Op("&").Id("exists")),
@@ -2983,14 +4027,15 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 
 	case "listAll":
 		// ListAll() string - get all instance IDs
-		f.Func().Id("ListAll").Params().String().Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		f.Func().Id(m.goName).Params().String().Block(
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit("")),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
-			jen.List(jen.Id("rows"), jen.Err()).Op(":=").Id("db").Dot("Query").Call(
+			jen.List(jen.Id("rows"), jen.Err()).Op(":=").Id("dbQuery").Call(
+				jen.Id("db"),
 				jen.Lit("SELECT id FROM instances"),
 			),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
@@ -3010,15 +4055,16 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 
 	case "countByClass_":
 		// CountByClass(className string) (string, error) - count instances of class
-		f.Func().Id("CountByClass").Params(jen.Id("className").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		f.Func().Id(m.goName).Params(jen.Id("className").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Var().Id("count").Int(),
-			jen.Err().Op("=").Id("db").Dot("QueryRow").Call(
+			jen.Err().Op("=").Id("dbQueryRow").Call(
+				jen.Id("db"),
 				jen.Lit("SELECT COUNT(*) FROM instances WHERE class = ?"),
 				jen.Id("className"),
 			).Dot("Scan").Call(jen.Op("&").Id("count")),
@@ -3029,6 +4075,10 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 		)
 
 	default:
+		// findBy:value:, where: and orderBy:limit:
+		if g.generateEnvironmentQuery(f, m) {
+			break
+		}
 		// Unknown method - generate a stub
 		f.Comment("// " + m.selector + " - unknown Environment method")
 		f.Func().Id(m.goName).Params().String().Block(
@@ -3038,14 +4088,14 @@ func (g *generator) generateEnvironmentMethod(f *jen.File, m *compiledMethod) {
 	f.Line()
 }
 
-// generateGrpcClientMethod generates specialized gRPC implementations for GrpcClient methods.
+// generateGrpcClientMethod generates specialized gRPC implementations for gRPC client methods.
 // Returns true if the method was handled, false to fall through to default generation.
 // Note: selectors use underscores (from AST), not colons (from source syntax).
 func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) bool {
 	switch m.selector {
 	case "call_with_":
 		// Unary call: call: method with: jsonPayload
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
 			jen.Id("method").String(),
 			jen.Id("jsonPayload").String(),
 		).Parens(jen.List(jen.String(), jen.Error())).Block(
@@ -3056,7 +4106,7 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 
 	case "call_":
 		// Unary call with empty payload: call: method
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
 			jen.Id("method").String(),
 		).Parens(jen.List(jen.String(), jen.Error())).Block(
 			jen.Return(jen.Id("c").Dot("grpcCall").Call(jen.Id("method"), jen.Lit("{}"))),
@@ -3066,7 +4116,7 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 
 	case "serverStream_with_handler_":
 		// Server streaming: serverStream: method with: payload handler: block
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
 			jen.Id("method").String(),
 			jen.Id("payload").String(),
 			jen.Id("handlerBlockID").String(),
@@ -3082,7 +4132,7 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 
 	case "clientStream_handler_":
 		// Client streaming: clientStream: method handler: block
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
 			jen.Id("method").String(),
 			jen.Id("handlerBlockID").String(),
 		).Parens(jen.List(jen.String(), jen.Error())).Block(
@@ -3096,7 +4146,7 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 
 	case "bidiStream_handler_":
 		// Bidi streaming: bidiStream: method handler: block
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
 			jen.Id("method").String(),
 			jen.Id("handlerBlockID").String(),
 		).Parens(jen.List(jen.String(), jen.Error())).Block(
@@ -3110,7 +4160,7 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 
 	case "listServices":
 		// List services via reflection
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params().Parens(jen.List(jen.String(), jen.Error())).Block(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params().Parens(jen.List(jen.String(), jen.Error())).Block(
 			jen.List(jen.Id("conn"), jen.Err()).Op(":=").Id("c").Dot("getConnection").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
@@ -3137,7 +4187,7 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 
 	case "listMethods_":
 		// List methods for a service
-		f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id(m.goName).Params(
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
 			jen.Id("serviceName").String(),
 		).Parens(jen.List(jen.String(), jen.Error())).Block(
 			jen.List(jen.Id("conn"), jen.Err()).Op(":=").Id("c").Dot("getConnection").Call(),
@@ -3169,21 +4219,111 @@ func (g *generator) generateGrpcClientMethod(f *jen.File, m *compiledMethod) boo
 		f.Line()
 		return true
 
+	case "isHealthy":
+		// Health check via grpc.health.v1: "true" only if the server answers SERVING
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params().Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("conn"), jen.Err()).Op(":=").Id("c").Dot("getConnection").Call(),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit("false"), jen.Nil()),
+			),
+			jen.If(jen.Id("c").Dot("PoolConnections").Op("!=").Lit("yes")).Block(
+				jen.Defer().Id("conn").Dot("Close").Call(),
+			),
+			jen.Line(),
+			jen.List(jen.Id("ctx"), jen.Id("cancel")).Op(":=").Qual("context", "WithTimeout").Call(
+				jen.Qual("context", "Background").Call(),
+				jen.Lit(5).Op("*").Qual("time", "Second"),
+			),
+			jen.Defer().Id("cancel").Call(),
+			jen.List(jen.Id("resp"), jen.Err()).Op(":=").Qual("google.golang.org/grpc/health/grpc_health_v1", "NewHealthClient").Call(jen.Id("conn")).Dot("Check").Call(
+				jen.Id("ctx"),
+				jen.Op("&").Qual("google.golang.org/grpc/health/grpc_health_v1", "HealthCheckRequest").Values(),
+			),
+			jen.If(jen.Err().Op("!=").Nil().Op("||").Id("resp").Dot("GetStatus").Call().Op("!=").Qual("google.golang.org/grpc/health/grpc_health_v1", "HealthCheckResponse_SERVING")).Block(
+				jen.Return(jen.Lit("false"), jen.Nil()),
+			),
+			jen.Return(jen.Lit("true"), jen.Nil()),
+		)
+		f.Line()
+		return true
+
+	case "waitUntilReady_":
+		// waitUntilReady: timeoutSeconds - "true" once the connection is READY,
+		// "false" if it is not ready before the timeout
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params(
+			jen.Id("timeoutSeconds").String(),
+		).Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("seconds"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("timeoutSeconds"), jen.Lit(64)),
+			jen.If(jen.Err().Op("!=").Nil().Op("||").Id("seconds").Op("<").Lit(0)).Block(
+				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("waitUntilReady: timeout %q is not a number of seconds"), jen.Id("timeoutSeconds"))),
+			),
+			jen.List(jen.Id("conn"), jen.Err()).Op(":=").Id("c").Dot("getConnection").Call(),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.If(jen.Id("c").Dot("PoolConnections").Op("!=").Lit("yes")).Block(
+				jen.Defer().Id("conn").Dot("Close").Call(),
+			),
+			jen.Line(),
+			jen.List(jen.Id("ctx"), jen.Id("cancel")).Op(":=").Qual("context", "WithTimeout").Call(
+				jen.Qual("context", "Background").Call(),
+				jen.Qual("time", "Duration").Call(jen.Id("seconds").Op("*").Float64().Call(jen.Qual("time", "Second"))),
+			),
+			jen.Defer().Id("cancel").Call(),
+			jen.Id("conn").Dot("Connect").Call(),
+			jen.For().Block(
+				jen.Id("state").Op(":=").Id("conn").Dot("GetState").Call(),
+				jen.Switch(jen.Id("state")).Block(
+					jen.Case(jen.Qual("google.golang.org/grpc/connectivity", "Ready")).Block(
+						jen.Return(jen.Lit("true"), jen.Nil()),
+					),
+					jen.Case(jen.Qual("google.golang.org/grpc/connectivity", "Shutdown")).Block(
+						jen.Return(jen.Lit("false"), jen.Nil()),
+					),
+				),
+				// TRANSIENT_FAILURE keeps waiting: the connection retries with backoff
+				jen.If(jen.Op("!").Id("conn").Dot("WaitForStateChange").Call(jen.Id("ctx"), jen.Id("state"))).Block(
+					jen.Return(jen.Lit("false"), jen.Nil()),
+				),
+			),
+		)
+		f.Line()
+		return true
+
+	case "connectionState":
+		// IDLE, CONNECTING, READY, TRANSIENT_FAILURE or SHUTDOWN. An idle
+		// connection is asked to connect first, so a new one answers CONNECTING.
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(m.goName).Params().Parens(jen.List(jen.String(), jen.Error())).Block(
+			jen.List(jen.Id("conn"), jen.Err()).Op(":=").Id("c").Dot("getConnection").Call(),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.If(jen.Id("c").Dot("PoolConnections").Op("!=").Lit("yes")).Block(
+				jen.Defer().Id("conn").Dot("Close").Call(),
+			),
+			jen.If(jen.Id("conn").Dot("GetState").Call().Op("==").Qual("google.golang.org/grpc/connectivity", "Idle")).Block(
+				jen.Id("conn").Dot("Connect").Call(),
+			),
+			jen.Return(jen.Id("conn").Dot("GetState").Call().Dot("String").Call(), jen.Nil()),
+		)
+		f.Line()
+		return true
+
 	default:
-		// Not a special GrpcClient method - fall through to default generation
+		// Not a special gRPC client method - fall through to default generation
 		return false
 	}
 }
 
-// generateGrpcHelpers generates helper functions for GrpcClient class
+// generateGrpcHelpers generates helper functions for a native gRPC client
 func (g *generator) generateGrpcHelpers(f *jen.File) {
 	f.Line()
-	f.Comment("// gRPC helper functions for GrpcClient")
+	f.Comment("// gRPC helper functions for " + g.class.Name)
 	f.Line()
 
 	// getConnection - lazy connection creation
 	f.Comment("// getConnection returns an existing connection or creates a new one")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("getConnection").Params().Parens(jen.List(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("getConnection").Params().Parens(jen.List(
 		jen.Op("*").Qual("google.golang.org/grpc", "ClientConn"),
 		jen.Error(),
 	)).Block(
@@ -3212,7 +4352,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 
 	// closeConnection - closes the pooled connection if any
 	f.Comment("// closeConnection closes the pooled connection if any")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("closeConnection").Params().Block(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("closeConnection").Params().Block(
 		jen.If(jen.Id("c").Dot("conn").Op("!=").Nil()).Block(
 			jen.Id("c").Dot("conn").Dot("Close").Call(),
 			jen.Id("c").Dot("conn").Op("=").Nil(),
@@ -3222,7 +4362,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 
 	// loadProtoFile - parses and caches proto file descriptors
 	f.Comment("// loadProtoFile parses a proto file and caches the descriptors")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("loadProtoFile").Params().Error().Block(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("loadProtoFile").Params().Error().Block(
 		jen.If(jen.Len(jen.Id("c").Dot("fileDescs")).Op(">").Lit(0)).Block(
 			jen.Return(jen.Nil()), // Already loaded
 		),
@@ -3251,7 +4391,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 
 	// findMethodInProto - finds a method descriptor from cached proto descriptors
 	f.Comment("// findMethodInProto finds a method descriptor from parsed proto files")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("findMethodInProto").Params(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("findMethodInProto").Params(
 		jen.Id("serviceName").String(),
 		jen.Id("methodName").String(),
 	).Parens(jen.List(
@@ -3278,7 +4418,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 	// Returns conn, ctx, methodDescriptor, stub, cleanup function, error
 	f.Comment("// resolveMethod resolves a gRPC method using server reflection or proto file")
 	f.Comment("// Returns connection, context, method descriptor, stub, cleanup func, and error")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("resolveMethod").Params(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("resolveMethod").Params(
 		jen.Id("method").String(),
 	).Parens(jen.List(
 		jen.Op("*").Qual("google.golang.org/grpc", "ClientConn"),
@@ -3356,7 +4496,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 
 	// grpcCall - makes a unary gRPC call using reflection
 	f.Comment("// grpcCall makes a unary gRPC call using reflection")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("grpcCall").Params(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("grpcCall").Params(
 		jen.Id("method").String(),
 		jen.Id("jsonPayload").String(),
 	).Parens(jen.List(jen.String(), jen.Error())).Block(
@@ -3395,7 +4535,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 
 	// serverStream - makes a server streaming gRPC call
 	f.Comment("// serverStream makes a server streaming gRPC call with callback")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("serverStream").Params(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("serverStream").Params(
 		jen.Id("method").String(),
 		jen.Id("jsonPayload").String(),
 		jen.Id("handlerBlockID").String(),
@@ -3453,7 +4593,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 	// clientStream - makes a client streaming gRPC call
 	f.Comment("// clientStream makes a client streaming gRPC call")
 	f.Comment("// Block is called repeatedly to get messages; return empty string to end stream")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("clientStream").Params(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("clientStream").Params(
 		jen.Id("method").String(),
 		jen.Id("handlerBlockID").String(),
 	).Parens(jen.List(jen.String(), jen.Error())).Block(
@@ -3510,7 +4650,7 @@ func (g *generator) generateGrpcHelpers(f *jen.File) {
 	// bidiStream - makes a bidirectional streaming gRPC call
 	f.Comment("// bidiStream makes a bidirectional streaming gRPC call")
 	f.Comment("// Block receives responses and returns messages to send; return empty to stop sending")
-	f.Func().Parens(jen.Id("c").Op("*").Id("GrpcClient")).Id("bidiStream").Params(
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("bidiStream").Params(
 		jen.Id("method").String(),
 		jen.Id("handlerBlockID").String(),
 	).Parens(jen.List(jen.String(), jen.Error())).Block(
@@ -3683,22 +4823,19 @@ func (g *generator) generateStringFileHelpers(f *jen.File) {
 
 	// _fileIsReadable - check if path is readable
 	f.Func().Id("_fileIsReadable").Params(jen.Id("path").String()).String().Block(
-		jen.Err().Op(":=").Qual("golang.org/x/sys/unix", "Access").Call(jen.Id("path"), jen.Qual("golang.org/x/sys/unix", "R_OK")),
-		jen.Return(jen.Id("_boolToString").Call(jen.Err().Op("==").Nil())),
+		g.fileAccessCheck("R_OK", 0444)...,
 	)
 	f.Line()
 
 	// _fileIsWritable - check if path is writable
 	f.Func().Id("_fileIsWritable").Params(jen.Id("path").String()).String().Block(
-		jen.Err().Op(":=").Qual("golang.org/x/sys/unix", "Access").Call(jen.Id("path"), jen.Qual("golang.org/x/sys/unix", "W_OK")),
-		jen.Return(jen.Id("_boolToString").Call(jen.Err().Op("==").Nil())),
+		g.fileAccessCheck("W_OK", 0222)...,
 	)
 	f.Line()
 
 	// _fileIsExecutable - check if path is executable
 	f.Func().Id("_fileIsExecutable").Params(jen.Id("path").String()).String().Block(
-		jen.Err().Op(":=").Qual("golang.org/x/sys/unix", "Access").Call(jen.Id("path"), jen.Qual("golang.org/x/sys/unix", "X_OK")),
-		jen.Return(jen.Id("_boolToString").Call(jen.Err().Op("==").Nil())),
+		g.fileAccessCheck("X_OK", 0111)...,
 	)
 	f.Line()
 
@@ -1,13 +1,27 @@
 package codegen_test
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	goast "go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/chazu/procyon/pkg/ast"
 	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/protocol"
+	"github.com/chazu/procyon/pkg/source"
 )
 
 func TestCodegenAcceptance(t *testing.T) {
@@ -40,8 +54,24 @@ func TestCodegenAcceptance(t *testing.T) {
 				t.Fatalf("Failed to parse AST: %v", err)
 			}
 
-			// Generate code
-			result := codegen.Generate(class)
+			// Generate code, with the options of the case if it has any
+			opts := caseOptions{Mode: "binary"}
+			if data, err := os.ReadFile(filepath.Join(testDir, "options.json")); err == nil {
+				if err := json.Unmarshal(data, &opts); err != nil {
+					t.Fatalf("Failed to parse options.json: %v", err)
+				}
+			}
+			var result *codegen.Result
+			switch opts.Mode {
+			case "binary":
+				result = codegen.GenerateWithOptions(class, opts.Options)
+			case "plugin":
+				result = codegen.GeneratePluginWithOptions(class, opts.Options)
+			case "wasm":
+				result = codegen.GenerateWASMWithOptions(class, opts.Options)
+			default:
+				t.Fatalf("Unknown mode %q in options.json", opts.Mode)
+			}
 
 			// Read expected output
 			expectedPath := filepath.Join(testDir, "expected.go")
@@ -58,6 +88,23 @@ func TestCodegenAcceptance(t *testing.T) {
 				t.Errorf("Generated code does not match expected.\n\n=== EXPECTED ===\n%s\n\n=== ACTUAL ===\n%s", expected, actual)
 			}
 
+			// The expected code must build as it is; a class the mode
+			// rejects has none
+			if strings.TrimSpace(expected) != "" {
+				var env []string
+				if opts.Mode == "wasm" {
+					env = []string{"GOOS=wasip1", "GOARCH=wasm"}
+				}
+				buildGenerated(t, expected, env...)
+			}
+
+			// Compare the warnings, errors and skipped methods if the case lists them
+			if reportData, err := os.ReadFile(filepath.Join(testDir, "report.txt")); err == nil {
+				if got := resultReport(result); got != string(reportData) {
+					t.Errorf("Report does not match report.txt.\n\n=== EXPECTED ===\n%s\n=== ACTUAL ===\n%s", reportData, got)
+				}
+			}
+
 			// Check for warnings
 			if len(result.Warnings) > 0 {
 				t.Logf("Warnings: %v", result.Warnings)
@@ -71,6 +118,1113 @@ func TestCodegenAcceptance(t *testing.T) {
 	}
 }
 
+// caseOptions are the options.json of a test case: the generator to run
+// (binary, plugin or wasm) and the options to run it with
+type caseOptions struct {
+	Mode string
+	codegen.Options
+}
+
+// resultReport lists the warnings, compile errors and skipped methods of
+// result one per line, in the format of report.txt
+func resultReport(result *codegen.Result) string {
+	var b strings.Builder
+	for _, w := range result.Warnings {
+		fmt.Fprintf(&b, "warning: %s\n", w)
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(&b, "error at %d:%d: %s\n", e.Location.Line, e.Location.Col, e.Message)
+	}
+	for _, s := range result.SkippedMethods {
+		fmt.Fprintf(&b, "skipped %s at %d:%d: %s\n", s.Selector, s.Location.Line, s.Location.Col, s.Reason)
+	}
+	return b.String()
+}
+
+func TestGenerateBundle(t *testing.T) {
+	var classes []*ast.Class
+	for _, name := range []string{"counter", "class_method", "instance_ref", "environment_queries"} {
+		inputData, err := os.ReadFile(filepath.Join("../../testdata", name, "input.json"))
+		if err != nil {
+			t.Fatalf("Failed to read %s input.json: %v", name, err)
+		}
+		class, err := ast.ParseBytes(inputData)
+		if err != nil {
+			t.Fatalf("Failed to parse %s AST: %v", name, err)
+		}
+		classes = append(classes, class)
+	}
+
+	result := codegen.GenerateBundle(classes)
+	buildGenerated(t, result.Code)
+
+	for _, want := range []string{
+		"var _classes = map[string]*_bundleClass{",
+		"func Counter_dispatch(c *Counter,",
+		"func Task_dispatchInstance(db *sql.DB,",
+		"//go:embed Task.trash",
+	} {
+		if !strings.Contains(result.Code, want) {
+			t.Errorf("Bundle missing %q", want)
+		}
+	}
+
+	// Shared helpers must be emitted exactly once
+	for _, helper := range []string{"func openDB()", "func sendMessage(", "func toInt("} {
+		if n := strings.Count(result.Code, helper); n != 1 {
+			t.Errorf("Expected %q once, found %d times", helper, n)
+		}
+	}
+}
+
+func TestGenerateBundleSameNameInPackages(t *testing.T) {
+	inputData, err := os.ReadFile(filepath.Join("../../testdata", "counter", "input.json"))
+	if err != nil {
+		t.Fatalf("Failed to read input.json: %v", err)
+	}
+	var classes []*ast.Class
+	for _, pkg := range []string{"Alpha", "Beta"} {
+		class, err := ast.ParseBytes(inputData)
+		if err != nil {
+			t.Fatalf("Failed to parse AST: %v", err)
+		}
+		class.Package = pkg
+		classes = append(classes, class)
+	}
+
+	result := codegen.GenerateBundle(classes)
+	if len(result.Warnings) > 0 {
+		t.Errorf("Unexpected warnings: %v", result.Warnings)
+	}
+	for _, want := range []string{"type Alpha__Counter struct", "type Beta__Counter struct"} {
+		if !strings.Contains(result.Code, want) {
+			t.Errorf("Bundle missing %q", want)
+		}
+	}
+	bin := buildGenerated(t, result.Code)
+
+	db := newInstancesDB(t)
+	for _, pkg := range []string{"Alpha", "Beta"} {
+		id := mustRun(t, bin, db, pkg+"::Counter", "new")
+		if got := mustRun(t, bin, db, id, "printString"); !strings.HasPrefix(got, "<"+pkg+"::Counter ") {
+			t.Errorf("%s instance printString = %q", pkg, got)
+		}
+	}
+}
+
+func TestGenerateSourceMap(t *testing.T) {
+	class := loadTestdata(t, "class_method")
+	class.Methods[2].Trait = "Versioned"
+
+	result := codegen.GenerateWithOptions(class, codegen.Options{SourceMap: true, Comments: true})
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", result.Code, 0)
+	if err != nil {
+		t.Fatalf("Output is not valid Go: %v", err)
+	}
+	sm := result.SourceMap
+	if sm == nil || sm.Class != "Widget" || sm.Source != "Widget.trash" || len(sm.Methods) == 0 {
+		t.Fatalf("Unexpected source map %+v", sm)
+	}
+
+	// Each entry spans the function it names
+	funcs := map[int]*goast.FuncDecl{}
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*goast.FuncDecl); ok {
+			funcs[fset.Position(fn.Pos()).Line] = fn
+		}
+	}
+	for _, e := range sm.Methods {
+		fn := funcs[e.GoStart]
+		if fn == nil || fn.Name.Name != e.Function || (fn.Recv == nil) != e.ClassMethod || fset.Position(fn.End()).Line != e.GoEnd {
+			t.Errorf("%s: lines %d-%d are not %s", e.Selector, e.GoStart, e.GoEnd, e.Function)
+		}
+		if got, ok := sm.Lookup(e.GoStart + 1); !ok || got.Selector != e.Selector {
+			t.Errorf("Lookup(%d) = %+v, want %s", e.GoStart+1, got, e.Selector)
+		}
+	}
+
+	for _, want := range []string{
+		"defer _sourceMapPanic()",
+		`"Widget.trash:5:1 Widget>>getName"}`,
+		`"Widget.trash:9:1 Widget class>>description"}`,
+		`"Versioned.trash:13:1 Widget class>>version"}`,
+	} {
+		if !strings.Contains(result.Code, want) {
+			t.Errorf("Output missing %q", want)
+		}
+	}
+
+	// Without SourceMap the output is Generate's
+	if plain := codegen.GenerateWithOptions(class, codegen.Options{}); plain.SourceMap != nil || strings.Contains(plain.Code, "_sourceMap") {
+		t.Error("Expected no source map by default")
+	}
+}
+
+// tallySource is a class whose bumpWhile: runs a command between loading
+// and saving the instance
+const tallySource = `Tally subclass: Object
+  instanceVars: count:0
+  capabilities: process
+
+  method: bump [
+    count := count + 1
+  ]
+
+  method: bumpWhile: command [
+    count := count + 1.
+    @ Shell run: command
+  ]
+`
+
+func TestSaveConflictIsNotRedispatched(t *testing.T) {
+	class, err := source.Parse(tallySource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := codegen.Generate(class)
+	if len(result.SkippedMethods) > 0 {
+		t.Fatalf("Expected Tally to compile, skipped: %s", result.SkippedMethods[0].Reason)
+	}
+	bin := buildGenerated(t, result.Code)
+	db := newInstancesDB(t)
+	id := mustRun(t, bin, db, "Tally", "new")
+
+	// The command saves the instance while bumpWhile: holds the copy it
+	// loaded, so its own save loses the race. The transaction bumpWhile:
+	// runs in is committed before the command, which would otherwise wait
+	// on it.
+	out, code := runGenerated(t, bin, db, id, "bumpWhile_", bin+" "+id+" bump")
+	if code != 1 || !strings.Contains(out, "instance modified concurrently") {
+		t.Fatalf("bumpWhile: exited %d: %s, want a conflict", code, out)
+	}
+	// Dispatching again would have run the command, and bumped, once more
+	if data := storedData(t, db, id); !strings.Contains(data, `"_version":1,`) || !strings.Contains(data, `"count":"1"`) {
+		t.Errorf("stored %s, want only the command's bump", data)
+	}
+}
+
+func TestInstanceRequestIsOneUnitOfWork(t *testing.T) {
+	class, err := source.Parse(tallySource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.GenerateWithOptions(class, codegen.Options{History: true}).Code)
+	db := newInstancesDB(t)
+	id := mustRun(t, bin, db, "Tally", "new")
+
+	// bump saves the instance and then its history row; when the history
+	// row is refused, the save is rolled back with it
+	execSQL(t, db, "CREATE TRIGGER history_full BEFORE INSERT ON instance_history BEGIN SELECT RAISE(ABORT, 'history full'); END")
+	if out, code := runGenerated(t, bin, db, id, "bump"); code != 1 || !strings.Contains(out, "history full") {
+		t.Errorf("bump exited %d: %s, want the history error", code, out)
+	}
+	if data := storedData(t, db, id); !strings.Contains(data, `"_version":0,`) || !strings.Contains(data, `"count":"0"`) {
+		t.Errorf("stored %s, want the instance as it was", data)
+	}
+}
+
+// TestStorageSaveConflict races two saves of an instance, as
+// TestSaveConflictIsNotRedispatched does, through the storage backends
+// that other processes share
+func TestStorageSaveConflict(t *testing.T) {
+	class, err := source.Parse(tallySource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.GenerateWithOptions(class, codegen.Options{Storage: []string{"sqlite", "file"}}).Code)
+
+	for _, backend := range []string{"sqlite", "file"} {
+		t.Run(backend, func(t *testing.T) {
+			db := newInstancesDB(t)
+			dir := t.TempDir()
+			t.Setenv("TRASHTALK_STORAGE", backend)
+			t.Setenv("TRASHTALK_STORAGE_DIR", dir)
+			stored := func(id string) string {
+				if backend == "sqlite" {
+					return storedData(t, db, id)
+				}
+				data, err := os.ReadFile(filepath.Join(dir, id+".json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(data)
+			}
+
+			id := mustRun(t, bin, db, "Tally", "new")
+			out, code := runGenerated(t, bin, db, id, "bumpWhile_", bin+" "+id+" bump")
+			if code != 1 || !strings.Contains(out, "instance modified concurrently") {
+				t.Fatalf("bumpWhile: exited %d: %s, want a conflict", code, out)
+			}
+			if data := stored(id); !strings.Contains(data, `"_version":2,`) || !strings.Contains(data, `"count":"1"`) {
+				t.Errorf("stored %s, want only the command's bump", data)
+			}
+
+			// A save at the version it loaded goes through
+			mustRun(t, bin, db, id, "bump")
+			if data := stored(id); !strings.Contains(data, `"_version":3,`) || !strings.Contains(data, `"count":"2"`) {
+				t.Errorf("stored %s after bump, want version 3 with count 2", data)
+			}
+		})
+	}
+}
+
+func TestServeRequestIsOneUnitOfWork(t *testing.T) {
+	class, err := source.Parse(`Tally subclass: Object
+  instanceVars: count:0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.GenerateWithOptions(class, codegen.Options{History: true}).Code)
+	db := newInstancesDB(t)
+
+	// new inserts the instance and then its first history row; when the
+	// history row is refused, the insert is rolled back with it
+	execSQL(t, db,
+		"CREATE TABLE instance_history (id TEXT NOT NULL, data JSON, saved_at TEXT NOT NULL)",
+		"CREATE TRIGGER history_full BEFORE INSERT ON instance_history BEGIN SELECT RAISE(ABORT, 'history full'); END",
+	)
+	resp := serveGenerated(t, bin, db, `{"selector":"new"}`, `{"selector":"instanceCount"}`)
+	if resp[0].ExitCode != 1 || !strings.Contains(resp[0].Error, "history full") {
+		t.Errorf("new = %+v, want the history error", resp[0])
+	}
+	if resp[1].Result != "0" {
+		t.Errorf("instanceCount after the failed new = %q, want 0", resp[1].Result)
+	}
+
+	execSQL(t, db, "DROP TRIGGER history_full")
+	resp = serveGenerated(t, bin, db, `{"selector":"new"}`, `{"selector":"instanceCount"}`)
+	if resp[0].ExitCode != 0 || !hasInstance(t, db, resp[0].Result) {
+		t.Errorf("new = %+v, want a stored instance", resp[0])
+	}
+	if resp[1].Result != "1" {
+		t.Errorf("instanceCount = %q, want 1", resp[1].Result)
+	}
+}
+
+// TestServeSendCommitsFirst sends, from a --serve request, a message that
+// trash-send hands to another process writing the same database. Looking
+// the receiver up for the daemon reads the database in the request's
+// transaction, which must not keep that process from writing.
+func TestServeSendCommitsFirst(t *testing.T) {
+	class, err := source.Parse(`Tally subclass: Object
+  instanceVars: count:0
+
+  method: bump [
+    count := count + 1
+  ]
+
+  method: bumpWith: other [
+    count := count + 1.
+    @ other bump
+  ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.Generate(class).Code)
+	db := newInstancesDB(t)
+
+	home := t.TempDir()
+	script := filepath.Join(home, ".trashtalk", "bin", "trash-send")
+	if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexec \"$TALLY_BIN\" \"$@\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("TALLY_BIN", bin)
+	t.Setenv("TRASHTALK_DAEMON_SOCKET", fakeDaemon(t, func(protocol.Request) protocol.Response {
+		return protocol.Response{ExitCode: protocol.ExitUnknownSelector}
+	}))
+
+	id := mustRun(t, bin, db, "Tally", "new")
+	other := mustRun(t, bin, db, "Tally", "new")
+	resp := serveGenerated(t, bin, db, `{"instance_id":"`+id+`","instance":"{\"class\":\"Tally\"}","selector":"bumpWith_","args":["`+other+`"]}`)
+	if resp[0].ExitCode != 0 {
+		t.Fatalf("bumpWith: = %+v, want success", resp[0])
+	}
+	if data := storedData(t, db, other); !strings.Contains(data, `"count":"1"`) {
+		t.Errorf("%s stored %s, want bump's count 1", other, data)
+	}
+}
+
+// loadTestdata parses the input.json of the test case name
+func loadTestdata(t *testing.T, name string) *ast.Class {
+	t.Helper()
+	inputData, err := os.ReadFile(filepath.Join("../../testdata", name, "input.json"))
+	if err != nil {
+		t.Fatalf("Failed to read input.json: %v", err)
+	}
+	class, err := ast.ParseBytes(inputData)
+	if err != nil {
+		t.Fatalf("Failed to parse AST: %v", err)
+	}
+	return class
+}
+
+func TestLargeNumbersRoundTrip(t *testing.T) {
+	// 2^53 + 1, the first integer a float64 cannot hold
+	const big = "9007199254740993"
+	code := codegen.Generate(loadTestdata(t, "large_numbers")).Code
+
+	testGenerated(t, code, `package main
+
+import "testing"
+
+func TestLargeNumber(t *testing.T) {
+	var v interface{}
+	if err := _jsonDecode([]byte("`+big+`"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if got := _toStr(v); got != "`+big+`" {
+		t.Errorf("_toStr answered %s, want `+big+`", got)
+	}
+	var items []interface{}
+	_jsonDecode([]byte("[`+big+`]"), &items)
+	if got := _toStr(items); got != "[`+big+`]" {
+		t.Errorf("_toStr answered %s, want [`+big+`]", got)
+	}
+}
+`, newInstancesDB(t))
+
+	bin := buildGenerated(t, code)
+	db := newInstancesDB(t)
+	id := mustRun(t, bin, db, "Ledger", "new")
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"firstId_", "[" + big + ",1]"}, big},
+		{[]string{"owner_", `{"owner":` + big + `}`}, big},
+		{[]string{"bigOnes_", "[9007199254740992," + big + "]"}, "[" + big + "]"},
+		{[]string{"total_", "[" + big + ",2]"}, "9007199254740995"},
+	} {
+		if out := mustRun(t, bin, db, append([]string{id}, tc.args...)...); out != tc.want {
+			t.Errorf("%s %s answered %s, want %s", tc.args[0], tc.args[1], out, tc.want)
+		}
+	}
+}
+
+func TestAddIntMatchesArith(t *testing.T) {
+	// value := value + 1 updates in place with _addInt, which must answer
+	// what the _arith it replaced did
+	testGenerated(t, codegen.Generate(loadTestdata(t, "increment")).Code, `package main
+
+import "testing"
+
+func TestAddIntMatchesArith(t *testing.T) {
+	for _, s := range []string{"0", "41", "-3", "1.5", "", "abc", " 7"} {
+		for _, n := range []int{1, -1, 5} {
+			if got, want := _addInt(s, n), _toStr(_arith("+", s, n)); got != want {
+				t.Errorf("_addInt(%q, %d) = %q, want %q", s, n, got, want)
+			}
+		}
+	}
+}
+`, newInstancesDB(t))
+}
+
+// BenchmarkIncrement measures the in-place _addInt update of the increment
+// golden against the _arith output it replaced. Both run inside the
+// generated module, and their ns/op are reported as addInt-ns/op and
+// arith-ns/op.
+func BenchmarkIncrement(b *testing.B) {
+	golden, err := os.ReadFile("../../testdata/increment/expected.go")
+	if err != nil {
+		b.Fatal(err)
+	}
+	out := benchGenerated(b, string(golden), `package main
+
+import "testing"
+
+func BenchmarkAddInt(b *testing.B) {
+	c := &Tally{Count: "0"}
+	for i := 0; i < b.N; i++ {
+		c.Count = _addInt(c.Count, 1)
+	}
+}
+
+func BenchmarkArith(b *testing.B) {
+	c := &Tally{Count: "0"}
+	for i := 0; i < b.N; i++ {
+		c.Count = _toStr(_arith("+", c.Count, 1))
+	}
+}
+`)
+
+	reported := 0
+	for _, line := range strings.Split(out, "\n") {
+		// BenchmarkAddInt-8   	100000000	        10.5 ns/op
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != "ns/op" || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(fields[0], "Benchmark"), "-")
+		ns, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			b.Fatalf("parsing %q: %v", line, err)
+		}
+		b.ReportMetric(ns, strings.ToLower(name[:1])+name[1:]+"-ns/op")
+		reported++
+	}
+	if reported != 2 {
+		b.Fatalf("go test -bench reported %d benchmarks, want 2:\n%s", reported, out)
+	}
+	b.ReportMetric(0, "ns/op")
+}
+
+func TestDeepCopyDoesNotShare(t *testing.T) {
+	code := codegen.Generate(loadTestdata(t, "typed_ivars")).Code
+
+	testGenerated(t, code, `package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeepCopy(t *testing.T) {
+	tags := []interface{}{map[string]interface{}{"names": []interface{}{"a"}}}
+	copied := _deepCopy(tags).([]interface{})
+	if !reflect.DeepEqual(copied, tags) {
+		t.Fatalf("_deepCopy answered %v, want %v", copied, tags)
+	}
+	nested := copied[0].(map[string]interface{})
+	nested["names"].([]interface{})[0] = "b"
+	nested["more"] = true
+	copied[0] = nil
+	if want := []interface{}{map[string]interface{}{"names": []interface{}{"a"}}}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("changing the copy changed the original to %v", tags)
+	}
+	if got := _deepCopy([]interface{}(nil)).([]interface{}); got != nil {
+		t.Errorf("_deepCopy of a nil array answered %v, want nil", got)
+	}
+}
+`, newInstancesDB(t))
+
+	bin := buildGenerated(t, code)
+	db := newInstancesDB(t)
+	id := mustRun(t, bin, db, "Tally", "new")
+	mustRun(t, bin, db, id, "tag_", "a")
+	copyID := mustRun(t, bin, db, id, "deepCopy")
+	if copyID == id || !hasInstance(t, db, copyID) {
+		t.Fatalf("deepCopy answered %s, want the ID of a new instance", copyID)
+	}
+	mustRun(t, bin, db, id, "tag_", "b")
+	if got := mustRun(t, bin, db, copyID, "tags"); got != `["a"]` {
+		t.Errorf("copy's tags = %s after tagging the original, want [\"a\"]", got)
+	}
+	if got := mustRun(t, bin, db, id, "tags"); got != `["a","b"]` {
+		t.Errorf("original's tags = %s, want [\"a\",\"b\"]", got)
+	}
+}
+
+func TestCleanInstanceIsNotSaved(t *testing.T) {
+	class, err := source.Parse(`Tally subclass: Object
+  instanceVars: count:0
+
+  method: current [
+    ^ count
+  ]
+
+  method: bump [
+    count := count + 1
+  ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.Generate(class).Code)
+	db := newInstancesDB(t)
+	id := mustRun(t, bin, db, "Tally", "new")
+
+	// A method that assigns no instance variable leaves the row alone
+	before := storedData(t, db, id)
+	if out := mustRun(t, bin, db, id, "current"); out != "0" {
+		t.Errorf("current answered %q, want 0", out)
+	}
+	if data := storedData(t, db, id); data != before {
+		t.Errorf("current saved %s over %s", data, before)
+	}
+
+	mustRun(t, bin, db, id, "bump")
+	if data := storedData(t, db, id); !strings.Contains(data, `"_version":1,`) || !strings.Contains(data, `"count":"1"`) {
+		t.Errorf("bump stored %s, want version 1 with count 1", data)
+	}
+}
+
+func TestFailedSaveLeavesInstanceDirty(t *testing.T) {
+	class, err := source.Parse(`Tally subclass: Object
+  instanceVars: count:0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// saveInstance runs in a unit of work that is rolled back, as after a
+	// method error, and then in one that is committed
+	testGenerated(t, codegen.Generate(class).Code, `package main
+
+import "testing"
+
+func TestSaveInUnitOfWork(t *testing.T) {
+	instance := &Tally{Class: "Tally", dirty: true}
+	for _, commit := range []bool{false, true} {
+		if err := beginWork(); err != nil {
+			t.Fatal(err)
+		}
+		db, err := requestDB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := saveInstance(db, "tally_1", instance); err != nil {
+			t.Fatal(err)
+		}
+		if !instance.dirty || instance.Version != 1 {
+			t.Errorf("before the commit: dirty %v, version %d, want dirty at version 1", instance.dirty, instance.Version)
+		}
+		if err := endWork(commit); err != nil {
+			t.Fatal(err)
+		}
+		releaseDB(db)
+		if commit && (instance.dirty || instance.Version != 1) {
+			t.Errorf("committed: dirty %v, version %d, want clean at version 1", instance.dirty, instance.Version)
+		}
+		if !commit && (!instance.dirty || instance.Version != 0) {
+			t.Errorf("rolled back: dirty %v, version %d, want dirty at version 0", instance.dirty, instance.Version)
+		}
+	}
+}
+`, newInstancesDB(t))
+}
+
+func TestClassVersionMigratesOnLoad(t *testing.T) {
+	bin := buildGenerated(t, codegen.Generate(loadTestdata(t, "class_version")).Code)
+	db := newInstancesDB(t)
+
+	// Saved by version 1, which kept the balance in dollars in any currency
+	id := "account_v1"
+	storeInstance(t, db, id, `{"class":"Account","created_at":"2026-01-01T00:00:00Z","_version":2,"balance":"5","currency":"EUR","_classVersion":1}`)
+	mustRun(t, bin, db, id, "deposit_", "1")
+
+	data := storedData(t, db, id)
+	for _, want := range []string{`"balance":"501"`, `"currency":"USD"`, `"_classVersion":3`} {
+		if !strings.Contains(data, want) {
+			t.Errorf("stored %s, want %s", data, want)
+		}
+	}
+}
+
+func TestSchemaMigrationRenamesOnLoad(t *testing.T) {
+	bin := buildGenerated(t, codegen.Generate(loadTestdata(t, "schema_migration")).Code)
+	db := newInstancesDB(t)
+
+	// Saved before total and state were renamed, so with no content hash
+	id := "account_old"
+	storeInstance(t, db, id, `{"class":"Account","created_at":"2026-01-01T00:00:00Z","_version":0,"owner":"ann","total":"7","state":"closed"}`)
+	if out := mustRun(t, bin, db, id, "describe"); out != "ann closed 7" {
+		t.Errorf("describe answered %q, want the renamed values", out)
+	}
+
+	// The migrated instance is saved once, under the current names
+	data := storedData(t, db, id)
+	for _, want := range []string{`"balance":"7"`, `"status":"closed"`, `"tags":[]`, `"_contentHash":"`} {
+		if !strings.Contains(data, want) {
+			t.Errorf("stored %s, want %s", data, want)
+		}
+	}
+	if strings.Contains(data, `"total"`) || strings.Contains(data, `"state"`) {
+		t.Errorf("stored %s, want the old names dropped", data)
+	}
+}
+
+func TestClassInstanceVarsPersist(t *testing.T) {
+	bin := buildGenerated(t, codegen.Generate(loadTestdata(t, "class_instance_vars")).Code)
+	db := newInstancesDB(t)
+
+	// Each run loads the class's row and saves what its class methods change
+	for i, name := range []string{"a", "b"} {
+		if out := mustRun(t, bin, db, "Registry", "register_", name); out != strconv.Itoa(i+1) {
+			t.Errorf("register: %s answered %q, want %d", name, out, i+1)
+		}
+	}
+	if out := mustRun(t, bin, db, "Registry", "summary"); out != "b of 2" {
+		t.Errorf("summary answered %q, want b of 2", out)
+	}
+	if data := storedData(t, db, "Registry::class"); !strings.Contains(data, `"lastName":"b"`) {
+		t.Errorf("class row is %s, want lastName b", data)
+	}
+
+	mustRun(t, bin, db, "Registry", "reset")
+	if out := mustRun(t, bin, db, "Registry", "count"); out != "0" {
+		t.Errorf("count after reset answered %q, want 0", out)
+	}
+}
+
+func TestNewRunsInitialize(t *testing.T) {
+	bin := buildGenerated(t, codegen.Generate(loadTestdata(t, "initialize_hook")).Code)
+	db := newInstancesDB(t)
+
+	id := mustRun(t, bin, db, "Account", "new")
+	if out := mustRun(t, bin, db, id, "describe"); out != "open 100" {
+		t.Errorf("describe answered %q, want the values initialize set", out)
+	}
+	if data := storedData(t, db, id); !strings.Contains(data, `"_version":0,`) {
+		t.Errorf("stored %s, want initialize to run before the first save", data)
+	}
+}
+
+func TestDeleteRunsAboutToDelete(t *testing.T) {
+	bin := buildGenerated(t, codegen.Generate(loadTestdata(t, "about_to_delete")).Code)
+	db := newInstancesDB(t)
+
+	// aboutToDelete throws for a locked instance, which stops the delete
+	locked := mustRun(t, bin, db, "Lock", "new")
+	mustRun(t, bin, db, locked, "lock")
+	if out, code := runGenerated(t, bin, db, locked, "delete"); code == 0 || !strings.Contains(out, "still locked") {
+		t.Errorf("delete of a locked instance exited %d: %s, want the Locked error", code, out)
+	}
+	if !hasInstance(t, db, locked) {
+		t.Error("locked instance was deleted")
+	}
+
+	unlocked := mustRun(t, bin, db, "Lock", "new")
+	mustRun(t, bin, db, unlocked, "delete")
+	if hasInstance(t, db, unlocked) {
+		t.Error("unlocked instance was not deleted")
+	}
+}
+
+func TestSendMessageGoesThroughDaemon(t *testing.T) {
+	class, err := source.Parse(`Greeter subclass: Object
+  instanceVars: peer
+  ref: peer
+
+  method: greet: name [
+    ^ @ Logger info: name
+  ]
+
+  method: shout: name [
+    ^ @ Logger shout: name
+  ]
+
+  method: befriend: other [
+    peer := other
+  ]
+
+  method: poke [
+    ^ @ peer ping
+  ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.Generate(class).Code)
+	db := newInstancesDB(t)
+
+	// Messages the daemon has no native method for go to trash-send
+	home := t.TempDir()
+	script := filepath.Join(home, ".trashtalk", "bin", "trash-send")
+	if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho bash \"$@\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("TRASHTALK_DAEMON_SOCKET", fakeDaemon(t, func(req protocol.Request) protocol.Response {
+		switch {
+		case req.Class == "Logger" && req.Selector == "info_" && req.Instance == "":
+			return protocol.Response{Result: "logged " + strings.Join(req.Args, " ")}
+		case req.Class == "Greeter" && req.Selector == "ping":
+			var data map[string]any
+			if err := json.Unmarshal([]byte(req.Instance), &data); err != nil {
+				return protocol.Response{ExitCode: protocol.ExitError, Error: err.Error()}
+			}
+			data["peer"] = "pinged"
+			instance, _ := json.Marshal(data)
+			return protocol.Response{Instance: string(instance), Result: "pong"}
+		}
+		return protocol.Response{ExitCode: protocol.ExitUnknownSelector}
+	}))
+
+	id := mustRun(t, bin, db, "Greeter", "new")
+	if out := mustRun(t, bin, db, id, "greet_", "hi"); out != "logged hi" {
+		t.Errorf("greet: answered %q, want the daemon's logged hi", out)
+	}
+	if out := mustRun(t, bin, db, id, "shout_", "hi"); out != "bash Logger shout_ hi" {
+		t.Errorf("shout: answered %q, want trash-send's answer", out)
+	}
+
+	// An instance receiver is sent with its data and stored as the daemon answers it
+	peer := mustRun(t, bin, db, "Greeter", "new")
+	mustRun(t, bin, db, id, "befriend_", peer)
+	if out := mustRun(t, bin, db, id, "poke"); out != "pong" {
+		t.Errorf("poke answered %q, want pong", out)
+	}
+	if data := storedData(t, db, peer); !strings.Contains(data, `"peer":"pinged"`) || !strings.Contains(data, `"_version":1`) {
+		t.Errorf("peer stored %s, want the daemon's instance at _version 1", data)
+	}
+
+	// So is the instance a ref: ivar names
+	storeInstance(t, db, "greeter_other", `{"class":"Greeter","peer":""}`)
+	mustRun(t, bin, db, id, "befriend_", "greeter_other")
+	if out := mustRun(t, bin, db, id, "peerDo_args_", "ping"); out != "pong" {
+		t.Errorf("peerDo: ping answered %q, want pong", out)
+	}
+	if data := storedData(t, db, "greeter_other"); !strings.Contains(data, `"peer":"pinged"`) {
+		t.Errorf("greeter_other stored %s, want the daemon's instance", data)
+	}
+
+	// Without a daemon socket every message goes to trash-send
+	t.Setenv("TRASHTALK_DAEMON_SOCKET", filepath.Join(home, "missing.sock"))
+	if out := mustRun(t, bin, db, id, "greet_", "hi"); out != "bash Logger info_ hi" {
+		t.Errorf("greet: without a daemon answered %q, want trash-send's answer", out)
+	}
+}
+
+func TestSendMessageReceiverErrors(t *testing.T) {
+	class, err := source.Parse(`Greeter subclass: Object
+  instanceVars: peer
+
+  method: greet: name [
+    ^ @ Logger info: name
+  ]
+
+  method: greetSafely: name [
+    | result |
+    result := 'ok'.
+    [ result := @ Logger info: name ] on: Boom do: [:e | result := 'caught ', e ].
+    ^ result
+  ]
+
+  method: poke: other [
+    ^ @ other ping
+  ]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := buildGenerated(t, codegen.Generate(class).Code)
+	db := newInstancesDB(t)
+
+	home := t.TempDir()
+	script := filepath.Join(home, ".trashtalk", "bin", "trash-send")
+	if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho bash \"$@\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	code := protocol.ExitTrashError
+	t.Setenv("TRASHTALK_DAEMON_SOCKET", fakeDaemon(t, func(req protocol.Request) protocol.Response {
+		if req.Selector == "ping" {
+			return protocol.Response{Instance: `{"class":"Greeter","peer":"pinged","_version":7}`, Result: "pong"}
+		}
+		return protocol.Response{ExitCode: code, Error: "Boom: " + strings.Join(req.Args, " ")}
+	}))
+	id := mustRun(t, bin, db, "Greeter", "new")
+
+	// The receiver's error is signaled in the sender, where on:do: catches it
+	if out, code := runGenerated(t, bin, db, id, "greet_", "hi"); code != protocol.ExitTrashError || out != "Error: Boom: hi" {
+		t.Errorf("greet: exited %d with %q, want 201 with the receiver's error", code, out)
+	}
+	if out := mustRun(t, bin, db, id, "greetSafely_", "hi"); out != "caught hi" {
+		t.Errorf("greetSafely: answered %q, want the handler's answer", out)
+	}
+	code = protocol.ExitStorageBusy
+	if out, code := runGenerated(t, bin, db, id, "greet_", "hi"); code != protocol.ExitTrashError || !strings.HasPrefix(out, "Error: StorageBusy: ") {
+		t.Errorf("greet: of a busy receiver exited %d with %q, want a StorageBusy error", code, out)
+	}
+
+	// The answered instance is stored at the version after the one sent,
+	// unless another process saved it in the meantime
+	storeInstance(t, db, "greeter_peer", `{"class":"Greeter","peer":"","_version":2}`)
+	if out := mustRun(t, bin, db, id, "poke_", "greeter_peer"); out != "pong" {
+		t.Errorf("poke: answered %q, want pong", out)
+	}
+	if data := storedData(t, db, "greeter_peer"); !strings.Contains(data, `"peer":"pinged"`) || !strings.Contains(data, `"_version":3`) {
+		t.Errorf("greeter_peer stored %s, want the daemon's instance at _version 3", data)
+	}
+
+	// A corrupt instance is left to Bash, like one the database does not hold
+	storeInstance(t, db, "greeter_corrupt", `"not an object"`)
+	if out := mustRun(t, bin, db, id, "poke_", "greeter_corrupt"); out != "bash greeter_corrupt ping" {
+		t.Errorf("poke: of a corrupt instance answered %q, want trash-send's answer", out)
+	}
+
+	// So is every message when the socket is left behind by a daemon that is gone
+	stale := filepath.Join(t.TempDir(), "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	t.Setenv("TRASHTALK_DAEMON_SOCKET", stale)
+	if out := mustRun(t, bin, db, id, "greet_", "hi"); out != "bash Logger info_ hi" {
+		t.Errorf("greet: through a stale socket answered %q, want trash-send's answer", out)
+	}
+}
+
+func TestServeSocketAuthArgs(t *testing.T) {
+	bin := buildGenerated(t, codegen.Generate(loadTestdata(t, "counter")).Code)
+	db := newInstancesDB(t)
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokens, []byte("secret alice\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Options without a value are usage errors
+	sock := filepath.Join(t.TempDir(), "counter.sock")
+	for _, args := range [][]string{
+		{"--auth-tokens="},
+		{"--auth-tokens"},
+		{"--auth-hook="},
+		{"--auth-tokens", tokens, "--auth-hook", "true"},
+		{"--idle", "1s"},
+	} {
+		out, code := runGenerated(t, bin, db, append([]string{"--serve-socket", sock}, args...)...)
+		if code != 1 || !strings.Contains(out, "Usage:") {
+			t.Errorf("--serve-socket %s exited %d: %s, want the usage", strings.Join(args, " "), code, out)
+		}
+	}
+
+	// Values may follow their option as the next argument
+	for _, args := range [][]string{
+		{"--auth-tokens", tokens, "--idle-timeout", "1m"},
+		{"--auth-tokens=" + tokens, "--idle-timeout=1m"},
+	} {
+		sock := filepath.Join(t.TempDir(), "counter.sock")
+		cmd := exec.Command(bin, append([]string{"--serve-socket", sock}, args...)...)
+		cmd.Env = append(os.Environ(), "SQLITE_JSON_DB="+db)
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				cmd.Process.Kill()
+				cmd.Wait()
+			}()
+			var conn net.Conn
+			var err error
+			for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(20 * time.Millisecond) {
+				if conn, err = net.Dial("unix", sock); err == nil {
+					break
+				}
+			}
+			if err != nil {
+				t.Fatalf("--serve-socket %s: %v\n%s", strings.Join(args, " "), err, stderr.String())
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for _, tc := range []struct {
+				request string
+				want    int
+			}{
+				{`{"selector":"new"}`, protocol.ExitUnauthorized},
+				{`{"selector":"new","token":"secret"}`, protocol.ExitOK},
+			} {
+				fmt.Fprintln(conn, tc.request)
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				var resp serveResponse
+				if err := json.Unmarshal(line, &resp); err != nil || resp.ExitCode != tc.want {
+					t.Errorf("--serve-socket %s answered %s to %s, want exit %d", strings.Join(args, " "), line, tc.request, tc.want)
+				}
+			}
+		}()
+	}
+}
+
+func TestServeMessagesMatchSchema(t *testing.T) {
+	class := loadTestdata(t, "counter")
+
+	// Between them the modes use every field of the published serve schemas.
+	// The daemon client sends a subset of what the daemon accepts.
+	schemas := map[string]string{
+		"ServeRequest":   "serve-request",
+		"ServeResponse":  "serve-response",
+		"DaemonRequest":  "request",
+		"DaemonResponse": "response",
+	}
+	used := map[string]map[string]bool{}
+	for typeName := range schemas {
+		used[typeName] = map[string]bool{}
+	}
+	for _, code := range []string{
+		codegen.Generate(class).Code,
+		codegen.GenerateWASM(class).Code,
+		codegen.GenerateWithOptions(class, codegen.Options{History: true}).Code,
+	} {
+		file, err := parser.ParseFile(token.NewFileSet(), "main.go", code, 0)
+		if err != nil {
+			t.Fatalf("Output is not valid Go: %v", err)
+		}
+		goast.Inspect(file, func(n goast.Node) bool {
+			spec, ok := n.(*goast.TypeSpec)
+			if !ok || used[spec.Name.Name] == nil {
+				return true
+			}
+			for _, field := range spec.Type.(*goast.StructType).Fields.List {
+				tag, _ := strconv.Unquote(field.Tag.Value)
+				name, _, _ := strings.Cut(reflect.StructTag(tag).Get("json"), ",")
+				used[spec.Name.Name][name] = true
+			}
+			return false
+		})
+	}
+
+	for typeName, schemaName := range schemas {
+		if len(used[typeName]) == 0 {
+			t.Errorf("%s is not generated", typeName)
+		}
+		data, err := protocol.Schema(schemaName)
+		if err != nil {
+			t.Fatalf("Schema(%q): %v", schemaName, err)
+		}
+		var schema struct {
+			Properties map[string]any `json:"properties"`
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("%s: invalid schema: %v", schemaName, err)
+		}
+		for name := range used[typeName] {
+			if _, ok := schema.Properties[name]; !ok {
+				t.Errorf("%s.%s is not in the %s schema", typeName, name, schemaName)
+			}
+		}
+		if strings.HasPrefix(typeName, "Daemon") {
+			continue
+		}
+		for name := range schema.Properties {
+			if !used[typeName][name] {
+				t.Errorf("%s schema property %s is not generated", schemaName, name)
+			}
+		}
+	}
+}
+
+func TestGenerateMapDispatch(t *testing.T) {
+	entries, err := os.ReadDir("../../testdata")
+	if err != nil {
+		t.Fatalf("Failed to read testdata directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t.Run(entry.Name(), func(t *testing.T) {
+			inputData, err := os.ReadFile(filepath.Join("../../testdata", entry.Name(), "input.json"))
+			if err != nil {
+				t.Fatalf("Failed to read input.json: %v", err)
+			}
+			class, err := ast.ParseBytes(inputData)
+			if err != nil {
+				t.Fatalf("Failed to parse AST: %v", err)
+			}
+
+			switched := dispatchCases(t, codegen.GenerateWithOptions(class, codegen.Options{}).Code)
+			mapped := dispatchCases(t, codegen.GenerateWithOptions(class, codegen.Options{MapDispatch: true}).Code)
+
+			if len(switched["dispatch"]) == 0 {
+				t.Fatal("Found no dispatch cases")
+			}
+
+			// Every selector must run the same statements in both modes
+			for _, fn := range []string{"dispatch", "dispatchClass", "dispatchClassMethod"} {
+				if len(switched[fn]) != len(mapped[fn]) {
+					t.Errorf("%s: %d cases in the switch, %d in the map", fn, len(switched[fn]), len(mapped[fn]))
+				}
+				for selector, body := range switched[fn] {
+					if got, ok := mapped[fn][selector]; !ok {
+						t.Errorf("%s: %q missing from the map", fn, selector)
+					} else if got != body {
+						t.Errorf("%s: %q runs\n%s\nin the map, want\n%s", fn, selector, got, body)
+					}
+				}
+			}
+		})
+	}
+}
+
+// dispatchCases returns the statements run for each selector by dispatch
+// and dispatchClass in code, whether they switch on the selector or look it
+// up in their init-built table
+func dispatchCases(t *testing.T, code string) map[string]map[string]string {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", code, 0)
+	if err != nil {
+		t.Fatalf("Output is not valid Go: %v\n%s", err, code)
+	}
+
+	printStmts := func(stmts []goast.Stmt) string {
+		var buf strings.Builder
+		for _, stmt := range stmts {
+			printer.Fprint(&buf, fset, stmt)
+			buf.WriteString("\n")
+		}
+		return buf.String()
+	}
+
+	cases := map[string]map[string]string{"dispatch": {}, "dispatchClass": {}, "dispatchClassMethod": {}}
+	goast.Inspect(file, func(n goast.Node) bool {
+		switch n := n.(type) {
+		case *goast.FuncDecl:
+			if _, ok := cases[n.Name.Name]; !ok {
+				return n.Name.Name == "init"
+			}
+			for _, stmt := range n.Body.List {
+				sw, ok := stmt.(*goast.SwitchStmt)
+				if !ok {
+					continue
+				}
+				for _, clause := range sw.Body.List {
+					clause := clause.(*goast.CaseClause)
+					for _, label := range clause.List {
+						selector, _ := strconv.Unquote(label.(*goast.BasicLit).Value)
+						cases[n.Name.Name][selector] = printStmts(clause.Body)
+					}
+				}
+			}
+			return false
+		case *goast.AssignStmt:
+			// Aliases: dispatchTable["inc"] = dispatchTable["increment"]
+			if index, ok := n.Lhs[0].(*goast.IndexExpr); ok {
+				fn := strings.TrimSuffix(index.X.(*goast.Ident).Name, "Table")
+				alias, _ := strconv.Unquote(index.Index.(*goast.BasicLit).Value)
+				selector, _ := strconv.Unquote(n.Rhs[0].(*goast.IndexExpr).Index.(*goast.BasicLit).Value)
+				cases[fn][alias] = cases[fn][selector]
+				return false
+			}
+			lhs, ok := n.Lhs[0].(*goast.Ident)
+			if !ok || !strings.HasSuffix(lhs.Name, "Table") {
+				return false
+			}
+			fn := strings.TrimSuffix(lhs.Name, "Table")
+			if _, ok := cases[fn]; !ok {
+				return false
+			}
+			for _, elt := range n.Rhs[0].(*goast.CompositeLit).Elts {
+				kv := elt.(*goast.KeyValueExpr)
+				selector, _ := strconv.Unquote(kv.Key.(*goast.BasicLit).Value)
+				cases[fn][selector] = printStmts(kv.Value.(*goast.FuncLit).Body.List)
+			}
+			return false
+		}
+		return true
+	})
+	return cases
+}
+
 func normalizeWhitespace(s string) string {
 	// Trim trailing whitespace from each line and normalize line endings
 	lines := strings.Split(s, "\n")
@@ -79,3 +1233,225 @@ func normalizeWhitespace(s string) string {
 	}
 	return strings.TrimSpace(strings.Join(lines, "\n"))
 }
+
+func TestGenerateTests(t *testing.T) {
+	load := func(name string) *ast.Class {
+		inputData, err := os.ReadFile(filepath.Join("../../testdata", name, "input.json"))
+		if err != nil {
+			t.Fatalf("Failed to read input.json: %v", err)
+		}
+		class, err := ast.ParseBytes(inputData)
+		if err != nil {
+			t.Fatalf("Failed to parse AST: %v", err)
+		}
+		return class
+	}
+
+	result := codegen.GenerateTests(load("arg_types"), codegen.Options{Storage: []string{"sqlite", "memory"}, Skip: []string{"label:"}})
+	if _, err := parser.ParseFile(token.NewFileSet(), "main_test.go", result.Code, 0); err != nil {
+		t.Fatalf("Output is not valid Go: %v\n%s", err, result.Code)
+	}
+	for _, want := range []string{
+		`storageBackend = "memory"`,
+		"func newTestInstance(t *testing.T) (*Account, string) {",
+		// Sample arguments follow argTypes:
+		`{"deposit_flag_", []string{"1", "true"}},`,
+		`{"scale_", []string{"1.5"}},`,
+		// Skipped methods must exit 200 for the Bash fallback
+		`[]string{"__procyonNoSuchSelector", "label_"}`,
+		"errors.Is(err, ErrUnknownSelector)",
+	} {
+		if !strings.Contains(result.Code, want) {
+			t.Errorf("Output missing %q", want)
+		}
+	}
+	if strings.Contains(result.Code, `{"label_",`) {
+		t.Error("Expected no dispatch case for the skipped method")
+	}
+
+	// Abstract classes have no instances to dispatch to
+	abstract := codegen.GenerateTests(load("abstract_shape"), codegen.Options{Storage: []string{"memory"}})
+	if !strings.Contains(abstract.Code, "new created an instance of an abstract class") {
+		t.Error("Expected a test that new fails for an abstract class")
+	}
+	if strings.Contains(abstract.Code, "newTestInstance") {
+		t.Error("Expected no instance tests for an abstract class")
+	}
+
+	// The tests run against the memory backend, so it must be compiled in
+	noMemory := codegen.GenerateTests(load("arg_types"), codegen.Options{})
+	if noMemory.Code != "" || len(noMemory.Warnings) != 1 || !strings.Contains(noMemory.Warnings[0], "memory") {
+		t.Errorf("Expected no tests and a warning without the memory backend, got %v", noMemory.Warnings)
+	}
+}
+
+const pluginProbeSource = `Probe subclass: Object
+  instanceVars: name:'probe' path:''
+
+  method: prefix [
+    ^ @ String substring: name from: 0 length: 2
+  ]
+
+  method: upper [
+    ^ @ String uppercase: name
+  ]
+
+  method: exists [
+    ^ @ File exists: path
+  ]
+
+  method: isFile [
+    ^ @ File isFile: path
+  ]
+`
+
+// undefinedHelpers returns the _helpers code calls without declaring them
+func undefinedHelpers(t *testing.T, code string) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", code, 0)
+	if err != nil {
+		t.Fatalf("Output is not valid Go: %v", err)
+	}
+	declared := map[string]bool{}
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *goast.FuncDecl:
+			if d.Recv == nil {
+				declared[d.Name.Name] = true
+			}
+		case *goast.GenDecl:
+			for _, spec := range d.Specs {
+				if v, ok := spec.(*goast.ValueSpec); ok {
+					for _, name := range v.Names {
+						declared[name.Name] = true
+					}
+				}
+			}
+		}
+	}
+	var missing []string
+	goast.Inspect(file, func(n goast.Node) bool {
+		if call, ok := n.(*goast.CallExpr); ok {
+			if id, ok := call.Fun.(*goast.Ident); ok && strings.HasPrefix(id.Name, "_") && !declared[id.Name] {
+				missing = append(missing, id.Name)
+				declared[id.Name] = true
+			}
+		}
+		return true
+	})
+	return missing
+}
+
+func TestGeneratePluginParity(t *testing.T) {
+	classes := map[string]*ast.Class{}
+	entries, err := os.ReadDir("../../testdata")
+	if err != nil {
+		t.Fatalf("Failed to read testdata directory: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		inputData, err := os.ReadFile(filepath.Join("../../testdata", entry.Name(), "input.json"))
+		if err != nil {
+			t.Fatalf("Failed to read input.json: %v", err)
+		}
+		if classes[entry.Name()], err = ast.ParseBytes(inputData); err != nil {
+			t.Fatalf("%s: failed to parse AST: %v", entry.Name(), err)
+		}
+	}
+	probe, err := source.Parse(pluginProbeSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	classes["probe"] = probe
+
+	skipped := func(r *codegen.Result) string {
+		var sels []string
+		for _, s := range r.SkippedMethods {
+			sels = append(sels, s.Selector)
+		}
+		return strings.Join(sels, " ")
+	}
+	for name, class := range classes {
+		binary := codegen.Generate(class)
+		plugin := codegen.GeneratePlugin(class)
+		if skipped(binary) != skipped(plugin) {
+			t.Errorf("%s: binary skips [%s], plugin skips [%s]", name, skipped(binary), skipped(plugin))
+		}
+		if missing := undefinedHelpers(t, plugin.Code); len(missing) > 0 {
+			t.Errorf("%s: plugin calls undefined helpers %v", name, missing)
+		}
+		for _, want := range []string{"//export Dispatch\n", "//export DispatchStream\n", "//export ReadResult\n"} {
+			if !strings.Contains(plugin.Code, want) {
+				t.Errorf("%s: plugin is missing %q", name, strings.TrimSpace(want))
+			}
+		}
+	}
+
+	mapped := codegen.GeneratePluginWithOptions(classes["counter"], codegen.Options{MapDispatch: true})
+	if !strings.Contains(mapped.Code, "dispatchTable") {
+		t.Error("Expected Options.MapDispatch to dispatch plugins through a map")
+	}
+}
+
+func TestGeneratePluginClassInfo(t *testing.T) {
+	inputData, err := os.ReadFile(filepath.Join("../../testdata", "counter", "input.json"))
+	if err != nil {
+		t.Fatalf("Failed to read input.json: %v", err)
+	}
+	class, err := ast.ParseBytes(inputData)
+	if err != nil {
+		t.Fatalf("Failed to parse AST: %v", err)
+	}
+	class.Aliases = []ast.Alias{{From: "bump", To: "increment"}}
+
+	result := codegen.GeneratePluginWithOptions(class, codegen.Options{Skip: []string{"reset"}, SourceHash: "abc123", GeneratorVersion: "0.9.0"})
+	file, err := parser.ParseFile(token.NewFileSet(), "main.go", result.Code, 0)
+	if err != nil {
+		t.Fatalf("Output is not valid Go: %v", err)
+	}
+	var literal string
+	goast.Inspect(file, func(n goast.Node) bool {
+		if fn, ok := n.(*goast.FuncDecl); ok && fn.Name.Name == "GetClassInfo" {
+			goast.Inspect(fn.Body, func(n goast.Node) bool {
+				if lit, ok := n.(*goast.BasicLit); ok && lit.Kind == token.STRING {
+					literal = lit.Value
+				}
+				return true
+			})
+		}
+		return true
+	})
+	text, err := strconv.Unquote(literal)
+	if err != nil {
+		t.Fatalf("Expected GetClassInfo to return a string literal, got %q", literal)
+	}
+
+	var info struct {
+		Name           string   `json:"name"`
+		Parent         string   `json:"parent"`
+		Selectors      []string `json:"selectors"`
+		ClassSelectors []string `json:"classSelectors"`
+		Fallback       []string `json:"fallback"`
+		Hash           string   `json:"hash"`
+		Compiler       string   `json:"compiler"`
+	}
+	if err := json.Unmarshal([]byte(text), &info); err != nil {
+		t.Fatalf("GetClassInfo is not JSON: %v\n%s", err, text)
+	}
+	if info.Name != "Counter" || info.Parent != "Object" || info.Hash != "abc123" || info.Compiler != "0.9.0" {
+		t.Errorf("Unexpected class info %s", text)
+	}
+	wantSelectors := []string{"asJSON", "bump", "decrement", "getStep", "getValue", "increment", "incrementBy_", "respondsTo_", "selectors", "setStep_", "setValue_"}
+	if !reflect.DeepEqual(info.Selectors, wantSelectors) {
+		t.Errorf("selectors = %v, want %v", info.Selectors, wantSelectors)
+	}
+	wantClassSelectors := []string{"allInstances", "deleteAll", "description", "firstInstance", "instanceCount", "instancesOf_", "respondsTo_", "selectors"}
+	if !reflect.DeepEqual(info.ClassSelectors, wantClassSelectors) {
+		t.Errorf("classSelectors = %v, want %v", info.ClassSelectors, wantClassSelectors)
+	}
+	if !reflect.DeepEqual(info.Fallback, []string{"new", "reset"}) {
+		t.Errorf("fallback = %v, want [new reset]", info.Fallback)
+	}
+}
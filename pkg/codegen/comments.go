@@ -0,0 +1,144 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the doc comments of Options.Comments: a file header
+// naming the class, the generator and the source hash, a comment on each
+// compiled method naming the selector and source line it came from, and a
+// comment on each helper saying what it does.
+package codegen
+
+import (
+	"fmt"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/dave/jennifer/jen"
+)
+
+// setComments records Options.Comments and the file header fields
+func (g *generator) setComments(opts Options) {
+	g.comments = opts.Comments
+	g.generatorVersion = opts.GeneratorVersion
+	g.sourceHash = opts.SourceHash
+}
+
+// generateHeader adds the file header. Nothing is emitted without comments.
+func (g *generator) generateHeader(f *jen.File) {
+	if !g.comments {
+		return
+	}
+	generator := "procyon"
+	if g.generatorVersion != "" {
+		generator += " " + g.generatorVersion
+	}
+	f.HeaderComment(fmt.Sprintf("Code generated by %s from %s.trash. DO NOT EDIT.", generator, g.class.CompiledName()))
+	f.HeaderComment("")
+	f.HeaderComment("Class: " + g.class.QualifiedName())
+	if g.sourceHash != "" {
+		f.HeaderComment("Source hash: " + g.sourceHash)
+	}
+}
+
+// methodComment adds the doc comment of name, the function generated for m.
+// Nothing is emitted without comments.
+func (g *generator) methodComment(f *jen.File, m *compiledMethod, name string) {
+	if !g.comments {
+		return
+	}
+	owner := g.class.QualifiedName()
+	if m.isClass {
+		owner += " class"
+	}
+	doc := fmt.Sprintf("%s implements %s>>%s", name, owner, mangle.TrashSelector(m.selector))
+	file := g.class.CompiledName() + ".trash"
+	if m.trait != "" {
+		doc += ", from trait " + m.trait
+		file = m.trait + ".trash"
+	}
+	if m.line > 0 {
+		doc += fmt.Sprintf(" (%s line %d)", file, m.line)
+	}
+	f.Comment(doc + ".")
+}
+
+// helperDocs are the doc comments of the helpers without one of their own,
+// by function name
+var helperDocs = map[string]string{
+	"init":               "init computes _contentHash from the embedded source.",
+	"main":               "main dispatches one message: <instance_id|class> <selector> [args...].",
+	"openDB":             "openDB opens the instance database, $SQLITE_JSON_DB or ~/.trashtalk/instances.db.",
+	"loadInstance":       "loadInstance reads an instance from the instances table.",
+	"generateInstanceID": "generateInstanceID returns a new instance ID: the lowercased class name and a UUID.",
+	"createInstance":     "createInstance inserts a new instance into the instances table.",
+	"deleteInstance":     "deleteInstance removes an instance from the instances table.",
+	"sendMessage":        "sendMessage sends a message through the Bash runtime and answers its output.",
+	"_sourceMapPanic":    "_sourceMapPanic prints a panic with its trace rewritten by _sourceMapStack and exits 2.",
+	"_sourceMapStack":    "_sourceMapStack appends the .trash position from _sourceMap to each frame of a compiled method.",
+	"runServeMode":       "runServeMode answers JSON requests read from stdin, one per line (--serve).",
+	"respond":            "respond writes a --serve response as one line of JSON.",
+	"handleServeRequest": "handleServeRequest dispatches one --serve request.",
+	"dispatch":           "dispatch runs the instance method selector on c.",
+	"dispatchClass":      "dispatchClass runs the class method selector.",
+	"_toStr":             "_toStr converts a Go value to its Trashtalk string.",
+}
+
+// helperFamilies describe the primitive helpers, by name prefix
+var helperFamilies = []struct{ prefix, doc string }{
+	{"_jsonArray", "is a JSON array primitive helper."},
+	{"_jsonObject", "is a JSON object primitive helper."},
+	{"_array", "is an array helper for native slice operations."},
+	{"_map", "is a map helper for native map operations."},
+	{"_file", "is a File primitive helper."},
+	{"_string", "is a String primitive helper."},
+}
+
+// helperDoc returns the doc comment of the helper name, or ""
+func helperDoc(name string) string {
+	if doc, ok := helperDocs[name]; ok {
+		return doc
+	}
+	for _, family := range helperFamilies {
+		if strings.HasPrefix(name, family.prefix) {
+			return name + " " + family.doc
+		}
+	}
+	return ""
+}
+
+// withHelperComments returns code with the helper doc comments added, or
+// unchanged without comments
+func (g *generator) withHelperComments(code string) string {
+	if !g.comments {
+		return code
+	}
+	return addHelperComments(code)
+}
+
+// addHelperComments adds the doc comment of each helper function in code
+// that has none. code is returned unchanged if it does not parse.
+func addHelperComments(code string) string {
+	fset := token.NewFileSet()
+	file, err := goparser.ParseFile(fset, "", code, goparser.ParseComments)
+	if err != nil {
+		return code
+	}
+	var out strings.Builder
+	last := 0
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*goast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Doc != nil {
+			continue
+		}
+		doc := helperDoc(fn.Name.Name)
+		if doc == "" {
+			continue
+		}
+		offset := fset.Position(fn.Pos()).Offset
+		out.WriteString(code[last:offset])
+		out.WriteString("// " + doc + "\n")
+		last = offset
+	}
+	out.WriteString(code[last:])
+	return out.String()
+}
@@ -0,0 +1,179 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains type-aware comparison operators.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// cmpKind is how a comparison operand should be compared
+type cmpKind int
+
+const (
+	cmpDynamic cmpKind = iota // decided at runtime from the values
+	cmpNumber
+	cmpString
+)
+
+// cmpKindOf classifies a comparison operand. String literals, concatenations
+// and ivars declared with a string default compare as strings; number
+// literals, arithmetic, <int> and <float> ivars and ivars with a number
+// default compare as numbers, and so do args declared int or float with
+// argTypes:; args declared string compare as strings.
+// Other method args, locals and sends are only known at runtime.
+func (g *generator) cmpKindOf(expr parser.Expr, m *compiledMethod) cmpKind {
+	switch e := expr.(type) {
+	case *parser.StringLit:
+		return cmpString
+	case *parser.NumberLit, *parser.NegateExpr:
+		return cmpNumber
+	case *parser.BinaryExpr:
+		if e.Op == "," {
+			return cmpString
+		}
+		return cmpNumber
+	case *parser.Identifier:
+		if m.argTypes[e.Name] == "string" {
+			return cmpString
+		}
+		switch typ, _ := g.typedValue(e.Name, m); typ {
+		case "int", "float":
+			return cmpNumber
+		case "bool", "array", "object":
+			return cmpDynamic
+		}
+		if m.isClass || !g.instanceVars[e.Name] || g.jsonVars[e.Name] {
+			return cmpDynamic
+		}
+		for _, arg := range m.args {
+			if arg == e.Name {
+				return cmpDynamic // the arg shadows the ivar
+			}
+		}
+		for _, iv := range g.class.InstanceVars {
+			if iv.Name == e.Name {
+				if iv.Type == "string" {
+					return cmpString
+				}
+				switch iv.Default.Type {
+				case "string":
+					return cmpString
+				case "number":
+					return cmpNumber
+				}
+			}
+		}
+	}
+	return cmpDynamic
+}
+
+// generateComparison generates >, <, >=, <=, == or != for a ComparisonExpr.
+// Either side being a known string compares as strings, both sides being
+// known numbers compares numerically, and anything else goes through
+// _compare, which compares numerically only when both values look numeric.
+func (g *generator) generateComparison(e *parser.ComparisonExpr, m *compiledMethod) *jen.Statement {
+	left, right := g.cmpKindOf(e.Left, m), g.cmpKindOf(e.Right, m)
+
+	switch {
+	case left == cmpString || right == cmpString:
+		return g.stringOperand(e.Left, m).Op(e.Op).Add(g.stringOperand(e.Right, m))
+	case left == cmpNumber && right == cmpNumber:
+		// Compare integer literals as ints; anything that may hold a decimal as float64
+		conv := "toFloat"
+		if g.numKind(e.Left, m) == numInt && g.numKind(e.Right, m) == numInt {
+			conv = "toInt"
+		}
+		return g.numOperand(e.Left, conv, m).Op(e.Op).Add(g.numOperand(e.Right, conv, m))
+	}
+	return jen.Id("_compare").Call(jen.Lit(e.Op), g.generateExpr(e.Left, m), g.generateExpr(e.Right, m))
+}
+
+// generateBetween generates value between: low and: high as two inclusive
+// comparisons, each typed like a ComparisonExpr
+func (g *generator) generateBetween(e *parser.BetweenExpr, m *compiledMethod) *jen.Statement {
+	low := g.generateComparison(&parser.ComparisonExpr{Left: e.Value, Op: ">=", Right: e.Low}, m)
+	high := g.generateComparison(&parser.ComparisonExpr{Left: e.Value, Op: "<=", Right: e.High}, m)
+	return jen.Parens(low.Op("&&").Add(high))
+}
+
+// generateMinMax generates left min: right or left max: right, which answers
+// whichever operand wins the comparison, unchanged
+func (g *generator) generateMinMax(e *parser.MinMaxExpr, m *compiledMethod) *jen.Statement {
+	return jen.Id("_"+e.Op).Call(g.generateExpr(e.Left, m), g.generateExpr(e.Right, m))
+}
+
+// stringOperand generates a comparison operand as a Go string
+func (g *generator) stringOperand(expr parser.Expr, m *compiledMethod) *jen.Statement {
+	if lit, ok := expr.(*parser.StringLit); ok {
+		return jen.Lit(lit.Value)
+	}
+	if str := g.typedString(expr, m); str != nil {
+		return str
+	}
+	return jen.Id("_toStr").Call(g.generateExpr(expr, m))
+}
+
+// generateCompareHelpers generates _isNum, _compare, _min and _max
+func generateCompareHelpers(f *jen.File) {
+	f.Comment("// _isNum reports whether v is a number or a string holding one")
+	f.Func().Id("_isNum").Params(jen.Id("v").Interface()).Bool().Block(
+		jen.Switch(jen.Id("x").Op(":=").Id("v").Assert(jen.Type())).Block(
+			jen.Case(jen.Int(), jen.Int64(), jen.Float64(), jen.Qual("encoding/json", "Number")).Block(jen.Return(jen.True())),
+			jen.Case(jen.String()).Block(
+				jen.Id("s").Op(":=").Qual("strings", "TrimSpace").Call(jen.Id("x")),
+				jen.Comment("ParseFloat also accepts words like \"inf\" and \"nan\"; those stay strings"),
+				jen.If(jen.Id("s").Op("==").Lit("").Op("||").Qual("strings", "Trim").Call(jen.Id("s"), jen.Lit("0123456789.eE+-")).Op("!=").Lit("")).Block(
+					jen.Return(jen.False()),
+				),
+				jen.List(jen.Id("_"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("s"), jen.Lit(64)),
+				jen.Return(jen.Err().Op("==").Nil()),
+			),
+		),
+		jen.Return(jen.False()),
+	)
+	f.Line()
+
+	cases := func(x, y string) []jen.Code {
+		var out []jen.Code
+		for _, op := range []string{"==", "!=", "<", ">", "<=", ">="} {
+			out = append(out, jen.Case(jen.Lit(op)).Block(jen.Return(jen.Id(x).Op(op).Id(y))))
+		}
+		return out
+	}
+
+	f.Comment("// _compare applies a comparison numerically when both operands look numeric,")
+	f.Comment("// exactly when both are integers, and as a string comparison otherwise")
+	f.Func().Id("_compare").Params(
+		jen.Id("op").String(),
+		jen.List(jen.Id("a"), jen.Id("b")).Interface(),
+	).Bool().Block(
+		jen.If(jen.Id("_isNum").Call(jen.Id("a")).Op("&&").Id("_isNum").Call(jen.Id("b"))).Block(
+			jen.Comment("Integers compare exactly; as float64 those past 2^53 would be rounded"),
+			jen.If(jen.List(jen.Id("i"), jen.Id("ok")).Op(":=").Id("toNum").Call(jen.Id("a")).Assert(jen.Int()), jen.Id("ok")).Block(
+				jen.If(jen.List(jen.Id("j"), jen.Id("ok")).Op(":=").Id("toNum").Call(jen.Id("b")).Assert(jen.Int()), jen.Id("ok")).Block(
+					jen.Switch(jen.Id("op")).Block(cases("i", "j")...),
+				),
+			),
+			jen.List(jen.Id("x"), jen.Id("y")).Op(":=").List(jen.Id("toFloat").Call(jen.Id("a")), jen.Id("toFloat").Call(jen.Id("b"))),
+			jen.Switch(jen.Id("op")).Block(cases("x", "y")...),
+		),
+		jen.List(jen.Id("s"), jen.Id("t")).Op(":=").List(jen.Id("_toStr").Call(jen.Id("a")), jen.Id("_toStr").Call(jen.Id("b"))),
+		jen.Switch(jen.Id("op")).Block(cases("s", "t")...),
+		jen.Return(jen.False()),
+	)
+	f.Line()
+
+	for _, mm := range []struct{ name, op string }{{"_min", "<="}, {"_max", ">="}} {
+		f.Comment(fmt.Sprintf("// %s answers a if a %s b, compared as by _compare, and b otherwise", mm.name, mm.op))
+		f.Func().Id(mm.name).Params(jen.List(jen.Id("a"), jen.Id("b")).Interface()).Interface().Block(
+			jen.If(jen.Id("_compare").Call(jen.Lit(mm.op), jen.Id("a"), jen.Id("b"))).Block(
+				jen.Return(jen.Id("a")),
+			),
+			jen.Return(jen.Id("b")),
+		)
+		f.Line()
+	}
+}
@@ -0,0 +1,79 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the copying selectors of every compiled class: copy,
+// which stores a new instance with the receiver's instance variables,
+// deepCopy, which also copies the arrays and objects they hold, and
+// copyWith:value:, which changes one of them in the copy. All answer the new
+// instance's ID.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// copyCases returns the default cases of copy, deepCopy and copyWith:value:, as
+// defaultInstanceCases leaves them. The copy gets a new ID, creation time
+// and _version and is stored with createInstance, like an instance from new;
+// initialize does not run. A class without instance variables leaves
+// copyWith:value: to Bash; plugins cannot create instances and leave both.
+func (g *generator) copyCases(cases []dispatchCase) []dispatchCase {
+	className := g.class.Name
+	copied := func(body ...jen.Code) []jen.Code {
+		return append(append([]jen.Code{
+			jen.Id("id").Op(":=").Id("generateInstanceID").Call(jen.Lit(className)),
+			jen.Id("copied").Op(":=").Op("*").Id("c"),
+			jen.Id("copied").Dot("CreatedAt").Op("=").Qual("time", "Now").Call().Dot("Format").Call(jen.Qual("time", "RFC3339")),
+			jen.Id("copied").Dot("Version").Op("=").Lit(0),
+		}, body...),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+			jen.If(jen.Err().Op(":=").Id(g.fn("createInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Op("&").Id("copied")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.Return(jen.Id("id"), jen.Nil()),
+		)
+	}
+
+	candidates := []dispatchCase{{"copy", copied()}, {"deepCopy", copied(g.deepCopyFields()...)}}
+	if len(g.class.InstanceVars) == 0 {
+		return g.defaultInstanceCases(cases, candidates)
+	}
+
+	var fields []jen.Code
+	for _, iv := range g.class.InstanceVars {
+		fields = append(fields, jen.Case(jen.Lit(iv.Name)).Block(
+			jen.Id("copied").Dot(capitalize(iv.Name)).Op("=").Add(g.ivarFromString(iv.Name, jen.Id("args").Index(jen.Lit(1)))),
+		))
+	}
+	fields = append(fields, jen.Default().Block(
+		jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(g.class.QualifiedName()+" has no instance variable %s"), jen.Id("args").Index(jen.Lit(0)))),
+	))
+
+	candidates = append(candidates, dispatchCase{"copyWith_value_", append([]jen.Code{
+		jen.If(jen.Len(jen.Id("args")).Op("<").Lit(2)).Block(
+			jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("copyWith_value_ requires 2 arguments"))),
+		),
+	}, copied(jen.Switch(jen.Id("args").Index(jen.Lit(0))).Block(fields...))...)})
+	return g.defaultInstanceCases(cases, candidates)
+}
+
+// deepCopyFields returns the statements that give copied its own copy of
+// each array and object instance variable of c, so changing one in either
+// instance leaves the other as it was
+func (g *generator) deepCopyFields() []jen.Code {
+	var stmts []jen.Code
+	for _, iv := range g.class.InstanceVars {
+		field := capitalize(iv.Name)
+		switch {
+		case g.ivarTypes[iv.Name] == "array":
+			stmts = append(stmts, jen.Id("copied").Dot(field).Op("=").Id("_deepCopy").Call(jen.Id("c").Dot(field)).Assert(jen.Index().Interface()))
+		case g.ivarTypes[iv.Name] == "object":
+			stmts = append(stmts, jen.Id("copied").Dot(field).Op("=").Id("_deepCopy").Call(jen.Id("c").Dot(field)).Assert(jen.Map(jen.String()).Interface()))
+		case g.jsonVars[iv.Name] && g.ivarTypes[iv.Name] == "":
+			stmts = append(stmts, jen.Id("copied").Dot(field).Op("=").Append(jen.Qual("encoding/json", "RawMessage").Parens(jen.Nil()), jen.Id("c").Dot(field).Op("...")))
+		}
+	}
+	return stmts
+}
@@ -0,0 +1,246 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the daemon client sendMessage sends through. It speaks
+// the protocol of pkg/client: one DaemonRequest per connection to the Unix
+// socket of trashtalk-daemon, redialed while the daemon refuses connections.
+// An instance receiver's JSON is sent with the request and the instance the
+// daemon answers is stored, as the Bash runtime does. Without a daemon
+// socket or a daemon answering on it, or for a selector the daemon leaves to
+// Bash, sendMessage runs trash-send.
+//
+// Either way, a message the receiver ends with an error (exit code 201, 202
+// or 203) signals a TrashError in the sender, which its on:do: handlers can
+// catch. A class that sends messages to other receivers therefore uses
+// exceptions.
+package codegen
+
+import (
+	"strconv"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/dave/jennifer/jen"
+)
+
+// daemonSocketEnv names the environment variable holding the daemon socket
+// sendMessage dials instead of defaultDaemonSocket, as in examples/build.bash
+const daemonSocketEnv = "TRASHTALK_DAEMON_SOCKET"
+
+// defaultDaemonSocket is the socket of trashtalk-daemon --socket the examples use
+const defaultDaemonSocket = "/tmp/trashtalk.sock"
+
+// daemonTimeoutSeconds bounds a round trip to the daemon, so a daemon that
+// never answers fails the send instead of hanging the sender
+const daemonTimeoutSeconds = 60
+
+// sendErrorClass is the TrashError class of a message that failed in the
+// sender's process, such as an answered instance that could not be stored
+const sendErrorClass = "SendError"
+
+// primitiveReceivers are the classes whose messages compile to native code
+// instead of sends, as parser.ClassPrimitiveExpr
+var primitiveReceivers = map[string]bool{
+	"String": true, "File": true, "HttpClient": true, "Locale": true, "Shell": true, "Env": true, "Os": true,
+}
+
+// sendsMessages reports whether a method of class sends a message to a
+// receiver other than self and the primitive classes, or the class declares
+// a ref: instance variable, whose helper sends to the instance it names
+func sendsMessages(class *ast.Class) bool {
+	for _, iv := range class.InstanceVars {
+		if iv.Ref {
+			return true
+		}
+	}
+	for _, m := range class.Methods {
+		if m.Raw {
+			continue
+		}
+		tokens := m.Body.Tokens
+		for i, tok := range tokens {
+			if tok.Type == ast.TokenAt && i+1 < len(tokens) &&
+				tokens[i+1].Value != "self" && !primitiveReceivers[tokens[i+1].Value] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateDaemonSend generates DaemonRequest, DaemonResponse, daemonSocket,
+// _sendDaemon and _daemonRoundTrip. WASM modules have no sockets and send
+// through trash-send only.
+func (g *generator) generateDaemonSend(f *jen.File) {
+	if g.wasm {
+		return
+	}
+
+	f.Comment("DaemonRequest is a request to trashtalk-daemon, as pkg/client sends it")
+	f.Type().Id("DaemonRequest").Struct(
+		jen.Id("Class").String().Tag(map[string]string{"json": "class"}),
+		jen.Id("Instance").String().Tag(map[string]string{"json": "instance"}),
+		jen.Id("Selector").String().Tag(map[string]string{"json": "selector"}),
+		jen.Id("Args").Index().String().Tag(map[string]string{"json": "args"}),
+	)
+	f.Line()
+
+	f.Comment("DaemonResponse is trashtalk-daemon's answer to a DaemonRequest")
+	f.Type().Id("DaemonResponse").Struct(
+		jen.Id("Instance").String().Tag(map[string]string{"json": "instance,omitempty"}),
+		jen.Id("Result").String().Tag(map[string]string{"json": "result,omitempty"}),
+		jen.Id("ExitCode").Int().Tag(map[string]string{"json": "exit_code"}),
+		jen.Id("Error").String().Tag(map[string]string{"json": "error,omitempty"}),
+	)
+	f.Line()
+
+	f.Comment("daemonSocket returns the Unix socket of the trashtalk-daemon messages are")
+	f.Comment("sent through: $" + daemonSocketEnv + ", or " + defaultDaemonSocket)
+	f.Func().Id("daemonSocket").Params().String().Block(
+		jen.If(jen.Id("path").Op(":=").Qual("os", "Getenv").Call(jen.Lit(daemonSocketEnv)), jen.Id("path").Op("!=").Lit("")).Block(
+			jen.Return(jen.Id("path")),
+		),
+		jen.Return(jen.Lit(defaultDaemonSocket)),
+	)
+	f.Line()
+
+	f.Comment("_sendDaemon sends selector to receiver, a class name or an instance ID,")
+	f.Comment("through the daemon and answers its response. ok is false if there is no")
+	f.Comment("daemon socket, the daemon cannot be reached, the instance is not stored or")
+	f.Comment("the daemon leaves the selector to Bash, so the message goes to trash-send.")
+	f.Comment("An instance the daemon answers that cannot be stored is answered as an error.")
+	f.Func().Id("_sendDaemon").Params(
+		jen.List(jen.Id("receiver"), jen.Id("selector")).String(),
+		jen.Id("args").Index().String(),
+	).Parens(jen.List(jen.Id("resp").Id("DaemonResponse"), jen.Id("ok").Bool())).Block(
+		jen.Id("path").Op(":=").Id("daemonSocket").Call(),
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Qual("os", "Stat").Call(jen.Id("path")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("resp"), jen.False()),
+		),
+		jen.Id("req").Op(":=").Id("DaemonRequest").Values(jen.Dict{
+			jen.Id("Class"):    jen.Id("receiver"),
+			jen.Id("Selector"): jen.Id("selector"),
+			jen.Id("Args"):     jen.Id("args"),
+		}),
+		jen.Comment("Class names are capitalized, instance IDs are not"),
+		jen.Id("isInstance").Op(":=").Id("receiver").Op("!=").Lit("").Op("&&").Op("!").Qual("unicode", "IsUpper").Call(jen.Rune().Parens(jen.Id("receiver").Index(jen.Lit(0)))),
+		jen.If(jen.Op("!").Id("isInstance")).Block(
+			jen.List(jen.Id("resp"), jen.Err()).Op(":=").Id("_daemonRoundTrip").Call(jen.Id("path"), jen.Id("req")),
+			jen.Return(jen.Id("resp"), jen.Err().Op("==").Nil().Op("&&").Id("resp").Dot("ExitCode").Op("!=").Lit(200)),
+		),
+		jen.Line(),
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("resp"), jen.False()),
+		),
+		jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+		g.loadSentInstance(),
+		jen.Var().Id("stored").Struct(
+			jen.Id("Class").String().Tag(map[string]string{"json": "class"}),
+			jen.Id("Version").Int().Tag(map[string]string{"json": "_version"}),
+		),
+		jen.Comment("An instance the database does not hold, or holds corrupt, is left to Bash"),
+		jen.If(jen.Err().Op("==").Nil()).Block(
+			jen.Err().Op("=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("stored")),
+		),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("resp"), jen.False()),
+		),
+		jen.List(jen.Id("req").Dot("Class"), jen.Id("req").Dot("Instance")).Op("=").List(jen.Id("stored").Dot("Class"), jen.Id("data")),
+		jen.Line(),
+		jen.List(jen.Id("resp"), jen.Err()).Op("=").Id("_daemonRoundTrip").Call(jen.Id("path"), jen.Id("req")),
+		jen.If(jen.Err().Op("!=").Nil().Op("||").Id("resp").Dot("ExitCode").Op("==").Lit(200)).Block(
+			jen.Return(jen.Id("resp"), jen.False()),
+		),
+		jen.Comment("The daemon answers the instance; storing it is left to the sender, at the"),
+		jen.Comment("next version unless another process saved it since it was loaded"),
+		jen.If(jen.Id("resp").Dot("ExitCode").Op("==").Lit(0).Op("&&").Id("resp").Dot("Instance").Op("!=").Lit("")).Block(
+			jen.Var().Id("answered").Map(jen.String()).Qual("encoding/json", "RawMessage"),
+			jen.Err().Op("=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("resp").Dot("Instance")), jen.Op("&").Id("answered")),
+			jen.If(jen.Err().Op("==").Nil()).Block(
+				jen.Id("answered").Index(jen.Lit("_version")).Op("=").Qual("encoding/json", "RawMessage").Call(jen.Qual("strconv", "Itoa").Call(jen.Id("stored").Dot("Version").Op("+").Lit(1))),
+				jen.Var().Id("instance").Index().Byte(),
+				jen.If(jen.List(jen.Id("instance"), jen.Err()).Op("=").Qual("encoding/json", "Marshal").Call(jen.Id("answered")), jen.Err().Op("==").Nil()).Block(
+					g.saveSentInstance(),
+				),
+			),
+			jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrStorageBusy"))).Block(
+				jen.Return(jen.Id("DaemonResponse").Values(jen.Dict{
+					jen.Id("ExitCode"): jen.Lit(storageBusyExitCode),
+					jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+				}), jen.True()),
+			),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Id("DaemonResponse").Values(jen.Dict{
+					jen.Id("ExitCode"): jen.Lit(trashErrorExitCode),
+					jen.Id("Error"):    jen.Lit(sendErrorClass+": ").Op("+").Err().Dot("Error").Call(),
+				}), jen.True()),
+			),
+		),
+		jen.Return(jen.Id("resp"), jen.True()),
+	)
+	f.Line()
+
+	f.Comment("_daemonRoundTrip sends req on a connection of its own to the daemon on path")
+	f.Comment("and reads its response. Like pkg/client, it redials a refused connection")
+	f.Comment("three times, waiting 50ms and then twice as long each time, and gives up")
+	f.Comment("on a daemon that has not answered within " + strconv.Itoa(daemonTimeoutSeconds) + "s.")
+	f.Func().Id("_daemonRoundTrip").Params(
+		jen.Id("path").String(),
+		jen.Id("req").Id("DaemonRequest"),
+	).Parens(jen.List(jen.Id("DaemonResponse"), jen.Error())).Block(
+		g.suspendWork(),
+		jen.Var().Id("resp").Id("DaemonResponse"),
+		jen.List(jen.Id("line"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("req")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("resp"), jen.Err()),
+		),
+		jen.Var().Id("conn").Qual("net", "Conn"),
+		jen.Id("delay").Op(":=").Lit(50).Op("*").Qual("time", "Millisecond"),
+		jen.For(jen.Id("attempt").Op(":=").Lit(0).Op(";").Op(";").Id("attempt").Op("++")).Block(
+			jen.If(jen.List(jen.Id("conn"), jen.Err()).Op("=").Qual("net", "DialTimeout").Call(jen.Lit("unix"), jen.Id("path"), jen.Lit(5).Op("*").Qual("time", "Second")), jen.Err().Op("==").Nil()).Block(
+				jen.Break(),
+			),
+			jen.If(jen.Id("attempt").Op("==").Lit(3).Op("||").Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Qual("syscall", "ECONNREFUSED"))).Block(
+				jen.Return(jen.Id("resp"), jen.Err()),
+			),
+			jen.Qual("time", "Sleep").Call(jen.Id("delay")),
+			jen.Id("delay").Op("*=").Lit(2),
+		),
+		jen.Defer().Id("conn").Dot("Close").Call(),
+		jen.Id("conn").Dot("SetDeadline").Call(jen.Qual("time", "Now").Call().Dot("Add").Call(jen.Lit(daemonTimeoutSeconds).Op("*").Qual("time", "Second"))),
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("conn").Dot("Write").Call(jen.Append(jen.Id("line"), jen.LitByte('\n'))), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("resp"), jen.Err()),
+		),
+		jen.List(jen.Id("out"), jen.Err()).Op(":=").Qual("bufio", "NewReader").Call(jen.Id("conn")).Dot("ReadBytes").Call(jen.LitByte('\n')),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("resp"), jen.Err()),
+		),
+		jen.Err().Op("=").Qual("encoding/json", "Unmarshal").Call(jen.Id("out"), jen.Op("&").Id("resp")),
+		jen.Return(jen.Id("resp"), jen.Err()),
+	)
+	f.Line()
+}
+
+// loadSentInstance returns the _sendDaemon statements that read the data of
+// the instance receiver from db into data, setting err if it is not stored
+func (g *generator) loadSentInstance() jen.Code {
+	if g.useStorage() {
+		return jen.List(jen.Id("data"), jen.Err()).Op(":=").Id("db").Dot("Load").Call(jen.Id("receiver"))
+	}
+	return jen.Var().Id("data").String().Line().
+		Err().Op("=").Id("dbQueryRow").Call(jen.Id("db"), jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Id("receiver")).Dot("Scan").Call(jen.Op("&").Id("data"))
+}
+
+// saveSentInstance returns the _sendDaemon statement that stores instance,
+// the daemon's answer, for receiver if it is still at stored.Version
+func (g *generator) saveSentInstance() jen.Code {
+	if g.useStorage() {
+		return jen.Err().Op("=").Id("db").Dot("Save").Call(jen.Id("receiver"), jen.String().Parens(jen.Id("instance")), jen.Id("stored").Dot("Version"))
+	}
+	return jen.Err().Op("=").Id("dbUpdate").Call(
+		jen.Id("db"),
+		jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrConflict"), jen.Id("receiver")),
+		jen.Lit("UPDATE instances SET data = json(?) WHERE id = ? AND COALESCE(json_extract(data, '$._version'), 0) = ?"),
+		jen.String().Parens(jen.Id("instance")),
+		jen.Id("receiver"),
+		jen.Id("stored").Dot("Version"),
+	)
+}
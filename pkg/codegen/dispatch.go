@@ -0,0 +1,198 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the dispatch functions mapping selectors to methods.
+package codegen
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dave/jennifer/jen"
+)
+
+// dispatch and dispatchClass are normally a switch on the selector. Go
+// compiles a long string switch to a binary search over the cases, so a
+// class with many selectors dispatches through a package-level map of
+// handlers instead, one func literal per case. The map is filled in init
+// rather than by a var initializer: handlers that send back through dispatch
+// would otherwise be an initialization cycle.
+
+// Each alias: declaration whose original selector has a case is dispatched
+// to that case too, as an extra case label or a second map entry for the
+// same handler. An alias naming a selector that already has a case of its
+// own is ignored.
+
+// dispatchMapThreshold is the number of cases above which a dispatch
+// function looks the selector up in a map instead of switching on it
+const dispatchMapThreshold = 64
+
+// dispatchCase is the body run for one selector
+type dispatchCase struct {
+	selector string
+	body     []jen.Code
+}
+
+// dispatchParam is a parameter of a dispatch function other than selector
+type dispatchParam struct {
+	name string
+	typ  jen.Code
+}
+
+// methodDispatchCase returns the case for m. call builds the call to the
+// method, a method on c or a package-level function for class methods.
+func methodDispatchCase(m *compiledMethod, call func(args ...jen.Code) *jen.Statement) dispatchCase {
+	if len(m.before) > 0 || len(m.after) > 0 {
+		return advisedDispatchCase(m, call)
+	}
+	if len(m.args) == 0 {
+		switch {
+		case m.returnsErr:
+			// Method returns (string, error) - don't add extra nil
+			return dispatchCase{m.selector, []jen.Code{jen.Return(call())}}
+		case m.hasReturn:
+			// Method returns string only - add nil for error
+			return dispatchCase{m.selector, []jen.Code{jen.Return(call(), jen.Nil())}}
+		default:
+			return dispatchCase{m.selector, []jen.Code{call(), jen.Return(jen.Lit(""), jen.Nil())}}
+		}
+	}
+
+	prelude, callArgs := dispatchArgs(m)
+	if m.returnsErr {
+		return dispatchCase{m.selector, append(prelude, jen.Return(call(callArgs...)))}
+	}
+	return dispatchCase{m.selector, append(prelude, jen.Return(call(callArgs...), jen.Nil()))}
+}
+
+// dispatchArgCheck fails a case for m when args are missing
+func dispatchArgCheck(m *compiledMethod) jen.Code {
+	return jen.If(jen.Len(jen.Id("args")).Op("<").Lit(len(m.args))).Block(
+		jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(m.selector+" requires "+fmt.Sprintf("%d", len(m.args))+" argument"))),
+	)
+}
+
+// useDispatchMap reports whether a dispatch function with n cases uses a map
+func (g *generator) useDispatchMap(n int) bool {
+	return g.mapDispatch || n > dispatchMapThreshold
+}
+
+// generateDispatchFunc generates the dispatch function name taking params,
+// then selector and args, and running the case for selector. Unknown
+// selectors fail with ErrUnknownSelector.
+func (g *generator) generateDispatchFunc(f *jen.File, name string, params []dispatchParam, cases []dispatchCase) {
+	var signature, handlerArgs []jen.Code
+	for _, p := range params {
+		signature = append(signature, jen.Id(p.name).Add(p.typ))
+		handlerArgs = append(handlerArgs, jen.Id(p.name))
+	}
+	signature = append(signature, jen.Id("args").Index().String())
+	handlerArgs = append(handlerArgs, jen.Id("args"))
+	unknown := jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrUnknownSelector"), jen.Id("selector")))
+
+	dispatchParams := append(append([]jen.Code{}, signature[:len(params)]...), jen.Id("selector").String(), signature[len(params)])
+	aliases := g.dispatchAliases(cases)
+
+	if !g.useDispatchMap(len(cases)) {
+		var clauses []jen.Code
+		for _, c := range cases {
+			labels := []jen.Code{jen.Lit(c.selector)}
+			for _, alias := range aliases[c.selector] {
+				labels = append(labels, jen.Lit(alias))
+			}
+			clauses = append(clauses, jen.Case(labels...).Block(c.body...))
+		}
+		clauses = append(clauses, jen.Default().Block(unknown))
+
+		f.Func().Id(name).Params(dispatchParams...).Add(g.dispatchResults()).Block(
+			g.dispatchRecover(),
+			jen.Switch(jen.Id("selector")).Block(clauses...),
+		)
+		return
+	}
+
+	table := name + "Table"
+	handlerType := jen.Func().Params(signature...).Parens(jen.List(jen.String(), jen.Error()))
+	handlers := jen.Dict{}
+	for _, c := range cases {
+		handlers[jen.Lit(c.selector)] = jen.Func().Params(signature...).Parens(jen.List(jen.String(), jen.Error())).Block(c.body...)
+	}
+
+	f.Commentf("%s maps each selector %s handles to its case", table, name)
+	f.Var().Id(table).Map(jen.String()).Add(handlerType)
+	f.Line()
+
+	initBody := []jen.Code{
+		jen.Id(table).Op("=").Map(jen.String()).Add(handlerType).Values(handlers),
+	}
+	for _, c := range cases {
+		for _, alias := range aliases[c.selector] {
+			initBody = append(initBody, jen.Id(table).Index(jen.Lit(alias)).Op("=").Id(table).Index(jen.Lit(c.selector)))
+		}
+	}
+	f.Func().Id("init").Params().Block(initBody...)
+	f.Line()
+
+	f.Func().Id(name).Params(dispatchParams...).Add(g.dispatchResults()).Block(
+		g.dispatchRecover(),
+		jen.If(jen.List(jen.Id("handler"), jen.Id("ok")).Op(":=").Id(table).Index(jen.Id("selector")), jen.Id("ok")).Block(
+			jen.Return(jen.Id("handler").Call(handlerArgs...)),
+		),
+		unknown,
+	)
+}
+
+// dispatchAliases maps the selector of each case to the aliases dispatched
+// to it, in declaration order
+func (g *generator) dispatchAliases(cases []dispatchCase) map[string][]string {
+	hasCase := make(map[string]bool)
+	for _, c := range cases {
+		hasCase[c.selector] = true
+	}
+	aliases := make(map[string][]string)
+	for _, a := range g.class.Aliases {
+		if hasCase[a.To] && !hasCase[a.From] {
+			hasCase[a.From] = true
+			aliases[a.To] = append(aliases[a.To], a.From)
+		}
+	}
+	return aliases
+}
+
+// defaultInstanceCases returns the candidates a dispatch function with
+// cases answers by default: those whose selector no case, instance method or
+// alias of the class takes, left in by Options.Only and Options.Skip
+func (g *generator) defaultInstanceCases(cases, candidates []dispatchCase) []dispatchCase {
+	taken := make(map[string]bool)
+	for _, c := range cases {
+		taken[c.selector] = true
+	}
+	for _, m := range g.class.Methods {
+		if m.Kind != "class" {
+			taken[m.Selector] = true
+		}
+	}
+	for _, a := range g.class.Aliases {
+		taken[a.From] = true
+	}
+
+	var added []dispatchCase
+	for _, c := range candidates {
+		if !taken[c.selector] && g.deselected(c.selector) == "" {
+			added = append(added, c)
+		}
+	}
+	return added
+}
+
+// dispatchSelectors returns the selectors a dispatch function with cases
+// answers, aliases included, in order
+func (g *generator) dispatchSelectors(cases []dispatchCase) []string {
+	selectors := []string{}
+	for _, c := range cases {
+		selectors = append(selectors, c.selector)
+	}
+	for _, aliases := range g.dispatchAliases(cases) {
+		selectors = append(selectors, aliases...)
+	}
+	sort.Strings(selectors)
+	return selectors
+}
@@ -0,0 +1,129 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the Env and Os class primitives. @ Env get: name (and
+// $NAME), set:to: and has: compile to os.Getenv, os.Setenv and
+// os.LookupEnv, so methods reading the environment no longer go to Bash;
+// they need capabilities: env. @ Os platform, arch, hostname and pid answer
+// runtime.GOOS, runtime.GOARCH, os.Hostname and os.Getpid.
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// usesEnv reports whether a method of class sends to Env or Os, so that
+// their helpers are only generated when needed. $NAME tokens read the
+// environment with os.Getenv and need no helper.
+func usesEnv(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenIdentifier && (tok.Value == "Env" || tok.Value == "Os") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usesEnvSet reports whether a method of class sends Env set:to:, which
+// throws an EnvError when the variable cannot be set
+func usesEnvSet(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		tokens := m.Body.Tokens
+		for i, tok := range tokens {
+			if tok.Type == ast.TokenIdentifier && tok.Value == "Env" &&
+				i+1 < len(tokens) && tokens[i+1].Type == ast.TokenKeyword && tokens[i+1].Value == "set:" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// envSelector returns the Trashtalk selector of an Env or Os operation
+func envSelector(op string) (string, bool) {
+	switch op {
+	case "envGet":
+		return "get:", true
+	case "envSet":
+		return "set:to:", true
+	case "envHas":
+		return "has:", true
+	case "osPlatform":
+		return "platform", true
+	case "osArch":
+		return "arch", true
+	case "osHostname":
+		return "hostname", true
+	case "osPid":
+		return "pid", true
+	}
+	return "", false
+}
+
+// generateEnvPrimitive generates Go code for Env and Os class primitives
+func (g *generator) generateEnvPrimitive(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	arg := func(i int) *jen.Statement {
+		if i >= len(e.Args) {
+			return jen.Lit("")
+		}
+		return g.generateStringArg(e.Args[i], m)
+	}
+	switch e.Operation {
+	case "envGet":
+		return jen.Qual("os", "Getenv").Call(arg(0))
+	case "envSet":
+		return jen.Id("_envSet").Call(arg(0), arg(1))
+	case "envHas":
+		return jen.Id("_envHas").Call(arg(0))
+	case "osPlatform":
+		return jen.Qual("runtime", "GOOS")
+	case "osArch":
+		return jen.Qual("runtime", "GOARCH")
+	case "osHostname":
+		return jen.Id("_osHostname").Call()
+	case "osPid":
+		return jen.Qual("strconv", "Itoa").Call(jen.Qual("os", "Getpid").Call())
+	}
+	return jen.Comment("unknown " + e.ClassName + " primitive: " + e.Operation)
+}
+
+// generateEnvHelpers generates _envSet, _envHas and _osHostname
+func (g *generator) generateEnvHelpers(f *jen.File) {
+	if !g.env {
+		return
+	}
+	f.Comment("// Env and Os primitive helpers")
+	f.Line()
+
+	// TrashError is only generated with exceptions, which set:to: turns on
+	if usesEnvSet(g.class) {
+		f.Comment("// _envSet sets the environment variable name to value and answers value. A")
+		f.Comment("// name the environment cannot hold throws an EnvError.")
+		f.Func().Id("_envSet").Params(jen.List(jen.Id("name"), jen.Id("value")).String()).String().Block(
+			jen.If(jen.Err().Op(":=").Qual("os", "Setenv").Call(jen.Id("name"), jen.Id("value")), jen.Err().Op("!=").Nil()).Block(
+				jen.Panic(jen.Op("&").Id("TrashError").Values(jen.Dict{
+					jen.Id("Class"):   jen.Lit("EnvError"),
+					jen.Id("Message"): jen.Err().Dot("Error").Call(),
+				})),
+			),
+			jen.Return(jen.Id("value")),
+		)
+		f.Line()
+	}
+
+	f.Comment("// _envHas answers whether the environment variable name is set, even to \"\"")
+	f.Func().Id("_envHas").Params(jen.Id("name").String()).String().Block(
+		jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Qual("os", "LookupEnv").Call(jen.Id("name")),
+		jen.Return(jen.Qual("strconv", "FormatBool").Call(jen.Id("ok"))),
+	)
+	f.Line()
+
+	f.Comment("// _osHostname answers the host name, or \"\" if it cannot be read")
+	f.Func().Id("_osHostname").Params().String().Block(
+		jen.List(jen.Id("name"), jen.Id("_")).Op(":=").Qual("os", "Hostname").Call(),
+		jen.Return(jen.Id("name")),
+	)
+	f.Line()
+}
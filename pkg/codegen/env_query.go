@@ -0,0 +1,263 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the Environment query methods: findBy:value:, where:
+// and orderBy:limit: compile to SQLite JSON1 queries over the instances
+// table and answer instance IDs, one per line, like findByClass:, and
+// createIndexOn: and dropIndexOn: manage the expression indexes on a field
+// the queries use. Values are passed as query arguments. Field paths are
+// checked against _jsonField and written into the SQL, as an index
+// expression only matches a literal path.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// envQuerySelectors are the Environment class methods compiled to queries
+var envQuerySelectors = map[string]bool{
+	"findBy_value_":  true,
+	"where_":         true,
+	"orderBy_limit_": true,
+	"createIndexOn_": true,
+	"dropIndexOn_":   true,
+}
+
+// hasEnvironmentQueries reports whether the class is Environment and
+// defines a query method
+func (g *generator) hasEnvironmentQueries() bool {
+	if g.class.Name != "Environment" {
+		return false
+	}
+	for _, m := range g.class.Methods {
+		if m.Kind == "class" && envQuerySelectors[m.Selector] {
+			return true
+		}
+	}
+	return false
+}
+
+// generateEnvironmentQuery generates the Environment query method m. It
+// returns false for other selectors.
+func (g *generator) generateEnvironmentQuery(f *jen.File, m *compiledMethod) bool {
+	returnErr := jen.If(jen.Err().Op("!=").Nil()).Block(jen.Return(jen.Lit(""), jen.Err()))
+	var body []jen.Code
+
+	switch m.selector {
+	case "findBy_value_":
+		// findBy: field value: v - instances whose field is v, as text or number
+		body = []jen.Code{
+			jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("_jsonFieldPath").Call(jen.Id("field")),
+			returnErr,
+			jen.Return(jen.Id("_queryIDs").Call(
+				jen.Lit("SELECT id FROM instances WHERE ").Op("+").Id("_jsonExtract").Call(jen.Id("path")).Op("+").Lit(" IN (?, ?) ORDER BY id"),
+				jen.Id("value"), jen.Id("_jsonNumber").Call(jen.Id("value")),
+			)),
+		}
+
+	case "where_":
+		// where: 'age >= 18 and name = ''bob''' - instances matching every comparison
+		body = []jen.Code{
+			jen.List(jen.Id("clause"), jen.Id("args"), jen.Err()).Op(":=").Id("_whereClause").Call(jen.Id("condition")),
+			returnErr,
+			jen.Return(jen.Id("_queryIDs").Call(
+				jen.Lit("SELECT id FROM instances WHERE ").Op("+").Id("clause").Op("+").Lit(" ORDER BY id"),
+				jen.Id("args").Op("..."),
+			)),
+		}
+
+	case "orderBy_limit_":
+		// orderBy: field limit: n - the first n instances having field, sorted by
+		// it (numbers numerically); -field sorts descending
+		body = []jen.Code{
+			jen.Id("order").Op(":=").Lit("ASC"),
+			jen.If(jen.List(jen.Id("name"), jen.Id("ok")).Op(":=").Qual("strings", "CutPrefix").Call(jen.Id("field"), jen.Lit("-")), jen.Id("ok")).Block(
+				jen.List(jen.Id("field"), jen.Id("order")).Op("=").List(jen.Id("name"), jen.Lit("DESC")),
+			),
+			jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("_jsonFieldPath").Call(jen.Id("field")),
+			returnErr,
+			jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("limit")),
+			jen.If(jen.Err().Op("!=").Nil().Op("||").Id("n").Op("<").Lit(0)).Block(
+				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("orderBy:limit: limit must be a non-negative integer, got %q"), jen.Id("limit"))),
+			),
+			jen.Id("value").Op(":=").Id("_jsonExtract").Call(jen.Id("path")),
+			jen.Return(jen.Id("_queryIDs").Call(
+				jen.Lit("SELECT id FROM instances WHERE ").Op("+").Id("value").Op("+").Lit(" IS NOT NULL ORDER BY CAST(").Op("+").Id("value").Op("+").Lit(" AS REAL) ").Op("+").Id("order").Op("+").
+					Lit(", CAST(").Op("+").Id("value").Op("+").Lit(" AS TEXT) ").Op("+").Id("order").Op("+").Lit(", id LIMIT ?"),
+				jen.Id("n"),
+			)),
+		}
+
+	case "createIndexOn_":
+		// createIndexOn: field - index the field for the queries; answers the index name
+		body = []jen.Code{
+			jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("_jsonFieldPath").Call(jen.Id("field")),
+			returnErr,
+			jen.Id("name").Op(":=").Id("_indexName").Call(jen.Id("path")),
+			jen.Return(jen.Id("name"), jen.Id("_execDDL").Call(
+				jen.Lit("CREATE INDEX IF NOT EXISTS ").Op("+").Id("name").Op("+").Lit(" ON instances(").Op("+").Id("_jsonExtract").Call(jen.Id("path")).Op("+").Lit(")"),
+			)),
+		}
+
+	case "dropIndexOn_":
+		// dropIndexOn: field - drop the index createIndexOn: or index: made
+		body = []jen.Code{
+			jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("_jsonFieldPath").Call(jen.Id("field")),
+			returnErr,
+			jen.Return(jen.Lit(""), jen.Id("_execDDL").Call(
+				jen.Lit("DROP INDEX IF EXISTS ").Op("+").Id("_indexName").Call(jen.Id("path")),
+			)),
+		}
+
+	default:
+		return false
+	}
+
+	params := []jen.Code{}
+	for _, name := range envQueryParams(m.selector) {
+		params = append(params, jen.Id(name).String())
+	}
+	f.Func().Id(m.goName).Params(params...).Parens(jen.List(jen.String(), jen.Error())).Block(body...)
+	return true
+}
+
+// envQueryParams returns the parameter names of an Environment query method
+func envQueryParams(selector string) []string {
+	switch selector {
+	case "findBy_value_":
+		return []string{"field", "value"}
+	case "where_":
+		return []string{"condition"}
+	case "orderBy_limit_":
+		return []string{"field", "limit"}
+	case "createIndexOn_", "dropIndexOn_":
+		return []string{"field"}
+	}
+	return nil
+}
+
+// generateEnvironmentQueryHelpers generates _execDDL, the field path helpers
+// and _whereClause; the queries also use _queryIDs. Nothing is emitted unless the class is Environment and
+// defines a query method.
+func (g *generator) generateEnvironmentQueryHelpers(f *jen.File) {
+	if !g.hasEnvironmentQueries() {
+		return
+	}
+
+	f.Comment("_execDDL runs a statement that changes the schema")
+	f.Func().Id("_execDDL").Params(jen.Id("stmt").String()).Error().Block(
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Defer().Id("releaseDB").Call(jen.Id("db")),
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("dbExec").Call(jen.Id("db"), jen.Id("stmt")),
+		jen.Return(jen.Err()),
+	)
+	f.Line()
+
+	f.Comment("_jsonField matches a field path: name, address.city, tags[0]")
+	f.Var().Id("_jsonField").Op("=").Qual("regexp", "MustCompile").Call(jen.Lit(jsonFieldPattern.String()))
+	f.Line()
+
+	f.Comment("_jsonFieldPath returns the JSON1 path of field, which may start with $.")
+	f.Func().Id("_jsonFieldPath").Params(jen.Id("field").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.Id("field").Op("=").Qual("strings", "TrimPrefix").Call(jen.Id("field"), jen.Lit("$.")),
+		jen.If(jen.Op("!").Id("_jsonField").Dot("MatchString").Call(jen.Id("field"))).Block(
+			jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("invalid field %q"), jen.Id("field"))),
+		),
+		jen.Return(jen.Lit("$.").Op("+").Id("field"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("_jsonExtract returns the SQL selecting path, from _jsonFieldPath, from an")
+	f.Comment("instance. index: and createIndexOn: index the same expression.")
+	f.Func().Id("_jsonExtract").Params(jen.Id("path").String()).String().Block(
+		jen.Return(jen.Lit("json_extract(data, '").Op("+").Id("path").Op("+").Lit("')")),
+	)
+	f.Line()
+
+	f.Comment("_indexUnsafe matches the characters of a field path an index name replaces")
+	f.Var().Id("_indexUnsafe").Op("=").Qual("regexp", "MustCompile").Call(jen.Lit(indexNameUnsafe.String()))
+	f.Line()
+
+	f.Comment("_indexName returns the name of the index on path, from _jsonFieldPath")
+	f.Func().Id("_indexName").Params(jen.Id("path").String()).String().Block(
+		jen.Return(jen.Lit("idx_instances_").Op("+").Id("_indexUnsafe").Dot("ReplaceAllString").Call(
+			jen.Qual("strings", "TrimPrefix").Call(jen.Id("path"), jen.Lit("$.")), jen.Lit("_"),
+		)),
+	)
+	f.Line()
+
+	f.Comment("_jsonNumber returns value as a number if it is one, so a field stored as")
+	f.Comment("a JSON number matches it too")
+	f.Func().Id("_jsonNumber").Params(jen.Id("value").String()).Interface().Block(
+		jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("value"), jen.Lit(64)), jen.Err().Op("==").Nil()).Block(
+			jen.Return(jen.Id("n")),
+		),
+		jen.Return(jen.Id("value")),
+	)
+	f.Line()
+
+	f.Comment("_whereTerm matches one comparison of a where: condition: a field, an")
+	f.Comment("operator and a 'quoted' or bare value")
+	f.Var().Id("_whereTerm").Op("=").Qual("regexp", "MustCompile").Call(jen.Lit(`^\s*([$A-Za-z_][A-Za-z0-9_.\[\]]*)\s*(==|!=|<>|<=|>=|=|<|>)\s*('(?:[^']|'')*'|[^\s']+)\s*`))
+	f.Line()
+
+	f.Comment("_whereAnd matches the and joining two comparisons")
+	f.Var().Id("_whereAnd").Op("=").Qual("regexp", "MustCompile").Call(jen.Lit(`^(?i:and)\s+`))
+	f.Line()
+
+	f.Comment("_whereClause compiles a where: condition such as age >= 18 and name = 'bob'")
+	f.Comment("to SQL and its arguments. = matches a field stored as text or number; other")
+	f.Comment("operators compare a bare number numerically, anything else as text.")
+	f.Func().Id("_whereClause").Params(jen.Id("condition").String()).Parens(jen.List(jen.String(), jen.Index().Interface(), jen.Error())).Block(
+		jen.Var().Id("terms").Index().String(),
+		jen.Var().Id("args").Index().Interface(),
+		jen.Id("rest").Op(":=").Id("condition"),
+		jen.For().Block(
+			jen.Id("match").Op(":=").Id("_whereTerm").Dot("FindStringSubmatch").Call(jen.Id("rest")),
+			jen.If(jen.Id("match").Op("==").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("where: cannot parse %q"), jen.Id("condition"))),
+			),
+			jen.Id("rest").Op("=").Id("rest").Index(jen.Len(jen.Id("match").Index(jen.Lit(0))).Op(":")),
+			jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("_jsonFieldPath").Call(jen.Id("match").Index(jen.Lit(1))),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Nil(), jen.Err()),
+			),
+			jen.List(jen.Id("op"), jen.Id("value")).Op(":=").List(jen.Id("match").Index(jen.Lit(2)), jen.Id("match").Index(jen.Lit(3))),
+			jen.Switch(jen.Id("op")).Block(
+				jen.Case(jen.Lit("==")).Block(jen.Id("op").Op("=").Lit("=")),
+				jen.Case(jen.Lit("<>")).Block(jen.Id("op").Op("=").Lit("!=")),
+			),
+			jen.Id("quoted").Op(":=").Qual("strings", "HasPrefix").Call(jen.Id("value"), jen.Lit("'")),
+			jen.If(jen.Id("quoted")).Block(
+				jen.Id("value").Op("=").Qual("strings", "ReplaceAll").Call(jen.Id("value").Index(jen.Lit(1).Op(":").Len(jen.Id("value")).Op("-").Lit(1)), jen.Lit("''"), jen.Lit("'")),
+			),
+			jen.Id("extract").Op(":=").Id("_jsonExtract").Call(jen.Id("path")),
+			jen.List(jen.Id("n"), jen.Id("numErr")).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("value"), jen.Lit(64)),
+			jen.Switch().Block(
+				jen.Case(jen.Id("op").Op("==").Lit("=")).Block(
+					jen.Comment("// Equality can use an index on the field"),
+					jen.Id("terms").Op("=").Append(jen.Id("terms"), jen.Id("extract").Op("+").Lit(" IN (?, ?)")),
+					jen.Id("args").Op("=").Append(jen.Id("args"), jen.Id("value"), jen.Id("_jsonNumber").Call(jen.Id("value"))),
+				),
+				jen.Case(jen.Op("!").Id("quoted").Op("&&").Id("numErr").Op("==").Nil()).Block(
+					jen.Id("terms").Op("=").Append(jen.Id("terms"), jen.Lit("CAST(").Op("+").Id("extract").Op("+").Lit(" AS REAL) ").Op("+").Id("op").Op("+").Lit(" ?")),
+					jen.Id("args").Op("=").Append(jen.Id("args"), jen.Id("n")),
+				),
+				jen.Default().Block(
+					jen.Id("terms").Op("=").Append(jen.Id("terms"), jen.Lit("CAST(").Op("+").Id("extract").Op("+").Lit(" AS TEXT) ").Op("+").Id("op").Op("+").Lit(" ?")),
+					jen.Id("args").Op("=").Append(jen.Id("args"), jen.Id("value")),
+				),
+			),
+			jen.If(jen.Id("rest").Op("==").Lit("")).Block(
+				jen.Return(jen.Qual("strings", "Join").Call(jen.Id("terms"), jen.Lit(" AND ")), jen.Id("args"), jen.Nil()),
+			),
+			jen.Id("and").Op(":=").Id("_whereAnd").Dot("FindString").Call(jen.Id("rest")),
+			jen.If(jen.Id("and").Op("==").Lit("")).Block(
+				jen.Return(jen.Lit(""), jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("where: expected and before %q"), jen.Id("rest"))),
+			),
+			jen.Id("rest").Op("=").Id("rest").Index(jen.Len(jen.Id("and")).Op(":")),
+		),
+	)
+	f.Line()
+}
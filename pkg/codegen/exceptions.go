@@ -0,0 +1,255 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains exceptions: _throw, on:do: and ensure:.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// A _throw panics with a *TrashError carrying the error class, the selector
+// that threw and the message. on:do: recovers it in a deferred function and
+// re-panics anything its class does not handle; ensure: runs its cleanup in
+// a deferred function. Whatever reaches dispatch is recovered into the
+// returned error, and the binary exits with trashErrorExitCode so the Bash
+// runtime can signal it again on its side. The instance is not saved.
+
+// trashErrorExitCode is the exit code of a request ended by an unhandled _throw
+const trashErrorExitCode = 201
+
+// usesExceptions reports whether any method of class throws or handles
+// errors, the class is abstract, it declares typed arguments, it uses the
+// File operations or Env set:to:, which throw FileError and EnvError, or it
+// sends messages, whose receivers' errors are signaled in it
+func usesExceptions(class *ast.Class) bool {
+	if isAbstract(class) || usesArgTypes(class) || usesFileOps(class) || usesEnvSet(class) || sendsMessages(class) {
+		return true
+	}
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			switch {
+			case tok.Type == ast.TokenIdentifier && tok.Value == "_throw",
+				tok.Type == ast.TokenKeyword && (tok.Value == "on:" || tok.Value == "ensure:"):
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateExceptionHelpers generates TrashError, _throw, _catch,
+// _recoverTrashError and _raiseSendError
+func generateExceptionHelpers(f *jen.File) {
+	f.Comment("TrashError is an error signaled by _throw")
+	f.Type().Id("TrashError").Struct(
+		jen.Id("Class").String(),
+		jen.Id("Selector").String(),
+		jen.Id("Message").String(),
+	)
+	f.Line()
+
+	f.Func().Params(jen.Id("e").Op("*").Id("TrashError")).Id("Error").Params().String().Block(
+		jen.Return(jen.Id("e").Dot("Class").Op("+").Lit(": ").Op("+").Id("e").Dot("Message")),
+	)
+	f.Line()
+
+	f.Comment("_throw signals class from selector, unwinding to the nearest on:do: handler")
+	f.Func().Id("_throw").Params(
+		jen.List(jen.Id("class"), jen.Id("selector")).String(),
+		jen.Id("message").Interface(),
+	).Block(
+		jen.Panic(jen.Op("&").Id("TrashError").Values(jen.Dict{
+			jen.Id("Class"):    jen.Id("class"),
+			jen.Id("Selector"): jen.Id("selector"),
+			jen.Id("Message"):  jen.Id("_toStr").Call(jen.Id("message")),
+		})),
+	)
+	f.Line()
+
+	f.Comment("_catch returns the error recovered as r if a handler for class catches it,")
+	f.Comment("and panics again otherwise. A handler for Error catches every TrashError.")
+	f.Func().Id("_catch").Params(jen.Id("r").Interface(), jen.Id("class").String()).Op("*").Id("TrashError").Block(
+		jen.List(jen.Id("te"), jen.Id("ok")).Op(":=").Id("r").Assert(jen.Op("*").Id("TrashError")),
+		jen.If(jen.Op("!").Id("ok").Op("||").Parens(jen.Id("class").Op("!=").Lit("Error").Op("&&").Id("te").Dot("Class").Op("!=").Id("class"))).Block(
+			jen.Panic(jen.Id("r")),
+		),
+		jen.Return(jen.Id("te")),
+	)
+	f.Line()
+
+	f.Comment("_recoverTrashError turns an unhandled _throw into the error dispatch returns")
+	f.Func().Id("_recoverTrashError").Params(jen.Id("err").Op("*").Error()).Block(
+		jen.If(jen.Id("r").Op(":=").Recover(), jen.Id("r").Op("!=").Nil()).Block(
+			jen.List(jen.Id("te"), jen.Id("ok")).Op(":=").Id("r").Assert(jen.Op("*").Id("TrashError")),
+			jen.If(jen.Op("!").Id("ok")).Block(
+				jen.Panic(jen.Id("r")),
+			),
+			jen.Op("*").Id("err").Op("=").Id("te"),
+		),
+	)
+	f.Line()
+
+	f.Comment("_raiseSendError signals the error the receiver of a message ended it with:")
+	f.Comment("its own TrashError for exit code " + fmt.Sprint(trashErrorExitCode) + ", StorageBusy for " + fmt.Sprint(storageBusyExitCode) + " and Unauthorized for " + fmt.Sprint(unauthorizedExitCode) + ".")
+	f.Comment("Other exit codes are answers, as in Bash.")
+	f.Func().Id("_raiseSendError").Params(
+		jen.Id("selector").String(),
+		jen.Id("code").Int(),
+		jen.Id("message").String(),
+	).Block(
+		jen.Id("class").Op(":=").Lit(""),
+		jen.Switch(jen.Id("code")).Block(
+			jen.Case(jen.Lit(trashErrorExitCode)).Block(
+				jen.Id("class").Op("=").Lit("Error"),
+				jen.If(jen.List(jen.Id("c"), jen.Id("m"), jen.Id("ok")).Op(":=").Qual("strings", "Cut").Call(jen.Id("message"), jen.Lit(": ")), jen.Id("ok")).Block(
+					jen.List(jen.Id("class"), jen.Id("message")).Op("=").List(jen.Id("c"), jen.Id("m")),
+				),
+			),
+			jen.Case(jen.Lit(storageBusyExitCode)).Block(
+				jen.Id("class").Op("=").Lit("StorageBusy"),
+			),
+			jen.Case(jen.Lit(unauthorizedExitCode)).Block(
+				jen.Id("class").Op("=").Lit("Unauthorized"),
+			),
+			jen.Default().Block(
+				jen.Return(),
+			),
+		),
+		jen.Panic(jen.Op("&").Id("TrashError").Values(jen.Dict{
+			jen.Id("Class"):    jen.Id("class"),
+			jen.Id("Selector"): jen.Id("selector"),
+			jen.Id("Message"):  jen.Id("message"),
+		})),
+	)
+	f.Line()
+}
+
+// raiseSendError returns the sendMessage statement that signals a receiver's
+// error in code and message. Nothing is emitted without exceptions, where it
+// would not be recovered.
+func (g *generator) raiseSendError(code, message jen.Code) jen.Code {
+	if !g.exceptions {
+		return jen.Null()
+	}
+	return jen.Id("_raiseSendError").Call(jen.Id("selector"), code, message)
+}
+
+// dispatchResults is the result list of dispatch and dispatchClass. With
+// exceptions the results are named so the deferred recover can set err.
+func (g *generator) dispatchResults() *jen.Statement {
+	if !g.exceptions {
+		return jen.Parens(jen.List(jen.String(), jen.Error()))
+	}
+	return jen.Parens(jen.List(jen.Id("result").String(), jen.Err().Error()))
+}
+
+// dispatchRecover returns the statement dispatch and dispatchClass start
+// with to recover an unhandled _throw. Nothing is emitted without exceptions.
+func (g *generator) dispatchRecover() jen.Code {
+	if !g.exceptions {
+		return jen.Null()
+	}
+	return jen.Defer().Id("_recoverTrashError").Call(jen.Op("&").Id("err"))
+}
+
+// trashErrorExit returns the main statements that report an unhandled
+// _throw in err and exit. Nothing is emitted without exceptions.
+func (g *generator) trashErrorExit() jen.Code {
+	if !g.exceptions {
+		return jen.Null()
+	}
+	return exitOnTrashError()
+}
+
+// exitOnTrashError returns the statements that report a *TrashError in err
+// on stderr and exit with trashErrorExitCode
+func exitOnTrashError() *jen.Statement {
+	return jen.Var().Id("te").Op("*").Id("TrashError").Line().
+		If(jen.Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("te"))).Block(
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Id("te")),
+		jen.Qual("os", "Exit").Call(jen.Lit(trashErrorExitCode)),
+	)
+}
+
+// trashErrorResponse returns the handleServeRequest statements that answer
+// an unhandled _throw in err. Nothing is emitted without exceptions.
+func (g *generator) trashErrorResponse() jen.Code {
+	if !g.exceptions {
+		return jen.Null()
+	}
+	return jen.Var().Id("te").Op("*").Id("TrashError").Line().
+		If(jen.Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("te"))).Block(
+		jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+			jen.Id("ExitCode"): jen.Lit(trashErrorExitCode),
+			jen.Id("Error"):    jen.Id("te").Dot("Error").Call(),
+		})),
+	)
+}
+
+// trashErrorResult returns the plugin statements that answer an unhandled
+// _throw in err. Nothing is emitted without exceptions.
+func (g *generator) trashErrorResult() jen.Code {
+	if !g.exceptions {
+		return jen.Null()
+	}
+	return jen.Var().Id("te").Op("*").Id("TrashError").Line().
+		If(jen.Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("te"))).Block(
+		jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(fmt.Sprintf(`{"exit_code":%d,"error":%%q}`, trashErrorExitCode)), jen.Id("te").Dot("Error").Call())),
+	)
+}
+
+// generateThrow generates _throw as a call that panics with a *TrashError
+func (g *generator) generateThrow(s *parser.ThrowExpr, m *compiledMethod) []jen.Code {
+	message := jen.Lit("")
+	if s.Message != nil {
+		message = g.generateExpr(s.Message, m)
+	}
+	return []jen.Code{jen.Id("_throw").Call(jen.Lit(s.Class), jen.Lit(m.selector), message)}
+}
+
+// generateOnDo generates on:do: as a closure whose deferred function
+// recovers the errors the handler catches. The handler parameter is bound to
+// the error message.
+func (g *generator) generateOnDo(s *parser.OnDoExpr, m *compiledMethod) []jen.Code {
+	catch := jen.Id("_catch").Call(jen.Id("r"), jen.Lit(s.ErrorClass))
+	var handler []jen.Code
+	if s.ErrVar != "" {
+		handler = append(handler,
+			jen.Var().Id(s.ErrVar).Interface().Op("=").Add(catch).Dot("Message"),
+			jen.Id("_").Op("=").Id(s.ErrVar),
+		)
+	} else {
+		handler = append(handler, catch)
+	}
+	handler = append(handler, g.generateStatements(s.Handler, m)...)
+
+	return []jen.Code{
+		jen.Func().Params().Block(append([]jen.Code{
+			jen.Defer().Func().Params().Block(
+				jen.If(jen.Id("r").Op(":=").Recover(), jen.Id("r").Op("!=").Nil()).Block(handler...),
+			).Call(),
+		}, g.generateStatements(s.Body, m)...)...).Call(),
+	}
+}
+
+// generateEnsure generates ensure: as a closure that defers the cleanup, so
+// it also runs while an error unwinds
+func (g *generator) generateEnsure(s *parser.EnsureExpr, m *compiledMethod) []jen.Code {
+	return []jen.Code{
+		jen.Func().Params().Block(append([]jen.Code{
+			jen.Defer().Func().Params().Block(g.generateStatements(s.Cleanup, m)...).Call(),
+		}, g.generateStatements(s.Body, m)...)...).Call(),
+	}
+}
+
+// generateStatements generates a list of statements
+func (g *generator) generateStatements(stmts []parser.Statement, m *compiledMethod) []jen.Code {
+	var code []jen.Code
+	for _, stmt := range stmts {
+		code = append(code, g.generateStatement(stmt, m)...)
+	}
+	return code
+}
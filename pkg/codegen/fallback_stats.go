@@ -0,0 +1,167 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains fallback statistics (Options.FallbackStats): every
+// dispatch that exits 200 for a selector with no native implementation is
+// counted per class, and the __fallbackStats class selector reports the
+// counts.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/dave/jennifer/jen"
+)
+
+// fallbackStatsSelector is the class selector that reports fallback counts.
+const fallbackStatsSelector = "__fallbackStats"
+
+// setFallbackStats records whether fallback statistics were requested. The
+// counts are kept next to the instances table, so they need the plain
+// SQLite helpers.
+func (g *generator) setFallbackStats(enabled bool) {
+	if !enabled {
+		return
+	}
+	if g.useStorage() || g.class.Name == "Environment" || g.grpc {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("fallback statistics need the SQLite helpers; fallback statistics ignored for %s", g.class.Name))
+		return
+	}
+	g.fallbackStats = true
+}
+
+// generateFallbackStats generates recordFallback and fallbackStats. Nothing
+// is emitted without fallback statistics.
+func (g *generator) generateFallbackStats(f *jen.File) {
+	if !g.fallbackStats {
+		return
+	}
+	qualifiedName := g.class.QualifiedName()
+	createTable := jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("db").Dot("Exec").Call(
+		jen.Lit("CREATE TABLE IF NOT EXISTS fallback_stats (class TEXT NOT NULL, selector TEXT NOT NULL, fallback_count INTEGER NOT NULL, last_fallback_at TEXT NOT NULL, PRIMARY KEY (class, selector))"),
+	), jen.Err().Op("!=").Nil())
+
+	f.Comment("recordFallback counts a dispatch of selector that fell back to Bash.")
+	f.Comment("Statistics never fail a dispatch, so errors are ignored.")
+	f.Func().Id("recordFallback").Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("selector").String(),
+	).Block(
+		createTable.Clone().Block(
+			jen.Return(),
+		),
+		jen.Id("db").Dot("Exec").Call(
+			jen.Lit("INSERT INTO fallback_stats (class, selector, fallback_count, last_fallback_at) VALUES (?, ?, 1, ?) "+
+				"ON CONFLICT (class, selector) DO UPDATE SET fallback_count = fallback_count + 1, last_fallback_at = excluded.last_fallback_at"),
+			jen.Lit(qualifiedName),
+			jen.Id("selector"),
+			jen.Qual("time", "Now").Call().Dot("UTC").Call().Dot("Format").Call(jen.Qual("time", "RFC3339")),
+		),
+	)
+	f.Line()
+
+	// fallbackStats - {"selector": {"count": n, "last": "..."}} for this class
+	f.Comment("fallbackStats returns the fallback count and last fallback time of each")
+	f.Comment("selector of " + qualifiedName + " as a JSON object")
+	f.Func().Id("fallbackStats").Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+	).Parens(jen.List(jen.String(), jen.Error())).Block(
+		createTable.Clone().Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.List(jen.Id("rows"), jen.Err()).Op(":=").Id("db").Dot("Query").Call(
+			jen.Lit("SELECT selector, fallback_count, last_fallback_at FROM fallback_stats WHERE class = ?"),
+			jen.Lit(qualifiedName),
+		),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Defer().Id("rows").Dot("Close").Call(),
+		jen.Type().Id("stat").Struct(
+			jen.Id("Count").Int64().Tag(map[string]string{"json": "count"}),
+			jen.Id("Last").String().Tag(map[string]string{"json": "last"}),
+		),
+		jen.Id("stats").Op(":=").Map(jen.String()).Id("stat").Values(),
+		jen.For(jen.Id("rows").Dot("Next").Call()).Block(
+			jen.Var().Id("selector").String(),
+			jen.Var().Id("s").Id("stat"),
+			jen.If(jen.Err().Op(":=").Id("rows").Dot("Scan").Call(jen.Op("&").Id("selector"), jen.Op("&").Id("s").Dot("Count"), jen.Op("&").Id("s").Dot("Last")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Err()),
+			),
+			jen.Id("stats").Index(jen.Id("selector")).Op("=").Id("s"),
+		),
+		jen.If(jen.Err().Op(":=").Id("rows").Dot("Err").Call(), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.List(jen.Id("out"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("stats")),
+		jen.Return(jen.String().Parens(jen.Id("out")), jen.Err()),
+	)
+	f.Line()
+}
+
+// recordFallback returns the statement that counts a fallback of selector
+// through db. Nothing is emitted without fallback statistics.
+func (g *generator) recordFallback(db, selector jen.Code) jen.Code {
+	if !g.fallbackStats {
+		return jen.Null()
+	}
+	return jen.Id("recordFallback").Call(db, selector)
+}
+
+// mainRecordClassFallback returns the statements main uses to count a class
+// method fallback. The database is only opened for instance methods, so it
+// is opened here. Nothing is emitted without fallback statistics.
+func (g *generator) mainRecordClassFallback() jen.Code {
+	if !g.fallbackStats {
+		return jen.Null()
+	}
+	return jen.If(jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(), jen.Err().Op("==").Nil()).Block(
+		jen.Id("recordFallback").Call(jen.Id("db"), jen.Id("selector")),
+		jen.Id("db").Dot("Close").Call(),
+	)
+}
+
+// mainFallbackStats returns the main statements that answer the
+// __fallbackStats class selector. Nothing is emitted without fallback
+// statistics.
+func (g *generator) mainFallbackStats() jen.Code {
+	if !g.fallbackStats {
+		return jen.Null()
+	}
+	return jen.If(jen.Id("selector").Op("==").Lit(fallbackStatsSelector)).Block(
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error opening database: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Defer().Id("db").Dot("Close").Call(),
+		jen.List(jen.Id("stats"), jen.Err()).Op(":=").Id("fallbackStats").Call(jen.Id("db")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Qual("fmt", "Println").Call(jen.Id("stats")),
+		jen.Return(),
+	)
+}
+
+// serveFallbackStats returns the handleServeRequest statements that answer
+// the __fallbackStats class selector. Nothing is emitted without fallback
+// statistics.
+func (g *generator) serveFallbackStats() jen.Code {
+	if !g.fallbackStats {
+		return jen.Null()
+	}
+	return jen.If(jen.Id("req").Dot("Selector").Op("==").Lit(fallbackStatsSelector)).Block(
+		jen.List(jen.Id("stats"), jen.Err()).Op(":=").Id("fallbackStats").Call(jen.Id("db")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+				jen.Id("ExitCode"): jen.Lit(1),
+				jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+			})),
+		),
+		jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+			jen.Id("Result"):   jen.Id("stats"),
+			jen.Id("ExitCode"): jen.Lit(0),
+		})),
+	)
+}
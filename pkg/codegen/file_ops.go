@@ -0,0 +1,170 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the File class primitives that read and change files:
+// readAll:, writeContents:to:, append:to:, delete:, copy:to:, listDirectory:
+// and mkdirp:. Each compiles to a helper making the os/io calls and
+// answering (string, error), like the File class's own methods. An error
+// is thrown as a FileError TrashError, so on: FileError do: can handle it
+// and otherwise dispatch returns it and the request ends with
+// trashErrorExitCode.
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// fileOps maps the File operations that read and change files to their
+// helpers
+var fileOps = map[string]string{
+	"fileReadAll":       "_fileReadAll",
+	"fileWriteContents": "_fileWriteContents",
+	"fileAppend":        "_fileAppend",
+	"fileDelete":        "_fileDelete",
+	"fileCopy":          "_fileCopy",
+	"fileListDirectory": "_fileListDirectory",
+	"fileMkdirp":        "_fileMkdirp",
+}
+
+// fileOpKeywords are the first keywords of the fileOps selectors
+var fileOpKeywords = map[string]bool{
+	"readAll:":       true,
+	"writeContents:": true,
+	"append:":        true,
+	"delete:":        true,
+	"copy:":          true,
+	"listDirectory:": true,
+	"mkdirp:":        true,
+}
+
+// usesFileOps reports whether a method of class sends one of the fileOps,
+// so that their helpers are only generated when needed
+func usesFileOps(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		tokens := m.Body.Tokens
+		for i, tok := range tokens {
+			if tok.Type == ast.TokenIdentifier && tok.Value == "File" &&
+				i+1 < len(tokens) && tokens[i+1].Type == ast.TokenKeyword && fileOpKeywords[tokens[i+1].Value] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateFileOp generates the call of the helper of a fileOps operation.
+// It returns nil for other operations.
+func (g *generator) generateFileOp(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	helper, ok := fileOps[e.Operation]
+	if !ok {
+		return nil
+	}
+	var args []jen.Code
+	for _, arg := range e.Args {
+		args = append(args, g.generateStringArg(arg, m))
+	}
+	return jen.Id("_fileResult").Call(jen.Id(helper).Call(args...))
+}
+
+// generateFileOpHelpers generates _fileResult and the helpers of the
+// fileOps operations
+func (g *generator) generateFileOpHelpers(f *jen.File) {
+	if !g.fileOps {
+		return
+	}
+	returnErr := jen.If(jen.Err().Op("!=").Nil()).Block(jen.Return(jen.Lit(""), jen.Err()))
+	result := jen.Parens(jen.List(jen.String(), jen.Error()))
+
+	f.Comment("// File operation helpers")
+	f.Line()
+
+	f.Comment("// _fileResult answers the result of a File operation, throwing its error as a")
+	f.Comment("// FileError")
+	f.Func().Id("_fileResult").Params(jen.Id("s").String(), jen.Err().Error()).String().Block(
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Panic(jen.Op("&").Id("TrashError").Values(jen.Dict{
+				jen.Id("Class"):   jen.Lit("FileError"),
+				jen.Id("Message"): jen.Err().Dot("Error").Call(),
+			})),
+		),
+		jen.Return(jen.Id("s")),
+	)
+	f.Line()
+
+	f.Comment("// _fileReadAll answers the contents of the file at path")
+	f.Func().Id("_fileReadAll").Params(jen.Id("path").String()).Add(result).Block(
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("os", "ReadFile").Call(jen.Id("path")),
+		returnErr,
+		jen.Return(jen.String().Parens(jen.Id("data")), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// _fileWriteContents replaces the contents of the file at path, creating it")
+	f.Func().Id("_fileWriteContents").Params(jen.List(jen.Id("contents"), jen.Id("path")).String()).Add(result).Block(
+		jen.Return(jen.Lit(""), jen.Qual("os", "WriteFile").Call(jen.Id("path"), jen.Index().Byte().Parens(jen.Id("contents")), jen.Lit(0644))),
+	)
+	f.Line()
+
+	f.Comment("// _fileAppend appends contents to the file at path, creating it")
+	f.Func().Id("_fileAppend").Params(jen.List(jen.Id("contents"), jen.Id("path")).String()).Add(result).Block(
+		jen.List(jen.Id("file"), jen.Err()).Op(":=").Qual("os", "OpenFile").Call(
+			jen.Id("path"),
+			jen.Qual("os", "O_APPEND").Op("|").Qual("os", "O_CREATE").Op("|").Qual("os", "O_WRONLY"),
+			jen.Lit(0644),
+		),
+		returnErr,
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("file").Dot("WriteString").Call(jen.Id("contents")), jen.Err().Op("!=").Nil()).Block(
+			jen.Id("file").Dot("Close").Call(),
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Return(jen.Lit(""), jen.Id("file").Dot("Close").Call()),
+	)
+	f.Line()
+
+	f.Comment("// _fileDelete removes the file or empty directory at path")
+	f.Func().Id("_fileDelete").Params(jen.Id("path").String()).Add(result).Block(
+		jen.Return(jen.Lit(""), jen.Qual("os", "Remove").Call(jen.Id("path"))),
+	)
+	f.Line()
+
+	f.Comment("// _fileCopy copies the file at src to dst, with the mode of src")
+	f.Func().Id("_fileCopy").Params(jen.List(jen.Id("src"), jen.Id("dst")).String()).Add(result).Block(
+		jen.List(jen.Id("in"), jen.Err()).Op(":=").Qual("os", "Open").Call(jen.Id("src")),
+		returnErr,
+		jen.Defer().Id("in").Dot("Close").Call(),
+		jen.List(jen.Id("info"), jen.Err()).Op(":=").Id("in").Dot("Stat").Call(),
+		returnErr,
+		jen.List(jen.Id("out"), jen.Err()).Op(":=").Qual("os", "OpenFile").Call(
+			jen.Id("dst"),
+			jen.Qual("os", "O_CREATE").Op("|").Qual("os", "O_TRUNC").Op("|").Qual("os", "O_WRONLY"),
+			jen.Id("info").Dot("Mode").Call().Dot("Perm").Call(),
+		),
+		returnErr,
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Qual("io", "Copy").Call(jen.Id("out"), jen.Id("in")), jen.Err().Op("!=").Nil()).Block(
+			jen.Id("out").Dot("Close").Call(),
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Return(jen.Lit(""), jen.Id("out").Dot("Close").Call()),
+	)
+	f.Line()
+
+	f.Comment("// _fileListDirectory answers the names in the directory at path, sorted, as a")
+	f.Comment("// JSON array")
+	f.Func().Id("_fileListDirectory").Params(jen.Id("path").String()).Add(result).Block(
+		jen.List(jen.Id("entries"), jen.Err()).Op(":=").Qual("os", "ReadDir").Call(jen.Id("path")),
+		returnErr,
+		jen.Id("names").Op(":=").Make(jen.Index().String(), jen.Len(jen.Id("entries"))),
+		jen.For(jen.List(jen.Id("i"), jen.Id("entry")).Op(":=").Range().Id("entries")).Block(
+			jen.Id("names").Index(jen.Id("i")).Op("=").Id("entry").Dot("Name").Call(),
+		),
+		jen.List(jen.Id("out"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("names")),
+		jen.Return(jen.String().Parens(jen.Id("out")), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// _fileMkdirp creates the directory at path and any missing parents")
+	f.Func().Id("_fileMkdirp").Params(jen.Id("path").String()).Add(result).Block(
+		jen.Return(jen.Lit(""), jen.Qual("os", "MkdirAll").Call(jen.Id("path"), jen.Lit(0755))),
+	)
+	f.Line()
+}
@@ -0,0 +1,88 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains constant folding. Integer arithmetic and string
+// concatenation on literals are worked out at compile time, so 60 * 60
+// compiles to 3600 and 'Hello, ', 'world' to one string literal, and a
+// JSON literal built from pieces can be validated like one written whole.
+package codegen
+
+import (
+	"math/big"
+	"strconv"
+
+	"github.com/chazu/procyon/pkg/parser"
+)
+
+// foldConstant returns expr with its constant parts folded: a BinaryExpr
+// whose operands are literals becomes the literal it evaluates to. An
+// integer result that overflows int64, or a division by zero, is left for
+// go build to report, as it would without folding. Other expressions are
+// returned as they are.
+func foldConstant(expr parser.Expr) parser.Expr {
+	e, ok := expr.(*parser.BinaryExpr)
+	if !ok {
+		return expr
+	}
+	left, right := foldConstant(e.Left), foldConstant(e.Right)
+
+	switch e.Op {
+	case ",":
+		l, lok := literalString(left)
+		r, rok := literalString(right)
+		if lok && rok {
+			return &parser.StringLit{Value: l + r}
+		}
+	case "+", "-", "*", "/":
+		l, lok := intLitValue(left)
+		r, rok := intLitValue(right)
+		if lok && rok {
+			if n, ok := foldInt(e.Op, int64(l), int64(r)); ok {
+				return &parser.NumberLit{Value: strconv.FormatInt(n, 10)}
+			}
+		}
+	}
+
+	if left != e.Left || right != e.Right {
+		return &parser.BinaryExpr{Left: left, Op: e.Op, Right: right}
+	}
+	return expr
+}
+
+// foldInt evaluates l op r, reporting false for a division by zero or a
+// result outside int64. Division truncates, like Go and Bash.
+func foldInt(op string, l, r int64) (int64, bool) {
+	x, y := big.NewInt(l), big.NewInt(r)
+	switch op {
+	case "+":
+		x.Add(x, y)
+	case "-":
+		x.Sub(x, y)
+	case "*":
+		x.Mul(x, y)
+	case "/":
+		if r == 0 {
+			return 0, false
+		}
+		x.Quo(x, y)
+	}
+	if !x.IsInt64() {
+		return 0, false
+	}
+	return x.Int64(), true
+}
+
+// literalString returns the string a literal concatenates as: a string's
+// value, or a number as _toStr formats it at runtime
+func literalString(expr parser.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *parser.StringLit:
+		return e.Value, true
+	case *parser.NumberLit:
+		if n, ok := intLitValue(e); ok {
+			return strconv.Itoa(n), true
+		}
+		if f, err := strconv.ParseFloat(e.Value, 64); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,35 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the choice of native gRPC clients. The GrpcClient
+// class and any class declaring pragma: grpcNative get the gRPC helpers and
+// native implementations of their procyonNative methods, so several clients
+// with their own defaults can be compiled side by side.
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// grpcIvars are the instance variables the gRPC helpers read
+var grpcIvars = []string{"address", "usePlaintext", "poolConnections", "protoFile"}
+
+// setGrpcNative records whether the class is a native gRPC client. A class
+// missing one of grpcIvars is compiled as an ordinary class, since the
+// helpers would not build.
+func (g *generator) setGrpcNative() {
+	if g.class.Name != "GrpcClient" && !g.class.HasPragma("grpcNative") {
+		return
+	}
+	var missing []string
+	for _, name := range grpcIvars {
+		if !g.instanceVars[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("%s is not a native gRPC client: missing instance variables %s", g.class.Name, strings.Join(missing, ", ")))
+		return
+	}
+	g.grpc = true
+}
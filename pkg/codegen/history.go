@@ -0,0 +1,227 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains instance history (Options.History): every saved state
+// is kept, and requests can dispatch read-only against the state an instance
+// had at a past time.
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/dave/jennifer/jen"
+)
+
+// historyTimeFormat is the saved_at format. Fixed-width UTC timestamps sort
+// lexically in time order, so SQLite can compare them as text.
+const historyTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// setHistory records whether instance history was requested. History is
+// kept next to the instances table, so it needs the plain SQLite helpers.
+func (g *generator) setHistory(enabled bool) {
+	if !enabled {
+		return
+	}
+	if g.useStorage() || g.class.Name == "Environment" || g.grpc {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("instance history needs the SQLite helpers; history ignored for %s", g.class.Name))
+		return
+	}
+	g.history = true
+}
+
+// generateHistory generates recordHistory, loadInstanceAsOf and dispatchAsOf.
+// Nothing is emitted without history.
+func (g *generator) generateHistory(f *jen.File) {
+	if !g.history {
+		return
+	}
+	typeName := g.typeName()
+
+	f.Comment("ErrReadOnly reports a dispatch as of a past time that would modify the instance")
+	f.Var().Id("ErrReadOnly").Op("=").Qual("errors", "New").Call(jen.Lit("read-only: cannot modify an instance as of a past time"))
+	f.Line()
+
+	f.Comment("recordHistory appends a saved state of id to instance_history")
+	f.Func().Id("recordHistory").Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("id").String(),
+		jen.Id("data").String(),
+	).Error().Block(
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dbExec").Call(
+			jen.Id("db"),
+			jen.Lit("CREATE TABLE IF NOT EXISTS instance_history (id TEXT NOT NULL, data JSON, saved_at TEXT NOT NULL)"),
+		), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dbExec").Call(
+			jen.Id("db"),
+			jen.Lit("INSERT INTO instance_history (id, data, saved_at) VALUES (?, json(?), ?)"),
+			jen.Id("id"),
+			jen.Id("data"),
+			jen.Qual("time", "Now").Call().Dot("UTC").Call().Dot("Format").Call(jen.Lit(historyTimeFormat)),
+		),
+		jen.Return(jen.Err()),
+	)
+	f.Line()
+
+	// loadInstanceAsOf - the latest state saved at or before asOf. A stored
+	// older version is migrated in memory only; nothing is written back.
+	f.Comment("loadInstanceAsOf loads the state id had at asOf, an RFC 3339 timestamp")
+	f.Func().Id(g.fn("loadInstanceAsOf")).Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("id").String(),
+		jen.Id("asOf").String(),
+	).Parens(jen.List(jen.Op("*").Id(typeName), jen.Error())).Block(
+		jen.List(jen.Id("t"), jen.Err()).Op(":=").Qual("time", "Parse").Call(jen.Qual("time", "RFC3339Nano"), jen.Id("asOf")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("invalid as_of %q: want an RFC 3339 timestamp"), jen.Id("asOf"))),
+		),
+		jen.Var().Id("data").String(),
+		jen.Err().Op("=").Id("dbQueryRow").Call(
+			jen.Id("db"),
+			jen.Lit("SELECT data FROM instance_history WHERE id = ? AND saved_at <= ? ORDER BY saved_at DESC, rowid DESC LIMIT 1"),
+			jen.Id("id"),
+			jen.Id("t").Dot("UTC").Call().Dot("Format").Call(jen.Lit(historyTimeFormat)),
+		).Dot("Scan").Call(jen.Op("&").Id("data")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("no history for %s as of %s"), jen.Id("id"), jen.Id("asOf"))),
+		),
+		jen.Var().Id("instance").Id(typeName),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		g.pluginMigrate(jen.Id("data")),
+		jen.Id("instance").Dot("dirty").Op("=").False(),
+		jen.Return(jen.Op("&").Id("instance"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("dispatchAsOf dispatches against the state id had at asOf. Selectors that")
+	f.Comment("assign an instance variable, and delete, fail with ErrReadOnly.")
+	f.Func().Id(g.fn("dispatchAsOf")).Params(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+		jen.Id("id").String(),
+		jen.Id("selector").String(),
+		jen.Id("args").Index().String(),
+		jen.Id("asOf").String(),
+	).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.If(jen.Id("selector").Op("==").Lit("delete")).Block(
+			jen.Return(jen.Lit(""), jen.Id("ErrReadOnly")),
+		),
+		jen.List(jen.Id("instance"), jen.Err()).Op(":=").Id(g.fn("loadInstanceAsOf")).Call(jen.Id("db"), jen.Id("id"), jen.Id("asOf")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatch")).Call(jen.Id("instance"), jen.Id("id"), jen.Id("selector"), jen.Id("args")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.If(jen.Id("instance").Dot("dirty")).Block(
+			jen.Return(jen.Lit(""), jen.Id("ErrReadOnly")),
+		),
+		jen.Return(jen.Id("result"), jen.Nil()),
+	)
+	f.Line()
+}
+
+// recordSaved returns the statement that appends data, just saved for id, to
+// the history. Nothing is emitted without history.
+func (g *generator) recordSaved() jen.Code {
+	if !g.history {
+		return jen.Null()
+	}
+	return jen.If(jen.Err().Op(":=").Id("recordHistory").Call(jen.Id("db"), jen.Id("id"), jen.String().Parens(jen.Id("data"))), jen.Err().Op("!=").Nil()).Block(
+		jen.Return(jen.Err()),
+	)
+}
+
+// createRecordSaved returns the statement createInstance uses to add the
+// first state of a new instance to the history, once it is inserted.
+func (g *generator) createRecordSaved() jen.Code {
+	if !g.history {
+		return jen.Null()
+	}
+	return jen.If(jen.Err().Op("==").Nil()).Block(
+		jen.Err().Op("=").Id("recordHistory").Call(jen.Id("db"), jen.Id("id"), jen.String().Parens(jen.Id("data"))),
+	)
+}
+
+// historyFlag returns the statements main uses to honor a leading
+// --as-of=TIMESTAMP argument. Nothing is emitted without history.
+func (g *generator) historyFlag() jen.Code {
+	if !g.history {
+		return jen.Null()
+	}
+	return jen.Id("asOf").Op(":=").Lit("").Line().
+		If(jen.Len(jen.Qual("os", "Args")).Op(">").Lit(1).Op("&&").Qual("strings", "HasPrefix").Call(jen.Qual("os", "Args").Index(jen.Lit(1)), jen.Lit("--as-of="))).Block(
+		jen.Id("asOf").Op("=").Qual("strings", "TrimPrefix").Call(jen.Qual("os", "Args").Index(jen.Lit(1)), jen.Lit("--as-of=")),
+		jen.Qual("os", "Args").Op("=").Append(jen.Qual("os", "Args").Index(jen.Op(":").Lit(1)), jen.Qual("os", "Args").Index(jen.Lit(2).Op(":")).Op("...")),
+	).Line()
+}
+
+// mainAsOf returns the main statements that dispatch as of --as-of and exit.
+// Nothing is emitted without history.
+func (g *generator) mainAsOf() jen.Code {
+	if !g.history {
+		return jen.Null()
+	}
+	return jen.If(jen.Id("asOf").Op("!=").Lit("")).Block(
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error opening database: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Defer().Id("db").Dot("Close").Call(),
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatchAsOf")).Call(jen.Id("db"), jen.Id("receiver"), jen.Id("selector"), jen.Id("args"), jen.Id("asOf")),
+		jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+			jen.Qual("os", "Exit").Call(jen.Lit(200)),
+		),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			g.trashErrorExit(),
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.If(jen.Id("result").Op("!=").Lit("")).Block(
+			jen.Qual("fmt", "Println").Call(jen.Id("result")),
+		),
+		jen.Return(),
+	).Line()
+}
+
+// serveAsOf returns the handleServeRequest statements that answer a request
+// carrying as_of. Nothing is emitted without history.
+func (g *generator) serveAsOf() jen.Code {
+	if !g.history {
+		return jen.Null()
+	}
+	return jen.If(jen.Id("req").Dot("AsOf").Op("!=").Lit("")).Block(
+		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id(g.fn("dispatchAsOf")).Call(
+			jen.Id("db"),
+			jen.Id("req").Dot("InstanceID"),
+			jen.Id("req").Dot("Selector"),
+			jen.Id("req").Dot("Args"),
+			jen.Id("req").Dot("AsOf"),
+		),
+		jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
+			jen.Return(jen.Id("ServeResponse").Values(jen.Dict{jen.Id("ExitCode"): jen.Lit(200)})),
+		),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			g.trashErrorResponse(),
+			jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+				jen.Id("ExitCode"): jen.Lit(1),
+				jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+			})),
+		),
+		jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+			jen.Id("Result"):   jen.Id("result"),
+			jen.Id("ExitCode"): jen.Lit(0),
+		})),
+	).Line()
+}
+
+// historyRequestField is the as_of field of ServeRequest
+func (g *generator) historyRequestField() jen.Code {
+	if !g.history {
+		return jen.Null()
+	}
+	return jen.Id("AsOf").String().Tag(map[string]string{"json": "as_of,omitempty"})
+}
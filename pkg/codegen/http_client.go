@@ -0,0 +1,163 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the HttpClient class primitives. @ HttpClient get: url,
+// post:body:, put:body: and delete: compile to net/http requests, each
+// optionally followed by headers: (a JSON object) and timeout: (seconds),
+// and answer the response as a JSON object:
+//
+//	{"status": 200, "body": "..."}
+//
+// A request that fails before a response answers status 0 and "error".
+package codegen
+
+import (
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// httpTimeout is the request timeout in seconds when timeout: is not given
+const httpTimeout = 30
+
+// usesHttpClient reports whether a method of class sends to HttpClient, so
+// that the request helpers are only generated when needed
+func usesHttpClient(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenIdentifier && tok.Value == "HttpClient" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// httpRequestMethod returns the HTTP method of an HttpClient operation and
+// the operation's modifiers: httpPostHeaders -> POST, "Headers"
+func httpRequestMethod(op string) (method, modifiers string, ok bool) {
+	for _, m := range []string{"Get", "Post", "Put", "Delete"} {
+		if rest, found := strings.CutPrefix(op, "http"+m); found {
+			return strings.ToUpper(m), rest, true
+		}
+	}
+	return "", "", false
+}
+
+// httpClientSelector returns the Trashtalk selector of an HttpClient
+// operation: httpPostHeadersTimeout -> post:body:headers:timeout:
+func httpClientSelector(op string) (string, bool) {
+	method, modifiers, ok := httpRequestMethod(op)
+	if !ok {
+		return "", false
+	}
+	selector := strings.ToLower(method) + ":"
+	if method == "POST" || method == "PUT" {
+		selector += "body:"
+	}
+	if strings.HasPrefix(modifiers, "Headers") {
+		selector += "headers:"
+	}
+	if strings.HasSuffix(modifiers, "Timeout") {
+		selector += "timeout:"
+	}
+	return selector, true
+}
+
+// generateHttpClientPrimitive generates Go code for HttpClient class primitives
+func (g *generator) generateHttpClientPrimitive(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	method, modifiers, ok := httpRequestMethod(e.Operation)
+	if !ok {
+		return jen.Comment("unknown HttpClient primitive: " + e.Operation)
+	}
+	args := e.Args
+	arg := func() jen.Code {
+		if len(args) == 0 {
+			return jen.Lit("")
+		}
+		code := g.generateStringArg(args[0], m)
+		args = args[1:]
+		return code
+	}
+
+	url := arg()
+	body, headers, timeout := jen.Code(jen.Lit("")), jen.Code(jen.Lit("")), jen.Code(jen.Lit(""))
+	if method == "POST" || method == "PUT" {
+		body = arg()
+	}
+	if strings.HasPrefix(modifiers, "Headers") {
+		headers = arg()
+	}
+	if strings.HasSuffix(modifiers, "Timeout") {
+		timeout = arg()
+	}
+	return jen.Id("_httpRequest").Call(jen.Lit(method), url, body, headers, timeout)
+}
+
+// generateHttpClientHelpers generates _httpRequest and _httpResponse
+func (g *generator) generateHttpClientHelpers(f *jen.File) {
+	if !g.httpClient {
+		return
+	}
+	f.Comment("// HttpClient primitive helpers")
+	f.Line()
+
+	f.Comment("// _httpRequest sends an HTTP request and answers the response as a JSON object")
+	f.Comment("// of status and body. headers is a JSON object of header values, timeout the")
+	f.Comment("// timeout in seconds.")
+	f.Func().Id("_httpRequest").Params(
+		jen.List(jen.Id("method"), jen.Id("url"), jen.Id("body"), jen.Id("headers"), jen.Id("timeout")).String(),
+	).String().Block(
+		jen.Id("seconds").Op(":=").Float64().Call(jen.Lit(httpTimeout)),
+		jen.If(jen.List(jen.Id("t"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("timeout"), jen.Lit(64)), jen.Err().Op("==").Nil().Op("&&").Id("t").Op(">").Lit(0)).Block(
+			jen.Id("seconds").Op("=").Id("t"),
+		),
+		jen.Var().Id("reader").Qual("io", "Reader"),
+		jen.If(jen.Id("body").Op("!=").Lit("")).Block(
+			jen.Id("reader").Op("=").Qual("strings", "NewReader").Call(jen.Id("body")),
+		),
+		jen.List(jen.Id("req"), jen.Err()).Op(":=").Qual("net/http", "NewRequest").Call(jen.Id("method"), jen.Id("url"), jen.Id("reader")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("_httpResponse").Call(jen.Lit(0), jen.Lit(""), jen.Err())),
+		),
+		jen.If(jen.Id("headers").Op("!=").Lit("")).Block(
+			jen.Var().Id("values").Map(jen.String()).Interface(),
+			jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("headers")), jen.Op("&").Id("values")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Id("_httpResponse").Call(jen.Lit(0), jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("invalid headers: %v"), jen.Err()))),
+			),
+			jen.For(jen.List(jen.Id("name"), jen.Id("value")).Op(":=").Range().Id("values")).Block(
+				jen.Id("req").Dot("Header").Dot("Set").Call(jen.Id("name"), jen.Qual("fmt", "Sprint").Call(jen.Id("value"))),
+			),
+		),
+		jen.Id("client").Op(":=").Op("&").Qual("net/http", "Client").Values(jen.Dict{
+			jen.Id("Timeout"): jen.Qual("time", "Duration").Call(jen.Id("seconds").Op("*").Float64().Call(jen.Qual("time", "Second"))),
+		}),
+		jen.List(jen.Id("resp"), jen.Err()).Op(":=").Id("client").Dot("Do").Call(jen.Id("req")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("_httpResponse").Call(jen.Lit(0), jen.Lit(""), jen.Err())),
+		),
+		jen.Defer().Id("resp").Dot("Body").Dot("Close").Call(),
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("io", "ReadAll").Call(jen.Id("resp").Dot("Body")),
+		jen.Return(jen.Id("_httpResponse").Call(jen.Id("resp").Dot("StatusCode"), jen.String().Parens(jen.Id("data")), jen.Err())),
+	)
+	f.Line()
+
+	f.Comment("// _httpResponse answers the JSON object of an HttpClient request, with the")
+	f.Comment("// error if there was one")
+	f.Func().Id("_httpResponse").Params(
+		jen.Id("status").Int(),
+		jen.Id("body").String(),
+		jen.Err().Error(),
+	).String().Block(
+		jen.Id("response").Op(":=").Map(jen.String()).Interface().Values(jen.Dict{
+			jen.Lit("status"): jen.Id("status"),
+			jen.Lit("body"):   jen.Id("body"),
+		}),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("response").Index(jen.Lit("error")).Op("=").Err().Dot("Error").Call(),
+		),
+		jen.List(jen.Id("out"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("response")),
+		jen.Return(jen.String().Parens(jen.Id("out"))),
+	)
+	f.Line()
+}
@@ -0,0 +1,120 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the expression indexes a class declares with index:
+// field. ensureIndexes creates them on the instances table before the binary
+// dispatches, so the Environment queries on those fields stop scanning every
+// instance as the database grows.
+package codegen
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/dave/jennifer/jen"
+)
+
+// jsonFieldPattern matches a field path: name, address.city, tags[0]. The
+// generated _jsonField is the same pattern.
+var jsonFieldPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*|\[[0-9]+\])*$`)
+
+// indexNameUnsafe matches the characters of a field path an index name replaces
+var indexNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// indexName returns the name of the index on field, a path without $.
+// The generated _indexName answers the same name.
+func indexName(field string) string {
+	return "idx_instances_" + indexNameUnsafe.ReplaceAllString(field, "_")
+}
+
+// indexStatement returns the CREATE INDEX statement for field. Its
+// expression is the one the Environment queries write for the field.
+func indexStatement(field string) string {
+	return fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON instances(json_extract(data, '$.%s'))", indexName(field), field)
+}
+
+// setIndexes records the fields the class declares with index:. Indexes
+// live on the instances table, so they need the SQLite helpers.
+func (g *generator) setIndexes() {
+	if len(g.class.Indexes) == 0 {
+		return
+	}
+	if g.useStorage() {
+		g.ignoreIndexes()
+		return
+	}
+	seen := map[string]bool{}
+	for _, field := range g.class.Indexes {
+		field = strings.TrimPrefix(field, "$.")
+		if !jsonFieldPattern.MatchString(field) {
+			g.warnings = append(g.warnings, fmt.Sprintf("index: %q is not a field path; index ignored", field))
+			continue
+		}
+		if !seen[field] {
+			seen[field] = true
+			g.indexes = append(g.indexes, field)
+		}
+	}
+}
+
+// ignoreIndexes warns that the class's index: declarations are not
+// compiled, in modes whose instances are not stored by the SQLite helpers
+func (g *generator) ignoreIndexes() {
+	if len(g.class.Indexes) > 0 {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("indexes need the SQLite helpers; index: ignored for %s", g.class.Name))
+	}
+}
+
+// generateEnsureIndexes generates ensureIndexes. Nothing is emitted unless
+// the class declares an index.
+func (g *generator) generateEnsureIndexes(f *jen.File) {
+	if len(g.indexes) == 0 {
+		return
+	}
+	stmts := []jen.Code{}
+	for _, field := range g.indexes {
+		stmts = append(stmts, jen.Lit(indexStatement(field)))
+	}
+
+	f.Comment("ensureIndexes creates the indexes the class declares on the instances")
+	f.Comment("table. It does nothing until the table exists.")
+	f.Func().Id("ensureIndexes").Params(jen.Id("db").Op("*").Qual("database/sql", "DB")).Error().Block(
+		jen.Var().Id("exists").Int(),
+		jen.Err().Op(":=").Id("db").Dot("QueryRow").Call(
+			jen.Lit("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'instances'"),
+		).Dot("Scan").Call(jen.Op("&").Id("exists")),
+		jen.If(jen.Err().Op("!=").Nil().Op("||").Id("exists").Op("==").Lit(0)).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.For(jen.List(jen.Id("_"), jen.Id("stmt")).Op(":=").Range().Index().String().Values(stmts...)).Block(
+			jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("db").Dot("Exec").Call(jen.Id("stmt")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Err()),
+			),
+		),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+}
+
+// ensureIndexesOn returns the statement that runs ensureIndexes on db,
+// warning if it fails: a missing index only makes queries slower. Nothing is
+// emitted unless the class declares an index.
+func (g *generator) ensureIndexesOn(db jen.Code) jen.Code {
+	if len(g.indexes) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.Err().Op(":=").Id("ensureIndexes").Call(db), jen.Err().Op("!=").Nil()).Block(
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Warning: creating indexes: %v\n"), jen.Err()),
+	)
+}
+
+// mainEnsureIndexes returns the step main runs before a single dispatch
+func (g *generator) mainEnsureIndexes() jen.Code {
+	if len(g.indexes) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(), jen.Err().Op("==").Nil()).Block(
+		g.ensureIndexesOn(jen.Id("db")),
+		jen.Id("db").Dot("Close").Call(),
+	)
+}
@@ -0,0 +1,226 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains inherited dispatch: an instance selector the class does
+// not compile is forwarded to the compiled binary of its parent class, which
+// answers it through --serve, before the send falls back to Bash. The parent
+// forwards what it cannot answer to its own parent, so the whole compiled
+// chain is tried. TRASHTALK_FORWARD_CHAIN lists the classes a request has
+// passed through, and a class already in it is not asked again. The
+// instance variables a subclass inherits are kept through a load and save
+// although the subclass does not declare them.
+package codegen
+
+import (
+	"strings"
+
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/dave/jennifer/jen"
+)
+
+// forwardChainEnv names the environment variable listing, comma-separated,
+// the compiled classes a forwarded request has passed through
+const forwardChainEnv = "TRASHTALK_FORWARD_CHAIN"
+
+// inherits reports whether the class has a parent other than Object, whose
+// instance variables its instances also hold
+func (g *generator) inherits() bool {
+	return g.class.Parent != "" && g.class.Parent != "Object"
+}
+
+// inheritedField returns the struct field holding the instance variables
+// the class does not declare
+func inheritedField() jen.Code {
+	return jen.Id("inherited").Map(jen.String()).Qual("encoding/json", "RawMessage").Tag(map[string]string{"json": "-"})
+}
+
+// generateInheritedJSON generates MarshalJSON and UnmarshalJSON for a
+// subclass, so instance variables it does not declare are decoded into
+// inherited and encoded again. Nothing is emitted for classes of Object.
+func (g *generator) generateInheritedJSON(f *jen.File) {
+	if !g.inherits() {
+		return
+	}
+	typeName := g.typeName()
+	f.Line()
+
+	f.Comment("UnmarshalJSON decodes the declared fields and keeps the others, such as")
+	f.Comment("the instance variables of the parent classes, in inherited")
+	f.Func().Params(jen.Id("c").Op("*").Id(typeName)).Id("UnmarshalJSON").Params(jen.Id("data").Index().Byte()).Error().Block(
+		jen.Type().Id("plain").Id(typeName),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Id("data"), jen.Parens(jen.Op("*").Id("plain")).Parens(jen.Id("c"))), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Var().Id("all").Map(jen.String()).Qual("encoding/json", "RawMessage"),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Id("data"), jen.Op("&").Id("all")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.List(jen.Id("own"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Parens(jen.Op("*").Id("plain")).Parens(jen.Id("c"))),
+		jen.Var().Id("declared").Map(jen.String()).Qual("encoding/json", "RawMessage"),
+		jen.Qual("encoding/json", "Unmarshal").Call(jen.Id("own"), jen.Op("&").Id("declared")),
+		jen.For(jen.List(jen.Id("k"), jen.Id("v")).Op(":=").Range().Id("all")).Block(
+			jen.If(jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Id("declared").Index(jen.Id("k")), jen.Id("ok")).Block(
+				jen.Continue(),
+			),
+			jen.If(jen.Id("c").Dot("inherited").Op("==").Nil()).Block(
+				jen.Id("c").Dot("inherited").Op("=").Make(jen.Map(jen.String()).Qual("encoding/json", "RawMessage")),
+			),
+			jen.Id("c").Dot("inherited").Index(jen.Id("k")).Op("=").Id("v"),
+		),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("MarshalJSON encodes the declared fields and the inherited ones")
+	f.Func().Params(jen.Id("c").Id(typeName)).Id("MarshalJSON").Params().Parens(jen.List(jen.Index().Byte(), jen.Error())).Block(
+		jen.Type().Id("plain").Id(typeName),
+		jen.List(jen.Id("own"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("plain").Parens(jen.Id("c"))),
+		jen.If(jen.Err().Op("!=").Nil().Op("||").Len(jen.Id("c").Dot("inherited")).Op("==").Lit(0)).Block(
+			jen.Return(jen.Id("own"), jen.Err()),
+		),
+		jen.Id("all").Op(":=").Make(jen.Map(jen.String()).Qual("encoding/json", "RawMessage"), jen.Len(jen.Id("c").Dot("inherited"))),
+		jen.For(jen.List(jen.Id("k"), jen.Id("v")).Op(":=").Range().Id("c").Dot("inherited")).Block(
+			jen.Id("all").Index(jen.Id("k")).Op("=").Id("v"),
+		),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Id("own"), jen.Op("&").Id("all")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.Return(jen.Qual("encoding/json", "Marshal").Call(jen.Id("all"))),
+	)
+}
+
+// parentClasses returns the compiled names the parent class may have, in
+// the order they are tried: a bare parent of a namespaced class is looked
+// for in the class's package, then its imports, then among non-namespaced
+// classes. With Options.Classes only the listed classes are candidates.
+// Classes deriving from Object, bundles and WASM modules have none.
+func (g *generator) parentClasses() []string {
+	parent := g.class.Parent
+	if !g.inherits() || g.prefix != "" || g.wasm {
+		return nil
+	}
+
+	candidates := []string{parent}
+	if !strings.Contains(parent, "::") {
+		candidates = nil
+		if g.class.Package != "" {
+			candidates = append(candidates, g.class.Package+"::"+parent)
+		}
+		for _, imp := range g.class.Imports {
+			if imp != g.class.Package {
+				candidates = append(candidates, imp+"::"+parent)
+			}
+		}
+		candidates = append(candidates, parent)
+	}
+
+	var names []string
+	for _, c := range candidates {
+		if g.knownClasses == nil || g.knownClasses[c] {
+			names = append(names, mangle.CompiledClass(c))
+		}
+	}
+	return names
+}
+
+// generateForwardToParent generates forwardToParent, which sends an
+// instance request to the first parent binary installed next to this one
+func (g *generator) generateForwardToParent(f *jen.File) {
+	parents := g.parentClasses()
+	if len(parents) == 0 {
+		return
+	}
+	typeName := g.typeName()
+
+	values := make([]jen.Code, len(parents))
+	for i, p := range parents {
+		values[i] = jen.Lit(p)
+	}
+	f.Comment("parentClasses are the compiled names the parent class may have, tried in order")
+	f.Var().Id("parentClasses").Op("=").Index().String().Values(values...)
+	f.Line()
+
+	f.Comment("forwardToParent answers a selector this class does not compile with the")
+	f.Comment("parent's binary. The instance takes the instance variables the parent")
+	f.Comment("returns and keeps its own. ok is false when no parent binary is installed,")
+	f.Comment("the parent is already in " + forwardChainEnv + ", or it answers 200.")
+	f.Func().Id("forwardToParent").Params(
+		jen.Id("instance").Op("*").Id(typeName),
+		jen.List(jen.Id("id"), jen.Id("selector")).String(),
+		jen.Id("args").Index().String(),
+	).Parens(jen.List(jen.Id("resp").Id("ServeResponse"), jen.Id("ok").Bool())).Block(
+		jen.List(jen.Id("exe"), jen.Err()).Op(":=").Qual("os", "Executable").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(jen.Return()),
+		jen.Id("chain").Op(":=").Qual("os", "Getenv").Call(jen.Lit(forwardChainEnv)),
+		jen.Id("visited").Op(":=").Qual("strings", "Split").Call(jen.Id("chain"), jen.Lit(",")),
+		jen.For(jen.List(jen.Id("_"), jen.Id("parent")).Op(":=").Range().Id("parentClasses")).Block(
+			jen.For(jen.List(jen.Id("_"), jen.Id("v")).Op(":=").Range().Id("visited")).Block(
+				jen.If(jen.Id("v").Op("==").Id("parent")).Block(jen.Return()),
+			),
+			jen.Id("path").Op(":=").Qual("path/filepath", "Join").Call(jen.Qual("path/filepath", "Dir").Call(jen.Id("exe")), jen.Id("parent").Op("+").Lit(".native")),
+			jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Qual("os", "Stat").Call(jen.Id("path")), jen.Err().Op("!=").Nil()).Block(
+				jen.Continue(),
+			),
+			jen.Line(),
+			jen.List(jen.Id("data"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("instance")),
+			jen.List(jen.Id("line"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("ServeRequest").Values(jen.Dict{
+				jen.Id("InstanceID"): jen.Id("id"),
+				jen.Id("Instance"):   jen.String().Parens(jen.Id("data")),
+				jen.Id("Selector"):   jen.Id("selector"),
+				jen.Id("Args"):       jen.Id("args"),
+			})),
+			g.suspendWork(),
+			jen.Id("cmd").Op(":=").Qual("os/exec", "Command").Call(jen.Id("path"), jen.Lit("--serve")),
+			jen.Id("cmd").Dot("Env").Op("=").Append(
+				jen.Qual("os", "Environ").Call(),
+				jen.Lit(forwardChainEnv+"=").Op("+").Qual("strings", "TrimPrefix").Call(jen.Id("chain").Op("+").Lit(","+g.class.CompiledName()), jen.Lit(",")),
+			),
+			jen.Id("cmd").Dot("Stdin").Op("=").Qual("bytes", "NewReader").Call(jen.Append(jen.Id("line"), jen.LitByte('\n'))),
+			jen.Id("cmd").Dot("Stderr").Op("=").Qual("os", "Stderr"),
+			jen.List(jen.Id("out"), jen.Err()).Op(":=").Id("cmd").Dot("Output").Call(),
+			jen.If(jen.Err().Op("!=").Nil().Op("||").Qual("encoding/json", "Unmarshal").Call(jen.Id("out"), jen.Op("&").Id("resp")).Op("!=").Nil().Op("||").Id("resp").Dot("ExitCode").Op("==").Lit(200)).Block(
+				jen.Return(jen.Id("ServeResponse").Values(), jen.False()),
+			),
+			jen.If(jen.Id("resp").Dot("ExitCode").Op("==").Lit(0).Op("&&").Id("resp").Dot("Instance").Op("!=").Lit("")).Block(
+				jen.Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("resp").Dot("Instance")), jen.Id("instance")),
+				jen.If(jen.List(jen.Id("updated"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("instance")), jen.String().Parens(jen.Id("updated")).Op("!=").String().Parens(jen.Id("data"))).Block(
+					jen.Id("instance").Dot("dirty").Op("=").True(),
+				),
+			),
+			jen.Return(jen.Id("resp"), jen.True()),
+		),
+		jen.Return(),
+	)
+	f.Line()
+}
+
+// forwardUnknown returns the statements that answer an unknown instance
+// selector in err with the parent's binary, setting result and err as if the
+// class had compiled it. The fail statements end the request when the parent
+// answers resp with an error. Nothing is emitted for classes
+// without a compiled parent.
+func (g *generator) forwardUnknown(instance, id, selector, args, fail jen.Code) jen.Code {
+	if len(g.parentClasses()) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector")).Op("&&").Add(selector).Op("!=").Lit("delete")).Block(
+		jen.If(jen.List(jen.Id("resp"), jen.Id("ok")).Op(":=").Id("forwardToParent").Call(instance, id, selector, args), jen.Id("ok")).Block(
+			jen.If(jen.Id("resp").Dot("ExitCode").Op("!=").Lit(0)).Block(fail),
+			jen.List(jen.Id("result"), jen.Err()).Op("=").List(jen.Id("resp").Dot("Result"), jen.Nil()),
+		),
+	)
+}
+
+// mainForwardUnknown is forwardUnknown for main, which reports a failing
+// parent on stderr and exits with its code
+func (g *generator) mainForwardUnknown() jen.Code {
+	return g.forwardUnknown(jen.Id("instance"), jen.Id("receiver"), jen.Id("selector"), jen.Id("args"),
+		jen.Add(g.mainEndWork(false)).Line().
+			Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %s\n"), jen.Id("resp").Dot("Error")).Line().
+			Qual("os", "Exit").Call(jen.Id("resp").Dot("ExitCode")))
+}
+
+// serveForwardUnknown is forwardUnknown for handleServeRequest, which
+// answers a failing parent's response as it is
+func (g *generator) serveForwardUnknown() jen.Code {
+	req := func(field string) *jen.Statement { return jen.Id("req").Dot(field) }
+	return g.forwardUnknown(jen.Op("&").Id("instance"), req("InstanceID"), req("Selector"), req("Args"), jen.Return(jen.Id("resp")))
+}
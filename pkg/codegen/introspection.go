@@ -0,0 +1,111 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the introspection selectors dispatch and dispatchClass
+// answer: respondsTo: and selectors. Both are built from the dispatch cases
+// and the methods left to Bash, so they are fixed when the class compiles.
+package codegen
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dave/jennifer/jen"
+
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// bashMarker follows a selector in the selectors answer when the method is
+// left to Bash
+const bashMarker = " (bash)"
+
+// introspectionCases returns the respondsTo: and selectors cases for the
+// dispatch function answering cases, leaving out any the class defines.
+//
+// selectors answers the Trashtalk selectors one per line: those dispatch
+// answers natively, then the methods of the same side left to Bash, marked
+// " (bash)". respondsTo: answers true for either kind. Any other selector
+// may still be inherited or answered by Object, so respondsTo: leaves it to
+// Bash rather than answering false.
+func (g *generator) introspectionCases(cases []dispatchCase, class bool) []dispatchCase {
+	taken := make(map[string]bool)
+	for _, c := range cases {
+		taken[c.selector] = true
+	}
+	for _, m := range g.class.Methods {
+		if (m.Kind == "class") == class {
+			taken[m.Selector] = true
+		}
+	}
+
+	var added []dispatchCase
+	for _, sel := range []string{"respondsTo_", "selectors"} {
+		if !taken[sel] {
+			added = append(added, dispatchCase{selector: sel})
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	native := g.dispatchSelectors(append(append([]dispatchCase{}, cases...), added...))
+	answered := make(map[string]bool, len(native))
+	for _, sel := range native {
+		answered[sel] = true
+	}
+	var fallback []string
+	for _, sel := range g.fallbackSelectors(class) {
+		if !answered[sel] {
+			fallback = append(fallback, sel)
+		}
+	}
+
+	var lines []string
+	for _, sel := range native {
+		lines = append(lines, mangle.TrashSelector(sel))
+	}
+	for _, sel := range fallback {
+		lines = append(lines, mangle.TrashSelector(sel)+bashMarker)
+	}
+
+	for i := range added {
+		switch added[i].selector {
+		case "respondsTo_":
+			var labels []jen.Code
+			for _, sel := range append(native, fallback...) {
+				labels = append(labels, jen.Lit(sel))
+			}
+			added[i].body = []jen.Code{
+				jen.If(jen.Len(jen.Id("args")).Op("<").Lit(1)).Block(
+					jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("respondsTo_ requires 1 argument"))),
+				),
+				jen.Switch(jen.Qual("strings", "ReplaceAll").Call(jen.Id("args").Index(jen.Lit(0)), jen.Lit(":"), jen.Lit("_"))).Block(
+					jen.Case(labels...).Block(jen.Return(jen.Lit("true"), jen.Nil())),
+				),
+				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrUnknownSelector"), jen.Lit("respondsTo_"))),
+			}
+		case "selectors":
+			added[i].body = []jen.Code{jen.Return(jen.Lit(strings.Join(lines, "\n")), jen.Nil())}
+		}
+	}
+	return added
+}
+
+// fallbackSelectors returns the sorted selectors of the class or instance
+// methods left to Bash
+func (g *generator) fallbackSelectors(class bool) []string {
+	side := make(map[string]bool)
+	for _, m := range g.class.Methods {
+		if (m.Kind == "class") == class {
+			side[m.Selector] = true
+		}
+	}
+	seen := make(map[string]bool)
+	var selectors []string
+	for _, s := range g.skipped {
+		if side[s.Selector] && !seen[s.Selector] {
+			seen[s.Selector] = true
+			selectors = append(selectors, s.Selector)
+		}
+	}
+	sort.Strings(selectors)
+	return selectors
+}
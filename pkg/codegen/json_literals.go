@@ -0,0 +1,230 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the compile-time checks of JSON literals and the
+// constants they become. An instance variable default, or a string literal
+// a method uses as a JSON array or object, must parse as one: at runtime
+// the helpers would answer an empty array or object instead, and a
+// json.RawMessage field would fail to save. Constant arrays and objects
+// for <array> and <object> instance variables are decoded once, into
+// package-level variables, and each instance or assignment gets a copy
+// instead of decoding the text again.
+package codegen
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// jsonLiteralProblem returns what is wrong with s as a JSON value of kind
+// (array, object, or "" for any), or "" if nothing is
+func jsonLiteralProblem(s, kind string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return "invalid JSON: " + strings.TrimPrefix(err.Error(), "json: ")
+	}
+	var got string
+	switch v.(type) {
+	case []interface{}:
+		got = "array"
+	case map[string]interface{}:
+		got = "object"
+	default:
+		got = "scalar"
+	}
+	if kind != "" && got != kind {
+		return fmt.Sprintf("JSON %s where an %s is expected", got, kind)
+	}
+	return ""
+}
+
+// checkJSONDefaults reports the defaults of <array> and <object> instance
+// variables, and the JSON defaults of untyped ones, that do not parse
+func (g *generator) checkJSONDefaults() {
+	for _, iv := range g.class.InstanceVars {
+		val := iv.Default.Value
+		var problem string
+		switch typ := g.ivarTypes[iv.Name]; {
+		case typ == "array" || typ == "object":
+			if val != "" {
+				problem = jsonLiteralProblem(val, typ)
+			}
+		case typ == "" && g.jsonVars[iv.Name]:
+			problem = jsonLiteralProblem(val, "")
+		}
+		if problem != "" {
+			g.errors = append(g.errors, CompileError{
+				Message:  fmt.Sprintf("default of instance variable %s: %s", iv.Name, problem),
+				Location: iv.Location,
+			})
+		}
+	}
+}
+
+// constantString returns the string expr is when it is a string literal or
+// a concatenation of literals
+func constantString(expr parser.Expr) (string, bool) {
+	if lit, ok := foldConstant(expr).(*parser.StringLit); ok {
+		return lit.Value, true
+	}
+	return "", false
+}
+
+// checkJSONLiteral reports expr, used in m as a JSON value of kind (array,
+// object, or "" for any), if it is a constant that does not parse as one.
+// It reports whether expr is a constant of that kind.
+func (g *generator) checkJSONLiteral(expr parser.Expr, kind string, m *compiledMethod) bool {
+	s, ok := constantString(expr)
+	if !ok {
+		return false
+	}
+	problem := jsonLiteralProblem(s, kind)
+	if problem == "" {
+		return true
+	}
+	e := CompileError{
+		Message:  fmt.Sprintf("%s: %s in %s", mangle.TrashSelector(m.selector), problem, strconv.Quote(s)),
+		Location: g.literalLocation(m, s),
+	}
+	for _, seen := range g.errors {
+		if seen == e {
+			return false
+		}
+	}
+	g.errors = append(g.errors, e)
+	return false
+}
+
+// jsonPrimitiveKind returns the kind of JSON value the receiver of a JSON
+// primitive operation must be: array, object, or "" for any
+func jsonPrimitiveKind(op string) string {
+	switch {
+	case strings.HasPrefix(op, "array"):
+		return "array"
+	case strings.HasPrefix(op, "object"):
+		return "object"
+	}
+	return ""
+}
+
+// checkJSONPrimitiveLiterals reports the constant receiver and object
+// arguments of e that do not parse as the JSON they are used as
+func (g *generator) checkJSONPrimitiveLiterals(e *parser.JSONPrimitiveExpr, m *compiledMethod) {
+	g.checkJSONLiteral(e.Receiver, jsonPrimitiveKind(e.Operation), m)
+	switch e.Operation {
+	case "objectMerge", "objectDeepMerge", "objectEquals":
+		for _, arg := range e.Args {
+			g.checkJSONLiteral(arg, "object", m)
+		}
+	}
+}
+
+// literalLocation returns the position of the string literal s in the body
+// of m, or of the method definition if s is not written out whole there
+func (g *generator) literalLocation(m *compiledMethod, s string) ast.Location {
+	for _, method := range g.class.Methods {
+		if method.Selector != m.selector || (method.Kind == "class") != m.isClass {
+			continue
+		}
+		for _, tok := range method.Body.Tokens {
+			if !strings.Contains(tok.Type, "STRING") {
+				continue
+			}
+			value := tok.Value
+			if n := len(value); n >= 2 && (value[0] == '\'' || value[0] == '"') && value[n-1] == value[0] {
+				value = value[1 : n-1]
+			}
+			if value == s {
+				return ast.Location{Line: tok.Line, Col: tok.Col}
+			}
+		}
+		return method.Location
+	}
+	return ast.Location{Line: m.line}
+}
+
+// jsonConst returns a copy of the decoded constant JSON array or object s,
+// for an <array> or <object> instance variable of type typ, declaring the
+// package-level variable holding it the first time s is seen
+func (g *generator) jsonConst(s, typ string) *jen.Statement {
+	index := -1
+	for i, seen := range g.jsonConsts {
+		if seen == s {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		index = len(g.jsonConsts)
+		g.jsonConsts = append(g.jsonConsts, s)
+	}
+	copied := jen.Id("_jsonCopy").Call(jen.Id(g.jsonConstName(index)))
+	if typ == "array" {
+		return copied.Assert(jen.Index().Interface())
+	}
+	return copied.Assert(jen.Map(jen.String()).Interface())
+}
+
+// jsonConstName is the package-level variable of constant JSON value i
+func (g *generator) jsonConstName(i int) string {
+	return g.fn("_jsonConst" + strconv.Itoa(i))
+}
+
+// generateJSONConsts generates the constant JSON values and _jsonCopy
+func (g *generator) generateJSONConsts(f *jen.File) {
+	if len(g.jsonConsts) == 0 {
+		return
+	}
+	g.generateJSONConstVars(f)
+	generateJSONCopyHelper(f)
+}
+
+// generateJSONConstVars declares the constant JSON values, decoded at init
+func (g *generator) generateJSONConstVars(f *jen.File) {
+	if len(g.jsonConsts) == 0 {
+		return
+	}
+	var defs []jen.Code
+	for i, s := range g.jsonConsts {
+		decode := "_jsonObject"
+		if strings.HasPrefix(strings.TrimSpace(s), "[") {
+			decode = "_jsonArray"
+		}
+		defs = append(defs, jen.Id(g.jsonConstName(i)).Op("=").Id(decode).Call(jen.Lit(s)))
+	}
+	f.Comment("// Constant JSON arrays and objects, decoded once and copied by each use")
+	f.Var().Defs(defs...)
+	f.Line()
+}
+
+// generateJSONCopyHelper generates _jsonCopy, the deep copy that keeps a
+// constant JSON value from being changed through the instance it was
+// given to
+func generateJSONCopyHelper(f *jen.File) {
+	f.Comment("// _jsonCopy returns a deep copy of a decoded JSON value")
+	f.Func().Id("_jsonCopy").Params(jen.Id("v").Interface()).Interface().Block(
+		jen.Switch(jen.Id("x").Op(":=").Id("v").Assert(jen.Type())).Block(
+			jen.Case(jen.Index().Interface()).Block(
+				jen.Id("out").Op(":=").Make(jen.Index().Interface(), jen.Len(jen.Id("x"))),
+				jen.For(jen.List(jen.Id("i"), jen.Id("e")).Op(":=").Range().Id("x")).Block(
+					jen.Id("out").Index(jen.Id("i")).Op("=").Id("_jsonCopy").Call(jen.Id("e")),
+				),
+				jen.Return(jen.Id("out")),
+			),
+			jen.Case(jen.Map(jen.String()).Interface()).Block(
+				jen.Id("out").Op(":=").Make(jen.Map(jen.String()).Interface(), jen.Len(jen.Id("x"))),
+				jen.For(jen.List(jen.Id("k"), jen.Id("e")).Op(":=").Range().Id("x")).Block(
+					jen.Id("out").Index(jen.Id("k")).Op("=").Id("_jsonCopy").Call(jen.Id("e")),
+				),
+				jen.Return(jen.Id("out")),
+			),
+		),
+		jen.Return(jen.Id("v")),
+	)
+	f.Line()
+}
@@ -0,0 +1,232 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the JSON path primitives, which reach into nested
+// objects and arrays in one step instead of a chain of objectAt: sends that
+// re-parse each intermediate value:
+//
+//	city := data jsonAtPath: 'user.addresses[0].city'
+//	data := data jsonSetPath: 'user.addresses[0].city' put: 'Paris'
+//
+// A path is keys separated by dots, each followed by any number of [index]
+// steps; the empty path is the value itself. jsonAtPath: answers "" for a
+// path that is not there and nested objects and arrays as JSON text.
+// jsonSetPath:put: creates missing objects and arrays along the path and
+// answers a copy of the receiver, or the receiver unchanged if the path
+// goes through a value that is neither.
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/dave/jennifer/jen"
+)
+
+// usesJSONPaths reports whether a method of class sends a JSON path
+// primitive, so that the path helpers are only generated when needed
+func usesJSONPaths(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenKeyword && (tok.Value == "jsonAtPath:" || tok.Value == "jsonSetPath:") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateJSONPathHelpers generates the JSON path helpers: _jsonAtPath,
+// _jsonSetPath, _mapSetPath and _arraySetPath, and the path walking they
+// share
+func (g *generator) generateJSONPathHelpers(f *jen.File) {
+	if !g.jsonPaths {
+		return
+	}
+	ifaces := jen.Index().Interface()
+	object := jen.Map(jen.String()).Interface()
+	fail := jen.Return(jen.Nil(), jen.False())
+
+	f.Comment("// JSON path primitive helpers")
+	f.Line()
+
+	f.Comment("// _jsonPathSteps splits a path like user.addresses[0].city into its steps:")
+	f.Comment("// string keys and int indexes")
+	f.Func().Id("_jsonPathSteps").Params(jen.Id("path").String()).Parens(jen.List(ifaces.Clone(), jen.Bool())).Block(
+		jen.If(jen.Id("path").Op("==").Lit("")).Block(
+			jen.Return(jen.Nil(), jen.True()),
+		),
+		jen.Var().Id("steps").Index().Interface(),
+		jen.For(jen.List(jen.Id("_"), jen.Id("part")).Op(":=").Range().Qual("strings", "Split").Call(jen.Id("path"), jen.Lit("."))).Block(
+			jen.List(jen.Id("key"), jen.Id("rest")).Op(":=").List(jen.Id("part"), jen.Lit("")),
+			jen.If(jen.Id("i").Op(":=").Qual("strings", "IndexByte").Call(jen.Id("part"), jen.LitByte('[')), jen.Id("i").Op(">=").Lit(0)).Block(
+				jen.List(jen.Id("key"), jen.Id("rest")).Op("=").List(jen.Id("part").Index(jen.Op(":").Id("i")), jen.Id("part").Index(jen.Id("i").Op(":"))),
+			),
+			jen.If(jen.Id("key").Op("!=").Lit("")).Block(
+				jen.Id("steps").Op("=").Append(jen.Id("steps"), jen.Id("key")),
+			).Else().If(jen.Id("rest").Op("==").Lit("")).Block(
+				fail,
+			),
+			jen.For(jen.Id("rest").Op("!=").Lit("")).Block(
+				jen.Id("end").Op(":=").Qual("strings", "IndexByte").Call(jen.Id("rest"), jen.LitByte(']')),
+				jen.If(jen.Id("rest").Index(jen.Lit(0)).Op("!=").LitByte('[').Op("||").Id("end").Op("<").Lit(0)).Block(
+					fail,
+				),
+				jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("rest").Index(jen.Lit(1).Op(":").Id("end"))),
+				jen.If(jen.Err().Op("!=").Nil().Op("||").Id("n").Op("<").Lit(0)).Block(
+					fail,
+				),
+				jen.Id("steps").Op("=").Append(jen.Id("steps"), jen.Id("n")),
+				jen.Id("rest").Op("=").Id("rest").Index(jen.Id("end").Op("+").Lit(1).Op(":")),
+			),
+		),
+		jen.Return(jen.Id("steps"), jen.True()),
+	)
+	f.Line()
+
+	f.Comment("// _jsonPathRoot returns v as decoded JSON: native maps and slices as they are,")
+	f.Comment("// JSON text decoded, and nil for anything else")
+	f.Func().Id("_jsonPathRoot").Params(jen.Id("v").Interface()).Interface().Block(
+		jen.Var().Id("data").Index().Byte(),
+		jen.Switch(jen.Id("x").Op(":=").Id("v").Assert(jen.Type())).Block(
+			jen.Case(object.Clone(), ifaces.Clone()).Block(
+				jen.Return(jen.Id("x")),
+			),
+			jen.Case(jen.Qual("encoding/json", "RawMessage")).Block(
+				jen.Id("data").Op("=").Id("x"),
+			),
+			jen.Case(jen.String()).Block(
+				jen.Id("data").Op("=").Index().Byte().Parens(jen.Id("x")),
+			),
+			jen.Default().Block(
+				jen.Return(jen.Nil()),
+			),
+		),
+		jen.Var().Id("root").Interface(),
+		jen.If(jen.Id("_jsonDecode").Call(jen.Id("data"), jen.Op("&").Id("root")).Op("!=").Nil()).Block(
+			jen.Return(jen.Nil()),
+		),
+		jen.Return(jen.Id("root")),
+	)
+	f.Line()
+
+	f.Comment("// _jsonPathGet returns the value at steps in node")
+	f.Func().Id("_jsonPathGet").Params(jen.Id("node").Interface(), jen.Id("steps").Index().Interface()).Parens(jen.List(jen.Interface(), jen.Bool())).Block(
+		jen.For(jen.List(jen.Id("_"), jen.Id("step")).Op(":=").Range().Id("steps")).Block(
+			jen.Switch(jen.Id("s").Op(":=").Id("step").Assert(jen.Type())).Block(
+				jen.Case(jen.String()).Block(
+					jen.List(jen.Id("m"), jen.Id("ok")).Op(":=").Id("node").Assert(object.Clone()),
+					jen.If(jen.Op("!").Id("ok")).Block(fail),
+					jen.If(jen.List(jen.Id("node"), jen.Id("ok")).Op("=").Id("m").Index(jen.Id("s")), jen.Op("!").Id("ok")).Block(fail),
+				),
+				jen.Case(jen.Int()).Block(
+					jen.List(jen.Id("arr"), jen.Id("ok")).Op(":=").Id("node").Assert(ifaces.Clone()),
+					jen.If(jen.Op("!").Id("ok").Op("||").Id("s").Op(">=").Len(jen.Id("arr"))).Block(fail),
+					jen.Id("node").Op("=").Id("arr").Index(jen.Id("s")),
+				),
+			),
+		),
+		jen.Return(jen.Id("node"), jen.True()),
+	)
+	f.Line()
+
+	f.Comment("// _jsonPathSet returns a copy of node with val at steps, copying the objects")
+	f.Comment("// and arrays along the path and creating missing ones")
+	f.Func().Id("_jsonPathSet").Params(jen.Id("node").Interface(), jen.Id("steps").Index().Interface(), jen.Id("val").Interface()).Parens(jen.List(jen.Interface(), jen.Bool())).Block(
+		jen.If(jen.Len(jen.Id("steps")).Op("==").Lit(0)).Block(
+			jen.Return(jen.Id("val"), jen.True()),
+		),
+		jen.Switch(jen.Id("s").Op(":=").Id("steps").Index(jen.Lit(0)).Assert(jen.Type())).Block(
+			jen.Case(jen.String()).Block(
+				jen.List(jen.Id("m"), jen.Id("ok")).Op(":=").Id("node").Assert(object.Clone()),
+				jen.If(jen.Id("node").Op("!=").Nil().Op("&&").Op("!").Id("ok")).Block(fail),
+				jen.List(jen.Id("child"), jen.Id("ok")).Op(":=").Id("_jsonPathSet").Call(jen.Id("m").Index(jen.Id("s")), jen.Id("steps").Index(jen.Lit(1).Op(":")), jen.Id("val")),
+				jen.If(jen.Op("!").Id("ok")).Block(fail),
+				jen.Id("out").Op(":=").Make(object.Clone(), jen.Len(jen.Id("m")).Op("+").Lit(1)),
+				jen.For(jen.List(jen.Id("k"), jen.Id("v")).Op(":=").Range().Id("m")).Block(
+					jen.Id("out").Index(jen.Id("k")).Op("=").Id("v"),
+				),
+				jen.Id("out").Index(jen.Id("s")).Op("=").Id("child"),
+				jen.Return(jen.Id("out"), jen.True()),
+			),
+			jen.Case(jen.Int()).Block(
+				jen.List(jen.Id("arr"), jen.Id("ok")).Op(":=").Id("node").Assert(ifaces.Clone()),
+				jen.If(jen.Id("node").Op("!=").Nil().Op("&&").Op("!").Id("ok")).Block(fail),
+				jen.Id("out").Op(":=").Make(ifaces.Clone(), jen.Max(jen.Len(jen.Id("arr")), jen.Id("s").Op("+").Lit(1))),
+				jen.Copy(jen.Id("out"), jen.Id("arr")),
+				jen.List(jen.Id("child"), jen.Id("ok")).Op(":=").Id("_jsonPathSet").Call(jen.Id("out").Index(jen.Id("s")), jen.Id("steps").Index(jen.Lit(1).Op(":")), jen.Id("val")),
+				jen.If(jen.Op("!").Id("ok")).Block(fail),
+				jen.Id("out").Index(jen.Id("s")).Op("=").Id("child"),
+				jen.Return(jen.Id("out"), jen.True()),
+			),
+		),
+		fail,
+	)
+	f.Line()
+
+	f.Comment("// _jsonPathValue returns val to store at a path: JSON object and array text is")
+	f.Comment("// decoded so that it nests, anything else is stored as it is")
+	f.Func().Id("_jsonPathValue").Params(jen.Id("val").Interface()).Interface().Block(
+		jen.If(jen.List(jen.Id("s"), jen.Id("ok")).Op(":=").Id("val").Assert(jen.String()), jen.Id("ok")).Block(
+			jen.If(jen.Id("t").Op(":=").Qual("strings", "TrimSpace").Call(jen.Id("s")), jen.Qual("strings", "HasPrefix").Call(jen.Id("t"), jen.Lit("{")).Op("||").Qual("strings", "HasPrefix").Call(jen.Id("t"), jen.Lit("["))).Block(
+				jen.If(jen.Id("v").Op(":=").Id("_jsonPathRoot").Call(jen.Id("t")), jen.Id("v").Op("!=").Nil()).Block(
+					jen.Return(jen.Id("v")),
+				),
+			),
+		),
+		jen.Return(jen.Id("val")),
+	)
+	f.Line()
+
+	f.Comment("// _jsonAtPath answers the value at path in jsonVal, nested objects and arrays")
+	f.Comment("// as JSON text, or \"\" if there is none")
+	f.Func().Id("_jsonAtPath").Params(jen.Id("jsonVal").Any(), jen.Id("path").String()).String().Block(
+		jen.List(jen.Id("steps"), jen.Id("ok")).Op(":=").Id("_jsonPathSteps").Call(jen.Id("path")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Lit("")),
+		),
+		jen.List(jen.Id("v"), jen.Id("ok")).Op(":=").Id("_jsonPathGet").Call(jen.Id("_jsonPathRoot").Call(jen.Id("jsonVal")), jen.Id("steps")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Lit("")),
+		),
+		jen.Switch(jen.Id("v").Assert(jen.Type())).Block(
+			jen.Case(object.Clone(), ifaces.Clone()).Block(
+				jen.List(jen.Id("out"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("v")),
+				jen.Return(jen.String().Parens(jen.Id("out"))),
+			),
+		),
+		jen.Return(jen.Id("_toStr").Call(jen.Id("v"))),
+	)
+	f.Line()
+
+	f.Comment("// _jsonSetPath answers jsonVal as JSON text with val at path")
+	f.Func().Id("_jsonSetPath").Params(jen.Id("jsonVal").Any(), jen.Id("path").String(), jen.Id("val").Any()).String().Block(
+		jen.List(jen.Id("steps"), jen.Id("ok")).Op(":=").Id("_jsonPathSteps").Call(jen.Id("path")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Id("_toStr").Call(jen.Id("jsonVal"))),
+		),
+		jen.List(jen.Id("root"), jen.Id("ok")).Op(":=").Id("_jsonPathSet").Call(jen.Id("_jsonPathRoot").Call(jen.Id("jsonVal")), jen.Id("steps"), jen.Id("_jsonPathValue").Call(jen.Id("val"))),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Id("_toStr").Call(jen.Id("jsonVal"))),
+		),
+		jen.List(jen.Id("out"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("root")),
+		jen.Return(jen.String().Parens(jen.Id("out"))),
+	)
+	f.Line()
+
+	// The native versions answer the receiver's type, for <object> and <array> ivars
+	for _, native := range []struct {
+		name string
+		typ  *jen.Statement
+	}{{"_mapSetPath", object}, {"_arraySetPath", ifaces}} {
+		f.Comment("// " + native.name + " answers a copy of v with val at path")
+		f.Func().Id(native.name).Params(jen.Id("v").Add(native.typ.Clone()), jen.Id("path").String(), jen.Id("val").Any()).Add(native.typ.Clone()).Block(
+			jen.List(jen.Id("steps"), jen.Id("ok")).Op(":=").Id("_jsonPathSteps").Call(jen.Id("path")),
+			jen.If(jen.Op("!").Id("ok")).Block(
+				jen.Return(jen.Id("v")),
+			),
+			jen.List(jen.Id("root"), jen.Id("ok")).Op(":=").Id("_jsonPathSet").Call(jen.Id("v"), jen.Id("steps"), jen.Id("_jsonPathValue").Call(jen.Id("val"))),
+			jen.If(jen.List(jen.Id("out"), jen.Id("isType")).Op(":=").Id("root").Assert(native.typ.Clone()), jen.Id("ok").Op("&&").Id("isType")).Block(
+				jen.Return(jen.Id("out")),
+			),
+			jen.Return(jen.Id("v")),
+		)
+		f.Line()
+	}
+}
@@ -0,0 +1,181 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the lifecycle hooks the Bash runtime honors: new runs
+// initialize on the fresh instance, and delete runs aboutToDelete and
+// onDelete before the caller removes the instance, as classes holding
+// external resources (temp files, connections, child instances) need.
+package codegen
+
+import (
+	"strings"
+
+	"github.com/dave/jennifer/jen"
+)
+
+const (
+	// initializeSelector is the instance method new runs on a new instance
+	initializeSelector = "initialize"
+	// teardownSelector is the instance method delete runs first
+	teardownSelector = "aboutToDelete"
+	// deleteHookSelector is the instance method delete runs after
+	// aboutToDelete
+	deleteHookSelector = "onDelete"
+)
+
+// teardownSelectors are the instance methods delete runs, in order
+var teardownSelectors = []string{teardownSelector, deleteHookSelector}
+
+// initializerHook is an initializer new runs: initialize when new is sent
+// without arguments, a keyword initializer such as initialize:with: when
+// new is sent with as many
+type initializerHook struct {
+	selector string
+	args     int
+	method   *compiledMethod // nil when the initializer runs in Bash
+}
+
+// isInitializer reports whether the instance method selector is one new
+// runs: initialize, or a keyword selector starting with initialize:
+func isInitializer(selector string) bool {
+	return selector == initializeSelector || strings.HasPrefix(selector, initializeSelector+"_")
+}
+
+// initializerHooks returns the initializers the class defines, compiled or
+// not, with the first declared of each arity
+func (g *generator) initializerHooks(compiled []*compiledMethod) []initializerHook {
+	var hooks []initializerHook
+	arities := make(map[int]bool)
+	for _, m := range g.class.Methods {
+		if m.Kind == "class" || !isInitializer(m.Selector) || arities[len(m.Args)] {
+			continue
+		}
+		hook := initializerHook{selector: m.Selector, args: len(m.Args), method: lifecycleHook(compiled, m.Selector)}
+		if hook.method == nil && !g.hookFallsBack(m.Selector) {
+			continue
+		}
+		arities[hook.args] = true
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// lifecycleHook returns the compiled instance method selector, or nil
+func lifecycleHook(methods []*compiledMethod, selector string) *compiledMethod {
+	for _, m := range methods {
+		if !m.isClass && m.selector == selector {
+			return m
+		}
+	}
+	return nil
+}
+
+// hookFallsBack reports whether the class defines the instance method
+// selector but it runs in Bash
+func (g *generator) hookFallsBack(selector string) bool {
+	return g.skippedMethods[selector] && g.definedInstanceSelectors()[selector]
+}
+
+// hasTeardown reports whether the class defines aboutToDelete or onDelete
+func (g *generator) hasTeardown() bool {
+	defined := g.definedInstanceSelectors()
+	for _, selector := range teardownSelectors {
+		if defined[selector] {
+			return true
+		}
+	}
+	return false
+}
+
+// hookCall returns the statement that calls hook m on recv with args,
+// failing the case with the method's error. The call skips the method's
+// advice, like @ self.
+func (g *generator) hookCall(recv string, m *compiledMethod, args ...jen.Code) jen.Code {
+	methodName := m.goName
+	if g.instanceVars[m.selector] {
+		methodName = "Get" + methodName
+	}
+	call := jen.Id(recv).Dot(methodName).Call(args...)
+	if !m.returnsErr {
+		return call
+	}
+	return jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Add(call), jen.Err().Op("!=").Nil()).Block(
+		jen.Return(jen.Lit(""), jen.Err()),
+	)
+}
+
+// initializeNative returns the statements new runs before it stores the
+// instance: the compiled initializer, so the instance is stored initialized
+// by one INSERT. An error, including an unhandled _throw, stores nothing.
+func (g *generator) initializeNative() jen.Code {
+	return g.initializerSwitch(true, func(hook initializerHook) []jen.Code {
+		if hook.args == 0 {
+			return []jen.Code{g.hookCall("instance", hook.method)}
+		}
+		prelude, callArgs := dispatchArgs(hook.method)
+		// The switch has checked the argument count
+		return append(prelude[1:], g.hookCall("instance", hook.method, callArgs...))
+	})
+}
+
+// initializeFallback returns the statements new runs after it stores the
+// instance for an initializer that falls back to Bash, which needs the
+// stored instance to send to
+func (g *generator) initializeFallback() jen.Code {
+	return g.initializerSwitch(false, func(hook initializerHook) []jen.Code {
+		sendArgs := []jen.Code{jen.Id("id"), jen.Lit(hook.selector)}
+		for i := 0; i < hook.args; i++ {
+			sendArgs = append(sendArgs, jen.Id("args").Index(jen.Lit(i)))
+		}
+		return []jen.Code{jen.Id("sendMessage").Call(sendArgs...)}
+	})
+}
+
+// initializerSwitch returns run for the initializers that are compiled, or
+// that fall back, choosing by the number of arguments new is sent with.
+// initialize runs for any count no keyword initializer takes. Nothing is
+// emitted if no initializer matches.
+func (g *generator) initializerSwitch(compiled bool, run func(initializerHook) []jen.Code) jen.Code {
+	var keyword, other, unary []jen.Code
+	for _, hook := range g.initializers {
+		switch {
+		case (hook.method != nil) != compiled:
+			if hook.args > 0 {
+				other = append(other, jen.Case(jen.Lit(hook.args)))
+			}
+		case hook.args == 0:
+			unary = run(hook)
+		default:
+			keyword = append(keyword, jen.Case(jen.Lit(hook.args)).Block(run(hook)...))
+		}
+	}
+	if len(unary) == 0 {
+		if len(keyword) == 0 {
+			return jen.Null()
+		}
+		return jen.Switch(jen.Len(jen.Id("args"))).Block(keyword...)
+	}
+	if len(keyword) == 0 && len(other) == 0 {
+		return jen.Add(unary...)
+	}
+	// The counts the other initializers take do not run initialize
+	keyword = append(append(keyword, other...), jen.Default().Block(unary...))
+	return jen.Switch(jen.Len(jen.Id("args"))).Block(keyword...)
+}
+
+// deleteDispatchCase returns the delete case. It answers the instance ID,
+// which tells the caller to delete the instance, after running
+// aboutToDelete and onDelete if the class defines them: natively when the
+// method was compiled, through sendMessage when it falls back to Bash. An
+// error from a native hook, including an unhandled _throw, keeps the
+// instance.
+func (g *generator) deleteDispatchCase(methods []*compiledMethod) dispatchCase {
+	body := []jen.Code{}
+	for _, selector := range teardownSelectors {
+		if m := lifecycleHook(methods, selector); m != nil {
+			body = append(body, g.hookCall("c", m))
+		} else if g.hookFallsBack(selector) {
+			body = append(body, jen.Id("sendMessage").Call(jen.Id("instanceID"), jen.Lit(selector)))
+		}
+	}
+	body = append(body, jen.Return(jen.Id("instanceID"), jen.Nil()))
+	return dispatchCase{"delete", body}
+}
@@ -0,0 +1,382 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the Locale class primitives, which format numbers and
+// dates the way printf "%'d" and date +FORMAT do under the user's locale:
+//
+//	@ Locale formatNumber: 1234567.5          "1,234,567.5" under en_US
+//	@ Locale formatNumber: n decimals: 2
+//	@ Locale formatDate: ts                    "14.10.2026" under de_DE (%x)
+//	@ Locale formatDate: ts pattern: '%A %e %B'
+//
+// The locale is the class's locale instance variable when it declares one
+// and it is set, otherwise LC_ALL, LC_NUMERIC or LC_TIME, then LANG. Unknown
+// locales format like C: no grouping and English names.
+package codegen
+
+import (
+	"sort"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// localeInfo is the LC_NUMERIC and LC_TIME data of a locale, as in glibc
+type localeInfo struct {
+	thousands, decimal   string
+	months, shortMonths  []string
+	days, shortDays      []string
+	date, time, dateTime string // %x, %X and %c
+	am, pm               string
+}
+
+var (
+	englishMonths      = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+	englishShortMonths = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+	englishDays        = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+	englishShortDays   = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+)
+
+// locales are the locales compiled into the Locale helpers. A language
+// alone ("de") selects the locale languageLocales names for it.
+var locales = map[string]localeInfo{
+	"C": {
+		decimal: ".",
+		months:  englishMonths, shortMonths: englishShortMonths, days: englishDays, shortDays: englishShortDays,
+		date: "%m/%d/%y", time: "%H:%M:%S", dateTime: "%a %b %e %H:%M:%S %Y",
+		am: "AM", pm: "PM",
+	},
+	"en_US": {
+		thousands: ",", decimal: ".",
+		months: englishMonths, shortMonths: englishShortMonths, days: englishDays, shortDays: englishShortDays,
+		date: "%m/%d/%Y", time: "%r", dateTime: "%a %d %b %Y %r %Z",
+		am: "AM", pm: "PM",
+	},
+	"en_GB": {
+		thousands: ",", decimal: ".",
+		months: englishMonths, shortMonths: englishShortMonths, days: englishDays, shortDays: englishShortDays,
+		date: "%d/%m/%y", time: "%T", dateTime: "%a %d %b %Y %T %Z",
+		am: "am", pm: "pm",
+	},
+	"de_DE": {
+		thousands: ".", decimal: ",",
+		months:      []string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		shortMonths: []string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		days:        []string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+		shortDays:   []string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		date:        "%d.%m.%Y", time: "%T", dateTime: "%a %d %b %Y %T %Z",
+	},
+	"fr_FR": {
+		thousands: "\u202f", decimal: ",", // narrow no-break space
+		months:      []string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		shortMonths: []string{"janv.", "févr.", "mars", "avril", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		days:        []string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+		shortDays:   []string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		date:        "%d/%m/%Y", time: "%T", dateTime: "%a %d %b %Y %T %Z",
+	},
+	"es_ES": {
+		thousands: ".", decimal: ",",
+		months:      []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		shortMonths: []string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sep", "oct", "nov", "dic"},
+		days:        []string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+		shortDays:   []string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		date:        "%d/%m/%y", time: "%T", dateTime: "%a %d %b %Y %T %Z",
+	},
+	"ja_JP": {
+		thousands: ",", decimal: ".",
+		months:      []string{"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月", "10月", "11月", "12月"},
+		shortMonths: []string{" 1月", " 2月", " 3月", " 4月", " 5月", " 6月", " 7月", " 8月", " 9月", "10月", "11月", "12月"},
+		days:        []string{"日曜日", "月曜日", "火曜日", "水曜日", "木曜日", "金曜日", "土曜日"},
+		shortDays:   []string{"日", "月", "火", "水", "木", "金", "土"},
+		date:        "%Y年%m月%d日", time: "%H時%M分%S秒", dateTime: "%Y年%m月%d日 %H時%M分%S秒",
+		am: "午前", pm: "午後",
+	},
+}
+
+// languageLocales are the locales chosen for a locale name without a territory
+var languageLocales = map[string]string{"en": "en_US", "de": "de_DE", "fr": "fr_FR", "es": "es_ES", "ja": "ja_JP"}
+
+// usesLocale reports whether a method of class sends to Locale, so that the
+// formatting helpers are only generated when needed
+func usesLocale(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenIdentifier && tok.Value == "Locale" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generateLocalePrimitive generates Go code for Locale class primitives
+func (g *generator) generateLocalePrimitive(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	// An instance method of a class with a locale ivar formats in that locale
+	locale := jen.Lit("")
+	if !m.isClass && g.instanceVars["locale"] {
+		locale = g.generateStringArg(&parser.Identifier{Name: "locale"}, m)
+	}
+	arg := func(i int) jen.Code {
+		if i < len(e.Args) {
+			return g.generateStringArg(e.Args[i], m)
+		}
+		return jen.Lit("")
+	}
+
+	switch e.Operation {
+	case "localeFormatNumber":
+		return jen.Id("_formatNumber").Call(arg(0), jen.Lit(""), locale)
+	case "localeFormatNumberDecimals":
+		return jen.Id("_formatNumber").Call(arg(0), arg(1), locale)
+	case "localeFormatDate":
+		return jen.Id("_formatDate").Call(arg(0), jen.Lit(""), locale)
+	case "localeFormatDatePattern":
+		return jen.Id("_formatDate").Call(arg(0), arg(1), locale)
+	default:
+		return jen.Comment("unknown Locale primitive: " + e.Operation)
+	}
+}
+
+// generateLocaleHelpers generates the locale table, _locale, _formatNumber,
+// _formatDate, _parseDate and _strftime
+func (g *generator) generateLocaleHelpers(f *jen.File) {
+	if !g.localeFormat {
+		return
+	}
+	f.Comment("Locale primitive helpers")
+	f.Line()
+
+	strs := func(values []string) jen.Code {
+		items := make([]jen.Code, len(values))
+		for i, v := range values {
+			items[i] = jen.Lit(v)
+		}
+		return jen.Index().String().Values(items...)
+	}
+	f.Comment("_localeInfo is the number and date formatting data of a locale")
+	f.Type().Id("_localeInfo").Struct(
+		jen.List(jen.Id("thousands"), jen.Id("decimal")).String(),
+		jen.List(jen.Id("months"), jen.Id("shortMonths"), jen.Id("days"), jen.Id("shortDays")).Index().String(),
+		jen.List(jen.Id("date"), jen.Id("time"), jen.Id("dateTime")).String().Comment("%x, %X and %c"),
+		jen.List(jen.Id("am"), jen.Id("pm")).String(),
+	)
+	f.Line()
+
+	names := make([]string, 0, len(locales))
+	for name := range locales {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f.Comment("_locales are the known locales, by name and by language")
+	f.Var().Id("_locales").Op("=").Map(jen.String()).Id("_localeInfo").Values(jen.DictFunc(func(d jen.Dict) {
+		for _, name := range names {
+			info := locales[name]
+			d[jen.Lit(name)] = jen.Values(jen.Dict{
+				jen.Id("thousands"):   jen.Lit(info.thousands),
+				jen.Id("decimal"):     jen.Lit(info.decimal),
+				jen.Id("months"):      strs(info.months),
+				jen.Id("shortMonths"): strs(info.shortMonths),
+				jen.Id("days"):        strs(info.days),
+				jen.Id("shortDays"):   strs(info.shortDays),
+				jen.Id("date"):        jen.Lit(info.date),
+				jen.Id("time"):        jen.Lit(info.time),
+				jen.Id("dateTime"):    jen.Lit(info.dateTime),
+				jen.Id("am"):          jen.Lit(info.am),
+				jen.Id("pm"):          jen.Lit(info.pm),
+			})
+		}
+	}))
+	f.Line()
+
+	f.Comment("_localeLanguages are the locales chosen for a language without a territory")
+	f.Var().Id("_localeLanguages").Op("=").Map(jen.String()).String().Values(jen.DictFunc(func(d jen.Dict) {
+		for lang, name := range languageLocales {
+			d[jen.Lit(lang)] = jen.Lit(name)
+		}
+	}))
+	f.Line()
+
+	f.Comment("_locale returns the locale named name, or, if name is empty, the locale of")
+	f.Comment("the environment for category: LC_ALL, then category, then LANG. Unknown")
+	f.Comment("locales are C.")
+	f.Func().Id("_locale").Params(jen.List(jen.Id("name"), jen.Id("category")).String()).Id("_localeInfo").Block(
+		jen.For(jen.List(jen.Id("_"), jen.Id("key")).Op(":=").Range().Index().String().Values(jen.Lit("LC_ALL"), jen.Id("category"), jen.Lit("LANG"))).Block(
+			jen.If(jen.Id("name").Op("!=").Lit("")).Block(jen.Break()),
+			jen.Id("name").Op("=").Qual("os", "Getenv").Call(jen.Id("key")),
+		),
+		jen.Comment("de_DE.UTF-8@euro -> de_DE"),
+		jen.If(jen.Id("i").Op(":=").Qual("strings", "IndexAny").Call(jen.Id("name"), jen.Lit(".@")), jen.Id("i").Op(">=").Lit(0)).Block(
+			jen.Id("name").Op("=").Id("name").Index(jen.Op(":").Id("i")),
+		),
+		jen.If(jen.List(jen.Id("info"), jen.Id("ok")).Op(":=").Id("_locales").Index(jen.Id("name")), jen.Id("ok")).Block(
+			jen.Return(jen.Id("info")),
+		),
+		jen.List(jen.Id("lang"), jen.Id("_"), jen.Id("_")).Op(":=").Qual("strings", "Cut").Call(jen.Id("name"), jen.Lit("_")),
+		jen.If(jen.List(jen.Id("info"), jen.Id("ok")).Op(":=").Id("_locales").Index(jen.Id("_localeLanguages").Index(jen.Id("lang"))), jen.Id("ok")).Block(
+			jen.Return(jen.Id("info")),
+		),
+		jen.Return(jen.Id("_locales").Index(jen.Lit("C"))),
+	)
+	f.Line()
+
+	f.Comment("_formatNumber formats value with the locale's thousands separator and decimal")
+	f.Comment("point, rounded to decimals places if decimals is given. A value that is not a")
+	f.Comment("number is answered unchanged.")
+	f.Func().Id("_formatNumber").Params(jen.List(jen.Id("value"), jen.Id("decimals"), jen.Id("locale")).String()).String().Block(
+		jen.Id("v").Op(":=").Qual("strings", "TrimSpace").Call(jen.Id("value")),
+		jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("v"), jen.Lit(64)),
+		jen.If(jen.Err().Op("!=").Nil().Op("||").Qual("strings", "ContainsAny").Call(jen.Id("v"), jen.Lit("eExXnN"))).Block(
+			jen.Return(jen.Id("value")),
+		),
+		jen.If(jen.List(jen.Id("places"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("decimals")), jen.Err().Op("==").Nil().Op("&&").Id("places").Op(">=").Lit(0)).Block(
+			jen.Id("v").Op("=").Qual("strconv", "FormatFloat").Call(jen.Id("n"), jen.LitByte('f'), jen.Id("places"), jen.Lit(64)),
+		),
+		jen.Id("info").Op(":=").Id("_locale").Call(jen.Id("locale"), jen.Lit("LC_NUMERIC")),
+		jen.Line(),
+		jen.Id("sign").Op(":=").Lit(""),
+		jen.If(jen.Qual("strings", "HasPrefix").Call(jen.Id("v"), jen.Lit("-"))).Block(
+			jen.List(jen.Id("sign"), jen.Id("v")).Op("=").List(jen.Lit("-"), jen.Id("v").Index(jen.Lit(1).Op(":"))),
+		).Else().If(jen.Qual("strings", "HasPrefix").Call(jen.Id("v"), jen.Lit("+"))).Block(
+			jen.Id("v").Op("=").Id("v").Index(jen.Lit(1).Op(":")),
+		),
+		jen.List(jen.Id("whole"), jen.Id("fraction"), jen.Id("hasFraction")).Op(":=").Qual("strings", "Cut").Call(jen.Id("v"), jen.Lit(".")),
+		jen.Var().Id("b").Qual("strings", "Builder"),
+		jen.Id("b").Dot("WriteString").Call(jen.Id("sign")),
+		jen.For(jen.List(jen.Id("i"), jen.Id("digit")).Op(":=").Range().Id("whole")).Block(
+			jen.If(jen.Id("i").Op(">").Lit(0).Op("&&").Parens(jen.Len(jen.Id("whole")).Op("-").Id("i")).Op("%").Lit(3).Op("==").Lit(0)).Block(
+				jen.Id("b").Dot("WriteString").Call(jen.Id("info").Dot("thousands")),
+			),
+			jen.Id("b").Dot("WriteRune").Call(jen.Id("digit")),
+		),
+		jen.If(jen.Id("hasFraction")).Block(
+			jen.Id("b").Dot("WriteString").Call(jen.Id("info").Dot("decimal").Op("+").Id("fraction")),
+		),
+		jen.Return(jen.Id("b").Dot("String").Call()),
+	)
+	f.Line()
+
+	f.Comment("_formatDate formats the date value, Unix seconds or RFC 3339, in local time")
+	f.Comment("with the strftime pattern (%x if empty) in the locale. An empty value is now;")
+	f.Comment("one that is not a date is answered unchanged.")
+	f.Func().Id("_formatDate").Params(jen.List(jen.Id("value"), jen.Id("pattern"), jen.Id("locale")).String()).String().Block(
+		jen.List(jen.Id("t"), jen.Id("ok")).Op(":=").Id("_parseDate").Call(jen.Id("value")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Id("value")),
+		),
+		jen.If(jen.Id("pattern").Op("==").Lit("")).Block(
+			jen.Id("pattern").Op("=").Lit("%x"),
+		),
+		jen.Return(jen.Id("_strftime").Call(jen.Id("t"), jen.Id("pattern"), jen.Id("_locale").Call(jen.Id("locale"), jen.Lit("LC_TIME")))),
+	)
+	f.Line()
+
+	f.Comment("_parseDate parses Unix seconds, RFC 3339 or a YYYY-MM-DD date")
+	f.Func().Id("_parseDate").Params(jen.Id("value").String()).Parens(jen.List(jen.Qual("time", "Time"), jen.Bool())).Block(
+		jen.Id("value").Op("=").Qual("strings", "TrimSpace").Call(jen.Id("value")),
+		jen.If(jen.Id("value").Op("==").Lit("")).Block(
+			jen.Return(jen.Qual("time", "Now").Call(), jen.True()),
+		),
+		jen.If(jen.List(jen.Id("seconds"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("value"), jen.Lit(64)), jen.Err().Op("==").Nil()).Block(
+			jen.Return(jen.Qual("time", "Unix").Call(jen.Lit(0), jen.Int64().Call(jen.Id("seconds").Op("*").Lit(1e9))), jen.True()),
+		),
+		jen.For(jen.List(jen.Id("_"), jen.Id("layout")).Op(":=").Range().Index().String().Values(jen.Qual("time", "RFC3339Nano"), jen.Lit("2006-01-02"))).Block(
+			jen.If(jen.List(jen.Id("t"), jen.Err()).Op(":=").Qual("time", "ParseInLocation").Call(jen.Id("layout"), jen.Id("value"), jen.Qual("time", "Local")), jen.Err().Op("==").Nil()).Block(
+				jen.Return(jen.Id("t").Dot("Local").Call(), jen.True()),
+			),
+		),
+		jen.Return(jen.Qual("time", "Time").Values(), jen.False()),
+	)
+	f.Line()
+
+	// Directives written with a number format
+	numeric := []struct {
+		directive byte
+		format    string
+		value     jen.Code
+	}{
+		{'Y', "%d", jen.Id("t").Dot("Year").Call()},
+		{'y', "%02d", jen.Id("t").Dot("Year").Call().Op("%").Lit(100)},
+		{'C', "%02d", jen.Id("t").Dot("Year").Call().Op("/").Lit(100)},
+		{'m', "%02d", jen.Int().Call(jen.Id("t").Dot("Month").Call())},
+		{'d', "%02d", jen.Id("t").Dot("Day").Call()},
+		{'e', "%2d", jen.Id("t").Dot("Day").Call()},
+		{'j', "%03d", jen.Id("t").Dot("YearDay").Call()},
+		{'H', "%02d", jen.Id("t").Dot("Hour").Call()},
+		{'k', "%2d", jen.Id("t").Dot("Hour").Call()},
+		{'I', "%02d", jen.Id("hour12")},
+		{'l', "%2d", jen.Id("hour12")},
+		{'M', "%02d", jen.Id("t").Dot("Minute").Call()},
+		{'S', "%02d", jen.Id("t").Dot("Second").Call()},
+		{'u', "%d", jen.Parens(jen.Int().Call(jen.Id("t").Dot("Weekday").Call()).Op("+").Lit(6)).Op("%").Lit(7).Op("+").Lit(1)},
+		{'w', "%d", jen.Int().Call(jen.Id("t").Dot("Weekday").Call())},
+		{'s', "%d", jen.Id("t").Dot("Unix").Call()},
+	}
+	// Directives written as another pattern
+	composite := []struct {
+		directive byte
+		pattern   jen.Code
+	}{
+		{'x', jen.Id("info").Dot("date")},
+		{'X', jen.Id("info").Dot("time")},
+		{'c', jen.Id("info").Dot("dateTime")},
+		{'D', jen.Lit("%m/%d/%y")},
+		{'F', jen.Lit("%Y-%m-%d")},
+		{'T', jen.Lit("%H:%M:%S")},
+		{'R', jen.Lit("%H:%M")},
+		{'r', jen.Lit("%I:%M:%S %p")},
+	}
+	write := func(s jen.Code) jen.Code {
+		return jen.Id("b").Dot("WriteString").Call(s)
+	}
+
+	f.Comment("_strftime formats t with the strftime pattern, as date +PATTERN does")
+	f.Func().Id("_strftime").Params(
+		jen.Id("t").Qual("time", "Time"),
+		jen.Id("pattern").String(),
+		jen.Id("info").Id("_localeInfo"),
+	).String().Block(
+		jen.Id("hour12").Op(":=").Id("t").Dot("Hour").Call().Op("%").Lit(12),
+		jen.If(jen.Id("hour12").Op("==").Lit(0)).Block(
+			jen.Id("hour12").Op("=").Lit(12),
+		),
+		jen.Var().Id("b").Qual("strings", "Builder"),
+		jen.For(jen.Id("i").Op(":=").Lit(0), jen.Id("i").Op("<").Len(jen.Id("pattern")), jen.Id("i").Op("++")).Block(
+			jen.If(jen.Id("pattern").Index(jen.Id("i")).Op("!=").LitByte('%').Op("||").Id("i").Op("+").Lit(1).Op("==").Len(jen.Id("pattern"))).Block(
+				jen.Id("b").Dot("WriteByte").Call(jen.Id("pattern").Index(jen.Id("i"))),
+				jen.Continue(),
+			),
+			jen.Id("i").Op("++"),
+			jen.Switch(jen.Id("c").Op(":=").Id("pattern").Index(jen.Id("i")), jen.Id("c")).BlockFunc(func(grp *jen.Group) {
+				for _, d := range numeric {
+					grp.Case(jen.LitByte(d.directive)).Block(
+						jen.Qual("fmt", "Fprintf").Call(jen.Op("&").Id("b"), jen.Lit(d.format), d.value),
+					)
+				}
+				grp.Case(jen.LitByte('B')).Block(write(jen.Id("info").Dot("months").Index(jen.Id("t").Dot("Month").Call().Op("-").Lit(1))))
+				grp.Case(jen.LitByte('b'), jen.LitByte('h')).Block(write(jen.Id("info").Dot("shortMonths").Index(jen.Id("t").Dot("Month").Call().Op("-").Lit(1))))
+				grp.Case(jen.LitByte('A')).Block(write(jen.Id("info").Dot("days").Index(jen.Id("t").Dot("Weekday").Call())))
+				grp.Case(jen.LitByte('a')).Block(write(jen.Id("info").Dot("shortDays").Index(jen.Id("t").Dot("Weekday").Call())))
+				grp.Case(jen.LitByte('p')).Block(
+					jen.If(jen.Id("t").Dot("Hour").Call().Op("<").Lit(12)).Block(
+						write(jen.Id("info").Dot("am")),
+					).Else().Block(
+						write(jen.Id("info").Dot("pm")),
+					),
+				)
+				grp.Case(jen.LitByte('Z')).Block(write(jen.Id("t").Dot("Format").Call(jen.Lit("MST"))))
+				grp.Case(jen.LitByte('z')).Block(write(jen.Id("t").Dot("Format").Call(jen.Lit("-0700"))))
+				for _, d := range composite {
+					grp.Case(jen.LitByte(d.directive)).Block(write(jen.Id("_strftime").Call(jen.Id("t"), d.pattern, jen.Id("info"))))
+				}
+				grp.Case(jen.LitByte('n')).Block(jen.Id("b").Dot("WriteByte").Call(jen.LitByte('\n')))
+				grp.Case(jen.LitByte('t')).Block(jen.Id("b").Dot("WriteByte").Call(jen.LitByte('\t')))
+				grp.Case(jen.LitByte('%')).Block(jen.Id("b").Dot("WriteByte").Call(jen.LitByte('%')))
+				grp.Default().Block(
+					jen.Id("b").Dot("WriteByte").Call(jen.LitByte('%')),
+					jen.Id("b").Dot("WriteByte").Call(jen.Id("c")),
+				)
+			}),
+		),
+		jen.Return(jen.Id("b").Dot("String").Call()),
+	)
+	f.Line()
+}
@@ -0,0 +1,232 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the numeric tower: integer and float arithmetic.
+package codegen
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// numKind is the statically known numeric type of an expression
+type numKind int
+
+const (
+	numDynamic numKind = iota // decided at runtime (variables, args, sends)
+	numInt
+	numFloat
+)
+
+// isFloatLit reports whether a number literal has a fractional part or exponent
+func isFloatLit(s string) bool {
+	return strings.ContainsAny(s, ".eE")
+}
+
+// numKindOf infers the numeric type of an arithmetic operand. Only literals
+// are known at compile time; every other value is a string or interface{}
+// that may hold either an integer or a decimal.
+func numKindOf(expr parser.Expr) numKind {
+	switch e := expr.(type) {
+	case *parser.NumberLit:
+		if isFloatLit(e.Value) {
+			return numFloat
+		}
+		return numInt
+	case *parser.NegateExpr:
+		return numKindOf(e.Operand)
+	case *parser.BinaryExpr:
+		if e.Op == "," {
+			return numDynamic
+		}
+		left, right := numKindOf(e.Left), numKindOf(e.Right)
+		if left == numFloat || right == numFloat {
+			return numFloat
+		}
+		if left == numInt && right == numInt {
+			return numInt
+		}
+	}
+	return numDynamic
+}
+
+// numKind is numKindOf that also knows typed arguments and instance
+// variables: count:<int> is an int and total:<float> a float64 in the
+// methods of m's class, argTypes: amount:int an int in m.
+func (g *generator) numKind(expr parser.Expr, m *compiledMethod) numKind {
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		switch typ, _ := g.typedValue(e.Name, m); typ {
+		case "int":
+			return numInt
+		case "float":
+			return numFloat
+		}
+	case *parser.NegateExpr:
+		return g.numKind(e.Operand, m)
+	case *parser.BinaryExpr:
+		if e.Op == "," {
+			return numDynamic
+		}
+		left, right := g.numKind(e.Left, m), g.numKind(e.Right, m)
+		if left == numFloat || right == numFloat {
+			return numFloat
+		}
+		if left == numInt && right == numInt {
+			return numInt
+		}
+		return numDynamic
+	}
+	return numKindOf(expr)
+}
+
+// generateArithmetic generates +, -, * or / for a BinaryExpr.
+// Integer-only expressions (literals and <int> ivars) use int arithmetic,
+// expressions with a float literal or <float> ivar use float64, and everything else goes through _arith, which
+// keeps integer semantics for integral values and switches to float64 as
+// soon as either operand has a decimal point.
+func (g *generator) generateArithmetic(e *parser.BinaryExpr, m *compiledMethod) *jen.Statement {
+	switch e.Op {
+	case "+", "-", "*", "/":
+	default:
+		return jen.Comment("unknown op: " + e.Op)
+	}
+
+	switch g.numKind(e, m) {
+	case numInt:
+		return g.numOperand(e.Left, "toInt", m).Op(e.Op).Add(g.numOperand(e.Right, "toInt", m))
+	case numFloat:
+		return g.numOperand(e.Left, "toFloat", m).Op(e.Op).Add(g.numOperand(e.Right, "toFloat", m))
+	}
+	return jen.Id("_arith").Call(jen.Lit(e.Op), g.generateExpr(e.Left, m), g.generateExpr(e.Right, m))
+}
+
+// generateNegate generates -x as 0 - x, so it follows the same int/float
+// rules as subtraction
+func (g *generator) generateNegate(e *parser.NegateExpr, m *compiledMethod) *jen.Statement {
+	return g.generateArithmetic(&parser.BinaryExpr{Left: &parser.NumberLit{Value: "0"}, Op: "-", Right: e.Operand}, m)
+}
+
+// ivarIncrement recognizes value := value + 1, value := 1 + value and
+// value := value - 1 (also written value increment / value decrement) and
+// returns the step. The ivar is a string, so the update is a single
+// Atoi/Itoa round trip instead of going through _arith and _toStr.
+func ivarIncrement(target string, value parser.Expr) (int, bool) {
+	e, ok := value.(*parser.BinaryExpr)
+	if !ok || (e.Op != "+" && e.Op != "-") {
+		return 0, false
+	}
+	left, right := e.Left, e.Right
+	if e.Op == "+" && !isIdent(left, target) {
+		left, right = right, left
+	}
+	if !isIdent(left, target) {
+		return 0, false
+	}
+	step, ok := intLitValue(right)
+	if !ok {
+		return 0, false
+	}
+	if e.Op == "-" {
+		step = -step
+	}
+	return step, true
+}
+
+// isIdent reports whether expr is the identifier name
+func isIdent(expr parser.Expr, name string) bool {
+	id, ok := expr.(*parser.Identifier)
+	return ok && id.Name == name
+}
+
+// intLitValue returns the value of an integer literal, possibly negated
+func intLitValue(expr parser.Expr) (int, bool) {
+	switch e := expr.(type) {
+	case *parser.NumberLit:
+		n, err := strconv.Atoi(e.Value)
+		return n, err == nil
+	case *parser.NegateExpr:
+		n, ok := intLitValue(e.Operand)
+		return -n, ok
+	}
+	return 0, false
+}
+
+// generateNumberLit generates an int or float64 literal
+func generateNumberLit(e *parser.NumberLit) *jen.Statement {
+	if isFloatLit(e.Value) {
+		return jen.Op(e.Value)
+	}
+	return jen.Lit(mustAtoi(e.Value))
+}
+
+// generateNumericHelpers generates toNum, toFloat, _arith and _addInt
+func generateNumericHelpers(f *jen.File) {
+	f.Comment("// toNum converts v to an int if it is integral, otherwise to a float64")
+	f.Func().Id("toNum").Params(jen.Id("v").Interface()).Interface().Block(
+		jen.Switch(jen.Id("x").Op(":=").Id("v").Assert(jen.Type())).Block(
+			jen.Case(jen.Int(), jen.Float64()).Block(jen.Return(jen.Id("x"))),
+			jen.Case(jen.Int64()).Block(jen.Return(jen.Int().Parens(jen.Id("x")))),
+			jen.Case(jen.Qual("encoding/json", "Number")).Block(jen.Return(jen.Id("toNum").Call(jen.String().Parens(jen.Id("x"))))),
+			jen.Case(jen.String()).Block(
+				jen.Id("s").Op(":=").Qual("strings", "TrimSpace").Call(jen.Id("x")),
+				jen.If(jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("s")), jen.Err().Op("==").Nil()).Block(
+					jen.Return(jen.Id("n")),
+				),
+				jen.If(jen.List(jen.Id("f"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("s"), jen.Lit(64)), jen.Err().Op("==").Nil()).Block(
+					jen.Return(jen.Id("f")),
+				),
+			),
+		),
+		jen.Return(jen.Lit(0)),
+	)
+	f.Line()
+
+	f.Comment("// toFloat converts interface{} to float64 for decimal arithmetic")
+	f.Func().Id("toFloat").Params(jen.Id("v").Interface()).Float64().Block(
+		jen.Switch(jen.Id("x").Op(":=").Id("toNum").Call(jen.Id("v")).Assert(jen.Type())).Block(
+			jen.Case(jen.Int()).Block(jen.Return(jen.Float64().Parens(jen.Id("x")))),
+			jen.Case(jen.Float64()).Block(jen.Return(jen.Id("x"))),
+		),
+		jen.Return(jen.Lit(0)),
+	)
+	f.Line()
+
+	f.Comment("// _arith applies op with int arithmetic when both operands are integral,")
+	f.Comment("// and float64 arithmetic otherwise")
+	f.Func().Id("_arith").Params(
+		jen.Id("op").String(),
+		jen.List(jen.Id("a"), jen.Id("b")).Interface(),
+	).Interface().Block(
+		jen.List(jen.Id("x"), jen.Id("y")).Op(":=").List(jen.Id("toNum").Call(jen.Id("a")), jen.Id("toNum").Call(jen.Id("b"))),
+		jen.List(jen.Id("i"), jen.Id("iok")).Op(":=").Id("x").Assert(jen.Int()),
+		jen.List(jen.Id("j"), jen.Id("jok")).Op(":=").Id("y").Assert(jen.Int()),
+		jen.If(jen.Id("iok").Op("&&").Id("jok")).Block(
+			jen.Switch(jen.Id("op")).Block(
+				jen.Case(jen.Lit("+")).Block(jen.Return(jen.Id("i").Op("+").Id("j"))),
+				jen.Case(jen.Lit("-")).Block(jen.Return(jen.Id("i").Op("-").Id("j"))),
+				jen.Case(jen.Lit("*")).Block(jen.Return(jen.Id("i").Op("*").Id("j"))),
+				jen.Case(jen.Lit("/")).Block(jen.Return(jen.Id("i").Op("/").Id("j"))),
+			),
+		),
+		jen.List(jen.Id("p"), jen.Id("q")).Op(":=").List(jen.Id("toFloat").Call(jen.Id("x")), jen.Id("toFloat").Call(jen.Id("y"))),
+		jen.Switch(jen.Id("op")).Block(
+			jen.Case(jen.Lit("+")).Block(jen.Return(jen.Id("p").Op("+").Id("q"))),
+			jen.Case(jen.Lit("-")).Block(jen.Return(jen.Id("p").Op("-").Id("q"))),
+			jen.Case(jen.Lit("*")).Block(jen.Return(jen.Id("p").Op("*").Id("q"))),
+			jen.Case(jen.Lit("/")).Block(jen.Return(jen.Id("p").Op("/").Id("q"))),
+		),
+		jen.Return(jen.Lit(0)),
+	)
+	f.Line()
+	f.Comment("// _addInt adds n to the integer held in s, falling back to _arith for")
+	f.Comment("// decimals and anything else that is not a plain integer")
+	f.Func().Id("_addInt").Params(jen.Id("s").String(), jen.Id("n").Int()).String().Block(
+		jen.If(jen.List(jen.Id("i"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("s")), jen.Err().Op("==").Nil()).Block(
+			jen.Return(jen.Qual("strconv", "Itoa").Call(jen.Id("i").Op("+").Id("n"))),
+		),
+		jen.Return(jen.Id("_toStr").Call(jen.Id("_arith").Call(jen.Lit("+"), jen.Id("s"), jen.Id("n")))),
+	)
+	f.Line()
+}
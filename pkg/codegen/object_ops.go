@@ -0,0 +1,151 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the object merge and comparison primitives:
+// objectMerge: (the argument's keys replace the receiver's), objectDeepMerge:
+// (nested objects are merged in turn) and objectEquals: (the same keys and
+// equal values, whatever their order). Either side may be an <object> ivar or
+// JSON object text; merges answer a new object and leave both as they were.
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// usesObjectOps reports whether a method of class sends objectMerge:,
+// objectDeepMerge: or objectEquals:, so that their helpers are only generated
+// when needed
+func usesObjectOps(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenKeyword {
+				switch tok.Value {
+				case "objectMerge:", "objectDeepMerge:", "objectEquals:":
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// generateObjectOp generates Go code for objectMerge:, objectDeepMerge: and
+// objectEquals:
+func (g *generator) generateObjectOp(e *parser.JSONPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	if e.Operation == "objectEquals" {
+		return jen.Id("_boolToString").Call(jen.Id("_objectEquals").Call(g.generateExpr(e.Receiver, m), g.generateExpr(e.Args[0], m)))
+	}
+	if g.exprResultsInObject(e.Receiver, m) {
+		return g.objectMergeCall(e, m)
+	}
+	return jen.Id("_jsonObjectText").Call(g.objectMergeCall(e, m))
+}
+
+// objectMergeCall returns the native helper call of a merge, answering a
+// map[string]interface{}
+func (g *generator) objectMergeCall(e *parser.JSONPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	return jen.Id("_objectMerge").Call(
+		g.nativeObject(e.Receiver, m),
+		g.nativeObject(e.Args[0], m),
+		jen.Lit(e.Operation == "objectDeepMerge"),
+	)
+}
+
+// nativeObject returns expr as a map[string]interface{}. Chained merges stay
+// native, so that only the end of a chain is encoded as JSON text.
+func (g *generator) nativeObject(expr parser.Expr, m *compiledMethod) *jen.Statement {
+	if g.exprResultsInObject(expr, m) {
+		return g.generateExpr(expr, m)
+	}
+	if e, ok := expr.(*parser.JSONPrimitiveExpr); ok && (e.Operation == "objectMerge" || e.Operation == "objectDeepMerge") {
+		return g.objectMergeCall(e, m)
+	}
+	return jen.Id("_objectDecode").Call(g.generateExpr(expr, m))
+}
+
+// generateObjectOpHelpers generates _objectMerge, _objectEquals,
+// _objectNormal, _objectDecode and _jsonObjectText
+func (g *generator) generateObjectOpHelpers(f *jen.File) {
+	if !g.objectOps {
+		return
+	}
+	object := jen.Map(jen.String()).Interface()
+
+	f.Comment("// Object merge and comparison primitive helpers")
+	f.Line()
+
+	f.Comment("// _objectMerge answers a copy of obj with the keys of other set over it. If")
+	f.Comment("// deep, keys holding objects on both sides are merged the same way.")
+	f.Func().Id("_objectMerge").Params(jen.List(jen.Id("obj"), jen.Id("other")).Add(object.Clone()), jen.Id("deep").Bool()).Add(object.Clone()).Block(
+		jen.Id("out").Op(":=").Make(object.Clone(), jen.Len(jen.Id("obj")).Op("+").Len(jen.Id("other"))),
+		jen.For(jen.List(jen.Id("k"), jen.Id("v")).Op(":=").Range().Id("obj")).Block(
+			jen.Id("out").Index(jen.Id("k")).Op("=").Id("v"),
+		),
+		jen.For(jen.List(jen.Id("k"), jen.Id("v")).Op(":=").Range().Id("other")).Block(
+			jen.If(jen.Id("deep")).Block(
+				jen.List(jen.Id("mine"), jen.Id("ok1")).Op(":=").Id("out").Index(jen.Id("k")).Assert(object.Clone()),
+				jen.List(jen.Id("theirs"), jen.Id("ok2")).Op(":=").Id("v").Assert(object.Clone()),
+				jen.If(jen.Id("ok1").Op("&&").Id("ok2")).Block(
+					jen.Id("out").Index(jen.Id("k")).Op("=").Id("_objectMerge").Call(jen.Id("mine"), jen.Id("theirs"), jen.True()),
+					jen.Continue(),
+				),
+			),
+			jen.Id("out").Index(jen.Id("k")).Op("=").Id("v"),
+		),
+		jen.Return(jen.Id("out")),
+	)
+	f.Line()
+
+	f.Comment("// _objectEquals reports whether a and b are the same JSON value: objects with")
+	f.Comment("// the same keys and equal values, whatever their order")
+	f.Func().Id("_objectEquals").Params(jen.List(jen.Id("a"), jen.Id("b")).Interface()).Bool().Block(
+		jen.Return(jen.Qual("reflect", "DeepEqual").Call(jen.Id("_objectNormal").Call(jen.Id("a")), jen.Id("_objectNormal").Call(jen.Id("b")))),
+	)
+	f.Line()
+
+	f.Comment("// _objectNormal decodes v, JSON text or a value, the way json.Unmarshal would,")
+	f.Comment("// so that equal values compare equal whatever their Go types. Text that is")
+	f.Comment("// not JSON stays a string.")
+	f.Func().Id("_objectNormal").Params(jen.Id("v").Interface()).Interface().Block(
+		jen.Var().Id("data").Index().Byte(),
+		jen.Switch(jen.Id("val").Op(":=").Id("v").Assert(jen.Type())).Block(
+			jen.Case(jen.String()).Block(
+				jen.Id("data").Op("=").Index().Byte().Parens(jen.Id("val")),
+			),
+			jen.Case(jen.Qual("encoding/json", "RawMessage")).Block(
+				jen.Id("data").Op("=").Id("val"),
+			),
+			jen.Default().Block(
+				jen.List(jen.Id("data"), jen.Id("_")).Op("=").Qual("encoding/json", "Marshal").Call(jen.Id("val")),
+			),
+		),
+		jen.Var().Id("out").Interface(),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Id("data"), jen.Op("&").Id("out")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Qual("fmt", "Sprint").Call(jen.Id("v"))),
+		),
+		jen.Return(jen.Id("out")),
+	)
+	f.Line()
+
+	f.Comment("// _objectDecode answers v as an object: itself if it is one, else decoded from")
+	f.Comment("// its JSON text, nil if that is not an object")
+	f.Func().Id("_objectDecode").Params(jen.Id("v").Interface()).Add(object.Clone()).Block(
+		jen.If(jen.List(jen.Id("obj"), jen.Id("ok")).Op(":=").Id("v").Assert(object.Clone()), jen.Id("ok")).Block(
+			jen.Return(jen.Id("obj")),
+		),
+		jen.Var().Id("obj").Add(object.Clone()),
+		jen.Id("_jsonDecode").Call(jen.Index().Byte().Parens(jen.Qual("fmt", "Sprintf").Call(jen.Lit("%s"), jen.Id("v"))), jen.Op("&").Id("obj")),
+		jen.Return(jen.Id("obj")),
+	)
+	f.Line()
+
+	f.Comment("// _jsonObjectText encodes obj as JSON object text")
+	f.Func().Id("_jsonObjectText").Params(jen.Id("obj").Add(object.Clone())).String().Block(
+		jen.If(jen.Id("obj").Op("==").Nil()).Block(
+			jen.Return(jen.Lit("{}")),
+		),
+		jen.List(jen.Id("result"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("obj")),
+		jen.Return(jen.String().Parens(jen.Id("result"))),
+	)
+	f.Line()
+}
@@ -4,7 +4,8 @@ package codegen
 
 import (
 	"bytes"
-	"fmt"
+	"encoding/json"
+	"sort"
 
 	"github.com/chazu/procyon/pkg/ast"
 	"github.com/dave/jennifer/jen"
@@ -13,30 +14,28 @@ import (
 // GeneratePlugin produces Go source code for a c-shared plugin.
 // The output can be built with: go build -buildmode=c-shared -o Class.so
 func GeneratePlugin(class *ast.Class) *Result {
-	g := &generator{
-		class:          class,
-		warnings:       []string{},
-		skipped:        []SkippedMethod{},
-		instanceVars:   map[string]bool{},
-		jsonVars:       map[string]bool{},
-		skippedMethods: map[string]bool{},
-	}
-
-	// Build instance var lookup and track JSON-typed vars
-	for _, iv := range class.InstanceVars {
-		g.instanceVars[iv.Name] = true
-		// Check if default value is JSON object or array
-		defaultVal := iv.Default.Value
-		if len(defaultVal) > 0 && (defaultVal[0] == '{' || defaultVal[0] == '[') {
-			g.jsonVars[iv.Name] = true
-		}
-	}
+	return GeneratePluginWithOptions(class, Options{})
+}
 
+// GeneratePluginWithOptions is GeneratePlugin honoring opts.Only,
+// opts.Skip, opts.Classes, opts.Accessors, opts.ImplicitLocals,
+// opts.MapDispatch and opts.Comments.
+func GeneratePluginWithOptions(class *ast.Class, opts Options) *Result {
+	g := newGenerator(class)
+	g.mapDispatch = opts.MapDispatch
+	g.setSelection(opts.Only, opts.Skip)
+	g.setClasses(opts.Classes)
+	g.accessors = opts.Accessors
+	g.implicitLocals = opts.ImplicitLocals
+	g.setComments(opts)
 	return g.generatePlugin()
 }
 
 func (g *generator) generatePlugin() *Result {
 	f := jen.NewFile("main")
+	g.ignoreIndexes()
+	g.ignoreSchemaMigration()
+	g.generateHeader(f)
 
 	// Import "C" for c-shared exports
 	f.ImportAlias("C", "")
@@ -48,6 +47,9 @@ func (g *generator) generatePlugin() *Result {
 	f.Var().Id("ErrUnknownSelector").Op("=").Qual("errors", "New").Call(jen.Lit("unknown selector"))
 	f.Line()
 
+	// ErrConflict
+	generateConflictDecls(f)
+
 	// Struct definition (same as binary mode)
 	g.generateStruct(f)
 	f.Line()
@@ -64,14 +66,34 @@ func (g *generator) generatePlugin() *Result {
 	g.generateTypeHelpers(f)
 	f.Line()
 
+	// TrashError and the _throw helpers
+	if g.exceptions {
+		generateExceptionHelpers(f)
+	}
+	g.generateArgTypeHelpers(f)
+
 	// JSON primitive helpers (_toStr, _arrayFirst, etc.)
 	g.generateJSONHelpers(f)
+	g.generateJSONPathHelpers(f)
+	g.generateArrayOpHelpers(f)
+	g.generateObjectOpHelpers(f)
+	g.generateTypedIvarHelpers(f)
+	g.generateStringFileHelpers(f)
+	g.generateFileOpHelpers(f)
+	g.generateHttpClientHelpers(f)
+	g.generateShellHelpers(f)
+	g.generateEnvHelpers(f)
+	g.generateLocaleHelpers(f)
 	f.Line()
 
-	// gRPC helper functions for GrpcClient class
-	if g.class.Name == "GrpcClient" {
+	// gRPC helper functions for native gRPC clients
+	if g.grpc {
 		g.generateGrpcHelpers(f)
 	}
+	if g.hasClassQueries() || g.hasEnvironmentQueries() {
+		g.generateQueryIDs(f)
+	}
+	g.generateEnvironmentQueryHelpers(f)
 
 	// First pass: identify which methods will be skipped (for @ self calls)
 	g.preIdentifySkippedMethods()
@@ -90,9 +112,11 @@ func (g *generator) generatePlugin() *Result {
 	}
 
 	// Generate internal dispatch functions (not exported)
-	g.generatePluginDispatch(f, instanceMethods)
+	selectors := g.generatePluginDispatch(f, instanceMethods)
 	f.Line()
-	g.generatePluginClassDispatch(f, classMethods)
+	classSelectors := g.generatePluginClassDispatch(f, classMethods)
+	f.Line()
+	g.generateClassInfoExport(f, selectors, classSelectors)
 	f.Line()
 
 	// Generate method implementations
@@ -100,6 +124,11 @@ func (g *generator) generatePlugin() *Result {
 		g.generateMethod(f, m)
 	}
 
+	// Data migrations for versioned classes
+	g.generateMigrations(f)
+	g.generateClassVars(f)
+	g.generateJSONConsts(f)
+
 	// Empty main (required for c-shared but unused)
 	f.Func().Id("main").Params().Block()
 
@@ -110,13 +139,15 @@ func (g *generator) generatePlugin() *Result {
 			Code:           "",
 			Warnings:       append(g.warnings, "render error: "+err.Error()),
 			SkippedMethods: g.skipped,
+			Errors:         g.errors,
 		}
 	}
 
 	return &Result{
-		Code:           buf.String(),
+		Code:           g.withHelperComments(buf.String()),
 		Warnings:       g.warnings,
 		SkippedMethods: g.skipped,
+		Errors:         g.errors,
 	}
 }
 
@@ -146,13 +177,78 @@ func (g *generator) generatePluginExports(f *jen.File) {
 		jen.Id("argsStr").Op(":=").Qual("C", "GoString").Call(jen.Id("argsJSON")),
 		jen.Line(),
 		// Call internal dispatch - returns JSON with embedded exit_code
-		jen.Id("result").Op(":=").Id("dispatchInternal").Call(
+		jen.Id("result").Op(":=").Id("dispatchWork").Call(
 			jen.Id("instanceStr"),
 			jen.Id("selectorStr"),
 			jen.Id("argsStr"),
 		),
 		jen.Return(jen.Qual("C", "CString").Call(jen.Id("result"))),
 	)
+	f.Line()
+	generatePluginStream(f)
+	g.generateCapabilitiesExport(f)
+}
+
+// generatePluginStream generates DispatchStream and ReadResult, which hand
+// a response to the daemon in chunks it reads into its own buffer. Dispatch
+// returns one C string, which the daemon cannot free and reads no further
+// than its size limit, so large results are cut short.
+func generatePluginStream(f *jen.File) {
+	f.Comment("pendingResults holds the responses of DispatchStream not yet read with ReadResult")
+	f.Var().Defs(
+		jen.Id("pendingMu").Qual("sync", "Mutex"),
+		jen.Id("pendingResults").Op("=").Map(jen.Int64()).String().Values(),
+		jen.Id("nextResult").Int64(),
+	)
+	f.Line()
+
+	f.Comment("//export DispatchStream")
+	f.Comment("// DispatchStream dispatches like Dispatch, but keeps the response for")
+	f.Comment("// ReadResult. It stores the response's length in size and returns its handle.")
+	f.Func().Id("DispatchStream").Params(
+		jen.List(jen.Id("instanceJSON"), jen.Id("selector"), jen.Id("argsJSON")).Op("*").Qual("C", "char"),
+		jen.Id("size").Op("*").Qual("C", "longlong"),
+	).Qual("C", "longlong").Block(
+		jen.Id("result").Op(":=").Id("dispatchWork").Call(
+			jen.Qual("C", "GoString").Call(jen.Id("instanceJSON")),
+			jen.Qual("C", "GoString").Call(jen.Id("selector")),
+			jen.Qual("C", "GoString").Call(jen.Id("argsJSON")),
+		),
+		jen.Id("pendingMu").Dot("Lock").Call(),
+		jen.Defer().Id("pendingMu").Dot("Unlock").Call(),
+		jen.Id("nextResult").Op("++"),
+		jen.Id("pendingResults").Index(jen.Id("nextResult")).Op("=").Id("result"),
+		jen.Op("*").Id("size").Op("=").Qual("C", "longlong").Call(jen.Len(jen.Id("result"))),
+		jen.Return(jen.Qual("C", "longlong").Call(jen.Id("nextResult"))),
+	)
+	f.Line()
+
+	f.Comment("//export ReadResult")
+	f.Comment("// ReadResult copies up to n bytes of the response handle names into buf,")
+	f.Comment("// from where the last read stopped, and returns how many it copied. The")
+	f.Comment("// response is released once it has all been read; -1 means no such handle.")
+	f.Func().Id("ReadResult").Params(
+		jen.Id("handle").Qual("C", "longlong"),
+		jen.Id("buf").Op("*").Qual("C", "char"),
+		jen.Id("n").Qual("C", "longlong"),
+	).Qual("C", "longlong").Block(
+		jen.Id("pendingMu").Dot("Lock").Call(),
+		jen.Defer().Id("pendingMu").Dot("Unlock").Call(),
+		jen.List(jen.Id("rest"), jen.Id("ok")).Op(":=").Id("pendingResults").Index(jen.Int64().Call(jen.Id("handle"))),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Lit(-1)),
+		),
+		jen.Id("copied").Op(":=").Copy(
+			jen.Qual("unsafe", "Slice").Call(jen.Parens(jen.Op("*").Byte()).Parens(jen.Qual("unsafe", "Pointer").Call(jen.Id("buf"))), jen.Int().Call(jen.Id("n"))),
+			jen.Id("rest"),
+		),
+		jen.If(jen.Id("copied").Op("==").Len(jen.Id("rest"))).Block(
+			jen.Delete(jen.Id("pendingResults"), jen.Int64().Call(jen.Id("handle"))),
+		).Else().Block(
+			jen.Id("pendingResults").Index(jen.Int64().Call(jen.Id("handle"))).Op("=").Id("rest").Index(jen.Id("copied").Op(":")),
+		),
+		jen.Return(jen.Qual("C", "longlong").Call(jen.Id("copied"))),
+	)
 }
 
 // generatePluginHelpers generates helper functions for plugin mode
@@ -166,26 +262,33 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 			jen.List(jen.Id("home"), jen.Id("_")).Op(":=").Qual("os", "UserHomeDir").Call(),
 			jen.Id("dbPath").Op("=").Qual("path/filepath", "Join").Call(jen.Id("home"), jen.Lit(".trashtalk"), jen.Lit("instances.db")),
 		),
-		jen.Return(jen.Qual("database/sql", "Open").Call(jen.Lit("sqlite3"), jen.Id("dbPath"))),
+		jen.Return(jen.Qual("database/sql", "Open").Call(jen.Lit("sqlite3"), jen.Id("withBusyTimeout").Call(jen.Id("dbPath")))),
 	)
 	f.Line()
+	g.generateSharedDB(f)
+	g.generateStmtCache(f)
 
 	// loadInstance
 	f.Func().Id("loadInstance").Params(
 		jen.Id("db").Op("*").Qual("database/sql", "DB"),
 		jen.Id("id").String(),
-	).Parens(jen.List(jen.Op("*").Id(className), jen.Error())).Block(
-		jen.Var().Id("data").String(),
-		jen.Err().Op(":=").Id("db").Dot("QueryRow").Call(jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Id("id")).Dot("Scan").Call(jen.Op("&").Id("data")),
-		jen.If(jen.Err().Op("!=").Nil()).Block(
+	).Parens(jen.List(jen.Op("*").Id(className), jen.Error())).BlockFunc(func(grp *jen.Group) {
+		grp.Var().Id("data").String()
+		grp.Err().Op(":=").Id("_retryBusy").Call(jen.Func().Params().Error().Block(
+			jen.Return(jen.Id("dbQueryRow").Call(jen.Id("db"), jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Id("id")).Dot("Scan").Call(jen.Op("&").Id("data"))),
+		))
+		grp.If(jen.Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Nil(), jen.Err()),
-		),
-		jen.Var().Id("instance").Id(className),
-		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("instance")).Op(";").Err().Op("!=").Nil()).Block(
+		)
+		grp.Var().Id("instance").Id(className)
+		grp.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("instance")).Op(";").Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Nil(), jen.Err()),
-		),
-		jen.Return(jen.Op("&").Id("instance"), jen.Nil()),
-	)
+		)
+		for _, stmt := range g.migrateOnLoad(jen.Id("data")) {
+			grp.Add(stmt)
+		}
+		grp.Return(jen.Op("&").Id("instance"), jen.Nil())
+	})
 	f.Line()
 
 	// saveInstance
@@ -198,7 +301,8 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 		jen.If(jen.Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Err()),
 		),
-		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("db").Dot("Exec").Call(
+		jen.List(jen.Id("_"), jen.Err()).Op("=").Id("dbExec").Call(
+			jen.Id("db"),
 			jen.Lit("INSERT OR REPLACE INTO instances (id, data) VALUES (?, json(?))"),
 			jen.Id("id"),
 			jen.String().Parens(jen.Id("data")),
@@ -207,6 +311,9 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 	)
 	f.Line()
 
+	// dispatchWork - a dispatch as one unit of work
+	generatePluginWork(f)
+
 	// dispatchInternal - main entry point for plugin calls
 	// Returns a single JSON string with exit_code embedded to avoid struct return ABI issues
 	f.Func().Id("dispatchInternal").Params(
@@ -225,6 +332,8 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 				jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
 					jen.Return(jen.Lit(`{"exit_code":200}`)),
 				),
+				g.trashErrorResult(),
+				storageBusyResult(),
 				jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(`{"exit_code":1,"error":%q}`), jen.Err().Dot("Error").Call())),
 			),
 			jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(`{"result":%q,"exit_code":0}`), jen.Id("result"))),
@@ -235,6 +344,7 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("instanceJSON")), jen.Op("&").Id("instance")).Op(";").Err().Op("!=").Nil()).Block(
 			jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(`{"exit_code":1,"error":%q}`), jen.Err().Dot("Error").Call())),
 		),
+		g.pluginMigrate(jen.Id("instanceJSON")),
 		jen.Line(),
 		// Dispatch to instance method
 		jen.List(jen.Id("result"), jen.Err()).Op(":=").Id("dispatch").Call(jen.Op("&").Id("instance"), jen.Id("selector"), jen.Id("args")),
@@ -242,6 +352,8 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 			jen.If(jen.Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector"))).Block(
 				jen.Return(jen.Lit(`{"exit_code":200}`)),
 			),
+			g.trashErrorResult(),
+			storageBusyResult(),
 			jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(`{"exit_code":1,"error":%q}`), jen.Err().Dot("Error").Call())),
 		),
 		jen.Line(),
@@ -254,34 +366,18 @@ func (g *generator) generatePluginHelpers(f *jen.File) {
 	f.Line()
 
 	// sendMessage - shell out to bash runtime for non-self message sends
-	// Returns just string - errors are silently ignored to match bash behavior and simplify usage in expressions
-	f.Func().Id("sendMessage").Params(
-		jen.Id("receiver").Interface(),
-		jen.Id("selector").String(),
-		jen.Id("args").Op("...").Interface(),
-	).String().Block(
-		// Convert receiver to string
-		jen.Id("receiverStr").Op(":=").Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("receiver")),
-		// Build command args: @ receiver selector args...
-		jen.Id("cmdArgs").Op(":=").Index().String().Values(jen.Id("receiverStr"), jen.Id("selector")),
-		jen.For(jen.List(jen.Id("_"), jen.Id("arg")).Op(":=").Range().Id("args")).Block(
-			jen.Id("cmdArgs").Op("=").Append(jen.Id("cmdArgs"), jen.Qual("fmt", "Sprintf").Call(jen.Lit("%v"), jen.Id("arg"))),
-		),
-		// Find the trashtalk dispatch script
-		jen.List(jen.Id("home"), jen.Id("_")).Op(":=").Qual("os", "UserHomeDir").Call(),
-		jen.Id("dispatchScript").Op(":=").Qual("path/filepath", "Join").Call(jen.Id("home"), jen.Lit(".trashtalk"), jen.Lit("bin"), jen.Lit("trash-send")),
-		// Execute: trash-send receiver selector args...
-		jen.Id("cmd").Op(":=").Qual("os/exec", "Command").Call(jen.Id("dispatchScript"), jen.Id("cmdArgs").Op("...")),
-		jen.List(jen.Id("output"), jen.Id("_")).Op(":=").Id("cmd").Dot("Output").Call(),
-		jen.Return(jen.Qual("strings", "TrimSpace").Call(jen.String().Parens(jen.Id("output")))),
-	)
+	g.generateSendMessage(f)
+
+	// Reference ivar helpers (ref: declarations)
+	g.generateRefHelpers(f)
 }
 
-// generatePluginDispatch generates the internal dispatch switch for instance methods
-func (g *generator) generatePluginDispatch(f *jen.File, methods []*compiledMethod) {
+// generatePluginDispatch generates the internal dispatch function for
+// instance methods, returning the selectors it answers
+func (g *generator) generatePluginDispatch(f *jen.File, methods []*compiledMethod) []string {
 	className := g.class.Name
 
-	cases := []jen.Code{}
+	cases := g.refDispatchCases()
 	for _, m := range methods {
 		// Check if method name was renamed to avoid collision with ivar
 		// In Go, you can't have a struct field and method with the same name
@@ -289,132 +385,82 @@ func (g *generator) generatePluginDispatch(f *jen.File, methods []*compiledMetho
 		if g.instanceVars[m.selector] {
 			methodName = "Get" + methodName
 		}
+		cases = append(cases, methodDispatchCase(m, jen.Id("c").Dot(methodName).Call))
+	}
+	cases = append(cases, g.abstractDispatchCases()...)
+	cases = append(cases, g.accessorDispatchCases()...)
+	cases = append(cases, g.printingCases(cases, nil)...)
+	cases = append(cases, g.introspectionCases(cases, false)...)
 
-		var callExpr *jen.Statement
-		if len(m.args) > 0 {
-			// Check args length
-			argCheck := jen.If(jen.Len(jen.Id("args")).Op("<").Lit(len(m.args))).Block(
-				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(m.selector+" requires "+fmt.Sprintf("%d", len(m.args))+" argument"))),
-			)
-
-			// Build call with args
-			callArgs := []jen.Code{}
-			for i := range m.args {
-				callArgs = append(callArgs, jen.Id("args").Index(jen.Lit(i)))
-			}
-			callExpr = jen.Id("c").Dot(methodName).Call(callArgs...)
-
-			if m.returnsErr {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr),
-				))
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr, jen.Nil()),
-				))
-			}
-		} else {
-			callExpr = jen.Id("c").Dot(methodName).Call()
-			if m.hasReturn {
-				if m.returnsErr {
-					// Method returns (string, error) - don't add extra nil
-					cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-						jen.Return(callExpr),
-					))
-				} else {
-					// Method returns string only - add nil for error
-					cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-						jen.Return(callExpr, jen.Nil()),
-					))
-				}
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					callExpr,
-					jen.Return(jen.Lit(""), jen.Nil()),
-				))
-			}
-		}
+	g.generateDispatchFunc(f, "dispatch", []dispatchParam{{"c", jen.Op("*").Id(className)}}, cases)
+	return g.dispatchSelectors(cases)
+}
+
+// generatePluginClassDispatch generates the dispatch function for class
+// methods, returning the selectors it answers
+func (g *generator) generatePluginClassDispatch(f *jen.File, methods []*compiledMethod) []string {
+	var cases []dispatchCase
+	for _, m := range methods {
+		// Class methods are package-level functions
+		cases = append(cases, methodDispatchCase(m, jen.Id(m.goName).Call))
+	}
+	cases = append(cases, g.classQueryCases(methods)...)
+	if g.hasClassVars() {
+		cases = append(cases, g.classVarAccessorCases(methods)...)
 	}
+	cases = append(cases, g.introspectionCases(cases, true)...)
 
-	// Default case
-	cases = append(cases, jen.Default().Block(
-		jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrUnknownSelector"), jen.Id("selector"))),
-	))
+	// dispatchClass takes no instance receiver
+	if !g.hasClassVars() {
+		g.generateDispatchFunc(f, "dispatchClass", nil, cases)
+		return g.dispatchSelectors(cases)
+	}
+	g.generateDispatchFunc(f, "dispatchClassMethod", nil, cases)
+	f.Line()
+	g.generateClassVarsDispatch(f, "dispatchClassMethod")
+	return g.dispatchSelectors(cases)
+}
 
-	f.Func().Id("dispatch").Params(
-		jen.Id("c").Op("*").Id(className),
-		jen.Id("selector").String(),
-		jen.Id("args").Index().String(),
-	).Parens(jen.List(jen.String(), jen.Error())).Block(
-		jen.Switch(jen.Id("selector")).Block(cases...),
-	)
+// pluginClassInfo is the JSON GetClassInfo answers. The daemon reads name
+// and package into its alias table, like a manifest.json entry.
+type pluginClassInfo struct {
+	Name           string   `json:"name"`
+	Package        string   `json:"package,omitempty"`
+	Parent         string   `json:"parent,omitempty"`
+	Selectors      []string `json:"selectors"`
+	ClassSelectors []string `json:"classSelectors"`
+	Fallback       []string `json:"fallback"`
+	Hash           string   `json:"hash,omitempty"`
+	Compiler       string   `json:"compiler,omitempty"`
 }
 
-// generatePluginClassDispatch generates the dispatch switch for class methods
-func (g *generator) generatePluginClassDispatch(f *jen.File, methods []*compiledMethod) {
-	cases := []jen.Code{}
-	for _, m := range methods {
-		var callExpr *jen.Statement
-		if len(m.args) > 0 {
-			// Check args length
-			argCheck := jen.If(jen.Len(jen.Id("args")).Op("<").Lit(len(m.args))).Block(
-				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(m.selector+" requires "+fmt.Sprintf("%d", len(m.args))+" argument"))),
-			)
-
-			// Build call with args - class methods are package-level functions
-			callArgs := []jen.Code{}
-			for i := range m.args {
-				callArgs = append(callArgs, jen.Id("args").Index(jen.Lit(i)))
-			}
-			callExpr = jen.Id(m.goName).Call(callArgs...)
-
-			if m.returnsErr {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr),
-				))
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					argCheck,
-					jen.Return(callExpr, jen.Nil()),
-				))
-			}
-		} else {
-			// No args - direct call to package-level function
-			callExpr = jen.Id(m.goName).Call()
-			if m.hasReturn {
-				if m.returnsErr {
-					// Method returns (string, error) - don't add extra nil
-					cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-						jen.Return(callExpr),
-					))
-				} else {
-					// Method returns string only - add nil for error
-					cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-						jen.Return(callExpr, jen.Nil()),
-					))
-				}
-			} else {
-				cases = append(cases, jen.Case(jen.Lit(m.selector)).Block(
-					callExpr,
-					jen.Return(jen.Lit(""), jen.Nil()),
-				))
-			}
+// generateClassInfoExport generates GetClassInfo, describing the class to
+// the daemon: the selectors dispatch and dispatchClass answer natively, the
+// methods left to Bash, which answer exit 200, and the source hash and
+// procyon version when Options gives them
+func (g *generator) generateClassInfoExport(f *jen.File, selectors, classSelectors []string) {
+	info := pluginClassInfo{
+		Name:           g.class.Name,
+		Package:        g.class.Package,
+		Parent:         g.class.Parent,
+		Selectors:      selectors,
+		ClassSelectors: classSelectors,
+		Fallback:       []string{},
+		Hash:           g.sourceHash,
+		Compiler:       g.generatorVersion,
+	}
+	seen := map[string]bool{}
+	for _, s := range g.skipped {
+		if !seen[s.Selector] {
+			seen[s.Selector] = true
+			info.Fallback = append(info.Fallback, s.Selector)
 		}
 	}
+	sort.Strings(info.Fallback)
+	data, _ := json.Marshal(info)
 
-	// Default case
-	cases = append(cases, jen.Default().Block(
-		jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrUnknownSelector"), jen.Id("selector"))),
-	))
-
-	// dispatchClass takes no instance receiver
-	f.Func().Id("dispatchClass").Params(
-		jen.Id("selector").String(),
-		jen.Id("args").Index().String(),
-	).Parens(jen.List(jen.String(), jen.Error())).Block(
-		jen.Switch(jen.Id("selector")).Block(cases...),
+	f.Comment("//export GetClassInfo")
+	f.Func().Id("GetClassInfo").Params().Op("*").Qual("C", "char").Block(
+		jen.Return(jen.Qual("C", "CString").Call(jen.Lit(string(data)))),
 	)
 }
@@ -116,11 +116,11 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 			),
 			jen.Line(),
 			jen.Comment("Create instance in database"),
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Id("instance").Op(":=").Op("&").Id("File").Values(jen.Dict{
 				jen.Id("Class"):     jen.Lit("File"),
@@ -128,7 +128,7 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 				jen.Id("Path"):      jen.Id("filepath"),
 			}),
 			jen.Line(),
-			jen.If(jen.Err().Op(":=").Id("saveInstance").Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.If(jen.Err().Op(":=").Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
 			jen.Return(jen.Id("id"), jen.Nil()),
@@ -154,11 +154,11 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 			),
 			jen.Line(),
 			jen.Comment("Create instance in database"),
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Id("instance").Op(":=").Op("&").Id("File").Values(jen.Dict{
 				jen.Id("Class"):     jen.Lit("File"),
@@ -166,7 +166,7 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 				jen.Id("Path"):      jen.Id("tmpfile").Dot("Name").Call(),
 			}),
 			jen.Line(),
-			jen.If(jen.Err().Op(":=").Id("saveInstance").Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.If(jen.Err().Op(":=").Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
 			jen.Return(jen.Id("id"), jen.Nil()),
@@ -192,11 +192,11 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 			),
 			jen.Line(),
 			jen.Comment("Create instance in database"),
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Id("instance").Op(":=").Op("&").Id("File").Values(jen.Dict{
 				jen.Id("Class"):     jen.Lit("File"),
@@ -204,7 +204,7 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 				jen.Id("Path"):      jen.Id("tmpfile").Dot("Name").Call(),
 			}),
 			jen.Line(),
-			jen.If(jen.Err().Op(":=").Id("saveInstance").Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.If(jen.Err().Op(":=").Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
 			jen.Return(jen.Id("id"), jen.Nil()),
@@ -231,11 +231,11 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 			),
 			jen.Line(),
 			jen.Comment("Create instance in database"),
-			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+			jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
 			jen.If(jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
-			jen.Defer().Id("db").Dot("Close").Call(),
+			jen.Defer().Id("releaseDB").Call(jen.Id("db")),
 			jen.Line(),
 			jen.Id("instance").Op(":=").Op("&").Id("File").Values(jen.Dict{
 				jen.Id("Class"):     jen.Lit("File"),
@@ -243,7 +243,7 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 				jen.Id("Path"):      jen.Id("filepath"),
 			}),
 			jen.Line(),
-			jen.If(jen.Err().Op(":=").Id("saveInstance").Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.If(jen.Err().Op(":=").Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance")), jen.Err().Op("!=").Nil()).Block(
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
 			jen.Return(jen.Id("id"), jen.Nil()),
@@ -482,6 +482,7 @@ func (g *generator) generatePrimitiveMethodFile(f *jen.File, m *compiledMethod)
 				jen.Return(jen.Lit(""), jen.Err()),
 			),
 			jen.Id("c").Dot("Path").Op("=").Id("destPath"),
+			jen.Id("c").Dot("dirty").Op("=").True(),
 			jen.Return(jen.Lit(""), jen.Nil()),
 		)
 		f.Line()
@@ -0,0 +1,46 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the default printing selectors of every compiled
+// class: printString, asJSON and inspect. A class defining a method with
+// the same selector keeps its own.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// printingCases returns the default cases of the printing selectors, as
+// defaultInstanceCases leaves them:
+//
+//   - printString answers <Class id ivar: value ...> on one line
+//   - asJSON answers the instance marshaled as it is stored
+//   - inspect answers the class and ID, then each instance variable on a
+//     line of its own
+//
+// id is the instance ID parameter of the dispatch function. Plugins, whose
+// dispatch is not given the ID, pass nil and leave printString and inspect
+// to Bash.
+func (g *generator) printingCases(cases []dispatchCase, id jen.Code) []dispatchCase {
+	qualifiedName := g.class.QualifiedName()
+	var candidates []dispatchCase
+	if id != nil {
+		printString := jen.Lit("<" + qualifiedName + " ").Op("+").Add(id)
+		inspect := jen.Lit(qualifiedName + " ").Op("+").Add(id)
+		for _, iv := range g.class.InstanceVars {
+			printString = printString.Op("+").Lit(" " + iv.Name + ": ").Op("+").Add(g.ivarString(iv.Name))
+			inspect = inspect.Op("+").Lit("\n  " + iv.Name + ": ").Op("+").Add(g.ivarString(iv.Name))
+		}
+		candidates = append(candidates,
+			dispatchCase{"printString", []jen.Code{jen.Return(printString.Op("+").Lit(">"), jen.Nil())}},
+			dispatchCase{"inspect", []jen.Code{jen.Return(inspect, jen.Nil())}},
+		)
+	}
+	candidates = append(candidates, dispatchCase{"asJSON", []jen.Code{
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("c")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.Return(jen.String().Parens(jen.Id("data")), jen.Nil()),
+	}})
+
+	return g.defaultInstanceCases(cases, candidates)
+}
@@ -0,0 +1,851 @@
+// Package codegen provides code generation backends for Trashtalk IR.
+// This file implements the Python backend, producing a Python module from IR.
+package codegen
+
+import (
+	_ "embed"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ir"
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// pythonRuntime is the start of every generated module: value semantics,
+// JSON and String primitives, SQLite storage and the dispatch protocol
+//
+//go:embed python_runtime.py
+var pythonRuntime string
+
+// PythonBackend generates a Python 3 module from Trashtalk IR, needing
+// nothing beyond the standard library. The module speaks the dispatch
+// protocol of Go binaries: "Counter.py <instance_id> <selector> [args...]" or
+// --serve, with the same exit codes, and keeps instances in the Bash
+// runtime's SQLite database. Methods it cannot translate are left out, so
+// that dispatching them exits 200 and falls back to Bash; Warnings names them.
+type PythonBackend struct {
+	prog     *ir.Program
+	buf      strings.Builder
+	indent   int
+	warnings []string
+	skipped  []SkippedMethod
+	compiled map[string]bool // "instance sel" and "class sel" of the methods generated
+	method   *ir.Method
+	scopes   []map[string]bool // names bound in the method and each enclosing block
+	blocks   int
+	inBlock  int
+}
+
+// pythonUnsupported reports a construct a method uses that the Python
+// backend leaves to Bash
+type pythonUnsupported struct {
+	reason string
+}
+
+func (e *pythonUnsupported) Error() string {
+	return e.reason
+}
+
+// pythonStringOps are the String primitives the runtime's _string implements
+var pythonStringOps = map[string]bool{
+	"stringIsEmpty": true, "stringNotEmpty": true, "stringLength": true,
+	"stringUppercase": true, "stringLowercase": true, "stringTrim": true,
+	"stringContains": true, "stringStartsWith": true, "stringEndsWith": true,
+	"stringEquals": true, "stringTrimPrefix": true, "stringTrimSuffix": true,
+	"stringConcat": true, "stringReplace": true, "stringReplaceAll": true,
+	"stringSubstring": true,
+}
+
+// pythonJSONOps are the JSON primitives the runtime's _json implements
+var pythonJSONOps = map[string]bool{
+	"arrayLength": true, "arrayIsEmpty": true, "arrayFirst": true, "arrayLast": true,
+	"arrayAt": true, "arrayPush": true, "arrayAtPut": true, "arrayRemoveAt": true,
+	"objectAt": true, "objectHasKey": true, "objectAtPut": true, "objectRemoveKey": true,
+	"objectMerge": true, "objectDeepMerge": true, "objectEquals": true,
+	"arraySort": true, "arraySortNumeric": true, "arrayReverse": true, "arrayUnique": true,
+	"arrayJoin": true, "jsonAtPath": true, "jsonSetPathPut": true,
+	"objectLength": true, "objectIsEmpty": true, "objectKeys": true, "objectValues": true,
+}
+
+// pythonKeywords are the Python keywords, and self, which Trashtalk
+// variables are renamed away from with a trailing underscore
+var pythonKeywords = map[string]bool{
+	"False": true, "None": true, "True": true, "and": true, "as": true, "assert": true,
+	"async": true, "await": true, "break": true, "class": true, "continue": true,
+	"def": true, "del": true, "elif": true, "else": true, "except": true,
+	"finally": true, "for": true, "from": true, "global": true, "if": true,
+	"import": true, "in": true, "is": true, "lambda": true, "nonlocal": true,
+	"not": true, "or": true, "pass": true, "raise": true, "return": true,
+	"try": true, "while": true, "with": true, "yield": true, "self": true,
+}
+
+var pythonNonIdent = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// NewPythonBackend creates a new Python code generator.
+func NewPythonBackend() *PythonBackend {
+	return &PythonBackend{}
+}
+
+// Generate produces a Python module from a Trashtalk IR Program.
+func (p *PythonBackend) Generate(prog *ir.Program) (string, error) {
+	p.prog = prog
+	p.warnings = nil
+	p.skipped = nil
+
+	// A first pass finds the methods that translate, so that self sends
+	// call them directly and send the others through the runtime
+	p.compiled = map[string]bool{}
+	for i := range prog.Methods {
+		m := &prog.Methods[i]
+		p.compiled[pythonMethodKey(m.Kind, m.Selector)] = true
+	}
+	for i := range prog.Methods {
+		m := &prog.Methods[i]
+		if _, err := p.methodCode(m); err != nil {
+			if _, ok := err.(*pythonUnsupported); !ok {
+				return "", fmt.Errorf("generating method %s: %w", m.Selector, err)
+			}
+			delete(p.compiled, pythonMethodKey(m.Kind, m.Selector))
+			p.warnings = append(p.warnings, fmt.Sprintf("method %s falls back to Bash: %s", m.Selector, err))
+			p.skipped = append(p.skipped, SkippedMethod{Selector: m.Selector, Reason: err.Error()})
+		}
+	}
+	var methods []string
+	for i := range prog.Methods {
+		m := &prog.Methods[i]
+		if p.compiled[pythonMethodKey(m.Kind, m.Selector)] {
+			code, err := p.methodCode(m)
+			if err != nil {
+				return "", fmt.Errorf("generating method %s: %w", m.Selector, err)
+			}
+			methods = append(methods, code)
+		}
+	}
+
+	p.buf.Reset()
+	p.indent = 0
+	p.writeln("#!/usr/bin/env python3")
+	p.writeln("# Generated by Trashtalk Compiler (procyon) - DO NOT EDIT")
+	p.writef("# Source: %s.trash\n", prog.Name)
+	p.writeln("")
+	p.buf.WriteString(pythonRuntime)
+	p.writeln("")
+	p.writeln("")
+	p.writef("# === %s ===\n", p.qualifiedName())
+	p.writeln("")
+	p.generateMetadata()
+	p.writeln("")
+	p.writeln("")
+
+	p.writef("class %s(_Instance):\n", p.instanceClass())
+	p.indent++
+	p.writef("\"\"\"An instance of %s\"\"\"\n", p.qualifiedName())
+	for _, code := range methods {
+		p.writeln("")
+		p.buf.WriteString(code)
+	}
+	p.indent--
+	p.writeln("")
+	p.writeln("")
+	p.generateDispatchTables()
+	p.writeln("")
+	p.writeln("if __name__ == \"__main__\":")
+	p.writeln("    sys.exit(_main(sys.argv[1:]))")
+	return p.buf.String(), nil
+}
+
+// Warnings returns the methods the last Generate left to Bash, and why.
+func (p *PythonBackend) Warnings() []string {
+	return p.warnings
+}
+
+// SkippedMethods returns the methods the last Generate left to Bash.
+func (p *PythonBackend) SkippedMethods() []SkippedMethod {
+	return p.skipped
+}
+
+func pythonMethodKey(kind ir.MethodKind, selector string) string {
+	return kind.String() + " " + selector
+}
+
+// qualifiedName returns the class name instances record
+func (p *PythonBackend) qualifiedName() string {
+	if p.prog.QualifiedName != "" {
+		return p.prog.QualifiedName
+	}
+	return mangle.Qualify(p.prog.Package, p.prog.Name)
+}
+
+// instanceClass returns the name of the Python class of instances
+func (p *PythonBackend) instanceClass() string {
+	return mangle.CompiledClass(p.qualifiedName()) + "Instance"
+}
+
+// pythonFuncName returns the name of a method's Python function
+func pythonFuncName(m *ir.Method) string {
+	prefix := "m_"
+	if m.Kind == ir.ClassMethod {
+		prefix = "c_"
+	}
+	return prefix + pythonNonIdent.ReplaceAllString(m.Selector, "_")
+}
+
+// pythonIdent returns the Python name of a Trashtalk variable
+func pythonIdent(name string) string {
+	name = pythonNonIdent.ReplaceAllString(name, "_")
+	if pythonKeywords[name] {
+		return name + "_"
+	}
+	return name
+}
+
+// generateMetadata writes the constants the runtime reads
+func (p *PythonBackend) generateMetadata() {
+	p.writef("_CLASS_NAME = %s\n", strconv.Quote(p.prog.Name))
+	p.writef("_QUALIFIED_NAME = %s\n", strconv.Quote(p.qualifiedName()))
+	p.writef("_PARENT = %s\n", strconv.Quote(p.prog.Parent))
+	p.writeln("_INSTANCE_VARS = [")
+	for _, iv := range p.prog.InstanceVars {
+		p.writef("    (%s, %s),\n", strconv.Quote(iv.Name), strconv.Quote(iv.Default.Raw))
+	}
+	p.writeln("]")
+	p.writeln("_CLASS_VARS = {")
+	for _, cv := range p.prog.ClassVars {
+		p.writef("    %s: %s,\n", strconv.Quote(cv.Name), strconv.Quote(cv.Default.Raw))
+	}
+	p.writeln("}")
+	p.writef("_SOURCE = %s\n", strconv.Quote(p.prog.SourceCode))
+}
+
+// generateDispatchTables writes the selectors dispatch calls, with their
+// number of arguments
+func (p *PythonBackend) generateDispatchTables() {
+	p.writef("_INSTANCE_CLASS = %s\n", p.instanceClass())
+	for _, kind := range []ir.MethodKind{ir.InstanceMethod, ir.ClassMethod} {
+		table := "_METHODS"
+		if kind == ir.ClassMethod {
+			table = "_CLASS_METHODS"
+		}
+		var lines []string
+		for i := range p.prog.Methods {
+			m := &p.prog.Methods[i]
+			if m.Kind == kind && p.compiled[pythonMethodKey(m.Kind, m.Selector)] {
+				lines = append(lines, fmt.Sprintf("    %s: (%s.%s, %d),", strconv.Quote(m.Selector), p.instanceClass(), pythonFuncName(m), len(m.Args)))
+			}
+		}
+		if len(lines) == 0 {
+			p.writef("%s = {}\n", table)
+			continue
+		}
+		p.writef("%s = {\n", table)
+		for _, line := range lines {
+			p.writeln(line)
+		}
+		p.writeln("}")
+	}
+}
+
+// methodCode returns a method's definition inside the instance class
+func (p *PythonBackend) methodCode(m *ir.Method) (string, error) {
+	if m.IsRaw || !m.CanCompile {
+		reason := m.FallbackReason
+		if reason == "" {
+			reason = "raw method requires Bash"
+		}
+		return "", &pythonUnsupported{reason: reason}
+	}
+
+	saved := p.buf
+	p.buf = strings.Builder{}
+	defer func() { p.buf = saved }()
+	p.method = m
+	p.indent = 1
+	p.blocks = 0
+	p.inBlock = 0
+
+	params := make([]string, 0, len(m.Args)+1)
+	scope := map[string]bool{}
+	if m.Kind == ir.ClassMethod {
+		p.writeln("@staticmethod")
+	} else {
+		params = append(params, "self")
+	}
+	for _, arg := range m.Args {
+		params = append(params, pythonIdent(arg.Name))
+		scope[arg.Name] = true
+	}
+	p.writef("def %s(%s):\n", pythonFuncName(m), strings.Join(params, ", "))
+	p.indent++
+
+	// Locals, and variables assigned without being declared, start as nil
+	var locals []string
+	for _, l := range m.Locals {
+		locals = append(locals, l.Name)
+	}
+	locals = append(locals, assignedNames(m.Body)...)
+	for _, name := range locals {
+		if !scope[name] {
+			scope[name] = true
+			p.writef("%s = None\n", pythonIdent(name))
+		}
+	}
+	p.scopes = []map[string]bool{scope}
+
+	// A ^ inside a block returns from the method through _Return
+	frame := blocksReturn(m.Body)
+	if frame {
+		p.writeln("_frame = object()")
+		p.writeln("try:")
+		p.indent++
+	}
+	start := p.buf.Len()
+	if err := p.generateStatements(m.Body); err != nil {
+		return "", err
+	}
+	if p.buf.Len() == start {
+		p.writeln("pass")
+	}
+	if frame {
+		p.indent--
+		p.writeln("except _Return as r:")
+		p.writeln("    if r.frame is not _frame:")
+		p.writeln("        raise")
+		p.writeln("    return r.value")
+	}
+	return p.buf.String(), nil
+}
+
+// assignedNames returns the local variables set in stmts outside blocks: the
+// targets of local assignments and loop variables
+func assignedNames(stmts []ir.Statement) []string {
+	var names []string
+	var walk func([]ir.Statement)
+	walk = func(stmts []ir.Statement) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *ir.AssignStmt:
+				if s.Kind == ir.AssignLocal {
+					names = append(names, s.Target)
+				}
+			case *ir.IfStmt:
+				walk(s.ThenBlock)
+				walk(s.ElseBlock)
+			case *ir.WhileStmt:
+				walk(s.Body)
+			case *ir.ForEachStmt:
+				names = append(names, s.IterVar)
+				walk(s.Body)
+			}
+		}
+	}
+	walk(stmts)
+	return names
+}
+
+// blocksReturn reports whether a block in stmts contains a ^
+func blocksReturn(stmts []ir.Statement) bool {
+	found := false
+	var inExpr func(ir.Expression, bool)
+	var inStmts func([]ir.Statement, bool)
+	inStmts = func(stmts []ir.Statement, block bool) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *ir.AssignStmt:
+				inExpr(s.Value, block)
+			case *ir.ReturnStmt:
+				if block {
+					found = true
+				}
+				inExpr(s.Value, block)
+			case *ir.ExprStmt:
+				inExpr(s.Expr, block)
+			case *ir.IfStmt:
+				inExpr(s.Condition, block)
+				inStmts(s.ThenBlock, block)
+				inStmts(s.ElseBlock, block)
+			case *ir.WhileStmt:
+				inExpr(s.Condition, block)
+				inStmts(s.Body, block)
+			case *ir.ForEachStmt:
+				inExpr(s.Collection, block)
+				inStmts(s.Body, block)
+			}
+		}
+	}
+	inExpr = func(expr ir.Expression, block bool) {
+		switch e := expr.(type) {
+		case *ir.BlockExpr:
+			inStmts(e.Body, true)
+		case *ir.BinaryExpr:
+			inExpr(e.Left, block)
+			inExpr(e.Right, block)
+		case *ir.UnaryExpr:
+			inExpr(e.Operand, block)
+		case *ir.CondExpr:
+			inExpr(e.Condition, block)
+			inExpr(e.Then, block)
+			inExpr(e.Else, block)
+		case *ir.MessageSendExpr:
+			inExpr(e.Receiver, block)
+			for _, arg := range e.Args {
+				inExpr(arg, block)
+			}
+		case *ir.JSONPrimitiveExpr:
+			inExpr(e.Receiver, block)
+			for _, arg := range e.Args {
+				inExpr(arg, block)
+			}
+		case *ir.ClassPrimitiveExpr:
+			for _, arg := range e.Args {
+				inExpr(arg, block)
+			}
+		}
+	}
+	inStmts(stmts, false)
+	return found
+}
+
+// bound reports whether name is a variable of the method or an enclosing
+// block
+func (p *PythonBackend) bound(name string) bool {
+	for _, scope := range p.scopes {
+		if scope[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PythonBackend) generateStatements(stmts []ir.Statement) error {
+	for _, stmt := range stmts {
+		if err := p.generateStatement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateBody writes the statements of an if, while or for, or pass
+func (p *PythonBackend) generateBody(stmts []ir.Statement) error {
+	p.indent++
+	defer func() { p.indent-- }()
+	start := p.buf.Len()
+	if err := p.generateStatements(stmts); err != nil {
+		return err
+	}
+	if p.buf.Len() == start {
+		p.writeln("pass")
+	}
+	return nil
+}
+
+func (p *PythonBackend) generateStatement(stmt ir.Statement) error {
+	switch s := stmt.(type) {
+	case *ir.AssignStmt:
+		value, err := p.generateExpr(s.Value)
+		if err != nil {
+			return err
+		}
+		switch {
+		case s.Kind == ir.AssignLocal || p.bound(s.Target):
+			p.writef("%s = %s\n", pythonIdent(s.Target), value)
+		case s.Kind == ir.AssignIVar:
+			if p.method.Kind == ir.ClassMethod {
+				return &pythonUnsupported{reason: "class method assigns instance variable " + s.Target}
+			}
+			p.writef("self.set(%s, %s)\n", strconv.Quote(s.Target), value)
+		default:
+			p.writef("_set_classvar(%s, %s)\n", strconv.Quote(s.Target), value)
+		}
+
+	case *ir.ReturnStmt:
+		value := "None"
+		if s.Value != nil {
+			v, err := p.generateExpr(s.Value)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		if p.inBlock > 0 {
+			p.writef("raise _Return(_frame, %s)\n", value)
+		} else {
+			p.writef("return %s\n", value)
+		}
+
+	case *ir.ExprStmt:
+		value, err := p.generateExpr(s.Expr)
+		if err != nil {
+			return err
+		}
+		p.writeln(value)
+
+	case *ir.IfStmt:
+		cond, err := p.generateExpr(s.Condition)
+		if err != nil {
+			return err
+		}
+		p.writef("if _truthy(%s):\n", cond)
+		if err := p.generateBody(s.ThenBlock); err != nil {
+			return err
+		}
+		if len(s.ElseBlock) > 0 {
+			p.writeln("else:")
+			if err := p.generateBody(s.ElseBlock); err != nil {
+				return err
+			}
+		}
+
+	case *ir.WhileStmt:
+		cond, err := p.generateExpr(s.Condition)
+		if err != nil {
+			return err
+		}
+		p.writef("while _truthy(%s):\n", cond)
+		return p.generateBody(s.Body)
+
+	case *ir.ForEachStmt:
+		coll, err := p.generateExpr(s.Collection)
+		if err != nil {
+			return err
+		}
+		p.writef("for %s in _to_array(%s):\n", pythonIdent(s.IterVar), coll)
+		return p.generateBody(s.Body)
+
+	case *ir.BashStmt:
+		return &pythonUnsupported{reason: s.Reason}
+
+	default:
+		return fmt.Errorf("unsupported statement type: %T", stmt)
+	}
+	return nil
+}
+
+func (p *PythonBackend) generateExprs(exprs []ir.Expression) ([]string, error) {
+	out := make([]string, len(exprs))
+	for i, expr := range exprs {
+		v, err := p.generateExpr(expr)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// generateExpr returns a Python expression. Blocks are written as functions
+// before the statement that uses them.
+func (p *PythonBackend) generateExpr(expr ir.Expression) (string, error) {
+	switch e := expr.(type) {
+	case *ir.LiteralExpr:
+		return pythonLiteral(e), nil
+
+	case *ir.VarRefExpr:
+		if p.bound(e.Name) {
+			return pythonIdent(e.Name), nil
+		}
+		switch e.Kind {
+		case ir.VarIVar:
+			if p.method.Kind == ir.ClassMethod {
+				return "", &pythonUnsupported{reason: "class method reads instance variable " + e.Name}
+			}
+			return fmt.Sprintf("self.get(%s)", strconv.Quote(e.Name)), nil
+		case ir.VarClassVar:
+			return fmt.Sprintf("_classvar(%s)", strconv.Quote(e.Name)), nil
+		case ir.VarGlobal:
+			return "", &pythonUnsupported{reason: "Bash global " + e.Name}
+		}
+		// Unknown variables are nil
+		return "None", nil
+
+	case *ir.SelfExpr:
+		if p.method.Kind == ir.ClassMethod {
+			return "_QUALIFIED_NAME", nil
+		}
+		return "self.id", nil
+
+	case *ir.ClassRefExpr:
+		return strconv.Quote(e.FullName()), nil
+
+	case *ir.BinaryExpr:
+		left, err := p.generateExpr(e.Left)
+		if err != nil {
+			return "", err
+		}
+		right, err := p.generateExpr(e.Right)
+		if err != nil {
+			return "", err
+		}
+		switch e.Op {
+		case "&&":
+			return fmt.Sprintf("(_truthy(%s) and _truthy(_force(%s)))", left, right), nil
+		case "||":
+			return fmt.Sprintf("(_truthy(%s) or _truthy(_force(%s)))", left, right), nil
+		case ",":
+			return fmt.Sprintf("(_to_str(%s) + _to_str(%s))", left, right), nil
+		case "+", "-", "*", "/":
+			return fmt.Sprintf("_arith(%q, %s, %s)", e.Op, left, right), nil
+		case "%":
+			return fmt.Sprintf("_mod(%s, %s)", left, right), nil
+		case "==", "!=", "<", ">", "<=", ">=":
+			return fmt.Sprintf("_compare(%q, %s, %s)", e.Op, left, right), nil
+		}
+		return "", fmt.Errorf("unknown operator %s", e.Op)
+
+	case *ir.UnaryExpr:
+		operand, err := p.generateExpr(e.Operand)
+		if err != nil {
+			return "", err
+		}
+		if e.Op != "!" {
+			return "", fmt.Errorf("unknown unary operator %s", e.Op)
+		}
+		return fmt.Sprintf("(not _truthy(%s))", operand), nil
+
+	case *ir.CondExpr:
+		cond, err := p.generateExpr(e.Condition)
+		if err != nil {
+			return "", err
+		}
+		then, err := p.generateExpr(e.Then)
+		if err != nil {
+			return "", err
+		}
+		els, err := p.generateExpr(e.Else)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s if _truthy(%s) else %s)", then, cond, els), nil
+
+	case *ir.MessageSendExpr:
+		return p.generateSend(e)
+
+	case *ir.BlockExpr:
+		return p.generateBlock(e)
+
+	case *ir.JSONPrimitiveExpr:
+		if !pythonJSONOps[e.Operation] {
+			return "", &pythonUnsupported{reason: e.Operation + " requires Bash"}
+		}
+		receiver, err := p.generateExpr(e.Receiver)
+		if err != nil {
+			return "", err
+		}
+		args, err := p.generateExprs(e.Args)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("_json(%s)", strings.Join(append([]string{strconv.Quote(e.Operation), receiver}, args...), ", ")), nil
+
+	case *ir.ClassPrimitiveExpr:
+		if !pythonStringOps[e.Operation] {
+			return "", &pythonUnsupported{reason: fmt.Sprintf("@ %s %s requires Bash", e.ClassName, e.Operation)}
+		}
+		args, err := p.generateExprs(e.Args)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("_string(%s)", strings.Join(append([]string{strconv.Quote(e.Operation)}, args...), ", ")), nil
+
+	case *ir.SubshellExpr:
+		return "", &pythonUnsupported{reason: "subshell requires Bash"}
+	}
+	return "", fmt.Errorf("unsupported expression type: %T", expr)
+}
+
+// pythonLiteral returns a literal as Python
+func pythonLiteral(e *ir.LiteralExpr) string {
+	switch v := e.Value.(type) {
+	case nil:
+		return "None"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s
+	case string:
+		// String literals keep their source quotes for the Bash backend
+		if e.Type_ == ir.TypeString && len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		return strconv.Quote(v)
+	}
+	return strconv.Quote(fmt.Sprintf("%v", e.Value))
+}
+
+// generateSend returns a message send: a direct call for self sends and
+// sends to the class of methods this module defines, through the runtime
+// otherwise
+func (p *PythonBackend) generateSend(e *ir.MessageSendExpr) (string, error) {
+	args, err := p.generateExprs(e.Args)
+	if err != nil {
+		return "", err
+	}
+	call := func(fn string) string {
+		return fmt.Sprintf("%s(%s)", fn, strings.Join(args, ", "))
+	}
+	runtime := func(receiver string) string {
+		return fmt.Sprintf("_send_runtime(%s)", strings.Join(append([]string{receiver, strconv.Quote(e.Selector)}, args...), ", "))
+	}
+	classMethod := func() string {
+		if e.Selector == "new" && !p.defines(ir.ClassMethod, "new") {
+			return "_new()"
+		}
+		if p.compiled[pythonMethodKey(ir.ClassMethod, e.Selector)] {
+			return call(p.instanceClass() + "." + pythonFuncName(&ir.Method{Kind: ir.ClassMethod, Selector: e.Selector}))
+		}
+		return runtime("_QUALIFIED_NAME")
+	}
+
+	if e.IsSelfSend {
+		if p.method.Kind == ir.ClassMethod {
+			return classMethod(), nil
+		}
+		if p.compiled[pythonMethodKey(ir.InstanceMethod, e.Selector)] {
+			return call("self." + pythonFuncName(&ir.Method{Selector: e.Selector})), nil
+		}
+		return runtime("self.id"), nil
+	}
+	if e.IsClassSend {
+		if e.TargetClass == p.qualifiedName() || e.TargetClass == p.prog.Name {
+			return classMethod(), nil
+		}
+		return runtime(strconv.Quote(e.TargetClass)), nil
+	}
+
+	receiver, err := p.generateExpr(e.Receiver)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("_send(%s)", strings.Join(append([]string{receiver, strconv.Quote(e.Selector)}, args...), ", ")), nil
+}
+
+// defines reports whether the class defines a method
+func (p *PythonBackend) defines(kind ir.MethodKind, selector string) bool {
+	for _, m := range p.prog.Methods {
+		if m.Kind == kind && m.Selector == selector {
+			return true
+		}
+	}
+	return false
+}
+
+// generateBlock writes a block as a function and returns its name. The
+// function answers the value of its last statement; variables it assigns
+// that the method or an enclosing block declares are nonlocal.
+func (p *PythonBackend) generateBlock(e *ir.BlockExpr) (string, error) {
+	p.blocks++
+	name := fmt.Sprintf("_block%d", p.blocks)
+	params := make([]string, 0, len(e.Params)+1)
+	scope := map[string]bool{}
+	for _, param := range e.Params {
+		params = append(params, pythonIdent(param)+"=None")
+		scope[param] = true
+	}
+	params = append(params, "*_")
+	p.writef("def %s(%s):\n", name, strings.Join(params, ", "))
+	p.indent++
+
+	var nonlocal, locals []string
+	seen := map[string]bool{}
+	for _, s := range blockAssigned(e.Body) {
+		if scope[s.Target] || seen[s.Target] {
+			continue
+		}
+		switch {
+		case p.bound(s.Target):
+			nonlocal = append(nonlocal, pythonIdent(s.Target))
+		case s.Kind == ir.AssignLocal:
+			locals = append(locals, s.Target)
+		default:
+			// An instance or class variable
+			continue
+		}
+		seen[s.Target] = true
+	}
+	if len(nonlocal) > 0 {
+		sort.Strings(nonlocal)
+		p.writef("nonlocal %s\n", strings.Join(nonlocal, ", "))
+	}
+	for _, local := range locals {
+		scope[local] = true
+		p.writef("%s = None\n", pythonIdent(local))
+	}
+
+	p.scopes = append(p.scopes, scope)
+	p.inBlock++
+	defer func() {
+		p.scopes = p.scopes[:len(p.scopes)-1]
+		p.inBlock--
+		p.indent--
+	}()
+
+	for i, stmt := range e.Body {
+		if es, ok := stmt.(*ir.ExprStmt); ok && i == len(e.Body)-1 {
+			value, err := p.generateExpr(es.Expr)
+			if err != nil {
+				return "", err
+			}
+			p.writef("return %s\n", value)
+			return name, nil
+		}
+		if err := p.generateStatement(stmt); err != nil {
+			return "", err
+		}
+	}
+	p.writeln("return None")
+	return name, nil
+}
+
+// blockAssigned returns the assignments of a block's statements, outside
+// nested blocks, with loop variables as local assignments
+func blockAssigned(stmts []ir.Statement) []*ir.AssignStmt {
+	var assigns []*ir.AssignStmt
+	var walk func([]ir.Statement)
+	walk = func(stmts []ir.Statement) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *ir.AssignStmt:
+				assigns = append(assigns, s)
+			case *ir.IfStmt:
+				walk(s.ThenBlock)
+				walk(s.ElseBlock)
+			case *ir.WhileStmt:
+				walk(s.Body)
+			case *ir.ForEachStmt:
+				assigns = append(assigns, &ir.AssignStmt{Target: s.IterVar, Kind: ir.AssignLocal})
+				walk(s.Body)
+			}
+		}
+	}
+	walk(stmts)
+	return assigns
+}
+
+// writeln writes a line with current indentation
+func (p *PythonBackend) writeln(s string) {
+	if s != "" {
+		p.buf.WriteString(strings.Repeat("    ", p.indent))
+	}
+	p.buf.WriteString(s)
+	p.buf.WriteString("\n")
+}
+
+// writef writes a formatted string with current indentation
+func (p *PythonBackend) writef(format string, args ...interface{}) {
+	p.buf.WriteString(strings.Repeat("    ", p.indent))
+	fmt.Fprintf(&p.buf, format, args...)
+}
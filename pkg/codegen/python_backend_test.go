@@ -0,0 +1,196 @@
+package codegen_test
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/ir"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+const ledgerSrc = `Ledger subclass: Object
+  instanceVars: items:'[]' total:0 name:'ledger'
+  classInstanceVars: opened:0
+
+  method: add: amount [
+    items := items arrayPush: amount.
+    total := total + amount.
+    ^ total
+  ]
+
+  method: big [
+    ^ items select: [:x | x > 10]
+  ]
+
+  method: firstOver: n [
+    items do: [:x | (x > n) ifTrue: [ ^ x ] ].
+    ^ 'none'
+  ]
+
+  method: label [
+    ^ (total > 100) ifTrue: [ 'big' ] ifFalse: [ name ]
+  ]
+
+  method: rename: s [
+    name := @ String uppercase: s.
+    ^ name
+  ]
+
+  method: bump [
+    ^ @ self add: 1
+  ]
+
+  classMethod: open [
+    opened := opened + 1.
+    ^ opened
+  ]
+
+  rawMethod: shell [
+    echo hi
+  ]
+`
+
+// ledgerModule generates the Python module for ledgerSrc
+func ledgerModule(t *testing.T) (string, *codegen.PythonBackend) {
+	t.Helper()
+	class, err := source.Parse(ledgerSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, _, errs := ir.NewBuilder(class).Build()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	ir.Optimize(prog)
+	prog.SourceCode = ledgerSrc
+
+	backend := codegen.NewPythonBackend()
+	code, err := backend.Generate(prog)
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	return code, backend
+}
+
+func TestPythonBackend_Generate(t *testing.T) {
+	code, backend := ledgerModule(t)
+
+	for _, want := range []string{
+		"#!/usr/bin/env python3",
+		"# Generated by Trashtalk Compiler (procyon) - DO NOT EDIT",
+		`_QUALIFIED_NAME = "Ledger"`,
+		`("items", "[]"),`,
+		"class LedgerInstance(_Instance):",
+		"def m_add_(self, amount):",
+		`return self.m_add_(1)`,
+		`"open": (LedgerInstance.c_open, 0),`,
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("module does not contain %q", want)
+		}
+	}
+	if strings.Contains(code, "m_shell") {
+		t.Error("raw method shell should be left to Bash")
+	}
+	if strings.Contains(code, " \n") {
+		t.Error("module has trailing whitespace")
+	}
+
+	warnings := backend.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "method shell falls back to Bash") {
+		t.Errorf("Warnings = %v, want shell falling back to Bash", warnings)
+	}
+	if skipped := backend.SkippedMethods(); len(skipped) != 1 || skipped[0].Selector != "shell" {
+		t.Errorf("SkippedMethods = %v, want shell", skipped)
+	}
+}
+
+func TestPythonBackend_Run(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not found")
+	}
+	code, _ := ledgerModule(t)
+	dir := t.TempDir()
+	module := filepath.Join(dir, "Ledger.py")
+	if err := os.WriteFile(module, []byte(code), 0755); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(), "SQLITE_JSON_DB="+filepath.Join(dir, "instances.db"))
+
+	run := func(stdin string, args ...string) (string, int) {
+		t.Helper()
+		cmd := exec.Command(python, append([]string{module}, args...)...)
+		cmd.Env = env
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if exit, ok := err.(*exec.ExitError); ok {
+			return strings.TrimSpace(string(out)), exit.ExitCode()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(out)), 0
+	}
+
+	id, status := run("", "Ledger", "new")
+	if status != 0 || !strings.HasPrefix(id, "ledger_") {
+		t.Fatalf("Ledger new = %q, exit %d", id, status)
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"add_", "5"}, "5"},
+		{[]string{"add_", "20"}, "25"},
+		{[]string{"big"}, `["20"]`},
+		{[]string{"firstOver_", "6"}, "20"},
+		{[]string{"firstOver_", "99"}, "none"},
+		{[]string{"label"}, "ledger"},
+		{[]string{"rename_", "bob"}, "BOB"},
+		{[]string{"bump"}, "26"},
+		{[]string{"class"}, "Ledger"},
+	} {
+		if got, exit := run("", append([]string{id}, tt.args...)...); exit != 0 || got != tt.want {
+			t.Errorf("%v = %q, exit %d, want %q", tt.args, got, exit, tt.want)
+		}
+	}
+	if got, _ := run("", "Ledger", "open"); got != "1" {
+		t.Errorf("Ledger open = %q, want 1", got)
+	}
+	if got, _ := run("", "Ledger", "open"); got != "2" {
+		t.Errorf("Ledger open = %q, want 2 from the stored class variable", got)
+	}
+	if _, exit := run("", id, "shell"); exit != 200 {
+		t.Errorf("shell exit = %d, want 200 for Bash fallback", exit)
+	}
+	if _, exit := run("", id, "add_"); exit != 1 {
+		t.Errorf("add_ without its argument exit = %d, want 1", exit)
+	}
+
+	out, _ := run(`{"instance_id":"ledger_x","instance":"{\"items\":[],\"total\":\"3\",\"name\":\"n\"}","selector":"add_","args":["4"]}
+{"instance_id":"ledger_x","instance":"{}","selector":"shell"}
+`, "--serve")
+	lines := strings.Split(out, "\n")
+	if len(lines) != 2 {
+		t.Fatalf("--serve answered %q, want two responses", out)
+	}
+	var resp struct {
+		Instance string `json:"instance"`
+		Result   string `json:"result"`
+		ExitCode int    `json:"exit_code"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ExitCode != 0 || resp.Result != "7" || !strings.Contains(resp.Instance, `"total":"7"`) || !strings.Contains(resp.Instance, `"items":["4"]`) {
+		t.Errorf("--serve add_ = %s", lines[0])
+	}
+	if lines[1] != `{"exit_code":200}` {
+		t.Errorf("--serve shell = %s, want exit 200", lines[1])
+	}
+}
@@ -0,0 +1,936 @@
+# Trashtalk runtime for classes generated by the Python backend.
+#
+# Generated modules are this file followed by one class. Values follow the Go
+# backend, like the IR interpreter: instance variables are stored as strings,
+# numbers use int arithmetic when both sides are integral and float
+# arithmetic otherwise, and comparisons are numeric when both sides look
+# numeric. JSON arrays and objects are lists and dicts while a method runs.
+# Blocks are Python functions.
+#
+# The dispatch protocol is the Go backend's: argv is
+# "<instance_id|Class> <selector> [args...]", and --serve reads one JSON
+# request per line from stdin and answers one JSON response per line.
+# Instances are kept in the SQLite database of the Bash runtime.
+
+import datetime
+import decimal
+import functools
+import hashlib
+import json
+import math
+import os
+import sqlite3
+import subprocess
+import sys
+import time
+import uuid
+
+EXIT_OK = 0
+EXIT_ERROR = 1
+EXIT_UNKNOWN_SELECTOR = 200  # no native implementation; fall back to Bash
+EXIT_STORAGE_BUSY = 202  # the database stayed locked; retry later
+
+_MAX_SAVE_ATTEMPTS = 3
+_MAX_BUSY_ATTEMPTS = 4
+_BUSY_BACKOFF = 0.025
+
+
+class _Error(Exception):
+    """A failed request, exit code 1"""
+
+
+class _UnknownSelector(Exception):
+    """A selector without a native implementation, exit code 200"""
+
+
+class _StorageBusy(Exception):
+    """The database stayed locked, exit code 202"""
+
+
+class _Conflict(Exception):
+    """Another process saved the instance since it was loaded"""
+
+
+class _Return(Exception):
+    """Carries ^ out of a block to the method that created it"""
+
+    def __init__(self, frame, value):
+        Exception.__init__(self)
+        self.frame = frame
+        self.value = value
+
+
+# === Values ===
+
+
+def _to_str(v):
+    """Renders a value the way the Go backend's _toStr does"""
+    if v is None:
+        return ""
+    if isinstance(v, bool):
+        return "true" if v else "false"
+    if isinstance(v, str):
+        return v
+    if isinstance(v, int):
+        return str(v)
+    if isinstance(v, float):
+        return _format_float(v)
+    if isinstance(v, (list, dict)):
+        return _json_text(v)
+    if callable(v):
+        return "<block>"
+    return str(v)
+
+
+def _format_float(f):
+    """Formats f like Go's strconv.FormatFloat(f, 'f', -1, 64)"""
+    if math.isnan(f):
+        return "NaN"
+    if math.isinf(f):
+        return "+Inf" if f > 0 else "-Inf"
+    text = repr(f)
+    if "e" in text or "E" in text:
+        text = format(decimal.Decimal(text), "f")
+    if text.endswith(".0"):
+        text = text[:-2]
+    return text
+
+
+def _json_text(v):
+    """Encodes v as compact JSON with sorted keys, as encoding/json does"""
+    return json.dumps(v, separators=(",", ":"), sort_keys=True, ensure_ascii=False, default=_to_str)
+
+
+def _truthy(v):
+    if isinstance(v, bool):
+        return v
+    return _to_str(v) == "true"
+
+
+def _force(v):
+    """Answers the value of v, invoking it if it is a block"""
+    if callable(v):
+        return v()
+    return v
+
+
+def _to_num(v):
+    """Converts v to an int if it is integral, a float if it is another
+    number, and None otherwise"""
+    if isinstance(v, bool):
+        return None
+    if isinstance(v, (int, float)):
+        return v
+    if isinstance(v, str):
+        s = v.strip()
+        if s == "" or s.strip("0123456789.eE+-") != "":
+            return None
+        try:
+            return int(s, 10)
+        except ValueError:
+            pass
+        try:
+            return float(s)
+        except ValueError:
+            pass
+    return None
+
+
+def _to_int(v):
+    n = _to_num(v)
+    if n is None:
+        return 0
+    return int(n)
+
+
+def _to_float(v):
+    n = _to_num(v)
+    if n is None:
+        return 0.0
+    return float(n)
+
+
+def _quo(i, j):
+    """Integer division truncating toward zero, as Go's / does"""
+    q = abs(i) // abs(j)
+    return q if (i < 0) == (j < 0) else -q
+
+
+def _arith(op, a, b):
+    x, y = _to_num(a), _to_num(b)
+    if isinstance(x, int) and isinstance(y, int):
+        if op == "+":
+            return x + y
+        if op == "-":
+            return x - y
+        if op == "*":
+            return x * y
+        if y == 0:
+            raise _Error("division by zero")
+        return _quo(x, y)
+    p, q = _to_float(x), _to_float(y)
+    if op == "+":
+        return p + q
+    if op == "-":
+        return p - q
+    if op == "*":
+        return p * q
+    if q == 0:
+        # Go's float division answers NaN or a signed infinity
+        if p == 0 or p != p:
+            return float("nan")
+        return math.copysign(float("inf"), p) * math.copysign(1.0, q)
+    return p / q
+
+
+def _mod(a, b):
+    d = _to_int(b)
+    if d == 0:
+        raise _Error("division by zero")
+    n = _to_int(a)
+    return n - d * _quo(n, d)
+
+
+def _compare(op, a, b):
+    if _to_num(a) is not None and _to_num(b) is not None:
+        x, y = _to_float(a), _to_float(b)
+    else:
+        x, y = _to_str(a), _to_str(b)
+    if op == "==":
+        return x == y
+    if op == "!=":
+        return x != y
+    if op == "<":
+        return x < y
+    if op == ">":
+        return x > y
+    if op == "<=":
+        return x <= y
+    return x >= y
+
+
+def _decode_json(s):
+    """Decodes JSON text, answering None if it is not JSON"""
+    try:
+        return json.loads(s)
+    except ValueError:
+        return None
+
+
+def _to_array(v):
+    """Answers v as a JSON array: decoded if it is JSON text, empty if it is
+    not an array"""
+    if isinstance(v, list):
+        return v
+    if isinstance(v, str):
+        arr = _decode_json(v)
+        if isinstance(arr, list):
+            return arr
+    return []
+
+
+def _to_object(v):
+    """Answers v as a JSON object, like _to_array"""
+    if isinstance(v, dict):
+        return v
+    if isinstance(v, str):
+        obj = _decode_json(v)
+        if isinstance(obj, dict):
+            return obj
+    return {}
+
+
+def _json_root(v):
+    if isinstance(v, str):
+        return _decode_json(v)
+    return v
+
+
+def _normal_json(v):
+    """Decodes v, JSON text or a value, so that equal values compare equal"""
+    text = v if isinstance(v, str) else _json_text(v)
+    decoded = _decode_json(text)
+    if decoded is None and text.strip() != "null":
+        return _to_str(v)
+    return decoded
+
+
+def _merge_objects(obj, other, deep):
+    out = dict(obj)
+    for k, v in other.items():
+        if deep and isinstance(out.get(k), dict) and isinstance(v, dict):
+            out[k] = _merge_objects(out[k], v, True)
+        else:
+            out[k] = v
+    return out
+
+
+def _array_cmp(numeric):
+    """Orders array elements for arraySort: numbers first and ascending if
+    numeric, then everything else by its string"""
+
+    def number(v):
+        try:
+            return float(_to_str(v))
+        except ValueError:
+            return None
+
+    def cmp(a, b):
+        if numeric:
+            x, y = number(a), number(b)
+            if x is not None and y is not None:
+                return (x > y) - (x < y)
+            if (x is None) != (y is None):
+                return -1 if x is not None else 1
+        s, t = _to_str(a), _to_str(b)
+        return (s > t) - (s < t)
+
+    return functools.cmp_to_key(cmp)
+
+
+def _json_path_steps(path):
+    """Splits a path like user.addresses[0].city into string keys and int
+    indexes, answering None if it is malformed"""
+    if path == "":
+        return []
+    steps = []
+    for part in path.split("."):
+        key, rest = part, ""
+        if "[" in part:
+            i = part.index("[")
+            key, rest = part[:i], part[i:]
+        if key != "":
+            steps.append(key)
+        elif rest == "":
+            return None
+        while rest != "":
+            end = rest.find("]")
+            if rest[0] != "[" or end < 0:
+                return None
+            index = rest[1:end]
+            if not index.isdigit():
+                return None
+            steps.append(int(index))
+            rest = rest[end + 1:]
+    return steps
+
+
+_MISSING = object()
+
+
+def _json_path_get(node, steps):
+    for step in steps:
+        if isinstance(step, str):
+            if not isinstance(node, dict) or step not in node:
+                return _MISSING
+            node = node[step]
+        else:
+            if not isinstance(node, list) or step >= len(node):
+                return _MISSING
+            node = node[step]
+    return node
+
+
+def _json_path_set(node, steps, val):
+    """Answers a copy of node with val at steps, creating missing objects and
+    arrays, or _MISSING if a step does not fit node"""
+    if not steps:
+        return val
+    step = steps[0]
+    if isinstance(step, str):
+        if node is not None and not isinstance(node, dict):
+            return _MISSING
+        obj = node or {}
+        child = _json_path_set(obj.get(step), steps[1:], val)
+        if child is _MISSING:
+            return _MISSING
+        out = dict(obj)
+        out[step] = child
+        return out
+    if node is not None and not isinstance(node, list):
+        return _MISSING
+    out = list(node or [])
+    while len(out) <= step:
+        out.append(None)
+    child = _json_path_set(out[step], steps[1:], val)
+    if child is _MISSING:
+        return _MISSING
+    out[step] = child
+    return out
+
+
+def _index(arr, i):
+    if i < 0:
+        i += len(arr)
+    if i < 0 or i >= len(arr):
+        return None
+    return arr[i]
+
+
+def _json(op, receiver, *args):
+    """Applies the JSON primitive op to receiver"""
+
+    def arg(i):
+        return args[i] if i < len(args) else None
+
+    if op == "arrayLength":
+        return len(_to_array(receiver))
+    if op == "arrayIsEmpty":
+        return len(_to_array(receiver)) == 0
+    if op == "arrayFirst":
+        arr = _to_array(receiver)
+        return arr[0] if arr else None
+    if op == "arrayLast":
+        arr = _to_array(receiver)
+        return arr[-1] if arr else None
+    if op == "arrayAt":
+        return _index(_to_array(receiver), _to_int(arg(0)))
+    if op == "arrayPush":
+        # Optimize coalesces a chain of pushes into one with several values
+        return list(_to_array(receiver)) + list(args)
+    if op == "arrayAtPut":
+        arr = list(_to_array(receiver))
+        i = _to_int(arg(0))
+        if i < 0:
+            i += len(arr)
+        while i >= len(arr):
+            arr.append(None)
+        if i >= 0:
+            arr[i] = arg(1)
+        return arr
+    if op == "arrayRemoveAt":
+        arr = _to_array(receiver)
+        i = _to_int(arg(0))
+        if i < 0 or i >= len(arr):
+            return arr
+        return arr[:i] + arr[i + 1:]
+    if op == "objectAt":
+        return _to_object(receiver).get(_to_str(arg(0)))
+    if op == "objectHasKey":
+        return _to_str(arg(0)) in _to_object(receiver)
+    if op == "objectAtPut":
+        obj = dict(_to_object(receiver))
+        obj[_to_str(arg(0))] = arg(1)
+        return obj
+    if op == "objectRemoveKey":
+        obj = dict(_to_object(receiver))
+        obj.pop(_to_str(arg(0)), None)
+        return obj
+    if op in ("objectMerge", "objectDeepMerge"):
+        return _merge_objects(_to_object(receiver), _to_object(arg(0)), op == "objectDeepMerge")
+    if op == "objectEquals":
+        return _normal_json(receiver) == _normal_json(arg(0))
+    if op in ("arraySort", "arraySortNumeric"):
+        return sorted(_to_array(receiver), key=_array_cmp(op == "arraySortNumeric"))
+    if op == "arrayReverse":
+        return list(reversed(_to_array(receiver)))
+    if op == "arrayUnique":
+        out, seen = [], set()
+        for v in _to_array(receiver):
+            key = _json_text(v)
+            if key not in seen:
+                seen.add(key)
+                out.append(v)
+        return out
+    if op == "arrayJoin":
+        return _to_str(arg(0)).join(_to_str(v) for v in _to_array(receiver))
+    if op == "jsonAtPath":
+        steps = _json_path_steps(_to_str(arg(0)))
+        if steps is None:
+            return None
+        v = _json_path_get(_json_root(receiver), steps)
+        return None if v is _MISSING else v
+    if op == "jsonSetPathPut":
+        steps = _json_path_steps(_to_str(arg(0)))
+        if steps is None:
+            return receiver
+        val = arg(1)
+        if isinstance(val, str) and val.strip()[:1] in ("{", "["):
+            decoded = _decode_json(val.strip())
+            if decoded is not None:
+                val = decoded
+        root = _json_path_set(_json_root(receiver), steps, val)
+        return receiver if root is _MISSING else root
+    if op == "objectLength":
+        return len(_to_object(receiver))
+    if op == "objectIsEmpty":
+        return len(_to_object(receiver)) == 0
+    if op == "objectKeys":
+        return sorted(_to_object(receiver))
+    if op == "objectValues":
+        obj = _to_object(receiver)
+        return [obj[k] for k in sorted(obj)]
+    raise _UnknownSelector(op)
+
+
+def _byte_len(s):
+    return len(s.encode("utf-8"))
+
+
+def _substring(s, start, length):
+    data = s.encode("utf-8")
+    start = max(start, 0)
+    if start > len(data):
+        return ""
+    end = start + length
+    if length < 0 or end > len(data):
+        end = len(data)
+    return data[start:end].decode("utf-8", "replace")
+
+
+_STRING_ARITY = {
+    "stringIsEmpty": 1, "stringNotEmpty": 1, "stringLength": 1,
+    "stringUppercase": 1, "stringLowercase": 1, "stringTrim": 1,
+    "stringContains": 2, "stringStartsWith": 2, "stringEndsWith": 2,
+    "stringEquals": 2, "stringTrimPrefix": 2, "stringTrimSuffix": 2,
+    "stringConcat": 2,
+    "stringReplace": 3, "stringReplaceAll": 3, "stringSubstring": 3,
+}
+
+
+def _string(op, *args):
+    """Applies the String class primitive op"""
+    if len(args) < _STRING_ARITY[op]:
+        raise _Error("%s requires %d arguments" % (op, _STRING_ARITY[op]))
+    s = [_to_str(a) for a in args]
+    if op == "stringIsEmpty":
+        return s[0] == ""
+    if op == "stringNotEmpty":
+        return s[0] != ""
+    if op == "stringLength":
+        return _byte_len(s[0])
+    if op == "stringUppercase":
+        return s[0].upper()
+    if op == "stringLowercase":
+        return s[0].lower()
+    if op == "stringTrim":
+        return s[0].strip()
+    if op == "stringContains":
+        return s[1] in s[0]
+    if op == "stringStartsWith":
+        return s[0].startswith(s[1])
+    if op == "stringEndsWith":
+        return s[0].endswith(s[1])
+    if op == "stringEquals":
+        return s[0] == s[1]
+    if op == "stringTrimPrefix":
+        return s[1][len(s[0]):] if s[1].startswith(s[0]) else s[1]
+    if op == "stringTrimSuffix":
+        return s[1][:len(s[1]) - len(s[0])] if s[0] and s[1].endswith(s[0]) else s[1]
+    if op == "stringConcat":
+        return s[0] + s[1]
+    if op == "stringReplace":
+        return s[2].replace(s[0], s[1], 1)
+    if op == "stringReplaceAll":
+        return s[2].replace(s[0], s[1])
+    return _substring(s[0], _to_int(args[1]), _to_int(args[2]))
+
+
+_ITERATIONS = ("do", "collect", "select", "reject", "detect", "anySatisfy", "allSatisfy")
+
+
+def _iterate(kind, elems, block):
+    results = []
+    for elem in elems:
+        v = block(elem)
+        if kind == "collect":
+            results.append(v)
+        elif kind == "select" and _truthy(v):
+            results.append(elem)
+        elif kind == "reject" and not _truthy(v):
+            results.append(elem)
+        elif kind == "detect" and _truthy(v):
+            return elem
+        elif kind == "anySatisfy" and _truthy(v):
+            return True
+        elif kind == "allSatisfy" and not _truthy(v):
+            return False
+    if kind == "detect":
+        return None
+    if kind == "anySatisfy":
+        return False
+    if kind == "allSatisfy":
+        return True
+    if kind == "do":
+        return elems
+    return results
+
+
+def _send(receiver, selector, *args):
+    """Sends selector to a block, iterates a collection with a block, or
+    sends through the Trashtalk runtime"""
+    if callable(receiver) and selector in ("value", "valueWith_", "valueWith_and_", "valueWith_and_and_"):
+        return receiver(*args)
+    if len(args) == 1 and callable(args[0]):
+        kind = selector[:-1] if selector.endswith("_") else selector
+        if kind in _ITERATIONS:
+            return _iterate(kind, _to_array(receiver), args[0])
+    return _send_runtime(receiver, selector, *args)
+
+
+def _send_runtime(receiver, selector, *args):
+    """Sends selector through ~/.trashtalk/bin/trash-send, answering its
+    output. Class instance variables assigned so far are saved first, so
+    that the other process sees them."""
+    if _session.db is not None:
+        _session.commit()
+    script = os.path.join(os.path.expanduser("~"), ".trashtalk", "bin", "trash-send")
+    argv = [script, _to_str(receiver), selector] + [_to_str(a) for a in args]
+    try:
+        out = subprocess.run(argv, stdout=subprocess.PIPE, stderr=subprocess.DEVNULL).stdout
+    except OSError:
+        return ""
+    return out.decode("utf-8", "replace").strip()
+
+
+# === Storage ===
+
+
+def _db_path():
+    path = os.environ.get("SQLITE_JSON_DB", "")
+    if path == "":
+        path = os.path.join(os.path.expanduser("~"), ".trashtalk", "instances.db")
+    return path
+
+
+def _is_busy(err):
+    msg = str(err)
+    return "database is locked" in msg or "database table is locked" in msg
+
+
+def _retry_busy(op):
+    """Runs op until it succeeds, fails for another reason than a locked
+    database or has been tried _MAX_BUSY_ATTEMPTS times"""
+    backoff = _BUSY_BACKOFF
+    attempt = 1
+    while True:
+        try:
+            return op()
+        except sqlite3.OperationalError as err:
+            if not _is_busy(err):
+                raise
+            if attempt == _MAX_BUSY_ATTEMPTS:
+                raise _StorageBusy("storage busy: %s" % err)
+        # Jitter keeps processes that collided from retrying in step
+        time.sleep(backoff / 2 + backoff * (uuid.uuid4().int % 1000) / 1000)
+        backoff *= 2
+        attempt += 1
+
+
+class _Session(object):
+    """The database connection and the class instance variables of a
+    process"""
+
+    def __init__(self):
+        self.db = None
+        self.class_vars = None
+        self.class_vars_dirty = False
+
+    def open(self):
+        if self.db is None:
+            self.db = sqlite3.connect(_db_path(), timeout=5, isolation_level=None)
+            _retry_busy(lambda: self.db.execute(
+                "CREATE TABLE IF NOT EXISTS instances (id TEXT PRIMARY KEY, data JSON NOT NULL)"))
+        return self.db
+
+    def load(self, id):
+        row = _retry_busy(lambda: self.open().execute(
+            "SELECT data FROM instances WHERE id = ?", (id,)).fetchone())
+        if row is None:
+            return None
+        return row[0]
+
+    def create(self, id, data):
+        _retry_busy(lambda: self.open().execute(
+            "INSERT INTO instances (id, data) VALUES (?, ?)", (id, data)))
+
+    def delete(self, id):
+        _retry_busy(lambda: self.open().execute("DELETE FROM instances WHERE id = ?", (id,)))
+
+    def save(self, id, fields, loaded):
+        """Stores fields as id unless another process saved it since it was
+        loaded at version loaded"""
+
+        def op():
+            db = self.open()
+            db.execute("BEGIN IMMEDIATE")
+            try:
+                row = db.execute("SELECT data FROM instances WHERE id = ?", (id,)).fetchone()
+                if row is not None:
+                    stored = _decode_json(row[0])
+                    version = stored.get("_version", 0) if isinstance(stored, dict) else 0
+                    if _to_int(version) != loaded:
+                        raise _Conflict("instance modified concurrently: %s" % id)
+                db.execute("INSERT OR REPLACE INTO instances (id, data) VALUES (?, ?)", (id, _encode_fields(fields)))
+            except BaseException:
+                db.execute("ROLLBACK")
+                raise
+            db.execute("COMMIT")
+
+        _retry_busy(op)
+
+    def commit(self):
+        """Saves the class instance variables if a method assigned one"""
+        if self.class_vars_dirty:
+            data = json.dumps(dict((k, _to_str(v)) for k, v in self.class_vars.items()),
+                              separators=(",", ":"), ensure_ascii=False)
+            _retry_busy(lambda: self.open().execute(
+                "INSERT OR REPLACE INTO instances (id, data) VALUES (?, ?)", (_QUALIFIED_NAME + "::class", data)))
+            self.class_vars_dirty = False
+
+    def classvars(self):
+        """Answers the class instance variables, loading them on first use"""
+        if self.class_vars is None:
+            self.class_vars = dict(_CLASS_VARS)
+            data = self.load(_QUALIFIED_NAME + "::class") if _CLASS_VARS else None
+            stored = _decode_json(data) if data is not None else None
+            if isinstance(stored, dict):
+                for name in _CLASS_VARS:
+                    if name in stored:
+                        self.class_vars[name] = _to_str(stored[name])
+        return self.class_vars
+
+    def reset(self):
+        """Forgets the class instance variables of a request that failed"""
+        self.class_vars = None
+        self.class_vars_dirty = False
+
+
+_session = _Session()
+
+
+def _classvar(name):
+    return _session.classvars().get(name)
+
+
+def _set_classvar(name, value):
+    _session.classvars()[name] = value
+    _session.class_vars_dirty = True
+
+
+def _is_json_var(default):
+    return default.strip()[:1] in ("[", "{")
+
+
+def _decode_fields(data):
+    """Decodes instance JSON, with scalar instance variables as strings as
+    the Go backend stores them"""
+    fields = json.loads(data)
+    if not isinstance(fields, dict):
+        raise ValueError("instance JSON is not an object")
+    for name, _ in _INSTANCE_VARS:
+        v = fields.get(name)
+        if v is None or isinstance(v, (bool, int, float)):
+            fields[name] = _to_str(v)
+    return fields
+
+
+def _encode_fields(fields):
+    """Encodes instance fields, with JSON instance variables as JSON"""
+    out = dict(fields)
+    for name, default in _INSTANCE_VARS:
+        v = out.get(name)
+        if isinstance(v, (list, dict)):
+            continue
+        if isinstance(v, str) and _is_json_var(default):
+            decoded = _decode_json(v)
+            if decoded is not None:
+                out[name] = decoded
+            continue
+        out[name] = _to_str(v)
+    return json.dumps(out, separators=(",", ":"), ensure_ascii=False)
+
+
+class _Instance(object):
+    """A loaded instance: its JSON fields, with instance variables decoded"""
+
+    def __init__(self, id, fields):
+        self.id = id
+        self.fields = fields
+        self.dirty = False
+
+    def get(self, name):
+        return self.fields.get(name)
+
+    def set(self, name, value):
+        self.fields[name] = value
+        self.dirty = True
+
+
+def _new():
+    """Creates an instance with the declared defaults and answers its ID"""
+    id = "%s_%s" % (_CLASS_NAME.lower(), uuid.uuid4())
+    fields = {
+        "class": _QUALIFIED_NAME,
+        "created_at": datetime.datetime.now().astimezone().replace(microsecond=0).isoformat(),
+        "_vars": [name for name, _ in _INSTANCE_VARS],
+        "_version": 0,
+    }
+    for name, default in _INSTANCE_VARS:
+        fields[name] = default
+    _session.create(id, _encode_fields(fields))
+    return id
+
+
+# === Dispatch ===
+
+
+def _call(table, selector, target, args):
+    entry = table.get(selector)
+    if entry is None:
+        raise _UnknownSelector(selector)
+    method, arity = entry
+    if len(args) < arity:
+        raise _Error("%s requires %d argument" % (selector, arity))
+    return method(target, *args[:arity]) if target is not None else method(*args[:arity])
+
+
+def _dispatch(instance, selector, args):
+    if selector == "class":
+        return _CLASS_NAME
+    if selector in ("id", "delete"):
+        return instance.id
+    return _to_str(_call(_METHODS, selector, instance, args))
+
+
+def _dispatch_class(selector, args):
+    if selector == "new" and "new" not in _CLASS_METHODS:
+        return _new()
+    result = _to_str(_call(_CLASS_METHODS, selector, None, args))
+    _session.commit()
+    return result
+
+
+def _is_class(receiver):
+    return receiver in (_CLASS_NAME, _QUALIFIED_NAME)
+
+
+def _exit_code(err):
+    if isinstance(err, _UnknownSelector):
+        return EXIT_UNKNOWN_SELECTOR
+    if isinstance(err, _StorageBusy):
+        return EXIT_STORAGE_BUSY
+    return EXIT_ERROR
+
+
+def _run(receiver, selector, args):
+    """Dispatches one argv request, answering its result"""
+    if _is_class(receiver):
+        return _dispatch_class(selector, args)
+    for attempt in range(1, _MAX_SAVE_ATTEMPTS + 1):
+        data = _session.load(receiver)
+        if data is None:
+            raise _UnknownSelector(receiver)
+        fields = _decode_fields(data)
+        instance = _INSTANCE_CLASS(receiver, fields)
+        loaded = _to_int(fields.get("_version", 0))
+        result = _dispatch(instance, selector, args)
+        _session.commit()
+        if selector == "delete":
+            _session.delete(receiver)
+        elif instance.dirty:
+            fields["_version"] = loaded + 1
+            try:
+                _session.save(receiver, fields, loaded)
+            except _Conflict:
+                if attempt < _MAX_SAVE_ATTEMPTS:
+                    _session.reset()
+                    continue
+                raise
+        return result
+
+
+def _serve_request(req):
+    """Handles one --serve request, answering its response"""
+    receiver = req.get("instance") or ""
+    selector = req.get("selector") or ""
+    args = [_to_str(a) for a in req.get("args") or []]
+    if receiver == "" or _is_class(receiver):
+        return {"result": _dispatch_class(selector, args), "exit_code": EXIT_OK}
+    try:
+        fields = _decode_fields(receiver)
+    except ValueError as err:
+        return {"exit_code": EXIT_ERROR, "error": "invalid instance JSON: %s" % err}
+    instance_id = req.get("instance_id") or ""
+    instance = _INSTANCE_CLASS(instance_id, fields)
+    result = _dispatch(instance, selector, args)
+    _session.commit()
+    if selector == "delete":
+        _session.delete(instance_id)
+        return {"result": result, "exit_code": EXIT_OK}
+    return {"instance": _encode_fields(fields), "result": result, "exit_code": EXIT_OK}
+
+
+def _respond(resp):
+    out = {}
+    for key in ("instance", "result", "exit_code", "error"):
+        if key in resp and (resp[key] != "" or key == "exit_code"):
+            out[key] = resp[key]
+    sys.stdout.write(json.dumps(out, separators=(",", ":"), ensure_ascii=False) + "\n")
+    sys.stdout.flush()
+
+
+def _serve():
+    for line in sys.stdin:
+        line = line.strip()
+        if line == "":
+            continue
+        try:
+            req = json.loads(line)
+            if not isinstance(req, dict):
+                raise ValueError("request is not an object")
+        except ValueError as err:
+            _respond({"exit_code": EXIT_ERROR, "error": "invalid JSON: %s" % err})
+            continue
+        try:
+            resp = _serve_request(req)
+        except Exception as err:
+            _session.reset()
+            code = _exit_code(err)
+            resp = {"exit_code": code}
+            if code != EXIT_UNKNOWN_SELECTOR:
+                resp["error"] = str(err)
+        _respond(resp)
+
+
+def _usage():
+    name = _CLASS_NAME + ".py"
+    sys.stderr.write("Usage: %s <instance_id> <selector> [args...]\n" % name)
+    sys.stderr.write("       %s --serve\n" % name)
+    sys.stderr.write("       %s --source [--raw|--json]\n" % name)
+    sys.stderr.write("       %s --hash\n" % name)
+    return EXIT_ERROR
+
+
+def _main(argv):
+    if len(argv) < 1:
+        return _usage()
+    if argv[0] == "--serve":
+        _serve()
+        return EXIT_OK
+    if argv[0] == "--hash":
+        print(hashlib.sha256(_SOURCE.encode("utf-8")).hexdigest())
+        return EXIT_OK
+    if argv[0] == "--source":
+        fmt = argv[1] if len(argv) > 1 else "--raw"
+        if fmt == "--raw":
+            sys.stdout.write(_SOURCE)
+        elif fmt == "--json":
+            digest = hashlib.sha256(_SOURCE.encode("utf-8")).hexdigest()
+            print(json.dumps({"class": _CLASS_NAME, "hash": digest, "source": _SOURCE},
+                             separators=(",", ":"), sort_keys=True, ensure_ascii=False))
+        else:
+            return _usage()
+        return EXIT_OK
+    if len(argv) < 2:
+        return _usage()
+    try:
+        result = _run(argv[0], argv[1], argv[2:])
+    except Exception as err:
+        code = _exit_code(err)
+        if code != EXIT_UNKNOWN_SELECTOR:
+            sys.stderr.write("Error: %s\n" % err)
+        return code
+    if result != "":
+        print(result)
+    return EXIT_OK
@@ -0,0 +1,169 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the source maintenance commands of a binary: --source
+// prints the embedded source, and --reembed checks a source file against it.
+// A source that differs must be a later revision of the embedded one in the
+// manifest's lineage of the class, the list of source hashes the class has
+// been built from, oldest first:
+//
+//	{"classes": [{"name": "Counter", "hashes": ["3f2a...", "9c41..."]}]}
+//
+// The manifest is $TRASHTALK_MANIFEST or manifest.json next to the binary.
+// --reembed then runs $PROCYON_BUILD, or prints how to rebuild the binary.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// mainSource returns the main case of --source [--raw|--json]. --raw, the
+// default, prints the embedded source as is; --json prints the class, the
+// hash and the source as one object.
+func (g *generator) mainSource() jen.Code {
+	usage := "Usage: " + g.class.CompiledName() + ".native --source [--raw|--json]"
+	return jen.Case(jen.Lit("--source")).Block(
+		jen.Id("format").Op(":=").Lit("--raw"),
+		jen.If(jen.Len(jen.Qual("os", "Args")).Op(">").Lit(2)).Block(
+			jen.Id("format").Op("=").Qual("os", "Args").Index(jen.Lit(2)),
+		),
+		jen.Switch(jen.Id("format")).Block(
+			jen.Case(jen.Lit("--raw")).Block(
+				jen.Qual("fmt", "Print").Call(jen.Id("_sourceCode")),
+			),
+			jen.Case(jen.Lit("--json")).Block(
+				jen.List(jen.Id("out"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Map(jen.String()).String().Values(jen.Dict{
+					jen.Lit("class"):  jen.Lit(g.class.QualifiedName()),
+					jen.Lit("hash"):   jen.Id("_contentHash"),
+					jen.Lit("source"): jen.Id("_sourceCode"),
+				})),
+				jen.Qual("fmt", "Println").Call(jen.String().Parens(jen.Id("out"))),
+			),
+			jen.Default().Block(
+				jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit(usage)),
+				jen.Qual("os", "Exit").Call(jen.Lit(1)),
+			),
+		),
+		jen.Return(),
+	)
+}
+
+// mainReembed returns the main case of --reembed PATH
+func (g *generator) mainReembed() jen.Code {
+	usage := "Usage: " + g.class.CompiledName() + ".native --reembed <" + g.class.CompiledName() + ".trash>"
+	return jen.Case(jen.Lit("--reembed")).Block(
+		jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(3)).Block(
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit(usage)),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Qual("os", "Exit").Call(jen.Id("reembed").Call(jen.Qual("os", "Args").Index(jen.Lit(2)))),
+	)
+}
+
+// generateReembed generates sourceLineage and reembed
+func (g *generator) generateReembed(f *jen.File) {
+	qualifiedName := g.class.QualifiedName()
+	compiledName := g.class.CompiledName()
+	errorf := func(format string, args ...jen.Code) jen.Code {
+		return jen.Qual("fmt", "Fprintf").Call(append([]jen.Code{jen.Qual("os", "Stderr"), jen.Lit("Error: " + format + "\n")}, args...)...)
+	}
+
+	f.Comment("sourceLineage returns the source hashes the manifest lists for the class,")
+	f.Comment("oldest first. The manifest is $TRASHTALK_MANIFEST or manifest.json next to")
+	f.Comment("the binary.")
+	f.Func().Id("sourceLineage").Params().Parens(jen.List(jen.Index().String(), jen.Error())).Block(
+		jen.Id("path").Op(":=").Qual("os", "Getenv").Call(jen.Lit("TRASHTALK_MANIFEST")),
+		jen.If(jen.Id("path").Op("==").Lit("")).Block(
+			jen.List(jen.Id("exe"), jen.Err()).Op(":=").Qual("os", "Executable").Call(),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Nil(), jen.Err()),
+			),
+			jen.Id("path").Op("=").Qual("path/filepath", "Join").Call(jen.Qual("path/filepath", "Dir").Call(jen.Id("exe")), jen.Lit("manifest.json")),
+		),
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("os", "ReadFile").Call(jen.Id("path")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.Var().Id("manifest").Struct(
+			jen.Id("Classes").Index().Struct(
+				jen.Id("Name").String().Tag(map[string]string{"json": "name"}),
+				jen.Id("Package").String().Tag(map[string]string{"json": "package"}),
+				jen.Id("Hashes").Index().String().Tag(map[string]string{"json": "hashes"}),
+			).Tag(map[string]string{"json": "classes"}),
+		),
+		jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Id("data"), jen.Op("&").Id("manifest")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("%s: %v"), jen.Id("path"), jen.Err())),
+		),
+		jen.For(jen.List(jen.Id("_"), jen.Id("c")).Op(":=").Range().Id("manifest").Dot("Classes")).Block(
+			jen.If(jen.Id("c").Dot("Name").Op("==").Lit(g.class.Name).Op("&&").Id("c").Dot("Package").Op("==").Lit(g.class.Package)).Block(
+				jen.Return(jen.Id("c").Dot("Hashes"), jen.Nil()),
+			),
+		),
+		jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("%s has no entry for "+qualifiedName), jen.Id("path"))),
+	)
+	f.Line()
+
+	f.Comment("reembed checks the source file at path against the embedded source (--reembed)")
+	f.Comment("and answers the exit code. A later revision in the manifest lineage is rebuilt")
+	f.Comment("with $PROCYON_BUILD, or the rebuild commands are printed.")
+	f.Func().Id("reembed").Params(jen.Id("path").String()).Int().Block(
+		jen.List(jen.Id("src"), jen.Err()).Op(":=").Qual("os", "ReadFile").Call(jen.Id("path")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			errorf("%v", jen.Err()),
+			jen.Return(jen.Lit(1)),
+		),
+		jen.Id("sum").Op(":=").Qual("crypto/sha256", "Sum256").Call(jen.Id("src")),
+		jen.Id("hash").Op(":=").Qual("encoding/hex", "EncodeToString").Call(jen.Id("sum").Index(jen.Op(":"))),
+		jen.If(jen.Id("hash").Op("==").Id("_contentHash")).Block(
+			jen.Qual("fmt", "Printf").Call(jen.Lit("%s is the embedded source (%s)\n"), jen.Id("path"), jen.Id("hash")),
+			jen.Return(jen.Lit(0)),
+		),
+		jen.Line(),
+		jen.List(jen.Id("lineage"), jen.Err()).Op(":=").Id("sourceLineage").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			errorf("cannot verify %s: %v", jen.Id("path"), jen.Err()),
+			jen.Return(jen.Lit(1)),
+		),
+		jen.List(jen.Id("embedded"), jen.Id("given")).Op(":=").Lit(-1).Op(",").Lit(-1),
+		jen.For(jen.List(jen.Id("i"), jen.Id("h")).Op(":=").Range().Id("lineage")).Block(
+			jen.If(jen.Id("h").Op("==").Id("_contentHash")).Block(
+				jen.Id("embedded").Op("=").Id("i"),
+			),
+			jen.If(jen.Id("h").Op("==").Id("hash")).Block(
+				jen.Id("given").Op("=").Id("i"),
+			),
+		),
+		jen.Switch().Block(
+			jen.Case(jen.Id("embedded").Op("<").Lit(0)).Block(
+				errorf("the embedded source (%s) is not in the manifest lineage of "+qualifiedName, jen.Id("_contentHash")),
+				jen.Return(jen.Lit(1)),
+			),
+			jen.Case(jen.Id("given").Op("<").Lit(0)).Block(
+				errorf("%s (%s) is not in the manifest lineage of "+qualifiedName, jen.Id("path"), jen.Id("hash")),
+				jen.Return(jen.Lit(1)),
+			),
+			jen.Case(jen.Id("given").Op("<").Id("embedded")).Block(
+				errorf("%s (%s) is older than the embedded source (%s)", jen.Id("path"), jen.Id("hash"), jen.Id("_contentHash")),
+				jen.Return(jen.Lit(1)),
+			),
+		),
+		jen.Line(),
+		jen.If(jen.Id("build").Op(":=").Qual("os", "Getenv").Call(jen.Lit("PROCYON_BUILD")), jen.Id("build").Op("!=").Lit("")).Block(
+			jen.Id("cmd").Op(":=").Qual("os/exec", "Command").Call(jen.Lit("sh"), jen.Lit("-c"), jen.Id("build")),
+			jen.Id("cmd").Dot("Env").Op("=").Append(jen.Qual("os", "Environ").Call(), jen.Lit("TRASH_CLASS="+qualifiedName), jen.Lit("TRASH_SOURCE=").Op("+").Id("path")),
+			jen.List(jen.Id("cmd").Dot("Stdin"), jen.Id("cmd").Dot("Stdout"), jen.Id("cmd").Dot("Stderr")).Op("=").List(jen.Qual("os", "Stdin"), jen.Qual("os", "Stdout"), jen.Qual("os", "Stderr")),
+			jen.If(jen.Err().Op(":=").Id("cmd").Dot("Run").Call(), jen.Err().Op("!=").Nil()).Block(
+				errorf("%s: %v", jen.Id("build"), jen.Err()),
+				jen.Return(jen.Lit(1)),
+			),
+			jen.Return(jen.Lit(0)),
+		),
+		jen.Qual("fmt", "Printf").Call(jen.Lit("%s (%s) is a later revision of the embedded source (%s).\n"+
+			"Rebuild "+compiledName+".native from it:\n\n"+
+			"  driver.bash parse %s | procyon > "+compiledName+"/main.go\n"+
+			"  cp %s "+compiledName+"/"+compiledName+".trash\n"+
+			"  go build -o "+compiledName+".native ./"+compiledName+"\n\n"+
+			"or set PROCYON_BUILD to the build command.\n"),
+			jen.Id("path"), jen.Id("hash"), jen.Id("_contentHash"), jen.Id("path"), jen.Id("path")),
+		jen.Return(jen.Lit(0)),
+	)
+	f.Line()
+}
@@ -0,0 +1,93 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains support for instance reference ivars (ref: declarations).
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/dave/jennifer/jen"
+)
+
+// refVars returns the instance variables declared with ref:.
+func (g *generator) refVars() []ast.InstanceVar {
+	var refs []ast.InstanceVar
+	for _, iv := range g.class.InstanceVars {
+		if iv.Ref {
+			refs = append(refs, iv)
+		}
+	}
+	return refs
+}
+
+// refSelector returns the dispatch selector for a reference helper.
+// For "owner" this is "ownerDo_args_" (ownerDo: selector args: ...).
+func refSelector(name string) string {
+	return name + "Do_args_"
+}
+
+// generateRefHelpers generates the _sendRef helper and one <name>Do_args
+// method per reference ivar. Nothing is emitted for classes without refs.
+func (g *generator) generateRefHelpers(f *jen.File) {
+	if len(g.refVars()) == 0 {
+		return
+	}
+	g.generateSendRef(f)
+	g.generateRefMethods(f)
+}
+
+// generateSendRef generates _sendRef, which dispatches selector to the
+// instance whose ID is stored in a reference ivar. It goes through
+// sendMessage, so the daemon client sends it with the instance's data.
+func (g *generator) generateSendRef(f *jen.File) {
+	f.Comment("_sendRef sends a message to the instance referenced by an ivar, through")
+	f.Comment("the daemon when there is one")
+	f.Func().Id("_sendRef").Params(
+		jen.Id("ref").String(),
+		jen.Id("selector").String(),
+		jen.Id("args").Index().String(),
+	).String().Block(
+		jen.If(jen.Id("ref").Op("==").Lit("")).Block(
+			jen.Return(jen.Lit("")),
+		),
+		jen.Id("sendArgs").Op(":=").Make(jen.Index().Interface(), jen.Len(jen.Id("args"))),
+		jen.For(jen.List(jen.Id("i"), jen.Id("arg")).Op(":=").Range().Id("args")).Block(
+			jen.Id("sendArgs").Index(jen.Id("i")).Op("=").Id("arg"),
+		),
+		jen.Return(jen.Id("sendMessage").Call(jen.Id("ref"), jen.Id("selector"), jen.Id("sendArgs").Op("..."))),
+	)
+	f.Line()
+}
+
+// generateRefMethods generates one <name>Do_args method per reference ivar.
+func (g *generator) generateRefMethods(f *jen.File) {
+	for _, iv := range g.refVars() {
+		goName := mangle.GoName(refSelector(iv.Name))
+		f.Comment(goName + " sends selector to the instance referenced by " + iv.Name)
+		f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id(goName).Params(
+			jen.Id("selector").String(),
+			jen.Id("args").Op("...").String(),
+		).String().Block(
+			jen.Return(jen.Id("_sendRef").Call(jen.Id("c").Dot(capitalize(iv.Name)), jen.Id("selector"), jen.Id("args"))),
+		)
+		f.Line()
+	}
+}
+
+// refDispatchCases returns dispatch cases for reference helpers.
+// The first arg is the selector; remaining args are forwarded unchanged.
+func (g *generator) refDispatchCases() []dispatchCase {
+	var cases []dispatchCase
+	for _, iv := range g.refVars() {
+		selector := refSelector(iv.Name)
+		cases = append(cases, dispatchCase{selector, []jen.Code{
+			jen.If(jen.Len(jen.Id("args")).Op("<").Lit(1)).Block(
+				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(selector+" requires a selector argument"))),
+			),
+			jen.If(jen.Id("c").Dot(capitalize(iv.Name)).Op("==").Lit("")).Block(
+				jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit(iv.Name+" does not reference an instance"))),
+			),
+			jen.Return(jen.Id("c").Dot(mangle.GoName(selector)).Call(jen.Id("args").Index(jen.Lit(0)), jen.Id("args").Index(jen.Lit(1).Op(":")).Op("...")), jen.Nil()),
+		}})
+	}
+	return cases
+}
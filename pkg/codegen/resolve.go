@@ -0,0 +1,86 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file resolves class references in compiled methods to the classes
+// they name, using the class's package and imports.
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// setClasses records the other compiled classes that methods may send to
+// (Options.Classes), as qualified or compiled names, and checks that every
+// imported package has at least one of them. Without them class references
+// are resolved within the class's own package only and not validated.
+func (g *generator) setClasses(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	g.knownClasses = map[string]bool{g.class.QualifiedName(): true}
+	packages := map[string]bool{}
+	for _, name := range names {
+		name = mangle.QualifiedClass(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		g.knownClasses[name] = true
+		if pkg, _, ok := strings.Cut(name, "::"); ok {
+			packages[pkg] = true
+		}
+	}
+	for _, imp := range g.class.Imports {
+		if !packages[imp] && imp != g.class.Package {
+			g.warnings = append(g.warnings, fmt.Sprintf("imported package %s has no compiled classes", imp))
+		}
+	}
+}
+
+// resolveClass returns the qualified name of the class a reference in
+// method m names. A bare name is looked up in the class's own package, then
+// in each imported package, then among non-namespaced classes. Sends keep
+// the qualified name: the runtime maps it to the compiled binary or plugin
+// (Utils__Logger) itself and falls back to the Bash class of that name.
+func (g *generator) resolveClass(name string, m *compiledMethod) string {
+	if strings.Contains(name, "::") {
+		if g.knownClasses != nil && !g.knownClasses[name] {
+			g.warnings = append(g.warnings, fmt.Sprintf("%s: unresolved class reference %s (no compiled %s, left to the runtime)", m.selector, name, mangle.CompiledClass(name)))
+		}
+		return name
+	}
+
+	if name == g.class.Name {
+		return g.class.QualifiedName()
+	}
+	if g.knownClasses == nil {
+		return name
+	}
+
+	var candidates []string
+	if g.class.Package != "" {
+		candidates = append(candidates, g.class.Package+"::"+name)
+	}
+	for _, imp := range g.class.Imports {
+		if imp != g.class.Package {
+			candidates = append(candidates, imp+"::"+name)
+		}
+	}
+	var found []string
+	for _, c := range candidates {
+		if g.knownClasses[c] {
+			found = append(found, c)
+		}
+	}
+	switch {
+	case len(found) > 1 && !(g.class.Package != "" && found[0] == g.class.Package+"::"+name):
+		g.warnings = append(g.warnings, fmt.Sprintf("%s: class reference %s is ambiguous (%s), using %s", m.selector, name, strings.Join(found, ", "), found[0]))
+		return found[0]
+	case len(found) > 0:
+		return found[0]
+	case g.knownClasses[name]:
+		return name
+	}
+	g.warnings = append(g.warnings, fmt.Sprintf("%s: unresolved class reference %s (no compiled class, left to the runtime)", m.selector, name))
+	return name
+}
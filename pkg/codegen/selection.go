@@ -0,0 +1,52 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file restricts which methods are compiled (Options.Only and
+// Options.Skip), leaving the rest to Bash.
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// setSelection records the selectors to compile (only, all if empty) and
+// the selectors to leave to Bash (skip). Selectors may be written at:put:
+// or at_put_; they match both instance and class methods.
+func (g *generator) setSelection(only, skip []string) {
+	if len(only) == 0 && len(skip) == 0 {
+		return
+	}
+	defined := map[string]bool{}
+	for _, m := range g.class.Methods {
+		defined[m.Selector] = true
+	}
+	record := func(selectors []string) map[string]bool {
+		set := map[string]bool{}
+		for _, s := range selectors {
+			s = strings.ReplaceAll(strings.TrimSpace(s), ":", "_")
+			if s == "" {
+				continue
+			}
+			if !defined[s] {
+				g.warnings = append(g.warnings, fmt.Sprintf("selector %s in --only or --skip is not defined by %s", s, g.class.Name))
+			}
+			set[s] = true
+		}
+		return set
+	}
+	if len(only) > 0 {
+		g.only = record(only)
+	}
+	g.skip = record(skip)
+}
+
+// deselected returns why a method is left to Bash by the selection, or ""
+// if it is compiled as usual
+func (g *generator) deselected(selector string) string {
+	if g.skip[selector] {
+		return "deselected (--skip)"
+	}
+	if g.only != nil && !g.only[selector] {
+		return "not selected (--only)"
+	}
+	return ""
+}
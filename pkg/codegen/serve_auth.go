@@ -0,0 +1,194 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the authentication of --serve-socket requests, as
+// protocol.AuthProvider does for the daemon. --auth-tokens=FILE reads a
+// token file like protocol.LoadStaticTokens and --auth-hook=CMD asks a
+// program like protocol.ExecHook, so one policy serves the daemon and the
+// class binaries. A refused request is answered with unauthorizedExitCode
+// and not dispatched. Without either flag every request is dispatched.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// unauthorizedExitCode is the exit code of a request the authProvider
+// refused (protocol.ExitUnauthorized)
+const unauthorizedExitCode = 203
+
+// generateServeAuth generates authProvider, its staticTokens and execHook
+// implementations, and authorizeServeRequest
+func (g *generator) generateServeAuth(f *jen.File) {
+	fail := func(args ...jen.Code) jen.Code {
+		return jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(args...))
+	}
+
+	f.Comment("// authProvider validates request tokens and decides which classes their")
+	f.Comment("// principals may use")
+	f.Type().Id("authProvider").Interface(
+		jen.Id("Authenticate").Params(jen.Id("token").String()).Params(jen.String(), jen.Error()),
+		jen.Id("Authorize").Params(jen.List(jen.Id("principal"), jen.Id("class"), jen.Id("selector")).String()).Error(),
+	)
+	f.Line()
+
+	f.Comment("// authorizeServeRequest runs req past auth, if there is one, returning an")
+	f.Comment("// error for a request to refuse")
+	f.Func().Id("authorizeServeRequest").Params(
+		jen.Id("auth").Id("authProvider"),
+		jen.Id("req").Op("*").Id("ServeRequest"),
+	).Error().Block(
+		jen.If(jen.Id("auth").Op("==").Nil()).Block(jen.Return(jen.Nil())),
+		jen.List(jen.Id("principal"), jen.Err()).Op(":=").Id("auth").Dot("Authenticate").Call(jen.Id("req").Dot("Token")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("unauthorized: %w"), jen.Err())),
+		),
+		jen.If(jen.Err().Op(":=").Id("auth").Dot("Authorize").Call(jen.Id("principal"), jen.Lit(g.class.CompiledName()), jen.Id("req").Dot("Selector")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("unauthorized: %w"), jen.Err())),
+		),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// tokenGrant is the principal of a static token and its classes, nil for all")
+	f.Type().Id("tokenGrant").Struct(
+		jen.Id("principal").String(),
+		jen.Id("classes").Map(jen.String()).Bool(),
+	)
+	f.Line()
+
+	f.Comment("// staticTokens maps the SHA-256 of each token of an --auth-tokens file to its")
+	f.Comment("// grant")
+	f.Type().Id("staticTokens").Map(jen.Index(jen.Qual("crypto/sha256", "Size")).Byte()).Id("tokenGrant")
+	f.Line()
+
+	f.Comment("// loadStaticTokens reads a token file: one token per line, followed by its")
+	f.Comment("// principal and the classes it may use, all of them if none or * is given")
+	f.Func().Id("loadStaticTokens").Params(jen.Id("path").String()).Params(jen.Id("staticTokens"), jen.Error()).Block(
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("os", "ReadFile").Call(jen.Id("path")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(jen.Return(jen.Nil(), jen.Err())),
+		jen.Id("tokens").Op(":=").Id("staticTokens").Values(),
+		jen.For(jen.List(jen.Id("i"), jen.Id("line")).Op(":=").Range().Qual("strings", "Split").Call(jen.String().Parens(jen.Id("data")), jen.Lit("\n"))).Block(
+			jen.Id("fields").Op(":=").Qual("strings", "Fields").Call(jen.Id("line")),
+			jen.If(jen.Len(jen.Id("fields")).Op("==").Lit(0).Op("||").Qual("strings", "HasPrefix").Call(jen.Id("fields").Index(jen.Lit(0)), jen.Lit("#"))).Block(
+				jen.Continue(),
+			),
+			jen.If(jen.Len(jen.Id("fields")).Op("<").Lit(2)).Block(
+				jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("line %d: expected a token and a principal"), jen.Id("i").Op("+").Lit(1))),
+			),
+			jen.Id("key").Op(":=").Qual("crypto/sha256", "Sum256").Call(jen.Index().Byte().Parens(jen.Id("fields").Index(jen.Lit(0)))),
+			jen.If(jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Id("tokens").Index(jen.Id("key")), jen.Id("ok")).Block(
+				jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(jen.Lit("line %d: token given twice"), jen.Id("i").Op("+").Lit(1))),
+			),
+			jen.Id("grant").Op(":=").Id("tokenGrant").Values(jen.Dict{jen.Id("principal"): jen.Id("fields").Index(jen.Lit(1))}),
+			jen.For(jen.List(jen.Id("_"), jen.Id("class")).Op(":=").Range().Id("fields").Index(jen.Lit(2).Op(":"))).Block(
+				jen.If(jen.Id("class").Op("==").Lit("*")).Block(
+					jen.Id("grant").Dot("classes").Op("=").Nil(),
+					jen.Break(),
+				),
+				jen.If(jen.Id("grant").Dot("classes").Op("==").Nil()).Block(
+					jen.Id("grant").Dot("classes").Op("=").Map(jen.String()).Bool().Values(),
+				),
+				jen.Id("grant").Dot("classes").Index(jen.Qual("strings", "ReplaceAll").Call(jen.Id("class"), jen.Lit("::"), jen.Lit("__"))).Op("=").True(),
+			),
+			jen.Id("tokens").Index(jen.Id("key")).Op("=").Id("grant"),
+		),
+		jen.Return(jen.Id("tokens"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// Authenticate returns the principal of token")
+	f.Func().Params(jen.Id("s").Id("staticTokens")).Id("Authenticate").Params(jen.Id("token").String()).Params(jen.String(), jen.Error()).Block(
+		jen.If(jen.Id("token").Op("==").Lit("")).Block(
+			jen.Return(jen.Lit(""), jen.Qual("errors", "New").Call(jen.Lit("the request has no token"))),
+		),
+		jen.List(jen.Id("grant"), jen.Id("ok")).Op(":=").Id("s").Index(jen.Qual("crypto/sha256", "Sum256").Call(jen.Index().Byte().Parens(jen.Id("token")))),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Lit(""), jen.Qual("errors", "New").Call(jen.Lit("unknown token"))),
+		),
+		jen.Return(jen.Id("grant").Dot("principal"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// Authorize allows principal the classes of its tokens")
+	f.Func().Params(jen.Id("s").Id("staticTokens")).Id("Authorize").Params(jen.List(jen.Id("principal"), jen.Id("class"), jen.Id("selector")).String()).Error().Block(
+		jen.For(jen.List(jen.Id("_"), jen.Id("grant")).Op(":=").Range().Id("s")).Block(
+			jen.If(jen.Id("grant").Dot("principal").Op("==").Id("principal").Op("&&").Parens(jen.Id("grant").Dot("classes").Op("==").Nil().Op("||").Id("grant").Dot("classes").Index(jen.Id("class")))).Block(
+				jen.Return(jen.Nil()),
+			),
+		),
+		jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%s may not use class %s"), jen.Id("principal"), jen.Id("class"))),
+	)
+	f.Line()
+
+	f.Comment("// execHook is the command of --auth-hook, run with sh -c and one JSON object")
+	f.Comment("// on its stdin for each decision. Exit status 0 accepts, with the principal")
+	f.Comment("// as the first line of stdout; any other refuses, with the first line of")
+	f.Comment("// stderr as the reason.")
+	f.Type().Id("execHook").String()
+	f.Line()
+
+	f.Comment("// Authenticate asks the hook for the principal of token")
+	f.Func().Params(jen.Id("h").Id("execHook")).Id("Authenticate").Params(jen.Id("token").String()).Params(jen.String(), jen.Error()).Block(
+		jen.Return(jen.Id("h").Dot("run").Call(jen.Map(jen.String()).String().Values(jen.Dict{
+			jen.Lit("action"): jen.Lit("authenticate"),
+			jen.Lit("token"):  jen.Id("token"),
+		}))),
+	)
+	f.Line()
+
+	f.Comment("// Authorize asks the hook whether principal may send selector to class")
+	f.Func().Params(jen.Id("h").Id("execHook")).Id("Authorize").Params(jen.List(jen.Id("principal"), jen.Id("class"), jen.Id("selector")).String()).Error().Block(
+		jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("h").Dot("run").Call(jen.Map(jen.String()).String().Values(jen.Dict{
+			jen.Lit("action"):    jen.Lit("authorize"),
+			jen.Lit("principal"): jen.Id("principal"),
+			jen.Lit("class"):     jen.Id("class"),
+			jen.Lit("selector"):  jen.Id("selector"),
+		})),
+		jen.Return(jen.Err()),
+	)
+	f.Line()
+
+	f.Comment("// run runs the hook on req, for at most 5s like protocol.ExecHook, and returns")
+	f.Comment("// the first line of its output")
+	f.Func().Params(jen.Id("h").Id("execHook")).Id("run").Params(jen.Id("req").Map(jen.String()).String()).Params(jen.String(), jen.Error()).Block(
+		jen.List(jen.Id("ctx"), jen.Id("cancel")).Op(":=").Qual("context", "WithTimeout").Call(
+			jen.Qual("context", "Background").Call(),
+			jen.Lit(5).Op("*").Qual("time", "Second"),
+		),
+		jen.Defer().Id("cancel").Call(),
+		jen.Line(),
+		jen.List(jen.Id("input"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("req")),
+		jen.Id("cmd").Op(":=").Qual("os/exec", "CommandContext").Call(jen.Id("ctx"), jen.Lit("sh"), jen.Lit("-c"), jen.String().Parens(jen.Id("h"))),
+		jen.Id("cmd").Dot("WaitDelay").Op("=").Qual("time", "Second"),
+		jen.Id("cmd").Dot("Stdin").Op("=").Qual("bytes", "NewReader").Call(jen.Append(jen.Id("input"), jen.LitRune('\n'))),
+		jen.Var().List(jen.Id("stdout"), jen.Id("stderr")).Qual("bytes", "Buffer"),
+		jen.Id("cmd").Dot("Stdout").Op("=").Op("&").Id("stdout"),
+		jen.Id("cmd").Dot("Stderr").Op("=").Op("&").Id("stderr"),
+		jen.If(jen.Err().Op(":=").Id("cmd").Dot("Run").Call(), jen.Err().Op("!=").Nil()).Block(
+			jen.If(jen.Id("ctx").Dot("Err").Call().Op("!=").Nil()).Block(
+				jen.Return(jen.Lit(""), jen.Qual("errors", "New").Call(jen.Lit("auth hook timed out after 5s"))),
+			),
+			jen.Var().Id("exitErr").Op("*").Qual("os/exec", "ExitError"),
+			jen.If(jen.Op("!").Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("exitErr"))).Block(
+				fail(jen.Lit("auth hook: %w"), jen.Err()),
+			),
+			jen.If(jen.Id("reason").Op(":=").Id("authFirstLine").Call(jen.Id("stderr").Dot("String").Call()), jen.Id("reason").Op("!=").Lit("")).Block(
+				jen.Return(jen.Lit(""), jen.Qual("errors", "New").Call(jen.Id("reason"))),
+			),
+			fail(jen.Lit("auth hook refused the request (exit code %d)"), jen.Id("exitErr").Dot("ExitCode").Call()),
+		),
+		jen.Return(jen.Id("authFirstLine").Call(jen.Id("stdout").Dot("String").Call()), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// authFirstLine returns the first line of s without surrounding space")
+	f.Func().Id("authFirstLine").Params(jen.Id("s").String()).String().Block(
+		jen.List(jen.Id("line"), jen.Id("_"), jen.Id("_")).Op(":=").Qual("strings", "Cut").Call(jen.Qual("strings", "TrimSpace").Call(jen.Id("s")), jen.Lit("\n")),
+		jen.Return(jen.Qual("strings", "TrimSpace").Call(jen.Id("line"))),
+	)
+	f.Line()
+}
+
+// tokenRequestField is the token field of ServeRequest
+func tokenRequestField() jen.Code {
+	return jen.Id("Token").String().Tag(map[string]string{"json": "token,omitempty"})
+}
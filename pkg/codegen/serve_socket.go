@@ -0,0 +1,195 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains --serve-socket: the --serve protocol over a Unix socket,
+// so the Bash runtime can keep one warm process per class and connect to it
+// instead of managing a pipe per caller.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// mainServeSocket returns the main case that starts --serve-socket PATH
+// [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]. Like the
+// daemon's flags, each option also takes its value as the next argument. The
+// process exits after 10 minutes without a request by default.
+func (g *generator) mainServeSocket() jen.Code {
+	usage := "Usage: " + g.class.CompiledName() + ".native --serve-socket PATH [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]"
+	exitUsage := func() []jen.Code {
+		return []jen.Code{
+			jen.Qual("fmt", "Fprintln").Call(jen.Qual("os", "Stderr"), jen.Lit(usage)),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		}
+	}
+	return jen.Case(jen.Lit("--serve-socket")).Block(
+		jen.If(jen.Len(jen.Qual("os", "Args")).Op("<").Lit(3)).Block(exitUsage()...),
+		jen.Id("idle").Op(":=").Lit(10).Op("*").Qual("time", "Minute"),
+		jen.Var().Id("auth").Id("authProvider"),
+		jen.Id("args").Op(":=").Qual("os", "Args").Index(jen.Lit(3).Op(":")),
+		jen.For(jen.Id("i").Op(":=").Lit(0), jen.Id("i").Op("<").Len(jen.Id("args")), jen.Id("i").Op("++")).Block(
+			jen.List(jen.Id("name"), jen.Id("value"), jen.Id("ok")).Op(":=").Qual("strings", "Cut").Call(jen.Id("args").Index(jen.Id("i")), jen.Lit("=")),
+			jen.If(jen.Op("!").Id("ok")).Block(
+				jen.Comment("The value is the next argument: --name value"),
+				jen.If(jen.Id("i").Op("+").Lit(1).Op("==").Len(jen.Id("args"))).Block(exitUsage()...),
+				jen.Id("i").Op("++"),
+				jen.Id("value").Op("=").Id("args").Index(jen.Id("i")),
+			),
+			jen.Switch(jen.Id("name")).Block(
+				jen.Case(jen.Lit("--idle-timeout")).Block(
+					jen.List(jen.Id("d"), jen.Err()).Op(":=").Qual("time", "ParseDuration").Call(jen.Id("value")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Invalid --idle-timeout: %v\n"), jen.Err()),
+						jen.Qual("os", "Exit").Call(jen.Lit(1)),
+					),
+					jen.Id("idle").Op("=").Id("d"),
+				),
+				jen.Case(jen.Lit("--auth-tokens")).Block(
+					jen.If(jen.Id("auth").Op("!=").Nil().Op("||").Id("value").Op("==").Lit("")).Block(exitUsage()...),
+					jen.List(jen.Id("tokens"), jen.Err()).Op(":=").Id("loadStaticTokens").Call(jen.Id("value")),
+					jen.If(jen.Err().Op("!=").Nil()).Block(
+						jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Invalid --auth-tokens: %v\n"), jen.Err()),
+						jen.Qual("os", "Exit").Call(jen.Lit(1)),
+					),
+					jen.Id("auth").Op("=").Id("tokens"),
+				),
+				jen.Case(jen.Lit("--auth-hook")).Block(
+					jen.If(jen.Id("auth").Op("!=").Nil().Op("||").Id("value").Op("==").Lit("")).Block(exitUsage()...),
+					jen.Id("auth").Op("=").Id("execHook").Call(jen.Id("value")),
+				),
+				jen.Default().Block(exitUsage()...),
+			),
+		),
+		jen.Id("runServeSocket").Call(jen.Qual("os", "Args").Index(jen.Lit(2)), jen.Id("idle"), jen.Id("auth")),
+		jen.Return(),
+	)
+}
+
+// generateServeSocket generates runServeSocket and serveSocketConn.
+// Connections are read concurrently, but requests are dispatched one at a
+// time: class instance variables and the storage backends are not safe for
+// concurrent use.
+func (g *generator) generateServeSocket(f *jen.File) {
+	f.Comment("runServeSocket serves --serve requests on the Unix socket at path, one JSON")
+	f.Comment("object per line on any number of connections. It exits after idle without")
+	f.Comment("a request (0: never) or on SIGINT or SIGTERM, removing the socket. Requests")
+	f.Comment("auth refuses are not dispatched.")
+	f.Func().Id("runServeSocket").Params(
+		jen.Id("path").String(),
+		jen.Id("idle").Qual("time", "Duration"),
+		jen.Id("auth").Id("authProvider"),
+	).Block(
+		// A socket someone still accepts on belongs to a live process
+		jen.If(jen.List(jen.Id("conn"), jen.Err()).Op(":=").Qual("net", "Dial").Call(jen.Lit("unix"), jen.Id("path")), jen.Err().Op("==").Nil()).Block(
+			jen.Id("conn").Dot("Close").Call(),
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %s is already being served\n"), jen.Id("path")),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Qual("os", "Remove").Call(jen.Id("path")),
+		jen.Line(),
+
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("openDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error opening database: %v\n"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Defer().Id("db").Dot("Close").Call(),
+		jen.Id("sharedDB").Op("=").Id("db"),
+		g.ensureIndexesOn(jen.Id("db")),
+		jen.Line(),
+
+		jen.List(jen.Id("ln"), jen.Err()).Op(":=").Qual("net", "Listen").Call(jen.Lit("unix"), jen.Id("path")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error listening on %s: %v\n"), jen.Id("path"), jen.Err()),
+			jen.Qual("os", "Exit").Call(jen.Lit(1)),
+		),
+		jen.Comment("Closing the listener unlinks the socket file"),
+		jen.Defer().Id("ln").Dot("Close").Call(),
+		jen.Line(),
+
+		jen.Id("signals").Op(":=").Make(jen.Chan().Qual("os", "Signal"), jen.Lit(1)),
+		jen.Qual("os/signal", "Notify").Call(jen.Id("signals"), jen.Qual("os", "Interrupt"), jen.Qual("syscall", "SIGTERM")),
+		jen.Go().Func().Params().Block(
+			jen.Op("<-").Id("signals"),
+			jen.Id("ln").Dot("Close").Call(),
+		).Call(),
+		jen.Line(),
+
+		jen.Var().Id("timer").Op("*").Qual("time", "Timer"),
+		jen.If(jen.Id("idle").Op(">").Lit(0)).Block(
+			jen.Id("timer").Op("=").Qual("time", "AfterFunc").Call(jen.Id("idle"), jen.Func().Params().Block(
+				jen.Id("ln").Dot("Close").Call(),
+			)),
+		),
+		jen.Var().Id("mu").Qual("sync", "Mutex"),
+		jen.Id("dispatch").Op(":=").Func().Params(jen.Id("req").Op("*").Id("ServeRequest")).Id("ServeResponse").Block(
+			jen.Id("mu").Dot("Lock").Call(),
+			jen.Defer().Id("mu").Dot("Unlock").Call(),
+			jen.Comment("A long request does not count as idle time"),
+			jen.If(jen.Id("timer").Op("!=").Nil()).Block(
+				jen.Id("timer").Dot("Stop").Call(),
+				jen.Defer().Id("timer").Dot("Reset").Call(jen.Id("idle")),
+			),
+			jen.Return(g.serveHandler().Call(jen.Id("db"), jen.Id("req"))),
+		),
+		jen.Line(),
+
+		jen.For().Block(
+			jen.List(jen.Id("conn"), jen.Err()).Op(":=").Id("ln").Dot("Accept").Call(),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Comment("Closed by the idle timer or a signal; let the request in progress finish"),
+				jen.Id("mu").Dot("Lock").Call(),
+				jen.Return(),
+			),
+			jen.Go().Id("serveSocketConn").Call(jen.Id("conn"), jen.Id("auth"), jen.Id("dispatch")),
+		),
+	)
+	f.Line()
+
+	f.Comment("serveSocketConn answers the requests on one connection until the client")
+	f.Comment("closes it")
+	f.Func().Id("serveSocketConn").Params(
+		jen.Id("conn").Qual("net", "Conn"),
+		jen.Id("auth").Id("authProvider"),
+		jen.Id("dispatch").Func().Params(jen.Op("*").Id("ServeRequest")).Id("ServeResponse"),
+	).Block(
+		jen.Defer().Id("conn").Dot("Close").Call(),
+		jen.Id("scanner").Op(":=").Qual("bufio", "NewScanner").Call(jen.Id("conn")),
+		jen.Comment("Increase buffer for large instance JSON"),
+		jen.Id("buf").Op(":=").Make(jen.Index().Byte(), jen.Lit(1024*1024)),
+		jen.Id("scanner").Dot("Buffer").Call(jen.Id("buf"), jen.Len(jen.Id("buf"))),
+		jen.Id("enc").Op(":=").Qual("encoding/json", "NewEncoder").Call(jen.Id("conn")),
+		jen.Id("strict").Op(":=").False(),
+		jen.Line(),
+
+		jen.For(jen.Id("scanner").Dot("Scan").Call()).Block(
+			jen.Id("line").Op(":=").Id("scanner").Dot("Text").Call(),
+			jen.If(jen.Id("line").Op("==").Lit("")).Block(jen.Continue()),
+			jen.Line(),
+
+			jen.Var().Id("req").Id("ServeRequest"),
+			jen.Var().Id("resp").Id("ServeResponse"),
+			jen.If(jen.Err().Op(":=").Id("decodeServeRequest").Call(
+				jen.Id("line"),
+				jen.Op("&").Id("strict"),
+				jen.Op("&").Id("req"),
+			).Op(";").Err().Op("!=").Nil()).Block(
+				jen.Id("resp").Op("=").Id("ServeResponse").Values(jen.Dict{
+					jen.Id("ExitCode"): jen.Lit(1),
+					jen.Id("Error"):    jen.Lit("invalid JSON: ").Op("+").Err().Dot("Error").Call(),
+				}),
+			).Else().If(jen.Err().Op(":=").Id("authorizeServeRequest").Call(jen.Id("auth"), jen.Op("&").Id("req")), jen.Err().Op("!=").Nil()).Block(
+				jen.Id("resp").Op("=").Id("ServeResponse").Values(jen.Dict{
+					jen.Id("ExitCode"): jen.Lit(unauthorizedExitCode),
+					jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+				}),
+			).Else().Block(
+				jen.Id("resp").Op("=").Id("dispatch").Call(jen.Op("&").Id("req")),
+			),
+			jen.If(jen.Id("enc").Dot("Encode").Call(jen.Id("resp")).Op("!=").Nil()).Block(
+				jen.Return(),
+			),
+		),
+	)
+	f.Line()
+
+	g.generateServeAuth(f)
+}
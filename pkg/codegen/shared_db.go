@@ -0,0 +1,138 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the database connection --serve and --serve-socket
+// share across requests. Dispatch paths that open the database themselves
+// (new, class instance variables, Environment and primitive methods) take it
+// from requestDB, and the SQLite helpers run their queries through
+// statements prepared once on it.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// generateSharedDB generates sharedDB, requestDB and releaseDB, and the busy
+// database helpers. It follows openDB in every mode.
+func (g *generator) generateSharedDB(f *jen.File) {
+	f.Comment("sharedDB is the connection --serve and --serve-socket open once for all")
+	f.Comment("requests; it is nil when the process handles a single request")
+	f.Var().Id("sharedDB").Add(g.dbType())
+	f.Line()
+
+	f.Comment("requestDB returns the database for the current request: the shared")
+	f.Comment("connection when serving, a new one otherwise. Release it with releaseDB.")
+	f.Func().Id("requestDB").Params().Parens(jen.List(g.dbType(), jen.Error())).Block(
+		jen.If(jen.Id("sharedDB").Op("!=").Nil()).Block(
+			jen.Return(jen.Id("sharedDB"), jen.Nil()),
+		),
+		jen.Return(jen.Id("openDB").Call()),
+	)
+	f.Line()
+
+	f.Comment("releaseDB closes a database from requestDB unless it is the shared connection")
+	f.Func().Id("releaseDB").Params(jen.Id("db").Add(g.dbType())).Block(
+		jen.If(jen.Id("db").Op("!=").Id("sharedDB")).Block(
+			jen.Id("db").Dot("Close").Call(),
+		),
+	)
+	f.Line()
+
+	generateBusyHelpers(f)
+}
+
+// generateStmtCache generates dbExec, dbQuery and dbQueryRow, which run a
+// query as a statement prepared once on sharedDB, and as a plain query on
+// any other connection. Requests are dispatched one at a time, so the cache
+// needs no lock. dbExec retries while the database is locked; a write that
+// found it locked did not happen. During a unit of work they all run in its
+// transaction.
+func (g *generator) generateStmtCache(f *jen.File) {
+	sqlDB := jen.Op("*").Qual("database/sql", "DB")
+	params := []jen.Code{
+		jen.Id("db").Add(sqlDB),
+		jen.Id("query").String(),
+		jen.Id("args").Op("...").Interface(),
+	}
+
+	f.Comment("stmtCache holds the statements prepared on sharedDB, by query")
+	f.Var().Id("stmtCache").Op("=").Map(jen.String()).Op("*").Qual("database/sql", "Stmt").Values()
+	f.Line()
+
+	f.Comment("cachedStmt returns query prepared on db if db is sharedDB, and nil otherwise.")
+	f.Comment("During a unit of work the statement runs in its transaction.")
+	f.Func().Id("cachedStmt").Params(jen.Id("db").Add(sqlDB.Clone()), jen.Id("query").String()).Op("*").Qual("database/sql", "Stmt").Block(
+		jen.If(jen.Id("db").Op("==").Nil().Op("||").Id("db").Op("!=").Id("sharedDB")).Block(
+			jen.Return(jen.Nil()),
+		),
+		jen.If(jen.Id("work").Op("!=").Nil().Op("&&").Id("work").Dot("db").Op("!=").Id("db")).Block(
+			jen.Return(jen.Nil()),
+		),
+		jen.List(jen.Id("stmt"), jen.Id("ok")).Op(":=").Id("stmtCache").Index(jen.Id("query")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Comment("// A query that cannot be prepared yet (no instances table) runs unprepared"),
+			jen.List(jen.Id("prepared"), jen.Err()).Op(":=").Id("db").Dot("Prepare").Call(jen.Id("query")),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Nil()),
+			),
+			jen.Id("stmt").Op("=").Id("prepared"),
+			jen.Id("stmtCache").Index(jen.Id("query")).Op("=").Id("stmt"),
+		),
+		jen.If(jen.Id("work").Op("!=").Nil().Op("&&").Id("work").Dot("tx").Op("!=").Nil()).Block(
+			jen.Return(jen.Id("work").Dot("tx").Dot("Stmt").Call(jen.Id("stmt"))),
+		),
+		jen.Return(jen.Id("stmt")),
+	)
+	f.Line()
+
+	f.Comment("dbExec runs query on db like db.Exec, retrying while the database is locked")
+	f.Func().Id("dbExec").Params(params...).Parens(jen.List(jen.Qual("database/sql", "Result"), jen.Error())).Block(
+		jen.Var().Id("res").Qual("database/sql", "Result"),
+		jen.Err().Op(":=").Id("_retryBusy").Call(jen.Func().Params().Parens(jen.Err().Error()).Block(
+			jen.If(jen.Id("stmt").Op(":=").Id("cachedStmt").Call(jen.Id("db"), jen.Id("query")), jen.Id("stmt").Op("!=").Nil()).Block(
+				jen.List(jen.Id("res"), jen.Err()).Op("=").Id("stmt").Dot("Exec").Call(jen.Id("args").Op("...")),
+				jen.Return(jen.Err()),
+			),
+			jen.List(jen.Id("res"), jen.Err()).Op("=").Id("workConn").Call(jen.Id("db")).Dot("Exec").Call(jen.Id("query"), jen.Id("args").Op("...")),
+			jen.Return(jen.Err()),
+		)),
+		jen.Return(jen.Id("res"), jen.Err()),
+	)
+	f.Line()
+
+	f.Comment("dbUpdate runs query on db like dbExec, answering conflict if it changes no row")
+	f.Func().Id("dbUpdate").Params(
+		jen.Id("db").Add(sqlDB.Clone()),
+		jen.Id("conflict").Error(),
+		jen.Id("query").String(),
+		jen.Id("args").Op("...").Interface(),
+	).Error().Block(
+		jen.List(jen.Id("res"), jen.Err()).Op(":=").Id("dbExec").Call(jen.Id("db"), jen.Id("query"), jen.Id("args").Op("...")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.If(jen.List(jen.Id("n"), jen.Id("_")).Op(":=").Id("res").Dot("RowsAffected").Call(), jen.Id("n").Op("==").Lit(0)).Block(
+			jen.Return(jen.Id("conflict")),
+		),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("dbQuery runs query on db like db.Query")
+	f.Func().Id("dbQuery").Params(params...).Parens(jen.List(jen.Op("*").Qual("database/sql", "Rows"), jen.Error())).Block(
+		jen.If(jen.Id("stmt").Op(":=").Id("cachedStmt").Call(jen.Id("db"), jen.Id("query")), jen.Id("stmt").Op("!=").Nil()).Block(
+			jen.Return(jen.Id("stmt").Dot("Query").Call(jen.Id("args").Op("..."))),
+		),
+		jen.Return(jen.Id("workConn").Call(jen.Id("db")).Dot("Query").Call(jen.Id("query"), jen.Id("args").Op("..."))),
+	)
+	f.Line()
+
+	f.Comment("dbQueryRow runs query on db like db.QueryRow")
+	f.Func().Id("dbQueryRow").Params(params...).Op("*").Qual("database/sql", "Row").Block(
+		jen.If(jen.Id("stmt").Op(":=").Id("cachedStmt").Call(jen.Id("db"), jen.Id("query")), jen.Id("stmt").Op("!=").Nil()).Block(
+			jen.Return(jen.Id("stmt").Dot("QueryRow").Call(jen.Id("args").Op("..."))),
+		),
+		jen.Return(jen.Id("workConn").Call(jen.Id("db")).Dot("QueryRow").Call(jen.Id("query"), jen.Id("args").Op("..."))),
+	)
+	f.Line()
+
+	generateUnitOfWork(f)
+}
@@ -0,0 +1,123 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the Shell class primitives. @ Shell run: cmd,
+// run:withTimeout: (seconds) and runCapturing: run cmd with sh -c through
+// os/exec and answer the outcome as a JSON object:
+//
+//	{"exit_code": 0, "stdout": "...", "stderr": "..."}
+//
+// runCapturing: captures both streams as one, as 2>&1 would, in "output". A
+// command killed by its timeout answers exit code 124, like timeout(1), and
+// one that cannot be started answers -1; both add "error".
+package codegen
+
+import (
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// shellTimeoutExitCode is the exit code of a command killed by its timeout
+const shellTimeoutExitCode = 124
+
+// usesShell reports whether a method of class sends to Shell, so that the
+// command helper is only generated when needed
+func usesShell(class *ast.Class) bool {
+	for _, m := range class.Methods {
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenIdentifier && tok.Value == "Shell" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shellSelector returns the Trashtalk selector of a Shell operation
+func shellSelector(op string) (string, bool) {
+	switch op {
+	case "shellRun":
+		return "run:", true
+	case "shellRunTimeout":
+		return "run:withTimeout:", true
+	case "shellRunCapturing":
+		return "runCapturing:", true
+	}
+	return "", false
+}
+
+// generateShellPrimitive generates Go code for Shell class primitives
+func (g *generator) generateShellPrimitive(e *parser.ClassPrimitiveExpr, m *compiledMethod) *jen.Statement {
+	if _, ok := shellSelector(e.Operation); !ok || len(e.Args) == 0 {
+		return jen.Comment("unknown Shell primitive: " + e.Operation)
+	}
+	command := g.generateStringArg(e.Args[0], m)
+	timeout := jen.Code(jen.Lit(""))
+	if e.Operation == "shellRunTimeout" {
+		timeout = g.generateStringArg(e.Args[1], m)
+	}
+	return jen.Id("_shellRun").Call(command, timeout, jen.Lit(e.Operation == "shellRunCapturing"))
+}
+
+// generateShellHelpers generates _shellRun
+func (g *generator) generateShellHelpers(f *jen.File) {
+	if !g.shell {
+		return
+	}
+	f.Comment("// Shell primitive helpers")
+	f.Line()
+
+	f.Comment("// _shellRun runs command with sh -c and answers its exit code and output as a")
+	f.Comment("// JSON object. timeout is in seconds, none if empty; combined captures stdout")
+	f.Comment("// and stderr as one stream in output.")
+	f.Func().Id("_shellRun").Params(
+		jen.List(jen.Id("command"), jen.Id("timeout")).String(),
+		jen.Id("combined").Bool(),
+	).String().Block(
+		jen.Id("ctx").Op(":=").Qual("context", "Background").Call(),
+		jen.If(jen.List(jen.Id("t"), jen.Err()).Op(":=").Qual("strconv", "ParseFloat").Call(jen.Id("timeout"), jen.Lit(64)), jen.Err().Op("==").Nil().Op("&&").Id("t").Op(">").Lit(0)).Block(
+			jen.Var().Id("cancel").Qual("context", "CancelFunc"),
+			jen.List(jen.Id("ctx"), jen.Id("cancel")).Op("=").Qual("context", "WithTimeout").Call(
+				jen.Id("ctx"),
+				jen.Qual("time", "Duration").Call(jen.Id("t").Op("*").Float64().Call(jen.Qual("time", "Second"))),
+			),
+			jen.Defer().Id("cancel").Call(),
+		),
+		g.suspendWork(),
+		jen.Id("cmd").Op(":=").Qual("os/exec", "CommandContext").Call(jen.Id("ctx"), jen.Lit("sh"), jen.Lit("-c"), jen.Id("command")),
+		jen.Id("cmd").Dot("WaitDelay").Op("=").Qual("time", "Second").Comment("// don't wait on children holding the pipes after a kill"),
+		jen.Var().List(jen.Id("stdout"), jen.Id("stderr")).Qual("bytes", "Buffer"),
+		jen.Id("cmd").Dot("Stdout").Op("=").Op("&").Id("stdout"),
+		jen.Id("cmd").Dot("Stderr").Op("=").Op("&").Id("stderr"),
+		jen.If(jen.Id("combined")).Block(
+			jen.Id("cmd").Dot("Stderr").Op("=").Op("&").Id("stdout"),
+		),
+		jen.Err().Op(":=").Id("cmd").Dot("Run").Call(),
+		jen.Line(),
+		jen.Id("result").Op(":=").Map(jen.String()).Interface().Values(jen.Dict{
+			jen.Lit("exit_code"): jen.Lit(0),
+		}),
+		jen.If(jen.Id("combined")).Block(
+			jen.Id("result").Index(jen.Lit("output")).Op("=").Id("stdout").Dot("String").Call(),
+		).Else().Block(
+			jen.Id("result").Index(jen.Lit("stdout")).Op("=").Id("stdout").Dot("String").Call(),
+			jen.Id("result").Index(jen.Lit("stderr")).Op("=").Id("stderr").Dot("String").Call(),
+		),
+		jen.Var().Id("exitErr").Op("*").Qual("os/exec", "ExitError"),
+		jen.Switch().Block(
+			jen.Case(jen.Qual("errors", "Is").Call(jen.Id("ctx").Dot("Err").Call(), jen.Qual("context", "DeadlineExceeded"))).Block(
+				jen.Id("result").Index(jen.Lit("exit_code")).Op("=").Lit(shellTimeoutExitCode),
+				jen.Id("result").Index(jen.Lit("error")).Op("=").Lit("timed out after ").Op("+").Id("timeout").Op("+").Lit("s"),
+			),
+			jen.Case(jen.Qual("errors", "As").Call(jen.Err(), jen.Op("&").Id("exitErr"))).Block(
+				jen.Id("result").Index(jen.Lit("exit_code")).Op("=").Id("exitErr").Dot("ExitCode").Call(),
+			),
+			jen.Case(jen.Err().Op("!=").Nil()).Block(
+				jen.Id("result").Index(jen.Lit("exit_code")).Op("=").Lit(-1),
+				jen.Id("result").Index(jen.Lit("error")).Op("=").Err().Dot("Error").Call(),
+			),
+		),
+		jen.List(jen.Id("out"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("result")),
+		jen.Return(jen.String().Parens(jen.Id("out"))),
+	)
+	f.Line()
+}
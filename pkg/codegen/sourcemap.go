@@ -0,0 +1,215 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the source map of Options.SourceMap, which links the
+// lines of each generated method to the .trash method it implements, and the
+// helpers that rewrite a binary's panic traces through it.
+package codegen
+
+import (
+	"fmt"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/dave/jennifer/jen"
+)
+
+// SourceMapVersion is the version of the SourceMap format.
+const SourceMapVersion = 1
+
+// SourceMap links the generated Go of a class to its .trash source. It is
+// written beside the generated code, as JSON, by procyon --source-map.
+type SourceMap struct {
+	Version int    `json:"version"`
+	Class   string `json:"class"`
+	Source  string `json:"source"` // the .trash file of the class
+	// Methods are the compiled methods in the order they are generated
+	Methods []SourceMapEntry `json:"methods"`
+}
+
+// SourceMapEntry is the range of generated lines of one compiled method and
+// where the method is defined.
+type SourceMapEntry struct {
+	Selector    string `json:"selector"` // as written in Trashtalk, at:put:
+	ClassMethod bool   `json:"classMethod,omitempty"`
+	Function    string `json:"function"`
+	GoStart     int    `json:"goStart"` // first line of the function, 1-based
+	GoEnd       int    `json:"goEnd"`   // last line of the function
+	// File is the .trash file defining the method: the class's, or the
+	// trait's it was merged from
+	File  string `json:"file"`
+	Line  int    `json:"line"` // 1-based; 0 if unknown
+	Col   int    `json:"col"`  // 1-based
+	Trait string `json:"trait,omitempty"`
+}
+
+// Lookup returns the entry whose generated lines include line.
+func (m *SourceMap) Lookup(line int) (SourceMapEntry, bool) {
+	for _, e := range m.Methods {
+		if line >= e.GoStart && line <= e.GoEnd {
+			return e, true
+		}
+	}
+	return SourceMapEntry{}, false
+}
+
+// where returns the position and name of the method e maps to, as the
+// panic traces of the binary show it: Counter.trash:12:3 Counter>>increment
+func (e SourceMapEntry) where(class string) string {
+	owner := class
+	if e.ClassMethod {
+		owner += " class"
+	}
+	pos := e.File
+	if e.Line > 0 {
+		pos += fmt.Sprintf(":%d:%d", e.Line, e.Col)
+	}
+	return pos + " " + owner + ">>" + e.Selector
+}
+
+// sourceMapDefer returns the first statement of main, which rewrites the
+// trace of a panic through the source map. Nothing is emitted without a
+// source map.
+func (g *generator) sourceMapDefer() jen.Code {
+	if !g.sourceMap {
+		return jen.Null()
+	}
+	return jen.Defer().Id("_sourceMapPanic").Call()
+}
+
+// generateSourceMapHelpers adds _sourceMap, filled by the init that
+// withSourceMap appends, and the helpers that print a panic with the .trash
+// position of each generated frame of its trace.
+func (g *generator) generateSourceMapHelpers(f *jen.File) {
+	if !g.sourceMap {
+		return
+	}
+	if g.comments {
+		f.Comment("_sourceMapEntry is the .trash position of the generated lines start to end.")
+	}
+	f.Type().Id("_sourceMapEntry").Struct(
+		jen.List(jen.Id("start"), jen.Id("end")).Int(),
+		jen.Id("where").String(),
+	)
+	f.Line()
+	f.Var().Id("_sourceMap").Index().Id("_sourceMapEntry")
+	f.Line()
+
+	// A panic in main's goroutine is printed as the runtime would, with the
+	// source map applied to its trace, and exits 2 like it
+	f.Func().Id("_sourceMapPanic").Params().Block(
+		jen.Id("r").Op(":=").Recover(),
+		jen.If(jen.Id("r").Op("==").Nil()).Block(jen.Return()),
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("panic: %v\n\n%s"), jen.Id("r"),
+			jen.Id("_sourceMapStack").Call(jen.Qual("runtime/debug", "Stack").Call())),
+		jen.Qual("os", "Exit").Call(jen.Lit(2)),
+	)
+	f.Line()
+
+	// Frames of this file end "\t/path/main.go:123 +0x1d"; the position
+	// of the method is appended to those inside a compiled method
+	f.Func().Id("_sourceMapStack").Params(jen.Id("stack").Index().Byte()).String().Block(
+		jen.List(jen.Id("_"), jen.Id("file"), jen.Id("_"), jen.Id("_")).Op(":=").Qual("runtime", "Caller").Call(jen.Lit(0)),
+		jen.Id("prefix").Op(":=").Lit("\t").Op("+").Id("file").Op("+").Lit(":"),
+		jen.Id("lines").Op(":=").Qual("strings", "Split").Call(jen.String().Parens(jen.Id("stack")), jen.Lit("\n")),
+		// Drop the frames of debug.Stack and _sourceMapPanic, up to the
+		// runtime's panic, so the trace starts where the runtime's would
+		jen.For(jen.List(jen.Id("i"), jen.Id("line")).Op(":=").Range().Id("lines")).Block(
+			jen.If(jen.Qual("strings", "HasPrefix").Call(jen.Id("line"), jen.Lit("panic(")).Op("&&").Id("i").Op("+").Lit(2).Op("<=").Len(jen.Id("lines"))).Block(
+				jen.Id("lines").Op("=").Append(jen.Id("lines").Index(jen.Op(":").Lit(1)), jen.Id("lines").Index(jen.Id("i").Op("+").Lit(2).Op(":")).Op("...")),
+				jen.Break(),
+			),
+		),
+		jen.For(jen.List(jen.Id("i"), jen.Id("line")).Op(":=").Range().Id("lines")).Block(
+			jen.If(jen.Op("!").Qual("strings", "HasPrefix").Call(jen.Id("line"), jen.Id("prefix"))).Block(jen.Continue()),
+			jen.Id("rest").Op(":=").Qual("strings", "TrimPrefix").Call(jen.Id("line"), jen.Id("prefix")),
+			jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(
+				jen.Qual("strings", "SplitN").Call(jen.Id("rest"), jen.Lit(" "), jen.Lit(2)).Index(jen.Lit(0))),
+			jen.If(jen.Err().Op("!=").Nil()).Block(jen.Continue()),
+			jen.For(jen.List(jen.Id("_"), jen.Id("e")).Op(":=").Range().Id("_sourceMap")).Block(
+				jen.If(jen.Id("n").Op(">=").Id("e").Dot("start").Op("&&").Id("n").Op("<=").Id("e").Dot("end")).Block(
+					jen.Id("lines").Index(jen.Id("i")).Op("=").Id("line").Op("+").Lit(" [").Op("+").Id("e").Dot("where").Op("+").Lit("]"),
+					jen.Break(),
+				),
+			),
+		),
+		jen.Return(jen.Qual("strings", "Join").Call(jen.Id("lines"), jen.Lit("\n"))),
+	)
+	f.Line()
+}
+
+// withSourceMap returns code with the init filling _sourceMap appended, and
+// the source map of the generated methods in it, or code unchanged and nil
+// without a source map. The init goes at the end so the lines before it,
+// which it maps, do not move.
+func (g *generator) withSourceMap(code string) (string, *SourceMap) {
+	if !g.sourceMap {
+		return code, nil
+	}
+	sm := &SourceMap{
+		Version: SourceMapVersion,
+		Class:   g.class.QualifiedName(),
+		Source:  g.class.CompiledName() + ".trash",
+		Methods: []SourceMapEntry{},
+	}
+
+	// Line ranges of the generated functions, by name and whether they
+	// have a receiver (instance methods) or not (class methods)
+	type funcKey struct {
+		name   string
+		method bool
+	}
+	ranges := map[funcKey][2]int{}
+	fset := token.NewFileSet()
+	if file, err := goparser.ParseFile(fset, "", code, 0); err == nil {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*goast.FuncDecl)
+			if !ok {
+				continue
+			}
+			key := funcKey{fn.Name.Name, fn.Recv != nil}
+			if _, seen := ranges[key]; !seen {
+				ranges[key] = [2]int{fset.Position(fn.Pos()).Line, fset.Position(fn.End()).Line}
+			}
+		}
+	}
+
+	entries := []jen.Code{}
+	for _, m := range g.compiled {
+		lines, ok := ranges[funcKey{m.funcName, !m.isClass}]
+		if m.funcName == "" || !ok {
+			continue
+		}
+		e := SourceMapEntry{
+			Selector:    mangle.TrashSelector(m.selector),
+			ClassMethod: m.isClass,
+			Function:    m.funcName,
+			GoStart:     lines[0],
+			GoEnd:       lines[1],
+			File:        sm.Source,
+			Line:        m.line,
+			Trait:       m.trait,
+		}
+		if m.line > 0 {
+			e.Col = m.col + 1
+		}
+		if m.trait != "" {
+			e.File = m.trait + ".trash"
+		}
+		sm.Methods = append(sm.Methods, e)
+		entries = append(entries, jen.Line().Values(jen.Lit(e.GoStart), jen.Lit(e.GoEnd), jen.Lit(e.where(sm.Class))))
+	}
+
+	if len(entries) > 0 {
+		entries = append(entries, jen.Line())
+	}
+	init := jen.Func().Id("init").Params().Block(
+		jen.Id("_sourceMap").Op("=").Index().Id("_sourceMapEntry").Values(entries...),
+	)
+	code += "\n"
+	if g.comments {
+		code += "// init fills _sourceMap with the .trash position of each compiled method.\n"
+	}
+	code += fmt.Sprintf("%#v\n", init)
+	return code, sm
+}
@@ -0,0 +1,667 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the Storage interface used in place of direct SQLite
+// access, and the backends that can be compiled into a binary.
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/dave/jennifer/jen"
+)
+
+// StorageBackends lists the storage backends codegen can compile in.
+var StorageBackends = []string{"sqlite", "file", "memory", "redis"}
+
+// Options controls optional parts of binary generation. Only, Skip,
+// Classes, Accessors and ImplicitLocals also apply to plugin and WASM
+// generation, and MapDispatch to plugin generation.
+type Options struct {
+	// Storage lists the backends compiled into the binary; the first is the
+	// default. Empty keeps the plain SQLite helpers with no Storage interface.
+	Storage []string
+	// History keeps every saved state of an instance in the instance_history
+	// table, so a request can dispatch read-only against the state as of a
+	// past time (--as-of, or as_of in --serve). Needs the SQLite helpers.
+	History bool
+	// MapDispatch makes dispatch and dispatchClass look the selector up in
+	// an init-built map even below dispatchMapThreshold cases.
+	MapDispatch bool
+	// Only lists the selectors to compile; the other methods fall back to
+	// Bash. Empty compiles every method that can be compiled.
+	Only []string
+	// Skip lists selectors to leave to Bash even if they could be compiled.
+	Skip []string
+	// Classes lists the other compiled classes, as qualified (Utils::Logger)
+	// or compiled (Utils__Logger) names, such as the plugins in the plugin
+	// directory. When set, bare class names in methods resolve through the
+	// class's package and imports, and references to classes not listed
+	// are reported as warnings.
+	Classes []string
+	// Accessors dispatches a getter (value) and a setter (value:) for each
+	// instance variable the class defines no method for, like the accessors
+	// the Bash runtime generates, instead of leaving them to Bash.
+	Accessors bool
+	// ImplicitLocals declares the variables a method uses without defining
+	// them as locals, as the Bash runtime treats them, instead of leaving
+	// the method to Bash.
+	ImplicitLocals bool
+	// FallbackStats counts, per selector, the dispatches that exit 200 to
+	// fall back to Bash in the fallback_stats table, and answers the
+	// __fallbackStats class selector with the counts. Needs the SQLite
+	// helpers.
+	FallbackStats bool
+	// Comments emits a doc comment on each generated method, naming its
+	// selector, source line and trait, and on each helper, plus a file
+	// header naming the class, GeneratorVersion and SourceHash. Plugins
+	// also report GeneratorVersion and SourceHash in GetClassInfo.
+	Comments         bool
+	GeneratorVersion string
+	SourceHash       string
+	// Migrate records the hash of the class source in each saved instance.
+	// Instances saved by another version of the source are migrated when
+	// loaded: instance variables renamed with migrate: old to: new keep
+	// their value, and missing ones get their defaults. A migrate:
+	// declaration turns it on by itself. Binary and WASM generation only.
+	Migrate bool
+	// SourceMap fills Result.SourceMap with the generated lines of each
+	// compiled method and makes the binary print panics with the .trash
+	// file, line and method of each generated frame. Binary generation
+	// only.
+	SourceMap bool
+}
+
+// GenerateWithOptions produces Go source code for a standalone binary with
+// the given options. Generate(class) is GenerateWithOptions(class, Options{}).
+func GenerateWithOptions(class *ast.Class, opts Options) *Result {
+	return newBinaryGenerator(class, opts).generate()
+}
+
+// newBinaryGenerator returns the generator of a standalone binary for class
+// with opts
+func newBinaryGenerator(class *ast.Class, opts Options) *generator {
+	g := newGenerator(class)
+	g.setBackends(opts.Storage)
+	g.setHistory(opts.History)
+	g.setFallbackStats(opts.FallbackStats)
+	g.mapDispatch = opts.MapDispatch
+	g.setSelection(opts.Only, opts.Skip)
+	g.setClasses(opts.Classes)
+	g.accessors = opts.Accessors
+	g.implicitLocals = opts.ImplicitLocals
+	g.setComments(opts)
+	g.setSchemaMigration(opts.Migrate)
+	g.sourceMap = opts.SourceMap
+	return g
+}
+
+// setBackends validates and records the requested storage backends.
+func (g *generator) setBackends(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	// These classes are implemented directly on SQLite and gRPC
+	if g.class.Name == "Environment" || g.grpc {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("%s always uses SQLite; storage backends ignored", g.class.Name))
+		return
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			continue
+		}
+		if !isStorageBackend(name) {
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("unknown storage backend %q ignored (use %s)", name, strings.Join(StorageBackends, ", ")))
+			continue
+		}
+		seen[name] = true
+		g.backends = append(g.backends, name)
+	}
+}
+
+// isStorageBackend reports whether name is a known backend.
+func isStorageBackend(name string) bool {
+	for _, b := range StorageBackends {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// useStorage reports whether generated helpers go through the Storage interface.
+func (g *generator) useStorage() bool {
+	return g.wasm || len(g.backends) > 0
+}
+
+// hasBackend reports whether the named backend is compiled in.
+func (g *generator) hasBackend(name string) bool {
+	for _, b := range g.backends {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// usesSQLite reports whether the binary links the sqlite3 driver.
+func (g *generator) usesSQLite() bool {
+	return !g.useStorage() || g.hasBackend("sqlite")
+}
+
+// dbType returns the type of the db handle threaded through generated helpers.
+func (g *generator) dbType() *jen.Statement {
+	if g.useStorage() {
+		return jen.Id("Storage")
+	}
+	return jen.Op("*").Qual("database/sql", "DB")
+}
+
+// generateStorageLoadSave generates loadInstance and saveInstance over Storage.
+func (g *generator) generateStorageLoadSave(f *jen.File) {
+	typeName := g.typeName()
+
+	f.Func().Id(g.fn("loadInstance")).Params(
+		jen.Id("db").Id("Storage"),
+		jen.Id("id").String(),
+	).Parens(jen.List(jen.Op("*").Id(typeName), jen.Error())).BlockFunc(func(grp *jen.Group) {
+		grp.List(jen.Id("data"), jen.Err()).Op(":=").Id("db").Dot("Load").Call(jen.Id("id"))
+		grp.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		)
+		grp.Var().Id("instance").Id(typeName)
+		grp.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("instance")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		)
+		for _, stmt := range g.migrateOnLoad(jen.Id("data")) {
+			grp.Add(stmt)
+		}
+		grp.Return(jen.Op("&").Id("instance"), jen.Nil())
+	})
+	f.Line()
+
+	f.Comment("saveInstance stores instance unless another process saved it since it was loaded,")
+	f.Comment("in which case it returns ErrConflict. New IDs are stored.")
+	f.Func().Id(g.fn("saveInstance")).Params(
+		jen.Id("db").Id("Storage"),
+		jen.Id("id").String(),
+		jen.Id("instance").Op("*").Id(typeName),
+	).Error().Block(
+		jen.Id("loaded").Op(":=").Id("instance").Dot("Version"),
+		jen.Id("instance").Dot("Version").Op("++"),
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("instance")),
+		jen.If(jen.Err().Op("==").Nil()).Block(
+			jen.Err().Op("=").Id("db").Dot("Save").Call(jen.Id("id"), jen.String().Parens(jen.Id("data")), jen.Id("loaded")),
+		),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("instance").Dot("Version").Op("=").Id("loaded"),
+			jen.Return(jen.Err()),
+		),
+		jen.Id("instance").Dot("dirty").Op("=").False(),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+}
+
+// generateStorageCreateDelete generates createInstance and deleteInstance over Storage.
+func (g *generator) generateStorageCreateDelete(f *jen.File) {
+	f.Func().Id(g.fn("createInstance")).Params(
+		jen.Id("db").Id("Storage"),
+		jen.Id("id").String(),
+		jen.Id("instance").Op("*").Id(g.typeName()),
+	).Error().Block(
+		jen.Return(jen.Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Id("instance"))),
+	)
+	f.Line()
+
+	f.Func().Id("deleteInstance").Params(
+		jen.Id("db").Id("Storage"),
+		jen.Id("id").String(),
+	).Error().Block(
+		jen.Return(jen.Id("db").Dot("Delete").Call(jen.Id("id"))),
+	)
+	f.Line()
+}
+
+// generateStorageInterface generates the Storage interface and
+// _storedVersion, which the backends check a save against.
+func (g *generator) generateStorageInterface(f *jen.File) {
+	f.Comment("Storage persists instance JSON by ID. Save stores data unless the stored")
+	f.Comment("instance's _version is no longer expected, in which case it returns")
+	f.Comment("ErrConflict; an ID with nothing stored is saved whatever expected is.")
+	f.Type().Id("Storage").Interface(
+		jen.Id("Load").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())),
+		jen.Id("Save").Params(jen.List(jen.Id("id"), jen.Id("data")).String(), jen.Id("expected").Int()).Error(),
+		jen.Id("Delete").Params(jen.Id("id").String()).Error(),
+		jen.Id("Close").Params().Error(),
+	)
+	f.Line()
+
+	f.Comment("_storedVersion returns the _version of stored instance JSON, 0 if it has none")
+	f.Func().Id("_storedVersion").Params(jen.Id("data").String()).Int().Block(
+		jen.Var().Id("stored").Struct(
+			jen.Id("Version").Int().Tag(map[string]string{"json": "_version"}),
+		),
+		jen.Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("data")), jen.Op("&").Id("stored")),
+		jen.Return(jen.Id("stored").Dot("Version")),
+	)
+	f.Line()
+}
+
+// storageConflict returns the ErrConflict a backend's Save answers for id
+func storageConflict() *jen.Statement {
+	return jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %s"), jen.Id("ErrConflict"), jen.Id("id"))
+}
+
+// checkStoredVersion returns the statement of a Save that answers
+// ErrConflict if stored, found if ok, is not at the expected version
+func checkStoredVersion(stored jen.Code) *jen.Statement {
+	return jen.If(jen.Id("ok").Op("&&").Id("_storedVersion").Call(stored).Op("!=").Id("expected")).Block(
+		jen.Return(storageConflict()),
+	)
+}
+
+// generateStorage generates the Storage interface, each selected backend,
+// an openDB that picks one by --storage=NAME or TRASHTALK_STORAGE, and the
+// shared serve connection.
+func (g *generator) generateStorage(f *jen.File) {
+	g.generateStorageInterface(f)
+
+	f.Comment("storageBackend names the backend openDB uses. It defaults to")
+	f.Comment("TRASHTALK_STORAGE and can be overridden with --storage=NAME.")
+	f.Var().Id("storageBackend").Op("=").Qual("os", "Getenv").Call(jen.Lit("TRASHTALK_STORAGE"))
+	f.Line()
+
+	cases := []jen.Code{}
+	for _, name := range g.backends {
+		var open jen.Code
+		switch name {
+		case "sqlite":
+			g.generateSQLiteStorage(f)
+			open = jen.Return(jen.Id("openSQLiteStorage").Call())
+		case "file":
+			g.generateFileStorage(f)
+			open = jen.Return(jen.Id("openFileStorage").Call())
+		case "memory":
+			g.generateMemoryStorage(f)
+			open = jen.Return(jen.Id("_memoryStorage"), jen.Nil())
+		case "redis":
+			g.generateRedisStorage(f)
+			open = jen.Return(jen.Id("openRedisStorage").Call())
+		}
+		cases = append(cases, jen.Case(jen.Lit(name)).Block(open))
+	}
+	cases = append(cases, jen.Default().Block(
+		jen.Return(jen.Nil(), jen.Qual("fmt", "Errorf").Call(
+			jen.Lit("unknown storage backend %q (compiled in: "+strings.Join(g.backends, ", ")+")"),
+			jen.Id("name"),
+		)),
+	))
+
+	f.Comment("openDB opens the selected storage backend")
+	f.Func().Id("openDB").Params().Parens(jen.List(jen.Id("Storage"), jen.Error())).Block(
+		jen.Id("name").Op(":=").Id("storageBackend"),
+		jen.If(jen.Id("name").Op("==").Lit("")).Block(
+			jen.Id("name").Op("=").Lit(g.backends[0]),
+		),
+		jen.Switch(jen.Id("name")).Block(cases...),
+	)
+	f.Line()
+	g.generateSharedDB(f)
+}
+
+// trashtalkPath generates code for a path under ~/.trashtalk, overridable by env.
+func trashtalkPath(varName, env, name string) []jen.Code {
+	return []jen.Code{
+		jen.Id(varName).Op(":=").Qual("os", "Getenv").Call(jen.Lit(env)),
+		jen.If(jen.Id(varName).Op("==").Lit("")).Block(
+			jen.List(jen.Id("home"), jen.Id("_")).Op(":=").Qual("os", "UserHomeDir").Call(),
+			jen.Id(varName).Op("=").Qual("path/filepath", "Join").Call(jen.Id("home"), jen.Lit(".trashtalk"), jen.Lit(name)),
+		),
+	}
+}
+
+// generateSQLiteStorage generates the SQLite backend (the Bash runtime's database).
+func (g *generator) generateSQLiteStorage(f *jen.File) {
+	recv := jen.Id("s").Op("*").Id("sqliteStorage")
+
+	f.Comment("sqliteStorage keeps instances in the shared instances.db")
+	f.Type().Id("sqliteStorage").Struct(
+		jen.Id("db").Op("*").Qual("database/sql", "DB"),
+	)
+	f.Line()
+
+	open := trashtalkPath("dbPath", "SQLITE_JSON_DB", "instances.db")
+	open = append(open,
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Qual("database/sql", "Open").Call(jen.Lit("sqlite3"), jen.Id("withBusyTimeout").Call(jen.Id("dbPath"))),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.Return(jen.Op("&").Id("sqliteStorage").Values(jen.Dict{jen.Id("db"): jen.Id("db")}), jen.Nil()),
+	)
+	f.Func().Id("openSQLiteStorage").Params().Parens(jen.List(jen.Id("Storage"), jen.Error())).Block(open...)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Load").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.Var().Id("data").String(),
+		jen.Err().Op(":=").Id("_retryBusy").Call(jen.Func().Params().Error().Block(
+			jen.Return(jen.Id("s").Dot("db").Dot("QueryRow").Call(jen.Lit("SELECT data FROM instances WHERE id = ?"), jen.Id("id")).Dot("Scan").Call(jen.Op("&").Id("data"))),
+		)),
+		jen.Return(jen.Id("data"), jen.Err()),
+	)
+	f.Line()
+
+	// The version check and the write are one upsert, as in the plain helpers
+	f.Func().Params(recv.Clone()).Id("Save").Params(jen.List(jen.Id("id"), jen.Id("data")).String(), jen.Id("expected").Int()).Error().Block(
+		jen.Return(jen.Id("_retryBusy").Call(jen.Func().Params().Error().Block(
+			jen.List(jen.Id("res"), jen.Err()).Op(":=").Id("s").Dot("db").Dot("Exec").Call(
+				jen.Lit("INSERT INTO instances (id, data) VALUES (?, json(?)) "+
+					"ON CONFLICT(id) DO UPDATE SET data = excluded.data "+
+					"WHERE COALESCE(json_extract(instances.data, '$._version'), 0) = ?"),
+				jen.Id("id"), jen.Id("data"), jen.Id("expected"),
+			),
+			jen.If(jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Err()),
+			),
+			jen.If(jen.List(jen.Id("n"), jen.Id("_")).Op(":=").Id("res").Dot("RowsAffected").Call(), jen.Id("n").Op("==").Lit(0)).Block(
+				jen.Return(storageConflict()),
+			),
+			jen.Return(jen.Nil()),
+		))),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Delete").Params(jen.Id("id").String()).Error().Block(
+		jen.Return(jen.Id("_retryBusy").Call(jen.Func().Params().Error().Block(
+			jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("s").Dot("db").Dot("Exec").Call(jen.Lit("DELETE FROM instances WHERE id = ?"), jen.Id("id")),
+			jen.Return(jen.Err()),
+		))),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Close").Params().Error().Block(
+		jen.Return(jen.Id("s").Dot("db").Dot("Close").Call()),
+	)
+	f.Line()
+}
+
+// generateFileStorage generates the flat-file backend: one JSON file per instance.
+func (g *generator) generateFileStorage(f *jen.File) {
+	recv := jen.Id("s").Op("*").Id("fileStorage")
+
+	f.Comment("fileStorage keeps each instance in <dir>/<id>.json")
+	f.Type().Id("fileStorage").Struct(
+		jen.Id("dir").String(),
+	)
+	f.Line()
+
+	open := trashtalkPath("dir", "TRASHTALK_STORAGE_DIR", "instances")
+	open = append(open,
+		jen.If(jen.Err().Op(":=").Qual("os", "MkdirAll").Call(jen.Id("dir"), jen.Lit(0755)), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.Return(jen.Op("&").Id("fileStorage").Values(jen.Dict{jen.Id("dir"): jen.Id("dir")}), jen.Nil()),
+	)
+	f.Func().Id("openFileStorage").Params().Parens(jen.List(jen.Id("Storage"), jen.Error())).Block(open...)
+	f.Line()
+
+	f.Comment("path maps an instance ID to its file, rejecting IDs that escape dir")
+	f.Func().Params(recv.Clone()).Id("path").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.If(jen.Id("id").Op("==").Lit("").Op("||").Qual("strings", "ContainsAny").Call(jen.Id("id"), jen.Lit(`/\`)).Op("||").Qual("strings", "HasPrefix").Call(jen.Id("id"), jen.Lit("."))).Block(
+			jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("invalid instance id %q"), jen.Id("id"))),
+		),
+		jen.Return(jen.Qual("path/filepath", "Join").Call(jen.Id("s").Dot("dir"), jen.Id("id").Op("+").Lit(".json")), jen.Nil()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Load").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("s").Dot("path").Call(jen.Id("id")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.Err()),
+		),
+		jen.List(jen.Id("data"), jen.Err()).Op(":=").Qual("os", "ReadFile").Call(jen.Id("path")),
+		jen.Return(jen.String().Parens(jen.Id("data")), jen.Err()),
+	)
+	f.Line()
+
+	// Check the version holding <id>.json.lock, so no other process saves
+	// in between, then write to a temp file of its own and rename it so
+	// readers never see partial JSON
+	f.Func().Params(recv.Clone()).Id("Save").Params(jen.List(jen.Id("id"), jen.Id("data")).String(), jen.Id("expected").Int()).Error().Block(
+		jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("s").Dot("path").Call(jen.Id("id")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.List(jen.Id("lock"), jen.Err()).Op(":=").Qual("os", "OpenFile").Call(jen.Id("path").Op("+").Lit(".lock"), jen.Qual("os", "O_CREATE").Op("|").Qual("os", "O_RDWR"), jen.Lit(0644)),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Defer().Id("lock").Dot("Close").Call(),
+		jen.If(jen.Err().Op(":=").Qual("syscall", "Flock").Call(jen.Int().Parens(jen.Id("lock").Dot("Fd").Call()), jen.Qual("syscall", "LOCK_EX")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.List(jen.Id("stored"), jen.Err()).Op(":=").Qual("os", "ReadFile").Call(jen.Id("path")),
+		jen.If(jen.Err().Op("!=").Nil().Op("&&").Op("!").Qual("os", "IsNotExist").Call(jen.Err())).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Id("ok").Op(":=").Err().Op("==").Nil(),
+		checkStoredVersion(jen.String().Parens(jen.Id("stored"))),
+		jen.List(jen.Id("tmp"), jen.Err()).Op(":=").Qual("os", "CreateTemp").Call(jen.Id("s").Dot("dir"), jen.Id("id").Op("+").Lit(".*.tmp")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Defer().Qual("os", "Remove").Call(jen.Id("tmp").Dot("Name").Call()),
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("tmp").Dot("WriteString").Call(jen.Id("data")), jen.Err().Op("!=").Nil()).Block(
+			jen.Id("tmp").Dot("Close").Call(),
+			jen.Return(jen.Err()),
+		),
+		jen.If(jen.Err().Op(":=").Id("tmp").Dot("Close").Call(), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Return(jen.Qual("os", "Rename").Call(jen.Id("tmp").Dot("Name").Call(), jen.Id("path"))),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Delete").Params(jen.Id("id").String()).Error().Block(
+		jen.List(jen.Id("path"), jen.Err()).Op(":=").Id("s").Dot("path").Call(jen.Id("id")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.If(jen.Err().Op(":=").Qual("os", "Remove").Call(jen.Id("path")), jen.Err().Op("!=").Nil().Op("&&").Op("!").Qual("os", "IsNotExist").Call(jen.Err())).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Close").Params().Error().Block(
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+}
+
+// generateMemoryStorage generates the in-memory backend. Instances live for
+// the life of the process, which suits tests and --serve sessions.
+func (g *generator) generateMemoryStorage(f *jen.File) {
+	recv := jen.Id("s").Op("*").Id("memoryStorage")
+
+	f.Comment("memoryStorage keeps instances in process memory")
+	f.Type().Id("memoryStorage").Struct(
+		jen.Id("mu").Qual("sync", "Mutex"),
+		jen.Id("instances").Map(jen.String()).String(),
+	)
+	f.Line()
+
+	f.Var().Id("_memoryStorage").Op("=").Op("&").Id("memoryStorage").Values(jen.Dict{
+		jen.Id("instances"): jen.Map(jen.String()).String().Values(),
+	})
+	f.Line()
+
+	lock := []jen.Code{
+		jen.Id("s").Dot("mu").Dot("Lock").Call(),
+		jen.Defer().Id("s").Dot("mu").Dot("Unlock").Call(),
+	}
+
+	f.Func().Params(recv.Clone()).Id("Load").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())).Block(append(lock,
+		jen.List(jen.Id("data"), jen.Id("ok")).Op(":=").Id("s").Dot("instances").Index(jen.Id("id")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("instance %s not found"), jen.Id("id"))),
+		),
+		jen.Return(jen.Id("data"), jen.Nil()),
+	)...)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Save").Params(jen.List(jen.Id("id"), jen.Id("data")).String(), jen.Id("expected").Int()).Error().Block(append(lock,
+		jen.List(jen.Id("stored"), jen.Id("ok")).Op(":=").Id("s").Dot("instances").Index(jen.Id("id")),
+		checkStoredVersion(jen.Id("stored")),
+		jen.Id("s").Dot("instances").Index(jen.Id("id")).Op("=").Id("data"),
+		jen.Return(jen.Nil()),
+	)...)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Delete").Params(jen.Id("id").String()).Error().Block(append(lock,
+		jen.Delete(jen.Id("s").Dot("instances"), jen.Id("id")),
+		jen.Return(jen.Nil()),
+	)...)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Close").Params().Error().Block(
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+}
+
+// generateRedisStorage generates the Redis backend. It speaks RESP directly
+// over a TCP connection so binaries need no Redis client dependency.
+func (g *generator) generateRedisStorage(f *jen.File) {
+	recv := jen.Id("s").Op("*").Id("redisStorage")
+
+	f.Comment("redisStorage keeps instances under trashtalk:<id> in Redis")
+	f.Type().Id("redisStorage").Struct(
+		jen.Id("conn").Qual("net", "Conn"),
+		jen.Id("r").Op("*").Qual("bufio", "Reader"),
+	)
+	f.Line()
+
+	f.Func().Id("openRedisStorage").Params().Parens(jen.List(jen.Id("Storage"), jen.Error())).Block(
+		jen.Id("addr").Op(":=").Qual("os", "Getenv").Call(jen.Lit("TRASHTALK_REDIS_ADDR")),
+		jen.If(jen.Id("addr").Op("==").Lit("")).Block(
+			jen.Id("addr").Op("=").Lit("127.0.0.1:6379"),
+		),
+		jen.List(jen.Id("conn"), jen.Err()).Op(":=").Qual("net", "Dial").Call(jen.Lit("tcp"), jen.Id("addr")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Nil(), jen.Err()),
+		),
+		jen.Return(jen.Op("&").Id("redisStorage").Values(jen.Dict{
+			jen.Id("conn"): jen.Id("conn"),
+			jen.Id("r"):    jen.Qual("bufio", "NewReader").Call(jen.Id("conn")),
+		}), jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("redisSaveScript sets KEYS[1] to ARGV[1] and answers 1, unless it holds an")
+	f.Comment("instance whose _version is not ARGV[2], which it answers 0")
+	f.Const().Id("redisSaveScript").Op("=").Lit(`local stored = redis.call('GET', KEYS[1])
+if stored and (cjson.decode(stored)._version or 0) ~= tonumber(ARGV[2]) then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1`)
+	f.Line()
+
+	f.Comment("do sends one command and reads a simple, integer, or bulk reply.")
+	f.Comment("ok is false for a nil bulk reply (missing key).")
+	f.Func().Params(recv.Clone()).Id("do").Params(jen.Id("args").Op("...").String()).Parens(jen.List(jen.Id("reply").String(), jen.Id("ok").Bool(), jen.Err().Error())).Block(
+		jen.Var().Id("b").Qual("strings", "Builder"),
+		jen.Qual("fmt", "Fprintf").Call(jen.Op("&").Id("b"), jen.Lit("*%d\r\n"), jen.Len(jen.Id("args"))),
+		jen.For(jen.List(jen.Id("_"), jen.Id("arg")).Op(":=").Range().Id("args")).Block(
+			jen.Qual("fmt", "Fprintf").Call(jen.Op("&").Id("b"), jen.Lit("$%d\r\n%s\r\n"), jen.Len(jen.Id("arg")), jen.Id("arg")),
+		),
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op("=").Qual("io", "WriteString").Call(jen.Id("s").Dot("conn"), jen.Id("b").Dot("String").Call()), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.False(), jen.Err()),
+		),
+		jen.List(jen.Id("line"), jen.Err()).Op(":=").Id("s").Dot("r").Dot("ReadString").Call(jen.LitRune('\n')),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Lit(""), jen.False(), jen.Err()),
+		),
+		jen.Id("line").Op("=").Qual("strings", "TrimRight").Call(jen.Id("line"), jen.Lit("\r\n")),
+		jen.If(jen.Id("line").Op("==").Lit("")).Block(
+			jen.Return(jen.Lit(""), jen.False(), jen.Qual("errors", "New").Call(jen.Lit("redis: empty reply"))),
+		),
+		jen.Switch(jen.Id("line").Index(jen.Lit(0))).Block(
+			jen.Case(jen.LitRune('+'), jen.LitRune(':')).Block(
+				jen.Return(jen.Id("line").Index(jen.Lit(1).Op(":")), jen.True(), jen.Nil()),
+			),
+			jen.Case(jen.LitRune('-')).Block(
+				jen.Return(jen.Lit(""), jen.False(), jen.Qual("errors", "New").Call(jen.Lit("redis: ").Op("+").Id("line").Index(jen.Lit(1).Op(":")))),
+			),
+			jen.Case(jen.LitRune('$')).Block(
+				jen.List(jen.Id("n"), jen.Err()).Op(":=").Qual("strconv", "Atoi").Call(jen.Id("line").Index(jen.Lit(1).Op(":"))),
+				jen.If(jen.Err().Op("!=").Nil().Op("||").Id("n").Op("<").Lit(0)).Block(
+					jen.Return(jen.Lit(""), jen.False(), jen.Err()),
+				),
+				jen.Id("buf").Op(":=").Make(jen.Index().Byte(), jen.Id("n").Op("+").Lit(2)),
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Qual("io", "ReadFull").Call(jen.Id("s").Dot("r"), jen.Id("buf")), jen.Err().Op("!=").Nil()).Block(
+					jen.Return(jen.Lit(""), jen.False(), jen.Err()),
+				),
+				jen.Return(jen.String().Parens(jen.Id("buf").Index(jen.Op(":").Id("n"))), jen.True(), jen.Nil()),
+			),
+		),
+		jen.Return(jen.Lit(""), jen.False(), jen.Qual("fmt", "Errorf").Call(jen.Lit("redis: unexpected reply %q"), jen.Id("line"))),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Load").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.List(jen.Id("data"), jen.Id("ok"), jen.Err()).Op(":=").Id("s").Dot("do").Call(jen.Lit("GET"), jen.Lit("trashtalk:").Op("+").Id("id")),
+		jen.If(jen.Err().Op("==").Nil().Op("&&").Op("!").Id("ok")).Block(
+			jen.Err().Op("=").Qual("fmt", "Errorf").Call(jen.Lit("instance %s not found"), jen.Id("id")),
+		),
+		jen.Return(jen.Id("data"), jen.Err()),
+	)
+	f.Line()
+
+	// The version check and the SET run in one script, which Redis runs
+	// without interleaving other commands
+	f.Func().Params(recv.Clone()).Id("Save").Params(jen.List(jen.Id("id"), jen.Id("data")).String(), jen.Id("expected").Int()).Error().Block(
+		jen.List(jen.Id("saved"), jen.Id("_"), jen.Err()).Op(":=").Id("s").Dot("do").Call(
+			jen.Lit("EVAL"),
+			jen.Id("redisSaveScript"),
+			jen.Lit("1"),
+			jen.Lit("trashtalk:").Op("+").Id("id"),
+			jen.Id("data"),
+			jen.Qual("strconv", "Itoa").Call(jen.Id("expected")),
+		),
+		jen.If(jen.Err().Op("==").Nil().Op("&&").Id("saved").Op("!=").Lit("1")).Block(
+			jen.Return(storageConflict()),
+		),
+		jen.Return(jen.Err()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Delete").Params(jen.Id("id").String()).Error().Block(
+		jen.List(jen.Id("_"), jen.Id("_"), jen.Err()).Op(":=").Id("s").Dot("do").Call(jen.Lit("DEL"), jen.Lit("trashtalk:").Op("+").Id("id")),
+		jen.Return(jen.Err()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Close").Params().Error().Block(
+		jen.Return(jen.Id("s").Dot("conn").Dot("Close").Call()),
+	)
+	f.Line()
+}
+
+// storageFlag returns the statements main uses to honor a leading
+// --storage=NAME argument. Nothing is emitted without storage backends.
+func (g *generator) storageFlag() jen.Code {
+	if len(g.backends) == 0 {
+		return jen.Null()
+	}
+	return jen.If(jen.Len(jen.Qual("os", "Args")).Op(">").Lit(1).Op("&&").Qual("strings", "HasPrefix").Call(jen.Qual("os", "Args").Index(jen.Lit(1)), jen.Lit("--storage="))).Block(
+		jen.Id("storageBackend").Op("=").Qual("strings", "TrimPrefix").Call(jen.Qual("os", "Args").Index(jen.Lit(1)), jen.Lit("--storage=")),
+		jen.Qual("os", "Args").Op("=").Append(jen.Qual("os", "Args").Index(jen.Op(":").Lit(1)), jen.Qual("os", "Args").Index(jen.Lit(2).Op(":")).Op("...")),
+	).Line()
+}
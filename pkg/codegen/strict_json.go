@@ -0,0 +1,100 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains strict decoding of --serve and --serve-socket request
+// lines, as protocol.Decoder does for the daemon: a request with
+// "strict": true makes its connection reject unknown fields, duplicate keys
+// and data after the document, in it and every later request. Other
+// connections are decoded with json.Unmarshal as before.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// generateStrictDecode generates decodeServeRequest and checkDuplicateKeys
+func generateStrictDecode(f *jen.File) {
+	returnErr := jen.If(jen.Err().Op("!=").Nil()).Block(jen.Return(jen.Err()))
+
+	f.Comment("// decodeServeRequest decodes a request line into req, strictly once *strict is")
+	f.Comment("// set by a request with \"strict\": true")
+	f.Func().Id("decodeServeRequest").Params(
+		jen.Id("line").String(),
+		jen.Id("strict").Op("*").Bool(),
+		jen.Id("req").Op("*").Id("ServeRequest"),
+	).Error().Block(
+		jen.If(jen.Op("!*").Id("strict")).Block(
+			jen.If(jen.Err().Op(":=").Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("line")), jen.Id("req")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Err()),
+			),
+			jen.If(jen.Op("!").Id("req").Dot("Strict")).Block(
+				jen.Return(jen.Nil()),
+			),
+			jen.Op("*").Id("strict").Op("=").True(),
+		),
+		jen.If(jen.Err().Op(":=").Id("checkDuplicateKeys").Call(jen.Id("line")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.Id("dec").Op(":=").Qual("encoding/json", "NewDecoder").Call(jen.Qual("strings", "NewReader").Call(jen.Id("line"))),
+		jen.Id("dec").Dot("DisallowUnknownFields").Call(),
+		jen.If(jen.Err().Op(":=").Id("dec").Dot("Decode").Call(jen.Id("req")), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Err()),
+		),
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dec").Dot("Token").Call(), jen.Err().Op("!=").Qual("io", "EOF")).Block(
+			jen.Return(jen.Qual("errors", "New").Call(jen.Lit("data after the request (one JSON document per line)"))),
+		),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("// checkDuplicateKeys returns an error naming the first key an object of the")
+	f.Comment("// first document in line gives twice")
+	f.Func().Id("checkDuplicateKeys").Params(jen.Id("line").String()).Error().Block(
+		jen.Id("dec").Op(":=").Qual("encoding/json", "NewDecoder").Call(jen.Qual("strings", "NewReader").Call(jen.Id("line"))),
+		jen.Comment("// objects holds the keys seen in each open object, nil for an array"),
+		jen.Var().Id("objects").Index().Map(jen.String()).Bool(),
+		jen.Id("key").Op(":=").False().Comment("// the next token of the innermost object is a key"),
+		jen.For().Block(
+			jen.List(jen.Id("tok"), jen.Err()).Op(":=").Id("dec").Dot("Token").Call(),
+			jen.If(jen.Err().Op("==").Qual("io", "EOF")).Block(
+				jen.Return(jen.Nil()),
+			),
+			returnErr,
+			jen.Switch(jen.Id("tok")).Block(
+				jen.Case(jen.Qual("encoding/json", "Delim").Call(jen.LitRune('{'))).Block(
+					jen.Id("objects").Op("=").Append(jen.Id("objects"), jen.Map(jen.String()).Bool().Values()),
+					jen.Id("key").Op("=").True(),
+					jen.Continue(),
+				),
+				jen.Case(jen.Qual("encoding/json", "Delim").Call(jen.LitRune('['))).Block(
+					jen.Id("objects").Op("=").Append(jen.Id("objects"), jen.Nil()),
+					jen.Id("key").Op("=").False(),
+					jen.Continue(),
+				),
+				jen.Case(jen.Qual("encoding/json", "Delim").Call(jen.LitRune('}')), jen.Qual("encoding/json", "Delim").Call(jen.LitRune(']'))).Block(
+					jen.Id("objects").Op("=").Id("objects").Index(jen.Empty(), jen.Len(jen.Id("objects")).Op("-").Lit(1)),
+				),
+				jen.Default().Block(
+					jen.If(jen.List(jen.Id("s"), jen.Id("ok")).Op(":=").Id("tok").Assert(jen.String()), jen.Id("ok").Op("&&").Id("key")).Block(
+						jen.Id("keys").Op(":=").Id("objects").Index(jen.Len(jen.Id("objects")).Op("-").Lit(1)),
+						jen.If(jen.Id("keys").Index(jen.Id("s"))).Block(
+							jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("duplicate key %q"), jen.Id("s"))),
+						),
+						jen.Id("keys").Index(jen.Id("s")).Op("=").True(),
+						jen.Id("key").Op("=").False(),
+						jen.Continue(),
+					),
+				),
+			),
+			jen.Comment("// A value ended: the document, or an object's next token is a key"),
+			jen.If(jen.Len(jen.Id("objects")).Op("==").Lit(0)).Block(
+				jen.Return(jen.Nil()),
+			),
+			jen.Id("key").Op("=").Id("objects").Index(jen.Len(jen.Id("objects")).Op("-").Lit(1)).Op("!=").Nil(),
+		),
+	)
+	f.Line()
+}
+
+// strictRequestField is the strict field of ServeRequest
+func strictRequestField() jen.Code {
+	return jen.Id("Strict").Bool().Tag(map[string]string{"json": "strict,omitempty"})
+}
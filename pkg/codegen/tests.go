@@ -0,0 +1,286 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the generated test harness (procyon --emit-tests): a
+// _test.go file for a binary that runs dispatch and dispatchClass against
+// the in-memory storage backend. It creates an instance with new, sends
+// each compiled selector sample arguments and saves the result, and checks
+// that unknown selectors and the methods left to Bash fail with
+// ErrUnknownSelector, which the binary turns into exit code 200.
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/dave/jennifer/jen"
+)
+
+// unknownTestSelector is a selector no class defines
+const unknownTestSelector = "__procyonNoSuchSelector"
+
+// GenerateTests produces a _test.go file for the binary that
+// GenerateWithOptions(class, opts) generates. opts.Storage must include the
+// memory backend the tests run against; the Result has no code and a
+// warning otherwise.
+func GenerateTests(class *ast.Class, opts Options) *Result {
+	g := newBinaryGenerator(class, opts)
+	main := g.generate()
+	if !g.hasBackend("memory") {
+		return &Result{Warnings: []string{fmt.Sprintf("tests need the memory storage backend compiled in; no tests generated for %s", class.Name)}}
+	}
+
+	f := jen.NewFile("main")
+	f.HeaderComment("Code generated by procyon --emit-tests. Edit the cases to check results.")
+	g.generateTestMain(f)
+	if class.IsAbstract {
+		g.generateAbstractNewTest(f)
+	} else {
+		g.generateNewTestInstance(f)
+		g.generateNewTest(f)
+		g.generateDispatchTest(f)
+	}
+	g.generateDispatchClassTest(f)
+	g.generateFallbackTest(f)
+
+	buf := &bytes.Buffer{}
+	if err := f.Render(buf); err != nil {
+		return &Result{Code: fmt.Sprintf("// Error rendering: %v", err), Warnings: main.Warnings}
+	}
+	return &Result{Code: buf.String(), Warnings: main.Warnings}
+}
+
+// generateTestMain selects the memory backend for every test
+func (g *generator) generateTestMain(f *jen.File) {
+	f.Comment("TestMain runs the tests against the in-memory storage backend")
+	f.Func().Id("TestMain").Params(jen.Id("m").Op("*").Qual("testing", "M")).Block(
+		jen.Id("storageBackend").Op("=").Lit("memory"),
+		jen.Qual("os", "Exit").Call(jen.Id("m").Dot("Run").Call()),
+	)
+	f.Line()
+}
+
+// generateNewTestInstance generates newTestInstance, which creates an
+// instance with new and loads it as the binary does
+func (g *generator) generateNewTestInstance(f *jen.File) {
+	f.Comment("newTestInstance creates an instance with new and loads it")
+	f.Func().Id("newTestInstance").Params(jen.Id("t").Op("*").Qual("testing", "T")).Parens(jen.List(
+		jen.Op("*").Id(g.typeName()), jen.String(),
+	)).Block(
+		jen.Id("t").Dot("Helper").Call(),
+		jen.List(jen.Id("id"), jen.Err()).Op(":=").Id("dispatchClass").Call(jen.Lit("new"), jen.Nil()),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("t").Dot("Fatalf").Call(jen.Lit("new: %v"), jen.Err()),
+		),
+		jen.List(jen.Id("c"), jen.Err()).Op(":=").Id("loadInstance").Call(jen.Id("_memoryStorage"), jen.Id("id")),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("t").Dot("Fatalf").Call(jen.Lit("loading %s: %v"), jen.Id("id"), jen.Err()),
+		),
+		jen.Return(jen.Id("c"), jen.Id("id")),
+	)
+	f.Line()
+}
+
+// generateNewTest checks new and the built-in class and id selectors
+func (g *generator) generateNewTest(f *jen.File) {
+	builtin := func(selector string, want jen.Code) jen.Code {
+		return jen.If(
+			jen.List(jen.Id("got"), jen.Err()).Op(":=").Id("dispatch").Call(jen.Id("c"), jen.Id("id"), jen.Lit(selector), jen.Nil()),
+			jen.Err().Op("!=").Nil().Op("||").Id("got").Op("!=").Add(want),
+		).Block(
+			jen.Id("t").Dot("Errorf").Call(jen.Lit(selector+" = %q, %v; want %q"), jen.Id("got"), jen.Err(), want),
+		)
+	}
+	f.Comment("TestNew creates an instance and checks the built-in class and id selectors")
+	f.Func().Id("TestNew").Params(jen.Id("t").Op("*").Qual("testing", "T")).Block(
+		jen.List(jen.Id("c"), jen.Id("id")).Op(":=").Id("newTestInstance").Call(jen.Id("t")),
+		builtin("class", jen.Lit(g.class.QualifiedName())),
+		builtin("id", jen.Id("id")),
+	)
+	f.Line()
+}
+
+// generateAbstractNewTest checks that new refuses to create an instance of
+// an abstract class
+func (g *generator) generateAbstractNewTest(f *jen.File) {
+	f.Comment("TestNew checks that new refuses to create an instance of the abstract class")
+	f.Func().Id("TestNew").Params(jen.Id("t").Op("*").Qual("testing", "T")).Block(
+		jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dispatchClass").Call(jen.Lit("new"), jen.Nil()), jen.Err().Op("==").Nil()).Block(
+			jen.Id("t").Dot("Error").Call(jen.Lit("new created an instance of an abstract class")),
+		),
+	)
+	f.Line()
+}
+
+// generateDispatchTest sends each compiled instance selector to a new
+// instance, and saves and reloads the instance if the method changed it
+func (g *generator) generateDispatchTest(f *jen.File) {
+	cases := g.testCases(false)
+	if len(cases) == 0 {
+		return
+	}
+	f.Comment("TestDispatch sends each compiled instance selector, with sample arguments,")
+	f.Comment("to a new instance and saves it")
+	f.Func().Id("TestDispatch").Params(jen.Id("t").Op("*").Qual("testing", "T")).Block(
+		testCaseTable(cases),
+		jen.For(jen.List(jen.Id("_"), jen.Id("tt")).Op(":=").Range().Id("tests")).Block(
+			jen.Id("t").Dot("Run").Call(jen.Id("tt").Dot("selector"), jen.Func().Params(jen.Id("t").Op("*").Qual("testing", "T")).Block(
+				jen.List(jen.Id("c"), jen.Id("id")).Op(":=").Id("newTestInstance").Call(jen.Id("t")),
+				jen.If(
+					jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dispatch").Call(jen.Id("c"), jen.Id("id"), jen.Id("tt").Dot("selector"), jen.Id("tt").Dot("args")),
+					jen.Err().Op("!=").Nil(),
+				).Block(
+					jen.Id("t").Dot("Fatalf").Call(jen.Lit("%s %q: %v"), jen.Id("tt").Dot("selector"), jen.Id("tt").Dot("args"), jen.Err()),
+				),
+				jen.If(jen.Op("!").Id("c").Dot("dirty")).Block(
+					jen.Return(),
+				),
+				jen.If(jen.Err().Op(":=").Id("saveInstance").Call(jen.Id("_memoryStorage"), jen.Id("id"), jen.Id("c")), jen.Err().Op("!=").Nil()).Block(
+					jen.Id("t").Dot("Fatalf").Call(jen.Lit("saving: %v"), jen.Err()),
+				),
+				jen.If(jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("loadInstance").Call(jen.Id("_memoryStorage"), jen.Id("id")), jen.Err().Op("!=").Nil()).Block(
+					jen.Id("t").Dot("Fatalf").Call(jen.Lit("reloading: %v"), jen.Err()),
+				),
+			)),
+		),
+	)
+	f.Line()
+}
+
+// generateDispatchClassTest sends each compiled class selector, with sample
+// arguments
+func (g *generator) generateDispatchClassTest(f *jen.File) {
+	cases := g.testCases(true)
+	if len(cases) == 0 {
+		return
+	}
+	f.Comment("TestDispatchClass sends each compiled class selector, with sample arguments")
+	f.Func().Id("TestDispatchClass").Params(jen.Id("t").Op("*").Qual("testing", "T")).Block(
+		testCaseTable(cases),
+		jen.For(jen.List(jen.Id("_"), jen.Id("tt")).Op(":=").Range().Id("tests")).Block(
+			jen.If(
+				jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dispatchClass").Call(jen.Id("tt").Dot("selector"), jen.Id("tt").Dot("args")),
+				jen.Err().Op("!=").Nil(),
+			).Block(
+				jen.Id("t").Dot("Errorf").Call(jen.Lit("%s %q: %v"), jen.Id("tt").Dot("selector"), jen.Id("tt").Dot("args"), jen.Err()),
+			),
+		),
+	)
+	f.Line()
+}
+
+// generateFallbackTest checks that an unknown selector and each method left
+// to Bash fail with ErrUnknownSelector, so the binary exits 200 and the
+// runtime falls back to Bash
+func (g *generator) generateFallbackTest(f *jen.File) {
+	instance, class := []jen.Code{jen.Lit(unknownTestSelector)}, []jen.Code{jen.Lit(unknownTestSelector)}
+	for _, s := range g.skipped {
+		switch {
+		case g.isClassSelector(s.Selector):
+			if s.Selector != "new" {
+				class = append(class, jen.Lit(s.Selector))
+			}
+		case !g.class.IsAbstract && !instanceBuiltins[s.Selector]:
+			instance = append(instance, jen.Lit(s.Selector))
+		}
+	}
+
+	body := []jen.Code{}
+	if !g.class.IsAbstract {
+		body = append(body,
+			jen.List(jen.Id("c"), jen.Id("id")).Op(":=").Id("newTestInstance").Call(jen.Id("t")),
+			jen.For(jen.List(jen.Id("_"), jen.Id("selector")).Op(":=").Range().Index().String().Values(instance...)).Block(
+				jen.If(
+					jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dispatch").Call(jen.Id("c"), jen.Id("id"), jen.Id("selector"), jen.Nil()),
+					jen.Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector")),
+				).Block(
+					jen.Id("t").Dot("Errorf").Call(jen.Lit("dispatch %s: got %v, want ErrUnknownSelector"), jen.Id("selector"), jen.Err()),
+				),
+			),
+		)
+	}
+	body = append(body,
+		jen.For(jen.List(jen.Id("_"), jen.Id("selector")).Op(":=").Range().Index().String().Values(class...)).Block(
+			jen.If(
+				jen.List(jen.Id("_"), jen.Err()).Op(":=").Id("dispatchClass").Call(jen.Id("selector"), jen.Nil()),
+				jen.Op("!").Qual("errors", "Is").Call(jen.Err(), jen.Id("ErrUnknownSelector")),
+			).Block(
+				jen.Id("t").Dot("Errorf").Call(jen.Lit("dispatchClass %s: got %v, want ErrUnknownSelector"), jen.Id("selector"), jen.Err()),
+			),
+		),
+	)
+
+	f.Comment("TestFallback checks that unknown selectors and the methods left to Bash")
+	f.Comment("fail with ErrUnknownSelector, which the binary exits 200 for")
+	f.Func().Id("TestFallback").Params(jen.Id("t").Op("*").Qual("testing", "T")).Block(body...)
+	f.Line()
+}
+
+// instanceBuiltins are the selectors dispatch answers for every class,
+// whether or not the class defines them
+var instanceBuiltins = map[string]bool{"class": true, "id": true, "delete": true}
+
+// testCase is a selector the harness sends and its sample arguments
+type testCase struct {
+	selector string
+	args     []string
+}
+
+// testCases returns a case for each compiled class or instance method
+func (g *generator) testCases(class bool) []testCase {
+	var cases []testCase
+	for _, m := range g.compiled {
+		if m.isClass != class || class && m.selector == "new" {
+			continue
+		}
+		var args []string
+		for _, arg := range m.args {
+			args = append(args, sampleArg(m.argTypes[arg]))
+		}
+		cases = append(cases, testCase{m.selector, args})
+	}
+	return cases
+}
+
+// sampleArg is the argument the harness passes for an argument declared
+// with argTypes: as typ. Untyped arguments get a number, which string
+// and numeric methods both accept.
+func sampleArg(typ string) string {
+	switch typ {
+	case "float":
+		return "1.5"
+	case "bool":
+		return "true"
+	}
+	return "1"
+}
+
+// testCaseTable declares the tests table of a dispatch test
+func testCaseTable(cases []testCase) jen.Code {
+	var rows []jen.Code
+	for _, c := range cases {
+		args := jen.Nil()
+		if len(c.args) > 0 {
+			var lits []jen.Code
+			for _, a := range c.args {
+				lits = append(lits, jen.Lit(a))
+			}
+			args = jen.Index().String().Values(lits...)
+		}
+		rows = append(rows, jen.Line().Values(jen.Lit(c.selector), args))
+	}
+	return jen.Id("tests").Op(":=").Index().Struct(
+		jen.Id("selector").String(),
+		jen.Id("args").Index().String(),
+	).Values(append(rows, jen.Line())...)
+}
+
+// isClassSelector reports whether the class defines selector as a class
+// method
+func (g *generator) isClassSelector(selector string) bool {
+	for _, m := range g.class.Methods {
+		if m.Selector == selector {
+			return m.Kind == "class"
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains typed instance variables: an instance variable declared
+// with a type annotation (count:<int> 0, tags:<array> []) is an int,
+// float64, []interface{} or map[string]interface{} struct field instead of a
+// string, so arithmetic and JSON primitives use it without conversions.
+package codegen
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// setIvarTypes records the type annotations of the class's instance
+// variables. string needs nothing beyond comparing as a string; ref:
+// variables hold instance IDs and class instance variables are always
+// strings, so their annotations are ignored.
+func (g *generator) setIvarTypes() {
+	for _, iv := range g.class.InstanceVars {
+		switch {
+		case iv.Type == "" || iv.Type == "string":
+		case iv.Ref:
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("ref: %s holds an instance ID; type <%s> ignored", iv.Name, iv.Type))
+		default:
+			g.ivarTypes[iv.Name] = iv.Type
+			// Typed arrays and objects are not json.RawMessage
+			delete(g.jsonVars, iv.Name)
+		}
+	}
+	for _, cv := range g.class.ClassInstanceVars {
+		if cv.Type != "" && cv.Type != "string" {
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("class instance variable %s is a string; type <%s> ignored", cv.Name, cv.Type))
+		}
+	}
+}
+
+// typedIvar returns the type of the typed instance variable name refers
+// to in m, or "" when name is not one (class methods, shadowing args).
+func (g *generator) typedIvar(name string, m *compiledMethod) string {
+	typ, ok := g.ivarTypes[name]
+	if !ok || m == nil || m.isClass {
+		return ""
+	}
+	for _, arg := range m.args {
+		if arg == name {
+			return ""
+		}
+	}
+	return typ
+}
+
+// hasTypedJSON reports whether an instance variable is a typed array or
+// object, which need the _jsonString, _jsonArray, _jsonObject and _deepCopy
+// helpers.
+func (g *generator) hasTypedJSON() bool {
+	for _, typ := range g.ivarTypes {
+		if typ == "array" || typ == "object" {
+			return true
+		}
+	}
+	return false
+}
+
+// ivarGoType returns the struct field type and json tag of iv
+func (g *generator) ivarGoType(iv ast.InstanceVar) (*jen.Statement, string) {
+	switch g.ivarTypes[iv.Name] {
+	case "int":
+		// ,string keeps the "42" the Bash runtime stores
+		return jen.Int(), iv.Name + ",string"
+	case "float":
+		return jen.Float64(), iv.Name + ",string"
+	case "array":
+		return jen.Index().Interface(), iv.Name
+	case "object":
+		return jen.Map(jen.String()).Interface(), iv.Name
+	}
+	return g.inferType(iv), iv.Name
+}
+
+// ivarDefault returns the value of iv in a new instance
+func (g *generator) ivarDefault(iv ast.InstanceVar) jen.Code {
+	val := iv.Default.Value
+	switch g.ivarTypes[iv.Name] {
+	case "int":
+		n, err := strconv.Atoi(val)
+		if err != nil && val != "" {
+			g.warnings = append(g.warnings, fmt.Sprintf("default %q of %s:<int> is not an integer; using 0", val, iv.Name))
+		}
+		return jen.Lit(n)
+	case "float":
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil && val != "" {
+			g.warnings = append(g.warnings, fmt.Sprintf("default %q of %s:<float> is not a number; using 0", val, iv.Name))
+		}
+		return jen.Lit(f)
+	case "array":
+		if val == "" || val == "[]" {
+			return jen.Index().Interface().Values()
+		}
+		if jsonLiteralProblem(val, "array") == "" {
+			return g.jsonConst(val, "array")
+		}
+		return jen.Id("_jsonArray").Call(jen.Lit(val))
+	case "object":
+		if val == "" || val == "{}" {
+			return jen.Map(jen.String()).Interface().Values()
+		}
+		if jsonLiteralProblem(val, "object") == "" {
+			return g.jsonConst(val, "object")
+		}
+		return jen.Id("_jsonObject").Call(jen.Lit(val))
+	}
+	if g.jsonVars[iv.Name] {
+		return jen.Qual("encoding/json", "RawMessage").Parens(jen.Lit(val))
+	}
+	// All other instance variables are strings (JSON representations for arrays/objects)
+	return jen.Lit(val)
+}
+
+// ivarString returns the string form of instance variable name, as the Bash
+// runtime would print it
+func (g *generator) ivarString(name string) *jen.Statement {
+	field := jen.Id("c").Dot(capitalize(name))
+	switch g.ivarTypes[name] {
+	case "int":
+		return jen.Qual("strconv", "Itoa").Call(field)
+	case "float":
+		return jen.Qual("strconv", "FormatFloat").Call(field, jen.LitRune('f'), jen.Lit(-1), jen.Lit(64))
+	case "array", "object":
+		return jen.Id("_jsonString").Call(field)
+	}
+	if g.jsonVars[name] {
+		return jen.String().Parens(field)
+	}
+	return field
+}
+
+// ivarFromString converts the string s to the type of instance variable
+// name, as when a setter receives an argument
+func (g *generator) ivarFromString(name string, s jen.Code) jen.Code {
+	switch g.ivarTypes[name] {
+	case "int":
+		return jen.Id("toInt").Call(s)
+	case "float":
+		return jen.Id("toFloat").Call(s)
+	case "array":
+		return jen.Id("_jsonArray").Call(s)
+	case "object":
+		return jen.Id("_jsonObject").Call(s)
+	}
+	if g.jsonVars[name] {
+		return jen.Qual("encoding/json", "RawMessage").Parens(s)
+	}
+	return s
+}
+
+// typedString returns the string form of expr when its value is a native
+// number, bool, slice or map: a typed argument or instance variable, or a
+// JSON primitive applied to a typed array or object. It returns nil for
+// every other expression.
+func (g *generator) typedString(expr parser.Expr, m *compiledMethod) *jen.Statement {
+	if id, ok := expr.(*parser.Identifier); ok {
+		if g.typedArg(id.Name, m) != "" {
+			return g.argString(id.Name, m)
+		}
+		if g.typedIvar(id.Name, m) == "" {
+			return nil
+		}
+		return g.ivarString(id.Name)
+	}
+	if g.exprResultsInArray(expr, m) || g.exprResultsInObject(expr, m) {
+		return jen.Id("_jsonString").Call(g.generateExpr(expr, m))
+	}
+	return nil
+}
+
+// numOperand converts an arithmetic or comparison operand with conv (toInt
+// or toFloat). Typed numeric arguments and instance variables are used as
+// they are.
+func (g *generator) numOperand(expr parser.Expr, conv string, m *compiledMethod) *jen.Statement {
+	if id, ok := expr.(*parser.Identifier); ok {
+		switch typ, value := g.typedValue(id.Name, m); {
+		case typ == "int" && conv == "toInt", typ == "float" && conv == "toFloat":
+			return value
+		case typ == "int" && conv == "toFloat":
+			return jen.Float64().Parens(value)
+		}
+	}
+	return jen.Id(conv).Call(g.generateExpr(expr, m))
+}
+
+// typedIvarAssignment generates target := value for a typed instance
+// variable
+func (g *generator) typedIvarAssignment(target string, value parser.Expr, m *compiledMethod) []jen.Code {
+	field := jen.Id("c").Dot(capitalize(target))
+	var expr jen.Code
+	switch g.ivarTypes[target] {
+	case "int", "float":
+		// count := count + 1 updates the number in place
+		if step, ok := ivarIncrement(target, value); ok {
+			op := "+="
+			if step < 0 {
+				op, step = "-=", -step
+			}
+			return []jen.Code{
+				field.Op(op).Lit(step),
+				jen.Id("c").Dot("dirty").Op("=").True(),
+			}
+		}
+		kind := g.numKind(value, m)
+		switch {
+		case g.ivarTypes[target] == "int" && kind == numInt:
+			expr = g.generateExpr(value, m)
+		case g.ivarTypes[target] == "float" && kind == numFloat:
+			expr = g.generateExpr(value, m)
+		case g.ivarTypes[target] == "float" && kind == numInt:
+			expr = jen.Float64().Parens(g.generateExpr(value, m))
+		case g.ivarTypes[target] == "int":
+			expr = jen.Id("toInt").Call(g.generateExpr(value, m))
+		default:
+			expr = jen.Id("toFloat").Call(g.generateExpr(value, m))
+		}
+	case "array":
+		if g.exprResultsInArray(value, m) {
+			expr = g.generateExpr(value, m)
+		} else if g.checkJSONLiteral(value, "array", m) {
+			lit, _ := constantString(value)
+			expr = g.jsonConst(lit, "array")
+		} else {
+			expr = jen.Id("_jsonArray").Call(g.generateStringValue(value, m))
+		}
+	case "object":
+		if g.exprResultsInObject(value, m) {
+			expr = g.generateExpr(value, m)
+		} else if g.checkJSONLiteral(value, "object", m) {
+			lit, _ := constantString(value)
+			expr = g.jsonConst(lit, "object")
+		} else {
+			expr = jen.Id("_jsonObject").Call(g.generateStringValue(value, m))
+		}
+	}
+	return []jen.Code{
+		field.Op("=").Add(expr),
+		jen.Id("c").Dot("dirty").Op("=").True(),
+	}
+}
+
+// generateTypedIvarHelpers generates _jsonString, _jsonArray, _jsonObject
+// and _deepCopy when an instance variable is a typed array or object
+func (g *generator) generateTypedIvarHelpers(f *jen.File) {
+	if !g.hasTypedJSON() {
+		return
+	}
+	f.Comment("// _jsonString encodes a typed array or object instance variable as JSON")
+	f.Func().Id("_jsonString").Params(jen.Id("v").Interface()).String().Block(
+		jen.List(jen.Id("data"), jen.Id("_")).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("v")),
+		jen.Return(jen.String().Parens(jen.Id("data"))),
+	)
+	f.Line()
+
+	f.Comment("// _jsonArray decodes a JSON array, or returns an empty one")
+	f.Func().Id("_jsonArray").Params(jen.Id("s").Interface()).Index().Interface().Block(
+		jen.Id("arr").Op(":=").Index().Interface().Values(),
+		jen.Id("_jsonDecode").Call(jen.Index().Byte().Parens(jen.Id("_toStr").Call(jen.Id("s"))), jen.Op("&").Id("arr")),
+		jen.Return(jen.Id("arr")),
+	)
+	f.Line()
+
+	f.Comment("// _jsonObject decodes a JSON object, or returns an empty one")
+	f.Func().Id("_jsonObject").Params(jen.Id("s").Interface()).Map(jen.String()).Interface().Block(
+		jen.Id("obj").Op(":=").Map(jen.String()).Interface().Values(),
+		jen.Id("_jsonDecode").Call(jen.Index().Byte().Parens(jen.Id("_toStr").Call(jen.Id("s"))), jen.Op("&").Id("obj")),
+		jen.Return(jen.Id("obj")),
+	)
+	f.Line()
+
+	f.Comment("// _deepCopy copies the arrays and objects nested in v, for deepCopy")
+	f.Func().Id("_deepCopy").Params(jen.Id("v").Interface()).Interface().Block(
+		jen.Switch(jen.Id("x").Op(":=").Id("v").Assert(jen.Type())).Block(
+			jen.Case(jen.Index().Interface()).Block(
+				jen.If(jen.Id("x").Op("==").Nil()).Block(jen.Return(jen.Id("x"))),
+				jen.Id("out").Op(":=").Make(jen.Index().Interface(), jen.Len(jen.Id("x"))),
+				jen.For(jen.List(jen.Id("i"), jen.Id("e")).Op(":=").Range().Id("x")).Block(
+					jen.Id("out").Index(jen.Id("i")).Op("=").Id("_deepCopy").Call(jen.Id("e")),
+				),
+				jen.Return(jen.Id("out")),
+			),
+			jen.Case(jen.Map(jen.String()).Interface()).Block(
+				jen.If(jen.Id("x").Op("==").Nil()).Block(jen.Return(jen.Id("x"))),
+				jen.Id("out").Op(":=").Make(jen.Map(jen.String()).Interface(), jen.Len(jen.Id("x"))),
+				jen.For(jen.List(jen.Id("k"), jen.Id("e")).Op(":=").Range().Id("x")).Block(
+					jen.Id("out").Index(jen.Id("k")).Op("=").Id("_deepCopy").Call(jen.Id("e")),
+				),
+				jen.Return(jen.Id("out")),
+			),
+		),
+		jen.Return(jen.Id("v")),
+	)
+	f.Line()
+}
@@ -0,0 +1,216 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the check for undefined variables. An identifier that
+// is not an argument, a declared local, an instance or class instance
+// variable, or a block parameter in scope would compile into a bare Go
+// identifier and fail go build, so the method is left to Bash instead, or,
+// with Options.ImplicitLocals, the name is declared as a local.
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
+	"github.com/chazu/procyon/pkg/parser"
+)
+
+// predeclared are the identifiers that compile to Go constants of the same name
+var predeclared = map[string]bool{"nil": true, "true": true, "false": true}
+
+// undefinedVars returns the identifiers body reads or assigns that are not
+// defined in m, in order of first use. Class names receiving a message are
+// not variables.
+func (g *generator) undefinedVars(m ast.Method, body *parser.MethodBody) []string {
+	isClass := m.Kind == "class"
+	scope := map[string]bool{}
+	for _, arg := range m.Args {
+		scope[arg] = true
+	}
+	for _, v := range body.LocalVars {
+		scope[v] = true
+	}
+
+	var undefined []string
+	reported := map[string]bool{}
+	use := func(name string, scope map[string]bool) {
+		switch {
+		case scope[name], predeclared[name], reported[name]:
+		case name == "self" && !isClass:
+		case !isClass && g.instanceVars[name]:
+		case isClass && g.classVars[name]:
+		default:
+			reported[name] = true
+			undefined = append(undefined, name)
+		}
+	}
+	// with returns scope extended with names, for a block's body
+	with := func(scope map[string]bool, names ...string) map[string]bool {
+		inner := make(map[string]bool, len(scope)+len(names))
+		for name := range scope {
+			inner[name] = true
+		}
+		for _, name := range names {
+			if name != "" {
+				inner[name] = true
+			}
+		}
+		return inner
+	}
+
+	var walkStmts func(stmts []parser.Statement, scope map[string]bool)
+	var walkExpr func(expr parser.Expr, scope map[string]bool)
+	walkIteration := func(it *parser.IterationExpr, scope map[string]bool) {
+		walkExpr(it.Collection, scope)
+		walkExpr(it.Initial, scope)
+		walkStmts(it.Body, with(scope, it.IterVar, it.AccVar))
+		walkStmts(it.IfNone, with(scope))
+	}
+	walkDynamicIteration := func(it *parser.DynamicIterationExpr, scope map[string]bool) {
+		walkExpr(it.Collection, scope)
+		walkExpr(it.BlockVar, scope)
+		walkExpr(it.Initial, scope)
+		walkStmts(it.IfNone, with(scope))
+	}
+
+	walkExpr = func(expr parser.Expr, scope map[string]bool) {
+		switch e := expr.(type) {
+		case *parser.Identifier:
+			use(e.Name, scope)
+		case *parser.BinaryExpr:
+			walkExpr(e.Left, scope)
+			walkExpr(e.Right, scope)
+		case *parser.ComparisonExpr:
+			walkExpr(e.Left, scope)
+			walkExpr(e.Right, scope)
+		case *parser.LogicalExpr:
+			walkExpr(e.Left, scope)
+			walkExpr(e.Right, scope)
+		case *parser.BetweenExpr:
+			walkExpr(e.Value, scope)
+			walkExpr(e.Low, scope)
+			walkExpr(e.High, scope)
+		case *parser.MinMaxExpr:
+			walkExpr(e.Left, scope)
+			walkExpr(e.Right, scope)
+		case *parser.NegateExpr:
+			walkExpr(e.Operand, scope)
+		case *parser.NotExpr:
+			walkExpr(e.Operand, scope)
+		case *parser.IfExpr:
+			walkExpr(e.Condition, scope)
+			walkStmts(e.TrueBlock, with(scope))
+			walkStmts(e.FalseBlock, with(scope))
+		case *parser.WhileExpr:
+			walkExpr(e.Condition, scope)
+			walkStmts(e.Body, with(scope))
+		case *parser.CountedLoopExpr:
+			walkExpr(e.From, scope)
+			walkExpr(e.To, scope)
+			walkStmts(e.Body, with(scope, e.IndexVar))
+		case *parser.IfNilExpr:
+			walkExpr(e.Subject, scope)
+			walkStmts(e.NilBlock, with(scope))
+			walkStmts(e.NotNilBlock, with(scope, e.BindingVar))
+		case *parser.BlockExpr:
+			walkStmts(e.Statements, with(scope, e.Params...))
+		case *parser.IterationExpr:
+			walkIteration(e, scope)
+		case *parser.IterationExprAsValue:
+			walkIteration(e.Iteration, scope)
+		case *parser.DynamicIterationExpr:
+			walkDynamicIteration(e, scope)
+		case *parser.DynamicIterationExprAsValue:
+			walkDynamicIteration(e.Iteration, scope)
+		case *parser.JSONPrimitiveExpr:
+			walkExpr(e.Receiver, scope)
+			for _, arg := range e.Args {
+				walkExpr(arg, scope)
+			}
+		case *parser.ClassPrimitiveExpr:
+			for _, arg := range e.Args {
+				walkExpr(arg, scope)
+			}
+		case *parser.MessageSend:
+			if ident, ok := e.Receiver.(*parser.Identifier); ok && !e.IsSelf {
+				// An unknown capitalized receiver is a class name
+				if name := ident.Name; scope[name] || name == "" || name[0] < 'A' || name[0] > 'Z' {
+					use(name, scope)
+				}
+			} else if !e.IsSelf {
+				walkExpr(e.Receiver, scope)
+			}
+			for _, arg := range e.Args {
+				walkExpr(arg, scope)
+			}
+		}
+	}
+
+	walkStmts = func(stmts []parser.Statement, scope map[string]bool) {
+		for _, stmt := range stmts {
+			switch s := stmt.(type) {
+			case *parser.LocalVarDecl:
+				for _, name := range s.Names {
+					scope[name] = true
+				}
+			case *parser.Assignment:
+				use(s.Target, scope)
+				walkExpr(s.Value, scope)
+			case *parser.Return:
+				walkExpr(s.Value, scope)
+			case *parser.ExprStmt:
+				walkExpr(s.Expr, scope)
+			case *parser.ThrowExpr:
+				walkExpr(s.Message, scope)
+			case *parser.OnDoExpr:
+				walkStmts(s.Body, with(scope))
+				walkStmts(s.Handler, with(scope, s.ErrVar))
+			case *parser.EnsureExpr:
+				walkStmts(s.Body, with(scope))
+				walkStmts(s.Cleanup, with(scope))
+			case parser.Expr:
+				walkExpr(s, scope)
+			}
+		}
+	}
+	walkStmts(body.Statements, scope)
+	return undefined
+}
+
+// undefinedReason describes the undefined variables of m, with the source
+// line where each is first used
+func undefinedReason(m ast.Method, names []string) string {
+	described := make([]string, len(names))
+	for i, name := range names {
+		described[i] = name
+		for _, tok := range m.Body.Tokens {
+			if tok.Type == ast.TokenIdentifier && tok.Value == name && tok.Line > 0 {
+				described[i] = fmt.Sprintf("%s (line %d)", name, tok.Line)
+				break
+			}
+		}
+	}
+	if len(names) == 1 {
+		return "undefined variable: " + described[0]
+	}
+	return "undefined variables: " + strings.Join(described, ", ")
+}
+
+// checkUndefinedVars reports the undefined variables of m. It returns the
+// reason to leave m to Bash, or "" if there are none or Options.ImplicitLocals
+// declared them as locals of body.
+func (g *generator) checkUndefinedVars(m ast.Method, body *parser.MethodBody) string {
+	names := g.undefinedVars(m, body)
+	if len(names) == 0 {
+		return ""
+	}
+	if !g.implicitLocals {
+		return undefinedReason(m, names)
+	}
+	body.LocalVars = append(body.LocalVars, names...)
+	for _, name := range names {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("undefined variable %s in %s declared as a local", name, mangle.TrashSelector(m.Selector)))
+	}
+	return ""
+}
@@ -0,0 +1,276 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains the unit of work of instance requests to a binary and of
+// --serve, --serve-socket and plugin dispatches. A dispatch runs in one
+// transaction, begun before the instance is loaded and
+// committed when it succeeds. The instance writes of the generated helpers
+// (createInstance, saveInstance, deleteInstance, class instance variables
+// and history) and the reads between them go through it, so the dispatch
+// sees its own writes and no other process sees them before it ends. A
+// method error rolls the transaction back, so a failed request leaves no
+// partial writes behind.
+//
+// A message sent to another process, a Shell command or a Bash block may
+// write the same database, and would wait on the dispatch's locks. Before
+// one runs the transaction is committed, and the rest of the dispatch runs
+// in a new one, so a method error only rolls back the writes made since.
+// The _version check of saveInstance still catches an instance the other
+// process saved. While the dispatch waits, another may run, such as a
+// plugin dispatch the message leads back to, in a transaction of its own.
+// Class method requests to a binary write at once.
+package codegen
+
+import (
+	"github.com/dave/jennifer/jen"
+)
+
+// generateUnitOfWork generates the unit of work: work, beginWork, endWork,
+// afterWork, suspendWork and workConn. It follows the statement cache in the SQLite
+// modes.
+func generateUnitOfWork(f *jen.File) {
+	sqlDB := jen.Op("*").Qual("database/sql", "DB")
+
+	f.Comment("unitOfWork is the transaction of the dispatch in progress")
+	f.Type().Id("unitOfWork").Struct(
+		jen.Id("db").Add(sqlDB).Comment("// from requestDB, released when the work ends"),
+		jen.Id("tx").Op("*").Qual("database/sql", "Tx").Comment("// nil if it could not be begun again after a send"),
+		jen.Id("err").Error().Comment("// of committing or beginning tx around a send"),
+		jen.Id("done").Index().Func().Params(jen.Id("committed").Bool()).Comment("// run when tx ends, last first"),
+	)
+	f.Line()
+
+	f.Comment("work is the unit of work of the dispatch in progress, nil when writes run at")
+	f.Comment("once. workMu lets one dispatch at a time use it.")
+	f.Var().Defs(
+		jen.Id("work").Op("*").Id("unitOfWork"),
+		jen.Id("workMu").Qual("sync", "Mutex"),
+	)
+	f.Line()
+
+	f.Comment("beginWork begins the transaction of a dispatch")
+	f.Func().Id("beginWork").Params().Error().Block(
+		jen.Id("workMu").Dot("Lock").Call(),
+		jen.List(jen.Id("db"), jen.Err()).Op(":=").Id("requestDB").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("workMu").Dot("Unlock").Call(),
+			jen.Return(jen.Err()),
+		),
+		jen.List(jen.Id("tx"), jen.Err()).Op(":=").Id("db").Dot("Begin").Call(),
+		jen.If(jen.Err().Op("!=").Nil()).Block(
+			jen.Id("releaseDB").Call(jen.Id("db")),
+			jen.Id("workMu").Dot("Unlock").Call(),
+			jen.Return(jen.Err()),
+		),
+		jen.Id("work").Op("=").Op("&").Id("unitOfWork").Values(jen.Dict{
+			jen.Id("db"): jen.Id("db"),
+			jen.Id("tx"): jen.Id("tx"),
+		}),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("endWork ends the unit of work, committing it if commit and rolling it back")
+	f.Comment("otherwise. A dispatch whose writes could not be committed before a send is")
+	f.Comment("rolled back and fails with that error.")
+	f.Func().Id("endWork").Params(jen.Id("commit").Bool()).Error().Block(
+		jen.Defer().Id("workMu").Dot("Unlock").Call(),
+		jen.Id("w").Op(":=").Id("work"),
+		jen.Id("work").Op("=").Nil(),
+		jen.Defer().Id("releaseDB").Call(jen.Id("w").Dot("db")),
+		jen.If(jen.Op("!").Id("commit").Op("||").Id("w").Dot("err").Op("!=").Nil()).Block(
+			jen.If(jen.Id("w").Dot("tx").Op("!=").Nil()).Block(
+				jen.Id("w").Dot("tx").Dot("Rollback").Call(),
+			),
+			jen.Id("w").Dot("finish").Call(jen.False()),
+			jen.If(jen.Op("!").Id("commit")).Block(
+				jen.Return(jen.Nil()),
+			),
+			jen.Return(jen.Id("w").Dot("err")),
+		),
+		jen.Err().Op(":=").Id("w").Dot("tx").Dot("Commit").Call(),
+		jen.Id("w").Dot("finish").Call(jen.Err().Op("==").Nil()),
+		jen.Return(jen.Id("workError").Call(jen.Err())),
+	)
+	f.Line()
+
+	f.Comment("workError returns err, wrapping ErrStorageBusy if the database was locked")
+	f.Func().Id("workError").Params(jen.Err().Error()).Error().Block(
+		jen.If(jen.Id("_isBusy").Call(jen.Err())).Block(
+			jen.Return(jen.Qual("fmt", "Errorf").Call(jen.Lit("%w: %v"), jen.Id("ErrStorageBusy"), jen.Err())),
+		),
+		jen.Return(jen.Err()),
+	)
+	f.Line()
+
+	f.Comment("finish runs the done functions with committed, and drops them")
+	f.Func().Params(jen.Id("w").Op("*").Id("unitOfWork")).Id("finish").Params(jen.Id("committed").Bool()).Block(
+		jen.For(jen.Id("i").Op(":=").Len(jen.Id("w").Dot("done")).Op("-").Lit(1), jen.Id("i").Op(">=").Lit(0), jen.Id("i").Op("--")).Block(
+			jen.Id("w").Dot("done").Index(jen.Id("i")).Call(jen.Id("committed")),
+		),
+		jen.Id("w").Dot("done").Op("=").Nil(),
+	)
+	f.Line()
+
+	f.Comment("afterWork runs done when the transaction in progress ends, with whether it")
+	f.Comment("was committed, and at once as committed when there is none")
+	f.Func().Id("afterWork").Params(jen.Id("done").Func().Params(jen.Id("committed").Bool())).Block(
+		jen.If(jen.Id("work").Op("==").Nil().Op("||").Id("work").Dot("tx").Op("==").Nil()).Block(
+			jen.Id("done").Call(jen.True()),
+			jen.Return(),
+		),
+		jen.Id("work").Dot("done").Op("=").Append(jen.Id("work").Dot("done"), jen.Id("done")),
+	)
+	f.Line()
+
+	f.Comment("suspendWork commits the writes of the dispatch so far, so that another")
+	f.Comment("process handling a message sees them and can write the database itself, and")
+	f.Comment("lets another dispatch run until resume is called. resume begins a new")
+	f.Comment("transaction for the rest of the dispatch.")
+	f.Func().Id("suspendWork").Params().Parens(jen.Id("resume").Func().Params()).Block(
+		jen.Id("w").Op(":=").Id("work"),
+		jen.If(jen.Id("w").Op("==").Nil()).Block(
+			jen.Return(jen.Func().Params().Block()),
+		),
+		jen.If(jen.Id("w").Dot("tx").Op("!=").Nil()).Block(
+			jen.Err().Op(":=").Id("w").Dot("tx").Dot("Commit").Call(),
+			jen.If(jen.Err().Op("!=").Nil().Op("&&").Id("w").Dot("err").Op("==").Nil()).Block(
+				jen.Id("w").Dot("err").Op("=").Id("workError").Call(jen.Err()),
+			),
+			jen.Id("w").Dot("finish").Call(jen.Err().Op("==").Nil()),
+			jen.Id("w").Dot("tx").Op("=").Nil(),
+		),
+		jen.Id("work").Op("=").Nil(),
+		jen.Id("workMu").Dot("Unlock").Call(),
+		jen.Return(jen.Func().Params().Block(
+			jen.Id("workMu").Dot("Lock").Call(),
+			jen.Var().Err().Error(),
+			jen.If(jen.List(jen.Id("w").Dot("tx"), jen.Err()).Op("=").Id("w").Dot("db").Dot("Begin").Call(), jen.Err().Op("!=").Nil().Op("&&").Id("w").Dot("err").Op("==").Nil()).Block(
+				jen.Id("w").Dot("err").Op("=").Err(),
+			),
+			jen.Id("work").Op("=").Id("w"),
+		)),
+	)
+	f.Line()
+
+	f.Comment("dbConn runs the queries of the SQLite helpers: *sql.DB or *sql.Tx")
+	f.Type().Id("dbConn").Interface(
+		jen.Id("Exec").Params(jen.Id("query").String(), jen.Id("args").Op("...").Interface()).Parens(jen.List(jen.Qual("database/sql", "Result"), jen.Error())),
+		jen.Id("Query").Params(jen.Id("query").String(), jen.Id("args").Op("...").Interface()).Parens(jen.List(jen.Op("*").Qual("database/sql", "Rows"), jen.Error())),
+		jen.Id("QueryRow").Params(jen.Id("query").String(), jen.Id("args").Op("...").Interface()).Op("*").Qual("database/sql", "Row"),
+	)
+	f.Line()
+
+	f.Comment("workConn returns the transaction of the unit of work in progress, or db")
+	f.Func().Id("workConn").Params(jen.Id("db").Add(sqlDB.Clone())).Id("dbConn").Block(
+		jen.If(jen.Id("work").Op("!=").Nil().Op("&&").Id("work").Dot("tx").Op("!=").Nil()).Block(
+			jen.Return(jen.Id("work").Dot("tx")),
+		),
+		jen.Return(jen.Id("db")),
+	)
+	f.Line()
+}
+
+// generateServeWork generates handleServeWork, which dispatches a --serve
+// request as one unit of work. Storage backends write at once.
+func (g *generator) generateServeWork(f *jen.File) {
+	if g.useStorage() {
+		return
+	}
+	f.Comment("handleServeWork dispatches req as one unit of work: its transaction is")
+	f.Comment("committed if it succeeds and rolled back otherwise")
+	f.Func().Id("handleServeWork").Params(
+		jen.Id("db").Add(g.dbType()),
+		jen.Id("req").Op("*").Id("ServeRequest"),
+	).Id("ServeResponse").Block(
+		jen.If(jen.Err().Op(":=").Id("beginWork").Call(), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+				jen.Id("ExitCode"): jen.Lit(1),
+				jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+			})),
+		),
+		jen.Id("resp").Op(":=").Id("handleServeRequest").Call(jen.Id("db"), jen.Id("req")),
+		jen.If(jen.Err().Op(":=").Id("endWork").Call(jen.Id("resp").Dot("ExitCode").Op("==").Lit(0)), jen.Err().Op("!=").Nil()).Block(
+			storageBusyResponse(),
+			jen.Return(jen.Id("ServeResponse").Values(jen.Dict{
+				jen.Id("ExitCode"): jen.Lit(1),
+				jen.Id("Error"):    jen.Err().Dot("Error").Call(),
+			})),
+		),
+		jen.Return(jen.Id("resp")),
+	)
+	f.Line()
+}
+
+// mainBeginWork returns the statement main uses to begin the unit of work
+// that loads, dispatches and saves an instance. Storage backends write at
+// once.
+func (g *generator) mainBeginWork() jen.Code {
+	if g.useStorage() {
+		return jen.Null()
+	}
+	return jen.If(jen.Err().Op(":=").Id("beginWork").Call(), jen.Err().Op("!=").Nil()).Block(
+		storageBusyExit(),
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error: %v\n"), jen.Err()),
+		jen.Qual("os", "Exit").Call(jen.Lit(1)),
+	)
+}
+
+// mainEndWork returns the statement main uses to end that unit of work. It is
+// committed, reporting a commit that fails, if commit; otherwise it is
+// rolled back before main exits with an error.
+func (g *generator) mainEndWork(commit bool) jen.Code {
+	if g.useStorage() {
+		return jen.Null()
+	}
+	if !commit {
+		return jen.Id("endWork").Call(jen.False())
+	}
+	return jen.If(jen.Err().Op(":=").Id("endWork").Call(jen.True()), jen.Err().Op("!=").Nil()).Block(
+		storageBusyExit(),
+		jen.Qual("fmt", "Fprintf").Call(jen.Qual("os", "Stderr"), jen.Lit("Error saving instance: %v\n"), jen.Err()),
+		jen.Qual("os", "Exit").Call(jen.Lit(1)),
+	)
+}
+
+// serveHandler returns the function --serve and --serve-socket answer a
+// request with
+func (g *generator) serveHandler() *jen.Statement {
+	if g.useStorage() {
+		return jen.Id("handleServeRequest")
+	}
+	return jen.Id("handleServeWork")
+}
+
+// generatePluginWork generates dispatchWork, which runs a plugin dispatch as
+// one unit of work
+func generatePluginWork(f *jen.File) {
+	f.Comment("dispatchWork runs dispatchInternal as one unit of work: its transaction is")
+	f.Comment("committed if it succeeds and rolled back otherwise")
+	f.Func().Id("dispatchWork").Params(
+		jen.List(jen.Id("instanceJSON"), jen.Id("selector"), jen.Id("argsJSON")).String(),
+	).String().Block(
+		jen.If(jen.Err().Op(":=").Id("beginWork").Call(), jen.Err().Op("!=").Nil()).Block(
+			jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(`{"exit_code":1,"error":%q}`), jen.Err().Dot("Error").Call())),
+		),
+		jen.Id("result").Op(":=").Id("dispatchInternal").Call(jen.Id("instanceJSON"), jen.Id("selector"), jen.Id("argsJSON")),
+		jen.Var().Id("outcome").Struct(
+			jen.Id("ExitCode").Int().Tag(map[string]string{"json": "exit_code"}),
+		),
+		jen.Qual("encoding/json", "Unmarshal").Call(jen.Index().Byte().Parens(jen.Id("result")), jen.Op("&").Id("outcome")),
+		jen.If(jen.Err().Op(":=").Id("endWork").Call(jen.Id("outcome").Dot("ExitCode").Op("==").Lit(0)), jen.Err().Op("!=").Nil()).Block(
+			storageBusyResult(),
+			jen.Return(jen.Qual("fmt", "Sprintf").Call(jen.Lit(`{"exit_code":1,"error":%q}`), jen.Err().Dot("Error").Call())),
+		),
+		jen.Return(jen.Id("result")),
+	)
+	f.Line()
+}
+
+// suspendWork returns the statement sendMessage uses to let other
+// dispatches run while another process handles the message. Storage
+// backends have none.
+func (g *generator) suspendWork() jen.Code {
+	if g.useStorage() {
+		return jen.Null()
+	}
+	return jen.Defer().Id("suspendWork").Call().Call()
+}
@@ -0,0 +1,270 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains support for class versioning (classVersion:) and lazy
+// data migrations (migrateFrom:), and the schema migration of instances saved
+// by another version of the class source (Options.Migrate, migrate: ... to:).
+package codegen
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/dave/jennifer/jen"
+)
+
+// versioned reports whether the class declares a classVersion:.
+func (g *generator) versioned() bool {
+	return g.class.ClassVersion > 0
+}
+
+// migrationGoName returns the Go method name for a migrateFrom: block.
+// Migrations are unexported so they can never collide with a selector.
+func migrationGoName(from int) string {
+	return fmt.Sprintf("migrateFrom%d", from)
+}
+
+// versionField returns the struct field storing the instance's data version.
+func (g *generator) versionField() jen.Code {
+	return jen.Id("ClassVersion").Int().Tag(map[string]string{"json": "_classVersion"})
+}
+
+// generateMigrations compiles each migrateFrom: block into an instance method
+// and generates migrate(), which runs the chain from the stored version up to
+// the declared classVersion. Nothing is emitted for unversioned classes.
+func (g *generator) generateMigrations(f *jen.File) {
+	if !g.versioned() {
+		return
+	}
+	current := g.class.ClassVersion
+
+	migrations := make([]ast.Migration, len(g.class.Migrations))
+	copy(migrations, g.class.Migrations)
+	sort.SliceStable(migrations, func(i, j int) bool { return migrations[i].From < migrations[j].From })
+
+	var compiled []*compiledMethod
+	var cases []jen.Code // one per version that has a migration
+	seen := make(map[int]bool)
+	for _, mig := range migrations {
+		if mig.From >= current {
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("migrateFrom: %d ignored: class %s is at classVersion %d", mig.From, g.class.Name, current))
+			continue
+		}
+		if seen[mig.From] {
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("duplicate migrateFrom: %d in class %s ignored", mig.From, g.class.Name))
+			continue
+		}
+		seen[mig.From] = true
+
+		result := parser.ParseMethod(mig.Block.Tokens)
+		if result.Unsupported {
+			// Upgrading past an uncompiled migration would lose its changes,
+			// so the chain stops there and the data keeps its old version
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("migrateFrom: %d in class %s not compiled (%s); instances stay at version %d",
+					mig.From, g.class.Name, result.Reason, mig.From))
+			cases = append(cases, jen.Case(jen.Lit(mig.From)).Block(
+				jen.Return(jen.Id("upgraded")),
+			))
+			continue
+		}
+
+		cases = append(cases, jen.Case(jen.Lit(mig.From)).Block(
+			jen.Id("c").Dot(migrationGoName(mig.From)).Call(),
+		))
+		compiled = append(compiled, &compiledMethod{
+			selector:    migrationGoName(mig.From),
+			goName:      migrationGoName(mig.From),
+			body:        result.Body,
+			hasReturn:   hasReturnInStatements(result.Body.Statements),
+			renamedVars: make(map[string]string),
+		})
+	}
+
+	for _, m := range compiled {
+		g.generateMethod(f, m)
+	}
+
+	loop := []jen.Code{}
+	if len(cases) > 0 {
+		loop = append(loop, jen.Switch(jen.Id("c").Dot("ClassVersion")).Block(cases...))
+	}
+	loop = append(loop,
+		jen.Id("c").Dot("ClassVersion").Op("++"),
+		jen.Id("upgraded").Op("=").True(),
+	)
+
+	f.Comment(fmt.Sprintf("migrate upgrades data stored by an older class version to version %d.", current))
+	f.Comment("Instances saved before versioning was declared are treated as version 1.")
+	f.Comment("Returns true if the instance changed and should be persisted.")
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("migrate").Params().Bool().Block(
+		jen.Id("upgraded").Op(":=").False(),
+		jen.If(jen.Id("c").Dot("ClassVersion").Op("<").Lit(1)).Block(
+			jen.Id("c").Dot("ClassVersion").Op("=").Lit(1),
+			jen.Id("upgraded").Op("=").True(),
+		),
+		jen.For(jen.Id("c").Dot("ClassVersion").Op("<").Lit(current)).Block(loop...),
+		jen.Return(jen.Id("upgraded")),
+	)
+	f.Line()
+}
+
+// migrateOnLoad returns the statements loadInstance runs after decoding an
+// instance from data: migrate it and persist the upgraded form before
+// dispatch.
+func (g *generator) migrateOnLoad(data jen.Code) []jen.Code {
+	var upgraded jen.Code
+	var stmts []jen.Code
+	switch {
+	case g.versioned() && g.schemaMigrate:
+		stmts = append(stmts, jen.Id("migrated").Op(":=").Add(g.migrateInstanceCall(data)))
+		upgraded = jen.Id("instance").Dot("migrate").Call().Op("||").Id("migrated")
+	case g.versioned():
+		upgraded = jen.Id("instance").Dot("migrate").Call()
+	case g.schemaMigrate:
+		upgraded = g.migrateInstanceCall(data)
+	default:
+		return nil
+	}
+	return append(stmts,
+		jen.If(upgraded).Block(
+			jen.If(jen.Err().Op(":=").Id(g.fn("saveInstance")).Call(jen.Id("db"), jen.Id("id"), jen.Op("&").Id("instance")), jen.Err().Op("!=").Nil()).Block(
+				jen.Return(jen.Nil(), jen.Err()),
+			),
+		),
+	)
+}
+
+// pluginMigrate upgrades the instance decoded from data, the instance JSON
+// handed to a plugin or --serve request. The caller stores the returned
+// instance, so the upgraded form is persisted with the result.
+func (g *generator) pluginMigrate(data jen.Code) jen.Code {
+	switch {
+	case g.versioned() && g.schemaMigrate:
+		return g.migrateInstanceCall(data).Line().Id("instance").Dot("migrate").Call()
+	case g.versioned():
+		return jen.Id("instance").Dot("migrate").Call()
+	case g.schemaMigrate:
+		return g.migrateInstanceCall(data)
+	}
+	return jen.Null()
+}
+
+// setSchemaMigration records whether Options.Migrate asked for instances
+// saved by another version of the class source to be migrated on load.
+func (g *generator) setSchemaMigration(enabled bool) {
+	g.schemaMigrate = enabled
+}
+
+// setRenames records the class's migrate: declarations, which turn schema
+// migration on by themselves. Renames of names that are not an old and a
+// current instance variable are ignored.
+func (g *generator) setRenames() {
+	for _, r := range g.class.Renames {
+		switch {
+		case !g.instanceVars[r.To]:
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("migrate: %s to: %s ignored: %s is not an instance variable of %s", r.From, r.To, r.To, g.class.Name))
+		case g.instanceVars[r.From]:
+			g.warnings = append(g.warnings,
+				fmt.Sprintf("migrate: %s to: %s ignored: %s is still an instance variable of %s", r.From, r.To, r.From, g.class.Name))
+		default:
+			g.renames = append(g.renames, r)
+			g.schemaMigrate = true
+		}
+	}
+}
+
+// ignoreSchemaMigration warns that the class's migrate: declarations are not
+// compiled, in modes that embed no source hash for the class
+func (g *generator) ignoreSchemaMigration() {
+	if len(g.class.Renames) > 0 {
+		g.warnings = append(g.warnings,
+			fmt.Sprintf("schema migration needs the embedded source hash; migrate: ignored for %s", g.class.Name))
+	}
+}
+
+// contentHashField returns the struct field storing the hash of the class
+// source the instance was last saved by.
+func (g *generator) contentHashField() jen.Code {
+	return jen.Id("ContentHash").String().Tag(map[string]string{"json": "_contentHash,omitempty"})
+}
+
+// migrateInstanceCall returns the call migrating the instance decoded from
+// data
+func (g *generator) migrateInstanceCall(data jen.Code) *jen.Statement {
+	return jen.Id("instance").Dot("migrateInstance").Call(jen.Index().Byte().Parens(data))
+}
+
+// generateMigrateInstance generates migrateInstance, which brings an
+// instance saved by another version of the class source up to the struct:
+// renamed instance variables keep their stored value, and the ones missing
+// from the stored JSON get their defaults. Nothing is emitted without schema
+// migration.
+func (g *generator) generateMigrateInstance(f *jen.File) {
+	if !g.schemaMigrate {
+		return
+	}
+
+	body := []jen.Code{
+		jen.If(jen.Id("c").Dot("ContentHash").Op("==").Id("_contentHash")).Block(
+			jen.Return(jen.False()),
+		),
+		jen.Var().Id("stored").Map(jen.String()).Qual("encoding/json", "RawMessage"),
+		jen.If(jen.Qual("encoding/json", "Unmarshal").Call(jen.Id("data"), jen.Op("&").Id("stored")).Op("!=").Nil()).Block(
+			jen.Return(jen.False()),
+		),
+	}
+
+	if len(g.renames) > 0 {
+		for _, r := range g.renames {
+			body = append(body,
+				jen.Comment(fmt.Sprintf("migrate: %s to: %s", r.From, r.To)),
+				jen.If(jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Id("stored").Index(jen.Lit(r.To)), jen.Op("!").Id("ok")).Block(
+					jen.If(jen.List(jen.Id("old"), jen.Id("ok")).Op(":=").Id("stored").Index(jen.Lit(r.From)), jen.Id("ok")).Block(
+						jen.Id("stored").Index(jen.Lit(r.To)).Op("=").Id("old"),
+					),
+				),
+			)
+		}
+		// Decoding the renamed JSON again applies each field's type and tag
+		body = append(body,
+			jen.If(jen.List(jen.Id("renamed"), jen.Err()).Op(":=").Qual("encoding/json", "Marshal").Call(jen.Id("stored")), jen.Err().Op("==").Nil()).Block(
+				jen.Qual("encoding/json", "Unmarshal").Call(jen.Id("renamed"), jen.Id("c")),
+			),
+		)
+	}
+
+	// Defaults are already reported by the new primitive's struct literal
+	n := len(g.warnings)
+	for _, iv := range g.class.InstanceVars {
+		typ := g.ivarTypes[iv.Name]
+		if iv.Default.Value == "" && typ != "array" && typ != "object" {
+			continue // the zero value is the default
+		}
+		def := g.ivarDefault(iv)
+		if typ == "" && g.jsonVars[iv.Name] {
+			def = jen.Qual("encoding/json", "RawMessage").Call(def)
+		}
+		body = append(body,
+			jen.If(jen.List(jen.Id("_"), jen.Id("ok")).Op(":=").Id("stored").Index(jen.Lit(iv.Name)), jen.Op("!").Id("ok")).Block(
+				jen.Id("c").Dot(capitalize(iv.Name)).Op("=").Add(def),
+			),
+		)
+	}
+	g.warnings = g.warnings[:n]
+
+	body = append(body,
+		jen.Id("c").Dot("ContentHash").Op("=").Id("_contentHash"),
+		jen.Return(jen.True()),
+	)
+
+	f.Comment("migrateInstance upgrades an instance decoded from data, saved by another")
+	f.Comment("version of the class source: renamed instance variables keep their value,")
+	f.Comment("and missing ones get their defaults. Returns true if the instance changed")
+	f.Comment("and should be persisted.")
+	f.Func().Parens(jen.Id("c").Op("*").Id(g.typeName())).Id("migrateInstance").Params(jen.Id("data").Index().Byte()).Bool().Block(body...)
+	f.Line()
+}
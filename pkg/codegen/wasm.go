@@ -0,0 +1,308 @@
+// Package codegen generates Go code from Trashtalk AST.
+// This file contains WASM/WASI generation (GOOS=wasip1 GOARCH=wasm).
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/dave/jennifer/jen"
+)
+
+// GenerateWASM produces Go source code for a WASI module.
+// The output can be built with: GOOS=wasip1 GOARCH=wasm go build -o Class.wasm
+//
+// WASM builds cannot use cgo, so SQLite is replaced by the Storage interface.
+// The module speaks the --serve JSON protocol over stdin/stdout; the host
+// supplies stored instances with each request and receives the writes back.
+func GenerateWASM(class *ast.Class) *Result {
+	return GenerateWASMWithOptions(class, Options{})
+}
+
+// GenerateWASMWithOptions is GenerateWASM honoring opts.Only, opts.Skip,
+// opts.Classes, opts.Accessors, opts.ImplicitLocals, opts.Comments and
+// opts.Migrate.
+func GenerateWASMWithOptions(class *ast.Class, opts Options) *Result {
+	g := newGenerator(class)
+	g.wasm = true
+	g.setSelection(opts.Only, opts.Skip)
+	g.setClasses(opts.Classes)
+	g.accessors = opts.Accessors
+	g.implicitLocals = opts.ImplicitLocals
+	g.setComments(opts)
+	g.setSchemaMigration(opts.Migrate)
+	return g.generateWASM()
+}
+
+func (g *generator) generateWASM() *Result {
+	// These classes are implemented directly on SQLite and gRPC
+	if g.class.Name == "Environment" || g.grpc {
+		return &Result{
+			Warnings: []string{g.class.Name + " needs host services that are unavailable in wasm mode"},
+		}
+	}
+
+	f := jen.NewFile("main")
+	g.ignoreIndexes()
+	g.setRenames()
+	g.generateHeader(f)
+
+	f.Anon("embed")
+
+	// Embed directive and source hash
+	f.Comment("//go:embed " + g.class.CompiledName() + ".trash")
+	f.Var().Id("_sourceCode").String()
+	f.Line()
+	f.Var().Id("_contentHash").String()
+	f.Line()
+
+	f.Func().Id("init").Params().Block(
+		jen.Id("hash").Op(":=").Qual("crypto/sha256", "Sum256").Call(jen.Index().Byte().Parens(jen.Id("_sourceCode"))),
+		jen.Id("_contentHash").Op("=").Qual("encoding/hex", "EncodeToString").Call(jen.Id("hash").Index(jen.Op(":"))),
+	)
+	f.Line()
+
+	f.Var().Id("ErrUnknownSelector").Op("=").Qual("errors", "New").Call(jen.Lit("unknown selector"))
+	f.Line()
+
+	generateConflictDecls(f)
+
+	g.generateStruct(f)
+	f.Line()
+
+	g.generateWASMMain(f)
+	f.Line()
+
+	// Helper functions (binary mode helpers with storage in place of SQLite)
+	g.generateJournalStorage(f)
+	g.generateStorageLoadSave(f)
+	g.generateInstanceIDHelper(f)
+	g.generateStorageCreateDelete(f)
+	g.generateSendMessage(f)
+	g.generateRefHelpers(f)
+	g.generateServeMode(f)
+	f.Line()
+	g.generateJSONHelpers(f)
+	g.generateJSONPathHelpers(f)
+	g.generateArrayOpHelpers(f)
+	g.generateObjectOpHelpers(f)
+	g.generateTypedIvarHelpers(f)
+	g.generateStringFileHelpers(f)
+	g.generateFileOpHelpers(f)
+	g.generateHttpClientHelpers(f)
+	g.generateShellHelpers(f)
+	g.generateEnvHelpers(f)
+	g.generateLocaleHelpers(f)
+	f.Line()
+
+	g.generateTypeHelpers(f)
+	f.Line()
+	if g.exceptions {
+		generateExceptionHelpers(f)
+	}
+	g.generateArgTypeHelpers(f)
+
+	g.preIdentifySkippedMethods()
+	compiled := g.compileMethods()
+
+	var instanceMethods, classMethods []*compiledMethod
+	for _, m := range compiled {
+		if m.isClass {
+			classMethods = append(classMethods, m)
+		} else {
+			instanceMethods = append(instanceMethods, m)
+		}
+	}
+
+	g.generateDispatch(f, instanceMethods)
+	f.Line()
+	g.generateClassDispatch(f, classMethods)
+	f.Line()
+
+	for _, m := range compiled {
+		g.generateMethod(f, m)
+	}
+
+	g.generateMigrations(f)
+	g.generateMigrateInstance(f)
+	g.generateClassVars(f)
+	g.generateJSONConsts(f)
+
+	buf := &bytes.Buffer{}
+	if err := f.Render(buf); err != nil {
+		return &Result{
+			Code:           fmt.Sprintf("// Error rendering: %v", err),
+			Warnings:       g.warnings,
+			SkippedMethods: g.skipped,
+			Errors:         g.errors,
+		}
+	}
+
+	return &Result{
+		Code:           g.withHelperComments(buf.String()),
+		Warnings:       g.warnings,
+		SkippedMethods: g.skipped,
+		Errors:         g.errors,
+	}
+}
+
+// fileAccessCheck returns the body of a _fileIs* helper. WASI has no
+// access(2), so wasm builds fall back to the file's permission bits.
+func (g *generator) fileAccessCheck(bit string, perm int) []jen.Code {
+	if !g.wasm {
+		return []jen.Code{
+			jen.Err().Op(":=").Qual("golang.org/x/sys/unix", "Access").Call(jen.Id("path"), jen.Qual("golang.org/x/sys/unix", bit)),
+			jen.Return(jen.Id("_boolToString").Call(jen.Err().Op("==").Nil())),
+		}
+	}
+	return []jen.Code{
+		jen.List(jen.Id("info"), jen.Err()).Op(":=").Qual("os", "Stat").Call(jen.Id("path")),
+		jen.Return(jen.Id("_boolToString").Call(jen.Err().Op("==").Nil().Op("&&").Id("info").Dot("Mode").Call().Dot("Perm").Call().Op("&").Op(fmt.Sprintf("%#o", perm)).Op("!=").Lit(0))),
+	}
+}
+
+// generateWASMMain generates main(), which answers metadata flags and
+// otherwise serves JSON requests from stdin until EOF.
+func (g *generator) generateWASMMain(f *jen.File) {
+	f.Func().Id("main").Params().Block(
+		jen.If(jen.Len(jen.Qual("os", "Args")).Op(">").Lit(1)).Block(
+			jen.Switch(jen.Qual("os", "Args").Index(jen.Lit(1))).Block(
+				jen.Case(jen.Lit("--source")).Block(
+					jen.Qual("fmt", "Print").Call(jen.Id("_sourceCode")),
+					jen.Return(),
+				),
+				jen.Case(jen.Lit("--hash")).Block(
+					jen.Qual("fmt", "Println").Call(jen.Id("_contentHash")),
+					jen.Return(),
+				),
+			),
+		),
+		jen.Id("runServeMode").Call(),
+	)
+}
+
+// generateJournalStorage generates the Storage interface, the default journal
+// backend, and an openDB that returns the active backend.
+func (g *generator) generateJournalStorage(f *jen.File) {
+	g.generateStorageInterface(f)
+
+	f.Comment("journalStorage keeps instances sent by the host and records changes")
+	f.Comment("so they can be returned with each response.")
+	f.Type().Id("journalStorage").Struct(
+		jen.Id("instances").Map(jen.String()).String(),
+		jen.Id("writes").Map(jen.String()).String(),
+		jen.Id("deletes").Index().String(),
+	)
+	f.Line()
+
+	f.Func().Id("newJournalStorage").Params().Op("*").Id("journalStorage").Block(
+		jen.Return(jen.Op("&").Id("journalStorage").Values(jen.Dict{
+			jen.Id("instances"): jen.Map(jen.String()).String().Values(),
+			jen.Id("writes"):    jen.Map(jen.String()).String().Values(),
+		})),
+	)
+	f.Line()
+
+	recv := jen.Id("s").Op("*").Id("journalStorage")
+
+	f.Func().Params(recv.Clone()).Id("Load").Params(jen.Id("id").String()).Parens(jen.List(jen.String(), jen.Error())).Block(
+		jen.List(jen.Id("data"), jen.Id("ok")).Op(":=").Id("s").Dot("instances").Index(jen.Id("id")),
+		jen.If(jen.Op("!").Id("ok")).Block(
+			jen.Return(jen.Lit(""), jen.Qual("fmt", "Errorf").Call(jen.Lit("instance %s not provided by host"), jen.Id("id"))),
+		),
+		jen.Return(jen.Id("data"), jen.Nil()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Save").Params(jen.List(jen.Id("id"), jen.Id("data")).String(), jen.Id("expected").Int()).Error().Block(
+		jen.List(jen.Id("stored"), jen.Id("ok")).Op(":=").Id("s").Dot("instances").Index(jen.Id("id")),
+		checkStoredVersion(jen.Id("stored")),
+		jen.Id("s").Dot("instances").Index(jen.Id("id")).Op("=").Id("data"),
+		jen.Id("s").Dot("writes").Index(jen.Id("id")).Op("=").Id("data"),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Delete").Params(jen.Id("id").String()).Error().Block(
+		jen.Delete(jen.Id("s").Dot("instances"), jen.Id("id")),
+		jen.Delete(jen.Id("s").Dot("writes"), jen.Id("id")),
+		jen.Id("s").Dot("deletes").Op("=").Append(jen.Id("s").Dot("deletes"), jen.Id("id")),
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Func().Params(recv.Clone()).Id("Close").Params().Error().Block(
+		jen.Return(jen.Nil()),
+	)
+	f.Line()
+
+	f.Comment("seed adds instances supplied with a request")
+	f.Func().Params(recv.Clone()).Id("seed").Params(jen.Id("instances").Map(jen.String()).String()).Block(
+		jen.For(jen.List(jen.Id("id"), jen.Id("data")).Op(":=").Range().Id("instances")).Block(
+			jen.Id("s").Dot("instances").Index(jen.Id("id")).Op("=").Id("data"),
+		),
+	)
+	f.Line()
+
+	f.Comment("flush returns and clears the changes made since the last flush")
+	f.Func().Params(recv.Clone()).Id("flush").Params().Parens(jen.List(jen.Map(jen.String()).String(), jen.Index().String())).Block(
+		jen.List(jen.Id("writes"), jen.Id("deletes")).Op(":=").List(jen.Id("s").Dot("writes"), jen.Id("s").Dot("deletes")),
+		jen.Id("s").Dot("writes").Op("=").Map(jen.String()).String().Values(),
+		jen.Id("s").Dot("deletes").Op("=").Nil(),
+		jen.If(jen.Len(jen.Id("writes")).Op("==").Lit(0)).Block(
+			jen.Id("writes").Op("=").Nil(),
+		),
+		jen.Return(jen.Id("writes"), jen.Id("deletes")),
+	)
+	f.Line()
+
+	f.Comment("storage is the active backend. Embedders may replace it before main runs.")
+	f.Var().Id("storage").Id("Storage").Op("=").Id("newJournalStorage").Call()
+	f.Line()
+
+	f.Func().Id("openDB").Params().Parens(jen.List(jen.Id("Storage"), jen.Error())).Block(
+		jen.Return(jen.Id("storage"), jen.Nil()),
+	)
+	f.Line()
+	g.generateSharedDB(f)
+}
+
+// storageRequestField adds the host-supplied instances to ServeRequest.
+func (g *generator) storageRequestField() jen.Code {
+	if !g.wasm {
+		return jen.Null()
+	}
+	return jen.Id("Instances").Map(jen.String()).String().Tag(map[string]string{"json": "instances,omitempty"})
+}
+
+// storageResponseFields adds the storage changes to ServeResponse.
+func (g *generator) storageResponseFields() []jen.Code {
+	if !g.wasm {
+		return nil
+	}
+	return []jen.Code{
+		jen.Id("Writes").Map(jen.String()).String().Tag(map[string]string{"json": "writes,omitempty"}),
+		jen.Id("Deletes").Index().String().Tag(map[string]string{"json": "deletes,omitempty"}),
+	}
+}
+
+// storageSeed hands instances from a request to the journal backend.
+func (g *generator) storageSeed() jen.Code {
+	if !g.wasm {
+		return jen.Null()
+	}
+	return jen.If(jen.List(jen.Id("j"), jen.Id("ok")).Op(":=").Id("db").Assert(jen.Op("*").Id("journalStorage")), jen.Id("ok")).Block(
+		jen.Id("j").Dot("seed").Call(jen.Id("req").Dot("Instances")),
+	)
+}
+
+// storageFlush reports the journal backend's changes with the response.
+func (g *generator) storageFlush() jen.Code {
+	if !g.wasm {
+		return jen.Null()
+	}
+	return jen.If(jen.List(jen.Id("j"), jen.Id("ok")).Op(":=").Id("db").Assert(jen.Op("*").Id("journalStorage")), jen.Id("ok")).Block(
+		jen.List(jen.Id("resp").Dot("Writes"), jen.Id("resp").Dot("Deletes")).Op("=").Id("j").Dot("flush").Call(),
+	)
+}
@@ -0,0 +1,311 @@
+// Package compiler is Procyon's programmatic API. It compiles the source of
+// a Trashtalk class as the procyon command does - tokenize, parse, merge
+// traits, then generate with the selected backend - so editors, build
+// servers and other Go tools can embed the compiler instead of running it.
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/codegen"
+	"github.com/chazu/procyon/pkg/ir"
+	"github.com/chazu/procyon/pkg/lexer"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+// Backend selects the code Compile generates.
+type Backend string
+
+const (
+	Binary Backend = "binary" // standalone Go program
+	Plugin Backend = "plugin" // Go c-shared library for trashtalk-daemon
+	WASM   Backend = "wasm"   // Go program for GOOS=wasip1, without cgo
+	Bash   Backend = "bash"   // Bash for the Trashtalk runtime, through the IR
+	Sh     Backend = "sh"     // POSIX sh for the Trashtalk runtime, through the IR
+	Python Backend = "python" // Python 3 module, through the IR, without cgo
+)
+
+// Backends lists the backends Compile accepts.
+var Backends = []Backend{Binary, Plugin, WASM, Bash, Sh, Python}
+
+// Options configure Compile.
+type Options struct {
+	// Backend is the code generated; the default is Binary.
+	Backend Backend
+	// Filename names the source in errors. It is optional.
+	Filename string
+	// Traits holds the source of included traits by name. Traits found
+	// neither here nor in TraitPath fall back to Bash.
+	Traits map[string][]byte
+	// TraitPath lists directories searched for included traits not in
+	// Traits, as Name.trash or Name.json.
+	TraitPath []string
+	// Codegen holds the options of the Go backends. Bash and Python
+	// ignore it.
+	Codegen codegen.Options
+	// Strict fails compilation when a method falls back to Bash.
+	Strict bool
+	// ShLocal lets Sh declare method variables local, which dash and
+	// busybox ash support though POSIX does not.
+	ShLocal bool
+}
+
+// Result is a compiled class.
+type Result struct {
+	// Class is the parsed class, with the methods of its traits merged.
+	Class *ast.Class
+	// Code is the generated Go, Bash or Python source.
+	Code     string
+	Warnings []string
+	// SkippedMethods are the methods the Go and Python backends leave to
+	// Bash.
+	SkippedMethods []codegen.SkippedMethod
+	// Traits reports how the included traits were merged.
+	Traits ast.TraitReport
+	// SourceMap links the generated functions to the methods they
+	// implement, with Codegen.SourceMap and the Binary backend.
+	SourceMap *codegen.SourceMap
+}
+
+// Stage is the step of compilation an Error comes from.
+type Stage string
+
+const (
+	StageTokenize Stage = "tokenize"
+	StageParse    Stage = "parse"
+	StageTraits   Stage = "traits"
+	StageIR       Stage = "ir"
+	StageCodegen  Stage = "codegen"
+)
+
+// Diagnostic is one problem in the source. Line and Col are 1-based, and 0
+// when unknown.
+type Diagnostic struct {
+	Message string
+	Line    int
+	Col     int
+}
+
+func (d Diagnostic) String() string {
+	switch {
+	case d.Line == 0:
+		return d.Message
+	case d.Col == 0:
+		return fmt.Sprintf("%d: %s", d.Line, d.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Col, d.Message)
+}
+
+// Error is a failed compilation, with every problem found in the failing
+// stage.
+type Error struct {
+	Stage       Stage
+	Filename    string
+	Diagnostics []Diagnostic
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(string(e.Stage))
+	b.WriteString(": ")
+	if e.Filename != "" {
+		b.WriteString(e.Filename)
+		if len(e.Diagnostics) > 0 && e.Diagnostics[0].Line > 0 {
+			b.WriteString(":")
+		} else {
+			b.WriteString(": ")
+		}
+	}
+	if len(e.Diagnostics) > 0 {
+		b.WriteString(e.Diagnostics[0].String())
+	}
+	if n := len(e.Diagnostics) - 1; n > 0 {
+		fmt.Fprintf(&b, " (and %d more)", n)
+	}
+	return b.String()
+}
+
+// Compile compiles the source of one class. The error is an *Error for
+// problems in the source; the Result holds what was produced before it,
+// such as the warnings.
+func Compile(src []byte, opts Options) (Result, error) {
+	tokens, err := lexer.New(string(src)).Tokenize()
+	if err != nil {
+		return Result{}, opts.fail(StageTokenize, Diagnostic{Message: err.Error()})
+	}
+	classAST, parseErrors := parser.ParseClass(source.ParserTokens(tokens))
+	if len(parseErrors) > 0 {
+		diags := make([]Diagnostic, len(parseErrors))
+		for i, pe := range parseErrors {
+			diags[i] = Diagnostic{Message: pe.Message}
+			if pe.Token != nil {
+				diags[i].Line, diags[i].Col = pe.Token.Line, pe.Token.Col+1
+			}
+		}
+		return Result{}, opts.fail(StageParse, diags...)
+	}
+	return compile(source.ToAST(classAST), string(src), opts)
+}
+
+// CompileClass compiles a parsed class, such as one read from the jq
+// parser's JSON with ast.ParseBytes.
+func CompileClass(class *ast.Class, opts Options) (Result, error) {
+	return compile(class, "", opts)
+}
+
+// compile merges the class's traits and generates it with the backend;
+// src, if known, is embedded in Bash output
+func compile(class *ast.Class, src string, opts Options) (Result, error) {
+	if opts.Backend == "" {
+		opts.Backend = Binary
+	}
+	res := Result{Class: class}
+	if err := opts.mergeTraits(&res); err != nil {
+		return res, err
+	}
+
+	var gen *codegen.Result
+	switch opts.Backend {
+	case Binary:
+		gen = codegen.GenerateWithOptions(class, opts.Codegen)
+	case Plugin:
+		gen = codegen.GeneratePluginWithOptions(class, opts.Codegen)
+	case WASM:
+		gen = codegen.GenerateWASMWithOptions(class, opts.Codegen)
+		if gen.Code == "" {
+			res.Warnings = append(res.Warnings, gen.Warnings...)
+			var diags []Diagnostic
+			for _, w := range gen.Warnings {
+				diags = append(diags, Diagnostic{Message: w})
+			}
+			return res, opts.fail(StageCodegen, diags...)
+		}
+	case Bash, Sh, Python:
+		return opts.compileIR(class, src, res)
+	default:
+		return res, fmt.Errorf("unknown backend %q", opts.Backend)
+	}
+
+	res.Code = gen.Code
+	res.Warnings = append(res.Warnings, gen.Warnings...)
+	res.SkippedMethods = gen.SkippedMethods
+	res.SourceMap = gen.SourceMap
+	if len(gen.Errors) > 0 {
+		diags := make([]Diagnostic, len(gen.Errors))
+		for i, e := range gen.Errors {
+			diags[i] = Diagnostic{Message: e.Message, Line: e.Location.Line}
+			if e.Location.Line > 0 {
+				diags[i].Col = e.Location.Col + 1
+			}
+		}
+		return res, opts.fail(StageCodegen, diags...)
+	}
+	if opts.Strict && len(gen.SkippedMethods) > 0 {
+		diags := make([]Diagnostic, len(gen.SkippedMethods))
+		for i, s := range gen.SkippedMethods {
+			diags[i] = Diagnostic{Message: s.Selector + " falls back to Bash: " + s.Reason, Line: s.Location.Line}
+			if s.Location.Line > 0 {
+				diags[i].Col = s.Location.Col + 1
+			}
+		}
+		return res, opts.fail(StageCodegen, diags...)
+	}
+	return res, nil
+}
+
+// compileIR builds the class's IR and generates Bash, POSIX sh or Python
+// from it
+func (opts Options) compileIR(class *ast.Class, src string, res Result) (Result, error) {
+	prog, warnings, errs := ir.NewBuilder(class).Build()
+	res.Warnings = append(res.Warnings, warnings...)
+	if len(errs) > 0 {
+		diags := make([]Diagnostic, len(errs))
+		for i, e := range errs {
+			diags[i] = Diagnostic{Message: e}
+		}
+		return res, opts.fail(StageIR, diags...)
+	}
+	ir.Optimize(prog)
+	prog.SourceCode = src
+	if opts.Backend == Python {
+		return opts.compilePython(prog, res)
+	}
+	backend := codegen.NewBashBackend()
+	if opts.Backend == Sh {
+		backend.Dialect = codegen.DialectPOSIX
+		backend.Local = opts.ShLocal
+	}
+	code, err := backend.Generate(prog)
+	if err != nil {
+		return res, opts.fail(StageCodegen, Diagnostic{Message: err.Error()})
+	}
+	res.Code = code
+	res.Warnings = append(res.Warnings, backend.Warnings()...)
+	return res, nil
+}
+
+// compilePython generates a Python module from the class's IR; with
+// Strict, methods it leaves to Bash fail compilation
+func (opts Options) compilePython(prog *ir.Program, res Result) (Result, error) {
+	backend := codegen.NewPythonBackend()
+	code, err := backend.Generate(prog)
+	if err != nil {
+		return res, opts.fail(StageCodegen, Diagnostic{Message: err.Error()})
+	}
+	res.Code = code
+	res.Warnings = append(res.Warnings, backend.Warnings()...)
+	res.SkippedMethods = backend.SkippedMethods()
+	if opts.Strict && len(res.SkippedMethods) > 0 {
+		diags := make([]Diagnostic, len(res.SkippedMethods))
+		for i, s := range res.SkippedMethods {
+			diags[i] = Diagnostic{Message: s.Selector + " falls back to Bash: " + s.Reason}
+		}
+		return res, opts.fail(StageCodegen, diags...)
+	}
+	return res, nil
+}
+
+// mergeTraits merges the traits the class includes from opts.Traits and
+// opts.TraitPath into it, reporting conflicts and unmet requirements
+func (opts Options) mergeTraits(res *Result) error {
+	unit := &ast.CompilationUnit{Class: res.Class, Traits: map[string]*ast.Class{}}
+	for name, data := range opts.Traits {
+		trait, err := source.Parse(string(data))
+		if err != nil {
+			return opts.fail(StageTraits, Diagnostic{Message: fmt.Sprintf("trait %s: %v", name, err)})
+		}
+		if !trait.IsTrait {
+			return opts.fail(StageTraits, Diagnostic{Message: fmt.Sprintf("trait %s: %s is a class, not a trait", name, trait.QualifiedName())})
+		}
+		unit.Traits[name] = trait
+	}
+	if len(opts.TraitPath) > 0 {
+		if _, err := source.LoadTraits(unit, opts.TraitPath); err != nil {
+			return opts.fail(StageTraits, Diagnostic{Message: err.Error()})
+		}
+	}
+
+	res.Traits = unit.MergeTraits()
+	if len(res.Traits.Missing) > 0 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf("traits not provided (will fall back to Bash): %v", res.Traits.Missing))
+	}
+	var diags []Diagnostic
+	for _, c := range res.Traits.Conflicts {
+		diags = append(diags, Diagnostic{Message: "selector defined by several traits: " + c})
+	}
+	for _, msg := range append(res.Traits.Invalid, res.Traits.Unmet...) {
+		diags = append(diags, Diagnostic{Message: msg})
+	}
+	if len(diags) > 0 {
+		return opts.fail(StageTraits, diags...)
+	}
+	return nil
+}
+
+// fail returns the Error for diags found in stage
+func (opts Options) fail(stage Stage, diags ...Diagnostic) *Error {
+	return &Error{Stage: stage, Filename: opts.Filename, Diagnostics: diags}
+}
@@ -0,0 +1,109 @@
+package compiler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const counterSource = `Counter subclass: Object
+  instanceVars: value:0
+
+  method: increment [
+    value := value + 1.
+    ^ value
+  ]
+`
+
+func TestCompileBackends(t *testing.T) {
+	for _, tt := range []struct {
+		backend Backend
+		want    string
+	}{
+		{"", "func main()"},
+		{Binary, "func main()"},
+		{Plugin, "//export"},
+		{Bash, "__Counter__increment"},
+		{Sh, "#!/bin/sh"},
+		{Python, `"increment": (CounterInstance.m_increment, 0)`},
+	} {
+		res, err := Compile([]byte(counterSource), Options{Backend: tt.backend})
+		if err != nil {
+			t.Errorf("%q: %v", tt.backend, err)
+			continue
+		}
+		if res.Class == nil || res.Class.Name != "Counter" {
+			t.Errorf("%q: Class = %+v", tt.backend, res.Class)
+		}
+		if !strings.Contains(res.Code, tt.want) {
+			t.Errorf("%q: code does not contain %q", tt.backend, tt.want)
+		}
+	}
+
+	if _, err := Compile([]byte(counterSource), Options{Backend: "cobol"}); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
+
+func TestCompileParseError(t *testing.T) {
+	_, err := Compile([]byte("Counter subclass: Object\n  classVersion:\n"), Options{Filename: "Counter.trash"})
+	var cerr *Error
+	if !errors.As(err, &cerr) {
+		t.Fatalf("err = %v, want an *Error", err)
+	}
+	if cerr.Stage != StageParse || len(cerr.Diagnostics) == 0 {
+		t.Fatalf("err = %+v", cerr)
+	}
+	if d := cerr.Diagnostics[0]; d.Line == 0 || d.Col == 0 {
+		t.Errorf("diagnostic %+v has no position", d)
+	}
+	if !strings.HasPrefix(err.Error(), "parse: Counter.trash:") {
+		t.Errorf("Error() = %q", err.Error())
+	}
+}
+
+func TestCompileTraits(t *testing.T) {
+	src := "Person subclass: Object\n  include: Greeter\n"
+	opts := Options{Traits: map[string][]byte{
+		"Greeter": []byte("Greeter trait\n\n  method: greet [\n    ^ 'hello'\n  ]\n"),
+	}}
+	res, err := Compile([]byte(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Traits.Merged) != 1 || res.Traits.Merged[0] != "Greeter" {
+		t.Errorf("Traits = %+v", res.Traits)
+	}
+	if !strings.Contains(res.Code, `"greet"`) {
+		t.Error("merged greet method was not generated")
+	}
+
+	res, err = Compile([]byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Traits.Missing) != 1 || len(res.Warnings) == 0 {
+		t.Errorf("missing trait not reported: %+v %v", res.Traits, res.Warnings)
+	}
+
+	opts.Traits["Greeter"] = []byte("Greeter subclass: Object\n")
+	var cerr *Error
+	if _, err := Compile([]byte(src), opts); !errors.As(err, &cerr) || cerr.Stage != StageTraits {
+		t.Errorf("err = %v, want a traits error for a class given as a trait", err)
+	}
+}
+
+func TestCompileStrict(t *testing.T) {
+	src := "Shell subclass: Object\n\n  method: run [\n    ^ $(date)\n  ]\n"
+	res, err := Compile([]byte(src), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.SkippedMethods) == 0 {
+		t.Skip("no method falls back to Bash")
+	}
+	var cerr *Error
+	if _, err := Compile([]byte(src), Options{Strict: true}); !errors.As(err, &cerr) || cerr.Stage != StageCodegen {
+		t.Errorf("err = %v, want a codegen error under Strict", err)
+	}
+}
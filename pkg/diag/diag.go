@@ -0,0 +1,146 @@
+// Package diag reports problems at a position in a Trashtalk source or AST
+// file. A Diagnostic is written either as JSON, for editors and build
+// tooling, or pretty, with the source line it refers to and a caret under
+// the offending token:
+//
+//	Counter.trash:14:7: warning: increment: skipped: bash variable references ($var) not supported
+//	   14 |     ^ $count + 1
+//	      |       ^
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Severity is how bad a diagnostic is
+type Severity string
+
+const (
+	Error   Severity = "error"
+	Warning Severity = "warning"
+)
+
+// Formats are the output formats Write accepts
+var Formats = []string{"pretty", "json"}
+
+// Diagnostic is one message about a position in a file
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line,omitempty"` // 1-based, 0 if unknown
+	Col      int      `json:"col,omitempty"`  // 1-based, 0 if unknown
+	// Selector is the method the diagnostic is about, if any
+	Selector string `json:"selector,omitempty"`
+}
+
+// String returns the diagnostic as one file:line:col: severity: message line,
+// leaving out the parts of the position that are unknown
+func (d Diagnostic) String() string {
+	var b strings.Builder
+	if d.File != "" {
+		b.WriteString(d.File + ":")
+	}
+	if d.Line > 0 {
+		fmt.Fprintf(&b, "%d:", d.Line)
+		if d.Col > 0 {
+			fmt.Fprintf(&b, "%d:", d.Col)
+		}
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	fmt.Fprintf(&b, "%s: ", d.Severity)
+	if d.Selector != "" {
+		b.WriteString(d.Selector + ": ")
+	}
+	b.WriteString(d.Message)
+	return b.String()
+}
+
+// AtOffset returns d located at byte offset in src
+func (d Diagnostic) AtOffset(src []byte, offset int64) Diagnostic {
+	if offset < 0 || offset > int64(len(src)) {
+		return d
+	}
+	before := src[:offset]
+	d.Line = bytes.Count(before, []byte("\n")) + 1
+	d.Col = len(before) - bytes.LastIndexByte(before, '\n')
+	return d
+}
+
+// FromJSON returns the diagnostic for err, the error from decoding the JSON
+// document src read from file. Syntax and type errors are located at the
+// last byte the decoder read: the unexpected character, or the end of the
+// value of the wrong type.
+func FromJSON(file string, src []byte, err error) Diagnostic {
+	d := Diagnostic{Severity: Error, Message: err.Error(), File: file}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return d.AtOffset(src, syntaxErr.Offset-1)
+	case errors.As(err, &typeErr):
+		return d.AtOffset(src, typeErr.Offset-1)
+	}
+	return d
+}
+
+// Excerpt returns the line of src a diagnostic at line and col refers to,
+// numbered, with a caret under col on the line after. It returns "" if src
+// has no such line.
+func Excerpt(src []byte, line, col int) string {
+	lines := strings.Split(string(src), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	text := strings.TrimRight(lines[line-1], "\r")
+	number := fmt.Sprintf("%5d", line)
+	out := fmt.Sprintf("%s | %s\n", number, text)
+	if col < 1 {
+		return out
+	}
+	if col > len(text)+1 {
+		col = len(text) + 1
+	}
+	// Keep the tabs before the caret so it lines up under them
+	pad := []byte(text[:col-1])
+	for i, c := range pad {
+		if c != '\t' {
+			pad[i] = ' '
+		}
+	}
+	return out + fmt.Sprintf("%s | %s^\n", strings.Repeat(" ", len(number)), pad)
+}
+
+// Write writes diags to w in format: json, an array of diagnostics, or
+// pretty, each diagnostic's line followed by the excerpt of its source, the
+// entry of sources named by its File
+func Write(w io.Writer, format string, diags []Diagnostic, sources map[string][]byte) error {
+	switch format {
+	case "json":
+		if diags == nil {
+			diags = []Diagnostic{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diags)
+	case "pretty":
+		var b strings.Builder
+		for _, d := range diags {
+			b.WriteString(d.String() + "\n")
+			if src, ok := sources[d.File]; ok {
+				b.WriteString(Excerpt(src, d.Line, d.Col))
+			}
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	return fmt.Errorf("unknown diagnostics format %q (use 'pretty' or 'json')", format)
+}
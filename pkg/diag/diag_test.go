@@ -0,0 +1,99 @@
+package diag
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		line, col int
+	}{
+		{"syntax error", "{\"name\": \"X\",\n  \"methods\": [1, }", 2, 18},
+		{"type error", "{\"name\": \"X\",\n\t\"methods\": 7}", 2, 13},
+		{"truncated", "{", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v struct {
+				Name    string
+				Methods []string
+			}
+			err := json.Unmarshal([]byte(tt.src), &v)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			d := FromJSON("in.json", []byte(tt.src), err)
+			if d.Severity != Error || d.File != "in.json" || d.Line != tt.line || d.Col != tt.col {
+				t.Errorf("got %+v, want in.json:%d:%d", d, tt.line, tt.col)
+			}
+		})
+	}
+
+	// Other errors have no position
+	if d := FromJSON("in.json", nil, errors.New("boom")); d.Line != 0 || d.Message != "boom" {
+		t.Errorf("got %+v, want an unlocated boom", d)
+	}
+}
+
+func TestWritePretty(t *testing.T) {
+	src := []byte("Clock subclass: Object\n  method: now [\n\t^ $(date)\n  ]\n")
+	diags := []Diagnostic{
+		{Severity: Warning, Message: "skipped: subshell expressions not supported", File: "Clock.trash", Line: 3, Col: 4, Selector: "now"},
+		{Severity: Error, Message: "no position", File: "Clock.trash"},
+		{Severity: Warning, Message: "no source", File: "Other.trash", Line: 1, Col: 1},
+	}
+	var out bytes.Buffer
+	if err := Write(&out, "pretty", diags, map[string][]byte{"Clock.trash": src}); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"Clock.trash:3:4: warning: now: skipped: subshell expressions not supported",
+		"    3 | \t^ $(date)",
+		"      | \t  ^",
+		"Clock.trash: error: no position",
+		"Other.trash:1:1: warning: no source",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, "json", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != "[]" {
+		t.Errorf("no diagnostics written as %s, want []", got)
+	}
+
+	out.Reset()
+	d := Diagnostic{Severity: Warning, Message: "skipped: raw method", File: "Clock.trash", Line: 2, Col: 3, Selector: "now"}
+	if err := Write(&out, "json", []Diagnostic{d}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var got []Diagnostic
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil || len(got) != 1 || got[0] != d {
+		t.Errorf("round trip gave %+v (%v), want %+v", got, err, d)
+	}
+
+	if err := Write(&out, "xml", nil, nil); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestExcerptClampsColumn(t *testing.T) {
+	if got, want := Excerpt([]byte("ab"), 1, 9), "    1 | ab\n      |   ^\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := Excerpt([]byte("ab"), 2, 1); got != "" {
+		t.Errorf("got %q for a line past the end, want none", got)
+	}
+}
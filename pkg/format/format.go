@@ -0,0 +1,421 @@
+// Package format prints Trashtalk source in its canonical layout, as
+// trashfmt does.
+//
+// The layout is computed from the lexer's token stream, so comments and the
+// text of every token are kept as written:
+//
+//   - the class header and anything before it start in column 0, the class
+//     body is indented by two spaces and each level of brackets by two more
+//   - a line continued with a backslash is indented two levels further
+//   - runs of spaces and tabs between tokens become one space; trailing
+//     whitespace, leading blank lines and repeated blank lines are removed
+//   - the defaults of consecutive instanceVars: (or classInstanceVars:)
+//     lines declaring one variable each are aligned in a column
+//
+// The bodies of raw methods, and of methods with a heredoc, are Bash whose
+// layout can matter and are kept verbatim.
+package format
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/lexer"
+	"github.com/chazu/procyon/pkg/parser"
+	"github.com/chazu/procyon/pkg/source"
+)
+
+// indentUnit is one level of indentation
+const indentUnit = "  "
+
+// Source returns src, the source of one class or trait, formatted. It fails
+// if src does not parse, and if the formatted source would not parse to the
+// same class, which would be a bug in the formatter.
+func Source(src []byte) ([]byte, error) {
+	text := string(src)
+	tokens, err := lexer.New(text).Tokenize()
+	if err != nil {
+		return nil, fmt.Errorf("tokenizing: %w", err)
+	}
+	class, err := parse(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &printer{src: text, tokens: tokens, lineStarts: lineStarts(text)}
+	out := alignInstanceVars(p.print(class))
+
+	formatted, err := source.Parse(out)
+	if err != nil {
+		return nil, fmt.Errorf("formatted source does not parse: %w", err)
+	}
+	if !sameClass(class, formatted) {
+		return nil, errors.New("formatting would change the class")
+	}
+	return []byte(out), nil
+}
+
+// parse parses the class tokens hold
+func parse(tokens []lexer.Token) (*ast.Class, error) {
+	classAST, parseErrors := parser.ParseClass(source.ParserTokens(tokens))
+	if len(parseErrors) > 0 {
+		errs := make([]error, len(parseErrors))
+		for i := range parseErrors {
+			errs[i] = &parseErrors[i]
+		}
+		return nil, fmt.Errorf("parsing: %w", errors.Join(errs...))
+	}
+	return source.ToAST(classAST), nil
+}
+
+// printer lays out the tokens of src
+type printer struct {
+	src        string
+	tokens     []lexer.Token
+	lineStarts []int // byte offset of each line of src
+	out        strings.Builder
+}
+
+// print returns the formatted source of class, which src holds
+func (p *printer) print(class *ast.Class) string {
+	verbatim := p.verbatimLines(class)
+	depth := 0
+	atLineStart := true
+	blank := false     // a blank line is owed before the next line
+	continued := false // the previous line ended with a backslash
+	for i, tok := range p.tokens {
+		if tok.Type == lexer.NEWLINE {
+			if atLineStart && verbatim[tok.Line] {
+				// A blank line in a verbatim body is kept
+				p.flushBlank(&blank)
+				p.out.WriteByte('\n')
+				continue
+			}
+			if atLineStart && !continued {
+				blank = p.out.Len() > 0
+			}
+			p.endLine()
+			atLineStart, continued = true, false
+			continue
+		}
+		if verbatim[tok.Line] {
+			if atLineStart {
+				p.flushBlank(&blank)
+				p.out.WriteString(p.line(tok.Line))
+				atLineStart = false
+			}
+			depth = nest(depth, tok)
+			continue
+		}
+
+		text, breaks := p.text(i)
+		switch {
+		case atLineStart:
+			p.flushBlank(&blank)
+			level := depth
+			if tok.Type == lexer.RBRACKET {
+				level--
+			}
+			p.indent(class, tok, level, continued)
+		case p.start(i) == p.end(i-1):
+			// Adjacent tokens stay adjacent
+		default:
+			p.out.WriteByte(' ')
+		}
+		p.out.WriteString(text)
+		depth = nest(depth, tok)
+		atLineStart, continued = false, false
+		if breaks {
+			p.out.WriteString(" \\")
+			p.endLine()
+			atLineStart, continued = true, true
+		}
+	}
+	p.endLine()
+	return strings.TrimRight(p.out.String(), "\n") + "\n"
+}
+
+// indent starts a line whose first token is tok, level brackets deep
+func (p *printer) indent(class *ast.Class, tok lexer.Token, level int, continued bool) {
+	if tok.Line <= class.Location.Line && level <= 0 && !continued {
+		return
+	}
+	n := 1 + max(level, 0)
+	if continued {
+		n += 2
+	}
+	p.out.WriteString(strings.Repeat(indentUnit, n))
+}
+
+// flushBlank writes the blank line owed, if any
+func (p *printer) flushBlank(blank *bool) {
+	if *blank {
+		p.out.WriteByte('\n')
+		*blank = false
+	}
+}
+
+// endLine ends the line being written, dropping its trailing whitespace
+func (p *printer) endLine() {
+	s := p.out.String()
+	trimmed := strings.TrimRight(s, " \t")
+	if len(trimmed) < len(s) {
+		p.out.Reset()
+		p.out.WriteString(trimmed)
+	}
+	if p.out.Len() > 0 && !strings.HasSuffix(trimmed, "\n") {
+		p.out.WriteByte('\n')
+	}
+}
+
+// nest returns the bracket depth after tok
+func nest(depth int, tok lexer.Token) int {
+	switch tok.Type {
+	case lexer.LBRACKET:
+		return depth + 1
+	case lexer.RBRACKET:
+		return max(depth-1, 0)
+	}
+	return depth
+}
+
+// start returns the byte offset of token i in src
+func (p *printer) start(i int) int {
+	tok := p.tokens[i]
+	return p.lineStarts[tok.Line-1] + tok.Column
+}
+
+// end returns the byte offset just past the text of token i
+func (p *printer) end(i int) int {
+	text, _ := p.text(i)
+	return p.start(i) + len(text)
+}
+
+// text returns the text of token i in src, and whether the line continues
+// after it with a backslash: the text runs to the next token, less the
+// whitespace and continuation between them
+func (p *printer) text(i int) (string, bool) {
+	limit := len(p.src)
+	if i+1 < len(p.tokens) {
+		limit = p.start(i + 1)
+	}
+	span := strings.TrimRight(p.src[p.start(i):limit], " \t\n")
+	if p.tokens[i].Type != lexer.NEWLINE && i+1 < len(p.tokens) && strings.HasSuffix(span, "\\") &&
+		strings.Contains(p.src[p.start(i)+len(span):limit], "\n") {
+		if text := strings.TrimRight(strings.TrimSuffix(span, "\\"), " \t"); text != "" {
+			return text, true
+		}
+	}
+	return span, false
+}
+
+// line returns line n of src, without its newline
+func (p *printer) line(n int) string {
+	start := p.lineStarts[n-1]
+	end := len(p.src)
+	if n < len(p.lineStarts) {
+		end = p.lineStarts[n] - 1
+	}
+	return p.src[start:end]
+}
+
+// verbatimLines returns the lines inside the bodies of the methods whose
+// layout is kept: raw methods, and those with a heredoc
+func (p *printer) verbatimLines(class *ast.Class) map[int]bool {
+	lines := map[int]bool{}
+	for _, m := range class.Methods {
+		keep := m.Raw
+		for _, tok := range m.Body.Tokens {
+			keep = keep || tok.Type == string(lexer.HEREDOC)
+		}
+		if !keep {
+			continue
+		}
+		open, close := p.bodyLines(m.Location)
+		for n := open + 1; n < close; n++ {
+			lines[n] = true
+		}
+	}
+	return lines
+}
+
+// bodyLines returns the lines of the opening and closing brackets of the
+// method defined at loc
+func (p *printer) bodyLines(loc ast.Location) (open, close int) {
+	i := 0
+	for i < len(p.tokens) && (p.tokens[i].Line != loc.Line || p.tokens[i].Column != loc.Col) {
+		i++
+	}
+	for i < len(p.tokens) && p.tokens[i].Type != lexer.LBRACKET {
+		i++
+	}
+	if i == len(p.tokens) {
+		return 0, 0
+	}
+	open = p.tokens[i].Line
+	depth := 0
+	for ; i < len(p.tokens); i++ {
+		depth = nest(depth, p.tokens[i])
+		if p.tokens[i].Type == lexer.RBRACKET && depth == 0 {
+			return open, p.tokens[i].Line
+		}
+	}
+	return open, open
+}
+
+// lineStarts returns the byte offset of each line of src
+func lineStarts(src string) []int {
+	starts := []int{0}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// alignInstanceVars aligns the defaults of each run of consecutive
+// instanceVars: or classInstanceVars: lines that declare one variable each
+func alignInstanceVars(src string) string {
+	lines := strings.Split(src, "\n")
+	for i := 0; i < len(lines); {
+		keyword, _, _, ok := splitDeclaration(lines[i])
+		if !ok {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(lines) {
+			if kw, _, _, ok := splitDeclaration(lines[j]); !ok || kw != keyword {
+				break
+			}
+			j++
+		}
+		if j-i > 1 {
+			alignRun(lines[i:j])
+		}
+		i = j
+	}
+	return strings.Join(lines, "\n")
+}
+
+// alignRun pads the names of the declarations in lines so their defaults
+// start in the same column
+func alignRun(lines []string) {
+	width := 0
+	for _, line := range lines {
+		if _, name, def, _ := splitDeclaration(line); def != "" {
+			width = max(width, nameWidth(name))
+		}
+	}
+	for k, line := range lines {
+		keyword, name, def, _ := splitDeclaration(line)
+		if def == "" {
+			continue
+		}
+		indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+		lines[k] = indent + keyword + " " + name + strings.Repeat(" ", width-len(name)) + def
+	}
+}
+
+// nameWidth is the room name takes before its default: a typed name such as
+// count:<int> is kept apart from it by a space
+func nameWidth(name string) int {
+	if strings.HasSuffix(name, ">") {
+		return len(name) + 1
+	}
+	return len(name)
+}
+
+// splitDeclaration splits an instanceVars: or classInstanceVars: line that
+// declares one variable into the keyword, the variable's name with its
+// colon and type, and its default, which is empty if it has none
+func splitDeclaration(line string) (keyword, name, def string, ok bool) {
+	tokens, err := lexer.New(strings.TrimLeft(line, " ")).Tokenize()
+	if err != nil || len(tokens) < 2 || tokens[0].Type != lexer.KEYWORD {
+		return "", "", "", false
+	}
+	keyword = tokens[0].Value
+	if keyword != "instanceVars:" && keyword != "classInstanceVars:" || tokens[1].Type != lexer.KEYWORD {
+		return "", "", "", false
+	}
+	rest := tokens[2:]
+	name = tokens[1].Value
+	if before, after, _ := strings.Cut(name, ":"); after != "" {
+		// An embedded number, count:0
+		name, def = before+":", after
+		if len(rest) > 0 {
+			return "", "", "", false
+		}
+		return keyword, name, def, true
+	}
+	if len(rest) >= 3 && rest[0].Type == lexer.LT && rest[1].Type == lexer.IDENTIFIER && rest[2].Type == lexer.GT {
+		name += "<" + rest[1].Value + ">"
+		rest = rest[3:]
+	}
+	switch {
+	case len(rest) == 0:
+		return keyword, name, "", true
+	case len(rest) == 1 && (rest[0].Type == lexer.NUMBER || rest[0].Type == lexer.STRING):
+		return keyword, name, rest[0].Value, true
+	case len(rest) == 2 && rest[0].Type == lexer.LBRACKET && rest[1].Type == lexer.RBRACKET:
+		return keyword, name, "[]", true
+	case len(rest) == 2 && rest[0].Type == lexer.LBRACE && rest[1].Type == lexer.RBRACE:
+		return keyword, name, "{}", true
+	}
+	return "", "", "", false
+}
+
+// sameClass reports whether a and b are the same class, ignoring where
+// their parts are in the source and how many blank lines separate the
+// statements of their methods
+func sameClass(a, b *ast.Class) bool {
+	return reflect.DeepEqual(shape(a), shape(b))
+}
+
+// shape returns class as JSON values without positions, and with each run
+// of newlines in method bodies folded into one
+func shape(class *ast.Class) any {
+	data, err := json.Marshal(class)
+	if err != nil {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil
+	}
+	return strip(v)
+}
+
+func strip(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		delete(v, "location")
+		delete(v, "line")
+		delete(v, "col")
+		for k, e := range v {
+			v[k] = strip(e)
+		}
+		return v
+	case []any:
+		var out []any
+		for _, e := range v {
+			if isNewline(e) && len(out) > 0 && isNewline(out[len(out)-1]) {
+				continue
+			}
+			out = append(out, strip(e))
+		}
+		return out
+	}
+	return v
+}
+
+// isNewline reports whether v is a NEWLINE body token
+func isNewline(v any) bool {
+	tok, ok := v.(map[string]any)
+	return ok && tok["type"] == string(lexer.NEWLINE)
+}
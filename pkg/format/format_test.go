@@ -0,0 +1,77 @@
+package format
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "indentation and spacing",
+			in: "\n\n# A counter\nCounter subclass: Object\ninstanceVars: value:0\n" +
+				"    method:   incrementBy:  n [\n" +
+				"value := value +   n.   # add it\n" +
+				"\t\t^ value\n" +
+				"        ]\n\n\n\n" +
+				"  method: each [\n    #(1 2) do: [:x |\n  value := x\n]\n  ]   \n\n",
+			want: "# A counter\nCounter subclass: Object\n  instanceVars: value:0\n" +
+				"  method: incrementBy: n [\n" +
+				"    value := value + n. # add it\n" +
+				"    ^ value\n" +
+				"  ]\n\n" +
+				"  method: each [\n    #(1 2) do: [:x |\n      value := x\n    ]\n  ]\n",
+		},
+		{
+			name: "aligned defaults",
+			in: "Person subclass: Object\n" +
+				"  instanceVars: name:'nobody'\n" +
+				"  instanceVars: age:0\n" +
+				"  instanceVars: tags:<array> []\n" +
+				"  instanceVars: nickname\n" +
+				"  classInstanceVars: count:0 total:0\n",
+			want: "Person subclass: Object\n" +
+				"  instanceVars: name:        'nobody'\n" +
+				"  instanceVars: age:         0\n" +
+				"  instanceVars: tags:<array> []\n" +
+				"  instanceVars: nickname\n" +
+				"  classInstanceVars: count:0 total:0\n",
+		},
+		{
+			name: "continuations",
+			in: "Greeter subclass: Object\n  method: greet [\n    ^ 'hello ' , \\\n 'world'\n  ]\n",
+			want: "Greeter subclass: Object\n  method: greet [\n    ^ 'hello ' , \\\n        'world'\n  ]\n",
+		},
+		{
+			name: "raw methods are verbatim",
+			in: "Shell subclass: Object\n   rawMethod: banner [\n    cat <<EOF\n  indented   text\n\n\nEOF\n    ]\n",
+			want: "Shell subclass: Object\n  rawMethod: banner [\n    cat <<EOF\n  indented   text\n\n\nEOF\n  ]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Source([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			again, err := Source(got)
+			if err != nil || string(again) != string(got) {
+				t.Errorf("formatting is not idempotent: %v\n%s", err, again)
+			}
+		})
+	}
+}
+
+func TestSourceParseError(t *testing.T) {
+	_, err := Source([]byte("Counter subclass: Object\n  classVersion:\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "parsing: ") {
+		t.Errorf("err = %v, want a parse error", err)
+	}
+}
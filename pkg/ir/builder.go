@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/mangle"
 	"github.com/chazu/procyon/pkg/parser"
 )
 
@@ -60,7 +61,7 @@ func NewBuilder(class *ast.Class) *Builder {
 	for _, ivar := range class.InstanceVars {
 		decl := VarDecl{
 			Name:   ivar.Name,
-			Type:   inferTypeFromDefault(ivar.Default),
+			Type:   ivarType(ivar),
 			IsIVar: true,
 		}
 		if ivar.Default.Value != "" {
@@ -98,17 +99,16 @@ func (b *Builder) Build() (*Program, []string, []string) {
 	}
 
 	// Handle parent package (if parent is qualified like Pkg::Parent)
-	if strings.Contains(b.class.Parent, "::") {
-		parts := strings.Split(b.class.Parent, "::")
-		program.ParentPackage = parts[0]
-		program.Parent = parts[1]
+	if pkg, parent := mangle.SplitClass(b.class.Parent); pkg != "" {
+		program.ParentPackage = pkg
+		program.Parent = parent
 	}
 
 	// Convert instance variables to VarDecl slice
 	for _, ivar := range b.class.InstanceVars {
 		decl := VarDecl{
 			Name:   ivar.Name,
-			Type:   inferTypeFromDefault(ivar.Default),
+			Type:   ivarType(ivar),
 			IsIVar: true,
 		}
 		if ivar.Default.Value != "" {
@@ -261,6 +261,18 @@ func (b *Builder) buildStatement(stmt parser.Statement, scope *Scope) (Statement
 		return b.buildWhileStmt(s, scope)
 	case *parser.IterationExpr:
 		return b.buildForEachStmt(s, scope)
+	case *parser.CountedLoopExpr:
+		// No counted loop in the IR yet
+		return &BashStmt{
+			Code:   "# to:do: / timesRepeat:",
+			Reason: "to:do: and timesRepeat: require Bash",
+		}, BackendBash, "to:do: and timesRepeat: require Bash"
+	case *parser.ThrowExpr, *parser.OnDoExpr, *parser.EnsureExpr:
+		// No exceptions in the IR yet
+		return &BashStmt{
+			Code:   "# _throw / on:do: / ensure:",
+			Reason: "exception handling requires Bash",
+		}, BackendBash, "exception handling requires Bash"
 	case *parser.DynamicIterationExpr:
 		// Dynamic iteration requires Bash fallback
 		return &BashStmt{
@@ -349,6 +361,45 @@ func (b *Builder) buildIfStmt(i *parser.IfExpr, scope *Scope) (Statement, Backen
 	}, backend, reason
 }
 
+// buildCondExpr converts a conditional used inside an expression. Each branch
+// must be a single expression or another such conditional.
+func (b *Builder) buildCondExpr(i *parser.IfExpr, scope *Scope) (Expression, Backend, string) {
+	condition, backend, reason := b.buildExpr(i.Condition, scope)
+	then, thenBackend, thenReason := b.buildBranchValue(i.TrueBlock, scope)
+	els, elseBackend, elseReason := b.buildBranchValue(i.FalseBlock, scope)
+
+	for _, r := range []struct {
+		backend Backend
+		reason  string
+	}{{thenBackend, thenReason}, {elseBackend, elseReason}} {
+		if r.backend == BackendBash && backend != BackendBash {
+			backend, reason = BackendBash, r.reason
+		}
+	}
+
+	typ := then.ResultType()
+	if els.ResultType() != typ {
+		typ = TypeAny
+	}
+	return &CondExpr{Condition: condition, Then: then, Else: els, Type_: typ}, backend, reason
+}
+
+// buildBranchValue converts the value of a conditional branch
+func (b *Builder) buildBranchValue(stmts []parser.Statement, scope *Scope) (Expression, Backend, string) {
+	switch len(stmts) {
+	case 0:
+		return &LiteralExpr{Value: "", Type_: TypeString}, BackendAny, ""
+	case 1:
+		switch s := stmts[0].(type) {
+		case *parser.ExprStmt:
+			return b.buildExpr(s.Expr, scope)
+		case *parser.IfExpr:
+			return b.buildCondExpr(s, scope)
+		}
+	}
+	return &LiteralExpr{Value: "", Type_: TypeString}, BackendBash, "conditional expression branch must be a single expression"
+}
+
 // buildWhileStmt converts a parser while expression to an IR while statement.
 func (b *Builder) buildWhileStmt(w *parser.WhileExpr, scope *Scope) (Statement, Backend, string) {
 	condition, condBackend, condReason := b.buildExpr(w.Condition, scope)
@@ -371,6 +422,18 @@ func (b *Builder) buildWhileStmt(w *parser.WhileExpr, scope *Scope) (Statement,
 
 // buildForEachStmt converts a parser iteration expression to an IR foreach statement.
 func (b *Builder) buildForEachStmt(i *parser.IterationExpr, scope *Scope) (Statement, Backend, string) {
+	if i.Kind == "inject" {
+		return &BashStmt{
+			Code:   "# inject:into:",
+			Reason: "inject:into: requires Bash",
+		}, BackendBash, "inject:into: requires Bash"
+	}
+	if i.Kind != "do" && i.Kind != "collect" && i.Kind != "select" {
+		// detect:, anySatisfy: etc. stop early, unlike a foreach
+		reason := i.Kind + ": requires Bash"
+		return &BashStmt{Code: "# " + i.Kind + ":", Reason: reason}, BackendBash, reason
+	}
+
 	collection, collBackend, collReason := b.buildExpr(i.Collection, scope)
 
 	// Create new scope for loop body with iteration variable
@@ -430,6 +493,26 @@ func (b *Builder) buildExpr(expr parser.Expr, scope *Scope) (Expression, Backend
 	case *parser.ComparisonExpr:
 		return b.buildComparisonExpr(e, scope)
 
+	case *parser.LogicalExpr:
+		return b.buildLogicalExpr(e, scope)
+
+	case *parser.BetweenExpr:
+		return b.buildBetweenExpr(e, scope)
+
+	case *parser.NegateExpr:
+		// -x is 0 - x
+		return b.buildBinaryExpr(&parser.BinaryExpr{Left: &parser.NumberLit{Value: "0"}, Op: "-", Right: e.Operand}, scope)
+
+	case *parser.MinMaxExpr:
+		return &SubshellExpr{Code: "# " + e.Op + ":"}, BackendBash, e.Op + ": requires Bash"
+
+	case *parser.NotExpr:
+		operand, backend, reason := b.buildExpr(e.Operand, scope)
+		return &UnaryExpr{Op: "!", Operand: operand, Type_: TypeBool}, backend, reason
+
+	case *parser.IfExpr:
+		return b.buildCondExpr(e, scope)
+
 	case *parser.MessageSend:
 		return b.buildMessageSend(e, scope)
 
@@ -557,6 +640,37 @@ func (b *Builder) buildComparisonExpr(e *parser.ComparisonExpr, scope *Scope) (E
 	}, backend, reason
 }
 
+// buildBetweenExpr converts between:and: to IR as two inclusive comparisons.
+func (b *Builder) buildBetweenExpr(e *parser.BetweenExpr, scope *Scope) (Expression, Backend, string) {
+	return b.buildLogicalExpr(&parser.LogicalExpr{
+		Left:  &parser.ComparisonExpr{Left: e.Value, Op: ">=", Right: e.Low},
+		Op:    "&&",
+		Right: &parser.ComparisonExpr{Left: e.Value, Op: "<=", Right: e.High},
+	}, scope)
+}
+
+// buildLogicalExpr converts and:/or: (&& / ||) to IR.
+func (b *Builder) buildLogicalExpr(e *parser.LogicalExpr, scope *Scope) (Expression, Backend, string) {
+	left, leftBackend, leftReason := b.buildExpr(e.Left, scope)
+	right, rightBackend, rightReason := b.buildExpr(e.Right, scope)
+
+	backend := leftBackend
+	reason := leftReason
+	if rightBackend == BackendBash {
+		backend = BackendBash
+		if reason == "" {
+			reason = rightReason
+		}
+	}
+
+	return &BinaryExpr{
+		Left:  left,
+		Op:    e.Op,
+		Right: right,
+		Type_: TypeBool,
+	}, backend, reason
+}
+
 // buildMessageSend converts a parser message send to IR.
 func (b *Builder) buildMessageSend(m *parser.MessageSend, scope *Scope) (Expression, Backend, string) {
 	var receiver Expression
@@ -643,11 +757,14 @@ func (b *Builder) buildJSONPrimitive(j *parser.JSONPrimitiveExpr, scope *Scope)
 	switch j.Operation {
 	case "arrayLength", "objectLength":
 		resultType = TypeInt
-	case "arrayIsEmpty", "objectIsEmpty", "objectHasKey":
+	case "arrayJoin":
+		resultType = TypeString
+	case "arrayIsEmpty", "objectIsEmpty", "objectHasKey", "objectEquals":
 		resultType = TypeBool
-	case "arrayFirst", "arrayLast", "arrayAt", "objectAt":
+	case "arrayFirst", "arrayLast", "arrayAt", "objectAt", "jsonAtPath":
 		resultType = TypeAny
-	case "arrayPush", "arrayRemoveAt", "objectRemoveKey", "arrayAtPut", "objectAtPut":
+	case "arrayPush", "arrayRemoveAt", "objectRemoveKey", "arrayAtPut", "objectAtPut", "jsonSetPathPut",
+		"arraySort", "arraySortNumeric", "arrayReverse", "arrayUnique", "objectMerge", "objectDeepMerge":
 		resultType = TypeJSON
 	case "objectKeys", "objectValues":
 		resultType = TypeJSON
@@ -694,7 +811,7 @@ func (b *Builder) buildClassPrimitive(c *parser.ClassPrimitiveExpr, scope *Scope
 		"fileIsFifo", "fileIsSocket", "fileIsBlockDevice", "fileIsCharDevice",
 		"fileIsReadable", "fileIsWritable", "fileIsExecutable",
 		"fileIsEmpty", "fileNotEmpty",
-		"fileIsNewer", "fileIsOlder", "fileIsSame":
+		"fileIsNewer", "fileIsOlder", "fileIsSame", "envHas":
 		resultType = TypeBool
 	}
 
@@ -708,6 +825,13 @@ func (b *Builder) buildClassPrimitive(c *parser.ClassPrimitiveExpr, scope *Scope
 
 // buildIterationAsValue handles iteration expressions used as values (e.g., in return).
 func (b *Builder) buildIterationAsValue(i *parser.IterationExpr, scope *Scope) (Expression, Backend, string) {
+	if i.Kind == "inject" {
+		return &SubshellExpr{Code: "# inject:into:"}, BackendBash, "inject:into: requires Bash"
+	}
+	if len(i.IfNone) > 0 {
+		return &SubshellExpr{Code: "# detect:ifNone:"}, BackendBash, "detect:ifNone: requires Bash"
+	}
+
 	// For collect: and select:, we need to return the result
 	// For now, treat as a message send that returns a collection
 	collection, backend, reason := b.buildExpr(i.Collection, scope)
@@ -735,7 +859,7 @@ func (b *Builder) buildIterationAsValue(i *parser.IterationExpr, scope *Scope) (
 		Type_:  TypeBlock,
 	}
 
-	// Create message send for the iteration method (collect:, select:, do:)
+	// Create message send for the iteration method (collect:, select:, detect:, ...)
 	selector := i.Kind + "_"
 	return &MessageSendExpr{
 		Receiver: collection,
@@ -767,6 +891,23 @@ func inferTypeFromDefault(def ast.DefaultValue) Type {
 	}
 }
 
+// ivarType returns the type of an instance variable: its annotation
+// (count:<int> 0) if it has one the IR can represent, otherwise the type of
+// its default value. IR has no float type, so <float> is TypeAny.
+func ivarType(ivar ast.InstanceVar) Type {
+	switch ivar.Type {
+	case "int":
+		return TypeInt
+	case "string":
+		return TypeString
+	case "array", "object":
+		return TypeJSON
+	case "float":
+		return TypeAny
+	}
+	return inferTypeFromDefault(ivar.Default)
+}
+
 // tokensToRawBash converts AST tokens back to raw Bash code for raw methods.
 // This preserves the original Bash code without any transformation.
 func tokensToRawBash(tokens []ast.Token) string {
@@ -0,0 +1,1243 @@
+package ir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The interpreter runs a Program without generating code, so a behavioral
+// difference between a backend and the Bash runtime can be traced to IR
+// construction (the interpreter differs too) or to the backend (it does
+// not). Values follow the Go backend: ivars are stored as strings, numbers
+// use int arithmetic when both sides are integral and float64 otherwise, and
+// comparisons are numeric when both sides look numeric. JSON arrays and
+// objects are []interface{} and map[string]interface{} while a method runs.
+//
+// Anything the Go backend would leave to Bash - methods that cannot compile,
+// BashStmt, subshells, sends to other classes - fails with a *BashError,
+// the interpreter's exit code 200.
+
+// Storage persists instance JSON by ID, like the Storage interface of
+// generated binaries
+type Storage interface {
+	Load(id string) (string, error)
+	Save(id, data string) error
+	Delete(id string) error
+}
+
+// MemoryStorage keeps instances in process memory
+type MemoryStorage struct {
+	mu        sync.Mutex
+	instances map[string]string
+}
+
+// NewMemoryStorage returns an empty MemoryStorage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{instances: map[string]string{}}
+}
+
+// Load returns the instance JSON saved as id
+func (s *MemoryStorage) Load(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.instances[id]
+	if !ok {
+		return "", fmt.Errorf("instance %s not found", id)
+	}
+	return data, nil
+}
+
+// Save stores data as id
+func (s *MemoryStorage) Save(id, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[id] = data
+	return nil
+}
+
+// Delete removes id
+func (s *MemoryStorage) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, id)
+	return nil
+}
+
+// BashError reports a construct the interpreter leaves to the Bash runtime
+type BashError struct {
+	Reason string
+}
+
+func (e *BashError) Error() string {
+	return "requires Bash: " + e.Reason
+}
+
+// ErrUnknownSelector is returned for a selector the class does not define
+var ErrUnknownSelector = errors.New("unknown selector")
+
+// Interpreter runs the methods of a Program against instances in a Storage.
+// Class instance variables live in the Interpreter.
+type Interpreter struct {
+	prog      *Program
+	store     Storage
+	classVars map[string]interface{}
+	nextID    int
+}
+
+// NewInterpreter returns an interpreter for prog keeping instances in store
+func NewInterpreter(prog *Program, store Storage) *Interpreter {
+	in := &Interpreter{prog: prog, store: store, classVars: map[string]interface{}{}}
+	for _, cv := range prog.ClassVars {
+		in.classVars[cv.Name] = cv.Default.Raw
+	}
+	return in
+}
+
+// instance is a loaded instance: its JSON fields, with ivars decoded
+type instance struct {
+	id     string
+	fields map[string]interface{}
+	dirty  bool
+}
+
+// frame is the state of one method activation
+type frame struct {
+	method *Method
+	self   *instance // nil in class methods
+}
+
+// env holds the locals, parameters and block parameters in scope
+type env struct {
+	vars   map[string]interface{}
+	parent *env
+}
+
+func (e *env) lookup(name string) (*env, bool) {
+	for s := e; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// closure is a block value
+type closure struct {
+	block *BlockExpr
+	env   *env
+	frame *frame
+}
+
+// nonLocalReturn carries ^ out of a block to the method that created it
+type nonLocalReturn struct {
+	frame *frame
+	value interface{}
+}
+
+// New creates an instance with the declared defaults and returns its ID
+func (in *Interpreter) New() (string, error) {
+	in.nextID++
+	id := fmt.Sprintf("%s_%d", strings.ToLower(in.prog.Name), in.nextID)
+	fields := map[string]interface{}{"class": in.prog.QualifiedName}
+	for _, iv := range in.prog.InstanceVars {
+		fields[iv.Name] = iv.Default.Raw
+		if isJSONVar(iv) {
+			fields[iv.Name] = decodeJSON(iv.Default.Raw)
+		}
+	}
+	if err := in.save(&instance{id: id, fields: fields}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Send runs the instance method selector on the instance saved as id, and
+// saves the instance if the method changed it
+func (in *Interpreter) Send(id, selector string, args []string) (string, error) {
+	self, err := in.load(id)
+	if err != nil {
+		return "", err
+	}
+	result, err := in.call(InstanceMethod, selector, self, stringValues(args))
+	if err != nil {
+		return "", err
+	}
+	if self.dirty {
+		if err := in.save(self); err != nil {
+			return "", err
+		}
+	}
+	return toStr(result), nil
+}
+
+// SendClass runs the class method selector; "new" creates an instance
+func (in *Interpreter) SendClass(selector string, args []string) (string, error) {
+	if selector == "new" && in.lookupMethod(ClassMethod, "new") == nil {
+		return in.New()
+	}
+	result, err := in.call(ClassMethod, selector, nil, stringValues(args))
+	if err != nil {
+		return "", err
+	}
+	return toStr(result), nil
+}
+
+// ClassVars returns the class instance variables as strings
+func (in *Interpreter) ClassVars() map[string]string {
+	vars := make(map[string]string, len(in.classVars))
+	for name, v := range in.classVars {
+		vars[name] = toStr(v)
+	}
+	return vars
+}
+
+func (in *Interpreter) load(id string) (*instance, error) {
+	data, err := in.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, fmt.Errorf("instance %s: %w", id, err)
+	}
+	// Scalar ivars are strings, as the Go backend stores them
+	for _, iv := range in.prog.InstanceVars {
+		switch v := fields[iv.Name].(type) {
+		case json.Number:
+			fields[iv.Name] = v.String()
+		case nil:
+			fields[iv.Name] = ""
+		case bool:
+			fields[iv.Name] = strconv.FormatBool(v)
+		}
+	}
+	return &instance{id: id, fields: fields}, nil
+}
+
+func (in *Interpreter) save(self *instance) error {
+	for _, iv := range in.prog.InstanceVars {
+		switch v := self.fields[iv.Name].(type) {
+		case []interface{}, map[string]interface{}:
+		case string:
+			// JSON ivars are stored as JSON, like json.RawMessage fields
+			if isJSONVar(iv) {
+				if decoded := decodeJSON(v); decoded != nil {
+					self.fields[iv.Name] = decoded
+				}
+			}
+		default:
+			self.fields[iv.Name] = toStr(v)
+		}
+	}
+	data, err := json.Marshal(self.fields)
+	if err != nil {
+		return err
+	}
+	self.dirty = false
+	return in.store.Save(self.id, string(data))
+}
+
+// isJSONVar reports whether an ivar holds a JSON array or object, which the
+// Go backend stores as JSON rather than as a string
+func isJSONVar(iv VarDecl) bool {
+	raw := strings.TrimSpace(iv.Default.Raw)
+	return iv.Default.Type == "json" || strings.HasPrefix(raw, "[") || strings.HasPrefix(raw, "{")
+}
+
+func (in *Interpreter) lookupMethod(kind MethodKind, selector string) *Method {
+	for i := range in.prog.Methods {
+		if m := &in.prog.Methods[i]; m.Selector == selector && m.Kind == kind {
+			return m
+		}
+	}
+	return nil
+}
+
+// call runs a method with evaluated arguments
+func (in *Interpreter) call(kind MethodKind, selector string, self *instance, args []interface{}) (result interface{}, err error) {
+	m := in.lookupMethod(kind, selector)
+	if m == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSelector, selector)
+	}
+	if !m.CanCompile {
+		return nil, &BashError{Reason: selector + ": " + m.FallbackReason}
+	}
+	if len(args) < len(m.Args) {
+		return nil, fmt.Errorf("%s requires %d argument", selector, len(m.Args))
+	}
+
+	fr := &frame{method: m, self: self}
+	scope := &env{vars: map[string]interface{}{}}
+	for i, arg := range m.Args {
+		scope.vars[arg.Name] = args[i]
+	}
+	for _, local := range m.Locals {
+		scope.vars[local.Name] = nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			ret, ok := r.(nonLocalReturn)
+			if !ok || ret.frame != fr {
+				panic(r)
+			}
+			result, err = ret.value, nil
+		}
+	}()
+	returned, value, err := in.execBlock(m.Body, fr, scope)
+	if err != nil || !returned {
+		return "", err
+	}
+	return value, nil
+}
+
+// execBlock runs stmts, reporting whether one returned from the method
+func (in *Interpreter) execBlock(stmts []Statement, fr *frame, scope *env) (bool, interface{}, error) {
+	for _, stmt := range stmts {
+		returned, value, err := in.exec(stmt, fr, scope)
+		if err != nil || returned {
+			return returned, value, err
+		}
+	}
+	return false, nil, nil
+}
+
+func (in *Interpreter) exec(stmt Statement, fr *frame, scope *env) (bool, interface{}, error) {
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		value, err := in.eval(s.Value, fr, scope)
+		if err != nil {
+			return false, nil, err
+		}
+		return false, nil, in.assign(s, value, fr, scope)
+
+	case *ReturnStmt:
+		if s.Value == nil {
+			return true, nil, nil
+		}
+		value, err := in.eval(s.Value, fr, scope)
+		return err == nil, value, err
+
+	case *ExprStmt:
+		_, err := in.eval(s.Expr, fr, scope)
+		return false, nil, err
+
+	case *IfStmt:
+		cond, err := in.eval(s.Condition, fr, scope)
+		if err != nil {
+			return false, nil, err
+		}
+		if truthy(cond) {
+			return in.execBlock(s.ThenBlock, fr, scope)
+		}
+		return in.execBlock(s.ElseBlock, fr, scope)
+
+	case *WhileStmt:
+		for {
+			cond, err := in.eval(s.Condition, fr, scope)
+			if err != nil {
+				return false, nil, err
+			}
+			if !truthy(cond) {
+				return false, nil, nil
+			}
+			if returned, value, err := in.execBlock(s.Body, fr, scope); err != nil || returned {
+				return returned, value, err
+			}
+		}
+
+	case *ForEachStmt:
+		coll, err := in.eval(s.Collection, fr, scope)
+		if err != nil {
+			return false, nil, err
+		}
+		for _, elem := range toArray(coll) {
+			loop := &env{vars: map[string]interface{}{s.IterVar: elem}, parent: scope}
+			if returned, value, err := in.execBlock(s.Body, fr, loop); err != nil || returned {
+				return returned, value, err
+			}
+		}
+		return false, nil, nil
+
+	case *BashStmt:
+		return false, nil, &BashError{Reason: s.Reason}
+	}
+	return false, nil, fmt.Errorf("unknown statement %T", stmt)
+}
+
+func (in *Interpreter) assign(s *AssignStmt, value interface{}, fr *frame, scope *env) error {
+	if s.Kind == AssignLocal || isBound(scope, s.Target) {
+		if owner, ok := scope.lookup(s.Target); ok {
+			owner.vars[s.Target] = value
+			return nil
+		}
+		scope.vars[s.Target] = value
+		return nil
+	}
+	switch s.Kind {
+	case AssignIVar:
+		if fr.self == nil {
+			return fmt.Errorf("class method %s assigns instance variable %s", fr.method.Selector, s.Target)
+		}
+		fr.self.fields[s.Target] = value
+		fr.self.dirty = true
+	case AssignClassVar:
+		in.classVars[s.Target] = value
+	}
+	return nil
+}
+
+func isBound(scope *env, name string) bool {
+	_, ok := scope.lookup(name)
+	return ok
+}
+
+func (in *Interpreter) eval(expr Expression, fr *frame, scope *env) (interface{}, error) {
+	switch e := expr.(type) {
+	case *LiteralExpr:
+		// String literals keep their source quotes for the Bash backend
+		if str, ok := e.Value.(string); ok && e.Type_ == TypeString && len(str) >= 2 &&
+			(str[0] == '"' || str[0] == '\'') && str[len(str)-1] == str[0] {
+			return str[1 : len(str)-1], nil
+		}
+		return e.Value, nil
+
+	case *VarRefExpr:
+		if owner, ok := scope.lookup(e.Name); ok {
+			return owner.vars[e.Name], nil
+		}
+		switch e.Kind {
+		case VarIVar:
+			if fr.self == nil {
+				return nil, fmt.Errorf("class method %s reads instance variable %s", fr.method.Selector, e.Name)
+			}
+			return fr.self.fields[e.Name], nil
+		case VarClassVar:
+			return in.classVars[e.Name], nil
+		}
+		return nil, nil
+
+	case *SelfExpr:
+		if fr.self == nil {
+			return in.prog.QualifiedName, nil
+		}
+		return fr.self.id, nil
+
+	case *ClassRefExpr:
+		return e.FullName(), nil
+
+	case *BinaryExpr:
+		return in.evalBinary(e, fr, scope)
+
+	case *UnaryExpr:
+		operand, err := in.eval(e.Operand, fr, scope)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "!" {
+			return !truthy(operand), nil
+		}
+		return nil, fmt.Errorf("unknown unary operator %s", e.Op)
+
+	case *CondExpr:
+		cond, err := in.eval(e.Condition, fr, scope)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return in.eval(e.Then, fr, scope)
+		}
+		return in.eval(e.Else, fr, scope)
+
+	case *BlockExpr:
+		return &closure{block: e, env: scope, frame: fr}, nil
+
+	case *MessageSendExpr:
+		return in.evalSend(e, fr, scope)
+
+	case *JSONPrimitiveExpr:
+		return in.evalJSON(e, fr, scope)
+
+	case *ClassPrimitiveExpr:
+		return in.evalClassPrimitive(e, fr, scope)
+
+	case *SubshellExpr:
+		return nil, &BashError{Reason: "subshell " + e.Code}
+	}
+	return nil, fmt.Errorf("unknown expression %T", expr)
+}
+
+func (in *Interpreter) evalBinary(e *BinaryExpr, fr *frame, scope *env) (interface{}, error) {
+	left, err := in.eval(e.Left, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+	// and: / or: only evaluate their right side when needed
+	if e.Op == "&&" || e.Op == "||" {
+		if truthy(left) == (e.Op == "||") {
+			return e.Op == "||", nil
+		}
+		right, err := in.eval(e.Right, fr, scope)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := right.(*closure); ok {
+			if right, err = in.invoke(c, nil); err != nil {
+				return nil, err
+			}
+		}
+		return truthy(right), nil
+	}
+
+	right, err := in.eval(e.Right, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Op {
+	case ",":
+		return toStr(left) + toStr(right), nil
+	case "+", "-", "*", "/":
+		return arith(e.Op, left, right)
+	case "%":
+		d := toInt(right)
+		if d == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return toInt(left) % d, nil
+	case "==", "!=", "<", ">", "<=", ">=":
+		return compare(e.Op, left, right), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", e.Op)
+}
+
+func (in *Interpreter) evalArgs(args []Expression, fr *frame, scope *env) ([]interface{}, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		v, err := in.eval(arg, fr, scope)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (in *Interpreter) evalSend(e *MessageSendExpr, fr *frame, scope *env) (interface{}, error) {
+	args, err := in.evalArgs(e.Args, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.IsSelfSend {
+		if fr.self == nil {
+			return in.call(ClassMethod, e.Selector, nil, args)
+		}
+		return in.call(InstanceMethod, e.Selector, fr.self, args)
+	}
+
+	if e.IsClassSend {
+		if e.TargetClass != in.prog.QualifiedName && e.TargetClass != in.prog.Name {
+			return nil, &BashError{Reason: "@ " + e.TargetClass + " " + e.Selector}
+		}
+		if e.Selector == "new" && in.lookupMethod(ClassMethod, "new") == nil {
+			return in.New()
+		}
+		return in.call(ClassMethod, e.Selector, nil, args)
+	}
+
+	receiver, err := in.eval(e.Receiver, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := receiver.(*closure); ok {
+		switch e.Selector {
+		case "value", "valueWith_", "valueWith_and_", "valueWith_and_and_":
+			return in.invoke(c, args)
+		}
+	}
+	if len(args) == 1 {
+		if c, ok := args[0].(*closure); ok {
+			if value, ok, err := in.iterate(strings.TrimSuffix(e.Selector, "_"), toArray(receiver), c); ok {
+				return value, err
+			}
+		}
+	}
+	return nil, &BashError{Reason: "@ " + toStr(receiver) + " " + e.Selector}
+}
+
+// iterate runs the iteration kind over elems, reporting whether kind is one
+func (in *Interpreter) iterate(kind string, elems []interface{}, c *closure) (interface{}, bool, error) {
+	switch kind {
+	case "do", "collect", "select", "reject", "detect", "anySatisfy", "allSatisfy":
+	default:
+		return nil, false, nil
+	}
+	results := []interface{}{}
+	for _, elem := range elems {
+		v, err := in.invoke(c, []interface{}{elem})
+		if err != nil {
+			return nil, true, err
+		}
+		switch kind {
+		case "collect":
+			results = append(results, v)
+		case "select":
+			if truthy(v) {
+				results = append(results, elem)
+			}
+		case "reject":
+			if !truthy(v) {
+				results = append(results, elem)
+			}
+		case "detect":
+			if truthy(v) {
+				return elem, true, nil
+			}
+		case "anySatisfy":
+			if truthy(v) {
+				return true, true, nil
+			}
+		case "allSatisfy":
+			if !truthy(v) {
+				return false, true, nil
+			}
+		}
+	}
+	switch kind {
+	case "detect":
+		return nil, true, nil
+	case "anySatisfy":
+		return false, true, nil
+	case "allSatisfy":
+		return true, true, nil
+	case "do":
+		return elems, true, nil
+	}
+	return results, true, nil
+}
+
+// invoke calls a block, answering the value of its last statement. A ^ in
+// the block returns from the method that created it.
+func (in *Interpreter) invoke(c *closure, args []interface{}) (interface{}, error) {
+	scope := &env{vars: map[string]interface{}{}, parent: c.env}
+	for i, param := range c.block.Params {
+		if i < len(args) {
+			scope.vars[param] = args[i]
+		} else {
+			scope.vars[param] = nil
+		}
+	}
+	var last interface{}
+	for _, stmt := range c.block.Body {
+		if es, ok := stmt.(*ExprStmt); ok {
+			v, err := in.eval(es.Expr, c.frame, scope)
+			if err != nil {
+				return nil, err
+			}
+			last = v
+			continue
+		}
+		returned, value, err := in.exec(stmt, c.frame, scope)
+		if err != nil {
+			return nil, err
+		}
+		if returned {
+			panic(nonLocalReturn{frame: c.frame, value: value})
+		}
+		last = nil
+	}
+	return last, nil
+}
+
+func (in *Interpreter) evalJSON(e *JSONPrimitiveExpr, fr *frame, scope *env) (interface{}, error) {
+	receiver, err := in.eval(e.Receiver, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+	args, err := in.evalArgs(e.Args, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+	arg := func(i int) interface{} {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+
+	switch e.Operation {
+	case "arrayLength":
+		return len(toArray(receiver)), nil
+	case "arrayIsEmpty":
+		return len(toArray(receiver)) == 0, nil
+	case "arrayFirst", "arrayLast", "arrayAt":
+		arr := toArray(receiver)
+		idx := 0
+		switch e.Operation {
+		case "arrayLast":
+			idx = len(arr) - 1
+		case "arrayAt":
+			idx = toInt(arg(0))
+			if idx < 0 {
+				idx += len(arr)
+			}
+		}
+		if idx < 0 || idx >= len(arr) {
+			return nil, nil
+		}
+		return arr[idx], nil
+	case "arrayPush":
+		// Optimize coalesces a chain of pushes into one with several values
+		arr := append([]interface{}{}, toArray(receiver)...)
+		for i := range e.Args {
+			arr = append(arr, arg(i))
+		}
+		return arr, nil
+	case "arrayAtPut":
+		arr := append([]interface{}{}, toArray(receiver)...)
+		idx := toInt(arg(0))
+		if idx < 0 {
+			idx += len(arr)
+		}
+		for idx >= len(arr) {
+			arr = append(arr, nil)
+		}
+		if idx >= 0 {
+			arr[idx] = arg(1)
+		}
+		return arr, nil
+	case "arrayRemoveAt":
+		arr := toArray(receiver)
+		idx := toInt(arg(0))
+		if idx < 0 || idx >= len(arr) {
+			return arr, nil
+		}
+		return append(append([]interface{}{}, arr[:idx]...), arr[idx+1:]...), nil
+	case "objectAt":
+		return toObject(receiver)[toStr(arg(0))], nil
+	case "objectHasKey":
+		_, ok := toObject(receiver)[toStr(arg(0))]
+		return ok, nil
+	case "objectAtPut":
+		obj := copyObject(toObject(receiver))
+		obj[toStr(arg(0))] = arg(1)
+		return obj, nil
+	case "objectRemoveKey":
+		obj := copyObject(toObject(receiver))
+		delete(obj, toStr(arg(0)))
+		return obj, nil
+	case "objectMerge", "objectDeepMerge":
+		return mergeObjects(toObject(receiver), toObject(arg(0)), e.Operation == "objectDeepMerge"), nil
+	case "objectEquals":
+		return reflect.DeepEqual(normalJSON(receiver), normalJSON(arg(0))), nil
+	case "arraySort", "arraySortNumeric":
+		arr := append([]interface{}{}, toArray(receiver)...)
+		numeric := e.Operation == "arraySortNumeric"
+		sort.SliceStable(arr, func(i, j int) bool { return arrayLess(arr[i], arr[j], numeric) })
+		return arr, nil
+	case "arrayReverse":
+		arr := toArray(receiver)
+		out := make([]interface{}, len(arr))
+		for i, v := range arr {
+			out[len(arr)-1-i] = v
+		}
+		return out, nil
+	case "arrayUnique":
+		out := []interface{}{}
+		seen := map[string]bool{}
+		for _, v := range toArray(receiver) {
+			key, _ := json.Marshal(v)
+			if !seen[string(key)] {
+				seen[string(key)] = true
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	case "arrayJoin":
+		arr := toArray(receiver)
+		parts := make([]string, len(arr))
+		for i, v := range arr {
+			parts[i] = toStr(v)
+		}
+		return strings.Join(parts, toStr(arg(0))), nil
+	case "jsonAtPath":
+		steps, ok := jsonPathSteps(toStr(arg(0)))
+		if !ok {
+			return nil, nil
+		}
+		v, _ := jsonPathGet(jsonRoot(receiver), steps)
+		return v, nil
+	case "jsonSetPathPut":
+		steps, ok := jsonPathSteps(toStr(arg(0)))
+		if !ok {
+			return receiver, nil
+		}
+		val := arg(1)
+		if s, isStr := val.(string); isStr {
+			if t := strings.TrimSpace(s); strings.HasPrefix(t, "{") || strings.HasPrefix(t, "[") {
+				if v := decodeJSON(t); v != nil {
+					val = v
+				}
+			}
+		}
+		root, ok := jsonPathSet(jsonRoot(receiver), steps, val)
+		if !ok {
+			return receiver, nil
+		}
+		return root, nil
+	case "objectLength":
+		return len(toObject(receiver)), nil
+	case "objectIsEmpty":
+		return len(toObject(receiver)) == 0, nil
+	case "objectKeys", "objectValues":
+		obj := toObject(receiver)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := make([]interface{}, len(keys))
+		for i, k := range keys {
+			if e.Operation == "objectKeys" {
+				out[i] = k
+			} else {
+				out[i] = obj[k]
+			}
+		}
+		return out, nil
+	}
+	return nil, &BashError{Reason: e.Operation}
+}
+
+func (in *Interpreter) evalClassPrimitive(e *ClassPrimitiveExpr, fr *frame, scope *env) (interface{}, error) {
+	args, err := in.evalArgs(e.Args, fr, scope)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]string, len(args))
+	for i, arg := range args {
+		s[i] = toStr(arg)
+	}
+	need := func(n int) error {
+		if len(s) < n {
+			return fmt.Errorf("%s requires %d arguments", e.Operation, n)
+		}
+		return nil
+	}
+
+	switch e.Operation {
+	case "stringIsEmpty", "stringNotEmpty", "stringLength", "stringUppercase", "stringLowercase", "stringTrim":
+		if err := need(1); err != nil {
+			return nil, err
+		}
+	case "stringContains", "stringStartsWith", "stringEndsWith", "stringEquals",
+		"stringTrimPrefix", "stringTrimSuffix", "stringConcat":
+		if err := need(2); err != nil {
+			return nil, err
+		}
+	case "stringReplace", "stringReplaceAll", "stringSubstring":
+		if err := need(3); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, &BashError{Reason: "@ " + e.ClassName + " " + e.Operation}
+	}
+
+	switch e.Operation {
+	case "stringIsEmpty":
+		return s[0] == "", nil
+	case "stringNotEmpty":
+		return s[0] != "", nil
+	case "stringLength":
+		return len(s[0]), nil
+	case "stringUppercase":
+		return strings.ToUpper(s[0]), nil
+	case "stringLowercase":
+		return strings.ToLower(s[0]), nil
+	case "stringTrim":
+		return strings.TrimSpace(s[0]), nil
+	case "stringContains":
+		return strings.Contains(s[0], s[1]), nil
+	case "stringStartsWith":
+		return strings.HasPrefix(s[0], s[1]), nil
+	case "stringEndsWith":
+		return strings.HasSuffix(s[0], s[1]), nil
+	case "stringEquals":
+		return s[0] == s[1], nil
+	case "stringTrimPrefix":
+		return strings.TrimPrefix(s[1], s[0]), nil
+	case "stringTrimSuffix":
+		return strings.TrimSuffix(s[1], s[0]), nil
+	case "stringConcat":
+		return s[0] + s[1], nil
+	case "stringReplace":
+		return strings.Replace(s[2], s[0], s[1], 1), nil
+	case "stringReplaceAll":
+		return strings.ReplaceAll(s[2], s[0], s[1]), nil
+	default: // stringSubstring
+		start, length := toInt(args[1]), toInt(args[2])
+		if start < 0 {
+			start = 0
+		}
+		if start > len(s[0]) {
+			return "", nil
+		}
+		end := start + length
+		if length < 0 || end > len(s[0]) {
+			end = len(s[0])
+		}
+		return s[0][start:end], nil
+	}
+}
+
+// === Values ===
+
+func stringValues(args []string) []interface{} {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	return values
+}
+
+// toStr renders a value the way the Go backend's _toStr does, with JSON
+// arrays and objects as JSON
+func toStr(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case []interface{}, map[string]interface{}:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(x)
+		return strings.TrimSuffix(buf.String(), "\n")
+	case *closure:
+		return "<block>"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// truthy reports whether a condition value holds
+func truthy(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	return toStr(v) == "true"
+}
+
+// toNum converts v to an int if it is integral, a float64 if it is another
+// number, and nil otherwise
+func toNum(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return x
+	case int64:
+		return int(x)
+	case float64:
+		return x
+	case json.Number:
+		return toNum(string(x))
+	case string:
+		s := strings.TrimSpace(x)
+		if s == "" || strings.Trim(s, "0123456789.eE+-") != "" {
+			return nil
+		}
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func toInt(v interface{}) int {
+	switch x := toNum(v).(type) {
+	case int:
+		return x
+	case float64:
+		return int(x)
+	}
+	return 0
+}
+
+func toFloat(v interface{}) float64 {
+	switch x := toNum(v).(type) {
+	case int:
+		return float64(x)
+	case float64:
+		return x
+	}
+	return 0
+}
+
+func arith(op string, a, b interface{}) (interface{}, error) {
+	x, y := toNum(a), toNum(b)
+	i, iok := x.(int)
+	j, jok := y.(int)
+	if iok && jok {
+		switch op {
+		case "+":
+			return i + j, nil
+		case "-":
+			return i - j, nil
+		case "*":
+			return i * j, nil
+		case "/":
+			if j == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return i / j, nil
+		}
+	}
+	p, q := toFloat(x), toFloat(y)
+	switch op {
+	case "+":
+		return p + q, nil
+	case "-":
+		return p - q, nil
+	case "*":
+		return p * q, nil
+	}
+	return p / q, nil
+}
+
+func compare(op string, a, b interface{}) bool {
+	if toNum(a) != nil && toNum(b) != nil {
+		x, y := toFloat(a), toFloat(b)
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		case "<":
+			return x < y
+		case ">":
+			return x > y
+		case "<=":
+			return x <= y
+		}
+		return x >= y
+	}
+	s, t := toStr(a), toStr(b)
+	switch op {
+	case "==":
+		return s == t
+	case "!=":
+		return s != t
+	case "<":
+		return s < t
+	case ">":
+		return s > t
+	case "<=":
+		return s <= t
+	}
+	return s >= t
+}
+
+// toArray returns v as a JSON array: decoded if it is JSON text, empty if
+// it is not an array
+func toArray(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		return x
+	case string:
+		if arr, ok := decodeJSON(x).([]interface{}); ok {
+			return arr
+		}
+	}
+	return nil
+}
+
+// toObject returns v as a JSON object, like toArray
+func toObject(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return x
+	case string:
+		if obj, ok := decodeJSON(x).(map[string]interface{}); ok {
+			return obj
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func copyObject(obj map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		out[k] = v
+	}
+	return out
+}
+
+// mergeObjects answers a copy of obj with the keys of other set over it,
+// merging keys that hold objects on both sides if deep
+func mergeObjects(obj, other map[string]interface{}, deep bool) map[string]interface{} {
+	out := copyObject(obj)
+	for k, v := range other {
+		mine, ok1 := out[k].(map[string]interface{})
+		theirs, ok2 := v.(map[string]interface{})
+		if deep && ok1 && ok2 {
+			out[k] = mergeObjects(mine, theirs, true)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// normalJSON decodes v, JSON text or a value, the way json.Unmarshal would,
+// so that equal values compare equal whatever their Go types
+func normalJSON(v interface{}) interface{} {
+	data := []byte(toStr(v))
+	if _, ok := v.(string); !ok {
+		data, _ = json.Marshal(v)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return toStr(v)
+	}
+	return out
+}
+
+// arrayLess orders array elements for arraySort: numbers first and ascending
+// if numeric, then everything else by its string
+func arrayLess(a, b interface{}, numeric bool) bool {
+	if numeric {
+		x, errX := strconv.ParseFloat(toStr(a), 64)
+		y, errY := strconv.ParseFloat(toStr(b), 64)
+		switch {
+		case errX == nil && errY == nil:
+			return x < y
+		case (errX == nil) != (errY == nil):
+			return errX == nil
+		}
+	}
+	return toStr(a) < toStr(b)
+}
+
+// jsonRoot returns v as a JSON value: decoded if it is JSON text
+func jsonRoot(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		return decodeJSON(s)
+	}
+	return v
+}
+
+// jsonPathSteps splits a path like user.addresses[0].city into string keys
+// and int indexes
+func jsonPathSteps(path string) ([]interface{}, bool) {
+	if path == "" {
+		return nil, true
+	}
+	var steps []interface{}
+	for _, part := range strings.Split(path, ".") {
+		key, rest := part, ""
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key, rest = part[:i], part[i:]
+		}
+		if key != "" {
+			steps = append(steps, key)
+		} else if rest == "" {
+			return nil, false
+		}
+		for rest != "" {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, false
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			steps = append(steps, n)
+			rest = rest[end+1:]
+		}
+	}
+	return steps, true
+}
+
+// jsonPathGet returns the value at steps in node
+func jsonPathGet(node interface{}, steps []interface{}) (interface{}, bool) {
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			obj, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if node, ok = obj[s]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := node.([]interface{})
+			if !ok || s >= len(arr) {
+				return nil, false
+			}
+			node = arr[s]
+		}
+	}
+	return node, true
+}
+
+// jsonPathSet returns a copy of node with val at steps, creating missing
+// objects and arrays
+func jsonPathSet(node interface{}, steps []interface{}, val interface{}) (interface{}, bool) {
+	if len(steps) == 0 {
+		return val, true
+	}
+	switch s := steps[0].(type) {
+	case string:
+		obj, ok := node.(map[string]interface{})
+		if node != nil && !ok {
+			return nil, false
+		}
+		child, ok := jsonPathSet(obj[s], steps[1:], val)
+		if !ok {
+			return nil, false
+		}
+		out := copyObject(obj)
+		out[s] = child
+		return out, true
+	case int:
+		arr, ok := node.([]interface{})
+		if node != nil && !ok {
+			return nil, false
+		}
+		out := make([]interface{}, max(len(arr), s+1))
+		copy(out, arr)
+		child, ok := jsonPathSet(out[s], steps[1:], val)
+		if !ok {
+			return nil, false
+		}
+		out[s] = child
+		return out, true
+	}
+	return nil, false
+}
+
+// decodeJSON decodes JSON text, keeping numbers exact
+func decodeJSON(s string) interface{} {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil
+	}
+	return v
+}
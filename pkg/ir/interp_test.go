@@ -0,0 +1,150 @@
+package ir
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func counterProgram() *Program {
+	ivar := func(name string) *VarRefExpr { return &VarRefExpr{Name: name, Kind: VarIVar} }
+	param := func(name string) *VarRefExpr { return &VarRefExpr{Name: name, Kind: VarParam} }
+	lit := func(v interface{}) *LiteralExpr { return &LiteralExpr{Value: v, Type_: TypeInt} }
+
+	return &Program{
+		Name:          "Counter",
+		QualifiedName: "Counter",
+		InstanceVars: []VarDecl{
+			{Name: "value", Default: Value{Type: "number", Raw: "0"}, IsIVar: true},
+			{Name: "items", Default: Value{Type: "string", Raw: "[]"}, IsIVar: true},
+		},
+		Methods: []Method{
+			{
+				Selector:   "add_",
+				Args:       []VarDecl{{Name: "n", IsParam: true}},
+				CanCompile: true,
+				Body: []Statement{
+					&AssignStmt{Target: "value", Kind: AssignIVar, Value: &BinaryExpr{Left: ivar("value"), Op: "+", Right: param("n")}},
+					&AssignStmt{Target: "items", Kind: AssignIVar, Value: &JSONPrimitiveExpr{Receiver: ivar("items"), Operation: "arrayPush", Args: []Expression{param("n")}}},
+					&ReturnStmt{Value: ivar("value")},
+				},
+			},
+			{
+				// items do: [:e | (e > 2) ifTrue: [^ e]]. ^ 'none'
+				Selector:   "firstBig",
+				CanCompile: true,
+				Body: []Statement{
+					&ExprStmt{Expr: &MessageSendExpr{
+						Receiver: ivar("items"),
+						Selector: "do_",
+						Args: []Expression{&BlockExpr{
+							Params: []string{"e"},
+							Body: []Statement{&IfStmt{
+								Condition: &BinaryExpr{Left: &VarRefExpr{Name: "e", Kind: VarParam}, Op: ">", Right: lit(int64(2))},
+								ThenBlock: []Statement{&ReturnStmt{Value: &VarRefExpr{Name: "e", Kind: VarParam}}},
+							}},
+						}},
+					}},
+					&ReturnStmt{Value: &LiteralExpr{Value: "'none'", Type_: TypeString}},
+				},
+			},
+			{
+				Selector:   "half",
+				CanCompile: true,
+				Body:       []Statement{&ReturnStmt{Value: &BinaryExpr{Left: ivar("value"), Op: "/", Right: lit(int64(2))}}},
+			},
+			{
+				Selector:       "shell",
+				FallbackReason: "raw method",
+			},
+			{
+				Selector:   "label",
+				Kind:       ClassMethod,
+				CanCompile: true,
+				Body:       []Statement{&ReturnStmt{Value: &LiteralExpr{Value: `"counter"`, Type_: TypeString}}},
+			},
+		},
+	}
+}
+
+func TestInterpreterSend(t *testing.T) {
+	store := NewMemoryStorage()
+	in := NewInterpreter(counterProgram(), store)
+
+	id, err := in.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		selector string
+		args     []string
+		want     string
+	}{
+		{"firstBig", nil, "none"},
+		{"add_", []string{"1"}, "1"},
+		{"add_", []string{"4"}, "5"},
+		// ^ inside the do: block returns from firstBig
+		{"firstBig", nil, "4"},
+		{"half", nil, "2"},
+	}
+	for _, tt := range tests {
+		got, err := in.Send(id, tt.selector, tt.args)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.selector, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s %v = %q, want %q", tt.selector, tt.args, got, tt.want)
+		}
+	}
+
+	data, _ := store.Load(id)
+	var saved map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &saved); err != nil {
+		t.Fatalf("saved instance: %v", err)
+	}
+	// Scalar ivars are saved as strings, JSON ivars as JSON
+	if saved["value"] != "5" {
+		t.Errorf("value = %#v, want \"5\"", saved["value"])
+	}
+	if items, ok := saved["items"].([]interface{}); !ok || len(items) != 2 {
+		t.Errorf("items = %#v, want a 2-element array", saved["items"])
+	}
+	if saved["class"] != "Counter" {
+		t.Errorf("class = %#v, want Counter", saved["class"])
+	}
+}
+
+func TestInterpreterSendClass(t *testing.T) {
+	in := NewInterpreter(counterProgram(), NewMemoryStorage())
+
+	got, err := in.SendClass("label", nil)
+	if err != nil || got != "counter" {
+		t.Errorf("label = %q, %v; want counter", got, err)
+	}
+	if _, err := in.SendClass("new", nil); err != nil {
+		t.Errorf("new: %v", err)
+	}
+}
+
+func TestInterpreterFallback(t *testing.T) {
+	store := NewMemoryStorage()
+	store.Save("c1", `{"class":"Counter","value":"7","items":[]}`)
+	in := NewInterpreter(counterProgram(), store)
+
+	var bashErr *BashError
+	if _, err := in.Send("c1", "shell", nil); !errors.As(err, &bashErr) {
+		t.Errorf("shell: got %v, want a BashError", err)
+	}
+	if _, err := in.Send("c1", "missing", nil); !errors.Is(err, ErrUnknownSelector) {
+		t.Errorf("missing: got %v, want ErrUnknownSelector", err)
+	}
+	if _, err := in.Send("c2", "half", nil); err == nil {
+		t.Error("expected an error for a missing instance")
+	}
+
+	got, err := in.Send("c1", "half", nil)
+	if err != nil || got != "3" {
+		t.Errorf("half = %q, %v; want 3", got, err)
+	}
+}
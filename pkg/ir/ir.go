@@ -5,6 +5,8 @@
 // - Optimization opportunities (constant folding, dead code elimination)
 package ir
 
+import "github.com/chazu/procyon/pkg/mangle"
+
 // Program represents a compiled class
 type Program struct {
 	Package       string
@@ -282,6 +284,18 @@ type UnaryExpr struct {
 func (UnaryExpr) irExpr()            {}
 func (e UnaryExpr) ResultType() Type { return e.Type_ }
 
+// CondExpr represents a conditional used as a value: the value of Then if
+// Condition holds, otherwise the value of Else
+type CondExpr struct {
+	Condition Expression
+	Then      Expression
+	Else      Expression
+	Type_     Type
+}
+
+func (CondExpr) irExpr()            {}
+func (e CondExpr) ResultType() Type { return e.Type_ }
+
 // MessageSendExpr represents a Smalltalk-style message send
 type MessageSendExpr struct {
 	Receiver    Expression
@@ -318,8 +332,8 @@ func (e SubshellExpr) ResultType() Type { return TypeString }
 // JSONPrimitiveExpr represents JSON operations
 type JSONPrimitiveExpr struct {
 	Receiver  Expression
-	Operation string // "arrayPush", "objectAt", etc.
-	Args      []Expression
+	Operation string       // "arrayPush", "objectAt", etc.
+	Args      []Expression // arrayPush: pushes each, in order, once optimized
 	Type_     Type
 }
 
@@ -355,8 +369,5 @@ func (ClassRefExpr) irExpr()            {}
 func (e ClassRefExpr) ResultType() Type { return TypeClass }
 
 func (c ClassRefExpr) FullName() string {
-	if c.Package != "" {
-		return c.Package + "::" + c.Name
-	}
-	return c.Name
+	return mangle.Qualify(c.Package, c.Name)
 }
@@ -278,6 +278,27 @@ func TestInferTypeFromDefault(t *testing.T) {
 	}
 }
 
+func TestIvarType(t *testing.T) {
+	tests := []struct {
+		input    ast.InstanceVar
+		expected Type
+	}{
+		{ast.InstanceVar{Type: "int", Default: ast.DefaultValue{Type: "string", Value: "0"}}, TypeInt},
+		{ast.InstanceVar{Type: "string", Default: ast.DefaultValue{Type: "number", Value: "42"}}, TypeString},
+		{ast.InstanceVar{Type: "array", Default: ast.DefaultValue{Type: "string", Value: "[]"}}, TypeJSON},
+		{ast.InstanceVar{Type: "float", Default: ast.DefaultValue{Type: "number", Value: "1.5"}}, TypeAny},
+		{ast.InstanceVar{Default: ast.DefaultValue{Type: "number", Value: "42"}}, TypeInt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input.Type, func(t *testing.T) {
+			if result := ivarType(tt.input); result != tt.expected {
+				t.Errorf("ivarType(%+v) = %v, want %v", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestTypeStringer(t *testing.T) {
 	tests := []struct {
 		t    Type
@@ -392,6 +413,7 @@ func TestExpressionResultTypes(t *testing.T) {
 		{"VarRefExpr", VarRefExpr{Name: "x", Type_: TypeAny}, TypeAny},
 		{"BinaryExpr", BinaryExpr{Op: "+", Type_: TypeInt}, TypeInt},
 		{"UnaryExpr", UnaryExpr{Op: "-", Type_: TypeInt}, TypeInt},
+		{"CondExpr", CondExpr{Type_: TypeString}, TypeString},
 		{"MessageSendExpr", MessageSendExpr{Selector: "foo", Type_: TypeAny}, TypeAny},
 		{"BlockExpr", BlockExpr{Params: []string{"x"}}, TypeBlock},
 		{"SubshellExpr", SubshellExpr{Code: "$(ls)"}, TypeString},
@@ -435,6 +457,7 @@ func TestExpressionInterface(t *testing.T) {
 		VarRefExpr{},
 		BinaryExpr{},
 		UnaryExpr{},
+		CondExpr{},
 		MessageSendExpr{},
 		BlockExpr{},
 		SubshellExpr{},
@@ -0,0 +1,598 @@
+package ir
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/chazu/procyon/pkg/ast"
+)
+
+// FormatVersion is the version of the JSON form of a Program. It changes
+// when a field is renamed or removed, or its meaning changes; adding a node
+// or an optional field does not.
+const FormatVersion = 1
+
+// The JSON form of a Program, written by procyon --emit=ir and
+// trash-compare ir, keeps every field a backend needs, so one can be run on
+// the IR of a class without the frontend. Statements and expressions are
+// objects whose "node" names their type; the other fields of a node are
+// those of the Go struct, in lower camel case, and are omitted when empty.
+// Types, kinds and backends are written as their String forms.
+
+// programJSON is the JSON form of a Program
+type programJSON struct {
+	Version       int          `json:"version"`
+	Package       string       `json:"package,omitempty"`
+	Name          string       `json:"name"`
+	QualifiedName string       `json:"qualifiedName"`
+	Parent        string       `json:"parent,omitempty"`
+	ParentPackage string       `json:"parentPackage,omitempty"`
+	Traits        []string     `json:"traits,omitempty"`
+	InstanceVars  []varJSON    `json:"instanceVars"`
+	ClassVars     []varJSON    `json:"classVars"`
+	Methods       []methodJSON `json:"methods"`
+	SourceCode    string       `json:"sourceCode,omitempty"`
+}
+
+// varJSON is the JSON form of a VarDecl
+type varJSON struct {
+	Name     string     `json:"name"`
+	Type     string     `json:"type,omitempty"`
+	Default  *valueJSON `json:"default,omitempty"`
+	IVar     bool       `json:"ivar,omitempty"`
+	ClassVar bool       `json:"classVar,omitempty"`
+	Local    bool       `json:"local,omitempty"`
+	Param    bool       `json:"param,omitempty"`
+}
+
+// valueJSON is the JSON form of a Value. Parsed is derived from the others
+// when it is read.
+type valueJSON struct {
+	Type string `json:"type"`
+	Raw  string `json:"raw"`
+}
+
+// methodJSON is the JSON form of a Method
+type methodJSON struct {
+	Selector       string      `json:"selector"`
+	Kind           string      `json:"kind"`
+	Args           []varJSON   `json:"args,omitempty"`
+	Locals         []varJSON   `json:"locals,omitempty"`
+	Body           []*nodeJSON `json:"body,omitempty"`
+	Backend        string      `json:"backend"`
+	CanCompile     bool        `json:"canCompile"`
+	FallbackReason string      `json:"fallbackReason,omitempty"`
+	Raw            bool        `json:"raw,omitempty"`
+	RawBody        string      `json:"rawBody,omitempty"`
+}
+
+// nodeJSON is the JSON form of a Statement or Expression
+type nodeJSON struct {
+	Node string `json:"node"`
+
+	// Names and operators
+	Target    string   `json:"target,omitempty"`    // assign
+	Kind      string   `json:"kind,omitempty"`      // assign, var
+	Name      string   `json:"name,omitempty"`      // var, classRef
+	Package   string   `json:"package,omitempty"`   // classRef
+	Op        string   `json:"op,omitempty"`        // binary, unary
+	Selector  string   `json:"selector,omitempty"`  // send
+	Operation string   `json:"operation,omitempty"` // json, classPrimitive
+	Class     string   `json:"class,omitempty"`     // send (target class), classPrimitive
+	SelfSend  bool     `json:"selfSend,omitempty"`  // send
+	ClassSend bool     `json:"classSend,omitempty"` // send
+	IterVar   string   `json:"iterVar,omitempty"`   // forEach
+	Params    []string `json:"params,omitempty"`    // block
+	Code      string   `json:"code,omitempty"`      // bash, subshell
+	Reason    string   `json:"reason,omitempty"`    // bash
+	Type      string   `json:"type,omitempty"`
+	Backend   string   `json:"backend,omitempty"` // send
+
+	// The value of a literal, including null
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Subexpressions
+	Expr       *nodeJSON   `json:"expr,omitempty"` // assign, return, expr
+	Left       *nodeJSON   `json:"left,omitempty"`
+	Right      *nodeJSON   `json:"right,omitempty"`
+	Operand    *nodeJSON   `json:"operand,omitempty"`
+	Condition  *nodeJSON   `json:"condition,omitempty"`
+	Then       *nodeJSON   `json:"then,omitempty"` // cond
+	Else       *nodeJSON   `json:"else,omitempty"` // cond
+	Receiver   *nodeJSON   `json:"receiver,omitempty"`
+	Collection *nodeJSON   `json:"collection,omitempty"`
+	Args       []*nodeJSON `json:"args,omitempty"`
+
+	// Statement lists
+	ThenBlock []*nodeJSON `json:"thenBlock,omitempty"`
+	ElseBlock []*nodeJSON `json:"elseBlock,omitempty"`
+	Body      []*nodeJSON `json:"body,omitempty"`
+}
+
+// MarshalJSON returns the JSON form of p, at FormatVersion
+func (p Program) MarshalJSON() ([]byte, error) {
+	out := programJSON{
+		Version:       FormatVersion,
+		Package:       p.Package,
+		Name:          p.Name,
+		QualifiedName: p.QualifiedName,
+		Parent:        p.Parent,
+		ParentPackage: p.ParentPackage,
+		Traits:        p.Traits,
+		InstanceVars:  varsJSON(p.InstanceVars),
+		ClassVars:     varsJSON(p.ClassVars),
+		Methods:       []methodJSON{},
+		SourceCode:    p.SourceCode,
+	}
+	for _, m := range p.Methods {
+		body, err := stmtsJSON(m.Body)
+		if err != nil {
+			return nil, fmt.Errorf("method %s: %w", m.Selector, err)
+		}
+		out.Methods = append(out.Methods, methodJSON{
+			Selector:       m.Selector,
+			Kind:           m.Kind.String(),
+			Args:           varsJSON(m.Args),
+			Locals:         varsJSON(m.Locals),
+			Body:           body,
+			Backend:        m.Backend.String(),
+			CanCompile:     m.CanCompile,
+			FallbackReason: m.FallbackReason,
+			Raw:            m.IsRaw,
+			RawBody:        m.RawBody,
+		})
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads the JSON form of a Program, rejecting other versions
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var in programJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	if in.Version != FormatVersion {
+		return fmt.Errorf("IR format version %d is not supported (want %d)", in.Version, FormatVersion)
+	}
+	prog := Program{
+		Package:       in.Package,
+		Name:          in.Name,
+		QualifiedName: in.QualifiedName,
+		Parent:        in.Parent,
+		ParentPackage: in.ParentPackage,
+		Traits:        in.Traits,
+		SourceCode:    in.SourceCode,
+	}
+	var err error
+	if prog.InstanceVars, err = varsFromJSON(in.InstanceVars); err != nil {
+		return err
+	}
+	if prog.ClassVars, err = varsFromJSON(in.ClassVars); err != nil {
+		return err
+	}
+	for _, jm := range in.Methods {
+		m := Method{
+			Selector:       jm.Selector,
+			CanCompile:     jm.CanCompile,
+			FallbackReason: jm.FallbackReason,
+			IsRaw:          jm.Raw,
+			RawBody:        jm.RawBody,
+		}
+		if err := parseEnum(jm.Kind, &m.Kind, InstanceMethod, ClassMethod); err != nil {
+			return fmt.Errorf("method %s: %w", jm.Selector, err)
+		}
+		if err := parseEnum(jm.Backend, &m.Backend, BackendAny, BackendGo, BackendBash); err != nil {
+			return fmt.Errorf("method %s: %w", jm.Selector, err)
+		}
+		if m.Args, err = varsFromJSON(jm.Args); err != nil {
+			return fmt.Errorf("method %s: %w", jm.Selector, err)
+		}
+		if m.Locals, err = varsFromJSON(jm.Locals); err != nil {
+			return fmt.Errorf("method %s: %w", jm.Selector, err)
+		}
+		if m.Body, err = stmtsFromJSON(jm.Body); err != nil {
+			return fmt.Errorf("method %s: %w", jm.Selector, err)
+		}
+		prog.Methods = append(prog.Methods, m)
+	}
+	*p = prog
+	return nil
+}
+
+var allTypes = []Type{TypeUnknown, TypeInt, TypeString, TypeBool, TypeJSON, TypeBlock, TypeInstance, TypeClass, TypeAny}
+
+// parseEnum sets *v to the one of values whose String is s
+func parseEnum[T fmt.Stringer](s string, v *T, values ...T) error {
+	for _, value := range values {
+		if value.String() == s {
+			*v = value
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %T %q", *v, s)
+}
+
+func typeJSON(t Type) string {
+	if t == TypeUnknown {
+		return ""
+	}
+	return t.String()
+}
+
+func typeFromJSON(s string) (Type, error) {
+	t := TypeUnknown
+	if s == "" {
+		return t, nil
+	}
+	err := parseEnum(s, &t, allTypes...)
+	return t, err
+}
+
+func varsJSON(decls []VarDecl) []varJSON {
+	out := []varJSON{}
+	for _, d := range decls {
+		v := varJSON{
+			Name:     d.Name,
+			Type:     typeJSON(d.Type),
+			IVar:     d.IsIVar,
+			ClassVar: d.IsClassVar,
+			Local:    d.IsLocal,
+			Param:    d.IsParam,
+		}
+		if d.Default.Type != "" || d.Default.Raw != "" {
+			v.Default = &valueJSON{Type: d.Default.Type, Raw: d.Default.Raw}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func varsFromJSON(vars []varJSON) ([]VarDecl, error) {
+	var out []VarDecl
+	for _, v := range vars {
+		typ, err := typeFromJSON(v.Type)
+		if err != nil {
+			return nil, fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		d := VarDecl{
+			Name:       v.Name,
+			Type:       typ,
+			IsIVar:     v.IVar,
+			IsClassVar: v.ClassVar,
+			IsLocal:    v.Local,
+			IsParam:    v.Param,
+		}
+		if v.Default != nil {
+			d.Default = parseDefaultValue(ast.DefaultValue{Type: v.Default.Type, Value: v.Default.Raw})
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func stmtsJSON(stmts []Statement) ([]*nodeJSON, error) {
+	var out []*nodeJSON
+	for _, s := range stmts {
+		n, err := stmtJSON(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func stmtJSON(stmt Statement) (*nodeJSON, error) {
+	var err error
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		n := &nodeJSON{Node: "assign", Target: s.Target, Kind: s.Kind.String()}
+		n.Expr, err = exprJSON(s.Value)
+		return n, err
+	case *ReturnStmt:
+		n := &nodeJSON{Node: "return"}
+		if s.Value != nil {
+			n.Expr, err = exprJSON(s.Value)
+		}
+		return n, err
+	case *ExprStmt:
+		n := &nodeJSON{Node: "expr"}
+		n.Expr, err = exprJSON(s.Expr)
+		return n, err
+	case *IfStmt:
+		n := &nodeJSON{Node: "if"}
+		if n.Condition, err = exprJSON(s.Condition); err != nil {
+			return nil, err
+		}
+		if n.ThenBlock, err = stmtsJSON(s.ThenBlock); err != nil {
+			return nil, err
+		}
+		n.ElseBlock, err = stmtsJSON(s.ElseBlock)
+		return n, err
+	case *WhileStmt:
+		n := &nodeJSON{Node: "while"}
+		if n.Condition, err = exprJSON(s.Condition); err != nil {
+			return nil, err
+		}
+		n.Body, err = stmtsJSON(s.Body)
+		return n, err
+	case *ForEachStmt:
+		n := &nodeJSON{Node: "forEach", IterVar: s.IterVar}
+		if n.Collection, err = exprJSON(s.Collection); err != nil {
+			return nil, err
+		}
+		n.Body, err = stmtsJSON(s.Body)
+		return n, err
+	case *BashStmt:
+		return &nodeJSON{Node: "bash", Code: s.Code, Reason: s.Reason}, nil
+	}
+	return nil, fmt.Errorf("unsupported statement type: %T", stmt)
+}
+
+func exprsJSON(exprs []Expression) ([]*nodeJSON, error) {
+	var out []*nodeJSON
+	for _, e := range exprs {
+		n, err := exprJSON(e)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func exprJSON(expr Expression) (*nodeJSON, error) {
+	var err error
+	switch e := expr.(type) {
+	case *LiteralExpr:
+		n := &nodeJSON{Node: "literal", Type: typeJSON(e.Type_)}
+		n.Value, err = json.Marshal(e.Value)
+		return n, err
+	case *VarRefExpr:
+		return &nodeJSON{Node: "var", Name: e.Name, Kind: e.Kind.String(), Type: typeJSON(e.Type_)}, nil
+	case *BinaryExpr:
+		n := &nodeJSON{Node: "binary", Op: e.Op, Type: typeJSON(e.Type_)}
+		if n.Left, err = exprJSON(e.Left); err != nil {
+			return nil, err
+		}
+		n.Right, err = exprJSON(e.Right)
+		return n, err
+	case *UnaryExpr:
+		n := &nodeJSON{Node: "unary", Op: e.Op, Type: typeJSON(e.Type_)}
+		n.Operand, err = exprJSON(e.Operand)
+		return n, err
+	case *CondExpr:
+		n := &nodeJSON{Node: "cond", Type: typeJSON(e.Type_)}
+		if n.Condition, err = exprJSON(e.Condition); err != nil {
+			return nil, err
+		}
+		if n.Then, err = exprJSON(e.Then); err != nil {
+			return nil, err
+		}
+		n.Else, err = exprJSON(e.Else)
+		return n, err
+	case *MessageSendExpr:
+		n := &nodeJSON{
+			Node:      "send",
+			Selector:  e.Selector,
+			Class:     e.TargetClass,
+			SelfSend:  e.IsSelfSend,
+			ClassSend: e.IsClassSend,
+			Type:      typeJSON(e.Type_),
+		}
+		if e.Backend != BackendAny {
+			n.Backend = e.Backend.String()
+		}
+		if e.Receiver != nil {
+			if n.Receiver, err = exprJSON(e.Receiver); err != nil {
+				return nil, err
+			}
+		}
+		n.Args, err = exprsJSON(e.Args)
+		return n, err
+	case *BlockExpr:
+		n := &nodeJSON{Node: "block", Params: e.Params, Type: typeJSON(e.Type_)}
+		n.Body, err = stmtsJSON(e.Body)
+		return n, err
+	case *SubshellExpr:
+		return &nodeJSON{Node: "subshell", Code: e.Code}, nil
+	case *JSONPrimitiveExpr:
+		n := &nodeJSON{Node: "json", Operation: e.Operation, Type: typeJSON(e.Type_)}
+		if n.Receiver, err = exprJSON(e.Receiver); err != nil {
+			return nil, err
+		}
+		n.Args, err = exprsJSON(e.Args)
+		return n, err
+	case *ClassPrimitiveExpr:
+		n := &nodeJSON{Node: "classPrimitive", Class: e.ClassName, Operation: e.Operation, Type: typeJSON(e.Type_)}
+		n.Args, err = exprsJSON(e.Args)
+		return n, err
+	case *SelfExpr:
+		return &nodeJSON{Node: "self"}, nil
+	case *ClassRefExpr:
+		return &nodeJSON{Node: "classRef", Package: e.Package, Name: e.Name}, nil
+	}
+	return nil, fmt.Errorf("unsupported expression type: %T", expr)
+}
+
+func stmtsFromJSON(nodes []*nodeJSON) ([]Statement, error) {
+	var out []Statement
+	for _, n := range nodes {
+		s, err := stmtFromJSON(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func stmtFromJSON(n *nodeJSON) (Statement, error) {
+	if n == nil {
+		return nil, fmt.Errorf("missing statement")
+	}
+	var err error
+	switch n.Node {
+	case "assign":
+		s := &AssignStmt{Target: n.Target}
+		if err = parseEnum(n.Kind, &s.Kind, AssignLocal, AssignIVar, AssignClassVar); err != nil {
+			return nil, err
+		}
+		s.Value, err = exprFromJSON(n.Expr)
+		return s, err
+	case "return":
+		s := &ReturnStmt{}
+		if n.Expr != nil {
+			s.Value, err = exprFromJSON(n.Expr)
+		}
+		return s, err
+	case "expr":
+		s := &ExprStmt{}
+		s.Expr, err = exprFromJSON(n.Expr)
+		return s, err
+	case "if":
+		s := &IfStmt{}
+		if s.Condition, err = exprFromJSON(n.Condition); err != nil {
+			return nil, err
+		}
+		if s.ThenBlock, err = stmtsFromJSON(n.ThenBlock); err != nil {
+			return nil, err
+		}
+		s.ElseBlock, err = stmtsFromJSON(n.ElseBlock)
+		return s, err
+	case "while":
+		s := &WhileStmt{}
+		if s.Condition, err = exprFromJSON(n.Condition); err != nil {
+			return nil, err
+		}
+		s.Body, err = stmtsFromJSON(n.Body)
+		return s, err
+	case "forEach":
+		s := &ForEachStmt{IterVar: n.IterVar}
+		if s.Collection, err = exprFromJSON(n.Collection); err != nil {
+			return nil, err
+		}
+		s.Body, err = stmtsFromJSON(n.Body)
+		return s, err
+	case "bash":
+		return &BashStmt{Code: n.Code, Reason: n.Reason}, nil
+	}
+	return nil, fmt.Errorf("unknown statement node %q", n.Node)
+}
+
+func exprsFromJSON(nodes []*nodeJSON) ([]Expression, error) {
+	var out []Expression
+	for _, n := range nodes {
+		e, err := exprFromJSON(n)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func exprFromJSON(n *nodeJSON) (Expression, error) {
+	if n == nil {
+		return nil, fmt.Errorf("missing expression")
+	}
+	typ, err := typeFromJSON(n.Type)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Node {
+	case "literal":
+		e := &LiteralExpr{Type_: typ}
+		e.Value, err = literalFromJSON(n.Value)
+		return e, err
+	case "var":
+		e := &VarRefExpr{Name: n.Name, Type_: typ}
+		err = parseEnum(n.Kind, &e.Kind, VarLocal, VarParam, VarIVar, VarClassVar, VarGlobal)
+		return e, err
+	case "binary":
+		e := &BinaryExpr{Op: n.Op, Type_: typ}
+		if e.Left, err = exprFromJSON(n.Left); err != nil {
+			return nil, err
+		}
+		e.Right, err = exprFromJSON(n.Right)
+		return e, err
+	case "unary":
+		e := &UnaryExpr{Op: n.Op, Type_: typ}
+		e.Operand, err = exprFromJSON(n.Operand)
+		return e, err
+	case "cond":
+		e := &CondExpr{Type_: typ}
+		if e.Condition, err = exprFromJSON(n.Condition); err != nil {
+			return nil, err
+		}
+		if e.Then, err = exprFromJSON(n.Then); err != nil {
+			return nil, err
+		}
+		e.Else, err = exprFromJSON(n.Else)
+		return e, err
+	case "send":
+		e := &MessageSendExpr{
+			Selector:    n.Selector,
+			IsSelfSend:  n.SelfSend,
+			IsClassSend: n.ClassSend,
+			TargetClass: n.Class,
+			Type_:       typ,
+		}
+		if n.Backend != "" {
+			if err = parseEnum(n.Backend, &e.Backend, BackendAny, BackendGo, BackendBash); err != nil {
+				return nil, err
+			}
+		}
+		if n.Receiver != nil {
+			if e.Receiver, err = exprFromJSON(n.Receiver); err != nil {
+				return nil, err
+			}
+		}
+		e.Args, err = exprsFromJSON(n.Args)
+		return e, err
+	case "block":
+		e := &BlockExpr{Params: n.Params, Type_: typ}
+		e.Body, err = stmtsFromJSON(n.Body)
+		return e, err
+	case "subshell":
+		return &SubshellExpr{Code: n.Code}, nil
+	case "json":
+		e := &JSONPrimitiveExpr{Operation: n.Operation, Type_: typ}
+		if e.Receiver, err = exprFromJSON(n.Receiver); err != nil {
+			return nil, err
+		}
+		e.Args, err = exprsFromJSON(n.Args)
+		return e, err
+	case "classPrimitive":
+		e := &ClassPrimitiveExpr{ClassName: n.Class, Operation: n.Operation, Type_: typ}
+		e.Args, err = exprsFromJSON(n.Args)
+		return e, err
+	case "self":
+		return &SelfExpr{}, nil
+	case "classRef":
+		return &ClassRefExpr{Package: n.Package, Name: n.Name}, nil
+	}
+	return nil, fmt.Errorf("unknown expression node %q", n.Node)
+}
+
+// literalFromJSON returns the value of a literal: nil, a bool, a string, an
+// int64 for an integer, or a float64
+func literalFromJSON(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("literal: %w", err)
+	}
+	if num, ok := v.(json.Number); ok {
+		if i, err := num.Int64(); err == nil {
+			return i, nil
+		}
+		return num.Float64()
+	}
+	return v, nil
+}
@@ -0,0 +1,111 @@
+package ir
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/source"
+)
+
+const shapesSrc = `Shape subclass: Object
+  instanceVars: items:'[]' count:0 name:'shape'
+  classInstanceVars: made:0
+
+  method: fill: n [
+    | xs |
+    xs := items arrayPush: n arrayPush: 2.
+    (count > 3) ifTrue: [ count := 0 ] ifFalse: [ count := count + 1 ].
+    [count < 10] whileTrue: [ count := count + 2 ].
+    xs do: [:x | @ self note: x].
+    items := xs.
+    ^ (count > 1) ifTrue: [ 'many' ] ifFalse: [ name ]
+  ]
+
+  method: note: x [
+    ^ (@ String isEmpty: x) not
+  ]
+
+  classMethod: make [
+    made := made + 1.
+    ^ @ Shape new
+  ]
+
+  rawMethod: shell [
+    echo "hi"
+  ]
+`
+
+func TestProgramJSONRoundTrip(t *testing.T) {
+	class, err := source.Parse(shapesSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prog, _, errs := NewBuilder(class).Build()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	Optimize(prog)
+
+	data, err := json.Marshal(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Program
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	again, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, again) {
+		t.Errorf("round trip changed the IR:\n%s\n%s", data, again)
+	}
+	if !reflect.DeepEqual(decoded.InstanceVars, prog.InstanceVars) {
+		t.Errorf("InstanceVars = %#v, want %#v", decoded.InstanceVars, prog.InstanceVars)
+	}
+
+	for _, want := range []string{`"version":1`, `"node":"forEach"`, `"node":"while"`, `"node":"classPrimitive"`, `"rawBody":"echo \"hi\""`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("JSON does not contain %s:\n%s", want, data)
+		}
+	}
+}
+
+func TestProgramJSONInterpreter(t *testing.T) {
+	data, err := json.Marshal(counterProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prog Program
+	if err := json.Unmarshal(data, &prog); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prog.Methods[0].Body, counterProgram().Methods[0].Body) {
+		t.Errorf("add: body = %#v, want %#v", prog.Methods[0].Body, counterProgram().Methods[0].Body)
+	}
+
+	in := NewInterpreter(&prog, NewMemoryStorage())
+	id, err := in.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := in.Send(id, "add_", []string{"3"}); err != nil || got != "3" {
+		t.Errorf("add: 3 = %q, %v, want 3", got, err)
+	}
+}
+
+func TestProgramJSONVersion(t *testing.T) {
+	var prog Program
+	err := json.Unmarshal([]byte(`{"version":2,"name":"Shape","methods":[]}`), &prog)
+	if err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("Unmarshal(version 2) = %v, want a version error", err)
+	}
+	err = json.Unmarshal([]byte(`{"version":1,"name":"Shape","methods":[{"selector":"x","kind":"instance","backend":"any","body":[{"node":"goto"}]}]}`), &prog)
+	if err == nil || !strings.Contains(err.Error(), `unknown statement node "goto"`) {
+		t.Errorf("Unmarshal(goto) = %v, want an unknown node error", err)
+	}
+}
@@ -0,0 +1,446 @@
+package ir
+
+// Optimization passes run over a built Program before a backend sees it.
+// Each pass keeps the behavior of the Bash runtime: nothing is folded that
+// the runtime would evaluate differently (division by zero, string
+// comparisons that may be numeric), and reads are only moved where no
+// statement between them can change what they read.
+
+// Optimize rewrites the methods of prog in place. In order, it folds
+// constant integer arithmetic, comparisons and boolean logic, drops the
+// branches of conditionals with a literal condition and the statements after
+// a return, coalesces chains of arrayPush: into one push of several values,
+// and reads an ivar used as a JSON receiver more than once into a local at
+// the start of the method.
+func Optimize(prog *Program) {
+	for i := range prog.Methods {
+		m := &prog.Methods[i]
+		if m.IsRaw {
+			continue
+		}
+		m.Body = optimizeBlock(m.Body)
+		hoistIVarReads(m)
+	}
+}
+
+// optimizeBlock folds, prunes and coalesces a statement list
+func optimizeBlock(stmts []Statement) []Statement {
+	var result []Statement
+	for _, stmt := range stmts {
+		for _, s := range optimizeStmt(stmt) {
+			if prev, ok := lastPush(result); ok && coalescePush(prev, s) {
+				continue
+			}
+			result = append(result, s)
+			if _, ok := s.(*ReturnStmt); ok {
+				// The rest of the block never runs
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// optimizeStmt returns the statements stmt becomes: itself, the surviving
+// branch of an if with a literal condition, or none
+func optimizeStmt(stmt Statement) []Statement {
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		s.Value = optimizeExpr(s.Value)
+	case *ReturnStmt:
+		if s.Value != nil {
+			s.Value = optimizeExpr(s.Value)
+		}
+	case *ExprStmt:
+		s.Expr = optimizeExpr(s.Expr)
+	case *IfStmt:
+		s.Condition = optimizeExpr(s.Condition)
+		if cond, ok := boolLiteral(s.Condition); ok {
+			if cond {
+				return optimizeBlock(s.ThenBlock)
+			}
+			return optimizeBlock(s.ElseBlock)
+		}
+		s.ThenBlock = optimizeBlock(s.ThenBlock)
+		s.ElseBlock = optimizeBlock(s.ElseBlock)
+	case *WhileStmt:
+		s.Condition = optimizeExpr(s.Condition)
+		if cond, ok := boolLiteral(s.Condition); ok && !cond {
+			return nil
+		}
+		s.Body = optimizeBlock(s.Body)
+	case *ForEachStmt:
+		s.Collection = optimizeExpr(s.Collection)
+		s.Body = optimizeBlock(s.Body)
+	}
+	return []Statement{stmt}
+}
+
+// optimizeExpr folds e bottom-up and returns what replaces it
+func optimizeExpr(e Expression) Expression {
+	switch x := e.(type) {
+	case *BinaryExpr:
+		x.Left = optimizeExpr(x.Left)
+		x.Right = optimizeExpr(x.Right)
+		if folded := foldBinary(x); folded != nil {
+			return folded
+		}
+	case *UnaryExpr:
+		x.Operand = optimizeExpr(x.Operand)
+		if v, ok := boolLiteral(x.Operand); ok && x.Op == "!" {
+			return &LiteralExpr{Value: !v, Type_: TypeBool}
+		}
+	case *CondExpr:
+		x.Condition = optimizeExpr(x.Condition)
+		x.Then = optimizeExpr(x.Then)
+		x.Else = optimizeExpr(x.Else)
+		if cond, ok := boolLiteral(x.Condition); ok {
+			if cond {
+				return x.Then
+			}
+			return x.Else
+		}
+	case *MessageSendExpr:
+		if x.Receiver != nil {
+			x.Receiver = optimizeExpr(x.Receiver)
+		}
+		optimizeArgs(x.Args)
+	case *BlockExpr:
+		x.Body = optimizeBlock(x.Body)
+	case *JSONPrimitiveExpr:
+		x.Receiver = optimizeExpr(x.Receiver)
+		optimizeArgs(x.Args)
+		// items arrayPush: a arrayPush: b pushes a and b to items
+		if inner, ok := x.Receiver.(*JSONPrimitiveExpr); ok && x.Operation == "arrayPush" && inner.Operation == "arrayPush" {
+			x.Receiver = inner.Receiver
+			x.Args = append(append([]Expression{}, inner.Args...), x.Args...)
+		}
+	case *ClassPrimitiveExpr:
+		optimizeArgs(x.Args)
+	}
+	return e
+}
+
+func optimizeArgs(args []Expression) {
+	for i, arg := range args {
+		args[i] = optimizeExpr(arg)
+	}
+}
+
+// foldBinary returns the literal a BinaryExpr of two literals evaluates to,
+// or nil. Only integers and booleans are folded: strings compare numerically
+// when they look like numbers, and division by zero is left to fail when it
+// runs.
+func foldBinary(e *BinaryExpr) Expression {
+	if l, ok := boolLiteral(e.Left); ok {
+		r, ok := boolLiteral(e.Right)
+		if !ok {
+			return nil
+		}
+		switch e.Op {
+		case "&&":
+			return &LiteralExpr{Value: l && r, Type_: TypeBool}
+		case "||":
+			return &LiteralExpr{Value: l || r, Type_: TypeBool}
+		}
+		return nil
+	}
+
+	l, ok := intLiteral(e.Left)
+	if !ok {
+		return nil
+	}
+	r, ok := intLiteral(e.Right)
+	if !ok {
+		return nil
+	}
+	switch e.Op {
+	case "+":
+		return &LiteralExpr{Value: l + r, Type_: TypeInt}
+	case "-":
+		return &LiteralExpr{Value: l - r, Type_: TypeInt}
+	case "*":
+		return &LiteralExpr{Value: l * r, Type_: TypeInt}
+	case "/", "%":
+		if r == 0 {
+			return nil
+		}
+		if e.Op == "/" {
+			return &LiteralExpr{Value: l / r, Type_: TypeInt}
+		}
+		return &LiteralExpr{Value: l % r, Type_: TypeInt}
+	case "==":
+		return &LiteralExpr{Value: l == r, Type_: TypeBool}
+	case "!=":
+		return &LiteralExpr{Value: l != r, Type_: TypeBool}
+	case "<":
+		return &LiteralExpr{Value: l < r, Type_: TypeBool}
+	case ">":
+		return &LiteralExpr{Value: l > r, Type_: TypeBool}
+	case "<=":
+		return &LiteralExpr{Value: l <= r, Type_: TypeBool}
+	case ">=":
+		return &LiteralExpr{Value: l >= r, Type_: TypeBool}
+	}
+	return nil
+}
+
+func boolLiteral(e Expression) (bool, bool) {
+	lit, ok := e.(*LiteralExpr)
+	if !ok || lit.Type_ != TypeBool {
+		return false, false
+	}
+	v, ok := lit.Value.(bool)
+	return v, ok
+}
+
+func intLiteral(e Expression) (int64, bool) {
+	lit, ok := e.(*LiteralExpr)
+	if !ok || lit.Type_ != TypeInt {
+		return 0, false
+	}
+	switch v := lit.Value.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// lastPush returns the last statement of stmts if it assigns the result of
+// an arrayPush: to the variable pushed to, x := x arrayPush: a
+func lastPush(stmts []Statement) (*AssignStmt, bool) {
+	if len(stmts) == 0 {
+		return nil, false
+	}
+	a, ok := stmts[len(stmts)-1].(*AssignStmt)
+	if !ok || !isSelfPush(a) {
+		return nil, false
+	}
+	return a, true
+}
+
+// isSelfPush reports whether a is x := x arrayPush: ...
+func isSelfPush(a *AssignStmt) bool {
+	push, ok := a.Value.(*JSONPrimitiveExpr)
+	if !ok || push.Operation != "arrayPush" {
+		return false
+	}
+	ref, ok := push.Receiver.(*VarRefExpr)
+	if !ok || ref.Name != a.Target {
+		return false
+	}
+	switch a.Kind {
+	case AssignIVar:
+		return ref.Kind == VarIVar
+	case AssignClassVar:
+		return ref.Kind == VarClassVar
+	}
+	return ref.Kind == VarLocal || ref.Kind == VarParam
+}
+
+// coalescePush merges next into prev when both push to the same variable
+// and the values next pushes do not read it, so
+//
+//	items := items arrayPush: a.
+//	items := items arrayPush: b
+//
+// becomes one push of a and b.
+func coalescePush(prev *AssignStmt, next Statement) bool {
+	a, ok := next.(*AssignStmt)
+	if !ok || a.Target != prev.Target || a.Kind != prev.Kind || !isSelfPush(a) {
+		return false
+	}
+	push := a.Value.(*JSONPrimitiveExpr)
+	for _, arg := range push.Args {
+		if readsVar(arg, a.Target) {
+			return false
+		}
+	}
+	into := prev.Value.(*JSONPrimitiveExpr)
+	into.Args = append(into.Args, push.Args...)
+	return true
+}
+
+// readsVar reports whether e reads a variable called name, of any kind
+func readsVar(e Expression, name string) bool {
+	found := false
+	walkStmts([]Statement{&ExprStmt{Expr: e}}, nil, func(x Expression) {
+		if ref, ok := x.(*VarRefExpr); ok && ref.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
+// hoistIVarReads reads each ivar the method uses as the receiver of two or
+// more JSON primitives into a local once, at the start of the method, so it
+// is decoded once. It only does so when nothing in the method can change the
+// ivar: it is never assigned, and there are no sends, subshells or Bash
+// statements, which may reach the instance another way.
+func hoistIVarReads(m *Method) {
+	uses := map[string]int{}
+	var order []string
+	assigned := map[string]bool{}
+	opaque := false
+	walkStmts(m.Body, func(s Statement) {
+		switch x := s.(type) {
+		case *AssignStmt:
+			if x.Kind == AssignIVar {
+				assigned[x.Target] = true
+			}
+		case *BashStmt:
+			opaque = true
+		}
+	}, func(e Expression) {
+		switch x := e.(type) {
+		case *JSONPrimitiveExpr:
+			if ref, ok := x.Receiver.(*VarRefExpr); ok && ref.Kind == VarIVar {
+				if uses[ref.Name] == 0 {
+					order = append(order, ref.Name)
+				}
+				uses[ref.Name]++
+			}
+		case *MessageSendExpr:
+			if !isIteration(x) {
+				opaque = true
+			}
+		case *SubshellExpr:
+			opaque = true
+		case *ClassPrimitiveExpr:
+			if x.ClassName == "Shell" {
+				opaque = true
+			}
+		}
+	})
+	if opaque {
+		return
+	}
+
+	taken := map[string]bool{}
+	for _, d := range m.Args {
+		taken[d.Name] = true
+	}
+	for _, d := range m.Locals {
+		taken[d.Name] = true
+	}
+	var reads []Statement
+	for _, name := range order {
+		if uses[name] < 2 || assigned[name] {
+			continue
+		}
+		local := "__" + name
+		if taken[local] {
+			continue
+		}
+		taken[local] = true
+		var typ Type = TypeJSON
+		walkStmts(m.Body, nil, func(e Expression) {
+			if ref, ok := e.(*VarRefExpr); ok && ref.Kind == VarIVar && ref.Name == name {
+				typ = ref.Type_
+				ref.Name, ref.Kind = local, VarLocal
+			}
+		})
+		m.Locals = append(m.Locals, VarDecl{Name: local, Type: typ, IsLocal: true})
+		reads = append(reads, &AssignStmt{
+			Target: local,
+			Value:  &VarRefExpr{Name: name, Kind: VarIVar, Type_: typ},
+			Kind:   AssignLocal,
+		})
+	}
+	if len(reads) > 0 {
+		m.Body = append(reads, m.Body...)
+	}
+}
+
+// isIteration reports whether e is a do:, collect: or select: over a block,
+// which runs the block rather than a method
+func isIteration(e *MessageSendExpr) bool {
+	switch e.Selector {
+	case "do_", "collect_", "select_":
+	default:
+		return false
+	}
+	if len(e.Args) != 1 {
+		return false
+	}
+	_, ok := e.Args[0].(*BlockExpr)
+	return ok
+}
+
+// walkStmts calls stmt for each statement of stmts and expr for each
+// expression, depth first, including those of nested blocks. Either may be
+// nil.
+func walkStmts(stmts []Statement, stmt func(Statement), expr func(Expression)) {
+	visit := func(e Expression) {
+		if e == nil {
+			return
+		}
+		walkExpr(e, func(x Expression) {
+			if expr != nil {
+				expr(x)
+			}
+			if b, ok := x.(*BlockExpr); ok {
+				walkStmts(b.Body, stmt, expr)
+			}
+		})
+	}
+	for _, s := range stmts {
+		if stmt != nil {
+			stmt(s)
+		}
+		switch x := s.(type) {
+		case *AssignStmt:
+			visit(x.Value)
+		case *ReturnStmt:
+			visit(x.Value)
+		case *ExprStmt:
+			visit(x.Expr)
+		case *IfStmt:
+			visit(x.Condition)
+			walkStmts(x.ThenBlock, stmt, expr)
+			walkStmts(x.ElseBlock, stmt, expr)
+		case *WhileStmt:
+			visit(x.Condition)
+			walkStmts(x.Body, stmt, expr)
+		case *ForEachStmt:
+			visit(x.Collection)
+			walkStmts(x.Body, stmt, expr)
+		}
+	}
+}
+
+// walkExpr calls fn for e and each expression inside it, stopping at the
+// body of a block
+func walkExpr(e Expression, fn func(Expression)) {
+	if e == nil {
+		return
+	}
+	fn(e)
+	switch x := e.(type) {
+	case *BinaryExpr:
+		walkExpr(x.Left, fn)
+		walkExpr(x.Right, fn)
+	case *UnaryExpr:
+		walkExpr(x.Operand, fn)
+	case *CondExpr:
+		walkExpr(x.Condition, fn)
+		walkExpr(x.Then, fn)
+		walkExpr(x.Else, fn)
+	case *MessageSendExpr:
+		walkExpr(x.Receiver, fn)
+		for _, arg := range x.Args {
+			walkExpr(arg, fn)
+		}
+	case *JSONPrimitiveExpr:
+		walkExpr(x.Receiver, fn)
+		for _, arg := range x.Args {
+			walkExpr(arg, fn)
+		}
+	case *ClassPrimitiveExpr:
+		for _, arg := range x.Args {
+			walkExpr(arg, fn)
+		}
+	}
+}
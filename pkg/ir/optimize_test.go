@@ -0,0 +1,141 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOptimizeFolding(t *testing.T) {
+	lit := func(v int64) *LiteralExpr { return &LiteralExpr{Value: v, Type_: TypeInt} }
+	tests := []struct {
+		name string
+		expr Expression
+		want Expression
+	}{
+		{"arithmetic", &BinaryExpr{Left: &BinaryExpr{Left: lit(3), Op: "*", Right: lit(4)}, Op: "+", Right: lit(1)}, lit(13)},
+		{"comparison", &BinaryExpr{Left: lit(2), Op: ">", Right: lit(1)}, &LiteralExpr{Value: true, Type_: TypeBool}},
+		{"logic", &UnaryExpr{Op: "!", Operand: &BinaryExpr{
+			Left:  &LiteralExpr{Value: true, Type_: TypeBool},
+			Op:    "&&",
+			Right: &LiteralExpr{Value: false, Type_: TypeBool},
+		}}, &LiteralExpr{Value: true, Type_: TypeBool}},
+		{"division by zero", &BinaryExpr{Left: lit(1), Op: "/", Right: lit(0)}, &BinaryExpr{Left: lit(1), Op: "/", Right: lit(0)}},
+		{"strings", &BinaryExpr{Left: &LiteralExpr{Value: "1", Type_: TypeString}, Op: "==", Right: &LiteralExpr{Value: "01", Type_: TypeString}},
+			&BinaryExpr{Left: &LiteralExpr{Value: "1", Type_: TypeString}, Op: "==", Right: &LiteralExpr{Value: "01", Type_: TypeString}}},
+		{"branch", &CondExpr{Condition: &BinaryExpr{Left: lit(1), Op: "==", Right: lit(2)}, Then: lit(1), Else: lit(2)}, lit(2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optimizeExpr(tt.expr); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optimizeExpr() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptimizeDeadBranches(t *testing.T) {
+	assign := func(name string, v int64) *AssignStmt {
+		return &AssignStmt{Target: name, Value: &LiteralExpr{Value: v, Type_: TypeInt}}
+	}
+	body := optimizeBlock([]Statement{
+		&IfStmt{
+			Condition: &LiteralExpr{Value: false, Type_: TypeBool},
+			ThenBlock: []Statement{assign("a", 1)},
+			ElseBlock: []Statement{assign("b", 2), &ReturnStmt{}},
+		},
+		assign("c", 3),
+	})
+	if want := []Statement{assign("b", 2), &ReturnStmt{}}; !reflect.DeepEqual(body, want) {
+		t.Errorf("optimizeBlock() = %#v, want %#v", body, want)
+	}
+
+	body = optimizeBlock([]Statement{&WhileStmt{
+		Condition: &BinaryExpr{Left: &LiteralExpr{Value: int64(1), Type_: TypeInt}, Op: "<", Right: &LiteralExpr{Value: int64(0), Type_: TypeInt}},
+		Body:      []Statement{assign("a", 1)},
+	}})
+	if len(body) != 0 {
+		t.Errorf("while false: optimizeBlock() = %#v, want no statements", body)
+	}
+}
+
+func TestOptimizeArrayPush(t *testing.T) {
+	xs := func() *VarRefExpr { return &VarRefExpr{Name: "xs", Kind: VarLocal} }
+	lit := func(v int64) *LiteralExpr { return &LiteralExpr{Value: v, Type_: TypeInt} }
+	push := func(receiver Expression, args ...Expression) *JSONPrimitiveExpr {
+		return &JSONPrimitiveExpr{Receiver: receiver, Operation: "arrayPush", Args: args, Type_: TypeJSON}
+	}
+
+	// xs := xs arrayPush: 1 arrayPush: 2. xs := xs arrayPush: 3.
+	// xs := xs arrayPush: xs arrayLength
+	length := &JSONPrimitiveExpr{Receiver: xs(), Operation: "arrayLength", Type_: TypeInt}
+	body := optimizeBlock([]Statement{
+		&AssignStmt{Target: "xs", Value: push(push(xs(), lit(1)), lit(2))},
+		&AssignStmt{Target: "xs", Value: push(xs(), lit(3))},
+		&AssignStmt{Target: "xs", Value: push(xs(), length)},
+	})
+	want := []Statement{
+		&AssignStmt{Target: "xs", Value: push(xs(), lit(1), lit(2), lit(3))},
+		&AssignStmt{Target: "xs", Value: push(xs(), length)},
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("optimizeBlock() = %#v, want %#v", body, want)
+	}
+
+	in := NewInterpreter(&Program{Name: "Opt", QualifiedName: "Opt", Methods: []Method{{
+		Selector:   "fill",
+		Kind:       ClassMethod,
+		Locals:     []VarDecl{{Name: "xs", IsLocal: true}},
+		CanCompile: true,
+		Body:       append([]Statement{&AssignStmt{Target: "xs", Value: &LiteralExpr{Value: "[]", Type_: TypeString}}}, append(body, &ReturnStmt{Value: xs()})...),
+	}}}, NewMemoryStorage())
+	got, err := in.SendClass("fill", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "[1,2,3,3]" {
+		t.Errorf("fill = %s, want [1,2,3,3]", got)
+	}
+}
+
+func TestOptimizeHoistIVarReads(t *testing.T) {
+	items := func() *VarRefExpr { return &VarRefExpr{Name: "items", Kind: VarIVar, Type_: TypeJSON} }
+	stats := func() Method {
+		return Method{
+			Selector:   "stats",
+			CanCompile: true,
+			Body: []Statement{&ReturnStmt{Value: &BinaryExpr{
+				Left:  &JSONPrimitiveExpr{Receiver: items(), Operation: "arrayLength", Type_: TypeInt},
+				Op:    "+",
+				Right: &JSONPrimitiveExpr{Receiver: items(), Operation: "arrayFirst", Type_: TypeAny},
+			}}},
+		}
+	}
+
+	prog := &Program{Methods: []Method{stats()}}
+	Optimize(prog)
+	m := prog.Methods[0]
+	if want := []VarDecl{{Name: "__items", Type: TypeJSON, IsLocal: true}}; !reflect.DeepEqual(m.Locals, want) {
+		t.Errorf("Locals = %#v, want %#v", m.Locals, want)
+	}
+	local := &VarRefExpr{Name: "__items", Kind: VarLocal, Type_: TypeJSON}
+	want := []Statement{
+		&AssignStmt{Target: "__items", Value: items(), Kind: AssignLocal},
+		&ReturnStmt{Value: &BinaryExpr{
+			Left:  &JSONPrimitiveExpr{Receiver: local, Operation: "arrayLength", Type_: TypeInt},
+			Op:    "+",
+			Right: &JSONPrimitiveExpr{Receiver: local, Operation: "arrayFirst", Type_: TypeAny},
+		}},
+	}
+	if !reflect.DeepEqual(m.Body, want) {
+		t.Errorf("Body = %#v, want %#v", m.Body, want)
+	}
+
+	// A send may change items, so its reads stay where they are
+	m = stats()
+	m.Body = append([]Statement{&ExprStmt{Expr: &MessageSendExpr{Receiver: &SelfExpr{}, Selector: "reset", IsSelfSend: true}}}, m.Body...)
+	prog = &Program{Methods: []Method{m}}
+	Optimize(prog)
+	if len(prog.Methods[0].Locals) != 0 {
+		t.Errorf("with a send: Locals = %#v, want none", prog.Methods[0].Locals)
+	}
+}
@@ -17,7 +17,8 @@
 //	AT          - At sign @ (message send)
 //	ASSIGN      - Assignment operator :=
 //	DOT         - Period . (statement terminator)
-//	NEWLINE     - Line break (preserved for error reporting)
+//	NEWLINE     - Line break (preserved for error reporting; none is
+//	              emitted for a line ending in a backslash)
 //
 // Output Format (JSON array):
 //
@@ -371,8 +372,16 @@ func (l *Lexer) scanToken() error {
 		l.addTokenAt(PERCENT, "%", l.line, startCol)
 		return nil
 
-	// Backslash
+	// Backslash - before a newline it continues the line, and neither is
+	// emitted, so a long message send can be wrapped
 	case '\\':
+		if next == '\n' {
+			l.advance()
+			l.advance()
+			l.line++
+			l.col = 0
+			return nil
+		}
 		startCol := l.col
 		l.advance()
 		l.addTokenAt(BACKSLASH, "\\\\", l.line, startCol)
@@ -1174,6 +1174,25 @@ func TestTokenize_Newlines(t *testing.T) {
 				{Type: IDENTIFIER, Value: "bar", Line: 2, Column: 0},
 			},
 		},
+		{
+			name:  "backslash continues the line",
+			input: "at: 1 \\\n  put: 2",
+			expected: []Token{
+				{Type: KEYWORD, Value: "at:", Line: 1, Column: 0},
+				{Type: NUMBER, Value: "1", Line: 1, Column: 4},
+				{Type: KEYWORD, Value: "put:", Line: 2, Column: 2},
+				{Type: NUMBER, Value: "2", Line: 2, Column: 7},
+			},
+		},
+		{
+			name:  "backslash not before a newline",
+			input: "a \\ b",
+			expected: []Token{
+				{Type: IDENTIFIER, Value: "a", Line: 1, Column: 0},
+				{Type: BACKSLASH, Value: "\\\\", Line: 1, Column: 2},
+				{Type: IDENTIFIER, Value: "b", Line: 1, Column: 4},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,123 @@
+// Package mangle is the one definition of how Trashtalk names become the
+// names the runtime, the compiled binaries and plugins use:
+//
+//	at:put:                at_put_                  (Selector)
+//	MyApp::Counter         MyApp__Counter           (CompiledClass)
+//	MyApp::Counter at:put: __MyApp__Counter__at_put_ (BashFunction)
+//
+// The Bash runtime and jq-compiler implement the same rules. Corpus returns
+// the table the tests of this package check, as JSON, so their test suites
+// can check themselves against it too (trash-compare mangle --corpus).
+package mangle
+
+import (
+	_ "embed"
+	"strings"
+)
+
+const (
+	// PackageSep separates a package from a class in a qualified name
+	PackageSep = "::"
+	// CompiledSep replaces PackageSep in compiled names, which name files and
+	// shell functions
+	CompiledSep = "__"
+)
+
+// Selector returns the mangled form of a selector: each keyword's colon
+// becomes an underscore (at:put: is at_put_). Unary selectors and mangled
+// selectors are returned unchanged.
+func Selector(selector string) string {
+	return strings.ReplaceAll(selector, ":", "_")
+}
+
+// TrashSelector returns a mangled selector as written in Trashtalk: at_put_
+// is at:put:. Only keyword selectors, which end in an underscore, are
+// changed, so a unary selector such as to_s keeps its underscore; a keyword
+// with an underscore of its own (set_x:) cannot be told apart from two
+// keywords.
+func TrashSelector(mangled string) string {
+	if !strings.HasSuffix(mangled, "_") {
+		return mangled
+	}
+	return strings.ReplaceAll(mangled, "_", ":")
+}
+
+// GoName returns the exported Go identifier compiled methods of a mangled
+// selector are named after: at_put_ is At_put, increment is Increment
+func GoName(mangled string) string {
+	name := strings.TrimSuffix(mangled, "_")
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Qualify returns the qualified name of class in pkg, class itself if pkg
+// is empty
+func Qualify(pkg, class string) string {
+	if pkg == "" {
+		return class
+	}
+	return pkg + PackageSep + class
+}
+
+// SplitClass splits a qualified or compiled class name into its package,
+// "" for none, and class: MyApp::Counter and MyApp__Counter are both MyApp
+// and Counter. Nested packages stay in the package part in qualified form.
+func SplitClass(name string) (pkg, class string) {
+	name = QualifiedClass(name)
+	if i := strings.LastIndex(name, PackageSep); i >= 0 {
+		return name[:i], name[i+len(PackageSep):]
+	}
+	return "", name
+}
+
+// CompiledClass returns the compiled name of a class, which names its
+// binary, plugin and Bash functions: MyApp::Counter is MyApp__Counter.
+// Compiled names are returned unchanged.
+func CompiledClass(name string) string {
+	return strings.ReplaceAll(name, PackageSep, CompiledSep)
+}
+
+// QualifiedClass returns the qualified name of a class: MyApp__Counter is
+// MyApp::Counter. Qualified names, and names in which CompiledSep does not
+// separate words (__Counter, My___App), are returned unchanged.
+func QualifiedClass(name string) string {
+	if strings.Contains(name, PackageSep) || !strings.Contains(name, CompiledSep) {
+		return name
+	}
+	parts := strings.Split(name, CompiledSep)
+	for _, part := range parts {
+		if part == "" || strings.HasPrefix(part, "_") || strings.HasSuffix(part, "_") {
+			return name
+		}
+	}
+	return strings.Join(parts, PackageSep)
+}
+
+// BashFunction returns the name of the Bash function implementing a method:
+// __Counter__increment for an instance method, __Counter__class__new for a
+// class method. class may be qualified or compiled, selector mangled or not.
+func BashFunction(class, selector string, classMethod bool) string {
+	name := "__" + CompiledClass(class) + "__"
+	if classMethod {
+		name += "class__"
+	}
+	return name + Selector(selector)
+}
+
+// InstanceIDPrefix returns the prefix of the IDs of a class's instances, the
+// lower-cased class name with its package separated by one underscore:
+// myapp_counter for MyApp::Counter
+func InstanceIDPrefix(class string) string {
+	return strings.ToLower(strings.ReplaceAll(QualifiedClass(class), PackageSep, "_"))
+}
+
+//go:embed corpus.json
+var corpus []byte
+
+// Corpus returns the mangling test corpus as JSON: selectors, classes and
+// Bash functions with the names every implementation must give them
+func Corpus() []byte {
+	return corpus
+}
@@ -0,0 +1,80 @@
+package mangle
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// corpusTable is the layout of corpus.json
+type corpusTable struct {
+	Selectors []struct {
+		Selector, Mangled, Trash, Go string
+	}
+	Classes []struct {
+		Name, Qualified, Compiled, Package, Class string
+		IDPrefix                                  string `json:"id_prefix"`
+	}
+	Functions []struct {
+		Class, Selector string
+		ClassMethod     bool `json:"class_method"`
+		Bash            string
+	}
+}
+
+func loadCorpus(t *testing.T) corpusTable {
+	t.Helper()
+	var table corpusTable
+	if err := json.Unmarshal(Corpus(), &table); err != nil {
+		t.Fatalf("corpus.json: %v", err)
+	}
+	if len(table.Selectors) == 0 || len(table.Classes) == 0 || len(table.Functions) == 0 {
+		t.Fatal("corpus.json has an empty table")
+	}
+	return table
+}
+
+func TestSelectors(t *testing.T) {
+	for _, tt := range loadCorpus(t).Selectors {
+		if got := Selector(tt.Selector); got != tt.Mangled {
+			t.Errorf("Selector(%q) = %q, want %q", tt.Selector, got, tt.Mangled)
+		}
+		if got := TrashSelector(tt.Mangled); got != tt.Trash {
+			t.Errorf("TrashSelector(%q) = %q, want %q", tt.Mangled, got, tt.Trash)
+		}
+		if got := GoName(tt.Mangled); got != tt.Go {
+			t.Errorf("GoName(%q) = %q, want %q", tt.Mangled, got, tt.Go)
+		}
+		// Mangling is idempotent
+		if got := Selector(tt.Mangled); got != tt.Mangled {
+			t.Errorf("Selector(%q) = %q, want it unchanged", tt.Mangled, got)
+		}
+	}
+}
+
+func TestClasses(t *testing.T) {
+	for _, tt := range loadCorpus(t).Classes {
+		if got := QualifiedClass(tt.Name); got != tt.Qualified {
+			t.Errorf("QualifiedClass(%q) = %q, want %q", tt.Name, got, tt.Qualified)
+		}
+		if got := CompiledClass(tt.Name); got != tt.Compiled {
+			t.Errorf("CompiledClass(%q) = %q, want %q", tt.Name, got, tt.Compiled)
+		}
+		if pkg, class := SplitClass(tt.Name); pkg != tt.Package || class != tt.Class {
+			t.Errorf("SplitClass(%q) = %q, %q, want %q, %q", tt.Name, pkg, class, tt.Package, tt.Class)
+		}
+		if got := Qualify(tt.Package, tt.Class); got != tt.Qualified {
+			t.Errorf("Qualify(%q, %q) = %q, want %q", tt.Package, tt.Class, got, tt.Qualified)
+		}
+		if got := InstanceIDPrefix(tt.Name); got != tt.IDPrefix {
+			t.Errorf("InstanceIDPrefix(%q) = %q, want %q", tt.Name, got, tt.IDPrefix)
+		}
+	}
+}
+
+func TestBashFunctions(t *testing.T) {
+	for _, tt := range loadCorpus(t).Functions {
+		if got := BashFunction(tt.Class, tt.Selector, tt.ClassMethod); got != tt.Bash {
+			t.Errorf("BashFunction(%q, %q, %v) = %q, want %q", tt.Class, tt.Selector, tt.ClassMethod, got, tt.Bash)
+		}
+	}
+}
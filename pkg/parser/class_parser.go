@@ -10,12 +10,19 @@
 //   - Method definitions (method:, classMethod:, rawMethod:, rawClassMethod:)
 //   - Trait inclusion (include:)
 //   - File dependencies and protocol requirements (requires:)
+//   - Trait conflict resolution (resolve: ... use:, exclude: ... from:)
 //   - Method aliases (alias: for:)
 //   - Method advice (before:/after: do:)
+//   - Instance references (ref:)
+//   - Class versioning and data migrations (classVersion:, migrateFrom:, migrate: ... to:)
+//   - Class pragmas (pragma:)
+//   - Capability declarations (capabilities:)
+//   - Method argument types (argTypes: at the start of a method body)
 package parser
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -119,6 +126,7 @@ type ClassAST struct {
 	Parent             string         `json:"parent"`             // Parent class name (empty for traits)
 	ParentPackage      string         `json:"parentPackage"`      // Parent's package (if qualified)
 	IsTrait            bool           `json:"isTrait"`            // True if this is a trait definition
+	IsAbstract         bool           `json:"isAbstract,omitempty"` // True for ClassName subclass: Parent abstract
 	InstanceVars       []VarSpec      `json:"instanceVars"`       // Instance variables
 	ClassInstanceVars  []VarSpec      `json:"classInstanceVars"`  // Class instance variables
 	Traits             []string       `json:"traits"`             // Included traits
@@ -126,16 +134,26 @@ type ClassAST struct {
 	MethodRequirements []string       `json:"methodRequirements"` // Protocol method requirements
 	Methods            []MethodAST    `json:"methods"`            // Method definitions
 	Aliases            []AliasAST     `json:"aliases"`            // Method aliases
+	Resolutions        []ResolutionAST `json:"resolutions"`       // Trait conflict resolutions
+	AbstractMethods    []string       `json:"abstractMethods,omitempty"` // Selectors declared with abstractMethod:
+	Indexes            []string       `json:"indexes,omitempty"`         // Instance fields declared with index:
+	Renames            []RenameAST    `json:"renames,omitempty"`         // migrate: old to: new declarations
+	Pragmas            []string       `json:"pragmas,omitempty"`         // Class pragmas (e.g., "grpcNative")
+	Capabilities       []string       `json:"capabilities,omitempty"`    // Powers declared with capabilities: (e.g., "network")
 	Advice             []AdviceAST    `json:"advice"`             // Before/after advice
+	ClassVersion       int            `json:"classVersion,omitempty"` // Declared schema version (0 if none)
+	Migrations         []MigrationAST `json:"migrations,omitempty"`   // migrateFrom: blocks
 	Warnings           []ParseWarning `json:"warnings"`           // Non-fatal parse warnings
 	Location           Location       `json:"location"`           // Source location
 }
 
 // VarSpec represents an instance variable declaration with optional default.
 type VarSpec struct {
-	Name     string        `json:"name"`     // Variable name
-	Default  *DefaultValue `json:"default"`  // Default value (nil if none)
-	Location Location      `json:"location"` // Source location
+	Name     string        `json:"name"`          // Variable name
+	Default  *DefaultValue `json:"default"`       // Default value (nil if none)
+	Type     string        `json:"type,omitempty"` // Type annotation: int, float, string, array or object (empty if none)
+	Ref      bool          `json:"ref,omitempty"` // True if the var holds another instance's ID
+	Location Location      `json:"location"`      // Source location
 }
 
 // DefaultValue represents a default value for a variable.
@@ -154,6 +172,7 @@ type MethodAST struct {
 	Args     []string `json:"args"`     // Argument names
 	Body     BlockAST `json:"body"`     // Method body
 	Pragmas  []string `json:"pragmas"`  // Method pragmas (e.g., "direct")
+	ArgTypes map[string]string `json:"argTypes,omitempty"` // Arg name -> type declared with argTypes:
 	Category string   `json:"category"` // Method category (empty if none)
 	Location Location `json:"location"` // Source location
 }
@@ -172,6 +191,15 @@ type AliasAST struct {
 	Location       Location `json:"location"`       // Source location
 }
 
+// ResolutionAST represents a trait conflict resolution declaration:
+// resolve: selector use: TraitName, or exclude: selector from: TraitName.
+type ResolutionAST struct {
+	Type     string   `json:"type"`     // "resolve" or "exclude"
+	Selector string   `json:"selector"` // Method selector (e.g., "describe", "at_put_")
+	Trait    string   `json:"trait"`    // Trait used or excluded
+	Location Location `json:"location"` // Source location
+}
+
 // AdviceAST represents before/after method advice.
 type AdviceAST struct {
 	Type       string   `json:"type"`       // "advice"
@@ -181,6 +209,24 @@ type AdviceAST struct {
 	Location   Location `json:"location"`   // Source location
 }
 
+// RenameAST represents a migrate: oldName to: newName declaration: instances
+// saved while the instance variable was called oldName keep its value.
+type RenameAST struct {
+	Type     string   `json:"type"`     // "rename"
+	From     string   `json:"from"`     // Old instance variable name
+	To       string   `json:"to"`       // Current instance variable name
+	Location Location `json:"location"` // Source location
+}
+
+// MigrationAST represents a migrateFrom: block that upgrades instance data
+// stored by an older classVersion: to the next version.
+type MigrationAST struct {
+	Type        string   `json:"type"`        // "migration"
+	FromVersion int      `json:"fromVersion"` // Version the block upgrades from
+	Block       BlockAST `json:"block"`       // Migration body
+	Location    Location `json:"location"`    // Source location
+}
+
 // ParseWarning represents a non-fatal parse warning.
 type ParseWarning struct {
 	Type    string `json:"type"`    // Warning type (e.g., "possible_typo")
@@ -271,10 +317,12 @@ func (p *ClassParser) isSyncPoint() bool {
 	switch tok.Value {
 	case "method:", "rawMethod:", "classMethod:", "rawClassMethod:",
 		"instanceVars:", "classInstanceVars:", "include:", "requires:",
-		"category:", "alias:", "before:", "after:":
+		"category:", "alias:", "before:", "after:", "ref:", "classVersion:",
+		"resolve:", "exclude:", "abstractMethod:", "index:", "migrate:", "pragma:",
+		"capabilities:":
 		return true
 	}
-	return false
+	return isMigrateFrom(tok)
 }
 
 // synchronize skips tokens until we find a class-level keyword.
@@ -419,10 +467,11 @@ type ClassHeader struct {
 	Parent        string
 	ParentPackage string
 	IsTrait       bool
+	IsAbstract    bool
 	Location      Location
 }
 
-// parseClassHeader parses: ClassName subclass: Parent | ClassName trait
+// parseClassHeader parses: ClassName subclass: Parent [abstract] | ClassName trait
 func (p *ClassParser) parseClassHeader() (*ClassHeader, bool) {
 	p.skipNewlines()
 
@@ -450,11 +499,19 @@ func (p *ClassParser) parseClassHeader() (*ClassHeader, bool) {
 			return nil, false
 		}
 
+		// The abstract modifier must follow the parent on the same line
+		abstract := false
+		if tok := p.current(); tok != nil && tok.Type == TokenIdentifier && tok.Value == "abstract" {
+			abstract = true
+			p.advance()
+		}
+
 		return &ClassHeader{
 			Name:          name,
 			Parent:        parentRef.Format(),
 			ParentPackage: parentRef.Package,
 			IsTrait:       false,
+			IsAbstract:    abstract,
 			Location:      loc,
 		}, true
 	}
@@ -533,6 +590,12 @@ func (p *ClassParser) parseVarSpecs() ([]VarSpec, bool) {
 			p.advance()
 			p.skipNewlines()
 
+			// Optional type annotation (e.g., "count:<int> 0")
+			var varType string
+			if def == nil {
+				varType = p.parseVarType(name)
+			}
+
 			// If no embedded default, check for explicit default value
 			if def == nil {
 				tok = p.current()
@@ -552,6 +615,12 @@ func (p *ClassParser) parseVarSpecs() ([]VarSpec, bool) {
 						def = &DefaultValue{Type: "triplestring", Value: tok.Value}
 						p.advance()
 						p.skipNewlines()
+					case TokenLBracket, TokenLBrace:
+						// Empty JSON default written bare: tags:<array> []
+						if empty, ok := p.parseEmptyJSON(); ok {
+							def = &DefaultValue{Type: "string", Value: empty}
+							p.skipNewlines()
+						}
 					case TokenIdentifier:
 						// Bare identifier after keyword - might be typo
 						p.addWarning("possible_typo",
@@ -562,7 +631,7 @@ func (p *ClassParser) parseVarSpecs() ([]VarSpec, bool) {
 				}
 			}
 
-			vars = append(vars, VarSpec{Name: name, Default: def, Location: loc})
+			vars = append(vars, VarSpec{Name: name, Default: def, Type: varType, Location: loc})
 
 		} else if tok.Type == TokenIdentifier {
 			// Simple variable name without default
@@ -578,6 +647,97 @@ func (p *ClassParser) parseVarSpecs() ([]VarSpec, bool) {
 	return vars, len(vars) > 0
 }
 
+// VarTypes lists the instance variable type annotations.
+var VarTypes = []string{"int", "float", "string", "array", "object"}
+
+// parseVarType parses an optional type annotation <type> after the keyword
+// of variable name. Unknown types are reported and ignored.
+func (p *ClassParser) parseVarType(name string) string {
+	if p.pos+2 >= len(p.tokens) {
+		return ""
+	}
+	lt, typ, gt := p.tokens[p.pos], p.tokens[p.pos+1], p.tokens[p.pos+2]
+	if lt.Type != TokenLT || typ.Type != TokenIdentifier || gt.Type != TokenGT {
+		return ""
+	}
+	p.pos += 3
+	p.skipNewlines()
+
+	for _, known := range VarTypes {
+		if typ.Value == known {
+			return known
+		}
+	}
+	p.addWarning("unknown_type",
+		fmt.Sprintf("'%s:<%s>' - unknown type, use one of %s", name, typ.Value, strings.Join(VarTypes, ", ")),
+		typ.Line, typ.Col)
+	return ""
+}
+
+// parseEmptyJSON parses a bare [] or {} default and returns it.
+func (p *ClassParser) parseEmptyJSON() (string, bool) {
+	if p.pos+1 >= len(p.tokens) {
+		return "", false
+	}
+	first, second := p.tokens[p.pos], p.tokens[p.pos+1]
+	switch {
+	case first.Type == TokenLBracket && second.Type == TokenRBracket:
+		p.pos += 2
+		return "[]", true
+	case first.Type == TokenLBrace && second.Type == TokenRBrace:
+		p.pos += 2
+		return "{}", true
+	}
+	return "", false
+}
+
+// =============================================================================
+// Reference Parsing
+// =============================================================================
+
+// parseRefs parses: ref: owner parent
+// Each name must also be declared in instanceVars:; the parser marks the
+// matching VarSpec once the whole class body has been read.
+func (p *ClassParser) parseRefs() ([]VarSpec, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "ref:" {
+		return nil, false
+	}
+
+	p.advance()
+
+	var refs []VarSpec
+	for !p.atEnd() {
+		tok = p.current()
+		if tok.Type != TokenIdentifier || p.isSyncPoint() {
+			break
+		}
+		refs = append(refs, VarSpec{Name: tok.Value, Ref: true, Location: Location{Line: tok.Line, Col: tok.Col}})
+		p.advance()
+	}
+
+	return refs, len(refs) > 0
+}
+
+// applyRefs marks instance variables named by ref: declarations.
+func (p *ClassParser) applyRefs(instanceVars []VarSpec, refs []VarSpec) {
+	for _, ref := range refs {
+		found := false
+		for i := range instanceVars {
+			if instanceVars[i].Name == ref.Name {
+				instanceVars[i].Ref = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			p.addWarning("unknown_ref",
+				fmt.Sprintf("ref: %s does not name an instance variable", ref.Name),
+				ref.Location.Line, ref.Location.Col)
+		}
+	}
+}
+
 // =============================================================================
 // Include Parsing
 // =============================================================================
@@ -705,6 +865,167 @@ func (p *ClassParser) parseAlias() (*AliasAST, bool) {
 	}, true
 }
 
+// =============================================================================
+// Abstract Method Parsing
+// =============================================================================
+
+// parseAbstractMethod parses: abstractMethod: selector. A keyword selector is
+// written as its keywords, optionally with argument names as in method:
+// (abstractMethod: at:put: or abstractMethod: at: key put: value), and
+// stored as at_put_.
+func (p *ClassParser) parseAbstractMethod() (string, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "abstractMethod:" {
+		return "", false
+	}
+	p.advance()
+	p.skipNewlines()
+
+	selector := p.parseSelectorName("")
+	return selector, selector != ""
+}
+
+// =============================================================================
+// Index Parsing
+// =============================================================================
+
+// parseIndex parses: index: field. The field is an instance variable name or
+// a quoted JSON path into one (index: 'address.city').
+func (p *ClassParser) parseIndex() (string, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "index:" {
+		return "", false
+	}
+	p.advance()
+	p.skipNewlines()
+
+	tok = p.current()
+	if tok == nil {
+		return "", false
+	}
+	switch tok.Type {
+	case TokenIdentifier:
+		p.advance()
+		return tok.Value, true
+	case TokenString:
+		val := strings.TrimPrefix(tok.Value, "'")
+		val = strings.TrimSuffix(val, "'")
+		p.advance()
+		return val, true
+	}
+	return "", false
+}
+
+// parseClassPragma parses a class pragma: pragma: name
+func (p *ClassParser) parseClassPragma() (string, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "pragma:" {
+		return "", false
+	}
+	p.advance()
+	p.skipNewlines()
+
+	tok = p.current()
+	if tok == nil || tok.Type != TokenIdentifier {
+		return "", false
+	}
+	p.advance()
+	return tok.Value, true
+}
+
+// parseCapabilities parses a capability declaration, the names on the line
+// after it: capabilities: fileWrite process
+func (p *ClassParser) parseCapabilities() ([]string, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "capabilities:" {
+		return nil, false
+	}
+	p.advance()
+
+	var caps []string
+	for tok = p.current(); tok != nil && tok.Type == TokenIdentifier; tok = p.current() {
+		caps = append(caps, tok.Value)
+		p.advance()
+	}
+	return caps, len(caps) > 0
+}
+
+// =============================================================================
+// Trait Resolution Parsing
+// =============================================================================
+
+// parseSelectorName parses the selector a declaration names: a unary
+// selector, or the keywords of a keyword selector up to the keyword stop
+// (at:put: is stored as at_put_). An argument name on the same line as its
+// keyword is skipped. It returns "" if there is none.
+func (p *ClassParser) parseSelectorName(stop string) string {
+	tok := p.current()
+	if tok == nil {
+		return ""
+	}
+	if tok.Type == TokenIdentifier {
+		p.advance()
+		p.skipNewlines()
+		return tok.Value
+	}
+	var selector string
+	for {
+		tok = p.current()
+		if tok == nil || tok.Type != TokenKeyword || tok.Value == stop || p.isSyncPoint() {
+			break
+		}
+		selector += strings.TrimSuffix(tok.Value, ":") + "_"
+		p.advance()
+		if arg := p.current(); arg != nil && arg.Type == TokenIdentifier {
+			p.advance()
+		}
+		p.skipNewlines()
+	}
+	return selector
+}
+
+// parseResolution parses: resolve: selector use: TraitName OR
+// exclude: selector from: TraitName. A keyword selector is written as its
+// keywords (resolve: at:put: use: Dict) and stored as at_put_.
+func (p *ClassParser) parseResolution() (*ResolutionAST, bool) {
+	tok := p.current()
+	if tok == nil || (tok.Value != "resolve:" && tok.Value != "exclude:") {
+		return nil, false
+	}
+
+	loc := Location{Line: tok.Line, Col: tok.Col}
+	kind, separator := "resolve", "use:"
+	if tok.Value == "exclude:" {
+		kind, separator = "exclude", "from:"
+	}
+	p.advance()
+	p.skipNewlines()
+
+	selector := p.parseSelectorName(separator)
+	if selector == "" {
+		return nil, false
+	}
+
+	tok = p.current()
+	if tok == nil || tok.Value != separator {
+		return nil, false
+	}
+	p.advance()
+	p.skipNewlines()
+
+	ref, ok := p.parseClassRef()
+	if !ok {
+		return nil, false
+	}
+
+	return &ResolutionAST{
+		Type:     kind,
+		Selector: selector,
+		Trait:    ref.Format(),
+		Location: loc,
+	}, true
+}
+
 // =============================================================================
 // Advice Parsing
 // =============================================================================
@@ -753,6 +1074,116 @@ func (p *ClassParser) parseAdvice() (*AdviceAST, bool) {
 	}, true
 }
 
+// =============================================================================
+// Versioning Parsing
+// =============================================================================
+
+// parseClassVersion parses: classVersion: 3
+func (p *ClassParser) parseClassVersion() (int, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "classVersion:" {
+		return 0, false
+	}
+
+	p.advance()
+
+	tok = p.current()
+	if tok == nil || tok.Type != TokenNumber {
+		return 0, false
+	}
+	version, err := strconv.Atoi(tok.Value)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	p.advance()
+
+	return version, true
+}
+
+// isMigrateFrom reports whether tok starts a migrateFrom: declaration.
+// The lexer folds "migrateFrom:2" into a single keyword token.
+func isMigrateFrom(tok *Token) bool {
+	return tok.Type == TokenKeyword && strings.HasPrefix(tok.Value, "migrateFrom:")
+}
+
+// parseMigration parses: migrateFrom: 2 [ ... ]
+// and the compact form: migrateFrom:2 [ ... ]
+func (p *ClassParser) parseMigration() (*MigrationAST, bool) {
+	tok := p.current()
+	if tok == nil || !isMigrateFrom(tok) {
+		return nil, false
+	}
+
+	loc := Location{Line: tok.Line, Col: tok.Col}
+	versionText := strings.TrimPrefix(tok.Value, "migrateFrom:")
+	p.advance()
+
+	if versionText == "" {
+		tok = p.current()
+		if tok == nil || tok.Type != TokenNumber {
+			return nil, false
+		}
+		versionText = tok.Value
+		p.advance()
+	}
+
+	from, err := strconv.Atoi(versionText)
+	if err != nil || from < 1 {
+		return nil, false
+	}
+
+	p.skipNewlines()
+	block, ok := p.collectBlock()
+	if !ok {
+		return nil, false
+	}
+
+	return &MigrationAST{
+		Type:        "migration",
+		FromVersion: from,
+		Block:       block,
+		Location:    loc,
+	}, true
+}
+
+// =============================================================================
+// Rename Parsing
+// =============================================================================
+
+// parseRename parses: migrate: oldName to: newName
+func (p *ClassParser) parseRename() (*RenameAST, bool) {
+	tok := p.current()
+	if tok == nil || tok.Value != "migrate:" {
+		return nil, false
+	}
+	loc := Location{Line: tok.Line, Col: tok.Col}
+	p.advance()
+	p.skipNewlines()
+
+	tok = p.current()
+	if tok == nil || tok.Type != TokenIdentifier {
+		return nil, false
+	}
+	from := tok.Value
+	p.advance()
+	p.skipNewlines()
+
+	tok = p.current()
+	if tok == nil || tok.Value != "to:" {
+		return nil, false
+	}
+	p.advance()
+	p.skipNewlines()
+
+	tok = p.current()
+	if tok == nil || tok.Type != TokenIdentifier {
+		return nil, false
+	}
+	p.advance()
+
+	return &RenameAST{Type: "rename", From: from, To: tok.Value, Location: loc}, true
+}
+
 // =============================================================================
 // Block Collection
 // =============================================================================
@@ -832,6 +1263,55 @@ func extractPragmas(tokens []Token) (pragmas []string, remaining []Token) {
 	return pragmas, tokens[i:]
 }
 
+// ArgTypes lists the method argument types of argTypes: declarations.
+var ArgTypes = []string{"int", "float", "bool", "string"}
+
+// extractArgTypes extracts an argTypes: declaration following the pragmas of
+// a method body. Format: argTypes: amount:int flag:bool
+// Unknown types and names that are not arguments of the method are reported
+// and ignored.
+func (p *ClassParser) extractArgTypes(tokens []Token, args []string) (map[string]string, []Token) {
+	if len(tokens) == 0 || tokens[0].Type != TokenKeyword || tokens[0].Value != "argTypes:" {
+		return nil, tokens
+	}
+	i := 1
+	argTypes := map[string]string{}
+	for i+1 < len(tokens) && tokens[i].Type == TokenKeyword && tokens[i+1].Type == TokenIdentifier {
+		name, typ := strings.TrimSuffix(tokens[i].Value, ":"), tokens[i+1]
+		switch {
+		case !containsString(args, name):
+			p.addWarning("unknown_arg",
+				fmt.Sprintf("'argTypes: %s:%s' - %s is not an argument of the method", name, typ.Value, name),
+				tokens[i].Line, tokens[i].Col)
+		case !containsString(ArgTypes, typ.Value):
+			p.addWarning("unknown_type",
+				fmt.Sprintf("'argTypes: %s:%s' - unknown type, use one of %s", name, typ.Value, strings.Join(ArgTypes, ", ")),
+				typ.Line, typ.Col)
+		default:
+			argTypes[name] = typ.Value
+		}
+		i += 2
+	}
+	// Skip newlines after the declaration
+	for i < len(tokens) && tokens[i].Type == TokenNewline {
+		i++
+	}
+	if len(argTypes) == 0 {
+		return nil, tokens[i:]
+	}
+	return argTypes, tokens[i:]
+}
+
+// containsString reports whether list holds s
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
 // =============================================================================
 // Method Signature Parsing
 // =============================================================================
@@ -955,8 +1435,9 @@ func (p *ClassParser) parseMethod() (*MethodAST, bool) {
 		return nil, false
 	}
 
-	// Extract pragmas from body tokens
+	// Extract pragmas and argument types from body tokens
 	pragmas, remaining := extractPragmas(body.Tokens)
+	argTypes, remaining := p.extractArgTypes(remaining, sig.Args)
 	body.Tokens = remaining
 
 	return &MethodAST{
@@ -968,6 +1449,7 @@ func (p *ClassParser) parseMethod() (*MethodAST, bool) {
 		Args:     sig.Args,
 		Body:     body,
 		Pragmas:  pragmas,
+		ArgTypes: argTypes,
 		Location: loc,
 	}, true
 }
@@ -976,17 +1458,29 @@ func (p *ClassParser) parseMethod() (*MethodAST, bool) {
 // Class Body Parsing
 // =============================================================================
 
+// classBody collects the declarations found in a class body.
+type classBody struct {
+	InstanceVars       []VarSpec
+	ClassInstanceVars  []VarSpec
+	Traits             []string
+	Requires           []string
+	MethodRequirements []string
+	Methods            []MethodAST
+	Aliases            []AliasAST
+	Resolutions        []ResolutionAST
+	AbstractMethods    []string
+	Indexes            []string
+	Renames            []RenameAST
+	Pragmas            []string
+	Capabilities       []string
+	Advice             []AdviceAST
+	Refs               []VarSpec
+	ClassVersion       int
+	Migrations         []MigrationAST
+}
+
 // parseClassBody parses all declarations within a class body.
-func (p *ClassParser) parseClassBody() (
-	instanceVars []VarSpec,
-	classInstanceVars []VarSpec,
-	traits []string,
-	requires []string,
-	methodRequirements []string,
-	methods []MethodAST,
-	aliases []AliasAST,
-	advice []AdviceAST,
-) {
+func (p *ClassParser) parseClassBody() (body classBody) {
 	var currentCategory string
 
 	for !p.atEnd() {
@@ -1021,7 +1515,7 @@ func (p *ClassParser) parseClassBody() (
 
 		case "instanceVars:":
 			if vars, ok := p.parseInstanceVars(); ok {
-				instanceVars = vars
+				body.InstanceVars = vars
 			} else {
 				p.addError("parse_error", "Failed to parse instanceVars declaration", "instanceVars")
 				p.advance()
@@ -1030,16 +1524,34 @@ func (p *ClassParser) parseClassBody() (
 
 		case "classInstanceVars:":
 			if vars, ok := p.parseClassInstanceVars(); ok {
-				classInstanceVars = vars
+				body.ClassInstanceVars = vars
 			} else {
 				p.addError("parse_error", "Failed to parse classInstanceVars declaration", "classInstanceVars")
 				p.advance()
 				p.synchronize()
 			}
 
+		case "ref:":
+			if vars, ok := p.parseRefs(); ok {
+				body.Refs = append(body.Refs, vars...)
+			} else {
+				p.addError("parse_error", "Expected instance variable names after ref:", "ref")
+				p.advance()
+				p.synchronize()
+			}
+
+		case "classVersion:":
+			if version, ok := p.parseClassVersion(); ok {
+				body.ClassVersion = version
+			} else {
+				p.addError("parse_error", "Expected positive version number after classVersion:", "classVersion")
+				p.advance()
+				p.synchronize()
+			}
+
 		case "include:":
 			if trait, ok := p.parseInclude(); ok {
-				traits = append(traits, trait)
+				body.Traits = append(body.Traits, trait)
 			} else {
 				p.addError("parse_error", "Failed to parse include declaration", "include")
 				p.advance()
@@ -1049,9 +1561,9 @@ func (p *ClassParser) parseClassBody() (
 		case "requires:":
 			if req, ok := p.parseRequires(); ok {
 				if req.IsFile {
-					requires = append(requires, req.Value)
+					body.Requires = append(body.Requires, req.Value)
 				} else {
-					methodRequirements = append(methodRequirements, req.Value)
+					body.MethodRequirements = append(body.MethodRequirements, req.Value)
 				}
 			} else {
 				p.addError("parse_error", "Failed to parse requires declaration", "requires")
@@ -1061,16 +1573,70 @@ func (p *ClassParser) parseClassBody() (
 
 		case "alias:":
 			if alias, ok := p.parseAlias(); ok {
-				aliases = append(aliases, *alias)
+				body.Aliases = append(body.Aliases, *alias)
 			} else {
 				p.addError("parse_error", "Failed to parse alias declaration", "alias")
 				p.advance()
 				p.synchronize()
 			}
 
+		case "resolve:", "exclude:":
+			if res, ok := p.parseResolution(); ok {
+				body.Resolutions = append(body.Resolutions, *res)
+			} else {
+				p.addError("parse_error", "Failed to parse "+tok.Value+" declaration", strings.TrimSuffix(tok.Value, ":"))
+				p.advance()
+				p.synchronize()
+			}
+
+		case "abstractMethod:":
+			if selector, ok := p.parseAbstractMethod(); ok {
+				body.AbstractMethods = append(body.AbstractMethods, selector)
+			} else {
+				p.addError("parse_error", "Expected selector after abstractMethod:", "abstractMethod")
+				p.advance()
+				p.synchronize()
+			}
+
+		case "index:":
+			if field, ok := p.parseIndex(); ok {
+				body.Indexes = append(body.Indexes, field)
+			} else {
+				p.addError("parse_error", "Expected field after index:", "index")
+				p.advance()
+				p.synchronize()
+			}
+
+		case "migrate:":
+			if rename, ok := p.parseRename(); ok {
+				body.Renames = append(body.Renames, *rename)
+			} else {
+				p.addError("parse_error", "Expected oldName to: newName after migrate:", "migrate")
+				p.advance()
+				p.synchronize()
+			}
+
+		case "pragma:":
+			if pragma, ok := p.parseClassPragma(); ok {
+				body.Pragmas = append(body.Pragmas, pragma)
+			} else {
+				p.addError("parse_error", "Expected pragma name after pragma:", "pragma")
+				p.advance()
+				p.synchronize()
+			}
+
+		case "capabilities:":
+			if caps, ok := p.parseCapabilities(); ok {
+				body.Capabilities = append(body.Capabilities, caps...)
+			} else {
+				p.addError("parse_error", "Expected capability names after capabilities:", "capabilities")
+				p.advance()
+				p.synchronize()
+			}
+
 		case "before:", "after:":
 			if adv, ok := p.parseAdvice(); ok {
-				advice = append(advice, *adv)
+				body.Advice = append(body.Advice, *adv)
 			} else {
 				p.addError("parse_error", "Failed to parse advice declaration", "advice")
 				p.advance()
@@ -1082,7 +1648,7 @@ func (p *ClassParser) parseClassBody() (
 				if currentCategory != "" {
 					method.Category = currentCategory
 				}
-				methods = append(methods, *method)
+				body.Methods = append(body.Methods, *method)
 			} else {
 				p.addError("parse_error", "Failed to parse method declaration", "method")
 				p.advance()
@@ -1090,6 +1656,17 @@ func (p *ClassParser) parseClassBody() (
 			}
 
 		default:
+			if isMigrateFrom(tok) {
+				if migration, ok := p.parseMigration(); ok {
+					body.Migrations = append(body.Migrations, *migration)
+				} else {
+					p.addError("parse_error", "Failed to parse migrateFrom: declaration", "migration")
+					p.advance()
+					p.synchronize()
+				}
+				continue
+			}
+
 			// Unknown token
 			if tok.Type == TokenNewline || tok.Type == TokenComment {
 				p.advance()
@@ -1121,7 +1698,8 @@ func (p *ClassParser) Parse() (*ClassAST, []ParseError) {
 	}
 
 	// Parse class body
-	instanceVars, classInstanceVars, traits, requires, methodRequirements, methods, aliases, advice := p.parseClassBody()
+	body := p.parseClassBody()
+	p.applyRefs(body.InstanceVars, body.Refs)
 
 	// Build the AST
 	ast := &ClassAST{
@@ -1130,14 +1708,23 @@ func (p *ClassParser) Parse() (*ClassAST, []ParseError) {
 		Parent:             header.Parent,
 		ParentPackage:      header.ParentPackage,
 		IsTrait:            header.IsTrait,
-		InstanceVars:       instanceVars,
-		ClassInstanceVars:  classInstanceVars,
-		Traits:             traits,
-		Requires:           requires,
-		MethodRequirements: methodRequirements,
-		Methods:            methods,
-		Aliases:            aliases,
-		Advice:             advice,
+		IsAbstract:         header.IsAbstract,
+		InstanceVars:       body.InstanceVars,
+		ClassInstanceVars:  body.ClassInstanceVars,
+		Traits:             body.Traits,
+		Requires:           body.Requires,
+		MethodRequirements: body.MethodRequirements,
+		Methods:            body.Methods,
+		Aliases:            body.Aliases,
+		Resolutions:        body.Resolutions,
+		AbstractMethods:    body.AbstractMethods,
+		Indexes:            body.Indexes,
+		Renames:            body.Renames,
+		Pragmas:            body.Pragmas,
+		Capabilities:       body.Capabilities,
+		Advice:             body.Advice,
+		ClassVersion:       body.ClassVersion,
+		Migrations:         body.Migrations,
 		Warnings:           p.warnings,
 		Location:           header.Location,
 	}
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -439,6 +440,56 @@ func TestParseInstanceVars(t *testing.T) {
 			t.Errorf("expected var[2]=flag, got %s", ast.InstanceVars[2].Name)
 		}
 	})
+
+	t.Run("type annotations", func(t *testing.T) {
+		toks := []Token{
+			tok(TokenIdentifier, "Counter", 1, 0),
+			tok(TokenKeyword, "subclass:", 1, 8),
+			tok(TokenIdentifier, "Object", 1, 18),
+			tok(TokenNewline, "\\n", 1, 24),
+			tok(TokenKeyword, "instanceVars:", 2, 2),
+			tok(TokenKeyword, "count:", 2, 16),
+			tok(TokenLT, "<", 2, 22),
+			tok(TokenIdentifier, "int", 2, 23),
+			tok(TokenGT, ">", 2, 26),
+			tok(TokenNumber, "0", 2, 28),
+			tok(TokenKeyword, "tags:", 2, 30),
+			tok(TokenLT, "<", 2, 35),
+			tok(TokenIdentifier, "array", 2, 36),
+			tok(TokenGT, ">", 2, 41),
+			tok(TokenLBracket, "[", 2, 43),
+			tok(TokenRBracket, "]", 2, 44),
+			tok(TokenKeyword, "size:", 2, 46),
+			tok(TokenLT, "<", 2, 51),
+			tok(TokenIdentifier, "long", 2, 52),
+			tok(TokenGT, ">", 2, 56),
+			tok(TokenNumber, "1", 2, 58),
+			tok(TokenNewline, "\\n", 2, 59),
+		}
+
+		ast, errs := ParseClass(toks)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if len(ast.InstanceVars) != 3 {
+			t.Fatalf("expected 3 instance vars, got %d", len(ast.InstanceVars))
+		}
+		count, tags, size := ast.InstanceVars[0], ast.InstanceVars[1], ast.InstanceVars[2]
+		if count.Type != "int" || count.Default == nil || count.Default.Value != "0" {
+			t.Errorf("count: got type %q default %+v", count.Type, count.Default)
+		}
+		if tags.Type != "array" || tags.Default == nil || tags.Default.Value != "[]" {
+			t.Errorf("tags: got type %q default %+v", tags.Type, tags.Default)
+		}
+		// Unknown types are ignored with a warning
+		if size.Type != "" || size.Default == nil || size.Default.Value != "1" {
+			t.Errorf("size: got type %q default %+v", size.Type, size.Default)
+		}
+		warnings := ast.Warnings
+		if len(warnings) != 1 || warnings[0].Type != "unknown_type" {
+			t.Errorf("expected one unknown_type warning, got %v", warnings)
+		}
+	})
 }
 
 func TestParseClassInstanceVars(t *testing.T) {
@@ -473,6 +524,118 @@ func TestParseClassInstanceVars(t *testing.T) {
 	})
 }
 
+func TestParseRefs(t *testing.T) {
+	t.Run("ref marks instance variable", func(t *testing.T) {
+		toks := []Token{
+			tok(TokenIdentifier, "Task", 1, 0),
+			tok(TokenKeyword, "subclass:", 1, 5),
+			tok(TokenIdentifier, "Object", 1, 15),
+			tok(TokenNewline, "\\n", 1, 21),
+			tok(TokenKeyword, "instanceVars:", 2, 2),
+			tok(TokenIdentifier, "title", 2, 16),
+			tok(TokenIdentifier, "owner", 2, 22),
+			tok(TokenNewline, "\\n", 2, 27),
+			tok(TokenKeyword, "ref:", 3, 2),
+			tok(TokenIdentifier, "owner", 3, 7),
+			tok(TokenNewline, "\\n", 3, 12),
+		}
+
+		ast, errs := ParseClass(toks)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if len(ast.InstanceVars) != 2 {
+			t.Fatalf("expected 2 instance vars, got %d", len(ast.InstanceVars))
+		}
+		if ast.InstanceVars[0].Ref {
+			t.Error("expected title not to be a ref")
+		}
+		if !ast.InstanceVars[1].Ref {
+			t.Error("expected owner to be a ref")
+		}
+	})
+
+	t.Run("ref to undeclared var warns", func(t *testing.T) {
+		toks := []Token{
+			tok(TokenIdentifier, "Task", 1, 0),
+			tok(TokenKeyword, "subclass:", 1, 5),
+			tok(TokenIdentifier, "Object", 1, 15),
+			tok(TokenNewline, "\\n", 1, 21),
+			tok(TokenKeyword, "ref:", 2, 2),
+			tok(TokenIdentifier, "owner", 2, 7),
+			tok(TokenNewline, "\\n", 2, 12),
+		}
+
+		ast, errs := ParseClass(toks)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if len(ast.Warnings) != 1 || ast.Warnings[0].Type != "unknown_ref" {
+			t.Errorf("expected unknown_ref warning, got %v", ast.Warnings)
+		}
+	})
+}
+
+func TestParseClassVersion(t *testing.T) {
+	t.Run("version and migrations", func(t *testing.T) {
+		toks := []Token{
+			tok(TokenIdentifier, "Account", 1, 0),
+			tok(TokenKeyword, "subclass:", 1, 8),
+			tok(TokenIdentifier, "Object", 1, 18),
+			tok(TokenNewline, "\\n", 1, 24),
+			tok(TokenKeyword, "classVersion:", 2, 2),
+			tok(TokenNumber, "3", 2, 16),
+			tok(TokenNewline, "\\n", 2, 17),
+			tok(TokenKeyword, "migrateFrom:", 3, 2),
+			tok(TokenNumber, "1", 3, 15),
+			tok(TokenLBracket, "[", 3, 17),
+			tok(TokenIdentifier, "currency", 3, 19),
+			tok(TokenAssign, ":=", 3, 28),
+			tok(TokenString, "'USD'", 3, 31),
+			tok(TokenRBracket, "]", 3, 37),
+			tok(TokenNewline, "\\n", 3, 38),
+			tok(TokenKeyword, "migrateFrom:2", 4, 2),
+			tok(TokenLBracket, "[", 4, 16),
+			tok(TokenIdentifier, "balance", 4, 18),
+			tok(TokenRBracket, "]", 4, 26),
+			tok(TokenNewline, "\\n", 4, 27),
+		}
+
+		ast, errs := ParseClass(toks)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if ast.ClassVersion != 3 {
+			t.Errorf("expected classVersion 3, got %d", ast.ClassVersion)
+		}
+		if len(ast.Migrations) != 2 {
+			t.Fatalf("expected 2 migrations, got %d", len(ast.Migrations))
+		}
+		if ast.Migrations[0].FromVersion != 1 || len(ast.Migrations[0].Block.Tokens) != 3 {
+			t.Errorf("unexpected first migration: %+v", ast.Migrations[0])
+		}
+		if ast.Migrations[1].FromVersion != 2 || len(ast.Migrations[1].Block.Tokens) != 1 {
+			t.Errorf("unexpected second migration: %+v", ast.Migrations[1])
+		}
+	})
+
+	t.Run("missing version number", func(t *testing.T) {
+		toks := []Token{
+			tok(TokenIdentifier, "Account", 1, 0),
+			tok(TokenKeyword, "subclass:", 1, 8),
+			tok(TokenIdentifier, "Object", 1, 18),
+			tok(TokenNewline, "\\n", 1, 24),
+			tok(TokenKeyword, "classVersion:", 2, 2),
+			tok(TokenNewline, "\\n", 2, 15),
+		}
+
+		_, errs := ParseClass(toks)
+		if len(errs) == 0 {
+			t.Error("expected error for classVersion: without a number")
+		}
+	})
+}
+
 // =============================================================================
 // Trait Inclusion Tests
 // =============================================================================
@@ -1025,6 +1188,291 @@ func TestParseAlias(t *testing.T) {
 	})
 }
 
+// =============================================================================
+// Trait Resolution Tests
+// =============================================================================
+
+func TestParseResolution(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Person", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 7),
+		tok(TokenIdentifier, "Object", 1, 17),
+		tok(TokenNewline, "\\n", 1, 23),
+		tok(TokenKeyword, "resolve:", 2, 2),
+		tok(TokenIdentifier, "greet", 2, 11),
+		tok(TokenKeyword, "use:", 2, 17),
+		tok(TokenIdentifier, "Waver", 2, 22),
+		tok(TokenNewline, "\\n", 2, 27),
+		tok(TokenKeyword, "exclude:", 3, 2),
+		tok(TokenKeyword, "at:", 3, 11),
+		tok(TokenKeyword, "put:", 3, 14),
+		tok(TokenKeyword, "from:", 3, 19),
+		tok(TokenIdentifier, "Util", 3, 25),
+		tok(TokenNamespaceSep, "::", 3, 29),
+		tok(TokenIdentifier, "Dict", 3, 31),
+		tok(TokenNewline, "\\n", 3, 35),
+		tok(TokenKeyword, "resolve:", 4, 2),
+		tok(TokenIdentifier, "wave", 4, 11),
+		tok(TokenNewline, "\\n", 4, 15),
+	}
+
+	ast, errs := ParseClass(toks)
+	// resolve: wave without use: is an error
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	want := []ResolutionAST{
+		{Type: "resolve", Selector: "greet", Trait: "Waver", Location: Location{Line: 2, Col: 2}},
+		{Type: "exclude", Selector: "at_put_", Trait: "Util::Dict", Location: Location{Line: 3, Col: 2}},
+	}
+	if len(ast.Resolutions) != len(want) {
+		t.Fatalf("expected %d resolutions, got %+v", len(want), ast.Resolutions)
+	}
+	for i, w := range want {
+		if ast.Resolutions[i] != w {
+			t.Errorf("resolution %d = %+v, want %+v", i, ast.Resolutions[i], w)
+		}
+	}
+}
+
+func TestParseAbstract(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Shape", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 6),
+		tok(TokenIdentifier, "Object", 1, 16),
+		tok(TokenIdentifier, "abstract", 1, 23),
+		tok(TokenNewline, "\\n", 1, 31),
+		tok(TokenKeyword, "abstractMethod:", 2, 2),
+		tok(TokenIdentifier, "area", 2, 18),
+		tok(TokenNewline, "\\n", 2, 22),
+		tok(TokenKeyword, "abstractMethod:", 3, 2),
+		tok(TokenKeyword, "scaleBy:", 3, 18),
+		tok(TokenIdentifier, "factor", 3, 27),
+		tok(TokenKeyword, "around:", 3, 34),
+		tok(TokenIdentifier, "point", 3, 42),
+		tok(TokenNewline, "\\n", 3, 47),
+		tok(TokenKeyword, "abstractMethod:", 4, 2),
+		tok(TokenKeyword, "at:", 4, 18),
+		tok(TokenKeyword, "put:", 4, 21),
+		tok(TokenNewline, "\\n", 4, 25),
+		tok(TokenKeyword, "method:", 5, 2),
+		tok(TokenIdentifier, "describe", 5, 10),
+		tok(TokenLBracket, "[", 5, 19),
+		tok(TokenRBracket, "]", 5, 21),
+		tok(TokenNewline, "\\n", 5, 22),
+		tok(TokenKeyword, "abstractMethod:", 6, 2),
+		tok(TokenNewline, "\\n", 6, 17),
+	}
+
+	ast, errs := ParseClass(toks)
+	// abstractMethod: without a selector is an error
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	if !ast.IsAbstract {
+		t.Error("expected class to be abstract")
+	}
+	want := []string{"area", "scaleBy_around_", "at_put_"}
+	if len(ast.AbstractMethods) != len(want) {
+		t.Fatalf("expected abstract methods %v, got %v", want, ast.AbstractMethods)
+	}
+	for i, w := range want {
+		if ast.AbstractMethods[i] != w {
+			t.Errorf("abstract method %d = %q, want %q", i, ast.AbstractMethods[i], w)
+		}
+	}
+	if len(ast.Methods) != 1 || ast.Methods[0].Selector != "describe" {
+		t.Errorf("expected method describe, got %+v", ast.Methods)
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Contact", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 8),
+		tok(TokenIdentifier, "Object", 1, 18),
+		tok(TokenNewline, "\\n", 1, 24),
+		tok(TokenKeyword, "index:", 2, 2),
+		tok(TokenIdentifier, "email", 2, 9),
+		tok(TokenNewline, "\\n", 2, 14),
+		tok(TokenKeyword, "index:", 3, 2),
+		tok(TokenString, "'address.city'", 3, 9),
+		tok(TokenNewline, "\\n", 3, 23),
+		tok(TokenKeyword, "method:", 4, 2),
+		tok(TokenIdentifier, "describe", 4, 10),
+		tok(TokenLBracket, "[", 4, 19),
+		tok(TokenRBracket, "]", 4, 21),
+		tok(TokenNewline, "\\n", 4, 22),
+	}
+
+	ast, errs := ParseClass(toks)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	want := []string{"email", "address.city"}
+	if len(ast.Indexes) != len(want) || ast.Indexes[0] != want[0] || ast.Indexes[1] != want[1] {
+		t.Errorf("expected indexes %v, got %v", want, ast.Indexes)
+	}
+	if len(ast.Methods) != 1 || ast.Methods[0].Selector != "describe" {
+		t.Errorf("expected method describe, got %+v", ast.Methods)
+	}
+}
+
+func TestParseRename(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Account", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 8),
+		tok(TokenIdentifier, "Object", 1, 18),
+		tok(TokenNewline, "\\n", 1, 24),
+		tok(TokenKeyword, "migrate:", 2, 2),
+		tok(TokenIdentifier, "total", 2, 11),
+		tok(TokenKeyword, "to:", 2, 17),
+		tok(TokenIdentifier, "balance", 2, 21),
+		tok(TokenNewline, "\\n", 2, 28),
+		tok(TokenKeyword, "method:", 3, 2),
+		tok(TokenIdentifier, "describe", 3, 10),
+		tok(TokenLBracket, "[", 3, 19),
+		tok(TokenRBracket, "]", 3, 21),
+		tok(TokenNewline, "\\n", 3, 22),
+	}
+
+	ast, errs := ParseClass(toks)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(ast.Renames) != 1 || ast.Renames[0].From != "total" || ast.Renames[0].To != "balance" {
+		t.Errorf("expected rename total to balance, got %+v", ast.Renames)
+	}
+	if ast.Renames[0].Location.Line != 2 {
+		t.Errorf("expected rename on line 2, got %d", ast.Renames[0].Location.Line)
+	}
+	if len(ast.Methods) != 1 || ast.Methods[0].Selector != "describe" {
+		t.Errorf("expected method describe, got %+v", ast.Methods)
+	}
+}
+
+func TestParseClassPragma(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Inventory", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 10),
+		tok(TokenIdentifier, "Object", 1, 20),
+		tok(TokenNewline, "\\n", 1, 26),
+		tok(TokenKeyword, "pragma:", 2, 2),
+		tok(TokenIdentifier, "grpcNative", 2, 10),
+		tok(TokenNewline, "\\n", 2, 20),
+		tok(TokenKeyword, "rawMethod:", 3, 2),
+		tok(TokenIdentifier, "isHealthy", 3, 13),
+		tok(TokenLBracket, "[", 3, 23),
+		tok(TokenKeyword, "pragma:", 3, 25),
+		tok(TokenIdentifier, "procyonNative", 3, 33),
+		tok(TokenRBracket, "]", 3, 47),
+		tok(TokenNewline, "\\n", 3, 48),
+	}
+
+	ast, errs := ParseClass(toks)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(ast.Pragmas) != 1 || ast.Pragmas[0] != "grpcNative" {
+		t.Errorf("expected class pragma grpcNative, got %v", ast.Pragmas)
+	}
+	if len(ast.Methods) != 1 || len(ast.Methods[0].Pragmas) != 1 || ast.Methods[0].Pragmas[0] != "procyonNative" {
+		t.Errorf("expected method isHealthy with pragma procyonNative, got %+v", ast.Methods)
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Deployer", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 9),
+		tok(TokenIdentifier, "Object", 1, 19),
+		tok(TokenNewline, "\\n", 1, 25),
+		tok(TokenKeyword, "capabilities:", 2, 2),
+		tok(TokenIdentifier, "fileWrite", 2, 16),
+		tok(TokenIdentifier, "process", 2, 26),
+		tok(TokenNewline, "\\n", 2, 33),
+		tok(TokenKeyword, "capabilities:", 3, 2),
+		tok(TokenIdentifier, "network", 3, 16),
+		tok(TokenNewline, "\\n", 3, 23),
+		tok(TokenKeyword, "method:", 4, 2),
+		tok(TokenIdentifier, "run", 4, 10),
+		tok(TokenLBracket, "[", 4, 14),
+		tok(TokenRBracket, "]", 4, 15),
+		tok(TokenNewline, "\\n", 4, 16),
+	}
+
+	ast, errs := ParseClass(toks)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if fmt.Sprint(ast.Capabilities) != "[fileWrite process network]" {
+		t.Errorf("expected capabilities fileWrite process network, got %v", ast.Capabilities)
+	}
+	if len(ast.Methods) != 1 || ast.Methods[0].Selector != "run" {
+		t.Errorf("expected method run after the declarations, got %+v", ast.Methods)
+	}
+}
+
+func TestParseArgTypes(t *testing.T) {
+	toks := []Token{
+		tok(TokenIdentifier, "Account", 1, 0),
+		tok(TokenKeyword, "subclass:", 1, 8),
+		tok(TokenIdentifier, "Object", 1, 18),
+		tok(TokenNewline, "\\n", 1, 24),
+		tok(TokenKeyword, "method:", 2, 2),
+		tok(TokenKeyword, "deposit:", 2, 10),
+		tok(TokenIdentifier, "amount", 2, 19),
+		tok(TokenKeyword, "flag:", 2, 26),
+		tok(TokenIdentifier, "flag", 2, 32),
+		tok(TokenLBracket, "[", 2, 37),
+		tok(TokenNewline, "\\n", 2, 38),
+		tok(TokenKeyword, "argTypes:", 3, 4),
+		tok(TokenKeyword, "amount:", 3, 14),
+		tok(TokenIdentifier, "int", 3, 21),
+		tok(TokenKeyword, "flag:", 3, 25),
+		tok(TokenIdentifier, "bool", 3, 30),
+		tok(TokenKeyword, "size:", 3, 35),
+		tok(TokenIdentifier, "int", 3, 40),
+		tok(TokenNewline, "\\n", 3, 43),
+		tok(TokenCaret, "^", 4, 4),
+		tok(TokenIdentifier, "amount", 4, 6),
+		tok(TokenRBracket, "]", 5, 2),
+		tok(TokenNewline, "\\n", 5, 3),
+		tok(TokenKeyword, "method:", 6, 2),
+		tok(TokenKeyword, "scale:", 6, 10),
+		tok(TokenIdentifier, "factor", 6, 17),
+		tok(TokenLBracket, "[", 6, 24),
+		tok(TokenKeyword, "argTypes:", 6, 26),
+		tok(TokenKeyword, "factor:", 6, 36),
+		tok(TokenIdentifier, "decimal", 6, 43),
+		tok(TokenRBracket, "]", 6, 51),
+		tok(TokenNewline, "\\n", 6, 52),
+	}
+
+	ast, errs := ParseClass(toks)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(ast.Methods) != 2 {
+		t.Fatalf("expected 2 methods, got %d", len(ast.Methods))
+	}
+	deposit, scale := ast.Methods[0], ast.Methods[1]
+	if fmt.Sprint(deposit.ArgTypes) != "map[amount:int flag:bool]" {
+		t.Errorf("expected amount:int flag:bool, got %v", deposit.ArgTypes)
+	}
+	// The declaration is not part of the body
+	if len(deposit.Body.Tokens) != 2 || deposit.Body.Tokens[0].Type != TokenCaret {
+		t.Errorf("expected body ^ amount, got %v", deposit.Body.Tokens)
+	}
+	// Unknown types and names that are not arguments are ignored with a warning
+	if scale.ArgTypes != nil {
+		t.Errorf("expected no argTypes for scale:, got %v", scale.ArgTypes)
+	}
+	if len(ast.Warnings) != 2 || ast.Warnings[0].Type != "unknown_arg" || ast.Warnings[1].Type != "unknown_type" {
+		t.Errorf("expected unknown_arg and unknown_type warnings, got %v", ast.Warnings)
+	}
+}
+
 // =============================================================================
 // Advice Tests
 // =============================================================================
@@ -1727,7 +2175,7 @@ func TestParserState(t *testing.T) {
 		syncKeywords := []string{
 			"method:", "rawMethod:", "classMethod:", "rawClassMethod:",
 			"instanceVars:", "classInstanceVars:", "include:", "requires:",
-			"category:", "alias:", "before:", "after:",
+			"category:", "alias:", "before:", "after:", "resolve:", "exclude:",
 		}
 
 		for _, kw := range syncKeywords {
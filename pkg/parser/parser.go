@@ -3,6 +3,8 @@ package parser
 
 import (
 	"fmt"
+	"strings"
+	"unicode"
 
 	"github.com/chazu/procyon/pkg/ast"
 )
@@ -106,7 +108,51 @@ type ComparisonExpr struct {
 
 func (ComparisonExpr) exprNode() {}
 
+// LogicalExpr represents: left and: [right], left or: [right], left && right, left || right
+type LogicalExpr struct {
+	Left  Expr
+	Op    string // "&&" or "||"
+	Right Expr
+}
+
+func (LogicalExpr) exprNode() {}
+
+// BetweenExpr represents: value between: low and: high (inclusive)
+type BetweenExpr struct {
+	Value Expr
+	Low   Expr
+	High  Expr
+}
+
+func (BetweenExpr) exprNode() {}
+
+// MinMaxExpr represents: left min: right, left max: right
+type MinMaxExpr struct {
+	Left  Expr
+	Op    string // "min" or "max"
+	Right Expr
+}
+
+func (MinMaxExpr) exprNode() {}
+
+// NegateExpr represents: -operand, for an operand that is not a number
+// literal. -5 stays a NumberLit.
+type NegateExpr struct {
+	Operand Expr
+}
+
+func (NegateExpr) exprNode() {}
+
+// NotExpr represents: expr not
+type NotExpr struct {
+	Operand Expr
+}
+
+func (NotExpr) exprNode() {}
+
 // IfExpr represents: (condition) ifTrue: [trueBlock] ifFalse: [falseBlock]
+// As an expression, its value is the last expression of the branch taken,
+// or nil if that branch is missing or does not end in an expression.
 type IfExpr struct {
 	Condition  Expr
 	TrueBlock  []Statement
@@ -125,6 +171,47 @@ type WhileExpr struct {
 func (WhileExpr) exprNode() {}
 func (WhileExpr) stmtNode() {}
 
+// CountedLoopExpr represents: from to: to do: [:i | body] or count timesRepeat: [body]
+// The loop runs for each integer from From to To inclusive; timesRepeat: counts
+// from 1 and has no IndexVar.
+type CountedLoopExpr struct {
+	From     Expr
+	To       Expr
+	IndexVar string // "" for timesRepeat:
+	Body     []Statement
+}
+
+func (CountedLoopExpr) exprNode() {}
+func (CountedLoopExpr) stmtNode() {}
+
+// ThrowExpr represents: _throw ErrorClass "message" or _throw "message"
+// Class is "Error" when no class is given.
+type ThrowExpr struct {
+	Class   string
+	Message Expr // nil when only a class is given
+}
+
+func (ThrowExpr) stmtNode() {}
+
+// OnDoExpr represents: [body] on: ErrorClass do: [:e | handler]
+// ErrVar is "" when the handler takes no parameter.
+type OnDoExpr struct {
+	Body       []Statement
+	ErrorClass string
+	ErrVar     string
+	Handler    []Statement
+}
+
+func (OnDoExpr) stmtNode() {}
+
+// EnsureExpr represents: [body] ensure: [cleanup]
+type EnsureExpr struct {
+	Body    []Statement
+	Cleanup []Statement
+}
+
+func (EnsureExpr) stmtNode() {}
+
 // IfNilExpr represents: value ifNil: [nilBlock] ifNotNil: [:v | notNilBlock]
 type IfNilExpr struct {
 	Subject     Expr        // The value being tested for nil
@@ -150,7 +237,10 @@ type IterationExpr struct {
 	Collection Expr        // The collection to iterate over (e.g., "items")
 	IterVar    string      // The iteration variable name (e.g., "item")
 	Body       []Statement // The loop body
-	Kind       string      // "do", "collect", "select", etc.
+	Kind       string      // "do", "collect", "select", "inject", etc.
+	AccVar     string      // inject: only - the accumulator parameter
+	Initial    Expr        // inject: only - the initial accumulator value
+	IfNone     []Statement // detect: only - the ifNone: block, if any
 }
 
 func (IterationExpr) exprNode() {}
@@ -160,9 +250,11 @@ func (IterationExpr) stmtNode() {}
 // When the block is a variable/parameter, not a literal
 // This requires shell-out to invoke the block at runtime
 type DynamicIterationExpr struct {
-	Collection Expr   // The collection to iterate over
-	BlockVar   Expr   // The block variable (identifier or expression)
-	Kind       string // "do", "collect", "select", etc.
+	Collection Expr        // The collection to iterate over
+	BlockVar   Expr        // The block variable (identifier or expression)
+	Kind       string      // "do", "collect", "select", "inject", etc.
+	Initial    Expr        // inject: only - the initial accumulator value
+	IfNone     []Statement // detect: only - the ifNone: block, if any
 }
 
 func (DynamicIterationExpr) exprNode() {}
@@ -200,10 +292,15 @@ func (JSONPrimitiveExpr) exprNode() {}
 // ClassPrimitiveExpr represents primitive class method calls like:
 // @ String isEmpty: str
 // @ File exists: path
+// @ HttpClient get: url
+// @ Locale formatNumber: n
+// @ Shell run: 'ls'
+// @ Env get: 'HOME', $HOME
+// @ Os platform
 // These are optimized to native code instead of message sends
 type ClassPrimitiveExpr struct {
-	ClassName string // "String" or "File"
-	Operation string // "stringIsEmpty", "fileExists", etc.
+	ClassName string // "String", "File", "HttpClient", "Locale", "Shell", "Env" or "Os"
+	Operation string // "stringIsEmpty", "fileExists", "httpGet", etc.
 	Args      []Expr // Arguments for the operation
 }
 
@@ -231,6 +328,10 @@ type ParseResult struct {
 	Body        *MethodBody
 	Unsupported bool
 	Reason      string
+	// Line and Col locate the token the parse stopped at when Unsupported
+	// (0 if the tokens carry no positions)
+	Line int
+	Col  int
 }
 
 // Parser converts token streams to expression trees
@@ -241,10 +342,31 @@ type Parser struct {
 
 // ParseMethod parses a method body from tokens
 func ParseMethod(tokens []ast.Token) *ParseResult {
-	p := &Parser{tokens: tokens, pos: 0}
+	p := &Parser{tokens: joinContinuedLines(tokens), pos: 0}
 	return p.parseBody()
 }
 
+// joinContinuedLines removes the line breaks that continue a statement: a
+// backslash ending a line, and the newlines after a keyword, whose argument
+// is on the next line. Long keyword messages can then be wrapped.
+func joinContinuedLines(tokens []ast.Token) []ast.Token {
+	joined := make([]ast.Token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.Type == ast.TokenBackslash && i+1 < len(tokens) && tokens[i+1].Type == ast.TokenNewline {
+			i++
+			continue
+		}
+		joined = append(joined, tok)
+		if tok.Type == ast.TokenKeyword {
+			for i+1 < len(tokens) && tokens[i+1].Type == ast.TokenNewline {
+				i++
+			}
+		}
+	}
+	return joined
+}
+
 func (p *Parser) parseBody() *ParseResult {
 	body := &MethodBody{
 		LocalVars:  []string{},
@@ -258,7 +380,7 @@ func (p *Parser) parseBody() *ParseResult {
 	if p.peek().Type == ast.TokenPipe {
 		vars, err := p.parseLocalVars()
 		if err != nil {
-			return &ParseResult{Unsupported: true, Reason: err.Error()}
+			return p.unsupported(err)
 		}
 		body.LocalVars = vars
 	}
@@ -272,7 +394,7 @@ func (p *Parser) parseBody() *ParseResult {
 
 		stmt, err := p.parseStatement()
 		if err != nil {
-			return &ParseResult{Unsupported: true, Reason: err.Error()}
+			return p.unsupported(err)
 		}
 		if stmt != nil {
 			body.Statements = append(body.Statements, stmt)
@@ -282,6 +404,20 @@ func (p *Parser) parseBody() *ParseResult {
 	return &ParseResult{Body: body}
 }
 
+// unsupported returns the result for a body that failed to parse with err,
+// located at the current token, or the last one if the parse ran off the end
+func (p *Parser) unsupported(err error) *ParseResult {
+	result := &ParseResult{Unsupported: true, Reason: err.Error()}
+	if len(p.tokens) > 0 {
+		tok := p.tokens[len(p.tokens)-1]
+		if !p.atEnd() {
+			tok = p.peek()
+		}
+		result.Line, result.Col = tok.Line, tok.Col
+	}
+	return result
+}
+
 func (p *Parser) parseLocalVars() ([]string, error) {
 	// Consume opening |
 	p.advance() // skip |
@@ -317,10 +453,14 @@ func (p *Parser) parseStatement() (Statement, error) {
 	// Return statement: ^ expr (which may include iteration like ^ items collect: block)
 	if tok.Type == ast.TokenCaret {
 		p.advance()
-		expr, err := p.parseExpr()
+		expr, err := p.parseValue()
 		if err != nil {
 			return nil, err
 		}
+		if ifx, ok := expr.(*IfExpr); ok {
+			// ^ cond ifTrue: [a] ifFalse: [b] returns from each branch
+			return valueIf(ifx, func(v Expr) Statement { return &Return{Value: v} }), nil
+		}
 
 		// Check for iteration keywords (^ items collect: block) or (^ items select: block)
 		if p.peek().Type == ast.TokenKeyword {
@@ -360,12 +500,51 @@ func (p *Parser) parseStatement() (Statement, error) {
 				if dyn, ok := stmt.(*DynamicIterationExpr); ok {
 					return &Return{Value: &DynamicIterationExprAsValue{Iteration: dyn}}, nil
 				}
+			case "inject:":
+				stmt, err := p.parseInjectIteration(expr)
+				if err != nil {
+					return nil, err
+				}
+				if iter, ok := stmt.(*IterationExpr); ok {
+					return &Return{Value: &IterationExprAsValue{Iteration: iter}}, nil
+				}
+				if dyn, ok := stmt.(*DynamicIterationExpr); ok {
+					return &Return{Value: &DynamicIterationExprAsValue{Iteration: dyn}}, nil
+				}
+			case "detect:", "reject:", "anySatisfy:", "allSatisfy:":
+				stmt, err := p.parsePredicateIteration(expr)
+				if err != nil {
+					return nil, err
+				}
+				if iter, ok := stmt.(*IterationExpr); ok {
+					return &Return{Value: &IterationExprAsValue{Iteration: iter}}, nil
+				}
+				if dyn, ok := stmt.(*DynamicIterationExpr); ok {
+					return &Return{Value: &DynamicIterationExprAsValue{Iteration: dyn}}, nil
+				}
 			}
 		}
 
 		return &Return{Value: expr}, nil
 	}
 
+	// _throw ErrorClass "message"
+	if tok.Type == ast.TokenIdentifier && tok.Value == "_throw" {
+		return p.parseThrow()
+	}
+
+	// value increment / value decrement: sugar for value := value + 1
+	if tok.Type == ast.TokenIdentifier && endsStatement(p.peekAhead(2)) {
+		if op, ok := incrementOps[p.peekAhead(1).Value]; ok && p.peekAhead(1).Type == ast.TokenIdentifier {
+			p.advance() // consume identifier
+			p.advance() // consume increment/decrement
+			return &Assignment{
+				Target: tok.Value,
+				Value:  &BinaryExpr{Left: &Identifier{Name: tok.Value}, Op: op, Right: &NumberLit{Value: "1"}},
+			}, nil
+		}
+	}
+
 	// Check for assignment: identifier := expr
 	if tok.Type == ast.TokenIdentifier {
 		// Look ahead for :=
@@ -373,10 +552,31 @@ func (p *Parser) parseStatement() (Statement, error) {
 			name := tok.Value
 			p.advance() // skip identifier
 			p.advance() // skip :=
-			expr, err := p.parseExpr()
+			expr, err := p.parseValue()
 			if err != nil {
 				return nil, err
 			}
+			if ifx, ok := expr.(*IfExpr); ok {
+				// x := cond ifTrue: [a] ifFalse: [b] assigns in each branch
+				return valueIf(ifx, func(v Expr) Statement { return &Assignment{Target: name, Value: v} }), nil
+			}
+			if p.peek().Type == ast.TokenKeyword && valueIterationKeywords[p.peek().Value] {
+				// total := items inject: 0 into: [:sum :x | sum + x]
+				// found := items detect: [:x | x > 3] ifNone: [0]
+				var stmt Statement
+				if p.peek().Value == "inject:" {
+					stmt, err = p.parseInjectIteration(expr)
+				} else {
+					stmt, err = p.parsePredicateIteration(expr)
+				}
+				if err != nil {
+					return nil, err
+				}
+				if iter, ok := stmt.(*IterationExpr); ok {
+					return &Assignment{Target: name, Value: &IterationExprAsValue{Iteration: iter}}, nil
+				}
+				return &Assignment{Target: name, Value: &DynamicIterationExprAsValue{Iteration: stmt.(*DynamicIterationExpr)}}, nil
+			}
 			return &Assignment{Target: name, Value: expr}, nil
 		}
 	}
@@ -397,6 +597,10 @@ func (p *Parser) parseStatement() (Statement, error) {
 			return p.parseIfFalse(expr)
 		case "whileTrue:":
 			return p.parseWhileTrue(expr)
+		case "timesRepeat:":
+			return p.parseTimesRepeat(expr)
+		case "to:":
+			return p.parseToDo(expr)
 		case "ifNil:":
 			return p.parseIfNil(expr)
 		case "ifNotNil:":
@@ -407,6 +611,14 @@ func (p *Parser) parseStatement() (Statement, error) {
 			return p.parseCollectIteration(expr)
 		case "select:":
 			return p.parseSelectIteration(expr)
+		case "inject:":
+			return p.parseInjectIteration(expr)
+		case "detect:", "reject:", "anySatisfy:", "allSatisfy:":
+			return p.parsePredicateIteration(expr)
+		case "on:":
+			return p.parseOnDo(expr)
+		case "ensure:":
+			return p.parseEnsure(expr)
 		}
 	}
 
@@ -458,6 +670,101 @@ func (p *Parser) parseIfFalse(condition Expr) (Statement, error) {
 	}, nil
 }
 
+// parseValue parses an expression that may be a conditional used as a
+// value: cond ifTrue: [a] ifFalse: [b]
+func (p *Parser) parseValue() (Expr, error) {
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().Type != ast.TokenKeyword {
+		return expr, nil
+	}
+	var stmt Statement
+	switch p.peek().Value {
+	case "ifTrue:":
+		stmt, err = p.parseIfTrue(expr)
+	case "ifFalse:":
+		stmt, err = p.parseIfFalse(expr)
+	default:
+		return expr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stmt.(*IfExpr), nil
+}
+
+// valueIf rewrites a conditional used as a value into a conditional
+// statement that passes the value of each branch to use. Conditionals at the
+// end of a branch are rewritten too, so else-if chains stay chains.
+func valueIf(ifx *IfExpr, use func(Expr) Statement) *IfExpr {
+	return &IfExpr{
+		Condition:  ifx.Condition,
+		TrueBlock:  valueBranch(ifx.TrueBlock, use),
+		FalseBlock: valueBranch(ifx.FalseBlock, use),
+	}
+}
+
+// valueBranch applies use to the value of a branch, nil ('') if the branch
+// does not end in an expression
+func valueBranch(stmts []Statement, use func(Expr) Statement) []Statement {
+	out := append([]Statement{}, stmts...)
+	if n := len(out); n > 0 {
+		switch last := out[n-1].(type) {
+		case *ExprStmt:
+			out[n-1] = use(last.Expr)
+			return out
+		case *IfExpr:
+			out[n-1] = valueIf(last, use)
+			return out
+		case *Return:
+			return out
+		}
+	}
+	return append(out, use(&StringLit{Value: ""}))
+}
+
+// returnsFrom reports whether either branch of a conditional contains a ^,
+// which cannot return from the method once the conditional is an expression
+func returnsFrom(ifx *IfExpr) bool {
+	return containsReturn(ifx.TrueBlock) || containsReturn(ifx.FalseBlock)
+}
+
+func containsReturn(stmts []Statement) bool {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *Return:
+			return true
+		case *IfExpr:
+			if returnsFrom(s) {
+				return true
+			}
+		case *WhileExpr:
+			if containsReturn(s.Body) {
+				return true
+			}
+		case *CountedLoopExpr:
+			if containsReturn(s.Body) {
+				return true
+			}
+		case *IfNilExpr:
+			if containsReturn(s.NilBlock) || containsReturn(s.NotNilBlock) {
+				return true
+			}
+		case *OnDoExpr:
+			if containsReturn(s.Body) || containsReturn(s.Handler) {
+				return true
+			}
+		case *EnsureExpr:
+			if containsReturn(s.Body) || containsReturn(s.Cleanup) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // parseWhileTrue parses: [condition] whileTrue: [body]
 func (p *Parser) parseWhileTrue(condition Expr) (Statement, error) {
 	p.advance() // consume "whileTrue:"
@@ -473,6 +780,168 @@ func (p *Parser) parseWhileTrue(condition Expr) (Statement, error) {
 	}, nil
 }
 
+// parseTimesRepeat parses: count timesRepeat: [body]
+func (p *Parser) parseTimesRepeat(count Expr) (Statement, error) {
+	p.advance() // consume "timesRepeat:"
+
+	body, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CountedLoopExpr{
+		From: &NumberLit{Value: "1"},
+		To:   count,
+		Body: body,
+	}, nil
+}
+
+// parseToDo parses: from to: to do: [:i | body]
+func (p *Parser) parseToDo(from Expr) (Statement, error) {
+	p.advance() // consume "to:"
+
+	to, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipNewlines()
+	if p.peek().Type != ast.TokenKeyword || p.peek().Value != "do:" {
+		return nil, fmt.Errorf("to: must be followed by do:, got %s", p.peek().Value)
+	}
+	p.advance() // consume "do:"
+
+	block, err := p.parseBlockExpr()
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Params) != 1 {
+		return nil, fmt.Errorf("to:do: block must have exactly one parameter, got %d", len(block.Params))
+	}
+
+	return &CountedLoopExpr{
+		From:     from,
+		To:       to,
+		IndexVar: block.Params[0],
+		Body:     block.Statements,
+	}, nil
+}
+
+// parseThrow parses: _throw [ErrorClass] [message]
+// A capitalized identifier right after _throw names the error class; the
+// message is any expression, e.g. _throw NotFound 'no key ', key.
+func (p *Parser) parseThrow() (Statement, error) {
+	p.advance() // consume "_throw"
+
+	throw := &ThrowExpr{Class: "Error"}
+	hasClass := false
+	if tok := p.peek(); tok.Type == ast.TokenIdentifier && tok.Value != "" && unicode.IsUpper(rune(tok.Value[0])) {
+		throw.Class = tok.Value
+		hasClass = true
+		p.advance()
+	}
+	if endsStatement(p.peek()) {
+		if !hasClass {
+			return nil, fmt.Errorf("_throw needs an error class or a message")
+		}
+		return throw, nil
+	}
+
+	message, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	throw.Message = message
+	return throw, nil
+}
+
+// incrementOps maps the increment sugar messages to their operator
+var incrementOps = map[string]string{
+	"increment": "+",
+	"decrement": "-",
+}
+
+// endsStatement reports whether tok ends the current statement
+func endsStatement(tok ast.Token) bool {
+	switch tok.Type {
+	case ast.TokenNewline, ast.TokenDot, ast.TokenRBracket, "EOF":
+		return true
+	}
+	return false
+}
+
+// protectedBlock returns the statements of the block receiving on:do: or
+// ensure:. The block runs in a Go closure, so it cannot return from the method.
+func protectedBlock(receiver Expr, keyword string) ([]Statement, error) {
+	block, ok := receiver.(*BlockExpr)
+	if !ok || len(block.Params) > 0 {
+		return nil, fmt.Errorf("%s must be sent to a block without parameters", keyword)
+	}
+	if containsReturn(block.Statements) {
+		return nil, fmt.Errorf("^ inside a block sent %s not supported", keyword)
+	}
+	return block.Statements, nil
+}
+
+// parseOnDo parses: [body] on: ErrorClass do: [:e | handler]
+func (p *Parser) parseOnDo(receiver Expr) (Statement, error) {
+	body, err := protectedBlock(receiver, "on:do:")
+	if err != nil {
+		return nil, err
+	}
+	p.advance() // consume "on:"
+
+	if p.peek().Type != ast.TokenIdentifier {
+		return nil, fmt.Errorf("on: expects an error class name, got %s", p.peek().Type)
+	}
+	errorClass := p.advance().Value
+
+	p.skipNewlines()
+	if p.peek().Type != ast.TokenKeyword || p.peek().Value != "do:" {
+		return nil, fmt.Errorf("on: must be followed by do:, got %s", p.peek().Value)
+	}
+	p.advance() // consume "do:"
+
+	handler, err := p.parseBlockExpr()
+	if err != nil {
+		return nil, err
+	}
+	if len(handler.Params) > 1 {
+		return nil, fmt.Errorf("on:do: handler takes at most one parameter, got %d", len(handler.Params))
+	}
+	if containsReturn(handler.Statements) {
+		return nil, fmt.Errorf("^ inside an on:do: handler not supported")
+	}
+
+	onDo := &OnDoExpr{
+		Body:       body,
+		ErrorClass: errorClass,
+		Handler:    handler.Statements,
+	}
+	if len(handler.Params) == 1 {
+		onDo.ErrVar = handler.Params[0]
+	}
+	return onDo, nil
+}
+
+// parseEnsure parses: [body] ensure: [cleanup]
+func (p *Parser) parseEnsure(receiver Expr) (Statement, error) {
+	body, err := protectedBlock(receiver, "ensure:")
+	if err != nil {
+		return nil, err
+	}
+	p.advance() // consume "ensure:"
+
+	cleanup, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	if containsReturn(cleanup) {
+		return nil, fmt.Errorf("^ inside an ensure: block not supported")
+	}
+	return &EnsureExpr{Body: body, Cleanup: cleanup}, nil
+}
+
 // parseIfNil parses: value ifNil: [block] [ifNotNil: [:v | block]]
 func (p *Parser) parseIfNil(subject Expr) (Statement, error) {
 	p.advance() // consume "ifNil:"
@@ -663,6 +1132,128 @@ func (p *Parser) parseSelectIteration(collection Expr) (Statement, error) {
 	}, nil
 }
 
+// parseInjectIteration parses: collection inject: initial into: [:acc :item | expr]
+// or collection inject: initial into: blockVar
+func (p *Parser) parseInjectIteration(collection Expr) (Statement, error) {
+	p.advance() // consume "inject:"
+
+	initial, err := p.parseMessageArg()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipNewlines()
+	if p.peek().Type != ast.TokenKeyword || p.peek().Value != "into:" {
+		return nil, fmt.Errorf("inject: must be followed by into:, got %s", p.peek().Value)
+	}
+	p.advance() // consume "into:"
+
+	// Check if we have a block literal or a variable
+	if p.peek().Type == ast.TokenLBracket {
+		// Block literal - inline the fold
+		block, err := p.parseBlockExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(block.Params) != 2 {
+			return nil, fmt.Errorf("inject:into: block must have exactly two parameters, got %d", len(block.Params))
+		}
+
+		return &IterationExpr{
+			Collection: collection,
+			AccVar:     block.Params[0],
+			IterVar:    block.Params[1],
+			Initial:    initial,
+			Body:       block.Statements,
+			Kind:       "inject",
+		}, nil
+	}
+
+	// Block variable - dynamic iteration (Phase 2)
+	blockVar, err := p.parseMessageArg()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DynamicIterationExpr{
+		Collection: collection,
+		BlockVar:   blockVar,
+		Initial:    initial,
+		Kind:       "inject",
+	}, nil
+}
+
+// valueIterationKeywords are the iterations that may be assigned to a variable
+var valueIterationKeywords = map[string]bool{
+	"inject:": true, "detect:": true, "reject:": true, "anySatisfy:": true, "allSatisfy:": true,
+}
+
+// parsePredicateIteration parses: collection detect: [:item | condition]
+// [ifNone: [block]], and likewise reject:, anySatisfy: and allSatisfy:.
+// The block may also be a variable.
+func (p *Parser) parsePredicateIteration(collection Expr) (Statement, error) {
+	keyword := p.advance().Value // consume "detect:", "reject:", ...
+	kind := strings.TrimSuffix(keyword, ":")
+
+	var stmt Statement
+	if p.peek().Type == ast.TokenLBracket {
+		// Block literal - inline the iteration
+		block, err := p.parseBlockExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(block.Params) != 1 {
+			return nil, fmt.Errorf("%s block must have exactly one parameter, got %d", keyword, len(block.Params))
+		}
+
+		stmt = &IterationExpr{
+			Collection: collection,
+			IterVar:    block.Params[0],
+			Body:       block.Statements,
+			Kind:       kind,
+		}
+	} else {
+		// Block variable - dynamic iteration (Phase 2)
+		blockVar, err := p.parseMessageArg()
+		if err != nil {
+			return nil, err
+		}
+
+		stmt = &DynamicIterationExpr{
+			Collection: collection,
+			BlockVar:   blockVar,
+			Kind:       kind,
+		}
+	}
+
+	// Check for optional ifNone:
+	if kind == "detect" {
+		p.skipNewlines()
+	}
+	if kind != "detect" || p.peek().Type != ast.TokenKeyword || p.peek().Value != "ifNone:" {
+		return stmt, nil
+	}
+	p.advance() // consume "ifNone:"
+
+	ifNone, err := p.parseBlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(ifNone) == 0 {
+		// An empty ifNone: block still answers nil
+		ifNone = []Statement{&ExprStmt{Expr: &StringLit{Value: ""}}}
+	}
+	switch s := stmt.(type) {
+	case *IterationExpr:
+		s.IfNone = ifNone
+	case *DynamicIterationExpr:
+		s.IfNone = ifNone
+	}
+	return stmt, nil
+}
+
 // parseBlock parses: [statements] (for control flow)
 func (p *Parser) parseBlock() ([]Statement, error) {
 	if p.peek().Type != ast.TokenLBracket {
@@ -749,7 +1340,98 @@ func (p *Parser) parseBlockExpr() (*BlockExpr, error) {
 }
 
 func (p *Parser) parseExpr() (Expr, error) {
-	return p.parseComparison()
+	return p.parseLogical()
+}
+
+// parseLogical handles and:/or: (lowest precedence, like keyword messages)
+// and the && / || operators. The right operand may be a block, as in
+// (x > 0) and: [y > 0]; it is evaluated only when needed.
+func (p *Parser) parseLogical() (Expr, error) {
+	left, err := p.parseComparisonMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	for !p.atEnd() {
+		tok := p.peek()
+		var op string
+		switch {
+		case tok.Type == ast.TokenAnd, tok.Type == ast.TokenKeyword && tok.Value == "and:":
+			op = "&&"
+		case tok.Type == ast.TokenOr, tok.Type == ast.TokenKeyword && tok.Value == "or:":
+			op = "||"
+		default:
+			return left, nil
+		}
+
+		p.advance()
+		var right Expr
+		if p.peek().Type == ast.TokenLBracket {
+			right, err = p.parseConditionBlock(tok.Value)
+		} else {
+			right, err = p.parseComparisonMessage()
+		}
+		if err != nil {
+			return nil, err
+		}
+		left = &LogicalExpr{Left: left, Op: op, Right: right}
+	}
+
+	return left, nil
+}
+
+// parseComparisonMessage handles between:and:, min: and max:, keyword
+// messages sent to a plain value rather than with @. Their arguments are
+// comparisons, so x between: a + 1 and: b is x between: (a + 1) and: b.
+func (p *Parser) parseComparisonMessage() (Expr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	if tok.Type != ast.TokenKeyword {
+		return left, nil
+	}
+	switch tok.Value {
+	case "between:":
+		p.advance()
+		low, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().Type != ast.TokenKeyword || p.peek().Value != "and:" {
+			return nil, fmt.Errorf("between: must be followed by and:, got %s", p.peek().Value)
+		}
+		p.advance() // consume "and:"
+		high, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		return &BetweenExpr{Value: left, Low: low, High: high}, nil
+	case "min:", "max:":
+		p.advance()
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		return &MinMaxExpr{Left: left, Op: strings.TrimSuffix(tok.Value, ":"), Right: right}, nil
+	}
+	return left, nil
+}
+
+// parseConditionBlock parses the [expr] operand of and:/or:
+func (p *Parser) parseConditionBlock(keyword string) (Expr, error) {
+	block, err := p.parseBlockExpr()
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Params) == 0 && len(block.Statements) == 1 {
+		if stmt, ok := block.Statements[0].(*ExprStmt); ok {
+			return stmt.Expr, nil
+		}
+	}
+	return nil, fmt.Errorf("%s block must be a single expression", keyword)
 }
 
 func (p *Parser) parseComparison() (Expr, error) {
@@ -830,6 +1512,15 @@ func (p *Parser) parseAddSub() (Expr, error) {
 				return nil, err
 			}
 			left = &BinaryExpr{Left: left, Op: op, Right: right}
+		} else if isNegativeNumber(tok) {
+			// The lexer reads x -5 and x-5 as x followed by the number -5,
+			// as jq-compiler does. After an operand it is a subtraction.
+			p.advance()
+			right, err := p.parseMulDivFrom(&NumberLit{Value: tok.Value[1:]})
+			if err != nil {
+				return nil, err
+			}
+			left = &BinaryExpr{Left: left, Op: "-", Right: right}
 		} else {
 			break
 		}
@@ -838,29 +1529,27 @@ func (p *Parser) parseAddSub() (Expr, error) {
 	return left, nil
 }
 
-func (p *Parser) parseMulDiv() (Expr, error) {
-	left, err := p.parsePrimary()
-	if err != nil {
-		return nil, err
-	}
+// isNegativeNumber reports whether tok is a number literal with a leading minus
+func isNegativeNumber(tok ast.Token) bool {
+	return tok.Type == ast.TokenNumber && len(tok.Value) > 1 && tok.Value[0] == '-'
+}
 
-	// Check for JSON primitives after primary expression
-	left, err = p.parseJSONPrimitive(left)
+func (p *Parser) parseMulDiv() (Expr, error) {
+	left, err := p.parseUnary()
 	if err != nil {
 		return nil, err
 	}
+	return p.parseMulDivFrom(left)
+}
 
+// parseMulDivFrom parses the * and / operations following left
+func (p *Parser) parseMulDivFrom(left Expr) (Expr, error) {
 	for !p.atEnd() {
 		tok := p.peek()
 		if tok.Type == ast.TokenStar || tok.Type == ast.TokenSlash {
 			op := tok.Value
 			p.advance()
-			right, err := p.parsePrimary()
-			if err != nil {
-				return nil, err
-			}
-			// Check for JSON primitives on right operand too
-			right, err = p.parseJSONPrimitive(right)
+			right, err := p.parseUnary()
 			if err != nil {
 				return nil, err
 			}
@@ -873,10 +1562,43 @@ func (p *Parser) parseMulDiv() (Expr, error) {
 	return left, nil
 }
 
+// parseUnary parses a primary expression with its JSON primitives, after an
+// optional unary minus: -x, -(a + b), -items arrayLength
+func (p *Parser) parseUnary() (Expr, error) {
+	if p.peek().Type == ast.TokenMinus {
+		p.advance() // consume -
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negate(operand), nil
+	}
+
+	primary, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for JSON primitives after primary expression
+	return p.parseJSONPrimitive(primary)
+}
+
+// negate returns -operand, folding the sign into a number literal
+func negate(operand Expr) Expr {
+	if lit, ok := operand.(*NumberLit); ok {
+		if strings.HasPrefix(lit.Value, "-") {
+			return &NumberLit{Value: lit.Value[1:]}
+		}
+		return &NumberLit{Value: "-" + lit.Value}
+	}
+	return &NegateExpr{Operand: operand}
+}
+
 // isJSONPrimitiveUnary checks if the identifier is a unary JSON primitive
 func isJSONPrimitiveUnary(name string) bool {
 	switch name {
 	case "arrayLength", "arrayFirst", "arrayLast", "arrayIsEmpty",
+		"arraySort", "arraySortNumeric", "arrayReverse", "arrayUnique",
 		"objectKeys", "objectValues", "objectLength", "objectIsEmpty":
 		return true
 	}
@@ -905,12 +1627,24 @@ func isJSONPrimitiveKeyword(keyword string) (string, int, bool) {
 		return "arrayAt", 1, true
 	case "arrayRemoveAt:":
 		return "arrayRemoveAt", 1, true
+	case "arrayJoin:":
+		return "arrayJoin", 1, true
 	case "objectAt:":
 		return "objectAt", 1, true
 	case "objectHasKey:":
 		return "objectHasKey", 1, true
 	case "objectRemoveKey:":
 		return "objectRemoveKey", 1, true
+	case "objectMerge:":
+		return "objectMerge", 1, true
+	case "objectDeepMerge:":
+		return "objectDeepMerge", 1, true
+	case "objectEquals:":
+		return "objectEquals", 1, true
+	case "jsonAtPath:":
+		return "jsonAtPath", 1, true
+	case "jsonSetPath:":
+		return "jsonSetPath", 2, true // Only valid as "jsonSetPath:put:"
 	}
 	return "", 0, false
 }
@@ -922,6 +1656,8 @@ func isJSONPrimitiveKeyword2(keyword string) (string, bool) {
 		return "arrayAtPut", true // Will be "arrayAt:put:" when we see "put:"
 	case "objectAt:":
 		return "objectAtPut", true // Will be "objectAt:put:" when we see "put:"
+	case "jsonSetPath:":
+		return "jsonSetPathPut", true // Will be "jsonSetPath:put:" when we see "put:"
 	}
 	return "", false
 }
@@ -1002,10 +1738,151 @@ func isFilePrimitive(selector string) (string, bool) {
 		return "fileIsOlder", true
 	case "isSame_as_":
 		return "fileIsSame", true
+	case "readAll_":
+		return "fileReadAll", true
+	case "writeContents_to_":
+		return "fileWriteContents", true
+	case "append_to_":
+		return "fileAppend", true
+	case "delete_":
+		return "fileDelete", true
+	case "copy_to_":
+		return "fileCopy", true
+	case "listDirectory_":
+		return "fileListDirectory", true
+	case "mkdirp_":
+		return "fileMkdirp", true
+	}
+	return "", false
+}
+
+// httpMethods maps the request selectors on HttpClient to operation names.
+// post: and put: take the request body as their second argument.
+var httpMethods = []struct{ selector, op string }{
+	{"get_", "httpGet"},
+	{"post_body_", "httpPost"},
+	{"put_body_", "httpPut"},
+	{"delete_", "httpDelete"},
+}
+
+// isHttpClientPrimitive checks if a selector on HttpClient class is a known
+// primitive. A request selector may end in headers: and timeout:, which add
+// "Headers" and "Timeout" to the operation name:
+// post:body:headers:timeout: -> httpPostHeadersTimeout
+func isHttpClientPrimitive(selector string) (string, bool) {
+	for _, m := range httpMethods {
+		rest, ok := strings.CutPrefix(selector, m.selector)
+		if !ok {
+			continue
+		}
+		switch rest {
+		case "":
+			return m.op, true
+		case "headers_":
+			return m.op + "Headers", true
+		case "timeout_":
+			return m.op + "Timeout", true
+		case "headers_timeout_":
+			return m.op + "HeadersTimeout", true
+		}
+	}
+	return "", false
+}
+
+// isLocalePrimitive checks if a selector on Locale class is a known primitive.
+// Returns (operation name, true) if it's a primitive.
+func isLocalePrimitive(selector string) (string, bool) {
+	switch selector {
+	case "formatNumber_":
+		return "localeFormatNumber", true
+	case "formatNumber_decimals_":
+		return "localeFormatNumberDecimals", true
+	case "formatDate_":
+		return "localeFormatDate", true
+	case "formatDate_pattern_":
+		return "localeFormatDatePattern", true
 	}
 	return "", false
 }
 
+// isShellPrimitive checks if a selector on Shell class is a known primitive.
+// Returns (operation name, true) if it's a primitive.
+func isShellPrimitive(selector string) (string, bool) {
+	switch selector {
+	case "run_":
+		return "shellRun", true
+	case "run_withTimeout_":
+		return "shellRunTimeout", true
+	case "runCapturing_":
+		return "shellRunCapturing", true
+	}
+	return "", false
+}
+
+// isEnvPrimitive checks if a selector on Env class is a known primitive.
+// Returns (operation name, true) if it's a primitive.
+func isEnvPrimitive(selector string) (string, bool) {
+	switch selector {
+	case "get_":
+		return "envGet", true
+	case "set_to_":
+		return "envSet", true
+	case "has_":
+		return "envHas", true
+	}
+	return "", false
+}
+
+// isOsPrimitive checks if a unary selector on Os class is a known primitive.
+// Returns (operation name, true) if it's a primitive.
+func isOsPrimitive(selector string) (string, bool) {
+	switch selector {
+	case "platform":
+		return "osPlatform", true
+	case "arch":
+		return "osArch", true
+	case "hostname":
+		return "osHostname", true
+	case "pid":
+		return "osPid", true
+	}
+	return "", false
+}
+
+// EnvVariableName returns the environment variable a $NAME or ${NAME}
+// token reads. Only upper-case names are taken for the environment; $name
+// may be a Bash local of the method.
+func EnvVariableName(token string) (string, bool) {
+	name, ok := strings.CutPrefix(token, "$")
+	if !ok {
+		return "", false
+	}
+	if braced, ok := strings.CutPrefix(name, "{"); ok {
+		name, ok = strings.CutSuffix(braced, "}")
+		if !ok {
+			return "", false
+		}
+	}
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return "", false
+	}
+	for _, r := range name {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// envVariable returns the Env get: primitive a $NAME token compiles to
+func envVariable(token string) (*ClassPrimitiveExpr, bool) {
+	name, ok := EnvVariableName(token)
+	if !ok {
+		return nil, false
+	}
+	return &ClassPrimitiveExpr{ClassName: "Env", Operation: "envGet", Args: []Expr{&StringLit{Value: name}}}, true
+}
+
 // isClassPrimitive checks if a message send to a class is a known primitive.
 // Returns (operation name, true) if it's a primitive.
 func isClassPrimitive(className, selector string) (string, bool) {
@@ -1014,6 +1891,16 @@ func isClassPrimitive(className, selector string) (string, bool) {
 		return isStringPrimitive(selector)
 	case "File":
 		return isFilePrimitive(selector)
+	case "HttpClient":
+		return isHttpClientPrimitive(selector)
+	case "Locale":
+		return isLocalePrimitive(selector)
+	case "Shell":
+		return isShellPrimitive(selector)
+	case "Env":
+		return isEnvPrimitive(selector)
+	case "Os":
+		return isOsPrimitive(selector)
 	}
 	return "", false
 }
@@ -1037,6 +1924,12 @@ func (p *Parser) parseJSONPrimitive(receiver Expr) (Expr, error) {
 				}
 				continue // Check for more primitives
 			}
+			// Boolean negation: (x > 0) not
+			if name == "not" {
+				p.advance() // consume "not"
+				result = &NotExpr{Operand: result}
+				continue
+			}
 			// Check for general unary messages (lowercase identifier, not a keyword)
 			// Examples: notEmpty, isNil, class, etc.
 			if isUnaryMessage(name) {
@@ -1071,10 +1964,8 @@ func (p *Parser) parseJSONPrimitive(receiver Expr) (Expr, error) {
 						return nil, err
 					}
 					// Adjust operation name for two-arg variants
-					if op == "arrayAt" {
-						op = "arrayAtPut"
-					} else if op == "objectAt" {
-						op = "objectAtPut"
+					if op2, ok := isJSONPrimitiveKeyword2(keyword); ok {
+						op = op2
 					}
 					result = &JSONPrimitiveExpr{
 						Receiver:  result,
@@ -1094,6 +1985,7 @@ func (p *Parser) parseJSONPrimitive(receiver Expr) (Expr, error) {
 					}
 					continue // Check for more primitives
 				}
+				return nil, fmt.Errorf("%s must be followed by put:", keyword)
 			}
 		}
 
@@ -1133,10 +2025,13 @@ func (p *Parser) parsePrimary() (Expr, error) {
 	case ast.TokenLParen:
 		// Parenthesized expression: (expr)
 		p.advance() // consume (
-		expr, err := p.parseExpr()
+		expr, err := p.parseValue()
 		if err != nil {
 			return nil, err
 		}
+		if ifx, ok := expr.(*IfExpr); ok && returnsFrom(ifx) {
+			return nil, fmt.Errorf("^ inside a conditional expression not supported")
+		}
 		if p.peek().Type != ast.TokenRParen {
 			return nil, fmt.Errorf("expected ) after parenthesized expression, got %s", p.peek().Type)
 		}
@@ -1144,7 +2039,11 @@ func (p *Parser) parsePrimary() (Expr, error) {
 		return expr, nil
 
 	case ast.TokenVariable:
-		// $variable - can't compile
+		// $HOME reads the environment; other $variables can't compile
+		if env, ok := envVariable(tok.Value); ok {
+			p.advance()
+			return env, nil
+		}
 		return nil, fmt.Errorf("bash variable references ($var) not supported")
 
 	case ast.TokenSubshell:
@@ -1212,6 +2111,11 @@ func (p *Parser) parseMessageSend() (Expr, error) {
 	if p.peek().Type == ast.TokenIdentifier {
 		selector := p.peek().Value
 		p.advance() // consume selector
+		if ident, ok := receiver.(*Identifier); ok && !isSelf {
+			if op, isPrimitive := isClassPrimitive(ident.Name, selector); isPrimitive {
+				return &ClassPrimitiveExpr{ClassName: ident.Name, Operation: op}, nil
+			}
+		}
 		return &MessageSend{
 			Receiver: receiver,
 			Selector: selector,
@@ -1230,7 +2134,7 @@ func (p *Parser) parseMessageSend() (Expr, error) {
 
 // parseKeywordMessage parses: key1: arg1 key2: arg2 ...
 // Returns a MessageSend with combined selector (e.g., "at_put_") and args
-// Or returns a ClassPrimitiveExpr if receiver is String/File with a known primitive selector
+// Or returns a ClassPrimitiveExpr if receiver is String/File/HttpClient/Locale/Shell/Env with a known primitive selector
 func (p *Parser) parseKeywordMessage(receiver Expr, isSelf bool) (Expr, error) {
 	var selectorParts []string
 	var args []Expr
@@ -1261,7 +2165,7 @@ func (p *Parser) parseKeywordMessage(receiver Expr, isSelf bool) (Expr, error) {
 	}
 
 	// Check if this is a class primitive (e.g., @ String isEmpty: str)
-	// The receiver must be an Identifier with a class name (String or File)
+	// The receiver must be an Identifier with a class name (String, File, HttpClient, Locale, Shell or Env)
 	if ident, ok := receiver.(*Identifier); ok && !isSelf {
 		if op, isPrimitive := isClassPrimitive(ident.Name, selector); isPrimitive {
 			return &ClassPrimitiveExpr{
@@ -1311,10 +2215,13 @@ func (p *Parser) parseMessageArg() (Expr, error) {
 	case ast.TokenLParen:
 		// Parenthesized expression
 		p.advance() // consume (
-		expr, err := p.parseExpr()
+		expr, err := p.parseValue()
 		if err != nil {
 			return nil, err
 		}
+		if ifx, ok := expr.(*IfExpr); ok && returnsFrom(ifx) {
+			return nil, fmt.Errorf("^ inside a conditional expression not supported")
+		}
 		if p.peek().Type != ast.TokenRParen {
 			return nil, fmt.Errorf("expected ) in message argument, got %s", p.peek().Type)
 		}
@@ -1325,6 +2232,23 @@ func (p *Parser) parseMessageArg() (Expr, error) {
 		// Block expression: [:param | body] or [body]
 		return p.parseBlockExpr()
 
+	case ast.TokenVariable:
+		// $HOME reads the environment
+		if env, ok := envVariable(tok.Value); ok {
+			p.advance()
+			return env, nil
+		}
+		return nil, fmt.Errorf("bash variable references ($var) not supported")
+
+	case ast.TokenMinus:
+		// Unary minus: @ self move: -step
+		p.advance() // consume -
+		operand, err := p.parseMessageArg()
+		if err != nil {
+			return nil, err
+		}
+		return negate(operand), nil
+
 	default:
 		return nil, fmt.Errorf("unexpected token in message argument: %s (%s)", tok.Type, tok.Value)
 	}
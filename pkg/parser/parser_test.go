@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/chazu/procyon/pkg/ast"
@@ -387,6 +388,60 @@ func TestParseIterationExpr(t *testing.T) {
 			wantVar:   "x",
 			wantStmts: 1,
 		},
+		{
+			name: "inject:into: iteration",
+			tokens: []ast.Token{
+				{Type: ast.TokenIdentifier, Value: "items"},
+				{Type: ast.TokenKeyword, Value: "inject:"},
+				{Type: ast.TokenNumber, Value: "0"},
+				{Type: ast.TokenKeyword, Value: "into:"},
+				{Type: ast.TokenLBracket, Value: "["},
+				{Type: ast.TokenBlockParam, Value: "acc"},
+				{Type: ast.TokenBlockParam, Value: "x"},
+				{Type: ast.TokenPipe, Value: "|"},
+				{Type: ast.TokenIdentifier, Value: "acc"},
+				{Type: ast.TokenPlus, Value: "+"},
+				{Type: ast.TokenIdentifier, Value: "x"},
+				{Type: ast.TokenRBracket, Value: "]"},
+			},
+			wantKind:  "inject",
+			wantVar:   "x",
+			wantStmts: 1,
+		},
+		{
+			name: "reject: iteration",
+			tokens: []ast.Token{
+				{Type: ast.TokenIdentifier, Value: "items"},
+				{Type: ast.TokenKeyword, Value: "reject:"},
+				{Type: ast.TokenLBracket, Value: "["},
+				{Type: ast.TokenBlockParam, Value: "x"},
+				{Type: ast.TokenPipe, Value: "|"},
+				{Type: ast.TokenIdentifier, Value: "x"},
+				{Type: ast.TokenLT, Value: "<"},
+				{Type: ast.TokenNumber, Value: "0"},
+				{Type: ast.TokenRBracket, Value: "]"},
+			},
+			wantKind:  "reject",
+			wantVar:   "x",
+			wantStmts: 1,
+		},
+		{
+			name: "allSatisfy: iteration",
+			tokens: []ast.Token{
+				{Type: ast.TokenIdentifier, Value: "items"},
+				{Type: ast.TokenKeyword, Value: "allSatisfy:"},
+				{Type: ast.TokenLBracket, Value: "["},
+				{Type: ast.TokenBlockParam, Value: "x"},
+				{Type: ast.TokenPipe, Value: "|"},
+				{Type: ast.TokenIdentifier, Value: "x"},
+				{Type: ast.TokenGT, Value: ">"},
+				{Type: ast.TokenNumber, Value: "0"},
+				{Type: ast.TokenRBracket, Value: "]"},
+			},
+			wantKind:  "allSatisfy",
+			wantVar:   "x",
+			wantStmts: 1,
+		},
 	}
 
 	for _, tt := range tests {
@@ -416,3 +471,879 @@ func TestParseIterationExpr(t *testing.T) {
 		})
 	}
 }
+
+func TestParseInjectInto(t *testing.T) {
+	// total := items inject: 1 into: [:acc :x | acc * x]
+	tokens := []ast.Token{
+		{Type: ast.TokenIdentifier, Value: "total"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenIdentifier, Value: "items"},
+		{Type: ast.TokenKeyword, Value: "inject:"},
+		{Type: ast.TokenNumber, Value: "1"},
+		{Type: ast.TokenKeyword, Value: "into:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenBlockParam, Value: "acc"},
+		{Type: ast.TokenBlockParam, Value: "x"},
+		{Type: ast.TokenPipe, Value: "|"},
+		{Type: ast.TokenIdentifier, Value: "acc"},
+		{Type: ast.TokenStar, Value: "*"},
+		{Type: ast.TokenIdentifier, Value: "x"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	}
+	result, err := newParser(tokens).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	assign, ok := result.(*Assignment)
+	if !ok {
+		t.Fatalf("expected Assignment, got %T", result)
+	}
+	value, ok := assign.Value.(*IterationExprAsValue)
+	if !ok {
+		t.Fatalf("expected IterationExprAsValue, got %T", assign.Value)
+	}
+	iter := value.Iteration
+	if iter.AccVar != "acc" || iter.IterVar != "x" {
+		t.Errorf("params = %q %q, want acc x", iter.AccVar, iter.IterVar)
+	}
+	if lit, ok := iter.Initial.(*NumberLit); !ok || lit.Value != "1" {
+		t.Errorf("Initial = %#v, want 1", iter.Initial)
+	}
+
+	// The block must take the accumulator and the element
+	oneParam := []ast.Token{
+		{Type: ast.TokenIdentifier, Value: "items"},
+		{Type: ast.TokenKeyword, Value: "inject:"},
+		{Type: ast.TokenNumber, Value: "0"},
+		{Type: ast.TokenKeyword, Value: "into:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenBlockParam, Value: "x"},
+		{Type: ast.TokenPipe, Value: "|"},
+		{Type: ast.TokenIdentifier, Value: "x"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	}
+	if _, err := newParser(oneParam).parseStatement(); err == nil {
+		t.Error("expected an error for a one-parameter inject:into: block")
+	}
+}
+
+func TestParseDetectIfNone(t *testing.T) {
+	// found := items detect: [:x | x > 3] ifNone: [0]
+	tokens := []ast.Token{
+		{Type: ast.TokenIdentifier, Value: "found"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenIdentifier, Value: "items"},
+		{Type: ast.TokenKeyword, Value: "detect:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenBlockParam, Value: "x"},
+		{Type: ast.TokenPipe, Value: "|"},
+		{Type: ast.TokenIdentifier, Value: "x"},
+		{Type: ast.TokenGT, Value: ">"},
+		{Type: ast.TokenNumber, Value: "3"},
+		{Type: ast.TokenRBracket, Value: "]"},
+		{Type: ast.TokenNewline, Value: "\n"},
+		{Type: ast.TokenKeyword, Value: "ifNone:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenNumber, Value: "0"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	}
+	result, err := newParser(tokens).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	assign, ok := result.(*Assignment)
+	if !ok {
+		t.Fatalf("expected Assignment, got %T", result)
+	}
+	value, ok := assign.Value.(*IterationExprAsValue)
+	if !ok {
+		t.Fatalf("expected IterationExprAsValue, got %T", assign.Value)
+	}
+	if iter := value.Iteration; iter.Kind != "detect" || len(iter.IfNone) != 1 {
+		t.Errorf("got kind %q with %d ifNone: statements, want detect with 1", iter.Kind, len(iter.IfNone))
+	}
+
+	// Without ifNone: and with a block variable
+	dynamic := []ast.Token{
+		{Type: ast.TokenCaret, Value: "^"},
+		{Type: ast.TokenIdentifier, Value: "items"},
+		{Type: ast.TokenKeyword, Value: "detect:"},
+		{Type: ast.TokenIdentifier, Value: "pred"},
+	}
+	result, err = newParser(dynamic).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	ret, ok := result.(*Return)
+	if !ok {
+		t.Fatalf("expected Return, got %T", result)
+	}
+	dyn, ok := ret.Value.(*DynamicIterationExprAsValue)
+	if !ok {
+		t.Fatalf("expected DynamicIterationExprAsValue, got %T", ret.Value)
+	}
+	if dyn.Iteration.Kind != "detect" || dyn.Iteration.IfNone != nil {
+		t.Errorf("got kind %q with ifNone: %v, want detect without", dyn.Iteration.Kind, dyn.Iteration.IfNone)
+	}
+}
+
+func TestParseCountedLoops(t *testing.T) {
+	// 1 to: n do: [:i | sum := sum + i]
+	toDo := []ast.Token{
+		{Type: ast.TokenNumber, Value: "1"},
+		{Type: ast.TokenKeyword, Value: "to:"},
+		{Type: ast.TokenIdentifier, Value: "n"},
+		{Type: ast.TokenKeyword, Value: "do:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenBlockParam, Value: "i"},
+		{Type: ast.TokenPipe, Value: "|"},
+		{Type: ast.TokenIdentifier, Value: "sum"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenIdentifier, Value: "sum"},
+		{Type: ast.TokenPlus, Value: "+"},
+		{Type: ast.TokenIdentifier, Value: "i"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	}
+	result, err := newParser(toDo).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	loop, ok := result.(*CountedLoopExpr)
+	if !ok {
+		t.Fatalf("expected CountedLoopExpr, got %T", result)
+	}
+	if loop.IndexVar != "i" || len(loop.Body) != 1 {
+		t.Errorf("got index %q with %d body statements, want i with 1", loop.IndexVar, len(loop.Body))
+	}
+	if to, ok := loop.To.(*Identifier); !ok || to.Name != "n" {
+		t.Errorf("To = %#v, want n", loop.To)
+	}
+
+	// 3 timesRepeat: [count := count + 1]
+	times := []ast.Token{
+		{Type: ast.TokenNumber, Value: "3"},
+		{Type: ast.TokenKeyword, Value: "timesRepeat:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenIdentifier, Value: "count"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenIdentifier, Value: "count"},
+		{Type: ast.TokenPlus, Value: "+"},
+		{Type: ast.TokenNumber, Value: "1"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	}
+	result, err = newParser(times).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	loop, ok = result.(*CountedLoopExpr)
+	if !ok {
+		t.Fatalf("expected CountedLoopExpr, got %T", result)
+	}
+	if from, ok := loop.From.(*NumberLit); !ok || from.Value != "1" || loop.IndexVar != "" {
+		t.Errorf("timesRepeat: loop = %#v, want from 1 without an index", loop)
+	}
+
+	// to: needs do:
+	if _, err := newParser(toDo[:3]).parseStatement(); err == nil {
+		t.Error("expected an error for to: without do:")
+	}
+}
+
+func TestParseExceptions(t *testing.T) {
+	// _throw NotFound 'no key'
+	throw := []ast.Token{
+		{Type: ast.TokenIdentifier, Value: "_throw"},
+		{Type: ast.TokenIdentifier, Value: "NotFound"},
+		{Type: ast.TokenSString, Value: "no key"},
+	}
+	result, err := newParser(throw).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	th, ok := result.(*ThrowExpr)
+	if !ok {
+		t.Fatalf("expected ThrowExpr, got %T", result)
+	}
+	if msg, ok := th.Message.(*StringLit); th.Class != "NotFound" || !ok || msg.Value != "no key" {
+		t.Errorf("got %#v, want NotFound 'no key'", th)
+	}
+
+	// _throw 'boom' signals Error
+	result, err = newParser([]ast.Token{throw[0], throw[2]}).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	if th, ok := result.(*ThrowExpr); !ok || th.Class != "Error" || th.Message == nil {
+		t.Errorf("got %#v, want Error 'no key'", result)
+	}
+
+	// [x := 1] on: NotFound do: [:e | x := e]
+	onDo := []ast.Token{
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenIdentifier, Value: "x"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenNumber, Value: "1"},
+		{Type: ast.TokenRBracket, Value: "]"},
+		{Type: ast.TokenKeyword, Value: "on:"},
+		{Type: ast.TokenIdentifier, Value: "NotFound"},
+		{Type: ast.TokenKeyword, Value: "do:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenBlockParam, Value: "e"},
+		{Type: ast.TokenPipe, Value: "|"},
+		{Type: ast.TokenIdentifier, Value: "x"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenIdentifier, Value: "e"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	}
+	result, err = newParser(onDo).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	handler, ok := result.(*OnDoExpr)
+	if !ok {
+		t.Fatalf("expected OnDoExpr, got %T", result)
+	}
+	if handler.ErrorClass != "NotFound" || handler.ErrVar != "e" || len(handler.Body) != 1 || len(handler.Handler) != 1 {
+		t.Errorf("got %#v, want NotFound handler binding e", handler)
+	}
+
+	// [x := 1] ensure: [x := 2]
+	ensure := append(append([]ast.Token{}, onDo[:5]...),
+		ast.Token{Type: ast.TokenKeyword, Value: "ensure:"},
+		ast.Token{Type: ast.TokenLBracket, Value: "["},
+		ast.Token{Type: ast.TokenIdentifier, Value: "x"},
+		ast.Token{Type: ast.TokenAssign, Value: ":="},
+		ast.Token{Type: ast.TokenNumber, Value: "2"},
+		ast.Token{Type: ast.TokenRBracket, Value: "]"},
+	)
+	result, err = newParser(ensure).parseStatement()
+	if err != nil {
+		t.Fatalf("parseStatement() error = %v", err)
+	}
+	if e, ok := result.(*EnsureExpr); !ok || len(e.Body) != 1 || len(e.Cleanup) != 1 {
+		t.Errorf("got %#v, want ensure: with one body and one cleanup statement", result)
+	}
+
+	// ^ inside the protected block cannot return from a closure
+	ret := append([]ast.Token{onDo[0], {Type: ast.TokenCaret, Value: "^"}}, onDo[3:]...)
+	if _, err := newParser(ret).parseStatement(); err == nil {
+		t.Error("expected an error for ^ inside an on:do: block")
+	}
+}
+
+func TestParseIncrementSugar(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+
+	tests := []struct {
+		tokens []ast.Token
+		want   string
+	}{
+		{[]ast.Token{tok(ast.TokenIdentifier, "count"), tok(ast.TokenIdentifier, "increment")}, "(count+1)"},
+		{[]ast.Token{tok(ast.TokenIdentifier, "count"), tok(ast.TokenIdentifier, "decrement"), tok(ast.TokenDot, ".")}, "(count-1)"},
+	}
+	for _, tt := range tests {
+		result, err := newParser(tt.tokens).parseStatement()
+		if err != nil {
+			t.Fatalf("parseStatement() error = %v", err)
+		}
+		assign, ok := result.(*Assignment)
+		if !ok || assign.Target != "count" {
+			t.Fatalf("expected assignment to count, got %#v", result)
+		}
+		if got := formatLogical(assign.Value); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+
+	// Only a whole statement is sugar
+	p := newParser([]ast.Token{tok(ast.TokenIdentifier, "count"), tok(ast.TokenIdentifier, "increment"), tok(ast.TokenPlus, "+")})
+	if result, _ := p.parseStatement(); result != nil {
+		if _, ok := result.(*Assignment); ok {
+			t.Errorf("count increment + parsed as an assignment")
+		}
+	}
+}
+
+func TestParseUnaryMinus(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	minus := tok(ast.TokenMinus, "-")
+
+	tests := []struct {
+		name   string
+		tokens []ast.Token
+		want   string
+	}{
+		{"negated variable", []ast.Token{minus, tok(ast.TokenIdentifier, "x")}, "-[x]"},
+		{"negative literal", []ast.Token{tok(ast.TokenNumber, "-5")}, "-5"},
+		{"minus before literal folds", []ast.Token{minus, tok(ast.TokenNumber, "5")}, "-5"},
+		{"double negation", []ast.Token{minus, tok(ast.TokenNumber, "-5")}, "5"},
+		{"negated parenthesized", []ast.Token{minus, tok(ast.TokenLParen, "("), tok(ast.TokenIdentifier, "x"),
+			tok(ast.TokenPlus, "+"), tok(ast.TokenNumber, "1"), tok(ast.TokenRParen, ")")}, "-[(x+1)]"},
+		{"operand of *", []ast.Token{tok(ast.TokenNumber, "3"), tok(ast.TokenStar, "*"), minus, tok(ast.TokenIdentifier, "x")}, "(3*-[x])"},
+		{"binary minus", []ast.Token{tok(ast.TokenIdentifier, "x"), minus, tok(ast.TokenNumber, "5")}, "(x-5)"},
+		{"lexed negative after operand", []ast.Token{tok(ast.TokenIdentifier, "x"), tok(ast.TokenNumber, "-5")}, "(x-5)"},
+		{"lexed negative binds looser than *", []ast.Token{tok(ast.TokenIdentifier, "x"), tok(ast.TokenNumber, "-5"),
+			tok(ast.TokenStar, "*"), tok(ast.TokenNumber, "2")}, "(x-(5*2))"},
+		{"comparison with negative", []ast.Token{tok(ast.TokenIdentifier, "x"), tok(ast.TokenLT, "<"), minus, tok(ast.TokenIdentifier, "y")}, "x<-[y]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newParser(tt.tokens)
+			result, err := p.parseExpr()
+			if err != nil {
+				t.Fatalf("parseExpr() error = %v", err)
+			}
+			if !p.atEnd() {
+				t.Fatalf("unparsed tokens from %v", p.peek())
+			}
+			if got := formatLogical(result); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// @ self moveBy: -step
+	p := newParser([]ast.Token{tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "self"), tok(ast.TokenKeyword, "moveBy:"),
+		minus, tok(ast.TokenIdentifier, "step")})
+	result, err := p.parseExpr()
+	if err != nil {
+		t.Fatalf("parseExpr() error = %v", err)
+	}
+	send, ok := result.(*MessageSend)
+	if !ok || len(send.Args) != 1 {
+		t.Fatalf("expected a one-argument MessageSend, got %#v", result)
+	}
+	if got := formatLogical(send.Args[0]); got != "-[step]" {
+		t.Errorf("argument = %s, want -[step]", got)
+	}
+}
+
+func TestParseLogicalExpr(t *testing.T) {
+	gt := func(name string) []ast.Token {
+		return []ast.Token{
+			{Type: ast.TokenIdentifier, Value: name},
+			{Type: ast.TokenGT, Value: ">"},
+			{Type: ast.TokenNumber, Value: "0"},
+		}
+	}
+	block := func(tokens []ast.Token) []ast.Token {
+		out := []ast.Token{{Type: ast.TokenLBracket, Value: "["}}
+		out = append(out, tokens...)
+		return append(out, ast.Token{Type: ast.TokenRBracket, Value: "]"})
+	}
+	paren := func(tokens []ast.Token) []ast.Token {
+		out := []ast.Token{{Type: ast.TokenLParen, Value: "("}}
+		out = append(out, tokens...)
+		return append(out, ast.Token{Type: ast.TokenRParen, Value: ")"})
+	}
+	join := func(parts ...[]ast.Token) []ast.Token {
+		var out []ast.Token
+		for _, part := range parts {
+			out = append(out, part...)
+		}
+		return out
+	}
+	keyword := func(v string) []ast.Token { return []ast.Token{{Type: ast.TokenKeyword, Value: v}} }
+	ident := func(v string) []ast.Token { return []ast.Token{{Type: ast.TokenIdentifier, Value: v}} }
+	num := func(v string) []ast.Token { return []ast.Token{{Type: ast.TokenNumber, Value: v}} }
+
+	tests := []struct {
+		name   string
+		tokens []ast.Token
+		want   string
+	}{
+		{"and: block", join(gt("a"), keyword("and:"), block(gt("b"))), "(a>0 && b>0)"},
+		{"or: block", join(gt("a"), keyword("or:"), block(gt("b"))), "(a>0 || b>0)"},
+		{"&& operator", join(gt("a"), []ast.Token{{Type: ast.TokenAnd, Value: "&&"}}, gt("b")), "(a>0 && b>0)"},
+		{"|| operator", join(gt("a"), []ast.Token{{Type: ast.TokenOr, Value: "||"}}, gt("b")), "(a>0 || b>0)"},
+		{"chained left to right", join(gt("a"), keyword("and:"), block(gt("b")), keyword("or:"), block(gt("c"))), "((a>0 && b>0) || c>0)"},
+		{"not", join(paren(gt("a")), []ast.Token{{Type: ast.TokenIdentifier, Value: "not"}}), "!(a>0)"},
+		{"not inside and:", join(gt("a"), keyword("and:"), block(join(paren(gt("b")), []ast.Token{{Type: ast.TokenIdentifier, Value: "not"}}))), "(a>0 && !(b>0))"},
+		{"between:and:", join(ident("x"), keyword("between:"), num("1"), keyword("and:"), num("10")), "x in [1,10]"},
+		{"between:and: then and:", join(ident("x"), keyword("between:"), num("1"), keyword("and:"), num("10"), keyword("and:"), block(gt("b"))), "(x in [1,10] && b>0)"},
+		{"max: inside min:", join(paren(join(ident("a"), keyword("max:"), num("0"))), keyword("min:"), num("9")), "min(max(a,0),9)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newParser(tt.tokens)
+			result, err := p.parseExpr()
+			if err != nil {
+				t.Fatalf("parseExpr() error = %v", err)
+			}
+			if !p.atEnd() {
+				t.Fatalf("unparsed tokens from %v", p.peek())
+			}
+			if got := formatLogical(result); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLogicalBlockMustBeExpression(t *testing.T) {
+	p := newParser([]ast.Token{
+		{Type: ast.TokenIdentifier, Value: "a"},
+		{Type: ast.TokenKeyword, Value: "and:"},
+		{Type: ast.TokenLBracket, Value: "["},
+		{Type: ast.TokenIdentifier, Value: "x"},
+		{Type: ast.TokenAssign, Value: ":="},
+		{Type: ast.TokenNumber, Value: "1"},
+		{Type: ast.TokenRBracket, Value: "]"},
+	})
+	if _, err := p.parseExpr(); err == nil {
+		t.Fatal("expected an error for a statement block")
+	}
+}
+
+// formatLogical renders logical and comparison expressions compactly
+func formatLogical(expr Expr) string {
+	switch e := expr.(type) {
+	case *LogicalExpr:
+		return "(" + formatLogical(e.Left) + " " + e.Op + " " + formatLogical(e.Right) + ")"
+	case *NotExpr:
+		return "!(" + formatLogical(e.Operand) + ")"
+	case *BetweenExpr:
+		return formatLogical(e.Value) + " in [" + formatLogical(e.Low) + "," + formatLogical(e.High) + "]"
+	case *MinMaxExpr:
+		return e.Op + "(" + formatLogical(e.Left) + "," + formatLogical(e.Right) + ")"
+	case *BinaryExpr:
+		return "(" + formatLogical(e.Left) + e.Op + formatLogical(e.Right) + ")"
+	case *NegateExpr:
+		return "-[" + formatLogical(e.Operand) + "]"
+	case *ComparisonExpr:
+		return formatLogical(e.Left) + e.Op + formatLogical(e.Right)
+	case *Identifier:
+		return e.Name
+	case *NumberLit:
+		return e.Value
+	}
+	return "?"
+}
+
+func TestParseConditionalValue(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	cond := func(name string) []ast.Token {
+		return []ast.Token{tok(ast.TokenLParen, "("), tok(ast.TokenIdentifier, name), tok(ast.TokenGT, ">"),
+			tok(ast.TokenNumber, "0"), tok(ast.TokenRParen, ")")}
+	}
+	str := func(v string) []ast.Token {
+		return []ast.Token{tok(ast.TokenLBracket, "["), tok(ast.TokenSString, v), tok(ast.TokenRBracket, "]")}
+	}
+	join := func(parts ...[]ast.Token) []ast.Token {
+		var out []ast.Token
+		for _, part := range parts {
+			out = append(out, part...)
+		}
+		return out
+	}
+	ifTrue := []ast.Token{tok(ast.TokenKeyword, "ifTrue:")}
+	ifFalse := []ast.Token{tok(ast.TokenKeyword, "ifFalse:")}
+	// (b > 0) ifTrue: ['y'] ifFalse: ['z']
+	inner := join(cond("b"), ifTrue, str("y"), ifFalse, str("z"))
+	chain := join(cond("a"), ifTrue, str("x"), ifFalse, []ast.Token{tok(ast.TokenLBracket, "[")}, inner, []ast.Token{tok(ast.TokenRBracket, "]")})
+
+	tests := []struct {
+		name   string
+		tokens []ast.Token
+		want   string
+	}{
+		{"return chain", join([]ast.Token{tok(ast.TokenCaret, "^")}, chain), "if a>0 {^x} else {if b>0 {^y} else {^z}}"},
+		{"assign chain", join([]ast.Token{tok(ast.TokenIdentifier, "v"), tok(ast.TokenAssign, ":=")}, chain), "if a>0 {v:=x} else {if b>0 {v:=y} else {v:=z}}"},
+		{"missing branch is nil", join([]ast.Token{tok(ast.TokenCaret, "^")}, cond("a"), ifTrue, str("x")), "if a>0 {^x} else {^}"},
+		{"parenthesized", join([]ast.Token{tok(ast.TokenCaret, "^"), tok(ast.TokenLParen, "(")}, inner, []ast.Token{tok(ast.TokenRParen, ")")}), "if b>0 {^y} else {^z}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			if got := formatStatements(result.Body.Statements); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// ^ cannot return from the method inside a nested conditional expression
+	tokens := join([]ast.Token{tok(ast.TokenIdentifier, "v"), tok(ast.TokenAssign, ":="), tok(ast.TokenSString, "n="),
+		tok(ast.TokenComma, ","), tok(ast.TokenLParen, "(")}, cond("a"), ifTrue,
+		[]ast.Token{tok(ast.TokenLBracket, "["), tok(ast.TokenCaret, "^"), tok(ast.TokenSString, "x"), tok(ast.TokenRBracket, "]")},
+		[]ast.Token{tok(ast.TokenRParen, ")")})
+	if result := ParseMethod(tokens); !result.Unsupported {
+		t.Error("expected ^ inside a conditional expression to be unsupported")
+	}
+}
+
+func TestParseContinuedLines(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	nl := tok(ast.TokenNewline, "\\n")
+	backslash := tok(ast.TokenBackslash, "\\\\")
+	ret, at, self := tok(ast.TokenCaret, "^"), tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "self")
+	combine, with := tok(ast.TokenKeyword, "combine:"), tok(ast.TokenKeyword, "with:")
+	a, b := tok(ast.TokenIdentifier, "a"), tok(ast.TokenIdentifier, "b")
+
+	tests := []struct {
+		name   string
+		tokens []ast.Token
+	}{
+		{"backslash", []ast.Token{ret, at, self, combine, a, backslash, nl, with, b}},
+		{"after keyword", []ast.Token{ret, at, self, combine, nl, a, with, nl, nl, b}},
+		{"both", []ast.Token{ret, at, self, combine, nl, a, backslash, nl, with, b, nl}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			if len(result.Body.Statements) != 1 {
+				t.Fatalf("got %d statements, want 1", len(result.Body.Statements))
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			send, ok := r.Value.(*MessageSend)
+			if !ok || send.Selector != "combine_with_" || len(send.Args) != 2 {
+				t.Errorf("expected combine:with: with 2 arguments, got %#v", r.Value)
+			}
+		})
+	}
+
+	// A newline anywhere else still ends the statement
+	result := ParseMethod([]ast.Token{at, self, combine, a, nl, with, b})
+	if !result.Unsupported && len(result.Body.Statements) < 2 {
+		t.Error("expected a newline before with: to end the statement")
+	}
+}
+
+func TestParseHttpClientPrimitive(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	ret, at, client := tok(ast.TokenCaret, "^"), tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "HttpClient")
+	url, data := tok(ast.TokenIdentifier, "url"), tok(ast.TokenIdentifier, "data")
+	headers, timeout := tok(ast.TokenSString, "'{}'"), tok(ast.TokenNumber, "5")
+
+	tests := []struct {
+		name   string
+		tokens []ast.Token
+		op     string
+		args   int
+	}{
+		{"get", []ast.Token{ret, at, client, tok(ast.TokenKeyword, "get:"), url}, "httpGet", 1},
+		{"post", []ast.Token{ret, at, client, tok(ast.TokenKeyword, "post:"), url, tok(ast.TokenKeyword, "body:"), data}, "httpPost", 2},
+		{"put headers", []ast.Token{ret, at, client, tok(ast.TokenKeyword, "put:"), url, tok(ast.TokenKeyword, "body:"), data,
+			tok(ast.TokenKeyword, "headers:"), headers}, "httpPutHeaders", 3},
+		{"delete timeout", []ast.Token{ret, at, client, tok(ast.TokenKeyword, "delete:"), url, tok(ast.TokenKeyword, "timeout:"), timeout}, "httpDeleteTimeout", 2},
+		{"get headers timeout", []ast.Token{ret, at, client, tok(ast.TokenKeyword, "get:"), url, tok(ast.TokenKeyword, "headers:"), headers,
+			tok(ast.TokenKeyword, "timeout:"), timeout}, "httpGetHeadersTimeout", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			prim, ok := r.Value.(*ClassPrimitiveExpr)
+			if !ok || prim.ClassName != "HttpClient" || prim.Operation != tt.op || len(prim.Args) != tt.args {
+				t.Errorf("expected %s with %d arguments, got %#v", tt.op, tt.args, r.Value)
+			}
+		})
+	}
+
+	// Other selectors are ordinary message sends
+	result := ParseMethod([]ast.Token{ret, at, client, tok(ast.TokenKeyword, "post:"), url})
+	if r, ok := result.Body.Statements[0].(*Return); !ok {
+		t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+	} else if _, ok := r.Value.(*MessageSend); !ok {
+		t.Errorf("expected post: without body: to be a message send, got %#v", r.Value)
+	}
+}
+
+func TestParseShellPrimitive(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	ret, at, shell, cmd := tok(ast.TokenCaret, "^"), tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "Shell"), tok(ast.TokenIdentifier, "cmd")
+
+	tests := []struct {
+		tokens []ast.Token
+		op     string
+		args   int
+	}{
+		{[]ast.Token{ret, at, shell, tok(ast.TokenKeyword, "run:"), cmd}, "shellRun", 1},
+		{[]ast.Token{ret, at, shell, tok(ast.TokenKeyword, "run:"), cmd, tok(ast.TokenKeyword, "withTimeout:"), tok(ast.TokenNumber, "5")}, "shellRunTimeout", 2},
+		{[]ast.Token{ret, at, shell, tok(ast.TokenKeyword, "runCapturing:"), cmd}, "shellRunCapturing", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			if prim, ok := r.Value.(*ClassPrimitiveExpr); !ok || prim.ClassName != "Shell" || prim.Operation != tt.op || len(prim.Args) != tt.args {
+				t.Errorf("expected %s with %d arguments, got %#v", tt.op, tt.args, r.Value)
+			}
+		})
+	}
+}
+
+func TestParseEnvPrimitives(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	ret, at, name := tok(ast.TokenCaret, "^"), tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "name")
+	env, osClass := tok(ast.TokenIdentifier, "Env"), tok(ast.TokenIdentifier, "Os")
+
+	tests := []struct {
+		name   string
+		tokens []ast.Token
+		class  string
+		op     string
+		args   int
+	}{
+		{"get", []ast.Token{ret, at, env, tok(ast.TokenKeyword, "get:"), name}, "Env", "envGet", 1},
+		{"set", []ast.Token{ret, at, env, tok(ast.TokenKeyword, "set:"), name, tok(ast.TokenKeyword, "to:"), tok(ast.TokenSString, "'x'")}, "Env", "envSet", 2},
+		{"has", []ast.Token{ret, at, env, tok(ast.TokenKeyword, "has:"), name}, "Env", "envHas", 1},
+		{"variable", []ast.Token{ret, tok(ast.TokenVariable, "$HOME")}, "Env", "envGet", 1},
+		{"braced variable", []ast.Token{ret, tok(ast.TokenVariable, "${XDG_DATA_HOME}")}, "Env", "envGet", 1},
+		{"platform", []ast.Token{ret, at, osClass, tok(ast.TokenIdentifier, "platform")}, "Os", "osPlatform", 0},
+		{"pid", []ast.Token{ret, at, osClass, tok(ast.TokenIdentifier, "pid")}, "Os", "osPid", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			if prim, ok := r.Value.(*ClassPrimitiveExpr); !ok || prim.ClassName != tt.class || prim.Operation != tt.op || len(prim.Args) != tt.args {
+				t.Errorf("expected %s with %d arguments, got %#v", tt.op, tt.args, r.Value)
+			}
+		})
+	}
+
+	// Lower-case names may be Bash locals, and positional parameters are not
+	// the environment
+	for _, v := range []string{"$name", "$1", "$?", "${HOME"} {
+		if result := ParseMethod([]ast.Token{ret, tok(ast.TokenVariable, v)}); !result.Unsupported {
+			t.Errorf("%s: expected the method to stay in Bash", v)
+		}
+	}
+}
+
+func TestParseLocalePrimitive(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	ret, at, locale, n := tok(ast.TokenCaret, "^"), tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "Locale"), tok(ast.TokenIdentifier, "n")
+
+	tests := []struct {
+		tokens []ast.Token
+		op     string
+	}{
+		{[]ast.Token{ret, at, locale, tok(ast.TokenKeyword, "formatNumber:"), n}, "localeFormatNumber"},
+		{[]ast.Token{ret, at, locale, tok(ast.TokenKeyword, "formatNumber:"), n, tok(ast.TokenKeyword, "decimals:"), tok(ast.TokenNumber, "2")}, "localeFormatNumberDecimals"},
+		{[]ast.Token{ret, at, locale, tok(ast.TokenKeyword, "formatDate:"), n}, "localeFormatDate"},
+		{[]ast.Token{ret, at, locale, tok(ast.TokenKeyword, "formatDate:"), n, tok(ast.TokenKeyword, "pattern:"), tok(ast.TokenSString, "'%x'")}, "localeFormatDatePattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			if prim, ok := r.Value.(*ClassPrimitiveExpr); !ok || prim.ClassName != "Locale" || prim.Operation != tt.op {
+				t.Errorf("expected %s, got %#v", tt.op, r.Value)
+			}
+		})
+	}
+}
+
+func TestParseJSONPathPrimitives(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	ret, data := tok(ast.TokenCaret, "^"), tok(ast.TokenIdentifier, "data")
+	path, value := tok(ast.TokenSString, "'user.addresses[0].city'"), tok(ast.TokenIdentifier, "city")
+
+	tests := []struct {
+		tokens []ast.Token
+		op     string
+		args   int
+	}{
+		{[]ast.Token{ret, data, tok(ast.TokenKeyword, "jsonAtPath:"), path}, "jsonAtPath", 1},
+		{[]ast.Token{ret, data, tok(ast.TokenKeyword, "jsonSetPath:"), path, tok(ast.TokenKeyword, "put:"), value}, "jsonSetPathPut", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			if prim, ok := r.Value.(*JSONPrimitiveExpr); !ok || prim.Operation != tt.op || len(prim.Args) != tt.args {
+				t.Errorf("expected %s with %d arguments, got %#v", tt.op, tt.args, r.Value)
+			}
+		})
+	}
+
+	result := ParseMethod([]ast.Token{ret, data, tok(ast.TokenKeyword, "jsonSetPath:"), path})
+	if !result.Unsupported || !strings.Contains(result.Reason, "put:") {
+		t.Errorf("expected jsonSetPath: without put: to be unsupported, got %q", result.Reason)
+	}
+}
+
+func TestParseArrayOrderingPrimitives(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	// ^ items arrayUnique arraySortNumeric arrayJoin: ', '
+	result := ParseMethod([]ast.Token{
+		tok(ast.TokenCaret, "^"), tok(ast.TokenIdentifier, "items"),
+		tok(ast.TokenIdentifier, "arrayUnique"), tok(ast.TokenIdentifier, "arraySortNumeric"),
+		tok(ast.TokenKeyword, "arrayJoin:"), tok("STRING", "', '"),
+	})
+	if result.Unsupported {
+		t.Fatalf("unsupported: %s", result.Reason)
+	}
+	r, ok := result.Body.Statements[0].(*Return)
+	if !ok {
+		t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+	}
+	var ops []string
+	for expr := r.Value; ; {
+		prim, ok := expr.(*JSONPrimitiveExpr)
+		if !ok {
+			break
+		}
+		ops = append([]string{prim.Operation}, ops...)
+		expr = prim.Receiver
+	}
+	if got := strings.Join(ops, " "); got != "arrayUnique arraySortNumeric arrayJoin" {
+		t.Errorf("got %q, want arrayUnique arraySortNumeric arrayJoin", got)
+	}
+}
+
+func TestParseObjectMergePrimitives(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	// ^ (defaults objectDeepMerge: overrides) objectEquals: expected
+	result := ParseMethod([]ast.Token{
+		tok(ast.TokenCaret, "^"), tok(ast.TokenLParen, "("), tok(ast.TokenIdentifier, "defaults"),
+		tok(ast.TokenKeyword, "objectDeepMerge:"), tok(ast.TokenIdentifier, "overrides"), tok(ast.TokenRParen, ")"),
+		tok(ast.TokenKeyword, "objectEquals:"), tok(ast.TokenIdentifier, "expected"),
+	})
+	if result.Unsupported {
+		t.Fatalf("unsupported: %s", result.Reason)
+	}
+	r, ok := result.Body.Statements[0].(*Return)
+	if !ok {
+		t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+	}
+	equals, ok := r.Value.(*JSONPrimitiveExpr)
+	if !ok || equals.Operation != "objectEquals" || len(equals.Args) != 1 {
+		t.Fatalf("expected objectEquals with one argument, got %#v", r.Value)
+	}
+	merge, ok := equals.Receiver.(*JSONPrimitiveExpr)
+	if !ok || merge.Operation != "objectDeepMerge" {
+		t.Errorf("expected objectDeepMerge as the receiver, got %#v", equals.Receiver)
+	}
+}
+
+func TestParseFileOperationPrimitives(t *testing.T) {
+	tok := func(typ, v string) ast.Token { return ast.Token{Type: typ, Value: v} }
+	ret, at, file := tok(ast.TokenCaret, "^"), tok(ast.TokenAt, "@"), tok(ast.TokenIdentifier, "File")
+	path, dst, text := tok(ast.TokenIdentifier, "path"), tok(ast.TokenIdentifier, "dst"), tok(ast.TokenIdentifier, "text")
+
+	tests := []struct {
+		tokens []ast.Token
+		op     string
+		args   int
+	}{
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "readAll:"), path}, "fileReadAll", 1},
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "writeContents:"), text, tok(ast.TokenKeyword, "to:"), path}, "fileWriteContents", 2},
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "append:"), text, tok(ast.TokenKeyword, "to:"), path}, "fileAppend", 2},
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "delete:"), path}, "fileDelete", 1},
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "copy:"), path, tok(ast.TokenKeyword, "to:"), dst}, "fileCopy", 2},
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "listDirectory:"), path}, "fileListDirectory", 1},
+		{[]ast.Token{ret, at, file, tok(ast.TokenKeyword, "mkdirp:"), path}, "fileMkdirp", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.op, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if result.Unsupported {
+				t.Fatalf("unsupported: %s", result.Reason)
+			}
+			r, ok := result.Body.Statements[0].(*Return)
+			if !ok {
+				t.Fatalf("expected a return, got %#v", result.Body.Statements[0])
+			}
+			if prim, ok := r.Value.(*ClassPrimitiveExpr); !ok || prim.ClassName != "File" || prim.Operation != tt.op || len(prim.Args) != tt.args {
+				t.Errorf("expected %s with %d arguments, got %#v", tt.op, tt.args, r.Value)
+			}
+		})
+	}
+}
+
+func TestParseMethodUnsupportedLocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokens    []ast.Token
+		line, col int
+	}{
+		{"offending token", []ast.Token{
+			{Type: ast.TokenIdentifier, Value: "x", Line: 3, Col: 4},
+			{Type: ast.TokenAssign, Value: ":=", Line: 3, Col: 6},
+			{Type: ast.TokenSubshell, Value: "$(date)", Line: 3, Col: 9},
+		}, 3, 9},
+		{"past the end", []ast.Token{
+			{Type: ast.TokenPipe, Value: "|", Line: 2, Col: 4},
+			{Type: ast.TokenIdentifier, Value: "x", Line: 2, Col: 6},
+		}, 2, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseMethod(tt.tokens)
+			if !result.Unsupported {
+				t.Fatal("expected the method to be unsupported")
+			}
+			if result.Line != tt.line || result.Col != tt.col {
+				t.Errorf("located at %d:%d, want %d:%d (%s)", result.Line, result.Col, tt.line, tt.col, result.Reason)
+			}
+		})
+	}
+}
+
+// formatStatements renders conditionals, returns and assignments compactly
+func formatStatements(stmts []Statement) string {
+	var parts []string
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *IfExpr:
+			parts = append(parts, "if "+formatLogical(s.Condition)+" {"+formatStatements(s.TrueBlock)+"} else {"+formatStatements(s.FalseBlock)+"}")
+		case *Return:
+			parts = append(parts, "^"+formatValue(s.Value))
+		case *Assignment:
+			parts = append(parts, s.Target+":="+formatValue(s.Value))
+		default:
+			parts = append(parts, "?")
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func formatValue(expr Expr) string {
+	if s, ok := expr.(*StringLit); ok {
+		return s.Value
+	}
+	return formatLogical(expr)
+}
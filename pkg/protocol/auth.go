@@ -0,0 +1,217 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/chazu/procyon/pkg/mangle"
+)
+
+// A daemon or --serve-socket binary started with an AuthProvider runs every
+// request past it before dispatch: the request's "token" must identify a
+// principal, and the principal must be allowed the class and selector. A
+// refused request is answered with ExitUnauthorized and never reaches the
+// class. Sites with their own policy implement AuthProvider, or point an
+// ExecHook at a program, instead of changing the daemon.
+
+// AuthProvider validates request tokens and decides which classes their
+// principals may use
+type AuthProvider interface {
+	// Authenticate returns the principal token identifies, or an error if
+	// it identifies none. Requests without a token pass "".
+	Authenticate(token string) (principal string, err error)
+	// Authorize returns an error if principal may not send selector to
+	// class. Classes are compiled names (MyApp__Counter), or AdminClass.
+	Authorize(principal, class, selector string) error
+}
+
+// CheckAuth runs a request past p, returning the principal it was made by
+// or an error for a request to answer with ExitUnauthorized
+func CheckAuth(p AuthProvider, token, class, selector string) (string, error) {
+	principal, err := p.Authenticate(token)
+	if err != nil {
+		return "", fmt.Errorf("unauthorized: %w", err)
+	}
+	if err := p.Authorize(principal, class, selector); err != nil {
+		return "", fmt.Errorf("unauthorized: %w", err)
+	}
+	return principal, nil
+}
+
+// StaticTokens is an AuthProvider with a fixed table of tokens, each
+// identifying a principal allowed a set of classes
+type StaticTokens struct {
+	// tokens maps the SHA-256 of each token to its grant, so a lookup takes
+	// no longer for a near miss
+	tokens map[[sha256.Size]byte]tokenGrant
+}
+
+// tokenGrant is the principal of a static token and its classes, nil for all
+type tokenGrant struct {
+	principal string
+	classes   map[string]bool
+}
+
+// LoadStaticTokens reads a token file: one token per line, followed by its
+// principal and the classes it may use, all of them if none or * is given.
+//
+//	# token                principal  classes
+//	3f9c0d1e6a7b4c28       deploy     Counter MyApp::Ledger
+//	a1b2c3d4e5f60718       admin      *
+//
+// Blank lines and lines starting with # are ignored.
+func LoadStaticTokens(path string) (*StaticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseStaticTokens(f)
+}
+
+// ParseStaticTokens reads a token file from r (see LoadStaticTokens)
+func ParseStaticTokens(r io.Reader) (*StaticTokens, error) {
+	s := &StaticTokens{tokens: map[[sha256.Size]byte]tokenGrant{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a token and a principal", n)
+		}
+		key := sha256.Sum256([]byte(fields[0]))
+		if _, ok := s.tokens[key]; ok {
+			return nil, fmt.Errorf("line %d: token given twice", n)
+		}
+		grant := tokenGrant{principal: fields[1]}
+		for _, class := range fields[2:] {
+			if class == "*" {
+				grant.classes = nil
+				break
+			}
+			if grant.classes == nil {
+				grant.classes = map[string]bool{}
+			}
+			grant.classes[mangle.CompiledClass(class)] = true
+		}
+		s.tokens[key] = grant
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add gives token to principal, allowing it classes, or all of them if none
+// are given
+func (s *StaticTokens) Add(token, principal string, classes ...string) {
+	if s.tokens == nil {
+		s.tokens = map[[sha256.Size]byte]tokenGrant{}
+	}
+	grant := tokenGrant{principal: principal}
+	if len(classes) > 0 {
+		grant.classes = map[string]bool{}
+		for _, class := range classes {
+			grant.classes[mangle.CompiledClass(class)] = true
+		}
+	}
+	s.tokens[sha256.Sum256([]byte(token))] = grant
+}
+
+// Authenticate returns the principal of token
+func (s *StaticTokens) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", errors.New("the request has no token")
+	}
+	grant, ok := s.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return "", errors.New("unknown token")
+	}
+	return grant.principal, nil
+}
+
+// Authorize allows principal the classes of its tokens
+func (s *StaticTokens) Authorize(principal, class, selector string) error {
+	for _, grant := range s.tokens {
+		if grant.principal == principal && (grant.classes == nil || grant.classes[mangle.CompiledClass(class)]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not use class %s", principal, class)
+}
+
+// ExecHook is an AuthProvider that asks a program. Each decision runs
+// Command with sh -c and one JSON object on its stdin:
+//
+//	{"action":"authenticate","token":"..."}
+//	{"action":"authorize","principal":"deploy","class":"Counter","selector":"increment"}
+//
+// Exit status 0 accepts; for authenticate the first line of stdout is the
+// principal. Any other status, or a hook that cannot run or outlasts
+// Timeout, refuses, with the first line of stderr as the reason.
+type ExecHook struct {
+	Command string
+	// Timeout bounds each run of the hook (default 5s)
+	Timeout time.Duration
+}
+
+// Authenticate asks the hook for the principal of token
+func (h *ExecHook) Authenticate(token string) (string, error) {
+	return h.run(map[string]string{"action": "authenticate", "token": token})
+}
+
+// Authorize asks the hook whether principal may send selector to class
+func (h *ExecHook) Authorize(principal, class, selector string) error {
+	_, err := h.run(map[string]string{"action": "authorize", "principal": principal, "class": class, "selector": selector})
+	return err
+}
+
+// run runs the hook on req and returns the first line of its output
+func (h *ExecHook) run(req map[string]string) (string, error) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	input, _ := json.Marshal(req)
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("auth hook timed out after %v", timeout)
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", fmt.Errorf("auth hook: %w", err)
+		}
+		if reason := firstLine(stderr.String()); reason != "" {
+			return "", errors.New(reason)
+		}
+		return "", fmt.Errorf("auth hook refused the request (exit code %d)", exitErr.ExitCode())
+	}
+	return firstLine(stdout.String()), nil
+}
+
+// firstLine returns the first line of s without surrounding space
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(line)
+}
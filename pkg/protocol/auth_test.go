@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStaticTokens(t *testing.T) {
+	tokens, err := ParseStaticTokens(strings.NewReader(`
+# token  principal  classes
+t1 deploy Counter MyApp::Ledger
+t2 admin *
+t3 reader
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token, class, principal, err string
+	}{
+		{"t1", "Counter", "deploy", ""},
+		{"t1", "MyApp__Ledger", "deploy", ""},
+		{"t1", "MyApp::Ledger", "deploy", ""},
+		{"t1", "Ledger", "", "deploy may not use class Ledger"},
+		{"t1", AdminClass, "", "deploy may not use class @daemon"},
+		{"t2", AdminClass, "admin", ""},
+		{"t3", "Counter", "reader", ""},
+		{"t4", "Counter", "", "unknown token"},
+		{"", "Counter", "", "the request has no token"},
+	}
+	for _, tt := range tests {
+		principal, err := CheckAuth(tokens, tt.token, tt.class, "increment")
+		switch {
+		case tt.err == "" && (err != nil || principal != tt.principal):
+			t.Errorf("%s %s: got %q, %v, want %q", tt.token, tt.class, principal, err, tt.principal)
+		case tt.err != "" && (err == nil || err.Error() != "unauthorized: "+tt.err):
+			t.Errorf("%s %s: got %v, want %q", tt.token, tt.class, err, tt.err)
+		}
+	}
+
+	for _, file := range []string{"lonely\n", "t1 a\nt1 b\n"} {
+		if _, err := ParseStaticTokens(strings.NewReader(file)); err == nil {
+			t.Errorf("%q: expected an error", file)
+		}
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	hook := filepath.Join(t.TempDir(), "hook")
+	script := `#!/bin/sh
+read -r line
+case "$line" in
+*'"action":"authenticate"'*'"token":"good"'*) echo deploy ;;
+*'"action":"authenticate"'*) echo "token revoked" >&2; exit 1 ;;
+*'"class":"Counter"'*'"principal":"deploy"'*) exit 0 ;;
+*) exit 3 ;;
+esac
+`
+	if err := os.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	h := &ExecHook{Command: hook}
+
+	if principal, err := CheckAuth(h, "good", "Counter", "increment"); err != nil || principal != "deploy" {
+		t.Errorf("accepted request: got %q, %v", principal, err)
+	}
+	if _, err := CheckAuth(h, "bad", "Counter", "increment"); err == nil || err.Error() != "unauthorized: token revoked" {
+		t.Errorf("bad token: got %v, want the hook's reason", err)
+	}
+	if _, err := CheckAuth(h, "good", "Ledger", "post"); err == nil || !strings.Contains(err.Error(), "exit code 3") {
+		t.Errorf("refused class: got %v", err)
+	}
+	if _, err := CheckAuth(&ExecHook{Command: "exec sleep 5", Timeout: 50 * time.Millisecond}, "good", "Counter", "increment"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("slow hook: got %v", err)
+	}
+
+	resp := Response{ExitCode: ExitUnauthorized, Error: "unauthorized: token revoked"}
+	if !errors.Is(resp.Err(), ErrUnauthorized) || errors.Is(resp.Err(), ErrStorageBusy) {
+		t.Errorf("%v should match ErrUnauthorized only", resp.Err())
+	}
+}
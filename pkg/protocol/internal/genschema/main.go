@@ -0,0 +1,25 @@
+// genschema writes the published JSON Schema documents of package protocol
+// to schema/. It is run by go generate in pkg/protocol.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chazu/procyon/pkg/protocol"
+)
+
+func main() {
+	for _, name := range protocol.SchemaNames {
+		schema, err := protocol.GenerateSchema(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "genschema: %v\n", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(filepath.Join("schema", name+".schema.json"), schema, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "genschema: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package protocol defines the JSON messages exchanged with compiled
+// classes and publishes a JSON Schema for each, so that clients in other
+// languages can validate against them and contract tests can check the Bash
+// runtime's messages.
+//
+// Request and Response are the lines read and written by trashtalk-daemon.
+// ServeRequest and ServeResponse are the lines read and written by a class
+// binary run with --serve (and by WASM modules); their optional fields are
+// only understood by binaries compiled with the matching option.
+//
+// A request with "strict": true turns its connection strict: that request
+// and every later one are decoded with DecodeStrict, which rejects unknown
+// fields, duplicate keys and data after the document (see Decoder).
+//
+// Requests carry a "token" for daemons and --serve-socket binaries that
+// authenticate them. An AuthProvider validates it and decides per class;
+// StaticTokens and ExecHook are the built-in ones (see CheckAuth).
+//
+// The schemas in schema/ are generated from these types; run
+// go generate ./pkg/protocol after changing them.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+//go:generate go run ./internal/genschema
+
+// Exit codes carried by a Response
+const (
+	ExitOK              = 0
+	ExitError           = 1
+	ExitUnknownSelector = 200 // no native implementation; fall back to Bash
+	ExitTrashError      = 201 // unhandled _throw
+	ExitStorageBusy     = 202 // the instance store stayed locked; retry later
+	ExitUnauthorized    = 203 // the AuthProvider refused the request
+)
+
+// AdminClass is the class of requests handled by the daemon itself, such as
+// preload, rather than dispatched to a plugin
+const AdminClass = "@daemon"
+
+// ErrUnknownSelector is the error of a response with ExitUnknownSelector
+var ErrUnknownSelector = errors.New("unknown selector")
+
+// ErrStorageBusy matches the *ResponseError of a response with
+// ExitStorageBusy: the class gave up waiting for another process to release
+// the instance store, and the request can be sent again
+var ErrStorageBusy = errors.New("storage busy")
+
+// ErrUnauthorized matches the *ResponseError of a response with
+// ExitUnauthorized: the request's token was refused, or its principal may
+// not use the class
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Request is a trashtalk-daemon dispatch request
+type Request struct {
+	Class    string   `json:"class"`
+	Instance string   `json:"instance"`
+	Selector string   `json:"selector"`
+	Args     []string `json:"args"`
+	Strict   bool     `json:"strict,omitempty"` // decode this and later requests on the connection strictly
+	Token    string   `json:"token,omitempty"`  // checked by the daemon's AuthProvider, if it has one
+}
+
+// Response is trashtalk-daemon's answer to a Request
+type Response struct {
+	Instance string `json:"instance,omitempty"`
+	Result   string `json:"result,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ResponseError is the error of a response with a non-zero exit code other
+// than ExitUnknownSelector
+type ResponseError struct {
+	ExitCode int
+	Message  string
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("exit code %d", e.ExitCode)
+	}
+	return e.Message
+}
+
+// Is reports whether target is ErrStorageBusy and the response was
+// ExitStorageBusy, so that errors.Is(err, ErrStorageBusy) picks out the
+// failures worth retrying, or target is ErrUnauthorized and the response was
+// ExitUnauthorized
+func (e *ResponseError) Is(target error) bool {
+	switch target {
+	case ErrStorageBusy:
+		return e.ExitCode == ExitStorageBusy
+	case ErrUnauthorized:
+		return e.ExitCode == ExitUnauthorized
+	}
+	return false
+}
+
+// Err returns nil if the request succeeded, ErrUnknownSelector if the class
+// has no native implementation of the selector, and a *ResponseError
+// otherwise
+func (r Response) Err() error {
+	switch r.ExitCode {
+	case ExitOK:
+		return nil
+	case ExitUnknownSelector:
+		return ErrUnknownSelector
+	}
+	return &ResponseError{ExitCode: r.ExitCode, Message: r.Error}
+}
+
+// ServeRequest is a request to a class binary in --serve mode
+type ServeRequest struct {
+	InstanceID string            `json:"instance_id"`
+	Instance   string            `json:"instance"`
+	Selector   string            `json:"selector"`
+	Args       []string          `json:"args"`
+	Instances  map[string]string `json:"instances,omitempty"` // WASM modules only
+	AsOf       string            `json:"as_of,omitempty"`     // binaries compiled with --history only
+	Strict     bool              `json:"strict,omitempty"`    // decode this and later requests on the connection strictly
+	Token      string            `json:"token,omitempty"`     // --serve-socket binaries started with --auth-tokens or --auth-hook only
+}
+
+// ServeResponse is a class binary's answer to a ServeRequest
+type ServeResponse struct {
+	Instance string            `json:"instance,omitempty"`
+	Result   string            `json:"result,omitempty"`
+	ExitCode int               `json:"exit_code"`
+	Error    string            `json:"error,omitempty"`
+	Writes   map[string]string `json:"writes,omitempty"`  // WASM modules only
+	Deletes  []string          `json:"deletes,omitempty"` // WASM modules only
+}
@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// SchemaNames are the names of the published schemas, as accepted by Schema
+// and procyon --schema
+var SchemaNames = []string{"request", "response", "serve-request", "serve-response"}
+
+//go:embed schema/*.schema.json
+var schemaFiles embed.FS
+
+// Schema returns the published JSON Schema document for name
+func Schema(name string) ([]byte, error) {
+	if _, ok := messages[name]; !ok {
+		return nil, fmt.Errorf("unknown schema %q (use %s)", name, strings.Join(SchemaNames, ", "))
+	}
+	return schemaFiles.ReadFile("schema/" + name + ".schema.json")
+}
+
+// message documents one of the message types for its schema
+type message struct {
+	value       any
+	title       string
+	description string
+	required    []string
+	fields      map[string]string // JSON name -> description
+}
+
+var messages = map[string]message{
+	"request": {
+		value:       Request{},
+		title:       "trashtalk-daemon request",
+		description: "One line of JSON sent to trashtalk-daemon, on stdin or a Unix socket connection.",
+		required:    []string{"class", "selector"},
+		fields: map[string]string{
+			"class":    "Qualified class name, such as Counter or MyApp::Counter, or @daemon for requests to the daemon itself",
+			"instance": "Instance JSON; empty for class methods",
+			"selector": "Selector, with keyword parts joined by underscores (at_put_)",
+			"args":     "Arguments, as strings",
+			"strict":   "Reject unknown fields, duplicate keys and trailing data in this and every later request on the connection",
+			"token":    "Credential checked by the daemon's auth provider (--auth-tokens, --auth-hook) before dispatch",
+		},
+	},
+	"response": {
+		value:       Response{},
+		title:       "trashtalk-daemon response",
+		description: "One line of JSON answering a trashtalk-daemon request.",
+		required:    []string{"exit_code"},
+		fields: map[string]string{
+			"instance":  "Updated instance JSON",
+			"result":    "Method result",
+			"exit_code": "0 on success, 1 on error, 200 if the selector is not compiled (fall back to Bash), 201 for an unhandled _throw, 202 if the instance store stayed locked (retry later), 203 if the request was not authorized",
+			"error":     "Error message",
+		},
+	},
+	"serve-request": {
+		value:       ServeRequest{},
+		title:       "Compiled class --serve request",
+		description: "One line of JSON read by a compiled class binary run with --serve, or by a WASM module.",
+		required:    []string{"selector"},
+		fields: map[string]string{
+			"instance_id": "Instance ID; instance methods load it from storage unless instance is given",
+			"instance":    "Instance JSON; empty or the class name for class methods",
+			"selector":    "Selector, with keyword parts joined by underscores (at_put_)",
+			"args":        "Arguments, as strings",
+			"instances":   "Stored instance JSON by ID, supplied by the host of a WASM module",
+			"as_of":       "RFC 3339 time to dispatch read-only against the instance as it was saved then (--history binaries)",
+			"strict":      "Reject unknown fields, duplicate keys and trailing data in this and every later request on the connection",
+			"token":       "Credential checked before dispatch by --serve-socket binaries started with --auth-tokens or --auth-hook",
+		},
+	},
+	"serve-response": {
+		value:       ServeResponse{},
+		title:       "Compiled class --serve response",
+		description: "One line of JSON answering a --serve request.",
+		required:    []string{"exit_code"},
+		fields: map[string]string{
+			"instance":  "Updated instance JSON",
+			"result":    "Method result",
+			"exit_code": "0 on success, 1 on error, 200 if the selector is not compiled (fall back to Bash), 201 for an unhandled _throw, 202 if the instance store stayed locked (retry later), 203 if the request was not authorized",
+			"error":     "Error message",
+			"writes":    "Instance JSON by ID for the host of a WASM module to store",
+			"deletes":   "Instance IDs for the host of a WASM module to delete",
+		},
+	},
+}
+
+// GenerateSchema builds the JSON Schema document for name from its Go type.
+// The published documents in schema/ are its output.
+func GenerateSchema(name string) ([]byte, error) {
+	msg, ok := messages[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", name)
+	}
+
+	t := reflect.TypeOf(msg.value)
+	properties := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonName, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		prop, err := typeSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), field.Name, err)
+		}
+		// encoding/json writes a nil slice or map as null unless omitted
+		if kind := field.Type.Kind(); (kind == reflect.Slice || kind == reflect.Map) && options != "omitempty" {
+			prop["type"] = []string{prop["type"].(string), "null"}
+		}
+		doc, ok := msg.fields[jsonName]
+		if !ok {
+			return nil, fmt.Errorf("%s.%s (%s) is not documented", t.Name(), field.Name, jsonName)
+		}
+		prop["description"] = doc
+		properties[jsonName] = prop
+	}
+
+	schema := map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"$id":                  "urn:procyon:protocol:" + name,
+		"title":                msg.title,
+		"description":          msg.description,
+		"type":                 "object",
+		"properties":           properties,
+		"required":             msg.required,
+		"additionalProperties": false,
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(schema); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// typeSchema returns the schema of a message field of type t
+func typeSchema(t reflect.Type) (map[string]any, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}, nil
+	case reflect.Int:
+		return map[string]any{"type": "integer"}, nil
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}, nil
+	case reflect.Slice:
+		items, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "array", "items": items}, nil
+	case reflect.Map:
+		values, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"type": "object", "additionalProperties": values}, nil
+	}
+	return nil, fmt.Errorf("unsupported field type %s", t)
+}
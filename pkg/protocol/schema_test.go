@@ -0,0 +1,52 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSchemasUpToDate(t *testing.T) {
+	for _, name := range SchemaNames {
+		published, err := Schema(name)
+		if err != nil {
+			t.Fatalf("Schema(%q): %v", name, err)
+		}
+		generated, err := GenerateSchema(name)
+		if err != nil {
+			t.Fatalf("GenerateSchema(%q): %v", name, err)
+		}
+		if !bytes.Equal(published, generated) {
+			t.Errorf("schema/%s.schema.json is stale; run go generate ./pkg/protocol", name)
+		}
+	}
+}
+
+func TestSchemaProperties(t *testing.T) {
+	// Every field a message marshals to is a property of its schema
+	for name, value := range map[string]any{
+		"request":        Request{Class: "Counter", Args: []string{"1"}},
+		"serve-response": ServeResponse{Result: "x", Writes: map[string]string{"a": "{}"}, Deletes: []string{"b"}},
+	} {
+		data, _ := json.Marshal(value)
+		var fields map[string]any
+		json.Unmarshal(data, &fields)
+
+		published, _ := Schema(name)
+		var schema struct {
+			Properties map[string]any `json:"properties"`
+		}
+		if err := json.Unmarshal(published, &schema); err != nil {
+			t.Fatalf("%s: invalid schema: %v", name, err)
+		}
+		for field := range fields {
+			if _, ok := schema.Properties[field]; !ok {
+				t.Errorf("%s: %s is not in the schema", name, field)
+			}
+		}
+	}
+
+	if _, err := Schema("nope"); err == nil {
+		t.Error("expected an error for an unknown schema")
+	}
+}
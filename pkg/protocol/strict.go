@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Strict decoding rejects request lines json.Unmarshal would accept: fields
+// the message does not have, keys given twice (which of them counts is
+// unspecified) and anything after the document. A connection opts in with
+// "strict": true in a request, and every later request on it is decoded
+// strictly too, so existing clients keep working unchanged.
+
+// DecodeStrict decodes the single JSON document data into v, rejecting
+// unknown fields, duplicate keys and trailing data
+func DecodeStrict(data []byte, v any) error {
+	if err := checkDuplicateKeys(data); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("data after the request (one JSON document per line)")
+	}
+	return nil
+}
+
+// checkDuplicateKeys returns an error naming the first key an object of the
+// first document in data gives twice
+func checkDuplicateKeys(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// objects holds the keys seen in each open object, nil for an array
+	var objects []map[string]bool
+	key := false // the next token of the innermost object is a key
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			objects = append(objects, map[string]bool{})
+			key = true
+			continue
+		case json.Delim('['):
+			objects = append(objects, nil)
+			key = false
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			objects = objects[:len(objects)-1]
+		default:
+			if s, ok := tok.(string); ok && key {
+				if objects[len(objects)-1][s] {
+					return fmt.Errorf("duplicate key %q", s)
+				}
+				objects[len(objects)-1][s] = true
+				key = false
+				continue
+			}
+		}
+		// A value ended: the document, or an object's next token is a key
+		if len(objects) == 0 {
+			return nil
+		}
+		key = objects[len(objects)-1] != nil
+	}
+}
+
+// Decoder decodes the request lines of one connection, strictly from the
+// first request asking for it
+type Decoder struct {
+	strict bool
+}
+
+// Strict reports whether the connection decodes requests strictly
+func (d *Decoder) Strict() bool {
+	return d.strict
+}
+
+// Decode decodes the request line into v, a *Request or *ServeRequest
+func (d *Decoder) Decode(line []byte, v any) error {
+	if !d.strict {
+		if err := json.Unmarshal(line, v); err != nil {
+			return err
+		}
+		var opt struct {
+			Strict bool `json:"strict"`
+		}
+		json.Unmarshal(line, &opt)
+		if !opt.Strict {
+			return nil
+		}
+		d.strict = true
+	}
+	return DecodeStrict(line, v)
+}
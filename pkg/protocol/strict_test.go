@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeStrict(t *testing.T) {
+	tests := []struct {
+		line, err string
+	}{
+		{`{"class":"Counter","selector":"inc","args":["1"]}`, ""},
+		{`{"class":"Counter","selector":"inc","args":[{"class":1}]}`, "cannot unmarshal"},
+		{`{"class":"Counter","selector":"inc","selectr":"x"}`, `unknown field "selectr"`},
+		{`{"class":"Counter","selector":"inc","selector":"dec"}`, `duplicate key "selector"`},
+		{`{"class":"Counter","instance":"{\"n\":1}","selector":"inc"}`, ""},
+		{`{"class":"Counter","selector":"inc"} {"class":"Counter"}`, "data after the request"},
+		{`{"class":"Counter","selector":"inc"} x`, "data after the request"},
+	}
+	for _, tt := range tests {
+		var req Request
+		err := DecodeStrict([]byte(tt.line), &req)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.line, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.line, err, tt.err)
+		}
+	}
+
+	// Keys only clash within one object
+	var req ServeRequest
+	if err := DecodeStrict([]byte(`{"selector":"x","instances":{"selector":"{}","a":"{}"}}`), &req); err != nil {
+		t.Errorf("nested keys: %v", err)
+	}
+}
+
+func TestDecoderTurnsStrict(t *testing.T) {
+	var dec Decoder
+	var req Request
+	if err := dec.Decode([]byte(`{"class":"Counter","selector":"inc","extra":1}`), &req); err != nil || dec.Strict() {
+		t.Fatalf("lenient request: err %v, strict %v", err, dec.Strict())
+	}
+	if err := dec.Decode([]byte(`{"class":"Counter","selector":"inc","strict":true,"extra":1}`), &req); err == nil || !dec.Strict() {
+		t.Fatalf("strict request: err %v, strict %v", err, dec.Strict())
+	}
+	// Later requests stay strict without asking again
+	req = Request{}
+	if err := dec.Decode([]byte(`{"class":"Counter","selector":"inc","extra":1}`), &req); err == nil {
+		t.Error("expected the connection to stay strict")
+	}
+	if err := dec.Decode([]byte(`{"class":"Counter","selector":"inc"}`), &req); err != nil || req.Selector != "inc" {
+		t.Errorf("strict request: err %v, selector %q", err, req.Selector)
+	}
+}
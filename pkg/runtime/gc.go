@@ -0,0 +1,143 @@
+package runtime
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// classVarsSuffix ends the ID of the row holding a class's class instance
+// variables, such as "Counter::class"
+const classVarsSuffix = "::class"
+
+// ErrNoGCRoots is returned when garbage collection is requested without any
+// root classes. Without roots every instance would be unreachable.
+var ErrNoGCRoots = errors.New("no root classes configured")
+
+// GCReport summarizes a garbage collection pass over the instances table.
+type GCReport struct {
+	Total       int      `json:"total"`       // Instances examined
+	Reachable   int      `json:"reachable"`   // Instances reachable from a root
+	Unreachable []string `json:"unreachable"` // IDs of unreachable instances, sorted
+	Deleted     int      `json:"deleted"`     // Instances removed (0 unless remove was set)
+}
+
+// CollectGarbage finds instances that cannot be reached from any instance of
+// the given root classes. An instance references another when any string in
+// its stored JSON equals the other's ID; this covers ref: ivars as well as IDs
+// kept in collections. Class instance variable rows are always roots, since
+// they have no class field and would otherwise never be reachable. When
+// remove is true the unreachable instances are deleted.
+func (r *Runtime) CollectGarbage(rootClasses []string, remove bool) (*GCReport, error) {
+	if len(rootClasses) == 0 {
+		return nil, ErrNoGCRoots
+	}
+
+	rows, err := r.db.Query("SELECT id, data FROM instances")
+	if err != nil {
+		return nil, fmt.Errorf("querying instances: %w", err)
+	}
+
+	isRoot := make(map[string]bool, len(rootClasses))
+	for _, c := range rootClasses {
+		isRoot[c] = true
+	}
+
+	refs := make(map[string][]string) // id -> strings found in its data
+	var roots []string
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning instance: %w", err)
+		}
+		if strings.HasSuffix(id, classVarsSuffix) {
+			roots = append(roots, id)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(data), &value); err != nil {
+			// Unparseable data can't reference anything but is still an instance
+			refs[id] = nil
+			continue
+		}
+		refs[id] = collectStrings(value, nil)
+
+		if obj, ok := value.(map[string]interface{}); ok {
+			if class, ok := obj["class"].(string); ok && isRoot[class] {
+				roots = append(roots, id)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading instances: %w", err)
+	}
+
+	// Mark phase: walk references breadth-first from the roots
+	reachable := make(map[string]bool, len(refs))
+	queue := roots
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if reachable[id] {
+			continue
+		}
+		reachable[id] = true
+		for _, s := range refs[id] {
+			if _, exists := refs[s]; exists && !reachable[s] {
+				queue = append(queue, s)
+			}
+		}
+	}
+
+	report := &GCReport{
+		Total:       len(refs),
+		Reachable:   len(reachable),
+		Unreachable: []string{},
+	}
+	for id := range refs {
+		if !reachable[id] {
+			report.Unreachable = append(report.Unreachable, id)
+		}
+	}
+	sort.Strings(report.Unreachable)
+
+	if remove {
+		for _, id := range report.Unreachable {
+			if err := r.DeleteInstance(id); err != nil {
+				return report, err
+			}
+			report.Deleted++
+		}
+	}
+
+	return report, nil
+}
+
+// collectStrings appends every string found in a decoded JSON value,
+// including strings inside JSON text stored as a string.
+func collectStrings(value interface{}, out []string) []string {
+	switch v := value.(type) {
+	case string:
+		out = append(out, v)
+		// Collections are often stored as JSON text inside a string ivar
+		if len(v) > 0 && (v[0] == '[' || v[0] == '{') {
+			var nested interface{}
+			if json.Unmarshal([]byte(v), &nested) == nil {
+				out = collectStrings(nested, out)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			out = collectStrings(item, out)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			out = collectStrings(item, out)
+		}
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	r := testRuntime(t)
+
+	ownerID, _, err := r.CreateInstance("Person", map[string]interface{}{"name": "alice"})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	tagID, _, err := r.CreateInstance("Tag", map[string]interface{}{"label": "urgent"})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	_, _, err = r.CreateInstance("Project", map[string]interface{}{
+		"lead": ownerID,
+		"tags": `["` + tagID + `"]`,
+	})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	orphanID, _, err := r.CreateInstance("Person", map[string]interface{}{"name": "bob"})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+
+	report, err := r.CollectGarbage([]string{"Project"}, false)
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Total != 4 {
+		t.Errorf("Total = %d, want 4", report.Total)
+	}
+	if report.Reachable != 3 {
+		t.Errorf("Reachable = %d, want 3", report.Reachable)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0] != orphanID {
+		t.Errorf("Unreachable = %v, want [%s]", report.Unreachable, orphanID)
+	}
+	if report.Deleted != 0 {
+		t.Errorf("Deleted = %d, want 0 for report-only pass", report.Deleted)
+	}
+
+	report, err = r.CollectGarbage([]string{"Project"}, true)
+	if err != nil {
+		t.Fatalf("CollectGarbage(remove) error = %v", err)
+	}
+	if report.Deleted != 1 {
+		t.Errorf("Deleted = %d, want 1", report.Deleted)
+	}
+	if _, err := r.LoadInstance(orphanID); !errors.Is(err, ErrInstanceNotFound) {
+		t.Errorf("LoadInstance(orphan) error = %v, want ErrInstanceNotFound", err)
+	}
+	if _, err := r.LoadInstance(tagID); err != nil {
+		t.Errorf("LoadInstance(tag) error = %v, want reachable instance kept", err)
+	}
+}
+
+func TestCollectGarbageKeepsClassVars(t *testing.T) {
+	r := testRuntime(t)
+
+	defaultID, _, err := r.CreateInstance("Settings", map[string]interface{}{"theme": "dark"})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+	// Class instance variables are stored without a class field
+	if _, err := r.db.Exec("INSERT INTO instances (id, data) VALUES (?, ?)",
+		"Settings::class", `{"count":1,"default":"`+defaultID+`"}`); err != nil {
+		t.Fatalf("inserting class vars: %v", err)
+	}
+	orphanID, _, err := r.CreateInstance("Settings", map[string]interface{}{"theme": "light"})
+	if err != nil {
+		t.Fatalf("CreateInstance() error = %v", err)
+	}
+
+	report, err := r.CollectGarbage([]string{"Project"}, true)
+	if err != nil {
+		t.Fatalf("CollectGarbage() error = %v", err)
+	}
+	if report.Total != 3 {
+		t.Errorf("Total = %d, want 3", report.Total)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0] != orphanID {
+		t.Errorf("Unreachable = %v, want [%s]", report.Unreachable, orphanID)
+	}
+	if _, err := r.LoadInstance("Settings::class"); err != nil {
+		t.Errorf("LoadInstance(class vars) error = %v, want class vars kept", err)
+	}
+	if _, err := r.LoadInstance(defaultID); err != nil {
+		t.Errorf("LoadInstance(default) error = %v, want instance referenced by class vars kept", err)
+	}
+}
+
+func TestCollectGarbageRequiresRoots(t *testing.T) {
+	r := testRuntime(t)
+
+	if _, err := r.CollectGarbage(nil, true); !errors.Is(err, ErrNoGCRoots) {
+		t.Errorf("CollectGarbage(nil) error = %v, want ErrNoGCRoots", err)
+	}
+}
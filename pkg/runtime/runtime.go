@@ -14,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/chazu/procyon/pkg/mangle"
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -302,8 +303,7 @@ func (r *Runtime) saveInstanceLocked(id string, instance *Instance) error {
 func (r *Runtime) CreateInstance(className string, defaults map[string]interface{}) (string, *Instance, error) {
 	// Generate instance ID: lowercase class name + UUID
 	// For namespaced classes like "MyApp::Counter", use "myapp_counter_uuid"
-	idPrefix := strings.ToLower(strings.ReplaceAll(className, "::", "_"))
-	id := idPrefix + "_" + uuid.New().String()
+	id := mangle.InstanceIDPrefix(className) + "_" + uuid.New().String()
 
 	instance := &Instance{
 		ID:        id,
@@ -0,0 +1,249 @@
+// Package source parses Trashtalk source files with the Go lexer and parser
+// into the ast types that codegen reads from jq parser JSON, so tools can
+// compile a .trash file without the Bash toolchain.
+package source
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chazu/procyon/pkg/ast"
+	"github.com/chazu/procyon/pkg/lexer"
+	"github.com/chazu/procyon/pkg/parser"
+)
+
+// Parse parses the source of one class or trait
+func Parse(src string) (*ast.Class, error) {
+	tokens, err := lexer.New(src).Tokenize()
+	if err != nil {
+		return nil, fmt.Errorf("tokenizing: %w", err)
+	}
+	classAST, parseErrors := parser.ParseClass(ParserTokens(tokens))
+	if len(parseErrors) > 0 {
+		errs := make([]error, len(parseErrors))
+		for i := range parseErrors {
+			errs[i] = &parseErrors[i]
+		}
+		return nil, fmt.Errorf("parsing: %w", errors.Join(errs...))
+	}
+	return ToAST(classAST), nil
+}
+
+// ParseFile parses a .trash file, or reads a .json file of jq parser output
+func ParseFile(path string) (*ast.Class, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var class *ast.Class
+	if filepath.Ext(path) == ".json" {
+		class, err = ast.ParseBytes(data)
+	} else {
+		class, err = Parse(string(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return class, nil
+}
+
+// ParserTokens converts lexer tokens to the parser's token type.
+func ParserTokens(tokens []lexer.Token) []parser.Token {
+	result := make([]parser.Token, len(tokens))
+	for i, t := range tokens {
+		result[i] = parser.Token{
+			Type:  parser.TokenType(t.Type),
+			Value: t.Value,
+			Line:  t.Line,
+			Col:   t.Column,
+		}
+	}
+	return result
+}
+
+// ToAST converts a parsed class to the ast.Class consumed by codegen and
+// the IR builder, as if it had been read from the jq parser's JSON.
+func ToAST(classAST *parser.ClassAST) *ast.Class {
+	if classAST == nil {
+		return nil
+	}
+
+	astClass := &ast.Class{
+		Type:               classAST.Type,
+		Name:               classAST.Name,
+		Parent:             classAST.Parent,
+		Package:            classAST.Package,
+		Imports:            classAST.Imports,
+		IsTrait:            classAST.IsTrait,
+		IsAbstract:         classAST.IsAbstract,
+		AbstractMethods:    classAST.AbstractMethods,
+		Indexes:            classAST.Indexes,
+		Pragmas:            classAST.Pragmas,
+		Capabilities:       classAST.Capabilities,
+		Traits:             classAST.Traits,
+		Requires:           classAST.Requires,
+		MethodRequirements: classAST.MethodRequirements,
+		Location: ast.Location{
+			Line: classAST.Location.Line,
+			Col:  classAST.Location.Col,
+		},
+	}
+
+	// Convert instance variables
+	for _, v := range classAST.InstanceVars {
+		ivar := ast.InstanceVar{
+			Name: v.Name,
+			Type: v.Type,
+			Ref:  v.Ref,
+			Location: ast.Location{
+				Line: v.Location.Line,
+				Col:  v.Location.Col,
+			},
+		}
+		if v.Default != nil {
+			ivar.Default = ast.DefaultValue{
+				Type:  v.Default.Type,
+				Value: v.Default.Value,
+			}
+		}
+		astClass.InstanceVars = append(astClass.InstanceVars, ivar)
+	}
+
+	// Convert class instance variables
+	for _, v := range classAST.ClassInstanceVars {
+		cvar := ast.InstanceVar{
+			Name: v.Name,
+			Location: ast.Location{
+				Line: v.Location.Line,
+				Col:  v.Location.Col,
+			},
+		}
+		if v.Default != nil {
+			cvar.Default = ast.DefaultValue{
+				Type:  v.Default.Type,
+				Value: v.Default.Value,
+			}
+		}
+		astClass.ClassInstanceVars = append(astClass.ClassInstanceVars, cvar)
+	}
+
+	// Convert methods
+	for _, m := range classAST.Methods {
+		method := ast.Method{
+			Type:     m.Type,
+			Kind:     m.Kind,
+			Raw:      m.Raw,
+			Selector: m.Selector,
+			Keywords: m.Keywords,
+			Args:     m.Args,
+			Pragmas:  m.Pragmas,
+			ArgTypes: m.ArgTypes,
+			Location: ast.Location{
+				Line: m.Location.Line,
+				Col:  m.Location.Col,
+			},
+		}
+
+		// Convert body tokens
+		method.Body = ast.Block{
+			Type: m.Body.Type,
+		}
+		for _, t := range m.Body.Tokens {
+			method.Body.Tokens = append(method.Body.Tokens, ast.Token{
+				Type:  string(t.Type),
+				Value: t.Value,
+				Line:  t.Line,
+				Col:   t.Col,
+			})
+		}
+
+		astClass.Methods = append(astClass.Methods, method)
+	}
+
+	// Convert aliases
+	for _, a := range classAST.Aliases {
+		astClass.Aliases = append(astClass.Aliases, ast.Alias{
+			From: a.AliasName,
+			To:   a.OriginalMethod,
+			Location: ast.Location{
+				Line: a.Location.Line,
+				Col:  a.Location.Col,
+			},
+		})
+	}
+
+	// Convert trait conflict resolutions
+	for _, r := range classAST.Resolutions {
+		astClass.Resolutions = append(astClass.Resolutions, ast.Resolution{
+			Kind:     r.Type,
+			Selector: r.Selector,
+			Trait:    r.Trait,
+			Location: ast.Location{
+				Line: r.Location.Line,
+				Col:  r.Location.Col,
+			},
+		})
+	}
+
+	// Convert advice
+	for _, adv := range classAST.Advice {
+		advice := ast.Advice{
+			Type:     adv.AdviceType,
+			Selector: adv.Selector,
+			Location: ast.Location{
+				Line: adv.Location.Line,
+				Col:  adv.Location.Col,
+			},
+		}
+		advice.Body = ast.Block{
+			Type: adv.Block.Type,
+		}
+		for _, t := range adv.Block.Tokens {
+			advice.Body.Tokens = append(advice.Body.Tokens, ast.Token{
+				Type:  string(t.Type),
+				Value: t.Value,
+				Line:  t.Line,
+				Col:   t.Col,
+			})
+		}
+		astClass.Advice = append(astClass.Advice, advice)
+	}
+
+	// Convert versioning
+	astClass.ClassVersion = classAST.ClassVersion
+	for _, mig := range classAST.Migrations {
+		migration := ast.Migration{
+			From: mig.FromVersion,
+			Location: ast.Location{
+				Line: mig.Location.Line,
+				Col:  mig.Location.Col,
+			},
+		}
+		migration.Block = ast.Block{
+			Type: mig.Block.Type,
+		}
+		for _, t := range mig.Block.Tokens {
+			migration.Block.Tokens = append(migration.Block.Tokens, ast.Token{
+				Type:  string(t.Type),
+				Value: t.Value,
+				Line:  t.Line,
+				Col:   t.Col,
+			})
+		}
+		astClass.Migrations = append(astClass.Migrations, migration)
+	}
+	for _, r := range classAST.Renames {
+		astClass.Renames = append(astClass.Renames, ast.Rename{
+			From: r.From,
+			To:   r.To,
+			Location: ast.Location{
+				Line: r.Location.Line,
+				Col:  r.Location.Col,
+			},
+		})
+	}
+
+	return astClass
+}
@@ -0,0 +1,64 @@
+package source
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chazu/procyon/pkg/ast"
+)
+
+// traitExts are the trait file extensions tried in each directory
+var traitExts = []string{".trash", ".json"}
+
+// FindTrait returns the file defining trait name in the first of dirs that
+// has one. Each directory is searched for Name.trash, then Name.json; a
+// namespaced trait Pkg::Name is looked up as Pkg/Name before Name.
+func FindTrait(dirs []string, name string) (string, bool) {
+	candidates := []string{name}
+	if pkg, base, ok := strings.Cut(name, "::"); ok {
+		candidates = []string{filepath.Join(pkg, base), base}
+	}
+	for _, dir := range dirs {
+		for _, candidate := range candidates {
+			for _, ext := range traitExts {
+				path := filepath.Join(dir, candidate+ext)
+				if info, err := os.Stat(path); err == nil && !info.IsDir() {
+					return path, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// LoadTraits adds the traits the unit's class includes, but that the unit
+// does not provide, from the trait files in dirs. It returns the names of
+// the traits it loaded. Traits found in no directory are left to
+// MergeTraits to report as missing.
+func LoadTraits(unit *ast.CompilationUnit, dirs []string) ([]string, error) {
+	var loaded []string
+	for _, name := range unit.Class.Traits {
+		if _, ok := unit.Traits[name]; ok {
+			continue
+		}
+		path, ok := FindTrait(dirs, name)
+		if !ok {
+			continue
+		}
+		trait, err := ParseFile(path)
+		if err != nil {
+			return loaded, err
+		}
+		if !trait.IsTrait {
+			return loaded, fmt.Errorf("%s: %s is a class, not a trait", path, trait.QualifiedName())
+		}
+		if unit.Traits == nil {
+			unit.Traits = map[string]*ast.Class{}
+		}
+		unit.Traits[name] = trait
+		loaded = append(loaded, name)
+	}
+	return loaded, nil
+}
@@ -0,0 +1,50 @@
+package source
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chazu/procyon/pkg/ast"
+)
+
+func TestLoadTraits(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	write := func(dir, name, content string) {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(first, "Greeter.trash", "Greeter trait\n\n  method: greet [\n    ^ 'hello'\n  ]\n")
+	write(second, "Waver.json", `{"type":"class","name":"Waver","isTrait":true,"methods":[{"selector":"wave","kind":"instance"}]}`)
+	write(second, "MyApp/Shouter.trash", "Shouter trait\n\n  method: shout [\n    ^ 'HEY'\n  ]\n")
+	write(second, "Counter.trash", "Counter subclass: Object\n  instanceVars: value:0\n")
+
+	unit := &ast.CompilationUnit{Class: &ast.Class{
+		Name:   "Person",
+		Traits: []string{"Greeter", "Waver", "MyApp::Shouter", "Missing"},
+	}}
+	loaded, err := LoadTraits(unit, []string{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 3 {
+		t.Fatalf("loaded %v, want Greeter, Waver and MyApp::Shouter", loaded)
+	}
+	if got := unit.Traits["Greeter"]; got == nil || len(got.Methods) != 1 || got.Methods[0].Selector != "greet" {
+		t.Errorf("Greeter = %+v", got)
+	}
+	if got := unit.Traits["MyApp::Shouter"]; got == nil || got.Name != "Shouter" {
+		t.Errorf("MyApp::Shouter = %+v", got)
+	}
+	if _, ok := unit.Traits["Missing"]; ok {
+		t.Error("Missing should be left for MergeTraits to report")
+	}
+
+	unit = &ast.CompilationUnit{Class: &ast.Class{Name: "Person", Traits: []string{"Counter"}}}
+	if _, err := LoadTraits(unit, []string{second}); err == nil {
+		t.Error("expected an error for a class file on the trait path")
+	}
+}
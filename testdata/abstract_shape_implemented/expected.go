@@ -0,0 +1,2223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	uuid "github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	unix "golang.org/x/sys/unix"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+//go:embed Shape.trash
+var _sourceCode string
+
+var _contentHash string
+
+func init() {
+	hash := sha256.Sum256([]byte(_sourceCode))
+	_contentHash = hex.EncodeToString(hash[:])
+}
+
+var ErrUnknownSelector = errors.New("unknown selector")
+
+// ErrConflict reports that another process saved the instance first
+var ErrConflict = errors.New("instance modified concurrently")
+
+type Shape struct {
+	Class     string   `json:"class"`
+	CreatedAt string   `json:"created_at"`
+	Vars      []string `json:"_vars"`
+	Version   int      `json:"_version"`
+	Name      string   `json:"name"`
+	dirty     bool     `json:"-"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: Shape.native <instance_id> <selector> [args...]")
+		fmt.Fprintln(os.Stderr, "       Shape.native --source [--raw|--json]")
+		fmt.Fprintln(os.Stderr, "       Shape.native --hash")
+		fmt.Fprintln(os.Stderr, "       Shape.native --reembed <Shape.trash>")
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "--source":
+		format := "--raw"
+		if len(os.Args) > 2 {
+			format = os.Args[2]
+		}
+		switch format {
+		case "--raw":
+			fmt.Print(_sourceCode)
+		case "--json":
+			out, _ := json.Marshal(map[string]string{
+				"class":  "Shape",
+				"hash":   _contentHash,
+				"source": _sourceCode,
+			})
+			fmt.Println(string(out))
+		default:
+			fmt.Fprintln(os.Stderr, "Usage: Shape.native --source [--raw|--json]")
+			os.Exit(1)
+		}
+		return
+	case "--hash":
+		fmt.Println(_contentHash)
+		return
+	case "--info":
+		fmt.Printf("Class: Shape\nHash: %s\nSource length: %d bytes\n", _contentHash, len(_sourceCode))
+		return
+	case "--serve":
+		runServeMode()
+		return
+	case "--serve-socket":
+		if len(os.Args) < 3 {
+			fmt.Fprintln(os.Stderr, "Usage: Shape.native --serve-socket PATH [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]")
+			os.Exit(1)
+		}
+		idle := 10 * time.Minute
+		var auth authProvider
+		args := os.Args[3:]
+		for i := 0; i < len(args); i++ {
+			name, value, ok := strings.Cut(args[i], "=")
+			if !ok {
+				// The value is the next argument: --name value
+				if i+1 == len(args) {
+					fmt.Fprintln(os.Stderr, "Usage: Shape.native --serve-socket PATH [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]")
+					os.Exit(1)
+				}
+				i++
+				value = args[i]
+			}
+			switch name {
+			case "--idle-timeout":
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Invalid --idle-timeout: %v\n", err)
+					os.Exit(1)
+				}
+				idle = d
+			case "--auth-tokens":
+				if auth != nil || value == "" {
+					fmt.Fprintln(os.Stderr, "Usage: Shape.native --serve-socket PATH [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]")
+					os.Exit(1)
+				}
+				tokens, err := loadStaticTokens(value)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Invalid --auth-tokens: %v\n", err)
+					os.Exit(1)
+				}
+				auth = tokens
+			case "--auth-hook":
+				if auth != nil || value == "" {
+					fmt.Fprintln(os.Stderr, "Usage: Shape.native --serve-socket PATH [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]")
+					os.Exit(1)
+				}
+				auth = execHook(value)
+			default:
+				fmt.Fprintln(os.Stderr, "Usage: Shape.native --serve-socket PATH [--idle-timeout=DURATION] [--auth-tokens=FILE|--auth-hook=CMD]")
+				os.Exit(1)
+			}
+		}
+		runServeSocket(os.Args[2], idle, auth)
+		return
+	case "--reembed":
+		if len(os.Args) < 3 {
+			fmt.Fprintln(os.Stderr, "Usage: Shape.native --reembed <Shape.trash>")
+			os.Exit(1)
+		}
+		os.Exit(reembed(os.Args[2]))
+	}
+
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "Usage: Shape.native <instance_id> <selector> [args...]")
+		os.Exit(1)
+	}
+
+	receiver := os.Args[1]
+	selector := os.Args[2]
+	args := os.Args[3:]
+
+	if receiver == "Shape" {
+		result, err := dispatchClass(selector, args)
+		if err != nil {
+			if errors.Is(err, ErrUnknownSelector) {
+				os.Exit(200)
+			}
+			var te *TrashError
+			if errors.As(err, &te) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", te)
+				os.Exit(201)
+			}
+			if errors.Is(err, ErrStorageBusy) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(202)
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if result != "" {
+			fmt.Println(result)
+		}
+		return
+	}
+
+	db, err := openDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	if err := beginWork(); err != nil {
+		if errors.Is(err, ErrStorageBusy) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(202)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	instance, err := loadInstance(db, receiver)
+	if err != nil {
+		endWork(false)
+		if errors.Is(err, ErrStorageBusy) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(202)
+		}
+		os.Exit(200)
+	}
+
+	result, err := dispatch(instance, receiver, selector, args)
+	if err != nil {
+		endWork(false)
+		if errors.Is(err, ErrUnknownSelector) {
+			os.Exit(200)
+		}
+		var te *TrashError
+		if errors.As(err, &te) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", te)
+			os.Exit(201)
+		}
+		if errors.Is(err, ErrStorageBusy) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(202)
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if selector == "delete" {
+		if err := deleteInstance(db, receiver); err != nil {
+			endWork(false)
+			if errors.Is(err, ErrStorageBusy) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(202)
+			}
+			fmt.Fprintf(os.Stderr, "Error deleting instance: %v\n", err)
+			os.Exit(1)
+		}
+	} else if instance.dirty {
+		if err := saveInstance(db, receiver, instance); err != nil {
+			endWork(false)
+			if errors.Is(err, ErrStorageBusy) {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(202)
+			}
+			fmt.Fprintf(os.Stderr, "Error saving instance: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := endWork(true); err != nil {
+		if errors.Is(err, ErrStorageBusy) {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(202)
+		}
+		fmt.Fprintf(os.Stderr, "Error saving instance: %v\n", err)
+		os.Exit(1)
+	}
+
+	if result != "" {
+		fmt.Println(result)
+	}
+}
+
+func openDB() (*sql.DB, error) {
+	dbPath := os.Getenv("SQLITE_JSON_DB")
+	if dbPath == "" {
+		home, _ := os.UserHomeDir()
+		dbPath = filepath.Join(home, ".trashtalk", "instances.db")
+	}
+	return sql.Open("sqlite3", withBusyTimeout(dbPath))
+}
+
+// sharedDB is the connection --serve and --serve-socket open once for all
+// requests; it is nil when the process handles a single request
+var sharedDB *sql.DB
+
+// requestDB returns the database for the current request: the shared
+// connection when serving, a new one otherwise. Release it with releaseDB.
+func requestDB() (*sql.DB, error) {
+	if sharedDB != nil {
+		return sharedDB, nil
+	}
+	return openDB()
+}
+
+// releaseDB closes a database from requestDB unless it is the shared connection
+func releaseDB(db *sql.DB) {
+	if db != sharedDB {
+		db.Close()
+	}
+}
+
+// ErrStorageBusy reports that the database stayed locked by another process
+var ErrStorageBusy = errors.New("storage busy")
+
+// maxBusyAttempts bounds how often an operation on a locked database is tried,
+// busyBackoff is the wait before the first retry; it doubles after each one
+const (
+	maxBusyAttempts = 4
+	busyBackoff     = 25 * time.Millisecond
+)
+
+// withBusyTimeout adds the busy timeout to an SQLite database path
+func withBusyTimeout(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + "_busy_timeout=5000"
+}
+
+// _isBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED
+func _isBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+// _retryBusy runs op until it succeeds, fails for another reason than a locked
+// database or has been tried maxBusyAttempts times, in which case the error
+// wraps ErrStorageBusy
+func _retryBusy(op func() error) error {
+	backoff := busyBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if !_isBusy(err) {
+			return err
+		}
+		if attempt == maxBusyAttempts {
+			return fmt.Errorf("%w: %v", ErrStorageBusy, err)
+		}
+		// Jitter keeps processes that collided from retrying in step
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+}
+
+// stmtCache holds the statements prepared on sharedDB, by query
+var stmtCache = map[string]*sql.Stmt{}
+
+// cachedStmt returns query prepared on db if db is sharedDB, and nil otherwise.
+// During a unit of work the statement runs in its transaction.
+func cachedStmt(db *sql.DB, query string) *sql.Stmt {
+	if db == nil || db != sharedDB {
+		return nil
+	}
+	if work != nil && work.db != db {
+		return nil
+	}
+	stmt, ok := stmtCache[query]
+	if !ok {
+		// A query that cannot be prepared yet (no instances table) runs unprepared
+		prepared, err := db.Prepare(query)
+		if err != nil {
+			return nil
+		}
+		stmt = prepared
+		stmtCache[query] = stmt
+	}
+	if work != nil && work.tx != nil {
+		return work.tx.Stmt(stmt)
+	}
+	return stmt
+}
+
+// dbExec runs query on db like db.Exec, retrying while the database is locked
+func dbExec(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := _retryBusy(func() (err error) {
+		if stmt := cachedStmt(db, query); stmt != nil {
+			res, err = stmt.Exec(args...)
+			return err
+		}
+		res, err = workConn(db).Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// dbUpdate runs query on db like dbExec, answering conflict if it changes no row
+func dbUpdate(db *sql.DB, conflict error, query string, args ...interface{}) error {
+	res, err := dbExec(db, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return conflict
+	}
+	return nil
+}
+
+// dbQuery runs query on db like db.Query
+func dbQuery(db *sql.DB, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt := cachedStmt(db, query); stmt != nil {
+		return stmt.Query(args...)
+	}
+	return workConn(db).Query(query, args...)
+}
+
+// dbQueryRow runs query on db like db.QueryRow
+func dbQueryRow(db *sql.DB, query string, args ...interface{}) *sql.Row {
+	if stmt := cachedStmt(db, query); stmt != nil {
+		return stmt.QueryRow(args...)
+	}
+	return workConn(db).QueryRow(query, args...)
+}
+
+// unitOfWork is the transaction of the dispatch in progress
+type unitOfWork struct {
+	db   *sql.DB                // from requestDB, released when the work ends
+	tx   *sql.Tx                // nil if it could not be begun again after a send
+	err  error                  // of committing or beginning tx around a send
+	done []func(committed bool) // run when tx ends, last first
+}
+
+// work is the unit of work of the dispatch in progress, nil when writes run at
+// once. workMu lets one dispatch at a time use it.
+var (
+	work   *unitOfWork
+	workMu sync.Mutex
+)
+
+// beginWork begins the transaction of a dispatch
+func beginWork() error {
+	workMu.Lock()
+	db, err := requestDB()
+	if err != nil {
+		workMu.Unlock()
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		releaseDB(db)
+		workMu.Unlock()
+		return err
+	}
+	work = &unitOfWork{
+		db: db,
+		tx: tx,
+	}
+	return nil
+}
+
+// endWork ends the unit of work, committing it if commit and rolling it back
+// otherwise. A dispatch whose writes could not be committed before a send is
+// rolled back and fails with that error.
+func endWork(commit bool) error {
+	defer workMu.Unlock()
+	w := work
+	work = nil
+	defer releaseDB(w.db)
+	if !commit || w.err != nil {
+		if w.tx != nil {
+			w.tx.Rollback()
+		}
+		w.finish(false)
+		if !commit {
+			return nil
+		}
+		return w.err
+	}
+	err := w.tx.Commit()
+	w.finish(err == nil)
+	return workError(err)
+}
+
+// workError returns err, wrapping ErrStorageBusy if the database was locked
+func workError(err error) error {
+	if _isBusy(err) {
+		return fmt.Errorf("%w: %v", ErrStorageBusy, err)
+	}
+	return err
+}
+
+// finish runs the done functions with committed, and drops them
+func (w *unitOfWork) finish(committed bool) {
+	for i := len(w.done) - 1; i >= 0; i-- {
+		w.done[i](committed)
+	}
+	w.done = nil
+}
+
+// afterWork runs done when the transaction in progress ends, with whether it
+// was committed, and at once as committed when there is none
+func afterWork(done func(committed bool)) {
+	if work == nil || work.tx == nil {
+		done(true)
+		return
+	}
+	work.done = append(work.done, done)
+}
+
+// suspendWork commits the writes of the dispatch so far, so that another
+// process handling a message sees them and can write the database itself, and
+// lets another dispatch run until resume is called. resume begins a new
+// transaction for the rest of the dispatch.
+func suspendWork() (resume func()) {
+	w := work
+	if w == nil {
+		return func() {}
+	}
+	if w.tx != nil {
+		err := w.tx.Commit()
+		if err != nil && w.err == nil {
+			w.err = workError(err)
+		}
+		w.finish(err == nil)
+		w.tx = nil
+	}
+	work = nil
+	workMu.Unlock()
+	return func() {
+		workMu.Lock()
+		var err error
+		if w.tx, err = w.db.Begin(); err != nil && w.err == nil {
+			w.err = err
+		}
+		work = w
+	}
+}
+
+// dbConn runs the queries of the SQLite helpers: *sql.DB or *sql.Tx
+type dbConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// workConn returns the transaction of the unit of work in progress, or db
+func workConn(db *sql.DB) dbConn {
+	if work != nil && work.tx != nil {
+		return work.tx
+	}
+	return db
+}
+
+func loadInstance(db *sql.DB, id string) (*Shape, error) {
+	var data string
+	err := _retryBusy(func() error {
+		return dbQueryRow(db, "SELECT data FROM instances WHERE id = ?", id).Scan(&data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var instance Shape
+	if err := json.Unmarshal([]byte(data), &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+// saveInstance stores instance unless another process saved it since it was loaded,
+// in which case it returns ErrConflict. New IDs are inserted.
+func saveInstance(db *sql.DB, id string, instance *Shape) error {
+	loaded := instance.Version
+	instance.Version++
+	data, err := json.Marshal(instance)
+	if err == nil {
+		err = dbUpdate(db, fmt.Errorf("%w: %s", ErrConflict, id), "INSERT INTO instances (id, data) VALUES (?, json(?)) ON CONFLICT(id) DO UPDATE SET data = excluded.data WHERE COALESCE(json_extract(instances.data, '$._version'), 0) = ?", id, string(data), loaded)
+	}
+	if err != nil {
+		instance.Version = loaded
+		return err
+	}
+	// The instance is clean, at its new version, once the write is committed
+	afterWork(func(committed bool) {
+		if committed {
+			instance.dirty = false
+		} else {
+			instance.Version = loaded
+		}
+	})
+	return nil
+}
+
+func generateInstanceID(className string) string {
+	uuid := uuid.New().String()
+	return strings.ToLower(className) + "_" + uuid
+}
+
+func createInstance(db *sql.DB, id string, instance *Shape) error {
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	_, err = dbExec(db, "INSERT INTO instances (id, data) VALUES (?, json(?))", id, string(data))
+	return err
+}
+
+func deleteInstance(db *sql.DB, id string) error {
+	_, err := dbExec(db, "DELETE FROM instances WHERE id = ?", id)
+	return err
+}
+
+// DaemonRequest is a request to trashtalk-daemon, as pkg/client sends it
+type DaemonRequest struct {
+	Class    string   `json:"class"`
+	Instance string   `json:"instance"`
+	Selector string   `json:"selector"`
+	Args     []string `json:"args"`
+}
+
+// DaemonResponse is trashtalk-daemon's answer to a DaemonRequest
+type DaemonResponse struct {
+	Instance string `json:"instance,omitempty"`
+	Result   string `json:"result,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+// daemonSocket returns the Unix socket of the trashtalk-daemon messages are
+// sent through: $TRASHTALK_DAEMON_SOCKET, or /tmp/trashtalk.sock
+func daemonSocket() string {
+	if path := os.Getenv("TRASHTALK_DAEMON_SOCKET"); path != "" {
+		return path
+	}
+	return "/tmp/trashtalk.sock"
+}
+
+// _sendDaemon sends selector to receiver, a class name or an instance ID,
+// through the daemon and answers its response. ok is false if there is no
+// daemon socket, the daemon cannot be reached, the instance is not stored or
+// the daemon leaves the selector to Bash, so the message goes to trash-send.
+// An instance the daemon answers that cannot be stored is answered as an error.
+func _sendDaemon(receiver, selector string, args []string) (resp DaemonResponse, ok bool) {
+	path := daemonSocket()
+	if _, err := os.Stat(path); err != nil {
+		return resp, false
+	}
+	req := DaemonRequest{
+		Args:     args,
+		Class:    receiver,
+		Selector: selector,
+	}
+	// Class names are capitalized, instance IDs are not
+	isInstance := receiver != "" && !unicode.IsUpper(rune(receiver[0]))
+	if !isInstance {
+		resp, err := _daemonRoundTrip(path, req)
+		return resp, err == nil && resp.ExitCode != 200
+	}
+
+	db, err := requestDB()
+	if err != nil {
+		return resp, false
+	}
+	defer releaseDB(db)
+	var data string
+	err = dbQueryRow(db, "SELECT data FROM instances WHERE id = ?", receiver).Scan(&data)
+	var stored struct {
+		Class   string `json:"class"`
+		Version int    `json:"_version"`
+	}
+	// An instance the database does not hold, or holds corrupt, is left to Bash
+	if err == nil {
+		err = json.Unmarshal([]byte(data), &stored)
+	}
+	if err != nil {
+		return resp, false
+	}
+	req.Class, req.Instance = stored.Class, data
+
+	resp, err = _daemonRoundTrip(path, req)
+	if err != nil || resp.ExitCode == 200 {
+		return resp, false
+	}
+	// The daemon answers the instance; storing it is left to the sender, at the
+	// next version unless another process saved it since it was loaded
+	if resp.ExitCode == 0 && resp.Instance != "" {
+		var answered map[string]json.RawMessage
+		err = json.Unmarshal([]byte(resp.Instance), &answered)
+		if err == nil {
+			answered["_version"] = json.RawMessage(strconv.Itoa(stored.Version + 1))
+			var instance []byte
+			if instance, err = json.Marshal(answered); err == nil {
+				err = dbUpdate(db, fmt.Errorf("%w: %s", ErrConflict, receiver), "UPDATE instances SET data = json(?) WHERE id = ? AND COALESCE(json_extract(data, '$._version'), 0) = ?", string(instance), receiver, stored.Version)
+			}
+		}
+		if errors.Is(err, ErrStorageBusy) {
+			return DaemonResponse{
+				Error:    err.Error(),
+				ExitCode: 202,
+			}, true
+		}
+		if err != nil {
+			return DaemonResponse{
+				Error:    "SendError: " + err.Error(),
+				ExitCode: 201,
+			}, true
+		}
+	}
+	return resp, true
+}
+
+// _daemonRoundTrip sends req on a connection of its own to the daemon on path
+// and reads its response. Like pkg/client, it redials a refused connection
+// three times, waiting 50ms and then twice as long each time, and gives up
+// on a daemon that has not answered within 60s.
+func _daemonRoundTrip(path string, req DaemonRequest) (DaemonResponse, error) {
+	defer suspendWork()()
+	var resp DaemonResponse
+	line, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	var conn net.Conn
+	delay := 50 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if conn, err = net.DialTimeout("unix", path, 5*time.Second); err == nil {
+			break
+		}
+		if attempt == 3 || !errors.Is(err, syscall.ECONNREFUSED) {
+			return resp, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	if _, err := conn.Write(append(line, byte(0xa))); err != nil {
+		return resp, err
+	}
+	out, err := bufio.NewReader(conn).ReadBytes(byte(0xa))
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(out, &resp)
+	return resp, err
+}
+
+func sendMessage(receiver interface{}, selector string, args ...interface{}) string {
+	receiverStr := fmt.Sprintf("%v", receiver)
+	strArgs := make([]string, 0, len(args))
+	for _, arg := range args {
+		strArgs = append(strArgs, fmt.Sprintf("%v", arg))
+	}
+	if resp, ok := _sendDaemon(receiverStr, selector, strArgs); ok {
+		_raiseSendError(selector, resp.ExitCode, resp.Error)
+		return resp.Result
+	}
+	defer suspendWork()()
+	cmdArgs := append([]string{receiverStr, selector}, strArgs...)
+	home, _ := os.UserHomeDir()
+	dispatchScript := filepath.Join(home, ".trashtalk", "bin", "trash-send")
+	cmd := exec.Command(dispatchScript, cmdArgs...)
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		_raiseSendError(selector, exitErr.ExitCode(), strings.TrimPrefix(strings.TrimSpace(string(exitErr.Stderr)), "Error: "))
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// ServeRequest is the JSON request format for --serve mode
+type ServeRequest struct {
+	InstanceID string   `json:"instance_id"`
+	Instance   string   `json:"instance"`
+	Selector   string   `json:"selector"`
+	Args       []string `json:"args"`
+	Strict     bool     `json:"strict,omitempty"`
+	Token      string   `json:"token,omitempty"`
+}
+
+// ServeResponse is the JSON response format for --serve mode
+type ServeResponse struct {
+	Instance string `json:"instance,omitempty"`
+	Result   string `json:"result,omitempty"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+func runServeMode() {
+	db, err := openDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	sharedDB = db
+
+	scanner := bufio.NewScanner(os.Stdin)
+	// Increase buffer for large instance JSON
+	buf := make([]byte, 1048576)
+	scanner.Buffer(buf, len(buf))
+	strict := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		var req ServeRequest
+		if err := decodeServeRequest(line, &strict, &req); err != nil {
+			respond(ServeResponse{
+				Error:    "invalid JSON: " + err.Error(),
+				ExitCode: 1,
+			})
+			continue
+		}
+
+		resp := handleServeWork(db, &req)
+		respond(resp)
+	}
+}
+
+func respond(resp ServeResponse) {
+	out, _ := json.Marshal(resp)
+	fmt.Println(string(out))
+}
+
+// decodeServeRequest decodes a request line into req, strictly once *strict is
+// set by a request with "strict": true
+func decodeServeRequest(line string, strict *bool, req *ServeRequest) error {
+	if !*strict {
+		if err := json.Unmarshal([]byte(line), req); err != nil {
+			return err
+		}
+		if !req.Strict {
+			return nil
+		}
+		*strict = true
+	}
+	if err := checkDuplicateKeys(line); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(req); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("data after the request (one JSON document per line)")
+	}
+	return nil
+}
+
+// checkDuplicateKeys returns an error naming the first key an object of the
+// first document in line gives twice
+func checkDuplicateKeys(line string) error {
+	dec := json.NewDecoder(strings.NewReader(line))
+	// objects holds the keys seen in each open object, nil for an array
+	var objects []map[string]bool
+	key := false // the next token of the innermost object is a key
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			objects = append(objects, map[string]bool{})
+			key = true
+			continue
+		case json.Delim('['):
+			objects = append(objects, nil)
+			key = false
+			continue
+		case json.Delim('}'), json.Delim(']'):
+			objects = objects[:len(objects)-1]
+		default:
+			if s, ok := tok.(string); ok && key {
+				keys := objects[len(objects)-1]
+				if keys[s] {
+					return fmt.Errorf("duplicate key %q", s)
+				}
+				keys[s] = true
+				key = false
+				continue
+			}
+		}
+		// A value ended: the document, or an object's next token is a key
+		if len(objects) == 0 {
+			return nil
+		}
+		key = objects[len(objects)-1] != nil
+	}
+}
+
+// handleServeWork dispatches req as one unit of work: its transaction is
+// committed if it succeeds and rolled back otherwise
+func handleServeWork(db *sql.DB, req *ServeRequest) ServeResponse {
+	if err := beginWork(); err != nil {
+		return ServeResponse{
+			Error:    err.Error(),
+			ExitCode: 1,
+		}
+	}
+	resp := handleServeRequest(db, req)
+	if err := endWork(resp.ExitCode == 0); err != nil {
+		if errors.Is(err, ErrStorageBusy) {
+			return ServeResponse{
+				Error:    err.Error(),
+				ExitCode: 202,
+			}
+		}
+		return ServeResponse{
+			Error:    err.Error(),
+			ExitCode: 1,
+		}
+	}
+	return resp
+}
+
+func handleServeRequest(db *sql.DB, req *ServeRequest) ServeResponse {
+	if req.Instance == "" || req.Instance == "Shape" {
+		result, err := dispatchClass(req.Selector, req.Args)
+		if err != nil {
+			if errors.Is(err, ErrUnknownSelector) {
+				return ServeResponse{ExitCode: 200}
+			}
+			var te *TrashError
+			if errors.As(err, &te) {
+				return ServeResponse{
+					Error:    te.Error(),
+					ExitCode: 201,
+				}
+			}
+			if errors.Is(err, ErrStorageBusy) {
+				return ServeResponse{
+					Error:    err.Error(),
+					ExitCode: 202,
+				}
+			}
+			return ServeResponse{
+				Error:    err.Error(),
+				ExitCode: 1,
+			}
+		}
+		return ServeResponse{
+			ExitCode: 0,
+			Result:   result,
+		}
+	}
+
+	var instance Shape
+	if err := json.Unmarshal([]byte(req.Instance), &instance); err != nil {
+		return ServeResponse{
+			Error:    "invalid instance JSON: " + err.Error(),
+			ExitCode: 1,
+		}
+	}
+
+	result, err := dispatch(&instance, req.InstanceID, req.Selector, req.Args)
+	if err != nil {
+		if errors.Is(err, ErrUnknownSelector) {
+			return ServeResponse{ExitCode: 200}
+		}
+		var te *TrashError
+		if errors.As(err, &te) {
+			return ServeResponse{
+				Error:    te.Error(),
+				ExitCode: 201,
+			}
+		}
+		if errors.Is(err, ErrStorageBusy) {
+			return ServeResponse{
+				Error:    err.Error(),
+				ExitCode: 202,
+			}
+		}
+		return ServeResponse{
+			Error:    err.Error(),
+			ExitCode: 1,
+		}
+	}
+
+	if req.Selector == "delete" {
+		if err := deleteInstance(db, req.InstanceID); err != nil {
+			if errors.Is(err, ErrStorageBusy) {
+				return ServeResponse{
+					Error:    err.Error(),
+					ExitCode: 202,
+				}
+			}
+			return ServeResponse{
+				Error:    err.Error(),
+				ExitCode: 1,
+			}
+		}
+		return ServeResponse{
+			ExitCode: 0,
+			Result:   result,
+		}
+	}
+
+	updatedJSON, _ := json.Marshal(&instance)
+	return ServeResponse{
+		ExitCode: 0,
+		Instance: string(updatedJSON),
+		Result:   result,
+	}
+}
+
+// runServeSocket serves --serve requests on the Unix socket at path, one JSON
+// object per line on any number of connections. It exits after idle without
+// a request (0: never) or on SIGINT or SIGTERM, removing the socket. Requests
+// auth refuses are not dispatched.
+func runServeSocket(path string, idle time.Duration, auth authProvider) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		fmt.Fprintf(os.Stderr, "Error: %s is already being served\n", path)
+		os.Exit(1)
+	}
+	os.Remove(path)
+
+	db, err := openDB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening database: %v\n", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	sharedDB = db
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listening on %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	// Closing the listener unlinks the socket file
+	defer ln.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		ln.Close()
+	}()
+
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.AfterFunc(idle, func() {
+			ln.Close()
+		})
+	}
+	var mu sync.Mutex
+	dispatch := func(req *ServeRequest) ServeResponse {
+		mu.Lock()
+		defer mu.Unlock()
+		// A long request does not count as idle time
+		if timer != nil {
+			timer.Stop()
+			defer timer.Reset(idle)
+		}
+		return handleServeWork(db, req)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			// Closed by the idle timer or a signal; let the request in progress finish
+			mu.Lock()
+			return
+		}
+		go serveSocketConn(conn, auth, dispatch)
+	}
+}
+
+// serveSocketConn answers the requests on one connection until the client
+// closes it
+func serveSocketConn(conn net.Conn, auth authProvider, dispatch func(*ServeRequest) ServeResponse) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	// Increase buffer for large instance JSON
+	buf := make([]byte, 1048576)
+	scanner.Buffer(buf, len(buf))
+	enc := json.NewEncoder(conn)
+	strict := false
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		var req ServeRequest
+		var resp ServeResponse
+		if err := decodeServeRequest(line, &strict, &req); err != nil {
+			resp = ServeResponse{
+				Error:    "invalid JSON: " + err.Error(),
+				ExitCode: 1,
+			}
+		} else if err := authorizeServeRequest(auth, &req); err != nil {
+			resp = ServeResponse{
+				Error:    err.Error(),
+				ExitCode: 203,
+			}
+		} else {
+			resp = dispatch(&req)
+		}
+		if enc.Encode(resp) != nil {
+			return
+		}
+	}
+}
+
+// authProvider validates request tokens and decides which classes their
+// principals may use
+type authProvider interface {
+	Authenticate(token string) (string, error)
+	Authorize(principal, class, selector string) error
+}
+
+// authorizeServeRequest runs req past auth, if there is one, returning an
+// error for a request to refuse
+func authorizeServeRequest(auth authProvider, req *ServeRequest) error {
+	if auth == nil {
+		return nil
+	}
+	principal, err := auth.Authenticate(req.Token)
+	if err != nil {
+		return fmt.Errorf("unauthorized: %w", err)
+	}
+	if err := auth.Authorize(principal, "Shape", req.Selector); err != nil {
+		return fmt.Errorf("unauthorized: %w", err)
+	}
+	return nil
+}
+
+// tokenGrant is the principal of a static token and its classes, nil for all
+type tokenGrant struct {
+	principal string
+	classes   map[string]bool
+}
+
+// staticTokens maps the SHA-256 of each token of an --auth-tokens file to its
+// grant
+type staticTokens map[[sha256.Size]byte]tokenGrant
+
+// loadStaticTokens reads a token file: one token per line, followed by its
+// principal and the classes it may use, all of them if none or * is given
+func loadStaticTokens(path string) (staticTokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := staticTokens{}
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a token and a principal", i+1)
+		}
+		key := sha256.Sum256([]byte(fields[0]))
+		if _, ok := tokens[key]; ok {
+			return nil, fmt.Errorf("line %d: token given twice", i+1)
+		}
+		grant := tokenGrant{principal: fields[1]}
+		for _, class := range fields[2:] {
+			if class == "*" {
+				grant.classes = nil
+				break
+			}
+			if grant.classes == nil {
+				grant.classes = map[string]bool{}
+			}
+			grant.classes[strings.ReplaceAll(class, "::", "__")] = true
+		}
+		tokens[key] = grant
+	}
+	return tokens, nil
+}
+
+// Authenticate returns the principal of token
+func (s staticTokens) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", errors.New("the request has no token")
+	}
+	grant, ok := s[sha256.Sum256([]byte(token))]
+	if !ok {
+		return "", errors.New("unknown token")
+	}
+	return grant.principal, nil
+}
+
+// Authorize allows principal the classes of its tokens
+func (s staticTokens) Authorize(principal, class, selector string) error {
+	for _, grant := range s {
+		if grant.principal == principal && (grant.classes == nil || grant.classes[class]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not use class %s", principal, class)
+}
+
+// execHook is the command of --auth-hook, run with sh -c and one JSON object
+// on its stdin for each decision. Exit status 0 accepts, with the principal
+// as the first line of stdout; any other refuses, with the first line of
+// stderr as the reason.
+type execHook string
+
+// Authenticate asks the hook for the principal of token
+func (h execHook) Authenticate(token string) (string, error) {
+	return h.run(map[string]string{
+		"action": "authenticate",
+		"token":  token,
+	})
+}
+
+// Authorize asks the hook whether principal may send selector to class
+func (h execHook) Authorize(principal, class, selector string) error {
+	_, err := h.run(map[string]string{
+		"action":    "authorize",
+		"class":     class,
+		"principal": principal,
+		"selector":  selector,
+	})
+	return err
+}
+
+// run runs the hook on req, for at most 5s like protocol.ExecHook, and returns
+// the first line of its output
+func (h execHook) run(req map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	input, _ := json.Marshal(req)
+	cmd := exec.CommandContext(ctx, "sh", "-c", string(h))
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(append(input, '\n'))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", errors.New("auth hook timed out after 5s")
+		}
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", fmt.Errorf("auth hook: %w", err)
+		}
+		if reason := authFirstLine(stderr.String()); reason != "" {
+			return "", errors.New(reason)
+		}
+		return "", fmt.Errorf("auth hook refused the request (exit code %d)", exitErr.ExitCode())
+	}
+	return authFirstLine(stdout.String()), nil
+}
+
+// authFirstLine returns the first line of s without surrounding space
+func authFirstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(line)
+}
+
+// sourceLineage returns the source hashes the manifest lists for the class,
+// oldest first. The manifest is $TRASHTALK_MANIFEST or manifest.json next to
+// the binary.
+func sourceLineage() ([]string, error) {
+	path := os.Getenv("TRASHTALK_MANIFEST")
+	if path == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(filepath.Dir(exe), "manifest.json")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest struct {
+		Classes []struct {
+			Name    string   `json:"name"`
+			Package string   `json:"package"`
+			Hashes  []string `json:"hashes"`
+		} `json:"classes"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, c := range manifest.Classes {
+		if c.Name == "Shape" && c.Package == "" {
+			return c.Hashes, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no entry for Shape", path)
+}
+
+// reembed checks the source file at path against the embedded source (--reembed)
+// and answers the exit code. A later revision in the manifest lineage is rebuilt
+// with $PROCYON_BUILD, or the rebuild commands are printed.
+func reembed(path string) int {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	sum := sha256.Sum256(src)
+	hash := hex.EncodeToString(sum[:])
+	if hash == _contentHash {
+		fmt.Printf("%s is the embedded source (%s)\n", path, hash)
+		return 0
+	}
+
+	lineage, err := sourceLineage()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot verify %s: %v\n", path, err)
+		return 1
+	}
+	embedded, given := -1, -1
+	for i, h := range lineage {
+		if h == _contentHash {
+			embedded = i
+		}
+		if h == hash {
+			given = i
+		}
+	}
+	switch {
+	case embedded < 0:
+		fmt.Fprintf(os.Stderr, "Error: the embedded source (%s) is not in the manifest lineage of Shape\n", _contentHash)
+		return 1
+	case given < 0:
+		fmt.Fprintf(os.Stderr, "Error: %s (%s) is not in the manifest lineage of Shape\n", path, hash)
+		return 1
+	case given < embedded:
+		fmt.Fprintf(os.Stderr, "Error: %s (%s) is older than the embedded source (%s)\n", path, hash, _contentHash)
+		return 1
+	}
+
+	if build := os.Getenv("PROCYON_BUILD"); build != "" {
+		cmd := exec.Command("sh", "-c", build)
+		cmd.Env = append(os.Environ(), "TRASH_CLASS=Shape", "TRASH_SOURCE="+path)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", build, err)
+			return 1
+		}
+		return 0
+	}
+	fmt.Printf("%s (%s) is a later revision of the embedded source (%s).\nRebuild Shape.native from it:\n\n  driver.bash parse %s | procyon > Shape/main.go\n  cp %s Shape/Shape.trash\n  go build -o Shape.native ./Shape\n\nor set PROCYON_BUILD to the build command.\n", path, hash, _contentHash, path, path)
+	return 0
+}
+
+// Common conversion helpers
+func _boolToString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// _jsonDecode unmarshals data into v, decoding numbers as json.Number
+func _jsonDecode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func _toStr(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if n, ok := v.(json.Number); ok {
+		return n.String()
+	}
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Array helpers for native slice operations
+func _arrayFirst(arr []interface{}) interface{} {
+	if len(arr) == 0 {
+		return nil
+	}
+	return arr[0]
+}
+
+func _arrayLast(arr []interface{}) interface{} {
+	if len(arr) == 0 {
+		return nil
+	}
+	return arr[len(arr)-1]
+}
+
+func _arrayAtPut(arr []interface{}, idx int, val interface{}) []interface{} {
+	// Handle negative indices
+	if idx < 0 {
+		idx = len(arr) + idx
+	}
+	if idx < 0 || idx >= len(arr) {
+		return arr
+	}
+	result := make([]interface{}, len(arr))
+	copy(result, arr)
+	result[idx] = val
+	return result
+}
+
+func _arrayRemoveAt(arr []interface{}, idx int) []interface{} {
+	// Handle negative indices
+	if idx < 0 {
+		idx = len(arr) + idx
+	}
+	if idx < 0 || idx >= len(arr) {
+		return arr
+	}
+	result := make([]interface{}, 0, len(arr)-1)
+	result = append(result, arr[:idx]...)
+	result = append(result, arr[idx+1:]...)
+	return result
+}
+
+// Map helpers for native map operations
+func _mapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func _mapValues(m map[string]interface{}) []interface{} {
+	vals := make([]interface{}, 0, len(m))
+	for _, v := range m {
+		vals = append(vals, v)
+	}
+	return vals
+}
+
+func _mapHasKey(m map[string]interface{}, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+func _mapAtPut(m map[string]interface{}, key string, val interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m)+1)
+	for k, v := range m {
+		result[k] = v
+	}
+	result[key] = val
+	return result
+}
+
+func _mapRemoveKey(m map[string]interface{}, key string) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if k != key {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// JSON string parsing helpers (for string-typed variables containing JSON)
+func _jsonArrayLen(jsonStr string) int {
+	var arr []interface{}
+	if err := _jsonDecode([]byte(jsonStr), &arr); err != nil {
+		return 0
+	}
+	return len(arr)
+}
+
+func _jsonArrayFirst(jsonStr string) string {
+	var arr []interface{}
+	if err := _jsonDecode([]byte(jsonStr), &arr); err != nil || len(arr) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v", arr[0])
+}
+
+func _jsonArrayLast(jsonStr string) string {
+	var arr []interface{}
+	if err := _jsonDecode([]byte(jsonStr), &arr); err != nil || len(arr) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v", arr[len(arr)-1])
+}
+
+func _jsonArrayIsEmpty(jsonStr string) bool {
+	var arr []interface{}
+	if err := _jsonDecode([]byte(jsonStr), &arr); err != nil {
+		return true
+	}
+	return len(arr) == 0
+}
+
+func _jsonArrayPush(jsonVal interface{}, val interface{}) string {
+	jsonStr := fmt.Sprintf("%v", jsonVal)
+	var arr []interface{}
+	_jsonDecode([]byte(jsonStr), &arr)
+	arr = append(arr, val)
+	result, _ := json.Marshal(arr)
+	return string(result)
+}
+
+func _jsonArrayAt(jsonStr string, idx int) string {
+	var arr []interface{}
+	if err := _jsonDecode([]byte(jsonStr), &arr); err != nil {
+		return ""
+	}
+	if idx < 0 {
+		idx = len(arr) + idx
+	}
+	if idx < 0 || idx >= len(arr) {
+		return ""
+	}
+	return fmt.Sprintf("%v", arr[idx])
+}
+
+func _jsonArrayAtPut(jsonStr string, idx int, val interface{}) string {
+	var arr []interface{}
+	_jsonDecode([]byte(jsonStr), &arr)
+	if idx < 0 {
+		idx = len(arr) + idx
+	}
+	if idx >= 0 && idx < len(arr) {
+		arr[idx] = val
+	}
+	result, _ := json.Marshal(arr)
+	return string(result)
+}
+
+func _jsonArrayRemoveAt(jsonStr string, idx int) string {
+	var arr []interface{}
+	_jsonDecode([]byte(jsonStr), &arr)
+	if idx < 0 {
+		idx = len(arr) + idx
+	}
+	if idx >= 0 && idx < len(arr) {
+		arr = append(arr[:idx], arr[idx+1:]...)
+	}
+	result, _ := json.Marshal(arr)
+	return string(result)
+}
+
+func _jsonObjectLen(jsonStr string) int {
+	var m map[string]interface{}
+	if err := _jsonDecode([]byte(jsonStr), &m); err != nil {
+		return 0
+	}
+	return len(m)
+}
+
+func _jsonObjectKeys(jsonStr string) []string {
+	var m map[string]interface{}
+	if err := _jsonDecode([]byte(jsonStr), &m); err != nil {
+		return nil
+	}
+	return _mapKeys(m)
+}
+
+func _jsonObjectValues(jsonStr string) []interface{} {
+	var m map[string]interface{}
+	if err := _jsonDecode([]byte(jsonStr), &m); err != nil {
+		return nil
+	}
+	return _mapValues(m)
+}
+
+func _jsonObjectIsEmpty(jsonStr string) bool {
+	var m map[string]interface{}
+	if err := _jsonDecode([]byte(jsonStr), &m); err != nil {
+		return true
+	}
+	return len(m) == 0
+}
+
+func _jsonObjectAt(jsonVal any, key string) string {
+	jsonStr := fmt.Sprintf("%v", jsonVal)
+	var m map[string]interface{}
+	if err := _jsonDecode([]byte(jsonStr), &m); err != nil {
+		return ""
+	}
+	if v, ok := m[key]; ok {
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
+
+func _jsonObjectAtPut(jsonVal any, key string, val any) string {
+	jsonStr := fmt.Sprintf("%v", jsonVal)
+	var m map[string]interface{}
+	_jsonDecode([]byte(jsonStr), &m)
+	if m == nil {
+		m = make(map[string]interface{})
+	}
+	m[key] = val
+	result, _ := json.Marshal(m)
+	return string(result)
+}
+
+func _jsonObjectHasKey(jsonVal any, key string) bool {
+	jsonStr := fmt.Sprintf("%v", jsonVal)
+	var m map[string]interface{}
+	if err := _jsonDecode([]byte(jsonStr), &m); err != nil {
+		return false
+	}
+	_, ok := m[key]
+	return ok
+}
+
+func _jsonObjectRemoveKey(jsonVal any, key string) string {
+	jsonStr := fmt.Sprintf("%v", jsonVal)
+	var m map[string]interface{}
+	_jsonDecode([]byte(jsonStr), &m)
+	delete(m, key)
+	result, _ := json.Marshal(m)
+	return string(result)
+}
+
+// String primitive helpers
+func _stringSubstring(s string, start int, length int) string {
+	if start < 0 {
+		start = 0
+	}
+	if start >= len(s) {
+		return ""
+	}
+	end := start + length
+	if end > len(s) {
+		end = len(s)
+	}
+	return s[start:end]
+}
+
+// File primitive helpers
+func _fileExists(path string) string {
+	_, err := os.Stat(path)
+	return _boolToString(err == nil)
+}
+
+func _fileIsFile(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Mode().IsRegular())
+}
+
+func _fileIsDirectory(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.IsDir())
+}
+
+func _fileIsSymlink(path string) string {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Mode()&os.ModeSymlink != 0)
+}
+
+func _fileIsFifo(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Mode()&os.ModeNamedPipe != 0)
+}
+
+func _fileIsSocket(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Mode()&os.ModeSocket != 0)
+}
+
+func _fileIsBlockDevice(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0)
+}
+
+func _fileIsCharDevice(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Mode()&os.ModeCharDevice != 0)
+}
+
+func _fileIsReadable(path string) string {
+	err := unix.Access(path, unix.R_OK)
+	return _boolToString(err == nil)
+}
+
+func _fileIsWritable(path string) string {
+	err := unix.Access(path, unix.W_OK)
+	return _boolToString(err == nil)
+}
+
+func _fileIsExecutable(path string) string {
+	err := unix.Access(path, unix.X_OK)
+	return _boolToString(err == nil)
+}
+
+func _fileIsEmpty(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Size() == 0)
+}
+
+func _fileNotEmpty(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "false"
+	}
+	return _boolToString(info.Size() > 0)
+}
+
+func _fileIsNewer(path1 string, path2 string) string {
+	info1, err1 := os.Stat(path1)
+	info2, err2 := os.Stat(path2)
+	if err1 != nil || err2 != nil {
+		return "false"
+	}
+	return _boolToString(info1.ModTime().After(info2.ModTime()))
+}
+
+func _fileIsOlder(path1 string, path2 string) string {
+	info1, err1 := os.Stat(path1)
+	info2, err2 := os.Stat(path2)
+	if err1 != nil || err2 != nil {
+		return "false"
+	}
+	return _boolToString(info1.ModTime().Before(info2.ModTime()))
+}
+
+func _fileIsSame(path1 string, path2 string) string {
+	info1, err1 := os.Stat(path1)
+	info2, err2 := os.Stat(path2)
+	if err1 != nil || err2 != nil {
+		return "false"
+	}
+	return _boolToString(os.SameFile(info1, info2))
+}
+
+// _queryIDs runs query and answers the instance IDs it selects, one per line
+func _queryIDs(query string, args ...interface{}) (string, error) {
+	db, err := requestDB()
+	if err != nil {
+		return "", err
+	}
+	defer releaseDB(db)
+
+	rows, err := dbQuery(db, query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	return strings.Join(ids, "\n"), rows.Err()
+}
+
+// toInt converts interface{} to int for arithmetic in iteration blocks
+func toInt(v interface{}) int {
+	switch x := v.(type) {
+	case int:
+		return x
+	case int64:
+		return int(x)
+	case float64:
+		return int(x)
+	case json.Number:
+		return toInt(string(x))
+	case string:
+		if n, ok := toNum(x).(int); ok {
+			return n
+		}
+		// Decimal strings truncate like float64 values
+		return int(toFloat(x))
+	default:
+		return 0
+	}
+}
+
+// toNum converts v to an int if it is integral, otherwise to a float64
+func toNum(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int, float64:
+		return x
+	case int64:
+		return int(x)
+	case json.Number:
+		return toNum(string(x))
+	case string:
+		s := strings.TrimSpace(x)
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return 0
+}
+
+// toFloat converts interface{} to float64 for decimal arithmetic
+func toFloat(v interface{}) float64 {
+	switch x := toNum(v).(type) {
+	case int:
+		return float64(x)
+	case float64:
+		return x
+	}
+	return 0
+}
+
+// _arith applies op with int arithmetic when both operands are integral,
+// and float64 arithmetic otherwise
+func _arith(op string, a, b interface{}) interface{} {
+	x, y := toNum(a), toNum(b)
+	i, iok := x.(int)
+	j, jok := y.(int)
+	if iok && jok {
+		switch op {
+		case "+":
+			return i + j
+		case "-":
+			return i - j
+		case "*":
+			return i * j
+		case "/":
+			return i / j
+		}
+	}
+	p, q := toFloat(x), toFloat(y)
+	switch op {
+	case "+":
+		return p + q
+	case "-":
+		return p - q
+	case "*":
+		return p * q
+	case "/":
+		return p / q
+	}
+	return 0
+}
+
+// _addInt adds n to the integer held in s, falling back to _arith for
+// decimals and anything else that is not a plain integer
+func _addInt(s string, n int) string {
+	if i, err := strconv.Atoi(s); err == nil {
+		return strconv.Itoa(i + n)
+	}
+	return _toStr(_arith("+", s, n))
+}
+
+// _isNum reports whether v is a number or a string holding one
+func _isNum(v interface{}) bool {
+	switch x := v.(type) {
+	case int, int64, float64, json.Number:
+		return true
+	case string:
+		s := strings.TrimSpace(x)
+		// ParseFloat also accepts words like "inf" and "nan"; those stay strings
+		if s == "" || strings.Trim(s, "0123456789.eE+-") != "" {
+			return false
+		}
+		_, err := strconv.ParseFloat(s, 64)
+		return err == nil
+	}
+	return false
+}
+
+// _compare applies a comparison numerically when both operands look numeric,
+// exactly when both are integers, and as a string comparison otherwise
+func _compare(op string, a, b interface{}) bool {
+	if _isNum(a) && _isNum(b) {
+		// Integers compare exactly; as float64 those past 2^53 would be rounded
+		if i, ok := toNum(a).(int); ok {
+			if j, ok := toNum(b).(int); ok {
+				switch op {
+				case "==":
+					return i == j
+				case "!=":
+					return i != j
+				case "<":
+					return i < j
+				case ">":
+					return i > j
+				case "<=":
+					return i <= j
+				case ">=":
+					return i >= j
+				}
+			}
+		}
+		x, y := toFloat(a), toFloat(b)
+		switch op {
+		case "==":
+			return x == y
+		case "!=":
+			return x != y
+		case "<":
+			return x < y
+		case ">":
+			return x > y
+		case "<=":
+			return x <= y
+		case ">=":
+			return x >= y
+		}
+	}
+	s, t := _toStr(a), _toStr(b)
+	switch op {
+	case "==":
+		return s == t
+	case "!=":
+		return s != t
+	case "<":
+		return s < t
+	case ">":
+		return s > t
+	case "<=":
+		return s <= t
+	case ">=":
+		return s >= t
+	}
+	return false
+}
+
+// _min answers a if a <= b, compared as by _compare, and b otherwise
+func _min(a, b interface{}) interface{} {
+	if _compare("<=", a, b) {
+		return a
+	}
+	return b
+}
+
+// _max answers a if a >= b, compared as by _compare, and b otherwise
+func _max(a, b interface{}) interface{} {
+	if _compare(">=", a, b) {
+		return a
+	}
+	return b
+}
+
+// toBool converts interface{} to bool for predicates in iteration blocks
+func toBool(v interface{}) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case int:
+		return x != 0
+	case string:
+		return x != ""
+	case json.Number:
+		return toFloat(x) != 0
+	default:
+		return v != nil
+	}
+}
+
+// invokeBlock calls a Trashtalk block through the Bash runtime
+// blockID is the instance ID of the Block object
+// args are the values to pass to the block
+func invokeBlock(blockID string, args ...interface{}) string {
+	var cmdStr string
+	switch len(args) {
+	case 0:
+		cmdStr = fmt.Sprintf("source ~/.trashtalk/lib/trash.bash && @ %q value", blockID)
+	case 1:
+		cmdStr = fmt.Sprintf("source ~/.trashtalk/lib/trash.bash && @ %q valueWith: %q", blockID, fmt.Sprint(args[0]))
+	case 2:
+		cmdStr = fmt.Sprintf("source ~/.trashtalk/lib/trash.bash && @ %q valueWith: %q and: %q", blockID, fmt.Sprint(args[0]), fmt.Sprint(args[1]))
+	default:
+		return ""
+	}
+
+	defer suspendWork()()
+	cmd := exec.Command("bash", "-c", cmdStr)
+	output, _ := cmd.Output()
+	return strings.TrimSpace(string(output))
+}
+
+// TrashError is an error signaled by _throw
+type TrashError struct {
+	Class    string
+	Selector string
+	Message  string
+}
+
+func (e *TrashError) Error() string {
+	return e.Class + ": " + e.Message
+}
+
+// _throw signals class from selector, unwinding to the nearest on:do: handler
+func _throw(class, selector string, message interface{}) {
+	panic(&TrashError{
+		Class:    class,
+		Message:  _toStr(message),
+		Selector: selector,
+	})
+}
+
+// _catch returns the error recovered as r if a handler for class catches it,
+// and panics again otherwise. A handler for Error catches every TrashError.
+func _catch(r interface{}, class string) *TrashError {
+	te, ok := r.(*TrashError)
+	if !ok || (class != "Error" && te.Class != class) {
+		panic(r)
+	}
+	return te
+}
+
+// _recoverTrashError turns an unhandled _throw into the error dispatch returns
+func _recoverTrashError(err *error) {
+	if r := recover(); r != nil {
+		te, ok := r.(*TrashError)
+		if !ok {
+			panic(r)
+		}
+		*err = te
+	}
+}
+
+// _raiseSendError signals the error the receiver of a message ended it with:
+// its own TrashError for exit code 201, StorageBusy for 202 and Unauthorized for 203.
+// Other exit codes are answers, as in Bash.
+func _raiseSendError(selector string, code int, message string) {
+	class := ""
+	switch code {
+	case 201:
+		class = "Error"
+		if c, m, ok := strings.Cut(message, ": "); ok {
+			class, message = c, m
+		}
+	case 202:
+		class = "StorageBusy"
+	case 203:
+		class = "Unauthorized"
+	default:
+		return
+	}
+	panic(&TrashError{
+		Class:    class,
+		Message:  message,
+		Selector: selector,
+	})
+}
+
+func dispatch(c *Shape, instanceID string, selector string, args []string) (result string, err error) {
+	defer _recoverTrashError(&err)
+	switch selector {
+	case "class":
+		return "Shape", nil
+	case "id":
+		return instanceID, nil
+	case "delete":
+		return instanceID, nil
+	case "describe":
+		return c.Describe(), nil
+	case "area":
+		c.Area()
+		return "", nil
+	case "scaleBy_":
+		return "", &TrashError{
+			Class:    "NotImplemented",
+			Message:  "Shape>>scaleBy: is abstract; a subclass must implement it",
+			Selector: "scaleBy_",
+		}
+	case "printString":
+		return "<Shape " + instanceID + " name: " + c.Name + ">", nil
+	case "inspect":
+		return "Shape " + instanceID + "\n  name: " + c.Name, nil
+	case "asJSON":
+		data, err := json.Marshal(c)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case "copy":
+		id := generateInstanceID("Shape")
+		copied := *c
+		copied.CreatedAt = time.Now().Format(time.RFC3339)
+		copied.Version = 0
+		db, err := requestDB()
+		if err != nil {
+			return "", err
+		}
+		defer releaseDB(db)
+		if err := createInstance(db, id, &copied); err != nil {
+			return "", err
+		}
+		return id, nil
+	case "deepCopy":
+		id := generateInstanceID("Shape")
+		copied := *c
+		copied.CreatedAt = time.Now().Format(time.RFC3339)
+		copied.Version = 0
+		db, err := requestDB()
+		if err != nil {
+			return "", err
+		}
+		defer releaseDB(db)
+		if err := createInstance(db, id, &copied); err != nil {
+			return "", err
+		}
+		return id, nil
+	case "copyWith_value_":
+		if len(args) < 2 {
+			return "", fmt.Errorf("copyWith_value_ requires 2 arguments")
+		}
+		id := generateInstanceID("Shape")
+		copied := *c
+		copied.CreatedAt = time.Now().Format(time.RFC3339)
+		copied.Version = 0
+		switch args[0] {
+		case "name":
+			copied.Name = args[1]
+		default:
+			return "", fmt.Errorf("Shape has no instance variable %s", args[0])
+		}
+		db, err := requestDB()
+		if err != nil {
+			return "", err
+		}
+		defer releaseDB(db)
+		if err := createInstance(db, id, &copied); err != nil {
+			return "", err
+		}
+		return id, nil
+	case "respondsTo_":
+		if len(args) < 1 {
+			return "", fmt.Errorf("respondsTo_ requires 1 argument")
+		}
+		switch strings.ReplaceAll(args[0], ":", "_") {
+		case "area", "asJSON", "class", "copy", "copyWith_value_", "deepCopy", "delete", "describe", "id", "inspect", "printString", "respondsTo_", "scaleBy_", "selectors":
+			return "true", nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrUnknownSelector, "respondsTo_")
+	case "selectors":
+		return "area\nasJSON\nclass\ncopy\ncopyWith:value:\ndeepCopy\ndelete\ndescribe\nid\ninspect\nprintString\nrespondsTo:\nscaleBy:\nselectors", nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownSelector, selector)
+	}
+}
+
+func dispatchClass(selector string, args []string) (result string, err error) {
+	defer _recoverTrashError(&err)
+	switch selector {
+	case "new":
+		return "", &TrashError{
+			Class:    "AbstractClass",
+			Message:  "Shape is abstract; create an instance of a subclass",
+			Selector: "new",
+		}
+	case "allInstances":
+		return _queryIDs("SELECT id FROM instances WHERE json_extract(data, '$.class') = ? AND id NOT LIKE '%::class' ORDER BY json_extract(data, '$.created_at'), id", "Shape")
+	case "firstInstance":
+		return _queryIDs("SELECT id FROM instances WHERE json_extract(data, '$.class') = ? AND id NOT LIKE '%::class' ORDER BY json_extract(data, '$.created_at'), id LIMIT 1", "Shape")
+	case "instanceCount":
+		db, err := requestDB()
+		if err != nil {
+			return "", err
+		}
+		defer releaseDB(db)
+		var n int
+		if err := dbQueryRow(db, "SELECT COUNT(*) FROM instances WHERE json_extract(data, '$.class') = ? AND id NOT LIKE '%::class'", "Shape").Scan(&n); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(n), nil
+	case "instancesOf_":
+		if len(args) < 1 {
+			return "", fmt.Errorf("instancesOf_ requires 1 argument")
+		}
+		return _queryIDs("SELECT id FROM instances WHERE json_extract(data, '$.class') = ? AND id NOT LIKE '%::class' ORDER BY json_extract(data, '$.created_at'), id", strings.ReplaceAll(args[0], "__", "::"))
+	case "deleteAll":
+		db, err := requestDB()
+		if err != nil {
+			return "", err
+		}
+		defer releaseDB(db)
+		if _, err := dbExec(db, "DELETE FROM instances WHERE json_extract(data, '$.class') = ? AND id NOT LIKE '%::class'", "Shape"); err != nil {
+			return "", err
+		}
+		return "", nil
+	case "respondsTo_":
+		if len(args) < 1 {
+			return "", fmt.Errorf("respondsTo_ requires 1 argument")
+		}
+		switch strings.ReplaceAll(args[0], ":", "_") {
+		case "allInstances", "deleteAll", "firstInstance", "instanceCount", "instancesOf_", "new", "respondsTo_", "selectors":
+			return "true", nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrUnknownSelector, "respondsTo_")
+	case "selectors":
+		return "allInstances\ndeleteAll\nfirstInstance\ninstanceCount\ninstancesOf:\nnew\nrespondsTo:\nselectors", nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownSelector, selector)
+	}
+}
+
+func (c *Shape) Describe() string {
+	var a interface{}
+	a = func() string {
+		c.Area()
+		return ""
+	}()
+	return _toStr(_toStr(c.Name) + " has area " + _toStr(a))
+}
+
+func (c *Shape) Area() {}